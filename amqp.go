@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/bitwurx/jrpc2"
+	"github.com/streadway/amqp"
+)
+
+const AMQPReplyQueue = "amq.rabbitmq.reply-to" // the direct reply-to pseudo queue of rabbitmq.
+
+var (
+	AMQPClosedError     = errors.New("amqp channel closed")
+	AMQPUnroutableError = errors.New("amqp request unroutable")
+)
+
+// amqpChannel is the subset of an amqp channel used by the broker.
+type amqpChannel interface {
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Close() error
+}
+
+// amqpConnChannel is an amqp channel that closes its connection with it.
+type amqpConnChannel struct {
+	*amqp.Channel
+	conn *amqp.Connection
+}
+
+func (c *amqpConnChannel) Close() error {
+	c.Channel.Close()
+	return c.conn.Close()
+}
+
+// amqpReply is the reply to an amqp request.
+type amqpReply struct {
+	body []byte
+	err  error
+}
+
+// AMQPServiceBroker is a json-rpc 2.0 service broker that publishes each
+// call to the queue named by the host of the service and reads the
+// json-rpc response from the rabbitmq direct reply-to queue. All methods
+// are safe for concurrent use.
+type AMQPServiceBroker struct {
+	dial    func() (amqpChannel, error)
+	mu      sync.Mutex
+	ch      amqpChannel
+	seq     uint64
+	pending map[string]chan amqpReply
+}
+
+// NewAMQPServiceBroker creates a new broker that calls the services
+// through the amqp server at the url. The server is connected on the first
+// call, and again on the next call after the connection is lost.
+func NewAMQPServiceBroker(url string) *AMQPServiceBroker {
+	return newAMQPServiceBroker(func() (amqpChannel, error) {
+		conn, err := amqp.Dial(url)
+		if err != nil {
+			return nil, err
+		}
+		ch, err := conn.Channel()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return &amqpConnChannel{ch, conn}, nil
+	})
+}
+
+// newAMQPServiceBroker creates a new broker that opens its channel with
+// the dial function.
+func newAMQPServiceBroker(dial func() (amqpChannel, error)) *AMQPServiceBroker {
+	return &AMQPServiceBroker{dial: dial, pending: make(map[string]chan amqpReply)}
+}
+
+// Call initiates a remote call of the method with parameters to the
+// service consuming from the queue.
+//
+// Calls are retried like the calls of JsonRPCServiceBroker. A call fails
+// in transport if the server is unreachable, no queue is bound to the
+// routing key, or no reply is received within BrokerTimeout. The requests
+// that never reached a service are retried for every method.
+func (b *AMQPServiceBroker) Call(ctx context.Context, queue string, method string, params map[string]interface{}) (interface{}, *jrpc2.ErrorObject) {
+	req, errObj := jsonRPCRequest(ctx, queue, method, params)
+	if errObj != nil {
+		return nil, errObj
+	}
+	var data []byte
+	errObj = retryCall(ctx, queue, method, func() (err error) {
+		data, err = b.request(ctx, queue, req)
+		return err
+	})
+	if errObj != nil {
+		return nil, errObj
+	}
+	return jsonRPCResponse(ctx, queue, method, data)
+}
+
+// Close closes the channel of the broker. Pending calls fail in transport.
+func (b *AMQPServiceBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ch == nil {
+		return nil
+	}
+	err := b.ch.Close()
+	b.ch = nil
+	return err
+}
+
+// request publishes the request to the queue and waits for the reply.
+func (b *AMQPServiceBroker) request(ctx context.Context, queue string, req []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, BrokerTimeout)
+	defer cancel()
+
+	b.mu.Lock()
+	if b.ch == nil {
+		if err := b.connect(); err != nil {
+			b.mu.Unlock()
+			return nil, unsentError{err}
+		}
+	}
+	b.seq++
+	id := strconv.FormatUint(b.seq, 10)
+	reply := make(chan amqpReply, 1)
+	b.pending[id] = reply
+	ch := b.ch
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.pending, id)
+		b.mu.Unlock()
+	}()
+
+	var headers amqp.Table
+	if cid := CorrelationId(ctx); cid != "" {
+		headers = amqp.Table{CorrelationHeader: cid}
+	}
+	err := ch.Publish("", queue, true, false, amqp.Publishing{
+		Headers:       headers,
+		ContentType:   "application/json",
+		CorrelationId: id,
+		ReplyTo:       AMQPReplyQueue,
+		Expiration:    strconv.FormatInt(BrokerTimeout.Milliseconds(), 10),
+		Body:          req,
+	})
+	if err != nil {
+		return nil, unsentError{err}
+	}
+	select {
+	case r := <-reply:
+		return r.body, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// connect opens the channel and starts consuming the replies. It must be
+// called with the lock held.
+func (b *AMQPServiceBroker) connect() error {
+	ch, err := b.dial()
+	if err != nil {
+		return err
+	}
+	deliveries, err := ch.Consume(AMQPReplyQueue, "", true, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return err
+	}
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+	b.ch = ch
+	go b.dispatch(ch, deliveries, returns)
+	return nil
+}
+
+// dispatch passes the replies and the returned unroutable requests of the
+// channel to the pending calls until the channel is closed.
+func (b *AMQPServiceBroker) dispatch(ch amqpChannel, deliveries <-chan amqp.Delivery, returns chan amqp.Return) {
+	for {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				b.closed(ch)
+				return
+			}
+			b.reply(d.CorrelationId, amqpReply{body: d.Body})
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			b.reply(r.CorrelationId, amqpReply{err: unsentError{fmt.Errorf("%v: %s", AMQPUnroutableError, r.ReplyText)}})
+		}
+	}
+}
+
+// reply passes the reply to the pending call with the correlation id.
+func (b *AMQPServiceBroker) reply(id string, r amqpReply) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if reply, ok := b.pending[id]; ok {
+		reply <- r
+		delete(b.pending, id)
+	}
+}
+
+// closed fails the pending calls of the closed channel and makes the next
+// call open a new channel.
+func (b *AMQPServiceBroker) closed(ch amqpChannel) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ch != nil && b.ch != ch {
+		return
+	}
+	b.ch = nil
+	for id, reply := range b.pending {
+		reply <- amqpReply{err: AMQPClosedError}
+		delete(b.pending, id)
+	}
+}
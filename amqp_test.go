@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitwurx/jrpc2"
+	"github.com/streadway/amqp"
+)
+
+// stubAMQPChannel is an amqp channel that answers the requests published
+// to its queues with the reply, and returns the requests to other queues.
+type stubAMQPChannel struct {
+	queues     map[string]bool
+	reply      string
+	mu         sync.Mutex
+	deliveries chan amqp.Delivery
+	returns    chan amqp.Return
+	published  []amqp.Publishing
+}
+
+func newStubAMQPChannel(reply string, queues ...string) *stubAMQPChannel {
+	ch := &stubAMQPChannel{queues: make(map[string]bool), reply: reply, deliveries: make(chan amqp.Delivery, 10)}
+	for _, queue := range queues {
+		ch.queues[queue] = true
+	}
+	return ch
+}
+
+func (ch *stubAMQPChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	return ch.deliveries, nil
+}
+
+func (ch *stubAMQPChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	ch.returns = c
+	return c
+}
+
+func (ch *stubAMQPChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ch.mu.Lock()
+	ch.published = append(ch.published, msg)
+	ch.mu.Unlock()
+	if !ch.queues[key] {
+		ch.returns <- amqp.Return{ReplyText: "NO_ROUTE", RoutingKey: key, CorrelationId: msg.CorrelationId}
+		return nil
+	}
+	if ch.reply != "" {
+		ch.deliveries <- amqp.Delivery{CorrelationId: msg.CorrelationId, Body: []byte(ch.reply)}
+	}
+	return nil
+}
+
+func (ch *stubAMQPChannel) Close() error {
+	close(ch.deliveries)
+	return nil
+}
+
+func TestAMQPServiceBrokerCall(t *testing.T) {
+	defer func(n int, d time.Duration) { BrokerRetries, BrokerTimeout = n, d }(BrokerRetries, BrokerTimeout)
+	BrokerRetries, BrokerTimeout = 0, time.Millisecond*50
+
+	var table = []struct {
+		Reply  string
+		Queue  string
+		Result interface{}
+		Code   jrpc2.ErrorCode
+		Data   string
+	}{
+		{`{"jsonrpc": "2.0", "result": 0, "id": 0}`, "concord-priority-queue", float64(0), 0, ""},
+		{`{"jsonrpc": "2.0", "error": {"code": -32602, "message": "Invalid params"}, "id": 0}`, "concord-priority-queue", nil, jrpc2.InvalidParamsCode, ""},
+		{`{"jsonrpc": "2.0", "result": 0, "id": 0}`, "concord-timetable", nil, BrokerCallErrorCode, "amqp request unroutable: NO_ROUTE (attempts 1)"},
+		{"", "concord-priority-queue", nil, BrokerCallErrorCode, "context deadline exceeded (attempts 1)"},
+	}
+
+	for i, tt := range table {
+		ch := newStubAMQPChannel(tt.Reply, "concord-priority-queue")
+		broker := newAMQPServiceBroker(func() (amqpChannel, error) { return ch, nil })
+		result, errObj := broker.Call(context.Background(), tt.Queue, "push", map[string]interface{}{"key": "test"})
+		if fmt.Sprint(result) != fmt.Sprint(tt.Result) {
+			t.Fatalf("[%d] expected result %v, got %v", i, tt.Result, result)
+		}
+		if (errObj != nil) != (tt.Code != 0) || (errObj != nil && errObj.Code != tt.Code) {
+			t.Fatalf("[%d] expected error code %d, got %v", i, tt.Code, errObj)
+		}
+		if tt.Data != "" && errObj.Data != tt.Data {
+			t.Fatalf("[%d] expected error data '%s', got '%v'", i, tt.Data, errObj.Data)
+		}
+		msg := ch.published[0]
+		var req struct {
+			Method string `json:"method"`
+		}
+		json.Unmarshal(msg.Body, &req)
+		if msg.ReplyTo != AMQPReplyQueue || msg.CorrelationId == "" || req.Method != "push" {
+			t.Fatalf("[%d] expected a push request with a reply-to queue, got %+v", i, msg)
+		}
+		if len(broker.pending) != 0 {
+			t.Fatalf("[%d] expected no pending calls, got %d", i, len(broker.pending))
+		}
+		broker.Close()
+	}
+}
+
+func TestAMQPServiceBrokerReconnect(t *testing.T) {
+	defer func(n int, d time.Duration) { BrokerRetries, BrokerBackoff = n, d }(BrokerRetries, BrokerBackoff)
+	BrokerRetries, BrokerBackoff = 1, time.Millisecond
+
+	dials := 0
+	var ch *stubAMQPChannel
+	broker := newAMQPServiceBroker(func() (amqpChannel, error) {
+		dials++
+		if dials == 1 {
+			return nil, errors.New("connection refused")
+		}
+		ch = newStubAMQPChannel(`{"jsonrpc": "2.0", "result": 0, "id": 0}`, "concord-priority-queue")
+		return ch, nil
+	})
+	if _, errObj := broker.Call(context.Background(), "concord-priority-queue", "push", nil); errObj != nil {
+		t.Fatal(errObj)
+	}
+	if dials != 2 {
+		t.Fatalf("expected the failed dial to be retried, got %d dials", dials)
+	}
+
+	first := ch
+	first.Close()
+	for i := 0; i < 100; i++ {
+		broker.mu.Lock()
+		open := broker.ch != nil
+		broker.mu.Unlock()
+		if !open {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, errObj := broker.Call(context.Background(), "concord-priority-queue", "push", nil); errObj != nil {
+		t.Fatal(errObj)
+	}
+	if dials != 3 || ch == first {
+		t.Fatalf("expected a new channel after the channel was closed, got %d dials", dials)
+	}
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/bitwurx/jrpc2"
 )
@@ -19,6 +25,43 @@ const (
 	NotificationFailedErrorCode jrpc2.ErrorCode = -32009
 	RemoveTaskErrorCode         jrpc2.ErrorCode = -32010
 	StartTaskErrorCode          jrpc2.ErrorCode = -32011
+	ListTasksErrorCode          jrpc2.ErrorCode = -32012
+	ListResourcesErrorCode      jrpc2.ErrorCode = -32013
+	RemoveResourceErrorCode     jrpc2.ErrorCode = -32014
+	UpdateTaskPriorityErrorCode jrpc2.ErrorCode = -32015
+	RescheduleTaskErrorCode     jrpc2.ErrorCode = -32016
+	GetResourceErrorCode        jrpc2.ErrorCode = -32017
+	PauseResourceErrorCode      jrpc2.ErrorCode = -32018
+	ResumeResourceErrorCode     jrpc2.ErrorCode = -32019
+	RetryTaskErrorCode          jrpc2.ErrorCode = -32020
+	GetTaskHistoryErrorCode     jrpc2.ErrorCode = -32021
+	GetTaskStatsErrorCode       jrpc2.ErrorCode = -32022
+	PurgeTasksErrorCode         jrpc2.ErrorCode = -32023
+	SearchTasksErrorCode        jrpc2.ErrorCode = -32024
+	GetStagedTaskErrorCode      jrpc2.ErrorCode = -32025
+	UnstageTaskErrorCode        jrpc2.ErrorCode = -32026
+	ForceCompleteTaskErrorCode  jrpc2.ErrorCode = -32027
+	UnauthorizedErrorCode       jrpc2.ErrorCode = -32028
+	CountTasksErrorCode         jrpc2.ErrorCode = -32029
+	GetGroupStatusErrorCode     jrpc2.ErrorCode = -32030
+	HeartbeatErrorCode          jrpc2.ErrorCode = -32031
+	AppendTaskLogErrorCode      jrpc2.ErrorCode = -32032
+	GetTaskLogErrorCode         jrpc2.ErrorCode = -32033
+	RestoreTaskErrorCode        jrpc2.ErrorCode = -32034
+	AcknowledgePreemptErrorCode jrpc2.ErrorCode = -32035
+	EstimateStartErrorCode      jrpc2.ErrorCode = -32036
+	PauseTaskErrorCode          jrpc2.ErrorCode = -32037
+	ResumeTaskErrorCode         jrpc2.ErrorCode = -32038
+	ResourceHeartbeatErrorCode  jrpc2.ErrorCode = -32039
+	GetResourceStatsErrorCode   jrpc2.ErrorCode = -32050
+	SetResourceWeightErrorCode  jrpc2.ErrorCode = -32051
+	SetResourceQuotaErrorCode   jrpc2.ErrorCode = -32052
+	RegisterResourceErrorCode   jrpc2.ErrorCode = -32053
+	SetResourceParentErrorCode  jrpc2.ErrorCode = -32054
+	ListStagedTasksErrorCode    jrpc2.ErrorCode = -32055
+	AtCapacityErrorCode         jrpc2.ErrorCode = -32057
+	ListFailedEventsErrorCode   jrpc2.ErrorCode = -32058
+	StorageUnavailableErrorCode jrpc2.ErrorCode = -32059
 )
 
 const (
@@ -31,23 +74,130 @@ const (
 	NotificationFailedErrorMsg jrpc2.ErrorMsg = "error sending notification"
 	RemoveTaskErrorMsg         jrpc2.ErrorMsg = "error removing task"
 	StartTaskErrorMsg          jrpc2.ErrorMsg = "error starting task"
+	ListTasksErrorMsg          jrpc2.ErrorMsg = "error listing tasks"
+	ListResourcesErrorMsg      jrpc2.ErrorMsg = "error listing resources"
+	RemoveResourceErrorMsg     jrpc2.ErrorMsg = "error removing resource"
+	UpdateTaskPriorityErrorMsg jrpc2.ErrorMsg = "error updating task priority"
+	RescheduleTaskErrorMsg     jrpc2.ErrorMsg = "error rescheduling task"
+	GetResourceErrorMsg        jrpc2.ErrorMsg = "error getting resource"
+	PauseResourceErrorMsg      jrpc2.ErrorMsg = "error pausing resource"
+	ResumeResourceErrorMsg     jrpc2.ErrorMsg = "error resuming resource"
+	RetryTaskErrorMsg          jrpc2.ErrorMsg = "error retrying task"
+	GetTaskHistoryErrorMsg     jrpc2.ErrorMsg = "error getting task history"
+	GetTaskStatsErrorMsg       jrpc2.ErrorMsg = "error getting task stats"
+	PurgeTasksErrorMsg         jrpc2.ErrorMsg = "error purging tasks"
+	SearchTasksErrorMsg        jrpc2.ErrorMsg = "error searching tasks"
+	GetStagedTaskErrorMsg      jrpc2.ErrorMsg = "error getting staged task"
+	UnstageTaskErrorMsg        jrpc2.ErrorMsg = "error unstaging task"
+	ForceCompleteTaskErrorMsg  jrpc2.ErrorMsg = "error force completing task"
+	UnauthorizedErrorMsg       jrpc2.ErrorMsg = "unauthorized"
+	CountTasksErrorMsg         jrpc2.ErrorMsg = "error counting tasks"
+	GetGroupStatusErrorMsg     jrpc2.ErrorMsg = "error getting group status"
+	HeartbeatErrorMsg          jrpc2.ErrorMsg = "error renewing task lease"
+	AppendTaskLogErrorMsg      jrpc2.ErrorMsg = "error appending task log"
+	GetTaskLogErrorMsg         jrpc2.ErrorMsg = "error getting task log"
+	RestoreTaskErrorMsg        jrpc2.ErrorMsg = "error restoring task"
+	AcknowledgePreemptErrorMsg jrpc2.ErrorMsg = "error acknowledging preemption"
+	EstimateStartErrorMsg      jrpc2.ErrorMsg = "error estimating task start"
+	PauseTaskErrorMsg          jrpc2.ErrorMsg = "error pausing task"
+	ResumeTaskErrorMsg         jrpc2.ErrorMsg = "error resuming task"
+	ResourceHeartbeatErrorMsg  jrpc2.ErrorMsg = "error recording resource heartbeat"
+	GetResourceStatsErrorMsg   jrpc2.ErrorMsg = "error getting resource stats"
+	SetResourceWeightErrorMsg  jrpc2.ErrorMsg = "error setting resource weight"
+	SetResourceQuotaErrorMsg   jrpc2.ErrorMsg = "error setting resource quota"
+	RegisterResourceErrorMsg   jrpc2.ErrorMsg = "error registering resource"
+	SetResourceParentErrorMsg  jrpc2.ErrorMsg = "error setting resource parent"
+	ListStagedTasksErrorMsg    jrpc2.ErrorMsg = "error listing staged tasks"
+	AtCapacityErrorMsg         jrpc2.ErrorMsg = "controller at capacity"
+	ListFailedEventsErrorMsg   jrpc2.ErrorMsg = "error listing failed events"
+	StorageUnavailableErrorMsg jrpc2.ErrorMsg = "storage unavailable"
 )
 
+const (
+	DefaultListLimit = 100   // the default number of items returned by list methods.
+	MaxListLimit     = 1000  // the maximum number of items returned by list methods.
+	MaxLabels        = 16    // the maximum number of labels, constraints or tags.
+	MaxLabelLength   = 63    // the maximum length of a label, constraint or tag key or value.
+	MaxTaskLogLength = 65536 // the maximum length of an appended task log snippet.
+	MaxStatWindows   = 10    // the maximum number of resource stat windows.
+	MaxCapacity      = 64    // the maximum capacity of a registered resource.
+)
+
+var DefaultStatWindows = []time.Duration{time.Hour, time.Hour * 24} // the default resource stat windows.
+
+var groupIdPattern = regexp.MustCompile(`^[A-Za-z0-9_:.-]{1,254}$`) // the valid task group id format.
+
 type ApiV1 struct {
 	models map[string]Model
 	ctrl   Controller
 }
 
+type AcknowledgePreemptionParams struct {
+	Id *string `json:"id"`
+}
+
+func (params *AcknowledgePreemptionParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("id parameter is required")
+	}
+	id, ok := args[0].(string)
+	if !ok {
+		return errors.New("id must be a string")
+	}
+	params.Id = &id
+
+	return nil
+}
+
+func (api *ApiV1) AcknowledgePreemption(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(AcknowledgePreemptionParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Id == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "id is required",
+		}
+	}
+	if err := api.ctrl.AcknowledgePreemption(*p.Id, api.models["tasks"], api.models["resources"]); err != nil {
+		return nil, errorObject(AcknowledgePreemptErrorCode, AcknowledgePreemptErrorMsg, err)
+	}
+	return 0, nil
+}
+
 type AddResourceParams struct {
-	Name *string `json:"name"`
+	Name   *string            `json:"name"`
+	Pool   *string            `json:"pool,omitempty"`
+	Tags   *map[string]string `json:"tags,omitempty"`
+	Weight *float64           `json:"weight,omitempty"`
 }
 
 func (params *AddResourceParams) FromPositional(args []interface{}) error {
-	if len(args) != 1 {
+	if len(args) < 1 {
 		return errors.New("name parameter is required")
 	}
 	name := args[0].(string)
 	params.Name = &name
+	if len(args) > 1 {
+		pool, ok := args[1].(string)
+		if !ok {
+			return errors.New("pool must be a string")
+		}
+		params.Pool = &pool
+	}
+	if len(args) > 2 {
+		tags := make(map[string]string)
+		for k, v := range args[2].(map[string]interface{}) {
+			tags[k] = v.(string)
+		}
+		params.Tags = &tags
+	}
+	if len(args) > 3 {
+		weight := args[3].(float64)
+		params.Weight = &weight
+	}
 
 	return nil
 }
@@ -64,21 +214,47 @@ func (api *ApiV1) AddResource(params json.RawMessage) (interface{}, *jrpc2.Error
 			Data:    "name is required",
 		}
 	}
-	if err := api.ctrl.AddResource(*p.Name, api.models["resources"]); err != nil {
-		return nil, &jrpc2.ErrorObject{
-			Code:    AddResourceErrorCode,
-			Message: AddResourceErrorMsg,
-			Data:    err.Error(),
+	var pool string
+	var tags map[string]string
+	var weight float64
+	if p.Pool != nil {
+		pool = *p.Pool
+	}
+	if p.Tags != nil {
+		if err := validatePairs("tag", *p.Tags); err != nil {
+			return nil, &jrpc2.ErrorObject{
+				Code:    jrpc2.InvalidParamsCode,
+				Message: jrpc2.InvalidParamsMsg,
+				Data:    err.Error(),
+			}
 		}
+		tags = *p.Tags
+	}
+	if p.Weight != nil {
+		weight = *p.Weight
+	}
+	if err := api.ctrl.AddResource(*p.Name, pool, tags, weight, api.models["resources"]); err != nil {
+		return nil, errorObject(AddResourceErrorCode, AddResourceErrorMsg, err)
 	}
 	return 0, nil
 }
 
 type AddTaskParams struct {
-	Key      *string                 `json:"key"`
-	Meta     *map[string]interface{} `json:"meta"`
-	Priority *float64                `json:"priority"`
-	RunAt    *string                 `json:"runAt"`
+	Key          *string                 `json:"key"`
+	Meta         *map[string]interface{} `json:"meta"`
+	Priority     *float64                `json:"priority"`
+	RunAt        *string                 `json:"runAt"`
+	MaxAttempts  *int                    `json:"maxAttempts,omitempty"`
+	Backoff      *float64                `json:"backoff,omitempty"`
+	DependsOn    *[]string               `json:"dependsOn,omitempty"`
+	ExpiresAt    *string                 `json:"expiresAt,omitempty"`
+	Labels       *map[string]string      `json:"labels,omitempty"`
+	GroupId      *string                 `json:"groupId,omitempty"`
+	ParentId     *string                 `json:"parentId,omitempty"`
+	RunAfter     *string                 `json:"runAfter,omitempty"`
+	CallbackUrl  *string                 `json:"callbackUrl,omitempty"`
+	Constraints  *map[string]string      `json:"constraints,omitempty"`
+	ValidateOnly *bool                   `json:"validateOnly,omitempty"`
 }
 
 func (params *AddTaskParams) FromPositional(args []interface{}) error {
@@ -93,7 +269,89 @@ func (params *AddTaskParams) FromPositional(args []interface{}) error {
 	params.Meta = &meta
 	params.Priority = &priority
 	params.RunAt = &runAt
+	if len(args) > 4 {
+		maxAttempts := int(args[4].(float64))
+		params.MaxAttempts = &maxAttempts
+	}
+	if len(args) > 5 {
+		backoff := args[5].(float64)
+		params.Backoff = &backoff
+	}
+	if len(args) > 6 {
+		dependsOn := make([]string, 0)
+		for _, id := range args[6].([]interface{}) {
+			dependsOn = append(dependsOn, id.(string))
+		}
+		params.DependsOn = &dependsOn
+	}
+	if len(args) > 7 {
+		expiresAt := args[7].(string)
+		params.ExpiresAt = &expiresAt
+	}
+	if len(args) > 8 {
+		labels := make(map[string]string)
+		for k, v := range args[8].(map[string]interface{}) {
+			labels[k] = v.(string)
+		}
+		params.Labels = &labels
+	}
+	if len(args) > 9 {
+		groupId := args[9].(string)
+		params.GroupId = &groupId
+	}
+	if len(args) > 10 {
+		parentId := args[10].(string)
+		params.ParentId = &parentId
+	}
+	if len(args) > 11 {
+		runAfter := args[11].(string)
+		params.RunAfter = &runAfter
+	}
+	if len(args) > 12 {
+		callbackUrl := args[12].(string)
+		params.CallbackUrl = &callbackUrl
+	}
+	if len(args) > 13 {
+		constraints := make(map[string]string)
+		for k, v := range args[13].(map[string]interface{}) {
+			constraints[k] = v.(string)
+		}
+		params.Constraints = &constraints
+	}
+	if len(args) > 14 {
+		validateOnly := args[14].(bool)
+		params.ValidateOnly = &validateOnly
+	}
+
+	return nil
+}
 
+// validateMeta returns an error if the task meta does not match the
+// TaskMetaSchema.
+func (params *AddTaskParams) validateMeta() error {
+	var meta map[string]interface{}
+	if params.Meta != nil {
+		meta = *params.Meta
+	}
+	return TaskMetaSchema.Validate(meta)
+}
+
+// resolveRunAfter sets the run at time of the params to the current time
+// plus the run after duration.
+func (params *AddTaskParams) resolveRunAfter() error {
+	if params.RunAfter == nil {
+		return nil
+	}
+	if params.RunAt != nil && *params.RunAt != "" {
+		return errors.New("runAt and runAfter are mutually exclusive")
+	}
+	runAfter, err := time.ParseDuration(*params.RunAfter)
+	if err != nil || runAfter < 0 {
+		return errors.New("runAfter must be a non-negative duration (e.g. 15m)")
+	}
+	runAt := time.Now().Add(runAfter).Format(time.RFC3339Nano)
+	params.RunAt = &runAt
+	params.RunAfter = nil
 	return nil
 }
 
@@ -109,35 +367,140 @@ func (api *ApiV1) AddTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObje
 			Data:    "key is required",
 		}
 	}
-	if p.Priority == nil && p.RunAt == nil {
+	if p.Priority == nil && p.RunAt == nil && p.RunAfter == nil {
 		return nil, &jrpc2.ErrorObject{
 			Code:    jrpc2.InvalidParamsCode,
 			Message: jrpc2.InvalidParamsMsg,
-			Data:    "priority or runAt is required",
+			Data:    "priority, runAt or runAfter is required",
 		}
 	}
-	data, _ := json.Marshal(p)
-	task := NewTask(data)
-	if err := api.ctrl.AddTask(task, api.models["tasks"], api.models["resources"]); err != nil {
+	if err := p.resolveRunAfter(); err != nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    err.Error(),
+		}
+	}
+	// runAt, priority and meta are checked for regular requests too, not
+	// only with validateOnly, so that a task that passes validation is
+	// also added.
+	if p.RunAt != nil && *p.RunAt != "" {
+		if _, err := time.Parse(time.RFC3339, *p.RunAt); err != nil {
+			return nil, &jrpc2.ErrorObject{
+				Code:    jrpc2.InvalidParamsCode,
+				Message: jrpc2.InvalidParamsMsg,
+				Data:    "runAt must be an RFC3339 date/time",
+			}
+		}
+	}
+	if p.Priority != nil && *p.Priority < 0 {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "priority must not be negative",
+		}
+	}
+	if err := p.validateMeta(); err != nil {
 		return nil, &jrpc2.ErrorObject{
-			Code:    AddTaskErrorCode,
-			Message: AddTaskErrorMsg,
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
 			Data:    err.Error(),
 		}
 	}
+	if p.MaxAttempts != nil && *p.MaxAttempts < 0 {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "maxAttempts must not be negative",
+		}
+	}
+	if p.Backoff != nil && *p.Backoff < 0 {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "backoff must not be negative",
+		}
+	}
+	if p.ExpiresAt != nil {
+		if _, err := time.Parse(time.RFC3339, *p.ExpiresAt); err != nil {
+			return nil, &jrpc2.ErrorObject{
+				Code:    jrpc2.InvalidParamsCode,
+				Message: jrpc2.InvalidParamsMsg,
+				Data:    "expiresAt must be an RFC3339 date/time",
+			}
+		}
+	}
+	if p.Labels != nil {
+		if err := validatePairs("label", *p.Labels); err != nil {
+			return nil, &jrpc2.ErrorObject{
+				Code:    jrpc2.InvalidParamsCode,
+				Message: jrpc2.InvalidParamsMsg,
+				Data:    err.Error(),
+			}
+		}
+	}
+	if p.GroupId != nil && !groupIdPattern.MatchString(*p.GroupId) {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "groupId must be 1 to 254 letters, digits, '_', '-', ':' or '.'",
+		}
+	}
+	if p.CallbackUrl != nil {
+		if err := validateCallbackUrl(*p.CallbackUrl); err != nil {
+			return nil, &jrpc2.ErrorObject{
+				Code:    jrpc2.InvalidParamsCode,
+				Message: jrpc2.InvalidParamsMsg,
+				Data:    err.Error(),
+			}
+		}
+	}
+	if p.Constraints != nil {
+		if err := validatePairs("constraint", *p.Constraints); err != nil {
+			return nil, &jrpc2.ErrorObject{
+				Code:    jrpc2.InvalidParamsCode,
+				Message: jrpc2.InvalidParamsMsg,
+				Data:    err.Error(),
+			}
+		}
+	}
+	data, _ := json.Marshal(p)
+	task := NewTask(data)
+	if p.ValidateOnly != nil && *p.ValidateOnly {
+		validation, err := api.ctrl.ValidateTask(task, api.models["tasks"])
+		if err != nil {
+			return nil, errorObject(AddTaskErrorCode, AddTaskErrorMsg, err)
+		}
+		return validation, nil
+	}
+	if err := api.ctrl.AddTask(task, api.models["tasks"], api.models["resources"]); err != nil {
+		return nil, errorObject(AddTaskErrorCode, AddTaskErrorMsg, err)
+	}
 	return task.Id, nil
 }
 
+func (api *ApiV1) ServerInfo(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	return api.ctrl.ServerInfo(), nil
+}
+
 type StartTaskParams struct {
-	Key *string `json:"key"`
+	Key      *string `json:"key"`
+	WorkerId *string `json:"workerId,omitempty"`
 }
 
 func (params *StartTaskParams) FromPositional(args []interface{}) error {
-	if len(args) != 1 {
+	if len(args) < 1 || len(args) > 2 {
 		return errors.New("key parameter is required")
 	}
 	key := args[0].(string)
 	params.Key = &key
+	if len(args) > 1 {
+		workerId, ok := args[1].(string)
+		if !ok {
+			return errors.New("workerId must be a string")
+		}
+		params.WorkerId = &workerId
+	}
 
 	return nil
 }
@@ -154,35 +517,45 @@ func (api *ApiV1) StartTask(params json.RawMessage) (interface{}, *jrpc2.ErrorOb
 			Data:    "key is required",
 		}
 	}
-	if err := api.ctrl.StartTask(*p.Key, api.models["tasks"], api.models["resources"]); err != nil {
-		return -1, &jrpc2.ErrorObject{
-			Code:    StartTaskErrorCode,
-			Message: StartTaskErrorMsg,
-			Data:    err.Error(),
+	var workerId string
+	if p.WorkerId != nil {
+		workerId = *p.WorkerId
+	}
+	if err := api.ctrl.StartTask(*p.Key, workerId, api.models["tasks"], api.models["resources"]); err != nil {
+		if err == AtCapacityError {
+			return -1, errorObject(AtCapacityErrorCode, AtCapacityErrorMsg, err)
 		}
+		return -1, errorObject(StartTaskErrorCode, StartTaskErrorMsg, err)
 	}
 	return 0, nil
 }
 
-type CompleteTaskParams struct {
+type AppendTaskLogParams struct {
 	Id     *string `json:"id"`
-	Status *string `json:"status"`
+	Data   *string `json:"data"`
+	Stream *string `json:"stream,omitempty"`
 }
 
-func (params *CompleteTaskParams) FromPositional(args []interface{}) error {
-	if len(args) != 2 {
-		return errors.New("id, status parameters are required")
+func (params *AppendTaskLogParams) FromPositional(args []interface{}) error {
+	if len(args) < 2 || len(args) > 3 {
+		return errors.New("id and data parameters are required")
 	}
 	id := args[0].(string)
-	status := args[1].(string)
+	data := args[1].(string)
 	params.Id = &id
-	params.Status = &status
+	params.Data = &data
+	if len(args) > 2 {
+		stream := args[2].(string)
+		params.Stream = &stream
+	}
 
 	return nil
 }
 
-func (api *ApiV1) CompleteTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
-	p := new(CompleteTaskParams)
+func (api *ApiV1) AppendTaskLog(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	stream := "stdout"
+
+	p := new(AppendTaskLogParams)
 	if err := jrpc2.ParseParams(params, p); err != nil {
 		return nil, err
 	}
@@ -193,39 +566,83 @@ func (api *ApiV1) CompleteTask(params json.RawMessage) (interface{}, *jrpc2.Erro
 			Data:    "id is required",
 		}
 	}
-	if p.Status == nil {
+	if p.Data == nil {
 		return nil, &jrpc2.ErrorObject{
 			Code:    jrpc2.InvalidParamsCode,
 			Message: jrpc2.InvalidParamsMsg,
-			Data:    "status is required",
+			Data:    "data is required",
 		}
 	}
-	if err := api.ctrl.CompleteTask(*p.Id, *p.Status, api.models["tasks"], api.models["resources"]); err != nil {
+	if len(*p.Data) > MaxTaskLogLength {
 		return nil, &jrpc2.ErrorObject{
-			Code:    CompleteTaskErrorCode,
-			Message: CompleteTaskErrorMsg,
-			Data:    err.Error(),
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    fmt.Sprintf("data must be at most %d bytes", MaxTaskLogLength),
+		}
+	}
+	if p.Stream != nil {
+		stream = *p.Stream
+	}
+	if stream != "stdout" && stream != "stderr" {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "stream must be stdout or stderr",
 		}
 	}
+	if err := api.ctrl.AppendTaskLog(*p.Id, stream, *p.Data, api.models["tasks"], api.models["taskLogs"]); err != nil {
+		return nil, errorObject(AppendTaskLogErrorCode, AppendTaskLogErrorMsg, err)
+	}
 	return 0, nil
 }
 
-type GetTaskParams struct {
-	Id *string `json:"id"`
+type CompleteTaskParams struct {
+	Id      *string          `json:"id"`
+	Status  *string          `json:"status"`
+	Result  *json.RawMessage `json:"result,omitempty"`
+	Error   *string          `json:"error,omitempty"`
+	Cascade *bool            `json:"cascade,omitempty"`
 }
 
-func (params *GetTaskParams) FromPositional(args []interface{}) error {
-	if len(args) != 1 {
-		return errors.New("id parameter is required")
+func (params *CompleteTaskParams) FromPositional(args []interface{}) error {
+	if len(args) < 2 || len(args) > 5 {
+		return errors.New("id, status parameters are required")
+	}
+	id, ok := args[0].(string)
+	if !ok {
+		return errors.New("id must be a string")
+	}
+	status, ok := args[1].(string)
+	if !ok {
+		return errors.New("status must be a string")
 	}
-	id := args[0].(string)
 	params.Id = &id
+	params.Status = &status
+	if len(args) > 2 {
+		data, _ := json.Marshal(args[2])
+		result := json.RawMessage(data)
+		params.Result = &result
+	}
+	if len(args) > 3 {
+		reason, ok := args[3].(string)
+		if !ok {
+			return errors.New("error must be a string")
+		}
+		params.Error = &reason
+	}
+	if len(args) > 4 {
+		cascade, ok := args[4].(bool)
+		if !ok {
+			return errors.New("cascade must be a boolean")
+		}
+		params.Cascade = &cascade
+	}
 
 	return nil
 }
 
-func (api *ApiV1) GetTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
-	p := new(GetTaskParams)
+func (api *ApiV1) CompleteTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(CompleteTaskParams)
 	if err := jrpc2.ParseParams(params, p); err != nil {
 		return nil, err
 	}
@@ -236,110 +653,136 @@ func (api *ApiV1) GetTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObje
 			Data:    "id is required",
 		}
 	}
-	task, err := api.ctrl.GetTask(*p.Id, api.models["tasks"])
-	if err != nil {
+	if p.Status == nil {
 		return nil, &jrpc2.ErrorObject{
-			Code:    GetTaskErrorCode,
-			Message: GetTaskErrorMsg,
-			Data:    err.Error(),
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "status is required",
 		}
 	}
-	return task, nil
+	var result json.RawMessage
+	var reason string
+	if p.Result != nil {
+		result = *p.Result
+	}
+	if p.Error != nil {
+		reason = *p.Error
+	}
+	cascade := p.Cascade != nil && *p.Cascade
+	if err := api.ctrl.CompleteTask(*p.Id, *p.Status, result, reason, cascade, api.models["tasks"], api.models["resources"]); err != nil {
+		return nil, errorObject(CompleteTaskErrorCode, CompleteTaskErrorMsg, err)
+	}
+	return 0, nil
 }
 
-type ListPriorityQueueParams struct {
-	Key *string `json:"key"`
+type CountTasksParams struct {
+	ByKey *bool `json:"byKey"`
 }
 
-func (params *ListPriorityQueueParams) FromPositional(args []interface{}) error {
-	if len(args) != 1 {
-		return errors.New("key parameter is required")
+func (params *CountTasksParams) FromPositional(args []interface{}) error {
+	if len(args) > 1 {
+		return errors.New("only the byKey parameter is accepted")
+	}
+	if len(args) > 0 {
+		byKey := args[0].(bool)
+		params.ByKey = &byKey
 	}
-	key := args[0].(string)
-	params.Key = &key
 
 	return nil
 }
 
-func (api *ApiV1) ListPriorityQueue(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
-	p := new(ListPriorityQueueParams)
+func (api *ApiV1) CountTasks(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	var byKey bool
+
+	p := new(CountTasksParams)
 	if err := jrpc2.ParseParams(params, p); err != nil {
 		return nil, err
 	}
-	if p.Key == nil {
-		return nil, &jrpc2.ErrorObject{
-			Code:    jrpc2.InvalidParamsCode,
-			Message: jrpc2.InvalidParamsMsg,
-			Data:    "key is required",
-		}
+	if p.ByKey != nil {
+		byKey = *p.ByKey
 	}
-	queue, err := api.ctrl.ListPriorityQueue(*p.Key)
+	counts, err := api.ctrl.CountTasks(byKey, api.models["taskCounts"])
 	if err != nil {
-		return nil, &jrpc2.ErrorObject{
-			Code:    ListPriorityQueueErrorCode,
-			Message: ListPriorityQueueErrorMsg,
-			Data:    err.Error(),
-		}
+		return nil, errorObject(CountTasksErrorCode, CountTasksErrorMsg, err)
 	}
-	return queue, nil
+	return counts, nil
 }
 
-type ListTimetableParams struct {
-	Key *string `json:"key"`
+type EstimateStartParams struct {
+	Id *string `json:"id"`
 }
 
-func (params *ListTimetableParams) FromPositional(args []interface{}) error {
+func (params *EstimateStartParams) FromPositional(args []interface{}) error {
 	if len(args) != 1 {
-		return errors.New("key parameter is required")
+		return errors.New("id parameter is required")
 	}
-	key := args[0].(string)
-	params.Key = &key
+	id, ok := args[0].(string)
+	if !ok {
+		return errors.New("id must be a string")
+	}
+	params.Id = &id
 
 	return nil
 }
 
-func (api *ApiV1) ListTimetable(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
-	p := new(ListTimetableParams)
+func (api *ApiV1) EstimateStart(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(EstimateStartParams)
 	if err := jrpc2.ParseParams(params, p); err != nil {
 		return nil, err
 	}
-	if p.Key == nil {
+	if p.Id == nil {
 		return nil, &jrpc2.ErrorObject{
 			Code:    jrpc2.InvalidParamsCode,
 			Message: jrpc2.InvalidParamsMsg,
-			Data:    "key is required",
+			Data:    "id is required",
 		}
 	}
-	queue, err := api.ctrl.ListTimetable(*p.Key)
+	estimate, err := api.ctrl.EstimateStart(*p.Id, api.models["tasks"], api.models["taskStats"])
 	if err != nil {
-		return nil, &jrpc2.ErrorObject{
-			Code:    ListTimetableErrorCode,
-			Message: ListTimetableErrorMsg,
-			Data:    err.Error(),
-		}
+		return nil, errorObject(EstimateStartErrorCode, EstimateStartErrorMsg, err)
 	}
-	return queue, nil
+	return estimate, nil
 }
 
-type RemoveTaskParams struct {
-	Id *string `json:"id"`
+type ForceCompleteTaskParams struct {
+	Id     *string `json:"id"`
+	Status *string `json:"status"`
+	Token  *string `json:"token"`
+	Reason *string `json:"reason"`
 }
 
-func (params *RemoveTaskParams) FromPositional(args []interface{}) error {
-	if len(args) < 2 {
-		return errors.New("key and id paramters are required")
+func (params *ForceCompleteTaskParams) FromPositional(args []interface{}) error {
+	if len(args) < 3 || len(args) > 4 {
+		return errors.New("id, status, and token parameters are required")
 	}
-	id := args[3].(string)
+	id := args[0].(string)
+	status := args[1].(string)
+	token := args[2].(string)
 	params.Id = &id
+	params.Status = &status
+	params.Token = &token
+	if len(args) > 3 {
+		reason := args[3].(string)
+		params.Reason = &reason
+	}
 
 	return nil
 }
 
-func (api *ApiV1) RemoveTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
-	p := new(RemoveTaskParams)
+func (api *ApiV1) ForceCompleteTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	var reason string
+
+	p := new(ForceCompleteTaskParams)
 	if err := jrpc2.ParseParams(params, p); err != nil {
 		return nil, err
 	}
+	if AdminToken == "" || p.Token == nil || subtle.ConstantTimeCompare([]byte(*p.Token), []byte(AdminToken)) != 1 {
+		return nil, &jrpc2.ErrorObject{
+			Code:    UnauthorizedErrorCode,
+			Message: UnauthorizedErrorMsg,
+			Data:    "a valid admin token is required",
+		}
+	}
 	if p.Id == nil {
 		return nil, &jrpc2.ErrorObject{
 			Code:    jrpc2.InvalidParamsCode,
@@ -347,41 +790,1546 @@ func (api *ApiV1) RemoveTask(params json.RawMessage) (interface{}, *jrpc2.ErrorO
 			Data:    "id is required",
 		}
 	}
-	if err := api.ctrl.RemoveTask(*p.Id, api.models["tasks"]); err != nil {
+	if p.Status == nil || (*p.Status != StatusComplete && *p.Status != StatusCancelled) {
 		return nil, &jrpc2.ErrorObject{
-			Code:    RemoveTaskErrorCode,
-			Message: RemoveTaskErrorMsg,
-			Data:    err.Error(),
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    fmt.Sprintf("status must be %s or %s", StatusComplete, StatusCancelled),
 		}
 	}
+	if p.Reason != nil {
+		reason = *p.Reason
+	}
+	models := bindModels(api.models, WithCaller(context.Background(), AdminCaller))
+	if err := api.ctrl.ForceCompleteTask(*p.Id, *p.Status, reason, models["tasks"], models["resources"]); err != nil {
+		return nil, errorObject(ForceCompleteTaskErrorCode, ForceCompleteTaskErrorMsg, err)
+	}
 	return 0, nil
 }
 
-func NewApiV1(models map[string]Model, ctrl Controller, s *jrpc2.Server) *ApiV1 {
-	api := &ApiV1{models: models, ctrl: ctrl}
-	resources, err := models["resources"].FetchAll()
-	if err != nil {
-		log.Fatal(err)
-	}
-	for _, resource := range resources {
-		v, _ := resource.(*Resource)
-		api.ctrl.AddResource(v.Name, models["resources"])
-	}
-	q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
-	tasks, err := models["tasks"].Query(q, map[string]interface{}{})
-	for _, task := range tasks {
-		v, _ := task.(*Task)
-		api.ctrl.StageTask(v, models["tasks"], false)
+type GetGroupStatusParams struct {
+	GroupId *string `json:"groupId"`
+}
+
+func (params *GetGroupStatusParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("groupId parameter is required")
 	}
+	groupId := args[0].(string)
+	params.GroupId = &groupId
 
+	return nil
+}
+
+func (api *ApiV1) GetGroupStatus(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(GetGroupStatusParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.GroupId == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "groupId is required",
+		}
+	}
+	status, err := api.ctrl.GetGroupStatus(*p.GroupId, api.models["taskGroups"])
+	if err != nil {
+		return nil, errorObject(GetGroupStatusErrorCode, GetGroupStatusErrorMsg, err)
+	}
+	return status, nil
+}
+
+type GetResourceParams struct {
+	Name *string `json:"name"`
+}
+
+func (params *GetResourceParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("name parameter is required")
+	}
+	name := args[0].(string)
+	params.Name = &name
+
+	return nil
+}
+
+func (api *ApiV1) GetResource(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(GetResourceParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Name == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "name is required",
+		}
+	}
+	resource, err := api.ctrl.GetResource(*p.Name)
+	if err != nil {
+		return nil, errorObject(GetResourceErrorCode, GetResourceErrorMsg, err)
+	}
+	return resource, nil
+}
+
+type GetStagedTaskParams struct {
+	Key *string `json:"key"`
+}
+
+func (params *GetStagedTaskParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("key parameter is required")
+	}
+	key := args[0].(string)
+	params.Key = &key
+
+	return nil
+}
+
+func (api *ApiV1) GetStagedTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(GetStagedTaskParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "key is required",
+		}
+	}
+	task, err := api.ctrl.GetStagedTask(*p.Key)
+	if err != nil {
+		return nil, errorObject(GetStagedTaskErrorCode, GetStagedTaskErrorMsg, err)
+	}
+	return task, nil
+}
+
+type GetTaskParams struct {
+	Id *string `json:"id"`
+}
+
+func (params *GetTaskParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("id parameter is required")
+	}
+	id := args[0].(string)
+	params.Id = &id
+
+	return nil
+}
+
+func (api *ApiV1) GetTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(GetTaskParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Id == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "id is required",
+		}
+	}
+	task, err := api.ctrl.GetTask(*p.Id, api.models["tasks"])
+	if err != nil {
+		return nil, errorObject(GetTaskErrorCode, GetTaskErrorMsg, err)
+	}
+	return task, nil
+}
+
+type GetTaskHistoryParams struct {
+	Id *string `json:"id"`
+}
+
+func (params *GetTaskHistoryParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("id parameter is required")
+	}
+	id := args[0].(string)
+	params.Id = &id
+
+	return nil
+}
+
+func (api *ApiV1) GetTaskHistory(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(GetTaskHistoryParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Id == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "id is required",
+		}
+	}
+	history, err := api.ctrl.GetTaskHistory(*p.Id, api.models["taskHistory"])
+	if err != nil {
+		return nil, errorObject(GetTaskHistoryErrorCode, GetTaskHistoryErrorMsg, err)
+	}
+	return history, nil
+}
+
+type GetTaskLogParams struct {
+	Id *string `json:"id"`
+}
+
+func (params *GetTaskLogParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("id parameter is required")
+	}
+	id := args[0].(string)
+	params.Id = &id
+
+	return nil
+}
+
+func (api *ApiV1) GetTaskLog(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(GetTaskLogParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Id == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "id is required",
+		}
+	}
+	logs, err := api.ctrl.GetTaskLog(*p.Id, api.models["taskLogs"])
+	if err != nil {
+		return nil, errorObject(GetTaskLogErrorCode, GetTaskLogErrorMsg, err)
+	}
+	return logs, nil
+}
+
+type GetResourceStatsParams struct {
+	Name    *string    `json:"name"`
+	Windows *[]float64 `json:"windows,omitempty"`
+}
+
+func (params *GetResourceStatsParams) FromPositional(args []interface{}) error {
+	if len(args) < 1 {
+		return errors.New("name parameter is required")
+	}
+	name := args[0].(string)
+	params.Name = &name
+	if len(args) > 1 {
+		windows := make([]float64, 0)
+		for _, window := range args[1].([]interface{}) {
+			windows = append(windows, window.(float64))
+		}
+		params.Windows = &windows
+	}
+
+	return nil
+}
+
+func (api *ApiV1) GetResourceStats(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(GetResourceStatsParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Name == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "name is required",
+		}
+	}
+	windows := DefaultStatWindows
+	if p.Windows != nil {
+		if len(*p.Windows) == 0 || len(*p.Windows) > MaxStatWindows {
+			return nil, &jrpc2.ErrorObject{
+				Code:    jrpc2.InvalidParamsCode,
+				Message: jrpc2.InvalidParamsMsg,
+				Data:    fmt.Sprintf("windows must have 1 to %d entries", MaxStatWindows),
+			}
+		}
+		windows = make([]time.Duration, 0, len(*p.Windows))
+		for _, window := range *p.Windows {
+			if window <= 0 {
+				return nil, &jrpc2.ErrorObject{
+					Code:    jrpc2.InvalidParamsCode,
+					Message: jrpc2.InvalidParamsMsg,
+					Data:    "windows must be positive numbers of seconds",
+				}
+			}
+			windows = append(windows, time.Duration(window*float64(time.Second)))
+		}
+	}
+	stats, err := api.ctrl.GetResourceStats(*p.Name, windows, api.models["resourceStats"])
+	if err != nil {
+		return nil, errorObject(GetResourceStatsErrorCode, GetResourceStatsErrorMsg, err)
+	}
+	return stats, nil
+}
+
+type GetTaskStatsParams struct {
+	Key *string `json:"key"`
+}
+
+func (params *GetTaskStatsParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("key parameter is required")
+	}
+	key := args[0].(string)
+	params.Key = &key
+
+	return nil
+}
+
+func (api *ApiV1) GetTaskStats(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(GetTaskStatsParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "key is required",
+		}
+	}
+	stats, err := api.ctrl.GetTaskStats(*p.Key, api.models["taskStats"])
+	if err != nil {
+		return nil, errorObject(GetTaskStatsErrorCode, GetTaskStatsErrorMsg, err)
+	}
+	return stats, nil
+}
+
+// HealthReport is the health of the controller and its dependencies.
+type HealthReport struct {
+	// Dependencies is the health of each downstream dependency.
+	// Healthy indicates if all dependencies are healthy.
+	Dependencies map[string]*DependencyStatus `json:"dependencies"`
+	Healthy      bool                         `json:"healthy"`
+}
+
+func (api *ApiV1) Health(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	deps := api.ctrl.Health()
+	deps[store.Name()] = &DependencyStatus{Healthy: true}
+	if err := store.Ping(); err != nil {
+		deps[store.Name()] = &DependencyStatus{Error: err.Error()}
+	}
+	report := &HealthReport{Dependencies: deps, Healthy: true}
+	for _, dep := range deps {
+		if !dep.Healthy {
+			report.Healthy = false
+		}
+	}
+	return report, nil
+}
+
+type HeartbeatParams struct {
+	Id *string `json:"id"`
+}
+
+func (params *HeartbeatParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("id parameter is required")
+	}
+	id := args[0].(string)
+	params.Id = &id
+
+	return nil
+}
+
+func (api *ApiV1) Heartbeat(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(HeartbeatParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Id == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "id is required",
+		}
+	}
+	leaseExpires, err := api.ctrl.Heartbeat(*p.Id, api.models["tasks"])
+	if err != nil {
+		return nil, errorObject(HeartbeatErrorCode, HeartbeatErrorMsg, err)
+	}
+	return leaseExpires.Format(time.RFC3339), nil
+}
+
+type ListPriorityQueueParams struct {
+	Key *string `json:"key"`
+}
+
+func (params *ListPriorityQueueParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("key parameter is required")
+	}
+	key := args[0].(string)
+	params.Key = &key
+
+	return nil
+}
+
+func (api *ApiV1) ListPriorityQueue(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(ListPriorityQueueParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "key is required",
+		}
+	}
+	queue, err := api.ctrl.ListPriorityQueue(*p.Key)
+	if err != nil {
+		return nil, errorObject(ListPriorityQueueErrorCode, ListPriorityQueueErrorMsg, err)
+	}
+	return queue, nil
+}
+
+func (api *ApiV1) ListResources(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	resources, err := api.ctrl.ListResources(api.models["resources"])
+	if err != nil {
+		return nil, errorObject(ListResourcesErrorCode, ListResourcesErrorMsg, err)
+	}
+	return resources, nil
+}
+
+type ListStagedTasksParams struct {
+	Key *string `json:"key"`
+}
+
+func (params *ListStagedTasksParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("key parameter is required")
+	}
+	key := args[0].(string)
+	params.Key = &key
+
+	return nil
+}
+
+func (api *ApiV1) ListStagedTasks(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(ListStagedTasksParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "key is required",
+		}
+	}
+	tasks, err := api.ctrl.ListStagedTasks(*p.Key)
+	if err != nil {
+		return nil, errorObject(ListStagedTasksErrorCode, ListStagedTasksErrorMsg, err)
+	}
+	return tasks, nil
+}
+
+type ListFailedEventsParams struct {
+	Status *string `json:"status"`
+	Limit  *int    `json:"limit"`
+}
+
+func (params *ListFailedEventsParams) FromPositional(args []interface{}) error {
+	if len(args) > 2 {
+		return errors.New("only status and limit parameters are accepted")
+	}
+	if len(args) > 0 {
+		status := args[0].(string)
+		params.Status = &status
+	}
+	if len(args) > 1 {
+		limit := int(args[1].(float64))
+		params.Limit = &limit
+	}
+
+	return nil
+}
+
+func (api *ApiV1) ListFailedEvents(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	var status string
+	limit := DefaultListLimit
+
+	p := new(ListFailedEventsParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Status != nil {
+		status = *p.Status
+	}
+	if p.Limit != nil {
+		limit = *p.Limit
+	}
+	if status != "" && status != FailedEventPending && status != FailedEventDead {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    fmt.Sprintf("status must be %s or %s", FailedEventPending, FailedEventDead),
+		}
+	}
+	if limit < 1 || limit > MaxListLimit {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    fmt.Sprintf("limit must be between 1 and %d", MaxListLimit),
+		}
+	}
+	events, err := api.ctrl.ListFailedEvents(status, limit, api.models["failedEvents"])
+	if err != nil {
+		return nil, errorObject(ListFailedEventsErrorCode, ListFailedEventsErrorMsg, err)
+	}
+	return events, nil
+}
+
+type ListTasksParams struct {
+	Status *string           `json:"status"`
+	Key    *string           `json:"key"`
+	Limit  *int              `json:"limit"`
+	Offset *int              `json:"offset"`
+	Labels map[string]string `json:"labels"`
+	Cursor *string           `json:"cursor"`
+}
+
+func (params *ListTasksParams) FromPositional(args []interface{}) error {
+	if len(args) > 6 {
+		return errors.New("only status, key, limit, offset, labels, and cursor parameters are accepted")
+	}
+	if len(args) > 0 {
+		status := args[0].(string)
+		params.Status = &status
+	}
+	if len(args) > 1 {
+		key := args[1].(string)
+		params.Key = &key
+	}
+	if len(args) > 2 {
+		limit := int(args[2].(float64))
+		params.Limit = &limit
+	}
+	if len(args) > 3 {
+		offset := int(args[3].(float64))
+		params.Offset = &offset
+	}
+	if len(args) > 4 {
+		params.Labels = make(map[string]string)
+		for k, v := range args[4].(map[string]interface{}) {
+			params.Labels[k] = v.(string)
+		}
+	}
+	if len(args) > 5 {
+		cursor := args[5].(string)
+		params.Cursor = &cursor
+	}
+
+	return nil
+}
+
+func (api *ApiV1) ListTasks(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	var status, key string
+	limit, offset := DefaultListLimit, 0
+
+	p := new(ListTasksParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Status != nil {
+		status = *p.Status
+	}
+	if p.Key != nil {
+		key = *p.Key
+	}
+	if p.Limit != nil {
+		limit = *p.Limit
+	}
+	if p.Offset != nil {
+		offset = *p.Offset
+	}
+	if p.Cursor != nil {
+		next, err := PageOffset(*p.Cursor)
+		if err != nil {
+			return nil, &jrpc2.ErrorObject{
+				Code:    jrpc2.InvalidParamsCode,
+				Message: jrpc2.InvalidParamsMsg,
+				Data:    err.Error(),
+			}
+		}
+		offset = next
+	}
+	if limit < 1 || limit > MaxListLimit {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    fmt.Sprintf("limit must be between 1 and %d", MaxListLimit),
+		}
+	}
+	if offset < 0 {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "offset must not be negative",
+		}
+	}
+	page, err := api.ctrl.ListTasks(status, key, p.Labels, limit, offset, api.models["tasks"])
+	if err != nil {
+		return nil, errorObject(ListTasksErrorCode, ListTasksErrorMsg, err)
+	}
+	return page, nil
+}
+
+type ListTimetableParams struct {
+	Key *string `json:"key"`
+}
+
+func (params *ListTimetableParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("key parameter is required")
+	}
+	key := args[0].(string)
+	params.Key = &key
+
+	return nil
+}
+
+func (api *ApiV1) ListTimetable(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(ListTimetableParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "key is required",
+		}
+	}
+	queue, err := api.ctrl.ListTimetable(*p.Key)
+	if err != nil {
+		return nil, errorObject(ListTimetableErrorCode, ListTimetableErrorMsg, err)
+	}
+	return queue, nil
+}
+
+type PauseResourceParams struct {
+	Name *string `json:"name"`
+}
+
+func (params *PauseResourceParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("name parameter is required")
+	}
+	name := args[0].(string)
+	params.Name = &name
+
+	return nil
+}
+
+func (api *ApiV1) PauseResource(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(PauseResourceParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Name == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "name is required",
+		}
+	}
+	if err := api.ctrl.PauseResource(*p.Name, api.models["resources"]); err != nil {
+		return nil, errorObject(PauseResourceErrorCode, PauseResourceErrorMsg, err)
+	}
+	return 0, nil
+}
+
+type PauseTaskParams struct {
+	Id *string `json:"id"`
+}
+
+func (params *PauseTaskParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("id parameter is required")
+	}
+	id, ok := args[0].(string)
+	if !ok {
+		return errors.New("id must be a string")
+	}
+	params.Id = &id
+
+	return nil
+}
+
+func (api *ApiV1) PauseTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(PauseTaskParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Id == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "id is required",
+		}
+	}
+	if err := api.ctrl.PauseTask(*p.Id, api.models["tasks"]); err != nil {
+		return nil, errorObject(PauseTaskErrorCode, PauseTaskErrorMsg, err)
+	}
+	return 0, nil
+}
+
+type PurgeTasksParams struct {
+	Age   *float64 `json:"age"`
+	Limit *int     `json:"limit"`
+}
+
+func (params *PurgeTasksParams) FromPositional(args []interface{}) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("age parameter is required and only age and limit parameters are accepted")
+	}
+	age := args[0].(float64)
+	params.Age = &age
+	if len(args) > 1 {
+		limit := int(args[1].(float64))
+		params.Limit = &limit
+	}
+
+	return nil
+}
+
+func (api *ApiV1) PurgeTasks(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	limit := MaxListLimit
+
+	p := new(PurgeTasksParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Age == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "age is required",
+		}
+	}
+	if *p.Age <= 0 {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "age must be positive",
+		}
+	}
+	if p.Limit != nil {
+		limit = *p.Limit
+	}
+	if limit < 1 || limit > MaxListLimit {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    fmt.Sprintf("limit must be between 1 and %d", MaxListLimit),
+		}
+	}
+	age := time.Duration(*p.Age * float64(time.Second))
+	count, err := api.ctrl.PurgeTasks(age, limit, api.models["tasks"])
+	if err != nil {
+		return nil, errorObject(PurgeTasksErrorCode, PurgeTasksErrorMsg, err)
+	}
+	return count, nil
+}
+
+type RemoveResourceParams struct {
+	Name *string `json:"name"`
+}
+
+func (params *RemoveResourceParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("name parameter is required")
+	}
+	name := args[0].(string)
+	params.Name = &name
+
+	return nil
+}
+
+func (api *ApiV1) RemoveResource(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(RemoveResourceParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Name == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "name is required",
+		}
+	}
+	if err := api.ctrl.RemoveResource(*p.Name, api.models["tasks"], api.models["resources"]); err != nil {
+		return nil, errorObject(RemoveResourceErrorCode, RemoveResourceErrorMsg, err)
+	}
+	return 0, nil
+}
+
+type RemoveTaskParams struct {
+	Id     *string `json:"id"`
+	Reason *string `json:"reason,omitempty"`
+}
+
+func (params *RemoveTaskParams) FromPositional(args []interface{}) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("id parameter is required")
+	}
+	id, ok := args[0].(string)
+	if !ok {
+		return errors.New("id must be a string")
+	}
+	params.Id = &id
+	if len(args) > 1 {
+		reason, ok := args[1].(string)
+		if !ok {
+			return errors.New("reason must be a string")
+		}
+		params.Reason = &reason
+	}
+
+	return nil
+}
+
+func (api *ApiV1) RemoveTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(RemoveTaskParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Id == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "id is required",
+		}
+	}
+	var reason string
+	if p.Reason != nil {
+		reason = *p.Reason
+	}
+	if err := api.ctrl.RemoveTask(*p.Id, reason, api.models["tasks"], api.models["taskArchive"]); err != nil {
+		return nil, errorObject(RemoveTaskErrorCode, RemoveTaskErrorMsg, err)
+	}
+	return 0, nil
+}
+
+type RestoreTaskParams struct {
+	Id *string `json:"id"`
+}
+
+func (params *RestoreTaskParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("id parameter is required")
+	}
+	id, ok := args[0].(string)
+	if !ok {
+		return errors.New("id must be a string")
+	}
+	params.Id = &id
+
+	return nil
+}
+
+func (api *ApiV1) RestoreTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(RestoreTaskParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Id == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "id is required",
+		}
+	}
+	if err := api.ctrl.RestoreTask(*p.Id, api.models["tasks"], api.models["resources"], api.models["taskArchive"]); err != nil {
+		return nil, errorObject(RestoreTaskErrorCode, RestoreTaskErrorMsg, err)
+	}
+	return 0, nil
+}
+
+type RescheduleTaskParams struct {
+	Id    *string `json:"id"`
+	RunAt *string `json:"runAt"`
+}
+
+func (params *RescheduleTaskParams) FromPositional(args []interface{}) error {
+	if len(args) != 2 {
+		return errors.New("id and runAt parameters are required")
+	}
+	id := args[0].(string)
+	runAt := args[1].(string)
+	params.Id = &id
+	params.RunAt = &runAt
+
+	return nil
+}
+
+func (api *ApiV1) RescheduleTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(RescheduleTaskParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Id == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "id is required",
+		}
+	}
+	if p.RunAt == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "runAt is required",
+		}
+	}
+	runAt, err := time.Parse(time.RFC3339, *p.RunAt)
+	if err != nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "runAt must be an RFC3339 date/time",
+		}
+	}
+	if err := api.ctrl.RescheduleTask(*p.Id, runAt, api.models["tasks"]); err != nil {
+		return nil, errorObject(RescheduleTaskErrorCode, RescheduleTaskErrorMsg, err)
+	}
+	return 0, nil
+}
+
+type ResumeResourceParams struct {
+	Name *string `json:"name"`
+}
+
+func (params *ResumeResourceParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("name parameter is required")
+	}
+	name := args[0].(string)
+	params.Name = &name
+
+	return nil
+}
+
+func (api *ApiV1) ResumeResource(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(ResumeResourceParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Name == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "name is required",
+		}
+	}
+	if err := api.ctrl.ResumeResource(*p.Name, api.models["resources"]); err != nil {
+		return nil, errorObject(ResumeResourceErrorCode, ResumeResourceErrorMsg, err)
+	}
+	return 0, nil
+}
+
+type ResumeTaskParams struct {
+	Id *string `json:"id"`
+}
+
+func (params *ResumeTaskParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("id parameter is required")
+	}
+	id, ok := args[0].(string)
+	if !ok {
+		return errors.New("id must be a string")
+	}
+	params.Id = &id
+
+	return nil
+}
+
+func (api *ApiV1) ResumeTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(ResumeTaskParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Id == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "id is required",
+		}
+	}
+	if err := api.ctrl.ResumeTask(*p.Id, api.models["tasks"]); err != nil {
+		return nil, errorObject(ResumeTaskErrorCode, ResumeTaskErrorMsg, err)
+	}
+	return 0, nil
+}
+
+type RegisterResourceParams struct {
+	Name     *string            `json:"name"`
+	Tags     *map[string]string `json:"tags,omitempty"`
+	Capacity *int               `json:"capacity,omitempty"`
+}
+
+func (params *RegisterResourceParams) FromPositional(args []interface{}) error {
+	if len(args) < 1 {
+		return errors.New("name parameter is required")
+	}
+	name := args[0].(string)
+	params.Name = &name
+	if len(args) > 1 {
+		tags := make(map[string]string)
+		for k, v := range args[1].(map[string]interface{}) {
+			tags[k] = v.(string)
+		}
+		params.Tags = &tags
+	}
+	if len(args) > 2 {
+		capacity := int(args[2].(float64))
+		params.Capacity = &capacity
+	}
+
+	return nil
+}
+
+func (api *ApiV1) RegisterResource(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(RegisterResourceParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Name == nil || *p.Name == "" {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "name is required",
+		}
+	}
+	var tags map[string]string
+	capacity := 1
+	if p.Tags != nil {
+		if err := validatePairs("tag", *p.Tags); err != nil {
+			return nil, &jrpc2.ErrorObject{
+				Code:    jrpc2.InvalidParamsCode,
+				Message: jrpc2.InvalidParamsMsg,
+				Data:    err.Error(),
+			}
+		}
+		tags = *p.Tags
+	}
+	if p.Capacity != nil {
+		capacity = *p.Capacity
+	}
+	if capacity < 1 || capacity > MaxCapacity {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    fmt.Sprintf("capacity must be between 1 and %d", MaxCapacity),
+		}
+	}
+	slots, err := api.ctrl.RegisterResource(*p.Name, tags, capacity, api.models["tasks"], api.models["resources"])
+	if err != nil {
+		return nil, errorObject(RegisterResourceErrorCode, RegisterResourceErrorMsg, err)
+	}
+	return slots, nil
+}
+
+type ResourceHeartbeatParams struct {
+	Name *string `json:"name"`
+}
+
+func (params *ResourceHeartbeatParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("name parameter is required")
+	}
+	name := args[0].(string)
+	params.Name = &name
+
+	return nil
+}
+
+func (api *ApiV1) ResourceHeartbeat(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(ResourceHeartbeatParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Name == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "name is required",
+		}
+	}
+	if err := api.ctrl.ResourceHeartbeat(*p.Name, api.models["resources"]); err != nil {
+		return nil, errorObject(ResourceHeartbeatErrorCode, ResourceHeartbeatErrorMsg, err)
+	}
+	return 0, nil
+}
+
+type SetResourceParentParams struct {
+	Name   *string `json:"name"`
+	Parent *string `json:"parent,omitempty"`
+}
+
+func (params *SetResourceParentParams) FromPositional(args []interface{}) error {
+	if len(args) < 1 {
+		return errors.New("name parameter is required")
+	}
+	name := args[0].(string)
+	params.Name = &name
+	if len(args) > 1 {
+		parent, _ := args[1].(string)
+		params.Parent = &parent
+	}
+
+	return nil
+}
+
+func (api *ApiV1) SetResourceParent(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(SetResourceParentParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Name == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "name is required",
+		}
+	}
+	var parent string
+	if p.Parent != nil {
+		parent = *p.Parent
+	}
+	if err := api.ctrl.SetResourceParent(*p.Name, parent, api.models["resources"]); err != nil {
+		return nil, errorObject(SetResourceParentErrorCode, SetResourceParentErrorMsg, err)
+	}
+	return 0, nil
+}
+
+type SetResourceQuotaParams struct {
+	Name   *string  `json:"name"`
+	Limit  *int     `json:"limit"`
+	Period *float64 `json:"period,omitempty"`
+}
+
+func (params *SetResourceQuotaParams) FromPositional(args []interface{}) error {
+	if len(args) < 2 {
+		return errors.New("name and limit parameters are required")
+	}
+	name := args[0].(string)
+	limit := int(args[1].(float64))
+	params.Name = &name
+	params.Limit = &limit
+	if len(args) > 2 {
+		period := args[2].(float64)
+		params.Period = &period
+	}
+
+	return nil
+}
+
+func (api *ApiV1) SetResourceQuota(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(SetResourceQuotaParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Name == nil || p.Limit == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "name and limit are required",
+		}
+	}
+	if *p.Limit < 0 {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "limit must not be negative",
+		}
+	}
+	var quota *ResourceQuota
+	if *p.Limit > 0 {
+		if p.Period == nil || *p.Period <= 0 {
+			return nil, &jrpc2.ErrorObject{
+				Code:    jrpc2.InvalidParamsCode,
+				Message: jrpc2.InvalidParamsMsg,
+				Data:    "period must be a positive number of seconds",
+			}
+		}
+		quota = &ResourceQuota{Limit: *p.Limit, Period: *p.Period}
+	}
+	if err := api.ctrl.SetResourceQuota(*p.Name, quota, api.models["resources"]); err != nil {
+		return nil, errorObject(SetResourceQuotaErrorCode, SetResourceQuotaErrorMsg, err)
+	}
+	return 0, nil
+}
+
+type SetResourceWeightParams struct {
+	Name   *string  `json:"name"`
+	Weight *float64 `json:"weight"`
+}
+
+func (params *SetResourceWeightParams) FromPositional(args []interface{}) error {
+	if len(args) != 2 {
+		return errors.New("name and weight parameters are required")
+	}
+	name := args[0].(string)
+	weight := args[1].(float64)
+	params.Name = &name
+	params.Weight = &weight
+
+	return nil
+}
+
+func (api *ApiV1) SetResourceWeight(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(SetResourceWeightParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Name == nil || p.Weight == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "name and weight are required",
+		}
+	}
+	if err := api.ctrl.SetResourceWeight(*p.Name, *p.Weight, api.models["resources"]); err != nil {
+		return nil, errorObject(SetResourceWeightErrorCode, SetResourceWeightErrorMsg, err)
+	}
+	return 0, nil
+}
+
+type RetryTaskParams struct {
+	Id *string `json:"id"`
+}
+
+func (params *RetryTaskParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("id parameter is required")
+	}
+	id := args[0].(string)
+	params.Id = &id
+
+	return nil
+}
+
+func (api *ApiV1) RetryTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(RetryTaskParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Id == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "id is required",
+		}
+	}
+	if err := api.ctrl.RetryTask(*p.Id, api.models["tasks"]); err != nil {
+		return nil, errorObject(RetryTaskErrorCode, RetryTaskErrorMsg, err)
+	}
+	return 0, nil
+}
+
+type SearchTasksParams struct {
+	Filters map[string]interface{} `json:"filters"`
+	Limit   *int                   `json:"limit"`
+	Offset  *int                   `json:"offset"`
+	Labels  map[string]string      `json:"labels"`
+	Cursor  *string                `json:"cursor"`
+}
+
+func (params *SearchTasksParams) FromPositional(args []interface{}) error {
+	if len(args) < 1 || len(args) > 5 {
+		return errors.New("filters parameter is required and only filters, limit, offset, labels, and cursor parameters are accepted")
+	}
+	params.Filters = args[0].(map[string]interface{})
+	if len(args) > 1 {
+		limit := int(args[1].(float64))
+		params.Limit = &limit
+	}
+	if len(args) > 2 {
+		offset := int(args[2].(float64))
+		params.Offset = &offset
+	}
+	if len(args) > 3 {
+		params.Labels = make(map[string]string)
+		for k, v := range args[3].(map[string]interface{}) {
+			params.Labels[k] = v.(string)
+		}
+	}
+	if len(args) > 4 {
+		cursor := args[4].(string)
+		params.Cursor = &cursor
+	}
+
+	return nil
+}
+
+func (api *ApiV1) SearchTasks(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	limit, offset := DefaultListLimit, 0
+
+	p := new(SearchTasksParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if len(p.Filters) == 0 && len(p.Labels) == 0 {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "filters or labels is required",
+		}
+	}
+	for path := range p.Filters {
+		for _, segment := range strings.Split(path, ".") {
+			if segment == "" {
+				return nil, &jrpc2.ErrorObject{
+					Code:    jrpc2.InvalidParamsCode,
+					Message: jrpc2.InvalidParamsMsg,
+					Data:    fmt.Sprintf("invalid meta path '%s'", path),
+				}
+			}
+		}
+	}
+	if p.Limit != nil {
+		limit = *p.Limit
+	}
+	if p.Offset != nil {
+		offset = *p.Offset
+	}
+	if p.Cursor != nil {
+		next, err := PageOffset(*p.Cursor)
+		if err != nil {
+			return nil, &jrpc2.ErrorObject{
+				Code:    jrpc2.InvalidParamsCode,
+				Message: jrpc2.InvalidParamsMsg,
+				Data:    err.Error(),
+			}
+		}
+		offset = next
+	}
+	if limit < 1 || limit > MaxListLimit {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    fmt.Sprintf("limit must be between 1 and %d", MaxListLimit),
+		}
+	}
+	if offset < 0 {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "offset must not be negative",
+		}
+	}
+	page, err := api.ctrl.SearchTasks(p.Filters, p.Labels, limit, offset, api.models["tasks"])
+	if err != nil {
+		return nil, errorObject(SearchTasksErrorCode, SearchTasksErrorMsg, err)
+	}
+	return page, nil
+}
+
+type UnstageTaskParams struct {
+	Key *string `json:"key"`
+}
+
+func (params *UnstageTaskParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("key parameter is required")
+	}
+	key := args[0].(string)
+	params.Key = &key
+
+	return nil
+}
+
+func (api *ApiV1) UnstageTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(UnstageTaskParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "key is required",
+		}
+	}
+	if err := api.ctrl.UnstageTask(*p.Key, api.models["tasks"]); err != nil {
+		return nil, errorObject(UnstageTaskErrorCode, UnstageTaskErrorMsg, err)
+	}
+	return 0, nil
+}
+
+type UpdateTaskPriorityParams struct {
+	Id       *string  `json:"id"`
+	Priority *float64 `json:"priority"`
+}
+
+func (params *UpdateTaskPriorityParams) FromPositional(args []interface{}) error {
+	if len(args) != 2 {
+		return errors.New("id and priority parameters are required")
+	}
+	id := args[0].(string)
+	priority := args[1].(float64)
+	params.Id = &id
+	params.Priority = &priority
+
+	return nil
+}
+
+func (api *ApiV1) UpdateTaskPriority(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(UpdateTaskPriorityParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Id == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "id is required",
+		}
+	}
+	if p.Priority == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "priority is required",
+		}
+	}
+	if err := api.ctrl.UpdateTaskPriority(*p.Id, *p.Priority, api.models["tasks"]); err != nil {
+		return nil, errorObject(UpdateTaskPriorityErrorCode, UpdateTaskPriorityErrorMsg, err)
+	}
+	return 0, nil
+}
+
+// cancellable returns the context method that calls the api method with the
+// models bound to the context of the request, so that the queries of the
+// method are canceled once the client is gone.
+func (api *ApiV1) cancellable(method func(*ApiV1, json.RawMessage) (interface{}, *jrpc2.ErrorObject)) ContextMethod {
+	return func(ctx context.Context, params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+		bound := *api
+		bound.models = bindModels(api.models, ctx)
+		return method(&bound, params)
+	}
+}
+
+func NewApiV1(models map[string]Model, ctrl Controller, s MethodRegistry) *ApiV1 {
+	api := &ApiV1{models: models, ctrl: ctrl}
+	resources, err := models["resources"].FetchAll()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, resource := range resources {
+		v, _ := resource.(*Resource)
+		if err := api.ctrl.RestoreResource(v, models["tasks"], models["resources"]); err != nil {
+			log.Println(err)
+		}
+	}
+	tasks, err := queryPendingTasks(models["tasks"])
+	for _, task := range tasks {
+		v, _ := task.(*Task)
+		if err := api.ctrl.RestoreStagedTask(v, models["tasks"]); err != nil {
+			log.Println(err)
+		}
+	}
+
+	s.Register("acknowledgePreemption", jrpc2.Method{Method: api.AcknowledgePreemption})
 	s.Register("addResource", jrpc2.Method{Method: api.AddResource})
 	s.Register("addTask", jrpc2.Method{Method: api.AddTask})
+	s.Register("appendTaskLog", jrpc2.Method{Method: api.AppendTaskLog})
 	s.Register("completeTask", jrpc2.Method{Method: api.CompleteTask})
+	registerContext(s, "countTasks", api.cancellable((*ApiV1).CountTasks))
+	s.Register("estimateStart", jrpc2.Method{Method: api.EstimateStart})
+	s.Register("forceCompleteTask", jrpc2.Method{Method: api.ForceCompleteTask})
+	s.Register("getGroupStatus", jrpc2.Method{Method: api.GetGroupStatus})
+	s.Register("getResource", jrpc2.Method{Method: api.GetResource})
+	s.Register("getResourceStats", jrpc2.Method{Method: api.GetResourceStats})
+	s.Register("getStagedTask", jrpc2.Method{Method: api.GetStagedTask})
 	s.Register("getTask", jrpc2.Method{Method: api.GetTask})
+	s.Register("getTaskHistory", jrpc2.Method{Method: api.GetTaskHistory})
+	s.Register("getTaskLog", jrpc2.Method{Method: api.GetTaskLog})
+	s.Register("getTaskStats", jrpc2.Method{Method: api.GetTaskStats})
+	s.Register("health", jrpc2.Method{Method: api.Health})
+	s.Register("heartbeat", jrpc2.Method{Method: api.Heartbeat})
+	s.Register("listFailedEvents", jrpc2.Method{Method: api.ListFailedEvents})
 	s.Register("listPriorityQueue", jrpc2.Method{Method: api.ListPriorityQueue})
+	s.Register("listResources", jrpc2.Method{Method: api.ListResources})
+	s.Register("listStagedTasks", jrpc2.Method{Method: api.ListStagedTasks})
+	registerContext(s, "listTasks", api.cancellable((*ApiV1).ListTasks))
 	s.Register("listTimetable", jrpc2.Method{Method: api.ListTimetable})
 	s.Register("startTask", jrpc2.Method{Method: api.StartTask})
+	s.Register("pauseResource", jrpc2.Method{Method: api.PauseResource})
+	s.Register("pauseTask", jrpc2.Method{Method: api.PauseTask})
+	registerContext(s, "purgeTasks", api.cancellable((*ApiV1).PurgeTasks))
+	s.Register("registerResource", jrpc2.Method{Method: api.RegisterResource})
+	s.Register("removeResource", jrpc2.Method{Method: api.RemoveResource})
 	s.Register("removeTask", jrpc2.Method{Method: api.RemoveTask})
+	s.Register("rescheduleTask", jrpc2.Method{Method: api.RescheduleTask})
+	s.Register("restoreTask", jrpc2.Method{Method: api.RestoreTask})
+	s.Register("resourceHeartbeat", jrpc2.Method{Method: api.ResourceHeartbeat})
+	s.Register("resumeResource", jrpc2.Method{Method: api.ResumeResource})
+	s.Register("resumeTask", jrpc2.Method{Method: api.ResumeTask})
+	s.Register("retryTask", jrpc2.Method{Method: api.RetryTask})
+	registerContext(s, "searchTasks", api.cancellable((*ApiV1).SearchTasks))
+	s.Register("serverInfo", jrpc2.Method{Method: api.ServerInfo})
+	s.Register("setResourceParent", jrpc2.Method{Method: api.SetResourceParent})
+	s.Register("setResourceQuota", jrpc2.Method{Method: api.SetResourceQuota})
+	s.Register("setResourceWeight", jrpc2.Method{Method: api.SetResourceWeight})
+	s.Register("unstageTask", jrpc2.Method{Method: api.UnstageTask})
+	s.Register("updateTaskPriority", jrpc2.Method{Method: api.UpdateTaskPriority})
 
 	return api
 }
+
+// errorObject returns the error object of the method error with the code
+// and message. An error caused by the storage being unavailable gets the
+// storage unavailable code instead, which tells the client to retry the
+// call later.
+func errorObject(code jrpc2.ErrorCode, msg jrpc2.ErrorMsg, err error) *jrpc2.ErrorObject {
+	if errors.Is(err, StorageUnavailableError) {
+		code, msg = StorageUnavailableErrorCode, StorageUnavailableErrorMsg
+	}
+	return &jrpc2.ErrorObject{
+		Code:    code,
+		Message: msg,
+		Data:    err.Error(),
+	}
+}
+
+// validateCallbackUrl returns an error if the callback url is not an
+// absolute http or https url, or if its host is not one of the
+// CallbackHosts.
+func validateCallbackUrl(callbackUrl string) error {
+	u, err := url.Parse(callbackUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("callbackUrl must be an absolute http or https url")
+	}
+	if !callbackAllowed(callbackUrl) {
+		return errors.New("callbackUrl host is not allowed")
+	}
+	return nil
+}
+
+// validatePairs returns an error describing the first invalid key value
+// pair of the task labels, task constraints or resource tags. The kind
+// names the pairs in the error.
+func validatePairs(kind string, pairs map[string]string) error {
+	if len(pairs) > MaxLabels {
+		return fmt.Errorf("at most %d %ss are allowed", MaxLabels, kind)
+	}
+	for k, v := range pairs {
+		if k == "" || len(k) > MaxLabelLength || strings.ContainsAny(k, "= ") {
+			return fmt.Errorf("invalid %s key '%s'", kind, k)
+		}
+		if len(v) > MaxLabelLength {
+			return fmt.Errorf("%s '%s' value is longer than %d characters", kind, k, MaxLabelLength)
+		}
+	}
+	return nil
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"testing"
+	"time"
 
 	"github.com/bitwurx/jrpc2"
 	"github.com/satori/go.uuid"
@@ -13,6 +16,9 @@ func TestAp1V1AddResource(t *testing.T) {
 	var table = []struct {
 		Body    []byte
 		Name    string
+		Pool    string
+		Tags    map[string]string
+		Weight  float64
 		CallErr error
 		Result  int
 		ErrCode jrpc2.ErrorCode
@@ -21,6 +27,9 @@ func TestAp1V1AddResource(t *testing.T) {
 		{
 			[]byte(`{"name": "test"}`),
 			"test",
+			"",
+			nil,
+			0,
 			nil,
 			0,
 			-1,
@@ -29,6 +38,64 @@ func TestAp1V1AddResource(t *testing.T) {
 		{
 			[]byte(`["test2"]`),
 			"test2",
+			"",
+			nil,
+			0,
+			nil,
+			0,
+			-1,
+			"",
+		},
+		{
+			[]byte(`{"name": "gpu1", "pool": "gpu"}`),
+			"gpu1",
+			"gpu",
+			nil,
+			0,
+			nil,
+			0,
+			-1,
+			"",
+		},
+		{
+			[]byte(`["gpu2", "gpu"]`),
+			"gpu2",
+			"gpu",
+			nil,
+			0,
+			nil,
+			0,
+			-1,
+			"",
+		},
+		{
+			[]byte(`["gpu3", "gpu", {"cuda": "12"}]`),
+			"gpu3",
+			"gpu",
+			map[string]string{"cuda": "12"},
+			0,
+			nil,
+			0,
+			-1,
+			"",
+		},
+		{
+			[]byte(`{"name": "gpu4", "tags": {"bad key": "12"}}`),
+			"gpu4",
+			"",
+			nil,
+			0,
+			nil,
+			-1,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`{"name": "new", "pool": "gpu", "weight": 2.5}`),
+			"new",
+			"gpu",
+			nil,
+			2.5,
 			nil,
 			0,
 			-1,
@@ -37,6 +104,9 @@ func TestAp1V1AddResource(t *testing.T) {
 		{
 			[]byte(`["test"]`),
 			"test",
+			"",
+			nil,
+			0,
 			ResourceExistsError,
 			-1,
 			AddResourceErrorCode,
@@ -52,7 +122,7 @@ func TestAp1V1AddResource(t *testing.T) {
 		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
 		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
 		ctrl := &MockController{}
-		ctrl.On("AddResource", tt.Name, rescModel).Return(tt.CallErr)
+		ctrl.On("AddResource", tt.Name, tt.Pool, tt.Tags, tt.Weight, rescModel).Return(tt.CallErr)
 		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
 		result, errObj := api.AddResource(tt.Body)
 		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
@@ -67,6 +137,24 @@ func TestAp1V1AddResource(t *testing.T) {
 	}
 }
 
+func TestAddResourceParamsFromPositional(t *testing.T) {
+	var table = []struct {
+		Args []interface{}
+		Err  string
+	}{
+		{[]interface{}{"gpu1", "gpu"}, "<nil>"},
+		{[]interface{}{"gpu1", 5.0}, "pool must be a string"},
+		{[]interface{}{"gpu1", nil}, "pool must be a string"},
+	}
+
+	for i, tt := range table {
+		err := new(AddResourceParams).FromPositional(tt.Args)
+		if fmt.Sprint(err) != tt.Err {
+			t.Fatalf("[%d] expected error '%s', got '%v'", i, tt.Err, err)
+		}
+	}
+}
+
 func TestAp1V1AddTask(t *testing.T) {
 	var table = []struct {
 		Body    []byte
@@ -98,6 +186,30 @@ func TestAp1V1AddTask(t *testing.T) {
 			jrpc2.InvalidParamsCode,
 			jrpc2.InvalidParamsMsg,
 		},
+		{
+			[]byte(`{"key": "test", "priority": 2.1, "expiresAt": "2017-01-01T12:00:00Z"}`),
+			nil,
+			-1,
+			"",
+		},
+		{
+			[]byte(`{"key": "test", "priority": 2.1, "expiresAt": "tomorrow"}`),
+			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`{"key": "test", "priority": 2.1, "labels": {"team": "data"}}`),
+			nil,
+			-1,
+			"",
+		},
+		{
+			[]byte(`{"key": "test", "priority": 2.1, "labels": {"team=x": "data"}}`),
+			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
 		{
 			[]byte(`{"key": "test"}`),
 			nil,
@@ -172,6 +284,16 @@ func TestAp1V1CompleteTask(t *testing.T) {
 			-1,
 			"",
 		},
+		{
+			[]byte(`{"id": "test3", "status": "complete", "result": {"rows": 10}}`),
+			"test3",
+			nil,
+			0,
+			true,
+			nil,
+			-1,
+			"",
+		},
 		{
 			[]byte(`[]`),
 			"",
@@ -192,6 +314,26 @@ func TestAp1V1CompleteTask(t *testing.T) {
 			jrpc2.InvalidParamsCode,
 			jrpc2.InvalidParamsMsg,
 		},
+		{
+			[]byte(`{"id": "test4", "status": "cancelled", "cascade": true}`),
+			"test4",
+			nil,
+			0,
+			true,
+			nil,
+			-1,
+			"",
+		},
+		{
+			[]byte(`["test5", "complete", null, "", "yes"]`),
+			"",
+			nil,
+			0,
+			true,
+			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
 		{
 			[]byte(`["", 2, 3]`),
 			"",
@@ -231,7 +373,7 @@ func TestAp1V1CompleteTask(t *testing.T) {
 		rescModel := &MockModel{}
 		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
 		ctrl := &MockController{}
-		ctrl.On("CompleteTask", tt.TaskId, mock.AnythingOfType("string"), taskModel, rescModel).Return(tt.CallErr)
+		ctrl.On("CompleteTask", tt.TaskId, mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("string"), mock.AnythingOfType("bool"), taskModel, rescModel).Return(tt.CallErr)
 		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
 		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
 		result, errObj := api.CompleteTask(tt.Body)
@@ -247,6 +389,64 @@ func TestAp1V1CompleteTask(t *testing.T) {
 	}
 }
 
+func TestApiV1GetResource(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		Name    string
+		Err     error
+		Result  *ResourceDetail
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{
+			[]byte(`{"name": "test"}`),
+			"test",
+			nil,
+			&ResourceDetail{Resource: NewResource("test")},
+			-1,
+			"",
+		},
+		{
+			[]byte(`{"key": "test"}`),
+			"",
+			nil,
+			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`["test"]`),
+			"test",
+			ResourceNotFoundError,
+			nil,
+			GetResourceErrorCode,
+			GetResourceErrorMsg,
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("GetResource", tt.Name).Return(tt.Result, tt.Err)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.GetResource(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if errObj == nil && result.(*ResourceDetail) != tt.Result {
+			t.Fatalf("expected result to be %v, got %v", tt.Result, result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
 func TestAp1V1GetTask(t *testing.T) {
 	var table = []struct {
 		Body    []byte
@@ -379,62 +579,24 @@ func TestApiV1ListPriorityQueue(t *testing.T) {
 	}
 }
 
-func TestApiV1ListTimetable(t *testing.T) {
+func TestApiV1ListResources(t *testing.T) {
 	var table = []struct {
-		Body    []byte
-		Key     string
 		Err     error
-		Result  map[string]interface{}
+		Result  []*Resource
 		ErrCode jrpc2.ErrorCode
 		ErrMsg  jrpc2.ErrorMsg
 	}{
 		{
-			[]byte(`{"key": "test"}`),
-			"test",
-			nil,
-			map[string]interface{}{"_key": "test"},
-			-1,
-			"",
-		},
-		{
-			[]byte(`["test"]`),
-			"test",
 			nil,
-			map[string]interface{}{"_key": "test"},
+			[]*Resource{NewResource("test")},
 			-1,
 			"",
 		},
 		{
-			[]byte(`["test", 25]`),
-			"test",
-			nil,
-			nil,
-			jrpc2.InvalidParamsCode,
-			jrpc2.InvalidParamsMsg,
-		},
-		{
-			[]byte(`{"keys", 25}`),
-			"test",
-			nil,
-			nil,
-			jrpc2.InvalidParamsCode,
-			jrpc2.InvalidParamsMsg,
-		},
-		{
-			[]byte(`{"key", 25}`),
-			"test",
-			nil,
-			nil,
-			jrpc2.InvalidParamsCode,
-			jrpc2.InvalidParamsMsg,
-		},
-		{
-			[]byte(`{"key": "test"}`),
-			"test",
-			QueueNotFoundError,
+			errors.New("model error"),
 			nil,
-			ListTimetableErrorCode,
-			ListTimetableErrorMsg,
+			ListResourcesErrorCode,
+			ListResourcesErrorMsg,
 		},
 	}
 
@@ -446,80 +608,93 @@ func TestApiV1ListTimetable(t *testing.T) {
 		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
 		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
 		ctrl := &MockController{}
-		ctrl.On("ListTimetable", tt.Key).Return(tt.Result, tt.Err)
+		ctrl.On("ListResources", rescModel).Return(tt.Result, tt.Err)
 		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
-		result, errObj := api.ListTimetable(tt.Body)
+		result, errObj := api.ListResources([]byte(`[]`))
 		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
 			t.Fatal(errObj.Message)
 		}
-		if result != nil && result.(map[string]interface{})["_key"] != tt.Result["_key"] {
-			t.Fatalf("expected key to be %d, go %d", tt.Result["_key"], result.(map[string]interface{})["_key"])
-		}
-		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
-			ctrl.AssertExpectations(t)
+		if errObj == nil && len(result.([]*Resource)) != len(tt.Result) {
+			t.Fatalf("expected %d resources, got %d", len(tt.Result), len(result.([]*Resource)))
 		}
+		ctrl.AssertExpectations(t)
 	}
 }
 
-func TestAp1V1RemoveTask(t *testing.T) {
+func TestApiV1ListFailedEvents(t *testing.T) {
 	var table = []struct {
-		Id      string
 		Body    []byte
-		Result  int
-		CallErr error
+		Status  string
+		Limit   int
+		Events  []*FailedEvent
+		Err     error
 		ErrCode jrpc2.ErrorCode
 		ErrMsg  jrpc2.ErrorMsg
 	}{
 		{
-			"abc123",
-			[]byte(`{"id": "abc123"}`),
-			0,
+			[]byte(`{}`),
+			"",
+			DefaultListLimit,
+			[]*FailedEvent{NewFailedEvent(NewEvent(TaskStatusChangedEvent, nil), NotificationFailedError)},
 			nil,
 			-1,
 			"",
 		},
 		{
-			"abc123",
-			[]byte(`{"key": "test"}`),
-			0,
+			[]byte(`["dead", 5]`),
+			FailedEventDead,
+			5,
+			[]*FailedEvent{},
+			nil,
+			-1,
+			"",
+		},
+		{
+			[]byte(`{"status": "lost"}`),
+			"lost",
+			DefaultListLimit,
+			nil,
 			nil,
 			jrpc2.InvalidParamsCode,
 			jrpc2.InvalidParamsMsg,
 		},
 		{
-			"abc123",
-			[]byte(`{"id": 0}`),
+			[]byte(`{"limit": 0}`),
+			"",
 			0,
 			nil,
+			nil,
 			jrpc2.InvalidParamsCode,
 			jrpc2.InvalidParamsMsg,
 		},
 		{
-			"abc123",
-			[]byte(`{"id": "abc123"}`),
-			-1,
-			TaskRemoveFailedError,
-			RemoveTaskErrorCode,
-			RemoveTaskErrorMsg,
+			[]byte(`{"status": "pending"}`),
+			FailedEventPending,
+			DefaultListLimit,
+			nil,
+			errors.New("query error"),
+			ListFailedEventsErrorCode,
+			ListFailedEventsErrorMsg,
 		},
 	}
 
-	for _, tt := range table {
+	for i, tt := range table {
 		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
 		taskModel := &MockModel{}
 		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
 		rescModel := &MockModel{}
 		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
-		models := map[string]Model{"tasks": taskModel, "resources": rescModel}
+		eventModel := &MockModel{}
+		models := map[string]Model{"failedEvents": eventModel, "resources": rescModel, "tasks": taskModel}
 		ctrl := &MockController{}
-		ctrl.On("RemoveTask", tt.Id, taskModel).Return(tt.CallErr).Once()
+		ctrl.On("ListFailedEvents", tt.Status, tt.Limit, eventModel).Return(tt.Events, tt.Err)
 		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
-		result, errObj := api.RemoveTask(tt.Body)
-		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
-			t.Fatal(errObj.Message)
+		result, errObj := api.ListFailedEvents(tt.Body)
+		if errObj != nil && (errObj.Code != tt.ErrCode || errObj.Message != tt.ErrMsg) {
+			t.Fatalf("[%d] %s", i, errObj.Message)
 		}
-		if result != nil && result != tt.Result {
-			t.Fatalf("expected %d to be %d", result, tt.Result)
+		if errObj == nil && len(result.([]*FailedEvent)) != len(tt.Events) {
+			t.Fatalf("[%d] expected %d failed events, got %d", i, len(tt.Events), len(result.([]*FailedEvent)))
 		}
 		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
 			ctrl.AssertExpectations(t)
@@ -527,76 +702,253 @@ func TestAp1V1RemoveTask(t *testing.T) {
 	}
 }
 
-func TestAp1V1StartTask(t *testing.T) {
+func TestApiV1ListTasks(t *testing.T) {
 	var table = []struct {
-		Body      []byte
-		Key       string
-		CallErr   error
-		Result    int
-		Notify    bool
-		NotifyErr error
-		ErrCode   jrpc2.ErrorCode
-		ErrMsg    jrpc2.ErrorMsg
+		Body    []byte
+		Status  string
+		Key     string
+		Limit   int
+		Offset  int
+		Err     error
+		Result  *TaskPage
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
 	}{
 		{
-			[]byte(`{"key": "test"}`),
-			"test",
-			nil,
-			0,
-			true,
+			[]byte(`{}`),
+			"",
+			"",
+			DefaultListLimit,
+			0,
 			nil,
+			&TaskPage{Limit: DefaultListLimit},
 			-1,
 			"",
 		},
 		{
-			[]byte(`["test2"]`),
-			"test2",
+			[]byte(`{"status": "queued", "key": "test", "limit": 5, "offset": 10}`),
+			StatusQueued,
+			"test",
+			5,
+			10,
 			nil,
+			&TaskPage{Limit: 5, Offset: 10},
+			-1,
+			"",
+		},
+		{
+			[]byte(`["started", "test", 20]`),
+			StatusStarted,
+			"test",
+			20,
 			0,
-			true,
 			nil,
+			&TaskPage{Limit: 20},
 			-1,
 			"",
 		},
 		{
-			[]byte(`[]`),
+			[]byte(`{"limit": 0}`),
 			"",
+			"",
+			0,
+			0,
+			nil,
 			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`{"offset": -1}`),
+			"",
+			"",
+			DefaultListLimit,
 			-1,
-			true,
+			nil,
 			nil,
 			jrpc2.InvalidParamsCode,
 			jrpc2.InvalidParamsMsg,
 		},
 		{
-			[]byte(`{"keys": "test"}`),
+			[]byte(fmt.Sprintf(`{"limit": 5, "cursor": "%s"}`, PageCursor(20))),
+			"",
 			"",
+			5,
+			20,
 			nil,
+			&TaskPage{Limit: 5, Offset: 20},
 			-1,
-			true,
+			"",
+		},
+		{
+			[]byte(`{"cursor": "not a cursor"}`),
+			"",
+			"",
+			DefaultListLimit,
+			0,
+			nil,
 			nil,
 			jrpc2.InvalidParamsCode,
 			jrpc2.InvalidParamsMsg,
 		},
 		{
-			[]byte(`["", 2]`),
+			[]byte(`{}`),
+			"",
+			"",
+			DefaultListLimit,
+			0,
+			errors.New("query error"),
+			nil,
+			ListTasksErrorCode,
+			ListTasksErrorMsg,
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("ListTasks", tt.Status, tt.Key, mock.Anything, tt.Limit, tt.Offset, taskModel).Return(tt.Result, tt.Err)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.ListTasks(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if errObj == nil && result.(*TaskPage) != tt.Result {
+			t.Fatalf("expected result to be %v, got %v", tt.Result, result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1ListTimetable(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		Key     string
+		Err     error
+		Result  map[string]interface{}
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{
+			[]byte(`{"key": "test"}`),
+			"test",
+			nil,
+			map[string]interface{}{"_key": "test"},
+			-1,
 			"",
+		},
+		{
+			[]byte(`["test"]`),
+			"test",
 			nil,
+			map[string]interface{}{"_key": "test"},
 			-1,
-			true,
+			"",
+		},
+		{
+			[]byte(`["test", 25]`),
+			"test",
+			nil,
+			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`{"keys", 25}`),
+			"test",
+			nil,
+			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`{"key", 25}`),
+			"test",
+			nil,
 			nil,
 			jrpc2.InvalidParamsCode,
 			jrpc2.InvalidParamsMsg,
 		},
+		{
+			[]byte(`{"key": "test"}`),
+			"test",
+			QueueNotFoundError,
+			nil,
+			ListTimetableErrorCode,
+			ListTimetableErrorMsg,
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("ListTimetable", tt.Key).Return(tt.Result, tt.Err)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.ListTimetable(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if result != nil && result.(map[string]interface{})["_key"] != tt.Result["_key"] {
+			t.Fatalf("expected key to be %d, go %d", tt.Result["_key"], result.(map[string]interface{})["_key"])
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1PauseResource(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		Name    string
+		CallErr error
+		Result  int
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{
+			[]byte(`{"name": "test"}`),
+			"test",
+			nil,
+			0,
+			-1,
+			"",
+		},
 		{
 			[]byte(`["test"]`),
 			"test",
-			TaskAlreadyStartedError,
+			nil,
+			0,
 			-1,
-			false,
+			"",
+		},
+		{
+			[]byte(`{"key": "test"}`),
+			"",
 			nil,
-			StartTaskErrorCode,
-			StartTaskErrorMsg,
+			0,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`["test"]`),
+			"test",
+			ResourceNotFoundError,
+			-1,
+			PauseResourceErrorCode,
+			PauseResourceErrorMsg,
 		},
 	}
 
@@ -606,11 +958,77 @@ func TestAp1V1StartTask(t *testing.T) {
 		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
 		rescModel := &MockModel{}
 		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
 		ctrl := &MockController{}
-		ctrl.On("StartTask", tt.Key, taskModel, rescModel).Return(tt.CallErr)
+		ctrl.On("PauseResource", tt.Name, rescModel).Return(tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.PauseResource(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if result != nil && result != tt.Result {
+			t.Fatalf("expected result to be %d, go %d", tt.Result, result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1RemoveResource(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		Name    string
+		CallErr error
+		Result  int
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{
+			[]byte(`{"name": "test"}`),
+			"test",
+			nil,
+			0,
+			-1,
+			"",
+		},
+		{
+			[]byte(`["test"]`),
+			"test",
+			nil,
+			0,
+			-1,
+			"",
+		},
+		{
+			[]byte(`{"key": "test"}`),
+			"",
+			nil,
+			0,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`["test"]`),
+			"test",
+			ResourceNotFoundError,
+			-1,
+			RemoveResourceErrorCode,
+			RemoveResourceErrorMsg,
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
 		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("RemoveResource", tt.Name, taskModel, rescModel).Return(tt.CallErr)
 		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
-		result, errObj := api.StartTask(tt.Body)
+		result, errObj := api.RemoveResource(tt.Body)
 		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
 			t.Fatal(errObj.Message)
 		}
@@ -622,3 +1040,1896 @@ func TestAp1V1StartTask(t *testing.T) {
 		}
 	}
 }
+
+func TestAp1V1RemoveTask(t *testing.T) {
+	var table = []struct {
+		Id      string
+		Reason  string
+		Body    []byte
+		Result  int
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{
+			"abc123",
+			"",
+			[]byte(`{"id": "abc123"}`),
+			0,
+			nil,
+			-1,
+			"",
+		},
+		{
+			"abc123",
+			"duplicate",
+			[]byte(`["abc123", "duplicate"]`),
+			0,
+			nil,
+			-1,
+			"",
+		},
+		{
+			"abc123",
+			"",
+			[]byte(`{"key": "test"}`),
+			0,
+			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			"abc123",
+			"",
+			[]byte(`{"id": 0}`),
+			0,
+			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			"abc123",
+			"",
+			[]byte(`{"id": "abc123"}`),
+			-1,
+			TaskRemoveFailedError,
+			RemoveTaskErrorCode,
+			RemoveTaskErrorMsg,
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		archiveModel := &MockModel{}
+		models := map[string]Model{"tasks": taskModel, "resources": rescModel, "taskArchive": archiveModel}
+		ctrl := &MockController{}
+		ctrl.On("RemoveTask", tt.Id, tt.Reason, taskModel, archiveModel).Return(tt.CallErr).Once()
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.RemoveTask(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if result != nil && result != tt.Result {
+			t.Fatalf("expected %d to be %d", result, tt.Result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestAp1V1StartTask(t *testing.T) {
+	var table = []struct {
+		Body      []byte
+		Key       string
+		CallErr   error
+		Result    int
+		Notify    bool
+		NotifyErr error
+		ErrCode   jrpc2.ErrorCode
+		ErrMsg    jrpc2.ErrorMsg
+	}{
+		{
+			[]byte(`{"key": "test"}`),
+			"test",
+			nil,
+			0,
+			true,
+			nil,
+			-1,
+			"",
+		},
+		{
+			[]byte(`["test2"]`),
+			"test2",
+			nil,
+			0,
+			true,
+			nil,
+			-1,
+			"",
+		},
+		{
+			[]byte(`[]`),
+			"",
+			nil,
+			-1,
+			true,
+			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`{"keys": "test"}`),
+			"",
+			nil,
+			-1,
+			true,
+			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`["", 2]`),
+			"",
+			nil,
+			-1,
+			true,
+			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`["test"]`),
+			"test",
+			TaskAlreadyStartedError,
+			-1,
+			false,
+			nil,
+			StartTaskErrorCode,
+			StartTaskErrorMsg,
+		},
+		{
+			[]byte(`["test"]`),
+			"test",
+			AtCapacityError,
+			-1,
+			false,
+			nil,
+			AtCapacityErrorCode,
+			AtCapacityErrorMsg,
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		ctrl := &MockController{}
+		ctrl.On("StartTask", tt.Key, mock.AnythingOfType("string"), taskModel, rescModel).Return(tt.CallErr)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.StartTask(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if result != nil && result != tt.Result {
+			t.Fatalf("expected result to be %d, go %d", tt.Result, result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1ResumeResource(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		Name    string
+		CallErr error
+		Result  int
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{
+			[]byte(`{"name": "test"}`),
+			"test",
+			nil,
+			0,
+			-1,
+			"",
+		},
+		{
+			[]byte(`["test"]`),
+			"test",
+			nil,
+			0,
+			-1,
+			"",
+		},
+		{
+			[]byte(`{"key": "test"}`),
+			"",
+			nil,
+			0,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`["test"]`),
+			"test",
+			ResourceNotFoundError,
+			-1,
+			ResumeResourceErrorCode,
+			ResumeResourceErrorMsg,
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("ResumeResource", tt.Name, rescModel).Return(tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.ResumeResource(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if result != nil && result != tt.Result {
+			t.Fatalf("expected result to be %d, go %d", tt.Result, result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1RetryTask(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		Id      string
+		CallErr error
+		Result  int
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{
+			[]byte(`{"id": "abc123"}`),
+			"abc123",
+			nil,
+			0,
+			-1,
+			"",
+		},
+		{
+			[]byte(`["abc123"]`),
+			"abc123",
+			nil,
+			0,
+			-1,
+			"",
+		},
+		{
+			[]byte(`{"key": "test"}`),
+			"",
+			nil,
+			0,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`["abc123"]`),
+			"abc123",
+			TaskNotRetryableError,
+			-1,
+			RetryTaskErrorCode,
+			RetryTaskErrorMsg,
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("RetryTask", tt.Id, taskModel).Return(tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.RetryTask(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if result != nil && result != tt.Result {
+			t.Fatalf("expected result to be %d, go %d", tt.Result, result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1UpdateTaskPriority(t *testing.T) {
+	var table = []struct {
+		Body     []byte
+		Id       string
+		Priority float64
+		CallErr  error
+		Result   int
+		ErrCode  jrpc2.ErrorCode
+		ErrMsg   jrpc2.ErrorMsg
+	}{
+		{
+			[]byte(`{"id": "abc123", "priority": 1.5}`),
+			"abc123",
+			1.5,
+			nil,
+			0,
+			-1,
+			"",
+		},
+		{
+			[]byte(`["abc123", 0.5]`),
+			"abc123",
+			0.5,
+			nil,
+			0,
+			-1,
+			"",
+		},
+		{
+			[]byte(`{"id": "abc123"}`),
+			"",
+			0,
+			nil,
+			0,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`{"priority": 1.5}`),
+			"",
+			0,
+			nil,
+			0,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`["abc123", 1.5]`),
+			"abc123",
+			1.5,
+			TaskNotQueuedError,
+			-1,
+			UpdateTaskPriorityErrorCode,
+			UpdateTaskPriorityErrorMsg,
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("UpdateTaskPriority", tt.Id, tt.Priority, taskModel).Return(tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.UpdateTaskPriority(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if result != nil && result != tt.Result {
+			t.Fatalf("expected result to be %d, go %d", tt.Result, result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1RescheduleTask(t *testing.T) {
+	runAt := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	var table = []struct {
+		Body    []byte
+		Id      string
+		CallErr error
+		Result  int
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{
+			[]byte(`{"id": "abc123", "runAt": "2018-01-01T12:00:00Z"}`),
+			"abc123",
+			nil,
+			0,
+			-1,
+			"",
+		},
+		{
+			[]byte(`["abc123", "2018-01-01T12:00:00Z"]`),
+			"abc123",
+			nil,
+			0,
+			-1,
+			"",
+		},
+		{
+			[]byte(`{"id": "abc123"}`),
+			"",
+			nil,
+			0,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`{"id": "abc123", "runAt": "tomorrow"}`),
+			"",
+			nil,
+			0,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`["abc123", "2018-01-01T12:00:00Z"]`),
+			"abc123",
+			TaskNotScheduledError,
+			-1,
+			RescheduleTaskErrorCode,
+			RescheduleTaskErrorMsg,
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("RescheduleTask", tt.Id, mock.MatchedBy(func(v time.Time) bool { return v.Equal(runAt) }), taskModel).Return(tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.RescheduleTask(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if result != nil && result != tt.Result {
+			t.Fatalf("expected result to be %d, go %d", tt.Result, result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1GetTaskHistory(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		Id      string
+		History []*TaskHistory
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{
+			[]byte(`{"id": "abc123"}`),
+			"abc123",
+			[]*TaskHistory{NewTaskHistory("abc123", "", StatusCreated, "task added")},
+			nil,
+			-1,
+			"",
+		},
+		{
+			[]byte(`["abc123"]`),
+			"abc123",
+			[]*TaskHistory{NewTaskHistory("abc123", "", StatusCreated, "task added")},
+			nil,
+			-1,
+			"",
+		},
+		{
+			[]byte(`{"key": "test"}`),
+			"",
+			nil,
+			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`["abc123"]`),
+			"abc123",
+			nil,
+			errors.New("query error"),
+			GetTaskHistoryErrorCode,
+			GetTaskHistoryErrorMsg,
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		historyModel := &MockModel{}
+		models := map[string]Model{"resources": rescModel, "taskHistory": historyModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("GetTaskHistory", tt.Id, historyModel).Return(tt.History, tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.GetTaskHistory(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if result != nil && len(result.([]*TaskHistory)) != len(tt.History) {
+			t.Fatalf("expected %d history entries, got %d", len(tt.History), len(result.([]*TaskHistory)))
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1GetTaskStats(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		Key     string
+		Stats   *TaskStats
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{
+			[]byte(`{"key": "test"}`),
+			"test",
+			&TaskStats{Average: 2.5, Count: 2, Key: "test", Max: 3.0, Min: 2.0},
+			nil,
+			-1,
+			"",
+		},
+		{
+			[]byte(`["test"]`),
+			"test",
+			&TaskStats{Key: "test"},
+			nil,
+			-1,
+			"",
+		},
+		{
+			[]byte(`{"id": "abc123"}`),
+			"",
+			nil,
+			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`["test"]`),
+			"test",
+			nil,
+			errors.New("query error"),
+			GetTaskStatsErrorCode,
+			GetTaskStatsErrorMsg,
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		statModel := &MockModel{}
+		models := map[string]Model{"resources": rescModel, "taskStats": statModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("GetTaskStats", tt.Key, statModel).Return(tt.Stats, tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.GetTaskStats(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if result != nil && result.(*TaskStats) != tt.Stats {
+			t.Fatalf("expected stats %+v, got %+v", tt.Stats, result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1Health(t *testing.T) {
+	var table = []struct {
+		Deps    map[string]*DependencyStatus
+		Healthy bool
+	}{
+		{
+			map[string]*DependencyStatus{"priorityQueue": {Healthy: true}},
+			PingDatabase() == nil,
+		},
+		{
+			map[string]*DependencyStatus{"priorityQueue": {Error: "connection refused"}},
+			false,
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("Health").Return(tt.Deps)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.Health([]byte(`[]`))
+		if errObj != nil {
+			t.Fatal(errObj.Message)
+		}
+		report := result.(*HealthReport)
+		if report.Healthy != tt.Healthy {
+			t.Fatalf("expected healthy to be %v, got %v", tt.Healthy, report.Healthy)
+		}
+		if _, ok := report.Dependencies["arangodb"]; !ok {
+			t.Fatal("expected arangodb health to be reported")
+		}
+		ctrl.AssertExpectations(t)
+	}
+}
+
+func TestApiV1ServerInfo(t *testing.T) {
+	q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+	taskModel := &MockModel{}
+	taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+	rescModel := &MockModel{}
+	rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+	models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+	info := &ServerInfo{Version: "1.0.0", ResourceCount: 2}
+	ctrl := &MockController{}
+	ctrl.On("ServerInfo").Return(info)
+	api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+	result, errObj := api.ServerInfo([]byte(`[]`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if result.(*ServerInfo) != info {
+		t.Fatalf("expected server info %+v, got %+v", info, result)
+	}
+	ctrl.AssertExpectations(t)
+}
+
+func TestApiV1PurgeTasks(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		Age     time.Duration
+		Limit   int
+		Count   int
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{
+			[]byte(`{"age": 3600}`),
+			time.Hour,
+			MaxListLimit,
+			4,
+			nil,
+			-1,
+			"",
+		},
+		{
+			[]byte(`[60, 10]`),
+			time.Minute,
+			10,
+			2,
+			nil,
+			-1,
+			"",
+		},
+		{
+			[]byte(`{"limit": 10}`),
+			0,
+			0,
+			0,
+			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`{"age": -5}`),
+			0,
+			0,
+			0,
+			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`{"age": 60, "limit": 5000}`),
+			0,
+			0,
+			0,
+			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`[60]`),
+			time.Minute,
+			MaxListLimit,
+			0,
+			errors.New("query error"),
+			PurgeTasksErrorCode,
+			PurgeTasksErrorMsg,
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("PurgeTasks", tt.Age, tt.Limit, taskModel).Return(tt.Count, tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.PurgeTasks(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if result != nil && result != tt.Count {
+			t.Fatalf("expected result to be %d, got %d", tt.Count, result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1SearchTasks(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		Filters map[string]interface{}
+		Limit   int
+		Offset  int
+		Err     error
+		Result  *TaskPage
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{
+			[]byte(`{"filters": {"order.id": "A-1001"}}`),
+			map[string]interface{}{"order.id": "A-1001"},
+			DefaultListLimit,
+			0,
+			nil,
+			&TaskPage{Limit: DefaultListLimit},
+			-1,
+			"",
+		},
+		{
+			[]byte(`[{"customer": 12}, 5, 10]`),
+			map[string]interface{}{"customer": float64(12)},
+			5,
+			10,
+			nil,
+			&TaskPage{Limit: 5, Offset: 10},
+			-1,
+			"",
+		},
+		{
+			[]byte(`{"filters": {}}`),
+			nil,
+			0,
+			0,
+			nil,
+			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`{"filters": {"order..id": "A-1001"}}`),
+			nil,
+			0,
+			0,
+			nil,
+			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`{"filters": {"order.id": "A-1001"}, "limit": 0}`),
+			nil,
+			0,
+			0,
+			nil,
+			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`{"filters": {"order.id": "A-1001"}}`),
+			map[string]interface{}{"order.id": "A-1001"},
+			DefaultListLimit,
+			0,
+			errors.New("query error"),
+			nil,
+			SearchTasksErrorCode,
+			SearchTasksErrorMsg,
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("SearchTasks", tt.Filters, mock.Anything, tt.Limit, tt.Offset, taskModel).Return(tt.Result, tt.Err)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.SearchTasks(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if errObj == nil && result.(*TaskPage) != tt.Result {
+			t.Fatalf("expected result to be %v, got %v", tt.Result, result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1GetStagedTask(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		Key     string
+		Task    *StagedTask
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{
+			[]byte(`{"key": "test"}`),
+			"test",
+			&StagedTask{Id: "abc123", Key: "test", StagedFor: 2.5},
+			nil,
+			-1,
+			"",
+		},
+		{
+			[]byte(`["test"]`),
+			"test",
+			&StagedTask{Id: "abc123", Key: "test"},
+			nil,
+			-1,
+			"",
+		},
+		{
+			[]byte(`{"name": "test"}`),
+			"",
+			nil,
+			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`["test"]`),
+			"test",
+			nil,
+			NoStagedTaskError,
+			GetStagedTaskErrorCode,
+			GetStagedTaskErrorMsg,
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("GetStagedTask", tt.Key).Return(tt.Task, tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.GetStagedTask(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if errObj == nil && result.(*StagedTask) != tt.Task {
+			t.Fatalf("expected result to be %v, got %v", tt.Task, result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1ListStagedTasks(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		Key     string
+		Tasks   []*StagedTask
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{
+			[]byte(`{"key": "test"}`),
+			"test",
+			[]*StagedTask{{Id: "abc123", Key: "test"}, {Id: "def456", Key: "test"}},
+			nil,
+			-1,
+			"",
+		},
+		{
+			[]byte(`["test"]`),
+			"test",
+			[]*StagedTask{},
+			nil,
+			-1,
+			"",
+		},
+		{
+			[]byte(`{"name": "test"}`),
+			"",
+			nil,
+			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`["test"]`),
+			"test",
+			nil,
+			errors.New("list error"),
+			ListStagedTasksErrorCode,
+			ListStagedTasksErrorMsg,
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("ListStagedTasks", tt.Key).Return(tt.Tasks, tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.ListStagedTasks(tt.Body)
+		if errObj != nil && (errObj.Code != tt.ErrCode || errObj.Message != tt.ErrMsg) {
+			t.Fatal(errObj.Message)
+		}
+		if errObj == nil && fmt.Sprint(result) != fmt.Sprint(tt.Tasks) {
+			t.Fatalf("expected result to be %v, got %v", tt.Tasks, result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1UnstageTask(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		Key     string
+		CallErr error
+		Result  int
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{
+			[]byte(`{"key": "test"}`),
+			"test",
+			nil,
+			0,
+			-1,
+			"",
+		},
+		{
+			[]byte(`["test"]`),
+			"test",
+			nil,
+			0,
+			-1,
+			"",
+		},
+		{
+			[]byte(`{"id": "abc123"}`),
+			"",
+			nil,
+			0,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`["test"]`),
+			"test",
+			NoStagedTaskError,
+			-1,
+			UnstageTaskErrorCode,
+			UnstageTaskErrorMsg,
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("UnstageTask", tt.Key, taskModel).Return(tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.UnstageTask(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if result != nil && result != tt.Result {
+			t.Fatalf("expected result to be %d, go %d", tt.Result, result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1ForceCompleteTask(t *testing.T) {
+	defer func(token string) { AdminToken = token }(AdminToken)
+	AdminToken = "secret"
+	var table = []struct {
+		Body    []byte
+		Id      string
+		Status  string
+		Reason  string
+		CallErr error
+		Result  int
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{
+			[]byte(`{"id": "abc123", "status": "complete", "token": "secret", "reason": "worker crashed"}`),
+			"abc123",
+			StatusComplete,
+			"worker crashed",
+			nil,
+			0,
+			-1,
+			"",
+		},
+		{
+			[]byte(`["abc123", "cancelled", "secret"]`),
+			"abc123",
+			StatusCancelled,
+			"",
+			nil,
+			0,
+			-1,
+			"",
+		},
+		{
+			[]byte(`{"id": "abc123", "status": "complete", "token": "wrong"}`),
+			"",
+			"",
+			"",
+			nil,
+			0,
+			UnauthorizedErrorCode,
+			UnauthorizedErrorMsg,
+		},
+		{
+			[]byte(`{"id": "abc123", "status": "queued", "token": "secret"}`),
+			"",
+			"",
+			"",
+			nil,
+			0,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`["abc123", "complete", "secret"]`),
+			"abc123",
+			StatusComplete,
+			"",
+			TaskNotFoundError,
+			-1,
+			ForceCompleteTaskErrorCode,
+			ForceCompleteTaskErrorMsg,
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("ForceCompleteTask", tt.Id, tt.Status, tt.Reason, taskModel, rescModel).Return(tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.ForceCompleteTask(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if result != nil && result != tt.Result {
+			t.Fatalf("expected result to be %d, go %d", tt.Result, result)
+		}
+		if errObj == nil || errObj.Code == ForceCompleteTaskErrorCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1CountTasks(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		ByKey   bool
+		Counts  []*TaskCount
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{
+			[]byte(`{}`),
+			false,
+			[]*TaskCount{{Count: 3, Status: StatusQueued}},
+			nil,
+			-1,
+			"",
+		},
+		{
+			[]byte(`[true]`),
+			true,
+			[]*TaskCount{{Count: 3, Key: "test", Status: StatusQueued}},
+			nil,
+			-1,
+			"",
+		},
+		{
+			[]byte(`{"byKey": false}`),
+			false,
+			nil,
+			errors.New("query error"),
+			CountTasksErrorCode,
+			CountTasksErrorMsg,
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		countModel := &MockModel{}
+		models := map[string]Model{"resources": rescModel, "taskCounts": countModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("CountTasks", tt.ByKey, countModel).Return(tt.Counts, tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.CountTasks(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if errObj == nil && len(result.([]*TaskCount)) != len(tt.Counts) {
+			t.Fatalf("expected %d counts, got %d", len(tt.Counts), len(result.([]*TaskCount)))
+		}
+		ctrl.AssertExpectations(t)
+	}
+}
+
+func TestApiV1GetGroupStatus(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		GroupId string
+		Status  *GroupStatus
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{
+			[]byte(`{"groupId": "batch-1"}`),
+			"batch-1",
+			&GroupStatus{GroupId: "batch-1", Total: 2, Counts: map[string]int{StatusComplete: 2}, Complete: true},
+			nil,
+			-1,
+			"",
+		},
+		{
+			[]byte(`["batch-1"]`),
+			"batch-1",
+			&GroupStatus{GroupId: "batch-1", Total: 1, Counts: map[string]int{StatusQueued: 1}},
+			nil,
+			-1,
+			"",
+		},
+		{
+			[]byte(`{"id": "batch-1"}`),
+			"",
+			nil,
+			nil,
+			jrpc2.InvalidParamsCode,
+			jrpc2.InvalidParamsMsg,
+		},
+		{
+			[]byte(`["batch-2"]`),
+			"batch-2",
+			nil,
+			GroupNotFoundError,
+			GetGroupStatusErrorCode,
+			GetGroupStatusErrorMsg,
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		groupModel := &MockModel{}
+		models := map[string]Model{"resources": rescModel, "taskGroups": groupModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("GetGroupStatus", tt.GroupId, groupModel).Return(tt.Status, tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.GetGroupStatus(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if errObj == nil && result.(*GroupStatus) != tt.Status {
+			t.Fatalf("expected result to be %v, got %v", tt.Status, result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1Heartbeat(t *testing.T) {
+	leaseExpires := time.Now().Add(LeaseDuration)
+	var table = []struct {
+		Body    []byte
+		Id      string
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{[]byte(`{"id": "abc123"}`), "abc123", nil, -1, ""},
+		{[]byte(`["abc123"]`), "abc123", nil, -1, ""},
+		{[]byte(`{"key": "test"}`), "", nil, jrpc2.InvalidParamsCode, jrpc2.InvalidParamsMsg},
+		{[]byte(`["abc123"]`), "abc123", TaskNotStartedError, HeartbeatErrorCode, HeartbeatErrorMsg},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("Heartbeat", tt.Id, taskModel).Return(leaseExpires, tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.Heartbeat(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if errObj == nil && result != leaseExpires.Format(time.RFC3339) {
+			t.Fatalf("expected result to be %s, got %v", leaseExpires.Format(time.RFC3339), result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1AppendTaskLog(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		Stream  string
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{[]byte(`{"id": "abc123", "data": "line"}`), "stdout", nil, -1, ""},
+		{[]byte(`["abc123", "line", "stderr"]`), "stderr", nil, -1, ""},
+		{[]byte(`{"id": "abc123"}`), "", nil, jrpc2.InvalidParamsCode, jrpc2.InvalidParamsMsg},
+		{[]byte(`{"id": "abc123", "data": "line", "stream": "stdin"}`), "", nil, jrpc2.InvalidParamsCode, jrpc2.InvalidParamsMsg},
+		{[]byte(`["abc123", "line"]`), "stdout", TaskNotFoundError, AppendTaskLogErrorCode, AppendTaskLogErrorMsg},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		logModel := &MockModel{}
+		models := map[string]Model{"resources": rescModel, "taskLogs": logModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("AppendTaskLog", "abc123", tt.Stream, "line", taskModel, logModel).Return(tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.AppendTaskLog(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if errObj == nil && result != 0 {
+			t.Fatalf("expected result to be 0, got %v", result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestNewApiV1RestoresResources(t *testing.T) {
+	resource := &Resource{Name: "test", Status: ResourceLocked, TaskId: "abc123"}
+	q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+	taskModel := &MockModel{}
+	taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+	rescModel := &MockModel{}
+	rescModel.On("FetchAll").Return([]interface{}{resource}, nil)
+	models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+	ctrl := &MockController{}
+	ctrl.On("RestoreResource", resource, taskModel, rescModel).Return(nil).Once()
+	NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+	ctrl.AssertExpectations(t)
+}
+
+func TestNewApiV1RestoresStagedTasks(t *testing.T) {
+	task := &Task{Id: "abc123", Key: "test", Status: StatusPending}
+	q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+	taskModel := &MockModel{}
+	taskModel.On("Query", q, map[string]interface{}{}).Return([]interface{}{task}, nil)
+	rescModel := &MockModel{}
+	rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+	models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+	ctrl := &MockController{}
+	ctrl.On("RestoreStagedTask", task, taskModel).Return(nil).Once()
+	NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+	ctrl.AssertExpectations(t)
+}
+
+func TestApiV1RestoreTask(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{[]byte(`{"id": "abc123"}`), nil, -1, ""},
+		{[]byte(`["abc123"]`), nil, -1, ""},
+		{[]byte(`{"key": "test"}`), nil, jrpc2.InvalidParamsCode, jrpc2.InvalidParamsMsg},
+		{[]byte(`["abc123"]`), TaskNotFoundError, RestoreTaskErrorCode, RestoreTaskErrorMsg},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		archiveModel := &MockModel{}
+		models := map[string]Model{"resources": rescModel, "taskArchive": archiveModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("RestoreTask", "abc123", taskModel, rescModel, archiveModel).Return(tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.RestoreTask(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if errObj == nil && result != 0 {
+			t.Fatalf("expected result to be 0, got %v", result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1AcknowledgePreemption(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{[]byte(`{"id": "abc123"}`), nil, -1, ""},
+		{[]byte(`["abc123"]`), nil, -1, ""},
+		{[]byte(`{"key": "test"}`), nil, jrpc2.InvalidParamsCode, jrpc2.InvalidParamsMsg},
+		{[]byte(`["abc123"]`), PreemptNotRequestedError, AcknowledgePreemptErrorCode, AcknowledgePreemptErrorMsg},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("AcknowledgePreemption", "abc123", taskModel, rescModel).Return(tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.AcknowledgePreemption(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if errObj == nil && result != 0 {
+			t.Fatalf("expected result to be 0, got %v", result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1EstimateStart(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{[]byte(`{"id": "abc123"}`), nil, -1, ""},
+		{[]byte(`["abc123"]`), nil, -1, ""},
+		{[]byte(`{"key": "test"}`), nil, jrpc2.InvalidParamsCode, jrpc2.InvalidParamsMsg},
+		{[]byte(`["abc123"]`), TaskNotQueuedError, EstimateStartErrorCode, EstimateStartErrorMsg},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		statModel := &MockModel{}
+		models := map[string]Model{"resources": rescModel, "taskStats": statModel, "tasks": taskModel}
+		estimate := &StartEstimate{Id: "abc123", Position: 3}
+		if tt.CallErr != nil {
+			estimate = nil
+		}
+		ctrl := &MockController{}
+		ctrl.On("EstimateStart", "abc123", taskModel, statModel).Return(estimate, tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.EstimateStart(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if errObj == nil && result.(*StartEstimate).Position != 3 {
+			t.Fatalf("unexpected estimate %+v", result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1PauseTask(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{[]byte(`{"id": "abc123"}`), nil, -1, ""},
+		{[]byte(`["abc123"]`), nil, -1, ""},
+		{[]byte(`{"key": "test"}`), nil, jrpc2.InvalidParamsCode, jrpc2.InvalidParamsMsg},
+		{[]byte(`["abc123"]`), TaskNotQueuedError, PauseTaskErrorCode, PauseTaskErrorMsg},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("PauseTask", "abc123", taskModel).Return(tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.PauseTask(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if errObj == nil && result != 0 {
+			t.Fatalf("expected result to be 0, got %v", result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1ResumeTask(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+		ErrMsg  jrpc2.ErrorMsg
+	}{
+		{[]byte(`{"id": "abc123"}`), nil, -1, ""},
+		{[]byte(`["abc123"]`), nil, -1, ""},
+		{[]byte(`{"key": "test"}`), nil, jrpc2.InvalidParamsCode, jrpc2.InvalidParamsMsg},
+		{[]byte(`["abc123"]`), TaskNotPausedError, ResumeTaskErrorCode, ResumeTaskErrorMsg},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("ResumeTask", "abc123", taskModel).Return(tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.ResumeTask(tt.Body)
+		if errObj != nil && errObj.Code != tt.ErrCode && errObj.Message != tt.ErrMsg {
+			t.Fatal(errObj.Message)
+		}
+		if errObj == nil && result != 0 {
+			t.Fatalf("expected result to be 0, got %v", result)
+		}
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			ctrl.AssertExpectations(t)
+		}
+	}
+}
+
+func TestApiV1AddTaskRunAfter(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		RunAt   time.Duration
+		ErrCode jrpc2.ErrorCode
+	}{
+		{[]byte(`{"key": "test", "runAfter": "15m"}`), 15 * time.Minute, -1},
+		{[]byte(`{"key": "test", "priority": 1, "runAfter": "0s"}`), 0, -1},
+		{[]byte(`{"key": "test", "runAfter": "-5m"}`), 0, jrpc2.InvalidParamsCode},
+		{[]byte(`{"key": "test", "runAfter": "soon"}`), 0, jrpc2.InvalidParamsCode},
+		{[]byte(`{"key": "test", "runAt": "2030-01-01T00:00:00Z", "runAfter": "15m"}`), 0, jrpc2.InvalidParamsCode},
+	}
+
+	for i, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"tasks": taskModel, "resources": rescModel}
+		var task *Task
+		ctrl := &MockController{}
+		ctrl.On("AddTask", mock.AnythingOfType("*main.Task"), taskModel, rescModel).Return(nil).Run(func(args mock.Arguments) {
+			task = args.Get(0).(*Task)
+		})
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		_, errObj := api.AddTask(tt.Body)
+		if errObj != nil {
+			if errObj.Code != tt.ErrCode {
+				t.Fatalf("[%d] expected error code %d, got %d", i, tt.ErrCode, errObj.Code)
+			}
+			continue
+		}
+		if tt.ErrCode != -1 {
+			t.Fatalf("[%d] expected error code %d", i, tt.ErrCode)
+		}
+		if task.RunAt == nil || math.Abs(time.Until(*task.RunAt).Seconds()-tt.RunAt.Seconds()) > 2 {
+			t.Fatalf("[%d] expected run at in %s, got %v", i, tt.RunAt, task.RunAt)
+		}
+	}
+}
+
+func TestApiV1AddTaskValidateOnly(t *testing.T) {
+	defer func(schema *MetaSchema) { TaskMetaSchema = schema }(TaskMetaSchema)
+	TaskMetaSchema = &MetaSchema{Properties: map[string]MetaProperty{"image": {"string"}}}
+	var table = []struct {
+		Body       []byte
+		Validation *TaskValidation
+		CallErr    error
+		ErrCode    jrpc2.ErrorCode
+	}{
+		{[]byte(`{"key": "test", "priority": 1, "validateOnly": true}`), &TaskValidation{false, "test", StatusQueued}, nil, -1},
+		{[]byte(`["test", {}, 1, "", 0, 0, [], "2030-01-01T00:00:00Z", {}, "group1", "", "15m", "https://example.com/done", {}, true]`), &TaskValidation{true, "test", StatusScheduled}, nil, -1},
+		{[]byte(`{"key": "test", "priority": 1, "parentId": "parent1", "validateOnly": true}`), nil, ParentNotFoundError, AddTaskErrorCode},
+		{[]byte(`{"key": "test", "priority": -1, "validateOnly": true}`), nil, nil, jrpc2.InvalidParamsCode},
+		{[]byte(`{"key": "test", "runAt": "tomorrow", "validateOnly": true}`), nil, nil, jrpc2.InvalidParamsCode},
+		{[]byte(`{"key": "test", "priority": -1}`), nil, nil, jrpc2.InvalidParamsCode},
+		{[]byte(`{"key": "test", "priority": 1, "meta": {"image": "alpine"}, "validateOnly": true}`), &TaskValidation{false, "test", StatusQueued}, nil, -1},
+		{[]byte(`{"key": "test", "priority": 1, "meta": {"image": 3}, "validateOnly": true}`), nil, nil, jrpc2.InvalidParamsCode},
+		{[]byte(`{"key": "test", "priority": 1, "meta": {"image": 3}}`), nil, nil, jrpc2.InvalidParamsCode},
+	}
+
+	for i, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"tasks": taskModel, "resources": rescModel}
+		ctrl := &MockController{}
+		ctrl.On("ValidateTask", mock.AnythingOfType("*main.Task"), taskModel).Return(tt.Validation, tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.AddTask(tt.Body)
+		if errObj != nil {
+			if errObj.Code != tt.ErrCode {
+				t.Fatalf("[%d] expected error code %d, got %d", i, tt.ErrCode, errObj.Code)
+			}
+			continue
+		}
+		if tt.ErrCode != -1 {
+			t.Fatalf("[%d] expected error code %d", i, tt.ErrCode)
+		}
+		if result != tt.Validation {
+			t.Fatalf("[%d] expected result %+v, got %+v", i, tt.Validation, result)
+		}
+		ctrl.AssertNotCalled(t, "AddTask", mock.Anything, mock.Anything, mock.Anything)
+	}
+}
+
+func TestApiV1RegisterResource(t *testing.T) {
+	var table = []struct {
+		Body     []byte
+		Tags     map[string]string
+		Capacity int
+		CallErr  error
+		ErrCode  jrpc2.ErrorCode
+	}{
+		{[]byte(`{"name": "worker"}`), nil, 1, nil, -1},
+		{[]byte(`["worker", {"gpu": "true"}, 4]`), map[string]string{"gpu": "true"}, 4, nil, -1},
+		{[]byte(`{"tags": {"gpu": "true"}}`), nil, 0, nil, jrpc2.InvalidParamsCode},
+		{[]byte(`{"name": "worker", "capacity": 0}`), nil, 0, nil, jrpc2.InvalidParamsCode},
+		{[]byte(`{"name": "worker", "capacity": 65}`), nil, 0, nil, jrpc2.InvalidParamsCode},
+		{[]byte(`{"name": "worker", "tags": {"": "true"}}`), nil, 0, nil, jrpc2.InvalidParamsCode},
+		{[]byte(`{"name": "worker"}`), nil, 1, PoolConflictError, RegisterResourceErrorCode},
+	}
+
+	for i, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		slots := []string{"worker:1"}
+		ctrl := &MockController{}
+		ctrl.On("RegisterResource", "worker", tt.Tags, tt.Capacity, taskModel, rescModel).Return(slots, tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.RegisterResource(tt.Body)
+		if errObj != nil {
+			if errObj.Code != tt.ErrCode {
+				t.Fatalf("[%d] expected error code %d, got %d", i, tt.ErrCode, errObj.Code)
+			}
+			continue
+		}
+		if fmt.Sprint(result) != fmt.Sprint(slots) {
+			t.Fatalf("[%d] expected result %v, got %v", i, slots, result)
+		}
+		ctrl.AssertExpectations(t)
+	}
+}
+
+func TestApiV1ResourceHeartbeat(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		Name    string
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+	}{
+		{[]byte(`{"name": "test"}`), "test", nil, -1},
+		{[]byte(`["test"]`), "test", nil, -1},
+		{[]byte(`{"key": "test"}`), "", nil, jrpc2.InvalidParamsCode},
+		{[]byte(`["test"]`), "test", ResourceNotFoundError, ResourceHeartbeatErrorCode},
+	}
+
+	for i, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("ResourceHeartbeat", tt.Name, rescModel).Return(tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.ResourceHeartbeat(tt.Body)
+		if errObj != nil {
+			if errObj.Code != tt.ErrCode {
+				t.Fatalf("[%d] expected error code %d, got %d", i, tt.ErrCode, errObj.Code)
+			}
+			continue
+		}
+		if result != 0 {
+			t.Fatalf("[%d] expected result to be 0, got %v", i, result)
+		}
+		ctrl.AssertExpectations(t)
+	}
+}
+
+func TestApiV1GetResourceStats(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		Name    string
+		Windows []time.Duration
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+	}{
+		{[]byte(`{"name": "test"}`), "test", DefaultStatWindows, nil, -1},
+		{[]byte(`["test", [60, 3600]]`), "test", []time.Duration{time.Minute, time.Hour}, nil, -1},
+		{[]byte(`{"windows": [60]}`), "", nil, nil, jrpc2.InvalidParamsCode},
+		{[]byte(`{"name": "test", "windows": []}`), "", nil, nil, jrpc2.InvalidParamsCode},
+		{[]byte(`{"name": "test", "windows": [-60]}`), "", nil, nil, jrpc2.InvalidParamsCode},
+		{[]byte(`["test"]`), "test", DefaultStatWindows, ResourceNotFoundError, GetResourceStatsErrorCode},
+	}
+
+	for i, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		statModel := &MockModel{}
+		models := map[string]Model{"resources": rescModel, "resourceStats": statModel, "tasks": taskModel}
+		stats := &ResourceStats{Name: tt.Name}
+		ctrl := &MockController{}
+		ctrl.On("GetResourceStats", tt.Name, tt.Windows, statModel).Return(stats, tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.GetResourceStats(tt.Body)
+		if errObj != nil {
+			if errObj.Code != tt.ErrCode {
+				t.Fatalf("[%d] expected error code %d, got %d", i, tt.ErrCode, errObj.Code)
+			}
+			continue
+		}
+		if result != stats {
+			t.Fatalf("[%d] unexpected result %v", i, result)
+		}
+		ctrl.AssertExpectations(t)
+	}
+}
+
+func TestApiV1SetResourceWeight(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		Name    string
+		Weight  float64
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+	}{
+		{[]byte(`{"name": "test", "weight": 2}`), "test", 2, nil, -1},
+		{[]byte(`["test", 0.5]`), "test", 0.5, nil, -1},
+		{[]byte(`{"name": "test"}`), "", 0, nil, jrpc2.InvalidParamsCode},
+		{[]byte(`["test", 2]`), "test", 2, ResourceNotFoundError, SetResourceWeightErrorCode},
+	}
+
+	for i, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("SetResourceWeight", tt.Name, tt.Weight, rescModel).Return(tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		_, errObj := api.SetResourceWeight(tt.Body)
+		if errObj != nil {
+			if errObj.Code != tt.ErrCode {
+				t.Fatalf("[%d] expected error code %d, got %d", i, tt.ErrCode, errObj.Code)
+			}
+			continue
+		}
+		ctrl.AssertExpectations(t)
+	}
+}
+
+func TestApiV1SetResourceParent(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		Name    string
+		Parent  string
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+	}{
+		{[]byte(`{"name": "gpu0", "parent": "host"}`), "gpu0", "host", nil, -1},
+		{[]byte(`["gpu0", "host"]`), "gpu0", "host", nil, -1},
+		{[]byte(`["gpu0"]`), "gpu0", "", nil, -1},
+		{[]byte(`{"parent": "host"}`), "", "", nil, jrpc2.InvalidParamsCode},
+		{[]byte(`["host", "gpu0"]`), "host", "gpu0", ResourceCycleError, SetResourceParentErrorCode},
+	}
+
+	for i, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("SetResourceParent", tt.Name, tt.Parent, rescModel).Return(tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		_, errObj := api.SetResourceParent(tt.Body)
+		if errObj != nil {
+			if errObj.Code != tt.ErrCode {
+				t.Fatalf("[%d] expected error code %d, got %d", i, tt.ErrCode, errObj.Code)
+			}
+			continue
+		}
+		ctrl.AssertExpectations(t)
+	}
+}
+
+func TestApiV1SetResourceQuota(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		Name    string
+		Quota   *ResourceQuota
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+	}{
+		{[]byte(`{"name": "test", "limit": 100, "period": 86400}`), "test", &ResourceQuota{Limit: 100, Period: 86400}, nil, -1},
+		{[]byte(`["test", 0]`), "test", nil, nil, -1},
+		{[]byte(`{"name": "test", "limit": 5}`), "", nil, nil, jrpc2.InvalidParamsCode},
+		{[]byte(`{"name": "test", "limit": -1, "period": 60}`), "", nil, nil, jrpc2.InvalidParamsCode},
+		{[]byte(`{"name": "test"}`), "", nil, nil, jrpc2.InvalidParamsCode},
+		{[]byte(`["test", 0]`), "test", nil, ResourceNotFoundError, SetResourceQuotaErrorCode},
+	}
+
+	for i, tt := range table {
+		q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+		taskModel := &MockModel{}
+		taskModel.On("Query", q, map[string]interface{}{}).Return(make([]interface{}, 0), nil)
+		rescModel := &MockModel{}
+		rescModel.On("FetchAll").Return(make([]interface{}, 0), nil)
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("SetResourceQuota", tt.Name, tt.Quota, rescModel).Return(tt.CallErr)
+		api := NewApiV1(models, ctrl, jrpc2.NewServer("", ""))
+		_, errObj := api.SetResourceQuota(tt.Body)
+		if errObj != nil {
+			if errObj.Code != tt.ErrCode {
+				t.Fatalf("[%d] expected error code %d, got %d", i, tt.ErrCode, errObj.Code)
+			}
+			continue
+		}
+		ctrl.AssertExpectations(t)
+	}
+}
+
+func TestErrorObject(t *testing.T) {
+	var table = []struct {
+		Err     error
+		Code    jrpc2.ErrorCode
+		Message jrpc2.ErrorMsg
+	}{
+		{TaskNotFoundError, GetTaskErrorCode, GetTaskErrorMsg},
+		{StorageUnavailableError, StorageUnavailableErrorCode, StorageUnavailableErrorMsg},
+		{fmt.Errorf("query: %w", StorageUnavailableError), StorageUnavailableErrorCode, StorageUnavailableErrorMsg},
+		{errors.New(StorageUnavailableError.Error()), GetTaskErrorCode, GetTaskErrorMsg},
+	}
+
+	for i, tt := range table {
+		errObj := errorObject(GetTaskErrorCode, GetTaskErrorMsg, tt.Err)
+		if errObj.Code != tt.Code || errObj.Message != tt.Message || errObj.Data != tt.Err.Error() {
+			t.Fatalf("[%d] unexpected error object %+v", i, errObj)
+		}
+	}
+}
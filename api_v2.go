@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/bitwurx/jrpc2"
+)
+
+const (
+	TaskNotFoundErrorCode       jrpc2.ErrorCode = -32040
+	ResourceNotFoundErrorCode   jrpc2.ErrorCode = -32041
+	InvalidTaskStatusErrorCode  jrpc2.ErrorCode = -32042
+	ResourceConflictErrorCode   jrpc2.ErrorCode = -32043
+	ServiceUnavailableErrorCode jrpc2.ErrorCode = -32044
+)
+
+const (
+	TaskNotFoundErrorMsg       jrpc2.ErrorMsg = "task not found"
+	ResourceNotFoundErrorMsg   jrpc2.ErrorMsg = "resource not found"
+	InvalidTaskStatusErrorMsg  jrpc2.ErrorMsg = "invalid task status"
+	ResourceConflictErrorMsg   jrpc2.ErrorMsg = "resource conflict"
+	ServiceUnavailableErrorMsg jrpc2.ErrorMsg = "service unavailable"
+)
+
+const (
+	ResourceActive   = "active"   // active resource result status.
+	ResourceDraining = "draining" // draining resource result status.
+	ResourceRemoved  = "removed"  // removed resource result status.
+)
+
+// Result is the structured result of the v2 methods that change a task
+// or resource.
+type Result struct {
+	// Id is the task id or resource name.
+	// Links maps the relations of the task or resource to the methods
+	// that accept the id.
+	// Status is the task status or resource status.
+	Id     string            `json:"id"`
+	Links  map[string]string `json:"links"`
+	Status string            `json:"status"`
+}
+
+// NewTaskResult returns the result for the task with the provided id.
+func NewTaskResult(id string, status string) *Result {
+	links := map[string]string{
+		"history": "getTaskHistory",
+		"self":    "v2.getTask",
+	}
+	return &Result{id, links, status}
+}
+
+// NewResourceResult returns the result for the resource with the provided
+// name.
+func NewResourceResult(name string, status string) *Result {
+	links := map[string]string{
+		"self":        "getResource",
+		"stagedTask":  "getStagedTask",
+		"unstageTask": "unstageTask",
+	}
+	return &Result{name, links, status}
+}
+
+// ApiV2 is the versioned api registered under v2 prefixed method names.
+// Changes return a Result and controller errors are mapped to typed error
+// codes.
+type ApiV2 struct {
+	models map[string]Model
+	ctrl   Controller
+}
+
+func (api *ApiV2) AddResource(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(AddResourceParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Name == nil {
+		return nil, invalidParams("name is required")
+	}
+	var pool string
+	var tags map[string]string
+	if p.Pool != nil {
+		pool = *p.Pool
+	}
+	if p.Tags != nil {
+		if err := validatePairs("tag", *p.Tags); err != nil {
+			return nil, invalidParams(err.Error())
+		}
+		tags = *p.Tags
+	}
+	var weight float64
+	if p.Weight != nil {
+		weight = *p.Weight
+	}
+	if err := api.ctrl.AddResource(*p.Name, pool, tags, weight, api.models["resources"]); err != nil {
+		return nil, typedError(err)
+	}
+	return NewResourceResult(*p.Name, ResourceActive), nil
+}
+
+func (api *ApiV2) AddTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(AddTaskParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, invalidParams("key is required")
+	}
+	if p.Priority == nil && p.RunAt == nil && p.RunAfter == nil {
+		return nil, invalidParams("priority, runAt or runAfter is required")
+	}
+	if err := p.resolveRunAfter(); err != nil {
+		return nil, invalidParams(err.Error())
+	}
+	if p.RunAt != nil && *p.RunAt != "" {
+		if _, err := time.Parse(time.RFC3339, *p.RunAt); err != nil {
+			return nil, invalidParams("runAt must be an RFC3339 date/time")
+		}
+	}
+	if p.Priority != nil && *p.Priority < 0 {
+		return nil, invalidParams("priority must not be negative")
+	}
+	if err := p.validateMeta(); err != nil {
+		return nil, invalidParams(err.Error())
+	}
+	if p.MaxAttempts != nil && *p.MaxAttempts < 0 {
+		return nil, invalidParams("maxAttempts must not be negative")
+	}
+	if p.Backoff != nil && *p.Backoff < 0 {
+		return nil, invalidParams("backoff must not be negative")
+	}
+	if p.ExpiresAt != nil {
+		if _, err := time.Parse(time.RFC3339, *p.ExpiresAt); err != nil {
+			return nil, invalidParams("expiresAt must be an RFC3339 date/time")
+		}
+	}
+	if p.Labels != nil {
+		if err := validatePairs("label", *p.Labels); err != nil {
+			return nil, invalidParams(err.Error())
+		}
+	}
+	if p.GroupId != nil && !groupIdPattern.MatchString(*p.GroupId) {
+		return nil, invalidParams("groupId must be 1 to 254 letters, digits, '_', '-', ':' or '.'")
+	}
+	if p.CallbackUrl != nil {
+		if err := validateCallbackUrl(*p.CallbackUrl); err != nil {
+			return nil, invalidParams(err.Error())
+		}
+	}
+	if p.Constraints != nil {
+		if err := validatePairs("constraint", *p.Constraints); err != nil {
+			return nil, invalidParams(err.Error())
+		}
+	}
+	data, _ := json.Marshal(p)
+	task := NewTask(data)
+	if p.ValidateOnly != nil && *p.ValidateOnly {
+		validation, err := api.ctrl.ValidateTask(task, api.models["tasks"])
+		if err != nil {
+			return nil, typedError(err)
+		}
+		return validation, nil
+	}
+	if err := api.ctrl.AddTask(task, api.models["tasks"], api.models["resources"]); err != nil {
+		return nil, typedError(err)
+	}
+	return NewTaskResult(task.Id, task.Status), nil
+}
+
+func (api *ApiV2) CompleteTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(CompleteTaskParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Id == nil {
+		return nil, invalidParams("id is required")
+	}
+	if p.Status == nil {
+		return nil, invalidParams("status is required")
+	}
+	var result json.RawMessage
+	var reason string
+	if p.Result != nil {
+		result = *p.Result
+	}
+	if p.Error != nil {
+		reason = *p.Error
+	}
+	cascade := p.Cascade != nil && *p.Cascade
+	if err := api.ctrl.CompleteTask(*p.Id, *p.Status, result, reason, cascade, api.models["tasks"], api.models["resources"]); err != nil {
+		return nil, typedError(err)
+	}
+	return NewTaskResult(*p.Id, *p.Status), nil
+}
+
+func (api *ApiV2) GetTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(GetTaskParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Id == nil {
+		return nil, invalidParams("id is required")
+	}
+	task, err := api.ctrl.GetTask(*p.Id, api.models["tasks"])
+	if err != nil {
+		return nil, typedError(err)
+	}
+	return task, nil
+}
+
+func (api *ApiV2) PauseResource(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(PauseResourceParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Name == nil {
+		return nil, invalidParams("name is required")
+	}
+	if err := api.ctrl.PauseResource(*p.Name, api.models["resources"]); err != nil {
+		return nil, typedError(err)
+	}
+	return NewResourceResult(*p.Name, ResourceDraining), nil
+}
+
+func (api *ApiV2) RemoveResource(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(RemoveResourceParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Name == nil {
+		return nil, invalidParams("name is required")
+	}
+	if err := api.ctrl.RemoveResource(*p.Name, api.models["tasks"], api.models["resources"]); err != nil {
+		return nil, typedError(err)
+	}
+	return NewResourceResult(*p.Name, ResourceRemoved), nil
+}
+
+func (api *ApiV2) RemoveTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(RemoveTaskParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Id == nil {
+		return nil, invalidParams("id is required")
+	}
+	var reason string
+	if p.Reason != nil {
+		reason = *p.Reason
+	}
+	if err := api.ctrl.RemoveTask(*p.Id, reason, api.models["tasks"], api.models["taskArchive"]); err != nil {
+		return nil, typedError(err)
+	}
+	return NewTaskResult(*p.Id, StatusCancelled), nil
+}
+
+func (api *ApiV2) RescheduleTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(RescheduleTaskParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Id == nil {
+		return nil, invalidParams("id is required")
+	}
+	if p.RunAt == nil {
+		return nil, invalidParams("runAt is required")
+	}
+	runAt, err := time.Parse(time.RFC3339, *p.RunAt)
+	if err != nil {
+		return nil, invalidParams("runAt must be an RFC3339 date/time")
+	}
+	if err := api.ctrl.RescheduleTask(*p.Id, runAt, api.models["tasks"]); err != nil {
+		return nil, typedError(err)
+	}
+	return api.taskResult(*p.Id)
+}
+
+func (api *ApiV2) ResumeResource(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(ResumeResourceParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Name == nil {
+		return nil, invalidParams("name is required")
+	}
+	if err := api.ctrl.ResumeResource(*p.Name, api.models["resources"]); err != nil {
+		return nil, typedError(err)
+	}
+	return NewResourceResult(*p.Name, ResourceActive), nil
+}
+
+func (api *ApiV2) RetryTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(RetryTaskParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Id == nil {
+		return nil, invalidParams("id is required")
+	}
+	if err := api.ctrl.RetryTask(*p.Id, api.models["tasks"]); err != nil {
+		return nil, typedError(err)
+	}
+	return api.taskResult(*p.Id)
+}
+
+func (api *ApiV2) StartTask(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(StartTaskParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, invalidParams("key is required")
+	}
+	var workerId string
+	if p.WorkerId != nil {
+		workerId = *p.WorkerId
+	}
+	if err := api.ctrl.StartTask(*p.Key, workerId, api.models["tasks"], api.models["resources"]); err != nil {
+		return nil, typedError(err)
+	}
+	return NewResourceResult(*p.Key, ResourceActive), nil
+}
+
+func (api *ApiV2) UpdateTaskPriority(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(UpdateTaskPriorityParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Id == nil {
+		return nil, invalidParams("id is required")
+	}
+	if p.Priority == nil {
+		return nil, invalidParams("priority is required")
+	}
+	if err := api.ctrl.UpdateTaskPriority(*p.Id, *p.Priority, api.models["tasks"]); err != nil {
+		return nil, typedError(err)
+	}
+	return api.taskResult(*p.Id)
+}
+
+// taskResult returns the result with the current status of the task.
+func (api *ApiV2) taskResult(id string) (interface{}, *jrpc2.ErrorObject) {
+	task, err := api.ctrl.GetTask(id, api.models["tasks"])
+	if err != nil {
+		return nil, typedError(err)
+	}
+	return NewTaskResult(task.Id, task.Status), nil
+}
+
+// NewApiV2 registers the v2 methods on the server. NewApiV1 must be called
+// first to load the managed resources and staged tasks.
+func NewApiV2(models map[string]Model, ctrl Controller, s MethodRegistry) *ApiV2 {
+	api := &ApiV2{models: models, ctrl: ctrl}
+
+	s.Register("v2.addResource", jrpc2.Method{Method: api.AddResource})
+	s.Register("v2.addTask", jrpc2.Method{Method: api.AddTask})
+	s.Register("v2.completeTask", jrpc2.Method{Method: api.CompleteTask})
+	s.Register("v2.getTask", jrpc2.Method{Method: api.GetTask})
+	s.Register("v2.pauseResource", jrpc2.Method{Method: api.PauseResource})
+	s.Register("v2.removeResource", jrpc2.Method{Method: api.RemoveResource})
+	s.Register("v2.removeTask", jrpc2.Method{Method: api.RemoveTask})
+	s.Register("v2.rescheduleTask", jrpc2.Method{Method: api.RescheduleTask})
+	s.Register("v2.resumeResource", jrpc2.Method{Method: api.ResumeResource})
+	s.Register("v2.retryTask", jrpc2.Method{Method: api.RetryTask})
+	s.Register("v2.startTask", jrpc2.Method{Method: api.StartTask})
+	s.Register("v2.updateTaskPriority", jrpc2.Method{Method: api.UpdateTaskPriority})
+
+	return api
+}
+
+// invalidParams returns an invalid params error object with the data.
+func invalidParams(data string) *jrpc2.ErrorObject {
+	return &jrpc2.ErrorObject{
+		Code:    jrpc2.InvalidParamsCode,
+		Message: jrpc2.InvalidParamsMsg,
+		Data:    data,
+	}
+}
+
+// typedError maps the controller error to the v2 error code of its kind.
+func typedError(err error) *jrpc2.ErrorObject {
+	errObj := &jrpc2.ErrorObject{
+		Code:    jrpc2.InternalErrorCode,
+		Message: jrpc2.InternalErrorMsg,
+		Data:    err.Error(),
+	}
+	if _, ok := err.(*TransitionError); ok {
+		errObj.Code, errObj.Message = InvalidTaskStatusErrorCode, InvalidTaskStatusErrorMsg
+	}
+	if errors.Is(err, StorageUnavailableError) {
+		errObj.Code, errObj.Message = StorageUnavailableErrorCode, StorageUnavailableErrorMsg
+	}
+	switch err {
+	case DependencyNotFoundError, NoStagedTaskError, ParentNotFoundError, TaskNotFoundError:
+		errObj.Code, errObj.Message = TaskNotFoundErrorCode, TaskNotFoundErrorMsg
+	case ResourceNotFoundError:
+		errObj.Code, errObj.Message = ResourceNotFoundErrorCode, ResourceNotFoundErrorMsg
+	case DependencyFailedError, ParentNotStartedError, TaskAlreadyStartedError, TaskNotPausedError, TaskNotQueuedError, TaskNotRetryableError, TaskNotScheduledError, TaskNotStartedError, TaskRemoveFailedError:
+		errObj.Code, errObj.Message = InvalidTaskStatusErrorCode, InvalidTaskStatusErrorMsg
+	case PoolConflictError, ResourceDrainingError, ResourceExistsError, ResourceUnavailableError, StartRateLimitedError:
+		errObj.Code, errObj.Message = ResourceConflictErrorCode, ResourceConflictErrorMsg
+	case NotificationFailedError, TaskAddFailedError, TaskUpdateFailedError:
+		errObj.Code, errObj.Message = ServiceUnavailableErrorCode, ServiceUnavailableErrorMsg
+	case AtCapacityError:
+		errObj.Code, errObj.Message = AtCapacityErrorCode, AtCapacityErrorMsg
+	}
+	return errObj
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/bitwurx/jrpc2"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestTypedError(t *testing.T) {
+	var table = []struct {
+		Err  error
+		Code jrpc2.ErrorCode
+	}{
+		{TaskNotFoundError, TaskNotFoundErrorCode},
+		{ParentNotFoundError, TaskNotFoundErrorCode},
+		{ParentNotStartedError, InvalidTaskStatusErrorCode},
+		{ResourceNotFoundError, ResourceNotFoundErrorCode},
+		{TaskNotStartedError, InvalidTaskStatusErrorCode},
+		{TaskNotRetryableError, InvalidTaskStatusErrorCode},
+		{&TransitionError{StatusStarted, StatusQueued}, InvalidTaskStatusErrorCode},
+		{ResourceDrainingError, ResourceConflictErrorCode},
+		{ResourceExistsError, ResourceConflictErrorCode},
+		{TaskAddFailedError, ServiceUnavailableErrorCode},
+		{AtCapacityError, AtCapacityErrorCode},
+		{StorageUnavailableError, StorageUnavailableErrorCode},
+		{fmt.Errorf("get task: %w", StorageUnavailableError), StorageUnavailableErrorCode},
+		{errors.New("query error"), jrpc2.InternalErrorCode},
+	}
+
+	for _, tt := range table {
+		errObj := typedError(tt.Err)
+		if errObj.Code != tt.Code {
+			t.Fatalf("expected code %d for '%s', got %d", tt.Code, tt.Err, errObj.Code)
+		}
+		if errObj.Data != tt.Err.Error() {
+			t.Fatalf("expected data to be '%s', got '%v'", tt.Err, errObj.Data)
+		}
+	}
+}
+
+func TestApiV2AddTask(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+	}{
+		{[]byte(`{"key": "test", "priority": 2.5}`), nil, -1},
+		{[]byte(`{"priority": 2.5}`), nil, jrpc2.InvalidParamsCode},
+		{[]byte(`{"key": "test", "priority": -1}`), nil, jrpc2.InvalidParamsCode},
+		{[]byte(`{"key": "test", "runAt": "tomorrow"}`), nil, jrpc2.InvalidParamsCode},
+		{[]byte(`{"key": "test", "priority": 2.5, "callbackUrl": "https://example.com/done"}`), nil, -1},
+		{[]byte(`{"key": "test", "priority": 2.5, "callbackUrl": "ftp://example.com/done"}`), nil, jrpc2.InvalidParamsCode},
+		{[]byte(`{"key": "test", "priority": 2.5, "callbackUrl": "/done"}`), nil, jrpc2.InvalidParamsCode},
+		{[]byte(`{"key": "test", "priority": 2.5}`), TaskAddFailedError, ServiceUnavailableErrorCode},
+	}
+
+	for _, tt := range table {
+		taskModel := &MockModel{}
+		rescModel := &MockModel{}
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("AddTask", mock.AnythingOfType("*main.Task"), taskModel, rescModel).Return(tt.CallErr).Run(func(args mock.Arguments) {
+			args.Get(0).(*Task).Status = StatusQueued
+		})
+		api := NewApiV2(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.AddTask(tt.Body)
+		if errObj != nil {
+			if errObj.Code != tt.ErrCode {
+				t.Fatalf("expected error code %d, got %d", tt.ErrCode, errObj.Code)
+			}
+			continue
+		}
+		res := result.(*Result)
+		if res.Id == "" || res.Status != StatusQueued || res.Links["self"] != "v2.getTask" {
+			t.Fatalf("unexpected result %+v", res)
+		}
+		ctrl.AssertExpectations(t)
+	}
+}
+
+func TestApiV2RetryTask(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		CallErr error
+		Task    *Task
+		GetErr  error
+		Status  string
+		ErrCode jrpc2.ErrorCode
+	}{
+		{[]byte(`["abc123"]`), nil, &Task{Id: "abc123", Status: StatusQueued}, nil, StatusQueued, -1},
+		{[]byte(`{"key": "test"}`), nil, nil, nil, "", jrpc2.InvalidParamsCode},
+		{[]byte(`["abc123"]`), TaskNotRetryableError, nil, nil, "", InvalidTaskStatusErrorCode},
+		{[]byte(`["abc123"]`), nil, nil, TaskNotFoundError, "", TaskNotFoundErrorCode},
+	}
+
+	for _, tt := range table {
+		taskModel := &MockModel{}
+		models := map[string]Model{"tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("RetryTask", "abc123", taskModel).Return(tt.CallErr)
+		ctrl.On("GetTask", "abc123", taskModel).Return(tt.Task, tt.GetErr)
+		api := NewApiV2(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.RetryTask(tt.Body)
+		if errObj != nil {
+			if errObj.Code != tt.ErrCode {
+				t.Fatalf("expected error code %d, got %d", tt.ErrCode, errObj.Code)
+			}
+			continue
+		}
+		if res := result.(*Result); res.Id != "abc123" || res.Status != tt.Status {
+			t.Fatalf("unexpected result %+v", res)
+		}
+		ctrl.AssertExpectations(t)
+	}
+}
+
+func TestApiV2PauseResource(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+	}{
+		{[]byte(`["test"]`), nil, -1},
+		{[]byte(`{}`), nil, jrpc2.InvalidParamsCode},
+		{[]byte(`["test"]`), ResourceNotFoundError, ResourceNotFoundErrorCode},
+	}
+
+	for _, tt := range table {
+		rescModel := &MockModel{}
+		models := map[string]Model{"resources": rescModel}
+		ctrl := &MockController{}
+		ctrl.On("PauseResource", "test", rescModel).Return(tt.CallErr)
+		api := NewApiV2(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.PauseResource(tt.Body)
+		if errObj != nil {
+			if errObj.Code != tt.ErrCode {
+				t.Fatalf("expected error code %d, got %d", tt.ErrCode, errObj.Code)
+			}
+			continue
+		}
+		if res := result.(*Result); res.Id != "test" || res.Status != ResourceDraining {
+			t.Fatalf("unexpected result %+v", res)
+		}
+		ctrl.AssertExpectations(t)
+	}
+}
+
+func TestApiV2StartTask(t *testing.T) {
+	var table = []struct {
+		Body    []byte
+		CallErr error
+		ErrCode jrpc2.ErrorCode
+	}{
+		{[]byte(`["test", "worker-1"]`), nil, -1},
+		{[]byte(`{}`), nil, jrpc2.InvalidParamsCode},
+		{[]byte(`["test", "worker-1"]`), NoStagedTaskError, TaskNotFoundErrorCode},
+		{[]byte(`["test", "worker-1"]`), AtCapacityError, AtCapacityErrorCode},
+	}
+
+	for i, tt := range table {
+		taskModel := &MockModel{}
+		rescModel := &MockModel{}
+		models := map[string]Model{"resources": rescModel, "tasks": taskModel}
+		ctrl := &MockController{}
+		ctrl.On("StartTask", "test", "worker-1", taskModel, rescModel).Return(tt.CallErr)
+		api := NewApiV2(models, ctrl, jrpc2.NewServer("", ""))
+		result, errObj := api.StartTask(tt.Body)
+		if errObj != nil {
+			if errObj.Code != tt.ErrCode {
+				t.Fatalf("[%d] expected error code %d, got %d", i, tt.ErrCode, errObj.Code)
+			}
+			continue
+		}
+		if res := result.(*Result); res.Id != "test" || res.Status != ResourceActive {
+			t.Fatalf("[%d] unexpected result %+v", i, res)
+		}
+		ctrl.AssertExpectations(t)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const DefaultAPIKeyHeader = "X-API-Key" // the header of the api key of a service.
+
+const (
+	AdminCaller  = "admin"  // the caller of the admin methods authorized with the admin token.
+	SystemCaller = "system" // the caller of the changes that are not made by an authenticated caller.
+)
+
+// callerKey is the context key of the authenticated caller.
+type callerKey struct{}
+
+// WithCaller returns a copy of the context with the authenticated caller.
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// Caller returns the authenticated caller of the context. SystemCaller is
+// returned if the context is nil or has none.
+func Caller(ctx context.Context) string {
+	if ctx == nil {
+		return SystemCaller
+	}
+	if caller, _ := ctx.Value(callerKey{}).(string); caller != "" {
+		return caller
+	}
+	return SystemCaller
+}
+
+// TokenProvider returns the token attached to a call to a service. It is
+// called for each call, so it can return refreshed tokens.
+type TokenProvider func(ctx context.Context) (string, error)
+
+// StaticToken returns a token provider that always returns the token.
+func StaticToken(token string) TokenProvider {
+	return func(context.Context) (string, error) {
+		return token, nil
+	}
+}
+
+// FileToken returns a token provider that reads the token from the file on
+// each call, so that a rotated token is picked up without a restart.
+func FileToken(path string) TokenProvider {
+	return func(context.Context) (string, error) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+}
+
+// ServiceAuth is the authentication of the calls to a downstream service.
+type ServiceAuth struct {
+	// Header is the header the token is sent in. The token is sent as a
+	// bearer token in the Authorization header if the header is empty.
+	// Token provides the token of each call.
+	Header string
+	Token  TokenProvider
+}
+
+// apply sets the token header of the request.
+func (auth ServiceAuth) apply(ctx context.Context, req *http.Request) error {
+	name, value, err := auth.header(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(name, value)
+	return nil
+}
+
+// header returns the name and value of the token header of a call.
+func (auth ServiceAuth) header(ctx context.Context) (string, string, error) {
+	token, err := auth.Token(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	if auth.Header == "" {
+		return "Authorization", "Bearer " + token, nil
+	}
+	return auth.Header, token, nil
+}
+
+// envServiceAuth returns the authentication of the service from the
+// <prefix>_TOKEN, <prefix>_TOKEN_FILE, <prefix>_API_KEY and
+// <prefix>_API_KEY_HEADER environment variables. False is returned if none
+// of the token variables is set.
+func envServiceAuth(prefix string) (ServiceAuth, bool) {
+	switch {
+	case os.Getenv(prefix+"_TOKEN") != "":
+		return ServiceAuth{Token: StaticToken(os.Getenv(prefix + "_TOKEN"))}, true
+	case os.Getenv(prefix+"_TOKEN_FILE") != "":
+		return ServiceAuth{Token: FileToken(os.Getenv(prefix + "_TOKEN_FILE"))}, true
+	case os.Getenv(prefix+"_API_KEY") != "":
+		header := os.Getenv(prefix + "_API_KEY_HEADER")
+		if header == "" {
+			header = DefaultAPIKeyHeader
+		}
+		return ServiceAuth{Header: header, Token: StaticToken(os.Getenv(prefix + "_API_KEY"))}, true
+	}
+	return ServiceAuth{}, false
+}
+
+// ConfigureServiceAuth configures the broker to authenticate the calls to
+// the priority queue, timetable and status change notifier services that
+// have a token configured. It must be called after ConfigureServiceTLS,
+// which may change the hosts.
+func ConfigureServiceAuth(broker *JsonRPCServiceBroker) {
+	for _, service := range brokerServices() {
+		auth, ok := envServiceAuth(service.prefix)
+		if !ok {
+			continue
+		}
+		for _, endpoint := range serviceEndpoints(*service.host) {
+			broker.UseAuth(endpoint, auth)
+			log.Printf("using authentication for service [%s]\n", endpoint)
+		}
+	}
+}
+
+// UseAuth makes the broker authenticate the calls to the service at the
+// host. It must be called before the broker is used.
+func (t *JsonRPCServiceBroker) UseAuth(host string, auth ServiceAuth) {
+	if t.auths == nil {
+		t.auths = make(map[string]ServiceAuth)
+	}
+	t.auths[host] = auth
+}
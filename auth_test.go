@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCaller(t *testing.T) {
+	var table = []struct {
+		Ctx    context.Context
+		Caller string
+	}{
+		{nil, SystemCaller},
+		{context.Background(), SystemCaller},
+		{WithCaller(context.Background(), ""), SystemCaller},
+		{WithCaller(context.Background(), AdminCaller), AdminCaller},
+	}
+
+	for i, tt := range table {
+		if caller := Caller(tt.Ctx); caller != tt.Caller {
+			t.Fatalf("[%d] expected caller %s, got %s", i, tt.Caller, caller)
+		}
+	}
+}
+
+func TestServiceBrokerCallAuth(t *testing.T) {
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		if r.Header.Get("Authorization") == "Bearer expired" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"jsonrpc": "2.0", "result": 0, "id": 0}`))
+	}))
+	defer srv.Close()
+
+	var table = []struct {
+		Auth   ServiceAuth
+		Header string
+		Value  string
+		Code   int
+	}{
+		{ServiceAuth{Token: StaticToken("secret")}, "Authorization", "Bearer secret", 0},
+		{ServiceAuth{Header: "X-API-Key", Token: StaticToken("key")}, "X-API-Key", "key", 0},
+		{ServiceAuth{Token: StaticToken("expired")}, "Authorization", "Bearer expired", int(BrokerRejectedErrorCode)},
+	}
+
+	for i, tt := range table {
+		header = nil
+		broker := NewJsonRPCServiceBroker()
+		broker.UseAuth(srv.URL, tt.Auth)
+		_, errObj := broker.Call(context.Background(), srv.URL, "notify", map[string]interface{}{})
+		if (errObj != nil) != (tt.Code != 0) || (errObj != nil && int(errObj.Code) != tt.Code) {
+			t.Fatalf("[%d] expected error code %d, got %v", i, tt.Code, errObj)
+		}
+		if value := header.Get(tt.Header); value != tt.Value {
+			t.Fatalf("[%d] expected the %s header %s, got %s", i, tt.Header, tt.Value, value)
+		}
+	}
+
+	defer func(retries int) { BrokerRetries = retries }(BrokerRetries)
+	BrokerRetries = 0
+	header = nil
+	broker := NewJsonRPCServiceBroker()
+	broker.UseAuth(srv.URL, ServiceAuth{Token: func(context.Context) (string, error) {
+		return "", errors.New("token unavailable")
+	}})
+	if _, errObj := broker.Call(context.Background(), srv.URL, "notify", map[string]interface{}{}); errObj == nil || errObj.Code != BrokerCallErrorCode {
+		t.Fatalf("expected the token provider error to fail the call, got %v", errObj)
+	}
+	if header != nil {
+		t.Fatal("expected the call not to be sent without a token")
+	}
+}
+
+func TestFileToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "concord-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	token := FileToken(path)
+	if _, err := token(context.Background()); err == nil {
+		t.Fatal("expected the missing token file to fail")
+	}
+	for _, expected := range []string{"first", "rotated"} {
+		ioutil.WriteFile(path, []byte(expected+"\n"), 0600)
+		if value, err := token(context.Background()); err != nil || value != expected {
+			t.Fatalf("expected the token %s, got %s %v", expected, value, err)
+		}
+	}
+}
+
+func TestConfigureServiceAuth(t *testing.T) {
+	defer func(queue, timetable, notifier string) {
+		PriorityQueueHost, TimetableHost, StatusChangeNotifierHost = queue, timetable, notifier
+	}(PriorityQueueHost, TimetableHost, StatusChangeNotifierHost)
+	PriorityQueueHost, TimetableHost, StatusChangeNotifierHost = "https://queue:8443", "timetable:8080", "notifier:8080"
+	for name, value := range map[string]string{
+		"CONCORD_PRIORITY_QUEUE_TOKEN":           "secret",
+		"CONCORD_STATUS_CHANGE_NOTIFIER_API_KEY": "key",
+	} {
+		defer os.Unsetenv(name)
+		os.Setenv(name, value)
+	}
+
+	broker := NewJsonRPCServiceBroker()
+	ConfigureServiceAuth(broker)
+	if len(broker.auths) != 2 {
+		t.Fatalf("expected 2 authenticated services, got %d", len(broker.auths))
+	}
+	if auth := broker.auths["https://queue:8443"]; auth.Header != "" {
+		t.Fatalf("expected a bearer token for the priority queue, got the %s header", auth.Header)
+	}
+	if auth := broker.auths["notifier:8080"]; auth.Header != DefaultAPIKeyHeader {
+		t.Fatalf("expected the %s header for the notifier, got %s", DefaultAPIKeyHeader, auth.Header)
+	}
+}
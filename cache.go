@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const CacheKeyPrefix = "concord:" // the prefix of the keys of the cached documents.
+
+var (
+	RedisURL      = os.Getenv("CONCORD_REDIS_URL")                          // the url of the redis server tasks and resources are cached in.
+	CacheTTL      = envDurationOr("CONCORD_CACHE_TTL", time.Minute)         // the time a cached task or resource is kept.
+	CacheCountTTL = envDurationOr("CONCORD_CACHE_COUNT_TTL", time.Second*2) // the time cached task counts are served.
+)
+
+// Cache contains methods for storing values by key with an expiry.
+type Cache interface {
+	Delete(string) error
+	Get(string) ([]byte, error)
+	Set(string, []byte, time.Duration) error
+}
+
+// RedisCache is a cache of the values stored in a redis server.
+type RedisCache struct {
+	client *redis.Client
+}
+
+// NewRedisCache creates a new redis cache for the redis server at the url.
+//
+// an error is encountered if the url is invalid.
+func NewRedisCache(url string) (*RedisCache, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisCache{redis.NewClient(opts)}, nil
+}
+
+// Delete removes the value with the key.
+func (c *RedisCache) Delete(key string) error {
+	return c.client.Del(key).Err()
+}
+
+// Get returns the value with the key. Nil is returned if the key is not
+// cached.
+func (c *RedisCache) Get(key string) ([]byte, error) {
+	value, err := c.client.Get(key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return value, err
+}
+
+// Set stores the value with the key for the ttl.
+func (c *RedisCache) Set(key string, value []byte, ttl time.Duration) error {
+	return c.client.Set(key, value, ttl).Err()
+}
+
+// Ping checks the connectivity of the redis server.
+func (c *RedisCache) Ping() error {
+	return c.client.Ping().Err()
+}
+
+// CacheModels caches the documents read by the task, resource and task
+// count models of the models in the cache. Tasks and resources are written
+// through to the cache when they are saved, and task counts are served from
+// the cache for CacheCountTTL.
+func CacheModels(models map[string]Model, cache Cache) {
+	models["tasks"] = NewCachedModel(models["tasks"], cache, CollectionTasks, func() interface{} { return new(Task) })
+	models["resources"] = NewCachedModel(models["resources"], cache, CollectionResources, func() interface{} { return new(Resource) })
+	counts := NewCachedModel(models["taskCounts"], cache, CollectionPrefix+"task_counts", func() interface{} { return new(TaskCount) })
+	counts.queryTTL = CacheCountTTL
+	models["taskCounts"] = counts
+}
+
+// CachedModel is a model whose documents are cached by key. Documents are
+// read from the cache before the wrapped model and written through to the
+// cache when they are saved. Documents removed by a query are removed from
+// the cache if the query returns them, as with RETURN OLD, and so are the
+// documents removed with RemoveSQL. Cache failures are logged and the
+// wrapped model is used instead.
+type CachedModel struct {
+	Model
+	cache    Cache
+	name     string
+	doc      func() interface{}
+	queryTTL time.Duration
+}
+
+// NewCachedModel creates a new cached model of the documents of the named
+// collection read into the values returned by doc.
+func NewCachedModel(model Model, cache Cache, name string, doc func() interface{}) *CachedModel {
+	return &CachedModel{Model: model, cache: cache, name: name, doc: doc}
+}
+
+// key returns the cache key of the document key.
+func (model *CachedModel) key(key string) string {
+	return CacheKeyPrefix + model.name + ":" + key
+}
+
+// Get returns the cached document with the key, or reads the document from
+// the wrapped model and caches it on a cache miss.
+func (model *CachedModel) Get(key string) (interface{}, error) {
+	data, err := model.cache.Get(model.key(key))
+	if err != nil {
+		log.Println(err)
+	}
+	if data != nil {
+		doc := model.doc()
+		if err := json.Unmarshal(data, doc); err == nil {
+			return doc, nil
+		}
+	}
+	doc, err := model.Model.Get(key)
+	if err != nil || doc == nil {
+		return doc, err
+	}
+	model.store(doc)
+	return doc, nil
+}
+
+// Query runs the query against the wrapped model. The results of queries
+// are cached for the query ttl of the model if it is set. The documents
+// returned by a query that removes documents are removed from the cache
+// instead.
+func (model *CachedModel) Query(q string, vars interface{}) ([]interface{}, error) {
+	if removes(q) {
+		docs, err := model.Model.Query(q, vars)
+		for _, doc := range docs {
+			model.forget(doc)
+		}
+		return docs, err
+	}
+	return model.cached(q, vars, func() ([]interface{}, error) {
+		return model.Model.Query(q, vars)
+	})
+}
+
+// cached returns the cached results of the query with the bind variables,
+// or runs the query and caches its results for the query ttl of the model.
+// The query is run past the cache if the query ttl is not set.
+func (model *CachedModel) cached(q string, vars interface{}, run func() ([]interface{}, error)) ([]interface{}, error) {
+	if model.queryTTL <= 0 {
+		return run()
+	}
+	data, _ := json.Marshal(vars)
+	sum := sha1.Sum(append([]byte(q), data...))
+	key := model.key("query:" + hex.EncodeToString(sum[:]))
+	if data, err := model.cache.Get(key); err != nil {
+		log.Println(err)
+	} else if data != nil {
+		var raw []json.RawMessage
+		if err := json.Unmarshal(data, &raw); err == nil {
+			docs := make([]interface{}, 0, len(raw))
+			for _, v := range raw {
+				doc := model.doc()
+				json.Unmarshal(v, doc)
+				docs = append(docs, doc)
+			}
+			return docs, nil
+		}
+	}
+	docs, err := run()
+	if err != nil {
+		return nil, err
+	}
+	if data, err := json.Marshal(docs); err == nil {
+		if err := model.cache.Set(key, data, model.queryTTL); err != nil {
+			log.Println(err)
+		}
+	}
+	return docs, nil
+}
+
+// QuerySQL runs the statement with the wrapped model, whose results are
+// cached like those of Query.
+func (model *CachedModel) QuerySQL(q string, args ...interface{}) ([]interface{}, error) {
+	m, ok := model.Model.(SQLModel)
+	if !ok {
+		return nil, UnsupportedQueryError
+	}
+	return model.cached(q, args, func() ([]interface{}, error) {
+		return m.QuerySQL(q, args...)
+	})
+}
+
+// RemoveSQL runs the delete statement with the wrapped model and removes
+// the documents it returns from the cache.
+func (model *CachedModel) RemoveSQL(q string, args ...interface{}) ([]interface{}, error) {
+	m, ok := model.Model.(SQLModel)
+	if !ok {
+		return nil, UnsupportedQueryError
+	}
+	docs, err := m.RemoveSQL(q, args...)
+	for _, doc := range docs {
+		model.forget(doc)
+	}
+	return docs, err
+}
+
+// StreamSQL streams the documents of the statement past the cache.
+func (model *CachedModel) StreamSQL(q string, args ...interface{}) (DocumentIterator, error) {
+	m, ok := model.Model.(SQLModel)
+	if !ok {
+		return nil, UnsupportedQueryError
+	}
+	return m.StreamSQL(q, args...)
+}
+
+// PageSQL pages the documents past the cache.
+func (model *CachedModel) PageSQL(where string, order string, offset int, limit int, args ...interface{}) (*Page, error) {
+	m, ok := model.Model.(SQLModel)
+	if !ok {
+		return nil, UnsupportedQueryError
+	}
+	return m.PageSQL(where, order, offset, limit, args...)
+}
+
+// removes indicates whether the query removes documents.
+func removes(q string) bool {
+	return strings.Contains(strings.ToUpper(q), " REMOVE ")
+}
+
+// WithContext returns a copy of the cached model whose wrapped model is
+// bound to the context.
+func (model *CachedModel) WithContext(ctx context.Context) Model {
+	bound := *model
+	bound.Model = bindContext(model.Model, ctx)
+	return &bound
+}
+
+// Remove removes the document from the wrapped model and the cache.
+func (model *CachedModel) Remove(doc interface{}) error {
+	if err := model.Model.Remove(doc); err != nil {
+		return err
+	}
+	model.forget(doc)
+	return nil
+}
+
+// Save saves the document with the wrapped model and writes it through to
+// the cache. The cached document is removed if the save failed.
+func (model *CachedModel) Save(doc interface{}) (DocumentMeta, error) {
+	meta, err := model.Model.Save(doc)
+	model.writeThrough(doc, err)
+	return meta, err
+}
+
+// writeThrough caches the document after it was written, or removes it from
+// the cache if the write failed.
+func (model *CachedModel) writeThrough(doc interface{}, err error) {
+	if err != nil {
+		model.forget(doc)
+		return
+	}
+	model.store(doc)
+}
+
+// store caches the document for CacheTTL.
+func (model *CachedModel) store(doc interface{}) {
+	key, _, err := document(doc)
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return
+	}
+	if err := model.cache.Set(model.key(key), data, CacheTTL); err != nil {
+		log.Println(err)
+	}
+}
+
+// forget removes the document from the cache.
+func (model *CachedModel) forget(doc interface{}) {
+	key, _, err := document(doc)
+	if err != nil {
+		return
+	}
+	if err := model.cache.Delete(model.key(key)); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
+
+// memoryCache is a cache of the values in a map that ignores the ttl.
+type memoryCache struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{values: make(map[string][]byte)}
+}
+
+func (c *memoryCache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.values, key)
+	return nil
+}
+
+func (c *memoryCache) Get(key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key], nil
+}
+
+func (c *memoryCache) Set(key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] = value
+	return nil
+}
+
+func TestCachedModelGet(t *testing.T) {
+	task := &Task{Id: "a", Key: "k", Status: StatusQueued}
+	taskModel := new(MockModel)
+	taskModel.On("Get", "a").Return(task, nil).Once()
+	taskModel.On("Get", "b").Return(nil, nil)
+	cache := newMemoryCache()
+	model := NewCachedModel(taskModel, cache, CollectionTasks, func() interface{} { return new(Task) })
+
+	for i := 0; i < 2; i++ {
+		doc, err := model.Get("a")
+		if err != nil {
+			t.Fatalf("[%d] %v", i, err)
+		}
+		if v := doc.(*Task); v.Id != "a" || v.Status != StatusQueued {
+			t.Fatalf("[%d] expected queued task a, got %+v", i, v)
+		}
+	}
+	if doc, err := model.Get("b"); doc != nil || err != nil {
+		t.Fatalf("expected missing task, got %v %v", doc, err)
+	}
+	if _, ok := cache.values[CacheKeyPrefix+"tasks:b"]; ok {
+		t.Fatal("expected missing task not to be cached")
+	}
+	taskModel.AssertExpectations(t)
+}
+
+func TestCachedModelSave(t *testing.T) {
+	var table = []struct {
+		Err    error
+		Cached bool
+	}{
+		{nil, true},
+		{errors.New("save error"), false},
+	}
+
+	for i, tt := range table {
+		task := &Task{Id: "a", Status: StatusStarted}
+		taskModel := new(MockModel)
+		taskModel.On("Save", task).Return(DocumentMeta{}, tt.Err)
+		cache := newMemoryCache()
+		cache.Set(CacheKeyPrefix+"tasks:a", []byte(`{"_key": "a", "status": "queued"}`), CacheTTL)
+		model := NewCachedModel(taskModel, cache, CollectionTasks, func() interface{} { return new(Task) })
+		if _, err := model.Save(task); err != tt.Err {
+			t.Fatalf("[%d] expected error %v, got %v", i, tt.Err, err)
+		}
+		doc, _ := cache.Get(CacheKeyPrefix + "tasks:a")
+		if (doc != nil) != tt.Cached {
+			t.Fatalf("[%d] expected cached %v, got %s", i, tt.Cached, doc)
+		}
+		if tt.Cached {
+			cached, _ := model.Get("a")
+			if cached.(*Task).Status != StatusStarted {
+				t.Fatalf("[%d] expected started task, got %+v", i, cached)
+			}
+		}
+	}
+}
+
+func TestCachedModelRemove(t *testing.T) {
+	resource := &Resource{Name: "a"}
+	resourceModel := new(MockModel)
+	resourceModel.On("Remove", resource).Return(nil)
+	cache := newMemoryCache()
+	cache.Set(CacheKeyPrefix+"resources:a", []byte(`{"_key": "a"}`), CacheTTL)
+	model := NewCachedModel(resourceModel, cache, CollectionResources, func() interface{} { return new(Resource) })
+	if err := model.Remove(resource); err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.values) != 0 {
+		t.Fatalf("expected removed resource not to be cached, got %v", cache.values)
+	}
+}
+
+func TestCachedModelQuery(t *testing.T) {
+	q := "FOR t IN tasks COLLECT status = t.status WITH COUNT INTO count RETURN {status, count}"
+	vars := map[string]interface{}{}
+	countModel := new(MockModel)
+	countModel.On("Query", q, vars).Return([]interface{}{&TaskCount{Status: StatusQueued, Count: 3}}, nil).Once()
+	model := NewCachedModel(countModel, newMemoryCache(), "task_counts", func() interface{} { return new(TaskCount) })
+	model.queryTTL = time.Second
+
+	for i := 0; i < 2; i++ {
+		counts, err := NewResourceController(nil).CountTasks(false, model)
+		if err != nil {
+			t.Fatalf("[%d] %v", i, err)
+		}
+		if len(counts) != 1 || counts[0].Status != StatusQueued || counts[0].Count != 3 {
+			t.Fatalf("[%d] expected 3 queued tasks, got %s", i, fmt.Sprint(counts))
+		}
+	}
+	countModel.AssertExpectations(t)
+}
+
+func TestCachedModelQueryRemove(t *testing.T) {
+	q := "FOR t IN tasks FILTER t.status == @status REMOVE t IN tasks RETURN OLD"
+	vars := map[string]interface{}{"status": StatusComplete}
+	taskModel := new(MockModel)
+	taskModel.On("Query", q, vars).Return([]interface{}{&Task{Id: "a", Status: StatusComplete}}, nil)
+	cache := newMemoryCache()
+	cache.Set(CacheKeyPrefix+"tasks:a", []byte(`{"_key": "a", "status": "complete"}`), CacheTTL)
+	cache.Set(CacheKeyPrefix+"tasks:b", []byte(`{"_key": "b", "status": "queued"}`), CacheTTL)
+	model := NewCachedModel(taskModel, cache, CollectionTasks, func() interface{} { return new(Task) })
+	model.queryTTL = time.Second
+
+	if _, err := model.Query(q, vars); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.values[CacheKeyPrefix+"tasks:a"]; ok || len(cache.values) != 1 {
+		t.Fatalf("expected only the removed task to be evicted, got %v", cache.values)
+	}
+}
+
+func TestUpdateAllCachedModels(t *testing.T) {
+	task := &Task{Id: "a", Status: StatusStarted}
+	resource := &Resource{Name: "r", Status: ResourceLocked}
+	taskModel := new(MockModel)
+	taskModel.On("Save", task).Return(DocumentMeta{}, nil)
+	resourceModel := new(MockModel)
+	resourceModel.On("Save", mock.Anything).Return(DocumentMeta{}, nil)
+	cache := newMemoryCache()
+	err := UpdateAll(
+		Update{NewCachedModel(taskModel, cache, CollectionTasks, func() interface{} { return new(Task) }), task},
+		Update{NewCachedModel(resourceModel, cache, CollectionResources, func() interface{} { return new(Resource) }), resource},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"tasks:a", "resources:r"} {
+		if _, ok := cache.values[CacheKeyPrefix+key]; !ok {
+			t.Fatalf("expected %s to be cached", key)
+		}
+	}
+}
+
+func TestCachedModelRemoveSQL(t *testing.T) {
+	q := "DELETE FROM tasks WHERE doc -> 'status' = $1::jsonb RETURNING doc"
+	args := []interface{}{`"complete"`}
+	taskModel := new(mockSQLModel)
+	taskModel.On("RemoveSQL", q, args).Return([]interface{}{&Task{Id: "a", Status: StatusComplete}}, nil)
+	cache := newMemoryCache()
+	cache.Set(CacheKeyPrefix+"tasks:a", []byte(`{"_key": "a", "status": "complete"}`), CacheTTL)
+	cache.Set(CacheKeyPrefix+"tasks:b", []byte(`{"_key": "b", "status": "queued"}`), CacheTTL)
+	model := NewCachedModel(taskModel, cache, CollectionTasks, func() interface{} { return new(Task) })
+
+	if _, err := model.RemoveSQL(q, args...); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.values[CacheKeyPrefix+"tasks:a"]; ok || len(cache.values) != 1 {
+		t.Fatalf("expected only the removed task to be evicted, got %v", cache.values)
+	}
+}
@@ -2,88 +2,637 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/bitwurx/jrpc2"
 	"github.com/mitchellh/mapstructure"
+	"github.com/satori/go.uuid"
 )
 
 const (
-	StageBuffer            = 10
-	TaskStatusChangedEvent = "taskStatusChanged" // task status changed event.
+	StageBuffer              = 10                      // the maximum number of tasks staged per key.
+	ConstraintSkipLimit      = 10                      // the maximum number of tasks with unsatisfied constraints skipped per stage poll.
+	MaxTaskLogEntries        = 1000                    // the maximum number of log entries kept per task.
+	TaskStatusChangedEvent   = "taskStatusChanged"     // task status changed event.
+	ResourceRemovedEvent     = "resourceRemoved"       // resource removed event.
+	TaskFailedEvent          = "taskFailedPermanently" // task failed permanently event.
+	TaskGroupCompletedEvent  = "taskGroupCompleted"    // task group completed event.
+	TaskPreemptEvent         = "taskPreemptRequested"  // task preempt requested event.
+	ResourceLockExpiredEvent = "resourceLockExpired"   // resource lock expired event.
+	QuotaExceededEvent       = "quotaExceeded"         // resource quota exceeded event.
+	TaskRecoveredEvent       = "taskRecovered"         // stuck started task recovered event.
+	ReplayInterval           = time.Second * 5         // the deferred call replay interval.
+	ExpiryInterval           = time.Second * 10        // the expired task sweep interval.
+	LeaseDuration            = time.Second * 60        // the time a started task is leased to its worker.
+	LeaseInterval            = time.Second * 5         // the expired lease reclaim interval.
+	LockInterval             = time.Second * 10        // the expired resource lock sweep interval.
+	ArchiveInterval          = time.Minute             // the completed task archival interval.
+	ArchiveBatchSize         = 500                     // the maximum number of tasks archived per query.
+	ArchivedReason           = "archived"              // the removed reason of tasks archived after the retention period.
+	HeartbeatInterval        = time.Second * 5         // the missed resource heartbeat sweep interval.
+	HeartbeatTimeout         = time.Second * 30        // the time after the last heartbeat a resource goes offline.
+	DeregisterTimeout        = time.Minute * 10        // the time after the last heartbeat a registered resource is removed.
+	StageTick                = time.Millisecond * 100  // the stage loop scheduling resolution.
+	ShutdownTimeout          = time.Second * 30        // the time in-flight work may take to finish on shutdown.
+	FIFOAddTimeout           = time.Minute             // the time an older task being added holds back staging in strict fifo mode.
+	StealDepthTTL            = time.Second * 5         // the time the queue depth of a pool member is cached for work stealing.
+	CallbackAttempts         = 5                       // the number of task callback delivery attempts.
+	CallbackBackoff          = time.Second * 1         // the delay before the first callback retry.
+	CallbackTimeout          = time.Second * 10        // the task callback request timeout.
+	CallbackSignatureHeader  = "X-Concord-Signature"   // the task callback signature header.
+	CallbackMethod           = "callback"              // the method of the deferred calls of task callbacks.
+	BrokerMaxBackoff         = time.Second * 5         // the maximum delay between broker call attempts.
+	BrokerIdleConns          = 64                      // the idle connections kept per service by the broker.
+	BrokerDialTimeout        = time.Second * 5         // the broker connection timeout.
+	BrokerBatchSize          = 100                     // the maximum number of calls sent in one broker batch.
+	NotifyQueueSize          = 1000                    // the maximum number of queued notifications.
+	NotifyAttempts           = 5                       // the number of notification delivery attempts.
+	NotifyBackoff            = time.Second * 1         // the delay before the first notification retry.
+	RedeliverInterval        = time.Second * 5         // the failed notification redelivery interval.
+	RedeliverBackoff         = time.Second * 10        // the delay before the first failed notification redelivery.
+	RedeliverMaxBackoff      = time.Minute * 10        // the maximum delay between failed notification redeliveries.
+	RedeliverAttempts        = 10                      // the number of failed deliveries before a notification is dead.
+)
+
+const (
+	StagePolicyScheduled = "scheduled" // stage due scheduled tasks before queued tasks.
+	StagePolicyQueued    = "queued"    // stage queued tasks before due scheduled tasks.
+	StagePolicyAlternate = "alternate" // alternate between scheduled and queued tasks.
+	StagePolicyWeighted  = "weighted"  // stage a queued task after every stage weight scheduled tasks.
+	StagePolicyDeadline  = "deadline"  // stage the task that expires first.
+)
+
+const (
+	RecoveryPolicyRequeue = "requeue" // return stuck started tasks to the priority queue or timetable.
+	RecoveryPolicyFail    = "fail"    // fail stuck started tasks with the error status.
 )
 
 var (
-	PriorityQueueHost        = os.Getenv("CONCORD_PRIORITY_QUEUE_HOST")         // the hostname of the priority queue service.
-	TimetableHost            = os.Getenv("CONCORD_TIMETABLE_HOST")              // the hostname of the timetable service.
-	StatusChangeNotifierHost = os.Getenv("CONCORD_STATUS_CHANGE_NOTIFIER_HOST") // the hostname of the status change notifier service.
+	PriorityQueueHost        = os.Getenv("CONCORD_PRIORITY_QUEUE_HOST")                   // the hostname of the priority queue service.
+	TimetableHost            = os.Getenv("CONCORD_TIMETABLE_HOST")                        // the hostname of the timetable service.
+	StatusChangeNotifierHost = os.Getenv("CONCORD_STATUS_CHANGE_NOTIFIER_HOST")           // the hostname of the status change notifier service.
+	BufferBrokerCalls        = os.Getenv("CONCORD_BUFFER_BROKER_CALLS") != ""             // buffer calls to unreachable services.
+	AdminToken               = os.Getenv("CONCORD_ADMIN_TOKEN")                           // the token required by admin methods.
+	TaskMetaSchema           *MetaSchema                                                  // the schema of the task meta, set from CONCORD_META_SCHEMA.
+	PreemptionEnabled        = os.Getenv("CONCORD_PREEMPTION_MARGIN") != ""               // request preemption of running tasks.
+	PreemptionMargin         = envFloat("CONCORD_PREEMPTION_MARGIN")                      // the priority margin required for preemption.
+	CallbackSecret           = os.Getenv("CONCORD_CALLBACK_SECRET")                       // the key used to sign task callbacks.
+	CallbackHosts            = envList("CONCORD_CALLBACK_HOSTS")                          // the hosts task callbacks may be sent to.
+	MaxLockDuration          = envDuration("CONCORD_MAX_LOCK_DURATION")                   // the time a resource may be locked by a started task.
+	ArchiveRetention         = envDuration("CONCORD_ARCHIVE_RETENTION")                   // the time tasks in a final status are kept before they are archived.
+	StageInterval            = envDurationOr("CONCORD_STAGE_INTERVAL", time.Second)       // the interval between stage polls of a key.
+	StageJitter              = envDuration("CONCORD_STAGE_JITTER")                        // the maximum random delay added to each stage poll.
+	StageMaxBackoff          = envDurationOr("CONCORD_STAGE_MAX_BACKOFF", time.Second*30) // the maximum stage poll delay after broker errors.
+	StageIdleInterval        = envDuration("CONCORD_STAGE_IDLE_INTERVAL")                 // the maximum stage poll interval of keys with empty queues.
+	StagePolicy              = os.Getenv("CONCORD_STAGE_POLICY")                          // the order in which scheduled and queued tasks are staged.
+	StageWeight              = int(envFloat("CONCORD_STAGE_WEIGHT"))                      // the scheduled tasks staged per queued task by the weighted policy.
+	StageLookahead           = int(envFloat("CONCORD_STAGE_LOOKAHEAD"))                   // the maximum number of tasks staged per key.
+	StealThreshold           = int(envFloat("CONCORD_STEAL_THRESHOLD"))                   // the queue depth of a pool member from which idle members steal tasks.
+	RecoveryPolicy           = os.Getenv("CONCORD_RECOVERY_POLICY")                       // how stuck started tasks are recovered on startup.
+	ShardAddress             = os.Getenv("CONCORD_SHARD_ADDRESS")                         // the <host>:<port> of the instance in sharding mode.
+	ShardSecret              = os.Getenv("CONCORD_SHARD_SECRET")                          // the key the instances sign proxied requests with.
+	StartRate                = envFloat("CONCORD_START_RATE")                             // the maximum number of task starts per minute and key.
+	StartBurst               = int(envFloat("CONCORD_START_BURST"))                       // the number of task starts per key allowed at once.
+	MaxStartedTasks          = int(envFloat("CONCORD_MAX_STARTED_TASKS"))                 // the maximum number of started tasks of the resources owned by the instance.
+	StrictFIFO               = os.Getenv("CONCORD_STRICT_FIFO") != ""                     // stage queued tasks of equal priority in creation order.
+	BrokerRetries            = int(envFloat("CONCORD_BROKER_RETRIES"))                    // the number of retries of failed broker calls.
+	BrokerBackoff            = envDurationOr("CONCORD_BROKER_BACKOFF", time.Second/10)    // the delay before the first broker call retry.
+	BrokerTimeout            = envDurationOr("CONCORD_BROKER_TIMEOUT", time.Second*10)    // the timeout of each broker call attempt.
+	NatsURL                  = os.Getenv("CONCORD_NATS_URL")                              // the url of the nats server the services are called through.
+	AMQPURL                  = os.Getenv("CONCORD_AMQP_URL")                              // the url of the amqp server the services are called through.
+	FailoverPolicy           = os.Getenv("CONCORD_FAILOVER_POLICY")                       // the order in which the endpoints of a service are called.
+	FailoverCooldown         = envDurationOr("CONCORD_FAILOVER_COOLDOWN", time.Second*30) // the time a failed service endpoint is called last.
+	NotifyOverflow           = os.Getenv("CONCORD_NOTIFY_OVERFLOW")                       // the notification dropped when the notify queue is full.
 )
 
 var (
+	AtCapacityError          = errors.New("controller at capacity")
+	CallbackFailedError      = errors.New("callback failed")
+	CallbackHostError        = errors.New("callback host not allowed")
+	DependencyFailedError    = errors.New("dependency failed")
+	DependencyNotFoundError  = errors.New("dependency not found")
+	GroupNotFoundError       = errors.New("group not found")
+	InvalidCursorError       = errors.New("invalid cursor")
 	NoStagedTaskError        = errors.New("no staged task")
 	NotificationFailedError  = errors.New("notification failed")
+	PoolConflictError        = errors.New("pool name conflicts with resource")
+	ParentNotFoundError      = errors.New("parent not found")
+	ParentNotStartedError    = errors.New("parent not started")
+	PreemptNotRequestedError = errors.New("preemption not requested")
 	QueueNotFoundError       = errors.New("queue not found")
 	ResourceUnavailableError = errors.New("resource unavailable")
+	ResourceCycleError       = errors.New("resource hierarchy cycle")
+	ResourceDrainingError    = errors.New("resource draining")
 	ResourceExistsError      = errors.New("resource exists")
+	ResourceNotFoundError    = errors.New("resource not found")
+	StartRateLimitedError    = errors.New("start rate limited")
 	TaskAddFailedError       = errors.New("task add failed")
 	TaskRemoveFailedError    = errors.New("task remove failed")
 	TaskAlreadyStartedError  = errors.New("task already started")
 	TaskNotFoundError        = errors.New("task not found")
+	TaskNotPausedError       = errors.New("task not paused")
+	TaskNotQueuedError       = errors.New("task not queued")
+	TaskNotRetryableError    = errors.New("task not retryable")
+	TaskNotScheduledError    = errors.New("task not scheduled")
 	TaskNotStartedError      = errors.New("task not started")
+	TaskUpdateFailedError    = errors.New("task update failed")
 	TimetableNotFound        = errors.New("timetable not found")
 )
 
 const (
-	BrokerCallErrorCode jrpc2.ErrorCode = -32100 // broker call jrpc error code.
+	BrokerCallErrorCode     jrpc2.ErrorCode = -32100 // broker call jrpc error code.
+	BrokerRejectedErrorCode jrpc2.ErrorCode = -32101 // broker call rejected with a 4xx status error code.
+	BrokerResponseErrorCode jrpc2.ErrorCode = -32102 // broker call answered with an invalid response error code.
 )
 
+// BrokerUnsentErrorMsg is the message of a broker call error whose request
+// was not sent, so the call can be made again at another endpoint.
+const BrokerUnsentErrorMsg jrpc2.ErrorMsg = "Request not sent"
+
 // ServiceBroker contains method for calling external services.
 type ServiceBroker interface {
-	Call(string, string, map[string]interface{}) (interface{}, *jrpc2.ErrorObject)
+	Call(context.Context, string, string, map[string]interface{}) (interface{}, *jrpc2.ErrorObject)
+}
+
+// BatchBroker is a service broker that can send several calls to a service
+// in one round trip.
+type BatchBroker interface {
+	BatchCall(context.Context, string, []BrokerCall) ([]BrokerResult, *jrpc2.ErrorObject)
+}
+
+// BrokerCall is a call of a remote method in a broker batch.
+type BrokerCall struct {
+	// Method is the remote method name.
+	// Params are the remote method parameters.
+	Method string
+	Params map[string]interface{}
+}
+
+// BrokerResult is the result of a call in a broker batch.
+type BrokerResult struct {
+	// Result is the result of the remote method.
+	// Error is the error returned by the remote method.
+	Result interface{}
+	Error  *jrpc2.ErrorObject
+}
+
+// batchCall sends the calls to the host in one batch if the broker
+// supports batches, and one after the other otherwise. The results of the
+// calls delivered before a call failed in transport are returned with the
+// transport error.
+func batchCall(ctx context.Context, broker ServiceBroker, host string, calls []BrokerCall) ([]BrokerResult, *jrpc2.ErrorObject) {
+	if batcher, ok := broker.(BatchBroker); ok {
+		return batcher.BatchCall(ctx, host, calls)
+	}
+	return callEach(ctx, broker, host, calls)
+}
+
+// callEach makes the calls to the host one after the other with the
+// results of batchCall.
+func callEach(ctx context.Context, broker ServiceBroker, host string, calls []BrokerCall) ([]BrokerResult, *jrpc2.ErrorObject) {
+	results := make([]BrokerResult, 0, len(calls))
+	for _, call := range calls {
+		result, errObj := broker.Call(ctx, host, call.Method, call.Params)
+		if errObj != nil && errObj.Code == BrokerCallErrorCode {
+			return results, errObj
+		}
+		results = append(results, BrokerResult{result, errObj})
+	}
+	return results, nil
+}
+
+// CallInt calls the method with parameters on the service at the host and
+// returns its integer result.
+//
+// an error is encountered if the call fails or its result is not an
+// integer.
+func CallInt(ctx context.Context, broker ServiceBroker, host string, method string, params map[string]interface{}) (int, *jrpc2.ErrorObject) {
+	result, errObj := broker.Call(ctx, host, method, params)
+	if errObj != nil {
+		return 0, errObj
+	}
+	return intResult(method, result)
+}
+
+// CallObject calls the method with parameters on the service at the host
+// and returns its object result. Nil is returned if the result is null.
+//
+// an error is encountered if the call fails or its result is not an
+// object.
+func CallObject(ctx context.Context, broker ServiceBroker, host string, method string, params map[string]interface{}) (map[string]interface{}, *jrpc2.ErrorObject) {
+	result, errObj := broker.Call(ctx, host, method, params)
+	if errObj != nil {
+		return nil, errObj
+	}
+	return objectResult(method, result)
+}
+
+// CallDecode calls the method with parameters on the service at the host
+// and decodes its object result into v. False is returned if the result is
+// null, in which case v is unchanged.
+//
+// an error is encountered if the call fails or its result cannot be
+// decoded into v.
+func CallDecode(ctx context.Context, broker ServiceBroker, host string, method string, params map[string]interface{}, v interface{}) (bool, *jrpc2.ErrorObject) {
+	object, errObj := CallObject(ctx, broker, host, method, params)
+	if errObj != nil || object == nil {
+		return false, errObj
+	}
+	if err := mapstructure.Decode(object, v); err != nil {
+		return false, responseError("%s result: %s", method, err)
+	}
+	return true, nil
+}
+
+// intResult returns the result of the method as an integer.
+//
+// an error is encountered if the result is not an integer.
+func intResult(method string, result interface{}) (int, *jrpc2.ErrorObject) {
+	n, ok := result.(float64)
+	if !ok || n != math.Trunc(n) {
+		return 0, responseError("%s result %v is not an integer", method, result)
+	}
+	return int(n), nil
+}
+
+// objectResult returns the result of the method as an object. Nil is
+// returned if the result is null.
+//
+// an error is encountered if the result is neither an object nor null.
+func objectResult(method string, result interface{}) (map[string]interface{}, *jrpc2.ErrorObject) {
+	if result == nil {
+		return nil, nil
+	}
+	object, ok := result.(map[string]interface{})
+	if !ok {
+		return nil, responseError("%s result %v is not an object", method, result)
+	}
+	return object, nil
+}
+
+// responseError returns the error of a broker call answered with an invalid
+// response.
+func responseError(format string, v ...interface{}) *jrpc2.ErrorObject {
+	return &jrpc2.ErrorObject{Code: BrokerResponseErrorCode, Message: jrpc2.ServerErrorMsg, Data: fmt.Sprintf(format, v...)}
+}
+
+// JsonRPCServiceBroker is json-rpc 2.0 service broker. The zero value uses
+// the default http client.
+type JsonRPCServiceBroker struct {
+	client     *http.Client
+	clients    map[string]*http.Client
+	auths      map[string]ServiceAuth
+	transports map[string]BrokerTransport
+}
+
+// BrokerTransport carries the calls of the broker to a service over
+// another protocol than json-rpc over http.
+type BrokerTransport interface {
+	// RoundTrip calls the method with parameters on the service once and
+	// returns its result and error. A transport error is returned if the
+	// call failed before the method returned, and a rejectedError if the
+	// service refused the call.
+	RoundTrip(ctx context.Context, method string, params map[string]interface{}) (interface{}, *jrpc2.ErrorObject, error)
+}
+
+// NewJsonRPCServiceBroker creates a new broker with a long-lived http
+// client that keeps up to BrokerIdleConns connections per service alive
+// between calls.
+func NewJsonRPCServiceBroker() *JsonRPCServiceBroker {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         (&net.Dialer{Timeout: BrokerDialTimeout, KeepAlive: time.Second * 30}).DialContext,
+		MaxIdleConns:        BrokerIdleConns * 4,
+		MaxIdleConnsPerHost: BrokerIdleConns,
+		IdleConnTimeout:     time.Second * 90,
+	}
+	return &JsonRPCServiceBroker{client: &http.Client{Transport: transport}}
 }
 
-// JsonRPCServiceBroker is json-rpc 2.0 service broker.
-type JsonRPCServiceBroker struct{}
+// UseTransport makes the broker call the service at the host over the
+// transport. It must be called before the broker is used.
+func (t *JsonRPCServiceBroker) UseTransport(host string, transport BrokerTransport) {
+	if t.transports == nil {
+		t.transports = make(map[string]BrokerTransport)
+	}
+	t.transports[host] = transport
+}
 
 // Call initiates a remote call of the method with parameters to the
-// provided url.
-func (t *JsonRPCServiceBroker) Call(url string, method string, params map[string]interface{}) (interface{}, *jrpc2.ErrorObject) {
-	p, _ := json.Marshal(params)
-	req := bytes.NewBuffer([]byte(fmt.Sprintf(`{"jsonrpc": "2.0", "method": "%s", "params": %s, "id": 0}`, method, string(p))))
-	resp, err := http.Post(fmt.Sprintf("http://%s/rpc", url), "application/json", req)
+// provided url, or over the transport of the url if one is set.
+//
+// Each attempt times out after BrokerTimeout. Calls of the idempotent
+// methods that fail in transport or with a 5xx status are retried up to
+// BrokerRetries times with an exponential backoff with jitter. Calls of
+// the other methods are only retried when the request was not sent, such
+// as when the connection failed. Errors returned by the remote method are
+// not retried. The call is abandoned when the context is done.
+func (t *JsonRPCServiceBroker) Call(ctx context.Context, url string, method string, params map[string]interface{}) (interface{}, *jrpc2.ErrorObject) {
+	if transport, ok := t.transports[url]; ok {
+		var result interface{}
+		var resultErr *jrpc2.ErrorObject
+		debugf(ctx, "broker request [%s %s %v]\n", url, method, params)
+		errObj := retryCall(ctx, url, method, func() (err error) {
+			ctx, cancel := context.WithTimeout(ctx, BrokerTimeout)
+			defer cancel()
+			result, resultErr, err = transport.RoundTrip(ctx, method, params)
+			return err
+		})
+		if errObj != nil {
+			return nil, errObj
+		}
+		debugf(ctx, "broker response [%s %s %v %v]\n", url, method, result, resultErr)
+		return result, resultErr
+	}
+	req, errObj := jsonRPCRequest(ctx, url, method, params)
+	if errObj != nil {
+		return nil, errObj
+	}
+	body, errObj := t.send(ctx, url, method, req)
+	if errObj != nil {
+		return nil, errObj
+	}
+	return jsonRPCResponse(ctx, url, method, body)
+}
+
+// BatchCall sends the calls to the provided url as one json-rpc batch and
+// returns their results in the order of the calls. The batch is retried
+// like a single call of a method that is not idempotent. An error is
+// returned if the batch fails as a whole, in which case no call is known
+// to be delivered. The calls are sent one after the other if the url has a
+// transport.
+func (t *JsonRPCServiceBroker) BatchCall(ctx context.Context, url string, calls []BrokerCall) ([]BrokerResult, *jrpc2.ErrorObject) {
+	if _, ok := t.transports[url]; ok {
+		return callEach(ctx, t, url, calls)
+	}
+	if len(calls) == 0 {
+		return nil, nil
+	}
+	reqs := make([]brokerRequest, len(calls))
+	index := make(map[uint64]int, len(calls))
+	for i, call := range calls {
+		reqs[i] = newBrokerRequest(call.Method, call.Params)
+		index[reqs[i].Id] = i
+	}
+	req, err := json.Marshal(reqs)
 	if err != nil {
-		return nil, &jrpc2.ErrorObject{
-			Code:    BrokerCallErrorCode,
-			Message: jrpc2.ServerErrorMsg,
-			Data:    err.Error(),
+		return nil, &jrpc2.ErrorObject{Code: jrpc2.InvalidParamsCode, Message: jrpc2.InvalidParamsMsg, Data: err.Error()}
+	}
+	debugf(ctx, "broker request [%s batch %s]\n", url, req)
+	body, errObj := t.send(ctx, url, "batch", req)
+	if errObj != nil {
+		return nil, errObj
+	}
+	debugf(ctx, "broker response [%s batch %s]\n", url, body)
+	var respObjs []struct {
+		Result interface{}        `json:"result"`
+		Error  *jrpc2.ErrorObject `json:"error"`
+		Id     *uint64            `json:"id"`
+	}
+	if err := json.Unmarshal(body, &respObjs); err != nil {
+		var respObj jrpc2.ResponseObject
+		if json.Unmarshal(body, &respObj) == nil && respObj.Error != nil {
+			return nil, respObj.Error
 		}
+		return nil, &jrpc2.ErrorObject{Code: jrpc2.ParseErrorCode, Message: jrpc2.ParseErrorMsg, Data: err.Error()}
 	}
-	defer resp.Body.Close()
+	results := make([]BrokerResult, len(calls))
+	for i := range results {
+		results[i].Error = &jrpc2.ErrorObject{Code: jrpc2.InternalErrorCode, Message: jrpc2.InternalErrorMsg, Data: "missing batch response"}
+	}
+	for _, respObj := range respObjs {
+		if respObj.Id == nil {
+			continue
+		}
+		if i, ok := index[*respObj.Id]; ok {
+			results[i] = BrokerResult{respObj.Result, respObj.Error}
+		}
+	}
+	return results, nil
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
+// send posts the json-rpc request to the provided url with the retries of
+// Call and returns the response body.
+func (t *JsonRPCServiceBroker) send(ctx context.Context, url string, method string, req []byte) ([]byte, *jrpc2.ErrorObject) {
+	var body []byte
+	errObj := retryCall(ctx, url, method, func() (err error) {
+		body, err = t.post(ctx, url, req)
+		return err
+	})
+	return body, errObj
+}
+
+// retryCall makes the attempts of a call of the method to the url until one
+// succeeds, is rejected, or the retries are used up. A failed call of a
+// method that is not idempotent is only retried if its request was not
+// sent, since the service may already have applied it. The error of a call
+// whose last request was not sent has the BrokerUnsentErrorMsg message.
+func retryCall(ctx context.Context, url string, method string, try func() error) *jrpc2.ErrorObject {
+	backoff := BrokerBackoff
+	for attempt := 1; ; attempt++ {
+		err := try()
+		if err == nil {
+			return nil
+		}
+		if rejected, ok := err.(rejectedError); ok {
+			return &jrpc2.ErrorObject{
+				Code:    BrokerRejectedErrorCode,
+				Message: jrpc2.ServerErrorMsg,
+				Data:    rejected.Error(),
+			}
+		}
+		if attempt > BrokerRetries || ctx.Err() != nil || !(IdempotentMethods[method] || unsent(err)) {
+			msg := jrpc2.ServerErrorMsg
+			if unsent(err) {
+				msg = BrokerUnsentErrorMsg
+			}
+			return &jrpc2.ErrorObject{
+				Code:    BrokerCallErrorCode,
+				Message: msg,
+				Data:    fmt.Sprintf("%s (attempts %d)", err, attempt),
+			}
+		}
+		logf(ctx, "broker call failed [%s %s %d %s]\n", url, method, attempt, err)
+		addRetry(ctx)
+		sleepContext(ctx, backoff/2+time.Duration(rand.Int63n(int64(backoff))))
+		if backoff *= 2; backoff > BrokerMaxBackoff {
+			backoff = BrokerMaxBackoff
+		}
+	}
+}
+
+// post posts the json-rpc request to the service at the url and returns
+// the response body. An error is returned if the request fails in
+// transport or with a 5xx status, and a rejectedError if it fails with a
+// 4xx status. The response body is read to the end so that the connection
+// can be reused.
+func (t *JsonRPCServiceBroker) post(ctx context.Context, url string, req []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, BrokerTimeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, serviceURL(url), bytes.NewReader(req))
 	if err != nil {
-		return nil, &jrpc2.ErrorObject{
-			Code:    BrokerCallErrorCode,
-			Message: jrpc2.ServerErrorMsg,
-			Data:    err.Error(),
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if id := CorrelationId(ctx); id != "" {
+		httpReq.Header.Set(CorrelationHeader, id)
+	}
+	if auth, ok := t.auths[url]; ok {
+		if err := auth.apply(ctx, httpReq); err != nil {
+			return nil, unsentError{err}
 		}
 	}
+	client, ok := t.clients[url]
+	if !ok {
+		client = t.client
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if resp.StatusCode >= 400 {
+		return nil, rejectedError{fmt.Errorf("status %d", resp.StatusCode)}
+	}
+	return body, nil
+}
 
-	var respObj jrpc2.ResponseObject
-	json.Unmarshal(body, &respObj)
+// rejectedError is the refusal of a broker call by the service, such as a
+// 4xx status, which is not retried.
+type rejectedError struct {
+	error
+}
+
+// unsentError is the failure of a broker call before its request was
+// sent, such as a refused connection, which is retried for every method.
+type unsentError struct {
+	error
+}
+
+// IdempotentMethods are the broker methods that can be called again
+// without changing their outcome, and so are retried after any transport
+// failure.
+var IdempotentMethods = map[string]bool{
+	"get":    true,
+	"remove": true,
+	"health": true,
+}
+
+// unsent reports whether the broker call failed before its request was
+// sent.
+func unsent(err error) bool {
+	if _, ok := err.(unsentError); ok {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// brokerRequestId is the id of the last json-rpc request of a broker call.
+var brokerRequestId uint64
+
+// brokerRequest is the json-rpc 2.0 request object of a broker call.
+type brokerRequest struct {
+	Jsonrpc string                 `json:"jsonrpc"`
+	Method  string                 `json:"method"`
+	Params  map[string]interface{} `json:"params"`
+	Id      uint64                 `json:"id"`
+}
+
+// newBrokerRequest returns the request of the call of the method with
+// parameters with a new unique non-zero id.
+func newBrokerRequest(method string, params map[string]interface{}) brokerRequest {
+	return brokerRequest{"2.0", method, params, atomic.AddUint64(&brokerRequestId, 1)}
+}
+
+// jsonRPCRequest returns the encoded json-rpc request of the call of the
+// method with parameters to the host.
+//
+// an error is encountered if the parameters cannot be encoded.
+func jsonRPCRequest(ctx context.Context, host string, method string, params map[string]interface{}) ([]byte, *jrpc2.ErrorObject) {
+	req, err := json.Marshal(newBrokerRequest(method, params))
+	if err != nil {
+		return nil, &jrpc2.ErrorObject{Code: jrpc2.InvalidParamsCode, Message: jrpc2.InvalidParamsMsg, Data: err.Error()}
+	}
+	debugf(ctx, "broker request [%s %s %s]\n", host, method, req)
+	return req, nil
+}
 
+// jsonRPCResponse returns the result and error of the json-rpc response to
+// the call of the method to the host.
+//
+// an error is encountered if the body is not a json-rpc 2.0 response
+// object.
+func jsonRPCResponse(ctx context.Context, host string, method string, body []byte) (interface{}, *jrpc2.ErrorObject) {
+	debugf(ctx, "broker response [%s %s %s]\n", host, method, body)
+	var respObj jrpc2.ResponseObject
+	if err := json.Unmarshal(body, &respObj); err != nil {
+		return nil, responseError("%s response: %s", method, err)
+	}
+	if respObj.Jsonrpc != "2.0" {
+		return nil, responseError("%s response: invalid jsonrpc version %q", method, respObj.Jsonrpc)
+	}
 	return respObj.Result, respObj.Error
 }
 
+// DeferredCall is a broker call that could not be delivered because the
+// downstream service was unreachable.
+type DeferredCall struct {
+	// Created is the time the call was deferred.
+	// Host is the host of the unreachable service.
+	// Id is the unique version 1 uuid assigned for call identification.
+	// Method is the remote method name.
+	// Params are the remote method parameters.
+	// Status is the task status applied once the call is delivered.
+	// TaskId is the id of the task the call was made for.
+	// Attempts is the number of failed deliveries of a task callback.
+	Created  time.Time              `json:"created"`
+	Host     string                 `json:"host"`
+	Id       string                 `json:"_key"`
+	Method   string                 `json:"method"`
+	Params   map[string]interface{} `json:"params"`
+	Status   string                 `json:"status"`
+	TaskId   string                 `json:"taskId"`
+	Attempts int                    `json:"attempts,omitempty"`
+}
+
+// NewDeferredCall creates a new deferred call instance.
+func NewDeferredCall(taskId string, host string, method string, params map[string]interface{}, status string) *DeferredCall {
+	id, _ := uuid.NewV1()
+	return &DeferredCall{time.Now(), host, id.String(), method, params, status, taskId, 0}
+}
+
 // Event contains the details of a status change event.
 type Event struct {
 	// Kind is the type of status change event.
@@ -99,40 +648,233 @@ func NewEvent(kind string, meta []byte) *Event {
 	return &Event{Kind: kind, Created: time.Now(), Meta: meta}
 }
 
+// DependencyStatus is the health of a downstream dependency.
+type DependencyStatus struct {
+	// Error is the reason the dependency is unhealthy.
+	// Healthy indicates if the dependency is reachable.
+	Error   string `json:"error,omitempty"`
+	Healthy bool   `json:"healthy"`
+}
+
+// ServerInfo contains the build and configuration details of the controller.
+type ServerInfo struct {
+	// BuildCommit is the commit the controller was built from.
+	// PriorityQueueHost is the configured priority queue host.
+	// ResourceCount is the number of managed resources.
+	// StageInterval is the stage loop interval in seconds.
+	// StatusChangeNotifierHost is the configured status change notifier host.
+	// TimetableHost is the configured timetable host.
+	// Version is the controller version.
+	BuildCommit              string  `json:"buildCommit"`
+	PriorityQueueHost        string  `json:"priorityQueueHost"`
+	ResourceCount            int     `json:"resourceCount"`
+	StageInterval            float64 `json:"stageInterval"`
+	StatusChangeNotifierHost string  `json:"statusChangeNotifierHost"`
+	TimetableHost            string  `json:"timetableHost"`
+	Version                  string  `json:"version"`
+}
+
+// StagedTask is the task waiting in the stage of a resource.
+type StagedTask struct {
+	// Id is the id of the staged task.
+	// Key is the resource key of the stage.
+	// Meta is the user defined data of the staged task.
+	// StagedFor is the number of seconds the task has been staged.
+	Id        string          `json:"id"`
+	Key       string          `json:"key"`
+	Meta      json.RawMessage `json:"meta,omitempty"`
+	StagedFor float64         `json:"stagedFor"`
+}
+
 type Controller interface {
-	AddResource(string, Model) error
+	AcknowledgePreemption(string, Model, Model) error
+	AddResource(string, string, map[string]string, float64, Model) error
 	AddTask(*Task, Model, Model) error
-	CompleteTask(string, string, Model, Model) error
+	AppendTaskLog(string, string, string, Model, Model) error
+	CompleteTask(string, string, json.RawMessage, string, bool, Model, Model) error
+	CountTasks(bool, Model) ([]*TaskCount, error)
+	EstimateStart(string, Model, Model) (*StartEstimate, error)
+	ExportTasks(string, string, map[string]string, Model, func(*Task) error) error
+	ForceCompleteTask(string, string, string, Model, Model) error
+	GetResource(string) (*ResourceDetail, error)
+	GetResourceStats(string, []time.Duration, Model) (*ResourceStats, error)
+	GetStagedTask(string) (*StagedTask, error)
 	GetTask(string, Model) (*Task, error)
+	ListStagedTasks(string) ([]*StagedTask, error)
+	GetTaskHistory(string, Model) ([]*TaskHistory, error)
+	GetTaskLog(string, Model) ([]*TaskLog, error)
+	GetGroupStatus(string, Model) (*GroupStatus, error)
+	GetTaskStats(string, Model) (*TaskStats, error)
+	Health() map[string]*DependencyStatus
+	Heartbeat(string, Model) (time.Time, error)
 	ListPriorityQueue(string) (map[string]interface{}, error)
+	ListResources(Model) ([]*Resource, error)
+	ListFailedEvents(string, int, Model) ([]*FailedEvent, error)
+	ListTasks(string, string, map[string]string, int, int, Model) (*TaskPage, error)
 	ListTimetable(string) (map[string]interface{}, error)
 	Notify(*Event) error
-	RemoveTask(string, Model) error
+	PauseResource(string, Model) error
+	PauseTask(string, Model) error
+	PurgeTasks(time.Duration, int, Model) (int, error)
+	RemoveResource(string, Model, Model) error
+	RegisterResource(string, map[string]string, int, Model, Model) ([]string, error)
+	RemoveTask(string, string, Model, Model) error
+	ResourceHeartbeat(string, Model) error
+	RescheduleTask(string, time.Time, Model) error
+	RestoreResource(*Resource, Model, Model) error
+	RestoreStagedTask(*Task, Model) error
+	RestoreTask(string, Model, Model, Model) error
+	ResumeResource(string, Model) error
+	ResumeTask(string, Model) error
 	StageTask(*Task, Model, bool)
-	StartTask(string, Model, Model) error
+	RetryTask(string, Model) error
+	SearchTasks(map[string]interface{}, map[string]string, int, int, Model) (*TaskPage, error)
+	ServerInfo() *ServerInfo
+	SetResourceParent(string, string, Model) error
+	SetResourceQuota(string, *ResourceQuota, Model) error
+	SetResourceWeight(string, float64, Model) error
+	StartTask(string, string, Model, Model) error
+	UnstageTask(string, Model) error
+	UpdateTaskPriority(string, float64, Model) error
+	ValidateTask(*Task, Model) (*TaskValidation, error)
 }
 
 // ResourceController handles tasks progression and resource allocation.
 type ResourceController struct {
-	resources map[string]*Resource
-	stage     sync.Map
-	broker    ServiceBroker
+	resources     map[string]*Resource
+	rescLock      sync.RWMutex
+	stage         sync.Map
+	broker        ServiceBroker
+	callBuffer    Model
+	history       Model
+	groups        Model
+	groupLock     sync.Mutex
+	preempting    sync.Map
+	rescStats     Model
+	exhausted     sync.Map
+	polls         sync.Map
+	staging       sync.Map
+	turns         sync.Map
+	depths        sync.Map
+	inflight      sync.WaitGroup
+	inflightLock  sync.Mutex
+	stopping      bool
+	hooks         []ControllerHooks
+	shards        *Sharder
+	limiter       *StartLimiter
+	notifications *NotifyQueue
+	notifiers     sync.WaitGroup
+	failedEvents  Model
+	ctx           context.Context
+	cancel        context.CancelFunc
 }
 
-// NewResourceController creates a new ResourceController instance.
-func NewResourceController(broker ServiceBroker) *ResourceController {
-	return &ResourceController{make(map[string]*Resource), sync.Map{}, broker}
+// NewResourceController creates a new ResourceController instance. The
+// hooks are called on the task lifecycle events in the order provided.
+func NewResourceController(broker ServiceBroker, hooks ...ControllerHooks) *ResourceController {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ResourceController{resources: make(map[string]*Resource), broker: broker, hooks: hooks, ctx: ctx, cancel: cancel}
 }
 
-// AddResource adds the resource to the ResourceController for management.
-func (ctrl *ResourceController) AddResource(name string, taskModel Model) error {
-	if _, ok := ctrl.resources[name]; ok {
-		return ResourceExistsError
+// BufferCalls enables store-and-forward buffering of task submission
+// calls to unreachable services using the provided deferred call model.
+func (ctrl *ResourceController) BufferCalls(callModel Model) {
+	ctrl.callBuffer = callModel
+}
+
+// RecordHistory enables recording of task status transitions using the
+// provided task history model.
+func (ctrl *ResourceController) RecordHistory(historyModel Model) {
+	ctrl.history = historyModel
+}
+
+// TrackResourceStats enables recording of the busy periods of resources
+// using the provided resource stat model.
+func (ctrl *ResourceController) TrackResourceStats(resourceStatModel Model) {
+	ctrl.rescStats = resourceStatModel
+}
+
+// LimitStarts enables limiting of the rate of task starts per resource key
+// using the provided start limiter.
+func (ctrl *ResourceController) LimitStarts(limiter *StartLimiter) {
+	ctrl.limiter = limiter
+}
+
+// TrackGroups enables tracking of task group membership and completion
+// using the provided task group model.
+func (ctrl *ResourceController) TrackGroups(groupModel Model) {
+	ctrl.groups = groupModel
+}
+
+// AcknowledgePreemption returns the preempted started task to the priority
+// queue or timetable, releases the resource and stages the task that the
+// preemption was requested for in front of the stage.
+//
+// an error is encountered if preemption of the task was not requested.
+func (ctrl *ResourceController) AcknowledgePreemption(taskId string, taskModel Model, resourceModel Model) error {
+	ctx := ctrl.operation()
+	task, err := getTask(taskId, taskModel)
+	if err != nil {
+		return err
+	}
+	if task.Status != StatusStarted {
+		return TaskNotStartedError
+	}
+	view, ok := ctrl.viewResource(task.Key)
+	v, requested := ctrl.preempting.Load(task.Key)
+	if !requested || v.(preemption).TaskId != task.Id || !ok || view.TaskId != task.Id {
+		return PreemptNotRequestedError
+	}
+	status, err := ctrl.submitTask(ctx, task)
+	if err != nil {
+		return err
+	}
+	ctrl.preempting.Delete(task.Key)
+	if resource, ok := ctrl.releaseTaskLock(task.Key, task.Id); ok {
+		if err := ctrl.saveResource(resource, resourceModel); err != nil {
+			return err
+		}
+	}
+	if err := task.SetStatus(status); err != nil {
+		return err
+	}
+	task.LeaseExpires = nil
+	task.EndAttempt(StatusCancelled, "task preempted")
+	if _, err := taskModel.Save(task); err != nil {
+		return err
+	}
+	ctrl.recordTransition(ctx, task, StatusStarted, "task preempted")
+
+	meta := make(map[string]interface{})
+	json.Unmarshal(task.Meta, &meta)
+	meta["_status"] = status
+	meta["_id"] = task.Id
+	data, _ := json.Marshal(meta)
+	ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data))
+	logf(ctx, "preempted task [%s %s] on resource [%s]\n", task.Created, string(task.Meta), task.Key)
+
+	if view, _ := ctrl.viewResource(task.Key); view.Draining {
+		return nil
 	}
+	return ctrl.stagePreemptor(ctx, task.Key, v.(preemption).By, taskModel)
+}
+
+// AddResource adds the resource to the ResourceController for management.
+// Resources with a pool share the priority queue and timetable of the pool.
+// The tags of the resource are matched against the task constraints and
+// free resources with a higher weight stage tasks first.
+//
+// an error is encountered if the pool name is the name of a resource.
+func (ctrl *ResourceController) AddResource(name string, pool string, tags map[string]string, weight float64, taskModel Model) error {
 	resource := NewResource(name)
-	ctrl.resources[name] = resource
-	_, err := taskModel.Save(resource)
-	log.Printf("resource added [%s]\n", name)
+	resource.Pool = pool
+	resource.Tags = tags
+	resource.Weight = weight
+	if err := ctrl.insertResource(resource); err != nil {
+		return err
+	}
+	err := ctrl.saveResource(resource, taskModel)
+	log.Printf("resource added [%s %s]\n", name, pool)
 	return err
 }
 
@@ -143,40 +885,45 @@ func (ctrl *ResourceController) AddResource(name string, taskModel Model) error
 //
 // If the run at point in time is omitted the task is added to the
 // priority queue service for priority order execution.
+//
+// The task is saved with the created status before it is submitted. If the
+// submission or the following save fails, the task is taken out of the
+// priority queue or timetable again and removed from the database.
+//
+// an error is encountered if the task has a parent that does not exist
+// or that is not in the started state.
 func (ctrl *ResourceController) AddTask(task *Task, taskModel Model, resourceModel Model) error {
-	var result interface{}
-	var errObj *jrpc2.ErrorObject
-	var status string
+	return ctrl.addTask(ctrl.operation(), task, taskModel, resourceModel)
+}
 
+// addTask is AddTask in the operation of the context.
+func (ctrl *ResourceController) addTask(ctx context.Context, task *Task, taskModel Model, resourceModel Model) error {
+	if err := ctrl.checkParent(task, taskModel); err != nil {
+		return err
+	}
+	pending, err := ctrl.pendingDependencies(task, taskModel)
+	if err != nil {
+		return err
+	}
 	task.Status = StatusCreated
 	if _, err := taskModel.Save(task); err != nil {
 		return err
 	}
+	ctrl.recordTransition(ctx, task, "", "task added")
 
-	params := map[string]interface{}{"key": task.Key, "id": task.Id}
-	if task.RunAt != nil {
-		params["runAt"] = task.RunAt.Format(time.RFC3339)
-		result, errObj = ctrl.broker.Call(TimetableHost, "insert", params)
-		status = StatusScheduled
-		log.Printf("scheduled task [%s %s]\n", task.Created, string(task.Meta))
-	} else {
-		params["priority"] = task.Priority
-		result, errObj = ctrl.broker.Call(PriorityQueueHost, "push", params)
-		status = StatusQueued
-		log.Printf("queued task [%s %s]\n", task.Created, string(task.Meta))
-	}
-	if errObj != nil {
-		return errors.New(string(errObj.Message))
-	}
-	result = int(result.(float64))
-	if result != 0 {
-		return TaskAddFailedError
+	status := StatusBlocked
+	if pending == 0 {
+		if status, err = ctrl.submitTask(ctx, task); err != nil {
+			ctrl.rollbackTask(ctx, task, "", taskModel)
+			return err
+		}
 	}
-	task.Status = status
-	if _, err := taskModel.Save(task); err != nil {
+	if err := task.ChangeStatus(taskModel, status); err != nil {
+		ctrl.rollbackTask(ctx, task, status, taskModel)
 		return err
 	}
-	if _, err := resourceModel.Save(NewResource(task.Key)); err != nil {
+	ctrl.recordTransition(ctx, task, StatusCreated, "task submitted")
+	if err := ctrl.ensureResource(task.Key, resourceModel); err != nil {
 		return err
 	}
 
@@ -185,273 +932,3726 @@ func (ctrl *ResourceController) AddTask(task *Task, taskModel Model, resourceMod
 	meta["_status"] = status
 	meta["_id"] = task.Id
 	data, _ := json.Marshal(meta)
-	ctrl.Notify(NewEvent(TaskStatusChangedEvent, data))
-	log.Printf("created task [%s %s]\n", task.Created, string(task.Meta))
+	ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data))
+	logf(ctx, "created task [%s %s]\n", task.Created, string(task.Meta))
+	ctrl.runHooks(func(h ControllerHooks) { h.OnTaskAdded(task) })
 
 	return nil
 }
 
-// CompleteTask marks the staged task as complete.
+// ensureResource saves the resource of the task key. A new resource is
+// only saved if the key is neither a resource nor a pool, including the
+// resources and pool members stored by other instances that are not known
+// to the instance.
+func (ctrl *ResourceController) ensureResource(key string, resourceModel Model) error {
+	if ctrl.isPool(key) {
+		return nil
+	}
+	if resource, ok := ctrl.lookupResource(key); ok {
+		return ctrl.saveResource(resource, resourceModel)
+	}
+	docs, err := queryResource(key, resourceModel)
+	if err != nil {
+		return err
+	}
+	if len(docs) > 0 {
+		return nil
+	}
+	_, err = resourceModel.Save(NewResource(key))
+	return err
+}
+
+// AppendTaskLog stores the output snippet of the task with the provided id.
+// Only the most recent MaxTaskLogEntries snippets of a task are kept.
+//
+// an error is encountered if a task with the provided id does not exist.
+func (ctrl *ResourceController) AppendTaskLog(taskId string, stream string, data string, taskModel Model, logModel Model) error {
+	if _, err := getTask(taskId, taskModel); err != nil {
+		return err
+	}
+	if _, err := logModel.Save(NewTaskLog(taskId, stream, data)); err != nil {
+		return err
+	}
+	return trimTaskLog(taskId, logModel)
+}
+
+// CompleteTask marks the started task as complete, error or cancelled. The
+// result, if not nil, is stored on the task and the reason is recorded as
+// the failure reason of the attempt. The child tasks that are not final are
+// cancelled if cascade is set.
+//
+// If the completion cannot be saved the task stays started and the
+// resource is locked again unless another task claimed it meanwhile.
 //
 // an error is encountered if a task with the provided does not exist
-// or if the task is not in the started state.
-func (ctrl *ResourceController) CompleteTask(taskId string, status string, taskModel Model, resourceModel Model) error {
-	q := fmt.Sprintf(`FOR t IN %s FILTER t._key == @key RETURN t`, CollectionTasks)
-	tasks, err := taskModel.Query(q, map[string]interface{}{"key": taskId})
+// or if the task is not in the started state. A TransitionError is returned
+// for any other status.
+func (ctrl *ResourceController) CompleteTask(taskId string, status string, result json.RawMessage, reason string, cascade bool, taskModel Model, resourceModel Model) error {
+	ctx := ctrl.operation()
+	task, err := getTask(taskId, taskModel)
 	if err != nil {
 		return err
 	}
-	if len(tasks) < 1 {
-		return TaskNotFoundError
-	}
-	task := tasks[0].(*Task)
 	if task.Status != StatusStarted {
 		return TaskNotStartedError
 	}
-	ctrl.resources[task.Key].Status = ResourceFree
-	task.Status = status
-	if _, err := taskModel.Save(task); err != nil {
+	switch status {
+	case StatusComplete, StatusError, StatusCancelled:
+	default:
+		return &TransitionError{task.Status, status}
+	}
+	resource, _ := ctrl.lookupResource(task.Key)
+	lockedAt, saved := ctrl.resourceLockedAt(resource), task.snapshot()
+	if err := task.SetStatus(status); err != nil {
 		return err
 	}
-	if _, err := resourceModel.Save(ctrl.resources[task.Key]); err != nil {
+	ctrl.unlockResource(resource)
+	task.LeaseExpires = nil
+	task.EndAttempt(status, reason)
+	if result != nil {
+		task.Result = result
+	}
+	doc := ctrl.resourceDoc(resource)
+	if err := UpdateAll(Update{taskModel, task}, Update{resourceModel, doc}); err != nil {
+		*task = *saved
+		ctrl.relockResource(resource, task, lockedAt)
 		return err
 	}
+	ctrl.syncResource(resource, doc)
+	ctrl.recordTransition(ctx, task, StatusStarted, "task completed")
 
 	meta := make(map[string]interface{})
 	json.Unmarshal(task.Meta, &meta)
 	meta["_status"] = status
 	meta["_id"] = taskId
 	data, _ := json.Marshal(meta)
-	ctrl.Notify(NewEvent(TaskStatusChangedEvent, data))
-	log.Printf("completed task [%s %s]\n", task.Created, string(task.Meta))
+	ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data))
+	logf(ctx, "completed task [%s %s]\n", task.Created, string(task.Meta))
+	ctrl.runHooks(func(h ControllerHooks) { h.OnTaskCompleted(task) })
+
+	if status == StatusError && task.MaxAttempts > 0 {
+		if err := ctrl.retryFailedTask(ctx, task, taskModel); err != nil {
+			logln(ctx, err)
+		}
+	}
+	if err := ctrl.settleDependents(ctx, task, taskModel); err != nil {
+		logln(ctx, err)
+	}
+	if cascade {
+		if err := ctrl.cancelChildren(ctx, task.Id, taskModel, resourceModel); err != nil {
+			logln(ctx, err)
+		}
+	}
 
 	return nil
 }
 
-// GetTask returns the task with the provided id.
-func (ctrl *ResourceController) GetTask(taskId string, taskModel Model) (*Task, error) {
-	q := fmt.Sprintf(`FOR t IN %s FILTER t._key == @key RETURN t`, CollectionTasks)
-	tasks, err := taskModel.Query(q, map[string]interface{}{"key": taskId})
+// CountTasks returns the number of tasks per status and, if byKey is set,
+// per resource key.
+func (ctrl *ResourceController) CountTasks(byKey bool, countModel Model) ([]*TaskCount, error) {
+	results, err := queryTaskCounts(byKey, countModel)
 	if err != nil {
 		return nil, err
 	}
-	if len(tasks) < 1 {
-		return nil, TaskNotFoundError
+	counts := make([]*TaskCount, 0, len(results))
+	for _, count := range results {
+		counts = append(counts, count.(*TaskCount))
 	}
-	return tasks[0].(*Task), nil
+	return counts, nil
 }
 
-// ListPrioriryQueue lists the heap nodes in the priority queue
-// with the provided key.
-func (ctrl *ResourceController) ListPriorityQueue(key string) (map[string]interface{}, error) {
-	params := map[string]interface{}{"key": key}
-	result, errObj := ctrl.broker.Call(PriorityQueueHost, "get", params)
-	if errObj != nil {
-		return nil, errors.New(strings.ToLower(string(errObj.Message)))
+// EstimateStart estimates the start time of the queued, scheduled or
+// pending task with the provided id. The estimate assumes the running task,
+// the staged task and every queued task ahead of the task take the average
+// run time of the resource key.
+//
+// an error is encountered if the task is not queued, scheduled or pending.
+func (ctrl *ResourceController) EstimateStart(taskId string, taskModel Model, taskStatModel Model) (*StartEstimate, error) {
+	ctx := ctrl.operation()
+	task, err := getTask(taskId, taskModel)
+	if err != nil {
+		return nil, err
 	}
-	return result.(map[string]interface{}), nil
-}
-
-// ListTimetable lists the scheduled tasks in the timetable with the
-// provided key.
-func (ctrl *ResourceController) ListTimetable(key string) (map[string]interface{}, error) {
-	params := map[string]interface{}{"key": key}
-	result, errObj := ctrl.broker.Call(TimetableHost, "get", params)
-	if errObj != nil {
-		return nil, errors.New(strings.ToLower(string(errObj.Message)))
+	if task.Status != StatusQueued && task.Status != StatusScheduled && task.Status != StatusPending {
+		return nil, TaskNotQueuedError
 	}
-	return result.(map[string]interface{}), nil
-}
+	avg, err := task.GetAverageRunTime(taskStatModel)
+	if err != nil {
+		return nil, err
+	}
+	estimate := &StartEstimate{AverageRunTime: avg, Id: task.Id}
 
-// Notify sends a status change event to the status change notifier.
-func (ctrl *ResourceController) Notify(evt *Event) error {
-	params := map[string]interface{}{"created": evt.Created, "kind": evt.Kind, "meta": evt.Meta}
-	result, errObj := ctrl.broker.Call(StatusChangeNotifierHost, "notify", params)
-	if errObj != nil {
-		return errors.New(string(errObj.Message))
+	var wait float64
+	if view, ok := ctrl.viewResource(task.Key); ok && view.Status == ResourceLocked && view.LockedAt != nil {
+		wait = math.Max(avg-time.Since(*view.LockedAt).Seconds(), 0)
 	}
-	result = int(result.(float64))
-	if result != 0 {
-		return NotificationFailedError
+	if task.Status == StatusQueued {
+		queue, err := ctrl.listPriorityQueue(ctx, task.QueueKey())
+		if err != nil {
+			return nil, err
+		}
+		entries, _ := queue["heap"].([]interface{})
+		for _, entry := range entries {
+			v, _ := entry.(map[string]interface{})
+			if priority, ok := v["priority"].(float64); ok && priority < task.Priority {
+				estimate.Position++
+			}
+		}
+		if slot, staged := ctrl.stagedSlot(task.Key); staged {
+			wait += float64(slot.Len()) * avg
+		}
+		wait += float64(estimate.Position) * avg
 	}
-	return nil
+	estimate.EstimatedStart = time.Now().Add(time.Duration(wait * float64(time.Second)))
+	if task.Status == StatusScheduled && task.RunAt != nil && task.RunAt.After(estimate.EstimatedStart) {
+		estimate.EstimatedStart = *task.RunAt
+	}
+	return estimate, nil
 }
 
-func (ctrl *ResourceController) RemoveTask(id string, taskModel Model) error {
-	var result interface{}
-	var errObj *jrpc2.ErrorObject
+// ForceCompleteTask sets the status of the task regardless of its current
+// status. The task is taken out of the priority queue, timetable or stage
+// and the resource lock held by the task is released. The reason is
+// recorded in the task history.
+func (ctrl *ResourceController) ForceCompleteTask(taskId string, status string, reason string, taskModel Model, resourceModel Model) error {
+	return ctrl.forceCompleteTask(ctrl.operation(), taskId, status, reason, taskModel, resourceModel)
+}
 
-	q := fmt.Sprintf(`FOR t IN %s FILTER t._key == @key RETURN t`, CollectionTasks)
-	tasks, err := taskModel.Query(q, map[string]interface{}{"key": id})
+// forceCompleteTask is ForceCompleteTask in the operation of the context.
+func (ctrl *ResourceController) forceCompleteTask(ctx context.Context, taskId string, status string, reason string, taskModel Model, resourceModel Model) error {
+	task, err := getTask(taskId, taskModel)
 	if err != nil {
 		return err
 	}
-	if len(tasks) < 1 {
-		return TaskNotFoundError
-	}
-	task := tasks[0].(*Task)
-	if task.Status != StatusQueued && task.Status != StatusScheduled && task.Status != StatusPending {
-		return TaskRemoveFailedError
-	}
-	params := map[string]interface{}{"key": task.Key, "id": task.Id}
+	params := map[string]interface{}{"key": task.QueueKey(), "id": task.Id}
 	switch task.Status {
 	case StatusQueued:
-		result, errObj = ctrl.broker.Call(PriorityQueueHost, "remove", params)
+		if _, errObj := ctrl.broker.Call(ctx, PriorityQueueHost, "remove", params); errObj != nil {
+			logln(ctx, errObj.Message)
+		}
 	case StatusScheduled:
-		result, errObj = ctrl.broker.Call(TimetableHost, "remove", params)
-	}
-	if errObj != nil {
-		return errors.New(string(errObj.Message))
+		if _, errObj := ctrl.broker.Call(ctx, TimetableHost, "remove", params); errObj != nil {
+			logln(ctx, errObj.Message)
+		}
+	case StatusPending:
+		if slot, ok := ctrl.stagedSlot(task.Key); ok {
+			slot.Remove(task.Id)
+			ctrl.releaseSlot(task.Key, slot)
+		}
 	}
-	if result != nil {
-		result = int(result.(float64))
-		if result != 0 {
-			return TaskRemoveFailedError
+	if resource, ok := ctrl.releaseTaskLock(task.Key, task.Id); ok {
+		if err := ctrl.saveResource(resource, resourceModel); err != nil {
+			return err
 		}
 	}
-	task.Status = StatusCancelled
-	if err := taskModel.Remove(task); err != nil {
+	prev := task.Status
+	if err := task.ForceStatus(status); err != nil {
 		return err
 	}
+	task.LeaseExpires = nil
+	task.EndAttempt(status, fmt.Sprintf("task force completed: %s", reason))
+	if _, err := taskModel.Save(task); err != nil {
+		return err
+	}
+	ctrl.recordTransition(ctx, task, prev, fmt.Sprintf("task force completed: %s", reason))
+	if err := ctrl.settleDependents(ctx, task, taskModel); err != nil {
+		logln(ctx, err)
+	}
 
 	meta := make(map[string]interface{})
 	json.Unmarshal(task.Meta, &meta)
-	meta["_status"] = StatusCancelled
+	meta["_status"] = status
 	meta["_id"] = task.Id
 	data, _ := json.Marshal(meta)
-	ctrl.Notify(NewEvent(TaskStatusChangedEvent, data))
-	log.Printf("removed task [%s %s]\n", task.Created, string(task.Meta))
+	ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data))
+	logf(ctx, "force completed task [%s %s] from status [%s]: %s\n", task.Created, string(task.Meta), prev, reason)
+	ctrl.runHooks(func(h ControllerHooks) { h.OnTaskCompleted(task) })
 
 	return nil
 }
 
-// StartTask starts the staged task.
-//
-// an error is encountered if no staged task exists for the key or if
-// the resource associated with the task is locked.
-func (ctrl *ResourceController) StartTask(key string, taskModel Model, resourceModel Model) error {
-	ch, ok := ctrl.stage.Load(key)
+// GetGroupStatus returns the number of member tasks per status of the task
+// group with the provided id.
+func (ctrl *ResourceController) GetGroupStatus(groupId string, groupModel Model) (*GroupStatus, error) {
+	groups, err := queryTaskGroup(groupId, groupModel)
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) < 1 {
+		return nil, GroupNotFoundError
+	}
+	group := groups[0].(*TaskGroup)
+	status := &GroupStatus{
+		Complete: group.Completed != nil,
+		Counts:   make(map[string]int),
+		GroupId:  group.Id,
+		Total:    len(group.Members),
+	}
+	for _, s := range group.Members {
+		status.Counts[s]++
+	}
+	return status, nil
+}
+
+// GetResource returns the lock details of the resource with the provided
+// name and the depth of its priority queue and timetable.
+func (ctrl *ResourceController) GetResource(name string) (*ResourceDetail, error) {
+	ctx := ctrl.operation()
+	view, ok := ctrl.viewResource(name)
 	if !ok {
-		return NoStagedTaskError
+		return nil, ResourceNotFoundError
+	}
+	detail := &ResourceDetail{Resource: &view}
+	if view.Status == ResourceLocked && view.LockedAt != nil {
+		detail.LockedFor = time.Since(*view.LockedAt).Seconds()
+	}
+	queue, err := ctrl.listPriorityQueue(ctx, name)
+	if err != nil && err.Error() != QueueNotFoundError.Error() {
+		return nil, err
+	}
+	detail.QueueDepth = entryCount(queue)
+	timetable, err := ctrl.listTimetable(ctx, name)
+	if err != nil && err.Error() != TimetableNotFound.Error() {
+		return nil, err
+	}
+	detail.TimetableDepth = entryCount(timetable)
+	detail.StartLimit = ctrl.limiter.State(name, time.Now())
+	return detail, nil
+}
+
+// GetResourceStats returns the busy and idle time of the resource in each
+// of the windows that end now.
+func (ctrl *ResourceController) GetResourceStats(name string, windows []time.Duration, resourceStatModel Model) (*ResourceStats, error) {
+	view, ok := ctrl.viewResource(name)
+	if !ok {
+		return nil, ResourceNotFoundError
+	}
+	var longest time.Duration
+	for _, window := range windows {
+		if window > longest {
+			longest = window
+		}
+	}
+	rescStats, err := queryResourceStats(name, longest, resourceStatModel)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	periods := make([]*ResourceStat, 0, len(rescStats)+1)
+	for _, v := range rescStats {
+		periods = append(periods, v.(*ResourceStat))
+	}
+	if view.Status == ResourceLocked && view.LockedAt != nil {
+		periods = append(periods, NewResourceStat(name, *view.LockedAt, now))
+	}
+	stats := &ResourceStats{Name: name, Windows: make([]*ResourceUtilization, 0, len(windows))}
+	for _, window := range windows {
+		stats.Windows = append(stats.Windows, NewResourceUtilization(window, now, periods))
+	}
+	return stats, nil
+}
+
+// GetStagedTask returns the task staged for the resource key without
+// removing it from the stage.
+func (ctrl *ResourceController) GetStagedTask(key string) (*StagedTask, error) {
+	slot, ok := ctrl.stagedSlot(key)
+	if !ok {
+		return nil, NoStagedTaskError
+	}
+	tasks := slot.Tasks()
+	if len(tasks) == 0 {
+		return nil, NoStagedTaskError
+	}
+	task := tasks[0]
+
+	staged := &StagedTask{Id: task.Id, Key: key, Meta: task.Meta}
+	staged.StagedFor = time.Since(slot.StagedAt()).Seconds()
+	return staged, nil
+}
+
+// ListStagedTasks returns the tasks staged for the resource key in the
+// order they are started.
+func (ctrl *ResourceController) ListStagedTasks(key string) ([]*StagedTask, error) {
+	staged := make([]*StagedTask, 0)
+	slot, ok := ctrl.stagedSlot(key)
+	if !ok {
+		return staged, nil
+	}
+	for _, task := range slot.Tasks() {
+		v := &StagedTask{Id: task.Id, Key: key, Meta: task.Meta}
+		if task.StagedAt != nil {
+			v.StagedFor = time.Since(*task.StagedAt).Seconds()
+		}
+		staged = append(staged, v)
 	}
+	return staged, nil
+}
 
-	// safety nil buffer to prevent deadlock
-	ch.(chan *Task) <- nil
+// GetTask returns the task with the provided id and the tree of its child
+// tasks.
+func (ctrl *ResourceController) GetTask(taskId string, taskModel Model) (*Task, error) {
+	task, err := getTask(taskId, taskModel)
+	if err != nil {
+		return nil, err
+	}
+	if task.Children, err = ctrl.childTasks(task.Id, taskModel); err != nil {
+		return nil, err
+	}
+	return task, nil
+}
 
-	if task := <-ch.(chan *Task); task != nil {
-		if ctrl.resources[key].Status == ResourceLocked {
-			<-ch.(chan *Task)
-			ch.(chan *Task) <- task
-			return ResourceUnavailableError
+// ExpireTasks cancels the queued and scheduled tasks that are past their
+// expiration time and removes them from the priority queue and timetable.
+// The number of expired tasks is returned.
+//
+// Tasks that can not be removed from the queue or timetable are skipped
+// since they were most likely staged in the meantime.
+func (ctrl *ResourceController) ExpireTasks(taskModel Model) (int, error) {
+	ctx := ctrl.operation()
+	tasks, err := queryExpiredTasks(taskModel)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, v := range tasks {
+		task := v.(*Task)
+		host := PriorityQueueHost
+		if task.Status == StatusScheduled {
+			host = TimetableHost
 		}
-		ctrl.stage.Delete(key)
-		if task.Status == StatusStarted {
-			return TaskAlreadyStartedError
+		params := map[string]interface{}{"key": task.QueueKey(), "id": task.Id}
+		result, errObj := CallInt(ctx, ctrl.broker, host, "remove", params)
+		if errObj != nil {
+			logln(ctx, errObj.Message, task.Id)
+			continue
 		}
-		ctrl.resources[key].Status = ResourceLocked
-		task.Status = StatusStarted
-		if _, err := taskModel.Save(task); err != nil {
-			return err
+		if result != 0 {
+			logln(ctx, TaskRemoveFailedError, task.Id)
+			continue
 		}
-		if _, err := resourceModel.Save(ctrl.resources[key]); err != nil {
-			return err
+		prev := task.Status
+		if err := task.ChangeStatus(taskModel, StatusCancelled); err != nil {
+			return count, err
+		}
+		ctrl.recordTransition(ctx, task, prev, "expired")
+		if err := ctrl.settleDependents(ctx, task, taskModel); err != nil {
+			logln(ctx, err)
 		}
+		count++
 
 		meta := make(map[string]interface{})
 		json.Unmarshal(task.Meta, &meta)
-		meta["_status"] = StatusStarted
+		meta["_status"] = StatusCancelled
 		meta["_id"] = task.Id
 		data, _ := json.Marshal(meta)
-		ctrl.Notify(NewEvent(TaskStatusChangedEvent, data))
-		log.Printf("started task [%s %s] with resource [%s]\n", task.Created, string(task.Meta), key)
+		ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data))
+		logf(ctx, "expired task [%s %s]\n", task.Created, string(task.Meta))
+	}
+	return count, nil
+}
 
-		return nil
+// ArchiveTasks moves the tasks in a final status that were last updated, or
+// created if they were never updated, longer than the retention ago from
+// the tasks collection to the tasks archive, so the tasks collection only
+// holds recent and active tasks. The tasks are archived in batches of
+// ArchiveBatchSize until no old tasks are left. The number of archived
+// tasks is returned.
+//
+// an error is encountered if the tasks cannot be queried, removed or saved
+// to the archive. A task that cannot be saved to the archive is restored
+// and archived again by the next sweep.
+func (ctrl *ResourceController) ArchiveTasks(retention time.Duration, taskModel Model, archiveModel Model) (int, error) {
+	ctx := ctrl.operation()
+	count := 0
+	for {
+		tasks, err := queryArchivableTasks(retention, taskModel)
+		if err != nil {
+			return count, err
+		}
+		archived := 0
+		for _, v := range tasks {
+			task := v.(*Task)
+			if !task.IsFinal() {
+				continue
+			}
+			if err := archiveTask(task, ArchivedReason, taskModel, archiveModel); err != nil {
+				return count, err
+			}
+			archived++
+		}
+		count += archived
+		if len(tasks) < ArchiveBatchSize || archived == 0 {
+			break
+		}
+	}
+	if count > 0 {
+		logf(ctx, "archived %d tasks\n", count)
 	}
+	return count, nil
+}
+
+// ReclaimExpiredLeases returns the started tasks whose lease expired to
+// the stage and unlocks their resources. The task is resubmitted to the
+// priority queue or timetable if another task is staged for the resource.
+// The number of reclaimed tasks is returned.
+func (ctrl *ResourceController) ReclaimExpiredLeases(taskModel Model, resourceModel Model) (int, error) {
+	ctx := ctrl.operation()
+	tasks, err := queryExpiredLeases(taskModel)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, v := range tasks {
+		task := v.(*Task)
+		if !ctrl.ownsKey(task.Key) {
+			continue
+		}
+		if resource, ok := ctrl.releaseTaskLock(task.Key, task.Id); ok {
+			if err := ctrl.saveResource(resource, resourceModel); err != nil {
+				return count, err
+			}
+		}
+		task.LeaseExpires = nil
+		task.EndAttempt(StatusError, "lease expired")
+		if _, staged := ctrl.stage.Load(task.Key); !staged {
+			if err := task.ChangeStatus(taskModel, StatusPending); err != nil {
+				return count, err
+			}
+			ctrl.recordTransition(ctx, task, StatusStarted, "lease expired")
+			ctrl.stageTask(ctx, task, taskModel, false)
+		} else {
+			status, err := ctrl.submitTask(ctx, task)
+			if err != nil {
+				logln(ctx, err)
+				continue
+			}
+			if err := task.ChangeStatus(taskModel, status); err != nil {
+				return count, err
+			}
+			ctrl.recordTransition(ctx, task, StatusStarted, "lease expired")
 
-	return NoStagedTaskError
+			meta := make(map[string]interface{})
+			json.Unmarshal(task.Meta, &meta)
+			meta["_status"] = status
+			meta["_id"] = task.Id
+			data, _ := json.Marshal(meta)
+			ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data))
+		}
+		count++
+		logf(ctx, "reclaimed task [%s %s] with expired lease\n", task.Created, string(task.Meta))
+	}
+	return count, nil
 }
 
-// StageTask adds the pending task to the associated task stage key.
-func (ctrl *ResourceController) StageTask(task *Task, taskModel Model, changeStatus bool) {
-	_, ok := ctrl.stage.Load(task.Key)
-	if !ok {
-		if changeStatus {
-			task.ChangeStatus(taskModel, StatusPending)
+// RecoverStartedTasks recovers the started tasks left behind by a crashed
+// controller. A started task is stuck if its resource is not locked by the
+// task or if its lease expired. With the fail recovery policy the stuck task
+// gets the error status and is retried if it has a retry policy, otherwise
+// it is returned to the priority queue or timetable. The number of
+// recovered tasks is returned.
+func (ctrl *ResourceController) RecoverStartedTasks(taskModel Model, resourceModel Model) (int, error) {
+	ctx := ctrl.operation()
+	count := 0
+	err := streamStartedTasks(taskModel, func(doc interface{}) error {
+		task := doc.(*Task)
+		if !ctrl.ownsKey(task.Key) {
+			return nil
+		}
+		view, ok := ctrl.viewResource(task.Key)
+		locked := ok && view.Status == ResourceLocked && view.TaskId == task.Id
+		var reason string
+		switch {
+		case !locked:
+			reason = "resource not locked"
+		case task.LeaseExpires != nil && task.LeaseExpires.Before(time.Now()):
+			reason = "lease expired"
+		default:
+			return nil
+		}
+		if locked {
+			if resource, ok := ctrl.releaseTaskLock(task.Key, task.Id); ok {
+				if err := ctrl.saveResource(resource, resourceModel); err != nil {
+					return err
+				}
+			}
+		}
+		task.LeaseExpires = nil
+		task.EndAttempt(StatusError, reason)
+		status := StatusError
+		if RecoveryPolicy != RecoveryPolicyFail {
+			var err error
+			if status, err = ctrl.submitTask(ctx, task); err != nil {
+				logln(ctx, err)
+				return nil
+			}
+		}
+		if err := task.ChangeStatus(taskModel, status); err != nil {
+			return err
 		}
-		ch := make(chan *Task, StageBuffer)
-		ch <- task
-		ctrl.stage.Store(task.Key, ch)
+		ctrl.recordTransition(ctx, task, StatusStarted, reason)
+		count++
 
 		meta := make(map[string]interface{})
 		json.Unmarshal(task.Meta, &meta)
-		meta["_status"] = StatusPending
+		meta["_status"] = task.Status
 		meta["_id"] = task.Id
-		meta["_key"] = task.Key
 		data, _ := json.Marshal(meta)
-		if err := ctrl.Notify(NewEvent(TaskStatusChangedEvent, data)); err != nil {
-			log.Println(err)
+		ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data))
+		data, _ = json.Marshal(map[string]interface{}{"_id": task.Id, "_resource": task.Key, "_status": task.Status, "_reason": reason})
+		ctrl.notify(ctx, NewEvent(TaskRecoveredEvent, data))
+		logf(ctx, "recovered task [%s %s] %s\n", task.Created, string(task.Meta), reason)
+		if task.Status == StatusError && task.MaxAttempts > 0 {
+			if err := ctrl.retryFailedTask(ctx, task, taskModel); err != nil {
+				logln(ctx, err)
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// ReleaseExpiredLocks unlocks the resources that have been locked by a
+// started task for longer than the max lock duration. The task gets the
+// error status and is retried if it has a retry policy. The number of
+// released resources is returned.
+func (ctrl *ResourceController) ReleaseExpiredLocks(maxLock time.Duration, taskModel Model, resourceModel Model) (int, error) {
+	ctx := ctrl.operation()
+	count := 0
+	for name, view := range ctrl.resourceViews() {
+		if !ctrl.ownsKey(name) || view.Status != ResourceLocked || view.LockedAt == nil || time.Since(*view.LockedAt) <= maxLock {
+			continue
+		}
+		lockedFor := time.Since(*view.LockedAt).Seconds()
+		taskId := view.TaskId
+		resource, ok := ctrl.releaseTaskLock(name, taskId)
+		if !ok {
+			continue
+		}
+		if err := ctrl.saveResource(resource, resourceModel); err != nil {
+			return count, err
+		}
+		count++
+		data, _ := json.Marshal(map[string]interface{}{"_id": taskId, "_resource": name, "lockedFor": lockedFor})
+		ctrl.notify(ctx, NewEvent(ResourceLockExpiredEvent, data))
+		logf(ctx, "released expired resource lock [%s %s]\n", name, taskId)
+
+		task, err := getTask(taskId, taskModel)
+		if err == TaskNotFoundError {
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		if task.Status != StatusStarted {
+			continue
+		}
+		if err := task.SetStatus(StatusError); err != nil {
+			return count, err
+		}
+		task.LeaseExpires = nil
+		task.EndAttempt(StatusError, "resource lock expired")
+		if _, err := taskModel.Save(task); err != nil {
+			return count, err
+		}
+		ctrl.recordTransition(ctx, task, StatusStarted, "resource lock expired")
+
+		meta := make(map[string]interface{})
+		json.Unmarshal(task.Meta, &meta)
+		meta["_status"] = StatusError
+		meta["_id"] = task.Id
+		data, _ = json.Marshal(meta)
+		ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data))
+		if task.MaxAttempts > 0 {
+			if err := ctrl.retryFailedTask(ctx, task, taskModel); err != nil {
+				logln(ctx, err)
+			}
+		}
+		if err := ctrl.settleDependents(ctx, task, taskModel); err != nil {
+			logln(ctx, err)
 		}
-		log.Printf("staged task [%s %s]\n", task.Created, string(task.Meta))
 	}
+	return count, nil
 }
 
-// StartStageLoop pulls tasks from the timetable and priority queues
-// and stages them for completion.
-func (ctrl *ResourceController) StartStageLoop(taskModel Model) {
-	for {
-		for key := range ctrl.resources {
-			if _, ok := ctrl.stage.Load(key); ok || ctrl.resources[key].Status == ResourceLocked {
-				continue
+// MarkOfflineResources moves the resources whose worker agent missed its
+// heartbeats to the offline state. The started and the staged task of an
+// offline resource are returned to the priority queue or timetable. The
+// number of resources that went offline is returned.
+func (ctrl *ResourceController) MarkOfflineResources(taskModel Model, resourceModel Model) (int, error) {
+	ctx := ctrl.operation()
+	count := 0
+	for name, view := range ctrl.resourceViews() {
+		if !ctrl.ownsKey(name) || view.Offline || view.HeartbeatAt == nil || time.Since(*view.HeartbeatAt) <= HeartbeatTimeout {
+			continue
+		}
+		taskId := ""
+		if view.Status == ResourceLocked {
+			taskId = view.TaskId
+		}
+		resource, ok := ctrl.lookupResource(name)
+		if !ok {
+			continue
+		}
+		ctrl.updateResource(resource, func(r *Resource) { r.Offline = true })
+		ctrl.unlockResource(resource)
+		if err := ctrl.saveResource(resource, resourceModel); err != nil {
+			return count, err
+		}
+		count++
+		logf(ctx, "resource offline [%s]\n", name)
+		if _, ok := ctrl.stage.Load(name); ok {
+			if err := ctrl.unstageTask(ctx, name, taskModel); err != nil {
+				logln(ctx, err, name)
 			}
-			task, _ := ctrl.stageScheduledTask(key)
-			if task == nil {
-				task, _ = ctrl.stageQueuedTask(key)
+		}
+		if taskId == "" {
+			continue
+		}
+
+		task, err := getTask(taskId, taskModel)
+		if err == TaskNotFoundError {
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		if task.Status != StatusStarted {
+			continue
+		}
+		task.LeaseExpires = nil
+		task.EndAttempt(StatusError, "resource offline")
+		status, err := ctrl.submitTask(ctx, task)
+		if err != nil {
+			logln(ctx, err)
+			continue
+		}
+		if err := task.ChangeStatus(taskModel, status); err != nil {
+			return count, err
+		}
+		ctrl.recordTransition(ctx, task, StatusStarted, "resource offline")
+
+		meta := make(map[string]interface{})
+		json.Unmarshal(task.Meta, &meta)
+		meta["_status"] = status
+		meta["_id"] = task.Id
+		data, _ := json.Marshal(meta)
+		ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data))
+	}
+	return count, nil
+}
+
+// DeregisterResources removes the registered resources whose worker agent
+// has not sent a heartbeat for longer than the deregister timeout. The
+// number of removed resources is returned.
+func (ctrl *ResourceController) DeregisterResources(taskModel Model, resourceModel Model) (int, error) {
+	ctx := ctrl.operation()
+	count := 0
+	for name, view := range ctrl.resourceViews() {
+		if !ctrl.ownsKey(name) || !view.Registered || view.HeartbeatAt == nil || time.Since(*view.HeartbeatAt) <= DeregisterTimeout {
+			continue
+		}
+		if view.Status == ResourceLocked {
+			continue
+		}
+		if err := ctrl.removeResource(ctx, name, taskModel, resourceModel); err != nil {
+			return count, err
+		}
+		count++
+		logf(ctx, "resource deregistered [%s]\n", name)
+	}
+	return count, nil
+}
+
+// ReplayDeferredCalls delivers the buffered calls in the order they were
+// deferred and moves the associated tasks out of the deferred status.
+//
+// Consecutive calls to the same service are sent in batches of up to
+// BrokerBatchSize calls. Replay stops at the first call whose service is
+// still unreachable. The deferred task callbacks are sent before the
+// calls, each once per replay.
+func (ctrl *ResourceController) ReplayDeferredCalls(taskModel Model) error {
+	ctx := ctrl.operation()
+	all, err := ctrl.callBuffer.FetchAll()
+	if err != nil {
+		return err
+	}
+	docs := make([]interface{}, 0, len(all))
+	for _, doc := range all {
+		if call := doc.(*DeferredCall); call.Method == CallbackMethod {
+			if err := ctrl.replayCallback(ctx, call); err != nil {
+				return err
 			}
-			if task != nil {
-				q := fmt.Sprintf(`FOR t IN %s FILTER t._key == @key RETURN t`, CollectionTasks)
-				tasks, err := taskModel.Query(q, map[string]interface{}{"key": task.Id})
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				if len(tasks) < 1 {
-					log.Println(TaskNotFoundError, task)
-					continue
-				}
-				task := tasks[0].(*Task)
-				ctrl.StageTask(task, taskModel, true)
+			continue
+		}
+		docs = append(docs, doc)
+	}
+	for len(docs) > 0 {
+		host := docs[0].(*DeferredCall).Host
+		n := 1
+		for n < len(docs) && n < BrokerBatchSize && docs[n].(*DeferredCall).Host == host {
+			n++
+		}
+		calls := make([]BrokerCall, n)
+		for i, v := range docs[:n] {
+			calls[i] = BrokerCall{v.(*DeferredCall).Method, v.(*DeferredCall).Params}
+		}
+		results, errObj := batchCall(ctx, ctrl.broker, host, calls)
+		for i, result := range results {
+			if err := ctrl.replayedCall(ctx, docs[i].(*DeferredCall), result, taskModel); err != nil {
+				return err
 			}
 		}
+		if errObj != nil {
+			return errors.New(string(errObj.Message))
+		}
+		docs = docs[n:]
+	}
+	return nil
+}
 
-		time.Sleep(time.Second * 1)
+// replayCallback sends the deferred task callback again. The callback is
+// removed once it is delivered, or dropped once it failed CallbackAttempts
+// times.
+func (ctrl *ResourceController) replayCallback(ctx context.Context, call *DeferredCall) error {
+	body, _ := call.Params["body"].(string)
+	err := sendCallback(call.Host, []byte(body))
+	if err == nil {
+		logf(ctx, "task callback delivered [%s %s]\n", call.Host, call.TaskId)
+		return ctrl.callBuffer.Remove(call)
 	}
+	call.Attempts++
+	logf(ctx, "task callback failed [%s %d %s]\n", call.Host, call.Attempts, err)
+	if call.Attempts >= CallbackAttempts || errors.Is(err, CallbackHostError) {
+		logln(ctx, CallbackFailedError, call.TaskId)
+		return ctrl.callBuffer.Remove(call)
+	}
+	_, err = ctrl.callBuffer.Save(call)
+	return err
 }
 
-// stageQueuedTask fetches the next task from the priorty queue.
-func (ctrl *ResourceController) stageQueuedTask(key string) (*Task, error) {
-	params := map[string]interface{}{"key": key}
-	result, errObj := ctrl.broker.Call(PriorityQueueHost, "pop", params)
-	if errObj != nil {
-		return nil, errors.New(string(errObj.Message))
+// replayedCall removes the delivered deferred call and moves its task out
+// of the deferred status.
+func (ctrl *ResourceController) replayedCall(ctx context.Context, call *DeferredCall, result BrokerResult, taskModel Model) error {
+	status := call.Status
+	if n, errObj := intResult(call.Method, result.Result); result.Error != nil || errObj != nil || n != 0 {
+		status = StatusError
 	}
-	var task *Task
-	if result != nil {
-		mapstructure.Decode(result.(map[string]interface{}), &task)
+	if err := ctrl.callBuffer.Remove(call); err != nil {
+		return err
+	}
+
+	task, err := getTask(call.TaskId, taskModel)
+	if err == TaskNotFoundError {
+		logln(ctx, err, call.TaskId)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	prev := task.Status
+	if err := task.ChangeStatus(taskModel, status); err != nil {
+		return err
+	}
+	ctrl.recordTransition(ctx, task, prev, "deferred call replayed")
+
+	meta := make(map[string]interface{})
+	json.Unmarshal(task.Meta, &meta)
+	meta["_status"] = status
+	meta["_id"] = task.Id
+	data, _ := json.Marshal(meta)
+	ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data))
+	logf(ctx, "replayed task [%s %s]\n", task.Created, string(task.Meta))
+	return nil
+}
+
+// getTask returns the task with the provided id.
+//
+// an error is encountered if a task with the id does not exist.
+func getTask(taskId string, taskModel Model) (*Task, error) {
+	doc, err := taskModel.Get(taskId)
+	if err != nil {
+		return nil, err
+	}
+	task, ok := doc.(*Task)
+	if !ok || task == nil {
+		return nil, TaskNotFoundError
 	}
 	return task, nil
 }
 
-// stageScheduledTask fetches the next scheduled task from the timetable.
-func (ctrl *ResourceController) stageScheduledTask(key string) (*Task, error) {
-	params := map[string]interface{}{"key": key}
-	result, errObj := ctrl.broker.Call(TimetableHost, "next", params)
-	if errObj != nil {
-		return nil, errors.New(string(errObj.Message))
+// GetTaskHistory returns the status transitions of the task with the
+// provided id in the order they occurred.
+func (ctrl *ResourceController) GetTaskHistory(taskId string, historyModel Model) ([]*TaskHistory, error) {
+	entries, err := queryTaskHistory(taskId, historyModel)
+	if err != nil {
+		return nil, err
 	}
-	var task *Task
-	if result != nil {
-		delete(result.(map[string]interface{}), "runAt")
-		mapstructure.Decode(result.(map[string]interface{}), &task)
+	history := make([]*TaskHistory, 0, len(entries))
+	for _, entry := range entries {
+		history = append(history, entry.(*TaskHistory))
+	}
+	return history, nil
+}
+
+// GetTaskLog returns the output snippets of the task with the provided id
+// in the order they were appended.
+func (ctrl *ResourceController) GetTaskLog(taskId string, logModel Model) ([]*TaskLog, error) {
+	entries, err := queryTaskLog(taskId, logModel)
+	if err != nil {
+		return nil, err
+	}
+	logs := make([]*TaskLog, 0, len(entries))
+	for _, entry := range entries {
+		logs = append(logs, entry.(*TaskLog))
+	}
+	return logs, nil
+}
+
+// GetTaskStats returns the average, minimum and maximum run time of the
+// recorded task stats for the key.
+func (ctrl *ResourceController) GetTaskStats(key string, taskStatModel Model) (*TaskStats, error) {
+	taskStats, err := queryTaskStats(key, taskStatModel)
+	if err != nil {
+		return nil, err
+	}
+	stats := &TaskStats{Key: key, Count: len(taskStats)}
+	if stats.Count == 0 {
+		return stats, nil
+	}
+	var sum float64
+	for i, taskStat := range taskStats {
+		runTime := taskStat.(*TaskStat).RunTime
+		if i == 0 || runTime < stats.Min {
+			stats.Min = runTime
+		}
+		if i == 0 || runTime > stats.Max {
+			stats.Max = runTime
+		}
+		sum += runTime
+	}
+	stats.Average = sum / float64(stats.Count)
+	return stats, nil
+}
+
+// Health probes the priority queue, timetable and status change notifier
+// services. Any response from a service, including a remote error, means
+// the service is reachable.
+func (ctrl *ResourceController) Health() map[string]*DependencyStatus {
+	ctx := ctrl.operation()
+	hosts := map[string]string{
+		"notifier":      StatusChangeNotifierHost,
+		"priorityQueue": PriorityQueueHost,
+		"timetable":     TimetableHost,
+	}
+	health := make(map[string]*DependencyStatus)
+	for name, host := range hosts {
+		status := &DependencyStatus{Healthy: true}
+		_, errObj := ctrl.broker.Call(ctx, host, "health", map[string]interface{}{})
+		if errObj != nil && errObj.Code == BrokerCallErrorCode {
+			status.Healthy = false
+			status.Error = fmt.Sprintf("%v", errObj.Data)
+		}
+		health[name] = status
+	}
+	return health
+}
+
+// Heartbeat renews the lease of the started task with the provided id and
+// returns the new lease expiration time.
+//
+// an error is encountered if a task with the provided id does not exist
+// or if the task is not in the started state.
+func (ctrl *ResourceController) Heartbeat(taskId string, taskModel Model) (time.Time, error) {
+	task, err := getTask(taskId, taskModel)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if task.Status != StatusStarted {
+		return time.Time{}, TaskNotStartedError
+	}
+	leaseExpires := time.Now().Add(LeaseDuration)
+	task.LeaseExpires = &leaseExpires
+	if _, err := taskModel.Save(task); err != nil {
+		return time.Time{}, err
+	}
+	return leaseExpires, nil
+}
+
+// ListPrioriryQueue lists the heap nodes in the priority queue
+// with the provided key.
+func (ctrl *ResourceController) ListPriorityQueue(key string) (map[string]interface{}, error) {
+	return ctrl.listPriorityQueue(ctrl.operation(), key)
+}
+
+// listPriorityQueue is ListPriorityQueue in the operation of the context.
+func (ctrl *ResourceController) listPriorityQueue(ctx context.Context, key string) (map[string]interface{}, error) {
+	params := map[string]interface{}{"key": key}
+	result, errObj := CallObject(ctx, ctrl.broker, PriorityQueueHost, "get", params)
+	if errObj != nil {
+		return nil, errors.New(strings.ToLower(string(errObj.Message)))
+	}
+	return result, nil
+}
+
+// ListResources returns the stored resources with the lock status and
+// task of the resources managed by the controller.
+func (ctrl *ResourceController) ListResources(resourceModel Model) ([]*Resource, error) {
+	docs, err := resourceModel.FetchAll()
+	if err != nil {
+		return nil, err
+	}
+	resources := make([]*Resource, 0, len(docs))
+	stored := make(map[string]bool)
+	for _, doc := range docs {
+		v := doc.(*Resource)
+		if view, ok := ctrl.viewResource(v.Name); ok {
+			v.Status = view.Status
+			v.TaskId = view.TaskId
+		}
+		stored[v.Name] = true
+		resources = append(resources, v)
+	}
+	for name, view := range ctrl.resourceViews() {
+		if !stored[name] {
+			view := view
+			resources = append(resources, &view)
+		}
+	}
+	sort.Slice(resources, func(i, j int) bool { return resources[i].Name < resources[j].Name })
+	return resources, nil
+}
+
+// ListTasks returns a page of tasks ordered by creation time.
+//
+// The status, key and labels filters are omitted from the query when empty.
+func (ctrl *ResourceController) ListTasks(status string, key string, labels map[string]string, limit int, offset int, taskModel Model) (*TaskPage, error) {
+	result, err := queryTaskList(status, key, labels, limit, offset, taskModel)
+	if err != nil {
+		return nil, err
+	}
+	return newTaskPage(result, limit, offset), nil
+}
+
+// ExportTasks calls fn with each task ordered by creation time. The tasks
+// are streamed from the database in batches, so all tasks can be exported
+// without holding them in memory.
+//
+// The status, key and labels filters are omitted from the query when empty.
+//
+// an error is encountered if the query fails or fn returns an error, which
+// stops the export.
+func (ctrl *ResourceController) ExportTasks(status string, key string, labels map[string]string, taskModel Model, fn func(*Task) error) error {
+	return streamTasks(status, key, labels, taskModel, func(doc interface{}) error {
+		return fn(doc.(*Task))
+	})
+}
+
+// ListTimetable lists the scheduled tasks in the timetable with the
+// provided key.
+func (ctrl *ResourceController) ListTimetable(key string) (map[string]interface{}, error) {
+	return ctrl.listTimetable(ctrl.operation(), key)
+}
+
+// listTimetable is ListTimetable in the operation of the context.
+func (ctrl *ResourceController) listTimetable(ctx context.Context, key string) (map[string]interface{}, error) {
+	params := map[string]interface{}{"key": key}
+	result, errObj := CallObject(ctx, ctrl.broker, TimetableHost, "get", params)
+	if errObj != nil {
+		return nil, errors.New(strings.ToLower(string(errObj.Message)))
+	}
+	return result, nil
+}
+
+// Notify sends a status change event to the status change notifier.
+func (ctrl *ResourceController) Notify(evt *Event) error {
+	return ctrl.notify(ctrl.operation(), evt)
+}
+
+// notify sends the event to the status change notifier service in the
+// operation of the context, or queues it if notifications are queued. An
+// event that fails to send is stored for redelivery if failed events are
+// stored.
+func (ctrl *ResourceController) notify(ctx context.Context, evt *Event) error {
+	if ctrl.notifications != nil {
+		if queued, err := ctrl.notifications.Push(ctx, evt); queued {
+			return err
+		}
+	}
+	err := ctrl.sendNotification(ctx, evt)
+	if err != nil && ctrl.storeFailedEvent(ctx, evt, err) {
+		return nil
+	}
+	return err
+}
+
+// sendNotification sends the event to the status change notifier service
+// in the operation of the context.
+func (ctrl *ResourceController) sendNotification(ctx context.Context, evt *Event) error {
+	params := map[string]interface{}{"created": evt.Created, "kind": evt.Kind, "meta": evt.Meta}
+	result, errObj := CallInt(ctx, ctrl.broker, StatusChangeNotifierHost, "notify", params)
+	if errObj != nil {
+		return errors.New(string(errObj.Message))
+	}
+	if result != 0 {
+		return NotificationFailedError
+	}
+	return nil
+}
+
+// PauseTask takes the queued or scheduled task out of the priority queue or
+// timetable and keeps it with the paused status until it is resumed.
+//
+// an error is encountered if a task with the provided id does not exist
+// or if the task is not queued or scheduled.
+func (ctrl *ResourceController) PauseTask(taskId string, taskModel Model) error {
+	ctx := ctrl.operation()
+	task, err := getTask(taskId, taskModel)
+	if err != nil {
+		return err
+	}
+	host := PriorityQueueHost
+	switch task.Status {
+	case StatusQueued:
+	case StatusScheduled:
+		host = TimetableHost
+	default:
+		return TaskNotQueuedError
+	}
+	result, errObj := CallInt(ctx, ctrl.broker, host, "remove", map[string]interface{}{"key": task.QueueKey(), "id": task.Id})
+	if errObj != nil {
+		return errors.New(string(errObj.Message))
+	}
+	if result != 0 {
+		return TaskRemoveFailedError
+	}
+	prev := task.Status
+	task.PausedFrom = prev
+	if err := task.ChangeStatus(taskModel, StatusPaused); err != nil {
+		return err
+	}
+	ctrl.recordTransition(ctx, task, prev, "task paused")
+
+	meta := make(map[string]interface{})
+	json.Unmarshal(task.Meta, &meta)
+	meta["_status"] = StatusPaused
+	meta["_id"] = task.Id
+	data, _ := json.Marshal(meta)
+	ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data))
+	logf(ctx, "paused task [%s %s]\n", task.Created, string(task.Meta))
+
+	return nil
+}
+
+// PauseResource puts the resource in drain mode.
+//
+// A draining resource allows the started task to complete but no new
+// tasks are staged or started until the resource is resumed.
+func (ctrl *ResourceController) PauseResource(name string, resourceModel Model) error {
+	return ctrl.setDraining(name, true, resourceModel)
+}
+
+// PurgeTasks deletes up to limit complete and cancelled tasks that were
+// created more than age ago and returns the number of purged tasks.
+func (ctrl *ResourceController) PurgeTasks(age time.Duration, limit int, taskModel Model) (int, error) {
+	return purgeTasks(age, limit, taskModel)
+}
+
+// RegisterResource upserts a resource slot for each unit of capacity of the
+// worker agent. The slots are named after the resource with the slot
+// number appended and are members of a pool with the resource name, so
+// tasks added with the resource name as key are staged on any free slot.
+// Slots beyond the capacity are removed, or drained if they are locked.
+// The slot names are returned.
+func (ctrl *ResourceController) RegisterResource(name string, tags map[string]string, capacity int, taskModel Model, resourceModel Model) ([]string, error) {
+	ctx := ctrl.operation()
+	if _, ok := ctrl.lookupResource(name); ok {
+		return nil, PoolConflictError
+	}
+	now := time.Now()
+	slots := make([]string, 0, capacity)
+	for i := 1; i <= capacity; i++ {
+		slot := fmt.Sprintf("%s:%d", name, i)
+		resource, ok := ctrl.lookupResource(slot)
+		if !ok {
+			if err := ctrl.AddResource(slot, name, tags, 0, resourceModel); err != nil {
+				return nil, err
+			}
+			resource, _ = ctrl.lookupResource(slot)
+		}
+		if resource.Pool != name {
+			return nil, PoolConflictError
+		}
+		ctrl.updateResource(resource, func(r *Resource) {
+			r.Draining = false
+			r.HeartbeatAt = &now
+			r.Offline = false
+			r.Registered = true
+			r.Tags = tags
+		})
+		if err := ctrl.saveResource(resource, resourceModel); err != nil {
+			return nil, err
+		}
+		slots = append(slots, slot)
+	}
+	for slot, view := range ctrl.resourceViews() {
+		var i int
+		if view.Pool != name || !view.Registered {
+			continue
+		}
+		if _, err := fmt.Sscanf(slot[len(name):], ":%d", &i); err != nil || i <= capacity {
+			continue
+		}
+		if view.Status == ResourceLocked {
+			if err := ctrl.setDraining(slot, true, resourceModel); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := ctrl.removeResource(ctx, slot, taskModel, resourceModel); err != nil {
+			return nil, err
+		}
+	}
+	logf(ctx, "resource registered [%s %d]\n", name, capacity)
+	return slots, nil
+}
+
+// RemoveResource stops managing the resource and deletes the resource
+// document.
+//
+// Any task staged for the resource is cancelled. An error is encountered
+// if the resource does not exist or is locked by a started task.
+func (ctrl *ResourceController) RemoveResource(name string, taskModel Model, resourceModel Model) error {
+	return ctrl.removeResource(ctrl.operation(), name, taskModel, resourceModel)
+}
+
+// removeResource is RemoveResource in the operation of the context.
+func (ctrl *ResourceController) removeResource(ctx context.Context, name string, taskModel Model, resourceModel Model) error {
+	resource, ok := ctrl.lookupResource(name)
+	if !ok {
+		return ResourceNotFoundError
+	}
+	if ctrl.resourceStatus(resource) == ResourceLocked {
+		return ResourceUnavailableError
+	}
+	if err := resourceModel.Remove(ctrl.resourceDoc(resource)); err != nil {
+		return err
+	}
+	ctrl.deleteResource(name)
+	ctrl.limiter.Forget(name)
+	for child, view := range ctrl.resourceViews() {
+		if view.Parent != name {
+			continue
+		}
+		resource, ok := ctrl.lookupResource(child)
+		if !ok {
+			continue
+		}
+		ctrl.updateResource(resource, func(r *Resource) { r.Parent = "" })
+		if err := ctrl.saveResource(resource, resourceModel); err != nil {
+			logln(ctx, err)
+		}
+	}
+
+	if slot, ok := ctrl.stagedSlot(name); ok {
+		tasks := slot.Drain()
+		ctrl.releaseSlot(name, slot)
+		for _, task := range tasks {
+			prev := task.Status
+			if err := task.ChangeStatus(taskModel, StatusCancelled); err != nil {
+				logln(ctx, err)
+			}
+			ctrl.recordTransition(ctx, task, prev, "resource removed")
+			if err := ctrl.settleDependents(ctx, task, taskModel); err != nil {
+				logln(ctx, err)
+			}
+
+			meta := make(map[string]interface{})
+			json.Unmarshal(task.Meta, &meta)
+			meta["_status"] = StatusCancelled
+			meta["_id"] = task.Id
+			data, _ := json.Marshal(meta)
+			ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data))
+			logf(ctx, "cancelled task [%s %s]\n", task.Created, string(task.Meta))
+		}
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{"_key": name})
+	ctrl.notify(ctx, NewEvent(ResourceRemovedEvent, data))
+	logf(ctx, "resource removed [%s]\n", name)
+
+	return nil
+}
+
+// RemoveTask cancels the queued, scheduled, pending, blocked or paused task and
+// moves it to the tasks archive with the removal time and reason. A pending
+// task is taken off the stage of its key first.
+//
+// an error is encountered if a pending task is no longer staged because it
+// was started in the meantime.
+func (ctrl *ResourceController) RemoveTask(id string, reason string, taskModel Model, archiveModel Model) error {
+	ctx := ctrl.operation()
+	var result int
+	var errObj *jrpc2.ErrorObject
+
+	task, err := getTask(id, taskModel)
+	if err != nil {
+		return err
+	}
+	if task.Status != StatusQueued && task.Status != StatusScheduled && task.Status != StatusPending && task.Status != StatusBlocked && task.Status != StatusPaused {
+		return TaskRemoveFailedError
+	}
+	params := map[string]interface{}{"key": task.QueueKey(), "id": task.Id}
+	switch task.Status {
+	case StatusQueued:
+		result, errObj = CallInt(ctx, ctrl.broker, PriorityQueueHost, "remove", params)
+	case StatusScheduled:
+		result, errObj = CallInt(ctx, ctrl.broker, TimetableHost, "remove", params)
+	case StatusPending:
+		slot, ok := ctrl.stagedSlot(task.Key)
+		if !ok || slot.Remove(task.Id) == nil {
+			return TaskRemoveFailedError
+		}
+		ctrl.releaseSlot(task.Key, slot)
+		stagedId := ""
+		if staged := slot.Tasks(); len(staged) > 0 {
+			stagedId = staged[0].Id
+		}
+		ctrl.setStagedTaskId(task.Key, stagedId)
+	}
+	if errObj != nil {
+		return errors.New(string(errObj.Message))
+	}
+	if result != 0 {
+		return TaskRemoveFailedError
+	}
+	prev := task.Status
+	if err := task.SetStatus(StatusCancelled); err != nil {
+		return err
+	}
+	if err := archiveTask(task, reason, taskModel, archiveModel); err != nil {
+		return err
+	}
+	if reason != "" {
+		ctrl.recordTransition(ctx, task, prev, fmt.Sprintf("task removed: %s", reason))
+	} else {
+		ctrl.recordTransition(ctx, task, prev, "task removed")
+	}
+
+	meta := make(map[string]interface{})
+	json.Unmarshal(task.Meta, &meta)
+	meta["_status"] = StatusCancelled
+	meta["_id"] = task.Id
+	data, _ := json.Marshal(meta)
+	ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data))
+	logf(ctx, "removed task [%s %s]\n", task.Created, string(task.Meta))
+	ctrl.runHooks(func(h ControllerHooks) { h.OnTaskRemoved(task) })
+	if err := ctrl.settleDependents(ctx, task, taskModel); err != nil {
+		logln(ctx, err)
+	}
+
+	return nil
+}
+
+// archiveTask moves the task from the tasks collection to the tasks archive
+// with the removal reason. The task is removed before it is archived, so
+// that it is never returned by both collections, and saved again if it
+// cannot be archived.
+//
+// an error is encountered if the task cannot be removed or archived.
+func archiveTask(task *Task, reason string, taskModel Model, archiveModel Model) error {
+	if err := taskModel.Remove(task); err != nil {
+		return err
+	}
+	if _, err := archiveModel.Save(NewArchivedTask(task, reason)); err != nil {
+		if _, restoreErr := taskModel.Save(task); restoreErr != nil {
+			log.Println(restoreErr, task.Id)
+		}
+		return err
+	}
+	return nil
+}
+
+// RescheduleTask changes the run at time of the scheduled task and moves
+// the task to the new time in the timetable.
+//
+// an error is encountered if a task with the provided id does not exist
+// or if the task is not in the scheduled state.
+func (ctrl *ResourceController) RescheduleTask(taskId string, runAt time.Time, taskModel Model) error {
+	ctx := ctrl.operation()
+	task, err := getTask(taskId, taskModel)
+	if err != nil {
+		return err
+	}
+	if task.Status != StatusScheduled {
+		return TaskNotScheduledError
+	}
+
+	params := map[string]interface{}{"key": task.QueueKey(), "id": task.Id}
+	result, errObj := CallInt(ctx, ctrl.broker, TimetableHost, "remove", params)
+	if errObj != nil {
+		return errors.New(string(errObj.Message))
+	}
+	if result != 0 {
+		return TaskUpdateFailedError
+	}
+	params["runAt"] = runAt.Format(time.RFC3339)
+	result, errObj = CallInt(ctx, ctrl.broker, TimetableHost, "insert", params)
+	if errObj != nil || result != 0 {
+		params["runAt"] = task.RunAt.Format(time.RFC3339)
+		if _, restoreErr := ctrl.broker.Call(ctx, TimetableHost, "insert", params); restoreErr != nil {
+			logf(ctx, "lost scheduled task [%s %s]\n", task.Created, string(task.Meta))
+		}
+		if errObj != nil {
+			return errors.New(string(errObj.Message))
+		}
+		return TaskUpdateFailedError
+	}
+	task.RunAt = &runAt
+	if _, err := taskModel.Save(task); err != nil {
+		return err
+	}
+
+	meta := make(map[string]interface{})
+	json.Unmarshal(task.Meta, &meta)
+	meta["_status"] = task.Status
+	meta["_id"] = task.Id
+	meta["_runAt"] = runAt.Format(time.RFC3339)
+	data, _ := json.Marshal(meta)
+	ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data))
+	logf(ctx, "rescheduled task [%s %s]\n", task.Created, string(task.Meta))
+
+	return nil
+}
+
+// RestoreResource manages the persisted resource again with the state it
+// had before the controller restarted. The lock of the resource is rebuilt
+// from the started task of the resource, so a lock whose task is no longer
+// started is released and a started task whose lock was not persisted
+// locks the resource again. The lock of a resource owned by another shard
+// member is left to its owner.
+func (ctrl *ResourceController) RestoreResource(resource *Resource, taskModel Model, resourceModel Model) error {
+	if _, ok := ctrl.lookupResource(resource.Name); ok {
+		return ResourceExistsError
+	}
+	tasks, err := queryResourceTasks(resource.Name, StatusStarted, taskModel)
+	if err != nil {
+		return err
+	}
+	ctrl.storeResource(resource)
+	if !ctrl.ownsKey(resource.Name) {
+		return nil
+	}
+	changed := false
+	ctrl.updateResource(resource, func(r *Resource) {
+		if len(tasks) > 0 {
+			task := tasks[0].(*Task)
+			if r.Status == ResourceLocked && r.TaskId == task.Id {
+				log.Printf("restored resource lock [%s %s]\n", r.Name, task.Id)
+				return
+			}
+			lockedAt := time.Now()
+			r.Status = ResourceLocked
+			r.TaskId = task.Id
+			r.LockedAt = &lockedAt
+			log.Printf("relocked resource [%s %s]\n", r.Name, task.Id)
+		} else {
+			if r.Status == ResourceFree {
+				r.TaskId = ""
+				return
+			}
+			r.Status = ResourceFree
+			r.TaskId = ""
+			r.LockedAt = nil
+			log.Printf("released stale resource lock [%s]\n", r.Name)
+		}
+		changed = true
+	})
+	if !changed {
+		return nil
+	}
+	return ctrl.saveResource(resource, resourceModel)
+}
+
+// RestoreStagedTask stages the pending task again after a restart. A pool
+// task whose resource no longer exists, or a task whose resource has no
+// room in its stage, is submitted back to its priority queue or timetable.
+// The task of a key owned by another shard member is left to its owner.
+func (ctrl *ResourceController) RestoreStagedTask(task *Task, taskModel Model) error {
+	ctx := ctrl.operation()
+	if !ctrl.ownsKey(task.Key) {
+		return nil
+	}
+	if _, ok := ctrl.lookupResource(task.Key); !ctrl.stageFull(task.Key) && (ok || task.Pool == "" && task.StolenFrom == "") {
+		ctrl.stageTask(ctx, task, taskModel, false)
+		return nil
+	}
+	return ctrl.requeueStagedTask(ctx, task, taskModel, "stage not restored")
+}
+
+// RestoreTask moves the removed task out of the tasks archive and submits
+// it again.
+//
+// an error is encountered if the archive does not contain a task with the
+// provided id.
+func (ctrl *ResourceController) RestoreTask(id string, taskModel Model, resourceModel Model, archiveModel Model) error {
+	ctx := ctrl.operation()
+	tasks, err := queryArchivedTask(id, archiveModel)
+	if err != nil {
+		return err
+	}
+	if len(tasks) < 1 {
+		return TaskNotFoundError
+	}
+	archived := tasks[0].(*ArchivedTask)
+	if err := ctrl.addTask(ctx, archived.Task, taskModel, resourceModel); err != nil {
+		return err
+	}
+	logf(ctx, "restored task [%s %s]\n", archived.Created, string(archived.Meta))
+	return archiveModel.Remove(archived)
+}
+
+// ResourceHeartbeat records that the worker agent of the resource is alive
+// and brings an offline resource back online. The heartbeat of a pool is
+// recorded for all members of the pool.
+func (ctrl *ResourceController) ResourceHeartbeat(name string, resourceModel Model) error {
+	resource, ok := ctrl.lookupResource(name)
+	if !ok {
+		if !ctrl.isPool(name) {
+			return ResourceNotFoundError
+		}
+		for member, view := range ctrl.resourceViews() {
+			if view.Pool != name {
+				continue
+			}
+			if err := ctrl.ResourceHeartbeat(member, resourceModel); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	now := time.Now()
+	ctrl.updateResource(resource, func(r *Resource) {
+		r.HeartbeatAt = &now
+		if r.Offline {
+			log.Printf("resource online [%s]\n", name)
+		}
+		r.Offline = false
+	})
+	return ctrl.saveResource(resource, resourceModel)
+}
+
+// ResumeResource takes the resource out of drain mode.
+func (ctrl *ResourceController) ResumeResource(name string, resourceModel Model) error {
+	return ctrl.setDraining(name, false, resourceModel)
+}
+
+// ResumeTask submits the paused task to the priority queue or timetable
+// it was paused from again with its original priority or run at time.
+//
+// an error is encountered if a task with the provided id does not exist
+// or if the task is not paused.
+func (ctrl *ResourceController) ResumeTask(taskId string, taskModel Model) error {
+	ctx := ctrl.operation()
+	task, err := getTask(taskId, taskModel)
+	if err != nil {
+		return err
+	}
+	if task.Status != StatusPaused {
+		return TaskNotPausedError
+	}
+	var status string
+	if task.PausedFrom != "" {
+		status, err = ctrl.submitTaskAs(ctx, task, task.PausedFrom)
+	} else {
+		status, err = ctrl.submitTask(ctx, task)
+	}
+	if err != nil {
+		return err
+	}
+	task.PausedFrom = ""
+	if err := task.ChangeStatus(taskModel, status); err != nil {
+		return err
+	}
+	ctrl.recordTransition(ctx, task, StatusPaused, "task resumed")
+
+	meta := make(map[string]interface{})
+	json.Unmarshal(task.Meta, &meta)
+	meta["_status"] = status
+	meta["_id"] = task.Id
+	data, _ := json.Marshal(meta)
+	ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data))
+	logf(ctx, "resumed task [%s %s]\n", task.Created, string(task.Meta))
+
+	return nil
+}
+
+// RetryTask resubmits the errored or cancelled task to the timetable or
+// priority queue and increments the task attempts.
+//
+// an error is encountered if a task with the provided id does not exist
+// or if the task is not in the error or cancelled state.
+func (ctrl *ResourceController) RetryTask(taskId string, taskModel Model) error {
+	ctx := ctrl.operation()
+	task, err := getTask(taskId, taskModel)
+	if err != nil {
+		return err
+	}
+	if task.Status != StatusError && task.Status != StatusCancelled {
+		return TaskNotRetryableError
+	}
+	status, err := ctrl.submitTask(ctx, task)
+	if err != nil {
+		return err
+	}
+	prev := task.Status
+	task.Attempts++
+	if err := task.ChangeStatus(taskModel, status); err != nil {
+		return err
+	}
+	ctrl.recordTransition(ctx, task, prev, "task retried")
+
+	meta := make(map[string]interface{})
+	json.Unmarshal(task.Meta, &meta)
+	meta["_status"] = status
+	meta["_id"] = task.Id
+	meta["_attempts"] = task.Attempts
+	data, _ := json.Marshal(meta)
+	ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data))
+	logf(ctx, "retried task [%s %s]\n", task.Created, string(task.Meta))
+
+	return nil
+}
+
+// SearchTasks returns a page of tasks with meta values matching all of the
+// filters and all of the labels. Filter keys are dot separated meta paths.
+// Path segments and values are passed as bind variables.
+func (ctrl *ResourceController) SearchTasks(filters map[string]interface{}, labels map[string]string, limit int, offset int, taskModel Model) (*TaskPage, error) {
+	result, err := querySearchTasks(filters, labels, limit, offset, taskModel)
+	if err != nil {
+		return nil, err
+	}
+	return newTaskPage(result, limit, offset), nil
+}
+
+// newTaskPage returns the task page of the page of tasks at the offset
+// with the total number of matched tasks and the cursor of the next page,
+// which is empty on the last page.
+func newTaskPage(result *Page, limit int, offset int) *TaskPage {
+	page := &TaskPage{Limit: limit, Offset: offset, Tasks: make([]*Task, 0, len(result.Docs)), Total: result.Total}
+	for _, task := range result.Docs {
+		page.Tasks = append(page.Tasks, task.(*Task))
+	}
+	if next := offset + len(result.Docs); int64(next) < result.Total {
+		page.Cursor = PageCursor(next)
+	}
+	return page
+}
+
+// ServerInfo returns the build and configuration details of the controller.
+func (ctrl *ResourceController) ServerInfo() *ServerInfo {
+	return &ServerInfo{
+		BuildCommit:              BuildCommit,
+		PriorityQueueHost:        PriorityQueueHost,
+		ResourceCount:            len(ctrl.resourceSnapshot()),
+		StageInterval:            StageInterval.Seconds(),
+		StatusChangeNotifierHost: StatusChangeNotifierHost,
+		TimetableHost:            TimetableHost,
+		Version:                  Version,
+	}
+}
+
+// SetResourceQuota limits the number of tasks started on the resource in a
+// rolling period. A nil quota removes the limit.
+func (ctrl *ResourceController) SetResourceQuota(name string, quota *ResourceQuota, resourceModel Model) error {
+	resource, ok := ctrl.lookupResource(name)
+	if !ok {
+		return ResourceNotFoundError
+	}
+	ctrl.updateResource(resource, func(r *Resource) {
+		r.Quota = quota
+		if quota == nil {
+			r.QuotaStarts = nil
+		}
+	})
+	if err := ctrl.saveResource(resource, resourceModel); err != nil {
+		return err
+	}
+	log.Printf("resource quota [%s %+v]\n", name, quota)
+	return nil
+}
+
+// SetResourceParent makes the resource a child of the parent resource. An
+// empty parent detaches the resource from its parent.
+//
+// an error is encountered if either resource does not exist or if the
+// parent is the resource itself or one of its descendants.
+func (ctrl *ResourceController) SetResourceParent(name string, parent string, resourceModel Model) error {
+	resource, ok := ctrl.lookupResource(name)
+	if !ok {
+		return ResourceNotFoundError
+	}
+	if parent != "" {
+		if _, ok := ctrl.lookupResource(parent); !ok {
+			return ResourceNotFoundError
+		}
+		for _, ancestor := range append([]string{parent}, ctrl.ancestors(parent)...) {
+			if ancestor == name {
+				return ResourceCycleError
+			}
+		}
+	}
+	ctrl.updateResource(resource, func(r *Resource) { r.Parent = parent })
+	if err := ctrl.saveResource(resource, resourceModel); err != nil {
+		return err
+	}
+	log.Printf("resource parent [%s %s]\n", name, parent)
+	return nil
+}
+
+// SetResourceWeight changes the staging preference of the resource.
+func (ctrl *ResourceController) SetResourceWeight(name string, weight float64, resourceModel Model) error {
+	resource, ok := ctrl.lookupResource(name)
+	if !ok {
+		return ResourceNotFoundError
+	}
+	ctrl.updateResource(resource, func(r *Resource) { r.Weight = weight })
+	if err := ctrl.saveResource(resource, resourceModel); err != nil {
+		return err
+	}
+	log.Printf("resource weight [%s %g]\n", name, weight)
+	return nil
+}
+
+// StartTask starts the staged task and records the start of an attempt by
+// the worker.
+//
+// If the start cannot be saved the resource is freed again and the task is
+// returned to the front of the stage unchanged.
+//
+// an error is encountered if no staged task exists for the key or if
+// the resource associated with the task is locked.
+func (ctrl *ResourceController) StartTask(key string, workerId string, taskModel Model, resourceModel Model) error {
+	ctx := ctrl.operation()
+	slot, ok := ctrl.stagedSlot(key)
+	if !ok {
+		return NoStagedTaskError
+	}
+	task, err := slot.Take(func(task *Task) error {
+		return ctrl.claimResource(key, task)
+	})
+	ctrl.releaseSlot(key, slot)
+	if err != nil {
+		return err
+	}
+	if task.Status == StatusStarted {
+		return TaskAlreadyStartedError
+	}
+	resource, _ := ctrl.lookupResource(key)
+	leaseExpires := time.Now().Add(LeaseDuration)
+	prev, saved := task.Status, task.snapshot()
+	if err := task.SetStatus(StatusStarted); err != nil {
+		ctrl.releaseClaim(resource, task)
+		ctrl.returnStagedTask(key, task)
+		return err
+	}
+	task.LeaseExpires = &leaseExpires
+	task.BeginAttempt(workerId)
+	doc := ctrl.resourceDoc(resource)
+	if err := UpdateAll(Update{taskModel, task}, Update{resourceModel, doc}); err != nil {
+		*task = *saved
+		ctrl.releaseClaim(resource, task)
+		ctrl.returnStagedTask(key, task)
+		return err
+	}
+	ctrl.syncResource(resource, doc)
+	ctrl.recordTransition(ctx, task, prev, "task started")
+
+	meta := make(map[string]interface{})
+	json.Unmarshal(task.Meta, &meta)
+	meta["_status"] = StatusStarted
+	meta["_id"] = task.Id
+	data, _ := json.Marshal(meta)
+	ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data))
+	logf(ctx, "started task [%s %s] with resource [%s]\n", task.Created, string(task.Meta), key)
+	ctrl.runHooks(func(h ControllerHooks) { h.OnTaskStarted(task) })
+
+	return nil
+}
+
+// StageTask adds the pending task to the associated task stage key if the
+// stage has room for it. The staging time is saved with the task; a task
+// staged again without a status change keeps its saved staging time. A
+// task that loses the last room in the stage to a concurrently staged task
+// is returned to its priority queue or timetable.
+func (ctrl *ResourceController) StageTask(task *Task, taskModel Model, changeStatus bool) {
+	ctrl.stageTask(ctrl.operation(), task, taskModel, changeStatus)
+}
+
+// stageTask is StageTask in the operation of the context.
+func (ctrl *ResourceController) stageTask(ctx context.Context, task *Task, taskModel Model, changeStatus bool) {
+	if !ctrl.stageFull(task.Key) {
+		stagedAt := time.Now()
+		if changeStatus || task.StagedAt == nil {
+			task.StagedAt = &stagedAt
+		} else {
+			stagedAt = *task.StagedAt
+		}
+		if changeStatus {
+			prev := task.Status
+			if err := task.ChangeStatus(taskModel, StatusPending); err != nil {
+				logln(ctx, err, task.Id)
+				return
+			}
+			ctrl.recordTransition(ctx, task, prev, "task staged")
+		}
+		ahead, err := ctrl.pushStagedTask(task, stagedAt)
+		if err != nil {
+			logln(ctx, err, task.Id)
+			if err := ctrl.requeueStagedTask(ctx, task, taskModel, "stage full"); err != nil {
+				logln(ctx, err, task.Id)
+			}
+			return
+		}
+		if ahead == 0 {
+			ctrl.setStagedTaskId(task.Key, task.Id)
+		}
+
+		meta := make(map[string]interface{})
+		json.Unmarshal(task.Meta, &meta)
+		meta["_status"] = StatusPending
+		meta["_id"] = task.Id
+		meta["_key"] = task.Key
+		data, _ := json.Marshal(meta)
+		if err := ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data)); err != nil {
+			logln(ctx, err)
+		}
+		logf(ctx, "staged task [%s %s]\n", task.Created, string(task.Meta))
+		ctrl.runHooks(func(h ControllerHooks) { h.OnTaskStaged(task) })
+	}
+}
+
+// StartStageLoop pulls tasks from the timetable and priority queues
+// and stages them for completion. Polls are started in order of resource
+// weight so that pool tasks go to the heaviest free member first.
+//
+// Each key is polled once per stage interval plus a random jitter. Polls
+// are delayed with exponential backoff after broker errors and, if an idle
+// interval is configured, keys with empty queues are polled less often
+// until a task is submitted for them.
+//
+// The due keys of a pool are polled one after the other in a goroutine of
+// the pool, so the members keep staging pool tasks in order of weight.
+// Every other key is polled in its own goroutine so a slow broker call only
+// delays the polled key. A key is not polled again while its last poll is
+// still running. The loop stops starting polls once the context is done.
+func (ctrl *ResourceController) StartStageLoop(ctx context.Context, taskModel Model) {
+	for {
+		groups := make(map[string][]string)
+		var order []string
+		for _, key := range ctrl.resourcesByWeight() {
+			if !ctrl.ownsKey(key) || !ctrl.pollDue(key) {
+				continue
+			}
+			group := ctrl.shardKey(key)
+			if _, ok := groups[group]; !ok {
+				order = append(order, group)
+			}
+			groups[group] = append(groups[group], key)
+		}
+		for _, group := range order {
+			if _, running := ctrl.staging.LoadOrStore(group, true); running {
+				continue
+			}
+			if !ctrl.track() {
+				ctrl.staging.Delete(group)
+				return
+			}
+			go ctrl.stageGroup(group, groups[group], taskModel)
+		}
+
+		if !sleepContext(ctx, StageTick) {
+			return
+		}
+	}
+}
+
+// UnstageTask removes the tasks staged for the resource key and submits
+// them back to the priority queue or timetable.
+func (ctrl *ResourceController) UnstageTask(key string, taskModel Model) error {
+	return ctrl.unstageTask(ctrl.operation(), key, taskModel)
+}
+
+// unstageTask is UnstageTask in the operation of the context.
+func (ctrl *ResourceController) unstageTask(ctx context.Context, key string, taskModel Model) error {
+	slot, ok := ctrl.stagedSlot(key)
+	if !ok {
+		return NoStagedTaskError
+	}
+	tasks := slot.Drain()
+	ctrl.releaseSlot(key, slot)
+	if len(tasks) == 0 {
+		return NoStagedTaskError
+	}
+	for i, task := range tasks {
+		status, err := ctrl.submitTask(ctx, task)
+		if err != nil {
+			ctrl.restageTasks(tasks[i:], slot.StagedAt())
+			return err
+		}
+		prev := task.Status
+		if err := task.ChangeStatus(taskModel, status); err != nil {
+			ctrl.restageTasks(tasks[i+1:], slot.StagedAt())
+			return err
+		}
+		ctrl.recordTransition(ctx, task, prev, "task unstaged")
+
+		meta := make(map[string]interface{})
+		json.Unmarshal(task.Meta, &meta)
+		meta["_status"] = status
+		meta["_id"] = task.Id
+		data, _ := json.Marshal(meta)
+		ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data))
+		logf(ctx, "unstaged task [%s %s] from resource [%s]\n", task.Created, string(task.Meta), key)
+	}
+	ctrl.setStagedTaskId(key, "")
+
+	return nil
+}
+
+// UpdateTaskPriority changes the priority of the queued task and moves
+// the task to the new position in the priority queue.
+//
+// an error is encountered if a task with the provided id does not exist
+// or if the task is not in the queued state.
+func (ctrl *ResourceController) UpdateTaskPriority(taskId string, priority float64, taskModel Model) error {
+	ctx := ctrl.operation()
+	task, err := getTask(taskId, taskModel)
+	if err != nil {
+		return err
+	}
+	if task.Status != StatusQueued {
+		return TaskNotQueuedError
+	}
+
+	params := map[string]interface{}{"key": task.QueueKey(), "id": task.Id}
+	result, errObj := CallInt(ctx, ctrl.broker, PriorityQueueHost, "remove", params)
+	if errObj != nil {
+		return errors.New(string(errObj.Message))
+	}
+	if result != 0 {
+		return TaskUpdateFailedError
+	}
+	params["priority"] = priority
+	result, errObj = CallInt(ctx, ctrl.broker, PriorityQueueHost, "push", params)
+	if errObj != nil || result != 0 {
+		params["priority"] = task.Priority
+		if _, restoreErr := ctrl.broker.Call(ctx, PriorityQueueHost, "push", params); restoreErr != nil {
+			logf(ctx, "lost queued task [%s %s]\n", task.Created, string(task.Meta))
+		}
+		if errObj != nil {
+			return errors.New(string(errObj.Message))
+		}
+		return TaskUpdateFailedError
+	}
+	task.Priority = priority
+	if _, err := taskModel.Save(task); err != nil {
+		return err
+	}
+
+	meta := make(map[string]interface{})
+	json.Unmarshal(task.Meta, &meta)
+	meta["_status"] = task.Status
+	meta["_id"] = task.Id
+	meta["_priority"] = priority
+	data, _ := json.Marshal(meta)
+	ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data))
+	logf(ctx, "updated task priority [%s %s]\n", task.Created, string(task.Meta))
+
+	return nil
+}
+
+// ValidateTask runs the checks of AddTask for the task and returns the
+// outcome of adding it. The task is not saved or submitted and the
+// resources are left unchanged.
+//
+// an error is encountered if the task has a parent that does not exist
+// or that is not in the started state, or if a dependency does not exist.
+func (ctrl *ResourceController) ValidateTask(task *Task, taskModel Model) (*TaskValidation, error) {
+	if err := ctrl.checkParent(task, taskModel); err != nil {
+		return nil, err
+	}
+	pending, err := ctrl.pendingDependencies(task, taskModel)
+	if err != nil {
+		return nil, err
+	}
+	validation := &TaskValidation{QueueKey: task.QueueKey(), Status: StatusQueued}
+	if pending > 0 {
+		validation.Status = StatusBlocked
+	} else if task.RunAt != nil {
+		validation.Status = StatusScheduled
+	}
+	if !ctrl.isPool(task.Key) {
+		_, ok := ctrl.lookupResource(task.Key)
+		validation.NewResource = !ok
+	}
+	return validation, nil
+}
+
+// StartExpiryLoop periodically cancels the expired tasks until the
+// context is done.
+func (ctrl *ResourceController) StartExpiryLoop(ctx context.Context, taskModel Model) {
+	for {
+		if _, err := ctrl.ExpireTasks(taskModel); err != nil {
+			logln(ctx, err)
+		}
+		if !sleepContext(ctx, ExpiryInterval) {
+			return
+		}
+	}
+}
+
+// StartLeaseLoop periodically reclaims the started tasks with expired
+// leases until the context is done.
+func (ctrl *ResourceController) StartLeaseLoop(ctx context.Context, taskModel Model, resourceModel Model) {
+	for {
+		if _, err := ctrl.ReclaimExpiredLeases(taskModel, resourceModel); err != nil {
+			logln(ctx, err)
+		}
+		if !sleepContext(ctx, LeaseInterval) {
+			return
+		}
+	}
+}
+
+// StartHeartbeatLoop periodically moves the resources that missed their
+// heartbeats to the offline state and removes the registered resources
+// that stayed silent until the context is done.
+func (ctrl *ResourceController) StartHeartbeatLoop(ctx context.Context, taskModel Model, resourceModel Model) {
+	for {
+		if _, err := ctrl.MarkOfflineResources(taskModel, resourceModel); err != nil {
+			logln(ctx, err)
+		}
+		if _, err := ctrl.DeregisterResources(taskModel, resourceModel); err != nil {
+			logln(ctx, err)
+		}
+		if !sleepContext(ctx, HeartbeatInterval) {
+			return
+		}
+	}
+}
+
+// StartLockLoop periodically releases the resources that have been locked
+// for longer than the max lock duration until the context is done.
+func (ctrl *ResourceController) StartLockLoop(ctx context.Context, maxLock time.Duration, taskModel Model, resourceModel Model) {
+	for {
+		if _, err := ctrl.ReleaseExpiredLocks(maxLock, taskModel, resourceModel); err != nil {
+			logln(ctx, err)
+		}
+		if !sleepContext(ctx, LockInterval) {
+			return
+		}
+	}
+}
+
+// StartArchiveLoop periodically moves the tasks in a final status that are
+// older than the retention to the tasks archive until the context is done.
+func (ctrl *ResourceController) StartArchiveLoop(ctx context.Context, retention time.Duration, taskModel Model, archiveModel Model) {
+	for {
+		if _, err := ctrl.ArchiveTasks(retention, taskModel, archiveModel); err != nil {
+			logln(ctx, err)
+		}
+		if !sleepContext(ctx, ArchiveInterval) {
+			return
+		}
+	}
+}
+
+// StartReplayLoop periodically replays the buffered calls to services
+// that were unreachable until the context is done.
+func (ctrl *ResourceController) StartReplayLoop(ctx context.Context, taskModel Model) {
+	for {
+		if err := ctrl.ReplayDeferredCalls(taskModel); err != nil {
+			logln(ctx, err)
+		}
+		if !sleepContext(ctx, ReplayInterval) {
+			return
+		}
+	}
+}
+
+// Shutdown waits for the running stage polls, task callback deliveries and
+// queued notifications to finish. No stage polls or callback deliveries
+// are started once it is called; task callbacks are deferred instead when
+// calls are buffered. The wait ends early with the context error when the
+// context is done, which also abandons the service calls in flight.
+func (ctrl *ResourceController) Shutdown(ctx context.Context) error {
+	ctrl.inflightLock.Lock()
+	ctrl.stopping = true
+	ctrl.inflightLock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		ctrl.inflight.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		ctrl.cancel()
+	}
+	if drainErr := ctrl.drainNotifications(ctx); drainErr != nil && err == nil {
+		err = drainErr
+		ctrl.cancel()
+	}
+	logln(ctx, "controller stopped")
+	return err
+}
+
+// track adds a unit of in-flight work that Shutdown waits for. False is
+// returned, and nothing is added, once the controller is stopping.
+func (ctrl *ResourceController) track() bool {
+	ctrl.inflightLock.Lock()
+	defer ctrl.inflightLock.Unlock()
+	if ctrl.stopping {
+		return false
+	}
+	ctrl.inflight.Add(1)
+	return true
+}
+
+// cancelChildren cancels the child tasks of the task, and their children,
+// that are not final.
+func (ctrl *ResourceController) cancelChildren(ctx context.Context, taskId string, taskModel Model, resourceModel Model) error {
+	children, err := queryChildTasks(taskId, false, taskModel)
+	if err != nil {
+		return err
+	}
+	for _, doc := range children {
+		child := doc.(*Task)
+		if err := ctrl.cancelChildren(ctx, child.Id, taskModel, resourceModel); err != nil {
+			logln(ctx, err)
+		}
+		if child.IsFinal() {
+			continue
+		}
+		if err := ctrl.forceCompleteTask(ctx, child.Id, StatusCancelled, "parent completed", taskModel, resourceModel); err != nil {
+			logln(ctx, err)
+		}
+	}
+	return nil
+}
+
+// childTasks returns the child tasks of the task, with their children,
+// in creation order.
+func (ctrl *ResourceController) childTasks(taskId string, taskModel Model) ([]*Task, error) {
+	docs, err := queryChildTasks(taskId, true, taskModel)
+	if err != nil {
+		return nil, err
+	}
+	children := make([]*Task, 0, len(docs))
+	for _, doc := range docs {
+		child := doc.(*Task)
+		if child.Children, err = ctrl.childTasks(child.Id, taskModel); err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	return children, nil
+}
+
+// settleDependents submits the blocked tasks that depend on the task once
+// all of their dependencies are complete, and cancels them if the task
+// ended in another final status or was removed. The dependents of the
+// cancelled tasks are cancelled in turn. Nothing is done while the task
+// can still complete.
+func (ctrl *ResourceController) settleDependents(ctx context.Context, task *Task, taskModel Model) error {
+	if !task.IsFinal() {
+		return nil
+	}
+	children, err := queryDependents(task.Id, taskModel)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		task := child.(*Task)
+		pending, err := ctrl.pendingDependencies(task, taskModel)
+		if err == DependencyFailedError || err == DependencyNotFoundError {
+			if err := ctrl.cancelDependent(ctx, task, err, taskModel); err != nil {
+				logln(ctx, err)
+			}
+			continue
+		}
+		if err != nil {
+			logln(ctx, err)
+			continue
+		}
+		if pending > 0 {
+			continue
+		}
+		status, err := ctrl.submitTask(ctx, task)
+		if err != nil {
+			logln(ctx, err)
+			continue
+		}
+		if err := task.ChangeStatus(taskModel, status); err != nil {
+			logln(ctx, err)
+			continue
+		}
+		ctrl.recordTransition(ctx, task, StatusBlocked, "dependencies complete")
+
+		meta := make(map[string]interface{})
+		json.Unmarshal(task.Meta, &meta)
+		meta["_status"] = status
+		meta["_id"] = task.Id
+		data, _ := json.Marshal(meta)
+		ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data))
+	}
+	return nil
+}
+
+// cancelDependent cancels the blocked task whose dependency failed or was
+// removed, and settles its own dependents.
+func (ctrl *ResourceController) cancelDependent(ctx context.Context, task *Task, cause error, taskModel Model) error {
+	if err := task.ChangeStatus(taskModel, StatusCancelled); err != nil {
+		return err
+	}
+	ctrl.recordTransition(ctx, task, StatusBlocked, cause.Error())
+
+	meta := make(map[string]interface{})
+	json.Unmarshal(task.Meta, &meta)
+	meta["_status"] = StatusCancelled
+	meta["_id"] = task.Id
+	data, _ := json.Marshal(meta)
+	ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data))
+	logf(ctx, "cancelled task [%s %s]: %s\n", task.Created, string(task.Meta), cause)
+	return ctrl.settleDependents(ctx, task, taskModel)
+}
+
+// retryFailedTask schedules the next attempt of the failed task in the
+// timetable using the task backoff. A task failed permanently event is sent
+// once all attempts are exhausted.
+func (ctrl *ResourceController) retryFailedTask(ctx context.Context, task *Task, taskModel Model) error {
+	meta := make(map[string]interface{})
+	json.Unmarshal(task.Meta, &meta)
+	meta["_id"] = task.Id
+	meta["_attempts"] = task.Attempts
+
+	runAt, ok := task.NextRetry()
+	if !ok {
+		meta["_status"] = task.Status
+		data, _ := json.Marshal(meta)
+		logf(ctx, "task [%s %s] failed permanently\n", task.Created, string(task.Meta))
+		return ctrl.notify(ctx, NewEvent(TaskFailedEvent, data))
+	}
+	prevRunAt := task.RunAt
+	task.RunAt = &runAt
+	status, err := ctrl.submitTask(ctx, task)
+	if err != nil {
+		task.RunAt = prevRunAt
+		return err
+	}
+	prev := task.Status
+	task.Attempts++
+	if err := task.ChangeStatus(taskModel, status); err != nil {
+		return err
+	}
+	ctrl.recordTransition(ctx, task, prev, "task retried automatically")
+
+	meta["_status"] = status
+	meta["_attempts"] = task.Attempts
+	data, _ := json.Marshal(meta)
+	ctrl.notify(ctx, NewEvent(TaskStatusChangedEvent, data))
+	return nil
+}
+
+// updateGroup records the status of the task in its group. A
+// taskGroupCompleted event is sent when all member tasks reached a final
+// status.
+func (ctrl *ResourceController) updateGroup(ctx context.Context, task *Task) error {
+	ctrl.groupLock.Lock()
+	defer ctrl.groupLock.Unlock()
+
+	groups, err := queryTaskGroup(task.GroupId, ctrl.groups)
+	if err != nil {
+		return err
+	}
+	group := NewTaskGroup(task.GroupId)
+	if len(groups) > 0 {
+		group = groups[0].(*TaskGroup)
+	}
+	group.Members[task.Id] = task.Status
+
+	complete := task.IsFinal()
+	for id, status := range group.Members {
+		if id != task.Id && status != StatusComplete && status != StatusCancelled && status != StatusError {
+			complete = false
+		}
+	}
+	completed := complete && group.Completed == nil
+	if !complete {
+		group.Completed = nil
+	} else if completed {
+		now := time.Now()
+		group.Completed = &now
+	}
+	if _, err := ctrl.groups.Save(group); err != nil {
+		return err
+	}
+
+	if completed {
+		counts := make(map[string]int)
+		for _, status := range group.Members {
+			counts[status]++
+		}
+		data, _ := json.Marshal(map[string]interface{}{"_groupId": group.Id, "counts": counts})
+		ctrl.notify(ctx, NewEvent(TaskGroupCompletedEvent, data))
+		logf(ctx, "completed task group [%s]\n", group.Id)
+	}
+	return nil
+}
+
+// setDraining changes the drain mode of the resource and saves the
+// resource.
+func (ctrl *ResourceController) setDraining(name string, draining bool, resourceModel Model) error {
+	resource, ok := ctrl.lookupResource(name)
+	if !ok {
+		return ResourceNotFoundError
+	}
+	ctrl.updateResource(resource, func(r *Resource) { r.Draining = draining })
+	if err := ctrl.saveResource(resource, resourceModel); err != nil {
+		return err
+	}
+	log.Printf("resource draining [%s %t]\n", name, draining)
+	return nil
+}
+
+// entryCount returns the number of entries in a listed priority queue
+// or timetable.
+func entryCount(list map[string]interface{}) int {
+	count := 0
+	for _, v := range list {
+		switch v := v.(type) {
+		case []interface{}:
+			count += len(v)
+		case map[string]interface{}:
+			count += entryCount(v)
+		}
+	}
+	return count
+}
+
+// deliverCallback posts the task document to the callback url. Failed
+// deliveries are retried with an exponential backoff.
+func deliverCallback(callbackUrl string, body []byte) error {
+	backoff := CallbackBackoff
+	for attempt := 1; attempt <= CallbackAttempts; attempt++ {
+		err := sendCallback(callbackUrl, body)
+		if err == nil {
+			return nil
+		}
+		log.Printf("task callback failed [%s %d %s]\n", callbackUrl, attempt, err)
+		if errors.Is(err, CallbackHostError) {
+			break
+		}
+		if attempt < CallbackAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return CallbackFailedError
+}
+
+// deliverTaskCallback posts the task document to the callback url of the
+// task. When calls are buffered, a failed delivery is saved as a deferred
+// call and retried by the replay loop, so that it survives a restart.
+func (ctrl *ResourceController) deliverTaskCallback(ctx context.Context, taskId string, callbackUrl string, body []byte) error {
+	if ctrl.callBuffer == nil {
+		return deliverCallback(callbackUrl, body)
+	}
+	err := sendCallback(callbackUrl, body)
+	if err == nil {
+		return nil
+	}
+	logf(ctx, "task callback failed [%s %d %s]\n", callbackUrl, 1, err)
+	if errors.Is(err, CallbackHostError) {
+		return CallbackFailedError
+	}
+	return ctrl.deferCallback(ctx, taskId, callbackUrl, body, 1)
+}
+
+// deferCallback saves the task callback as a deferred call, which already
+// failed the number of attempts, so that the replay loop delivers it.
+//
+// an error is encountered if calls are not buffered, since the callback is
+// then lost.
+func (ctrl *ResourceController) deferCallback(ctx context.Context, taskId string, callbackUrl string, body []byte, attempts int) error {
+	if ctrl.callBuffer == nil {
+		return CallbackFailedError
+	}
+	call := NewDeferredCall(taskId, callbackUrl, CallbackMethod, map[string]interface{}{"body": string(body)}, "")
+	call.Attempts = attempts
+	if _, err := ctrl.callBuffer.Save(call); err != nil {
+		return err
+	}
+	logf(ctx, "deferred task callback [%s %s]\n", callbackUrl, taskId)
+	return nil
+}
+
+// sendCallback posts the body to the callback url once. The body is signed
+// with an HMAC-SHA256 signature when a callback secret is set.
+//
+// an error is encountered if the host of the url is not one of the
+// CallbackHosts, or if the request fails or is answered with a status
+// other than 2xx.
+func sendCallback(callbackUrl string, body []byte) error {
+	if !callbackAllowed(callbackUrl) {
+		return CallbackHostError
+	}
+	req, err := http.NewRequest(http.MethodPost, callbackUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if CallbackSecret != "" {
+		req.Header.Set(CallbackSignatureHeader, signBody(CallbackSecret, body))
+	}
+	resp, err := callbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// callbackClient is the http client of the task callbacks. It does not
+// follow redirects, and does not connect to loopback, private or
+// link-local addresses unless the callback hosts are restricted with
+// CallbackHosts.
+var callbackClient = &http.Client{
+	Timeout: CallbackTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{Timeout: CallbackTimeout, Control: callbackControl}).DialContext,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// callbackControl refuses the connections of task callbacks to internal
+// addresses when CallbackHosts is unset.
+func callbackControl(network string, address string, c syscall.RawConn) error {
+	if len(CallbackHosts) > 0 {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return CallbackHostError
+	}
+	return nil
+}
+
+// callbackAllowed indicates whether task callbacks may be sent to the host
+// of the url. All hosts are allowed if CallbackHosts is unset. A host entry
+// starting with a dot allows its subdomains.
+func callbackAllowed(callbackUrl string) bool {
+	if len(CallbackHosts) == 0 {
+		return true
+	}
+	u, err := url.Parse(callbackUrl)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range CallbackHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// signBody returns the hex encoded HMAC-SHA256 signature of the request
+// body prefixed with the algorithm name.
+func signBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// envList returns the comma separated values of the environment variable
+// without surrounding spaces. Nil is returned if it is unset.
+func envList(name string) []string {
+	var values []string
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// envFloat returns the float value of the environment variable or 0 if it
+// is unset or invalid.
+func envFloat(name string) float64 {
+	v, _ := strconv.ParseFloat(os.Getenv(name), 64)
+	return v
+}
+
+// unlockResource frees the resource and records the busy period of the
+// lock when resource statistics are tracked.
+func (ctrl *ResourceController) unlockResource(resource *Resource) {
+	ctrl.rescLock.Lock()
+	lockedAt := resource.LockedAt
+	resource.Status = ResourceFree
+	resource.TaskId = ""
+	resource.LockedAt = nil
+	ctrl.rescLock.Unlock()
+	ctrl.recordBusy(resource.Name, lockedAt)
+}
+
+// releaseTaskLock frees the resource with the provided name if it is held
+// by the task. The check and the unlock are made under the resources lock,
+// so a resource claimed by another task in the meantime is left alone. The
+// resource is returned if it was freed.
+func (ctrl *ResourceController) releaseTaskLock(name string, taskId string) (*Resource, bool) {
+	ctrl.rescLock.Lock()
+	resource, ok := ctrl.resources[name]
+	if !ok || resource.TaskId != taskId {
+		ctrl.rescLock.Unlock()
+		return nil, false
+	}
+	lockedAt := resource.LockedAt
+	resource.Status = ResourceFree
+	resource.TaskId = ""
+	resource.LockedAt = nil
+	ctrl.rescLock.Unlock()
+	ctrl.recordBusy(name, lockedAt)
+	return resource, true
+}
+
+// recordBusy records the busy period of the resource lock that started at
+// lockedAt when resource statistics are tracked.
+func (ctrl *ResourceController) recordBusy(name string, lockedAt *time.Time) {
+	if ctrl.rescStats == nil || lockedAt == nil {
+		return
+	}
+	if _, err := ctrl.rescStats.Save(NewResourceStat(name, *lockedAt, time.Now())); err != nil {
+		log.Println(err)
+	}
+}
+
+// releaseClaim frees the resource claimed by the task whose start could not
+// be saved. The quota start recorded by the claim is dropped and the task
+// stays the staged task of the resource.
+func (ctrl *ResourceController) releaseClaim(resource *Resource, task *Task) {
+	ctrl.rescLock.Lock()
+	defer ctrl.rescLock.Unlock()
+	if resource.Status != ResourceLocked || resource.TaskId != task.Id {
+		return
+	}
+	resource.Status = ResourceFree
+	resource.LockedAt = nil
+	if n := len(resource.QuotaStarts); resource.Quota != nil && n > 0 {
+		resource.QuotaStarts = resource.QuotaStarts[:n-1]
+	}
+}
+
+// relockResource locks the resource for the started task again after its
+// completion could not be saved. A resource claimed by another task in the
+// meantime is left alone.
+func (ctrl *ResourceController) relockResource(resource *Resource, task *Task, lockedAt *time.Time) {
+	ctrl.rescLock.Lock()
+	defer ctrl.rescLock.Unlock()
+	if resource.Status != ResourceFree || (resource.TaskId != "" && resource.TaskId != task.Id) {
+		return
+	}
+	resource.Status = ResourceLocked
+	resource.TaskId = task.Id
+	resource.LockedAt = lockedAt
+}
+
+// resourceLockedAt returns the time the resource was locked.
+func (ctrl *ResourceController) resourceLockedAt(resource *Resource) *time.Time {
+	ctrl.rescLock.RLock()
+	defer ctrl.rescLock.RUnlock()
+	return resource.LockedAt
+}
+
+// claimResource locks the resource for the staged task unless the resource
+// or one of its relatives is locked, the resource is draining, the maximum
+// number of started tasks is reached or the start is rate limited. The check
+// and the lock are made under the resources lock so that concurrent starts
+// cannot lock the resource twice. A task that is already started does not
+// lock the resource.
+func (ctrl *ResourceController) claimResource(key string, task *Task) error {
+	ctrl.rescLock.Lock()
+	defer ctrl.rescLock.Unlock()
+	resource := ctrl.resources[key]
+	if resource.Status == ResourceLocked || relativeLocked(ctrl.resources, key) {
+		return ResourceUnavailableError
+	}
+	if resource.Draining {
+		return ResourceDrainingError
+	}
+	if task.Status == StatusStarted {
+		return nil
+	}
+	if MaxStartedTasks > 0 && ctrl.startedCount() >= MaxStartedTasks {
+		return AtCapacityError
+	}
+	lockedAt := time.Now()
+	if !ctrl.limiter.Take(key, lockedAt) {
+		return StartRateLimitedError
+	}
+	resource.Status = ResourceLocked
+	resource.TaskId = task.Id
+	resource.LockedAt = &lockedAt
+	resource.RecordStart(lockedAt)
+	return nil
+}
+
+// resourceStatus returns the lock status of the resource. The status is
+// read under the resources lock because it is changed by concurrent starts
+// and completions.
+func (ctrl *ResourceController) resourceStatus(resource *Resource) ResourceStatus {
+	ctrl.rescLock.RLock()
+	defer ctrl.rescLock.RUnlock()
+	return resource.Status
+}
+
+// lookupResource returns the managed resource with the provided name. The
+// name and pool of the resource do not change once it is managed; all other
+// fields are read through viewResource and changed through updateResource,
+// because they are changed by concurrent starts and completions.
+func (ctrl *ResourceController) lookupResource(name string) (*Resource, bool) {
+	ctrl.rescLock.RLock()
+	defer ctrl.rescLock.RUnlock()
+	resource, ok := ctrl.resources[name]
+	return resource, ok
+}
+
+// viewResource returns a copy of the managed resource with the provided
+// name taken under the resources lock.
+func (ctrl *ResourceController) viewResource(name string) (Resource, bool) {
+	ctrl.rescLock.RLock()
+	defer ctrl.rescLock.RUnlock()
+	resource, ok := ctrl.resources[name]
+	if !ok {
+		return Resource{}, false
+	}
+	return copyResource(resource), true
+}
+
+// resourceViews returns copies of the managed resources taken under the
+// resources lock.
+func (ctrl *ResourceController) resourceViews() map[string]Resource {
+	ctrl.rescLock.RLock()
+	defer ctrl.rescLock.RUnlock()
+	views := make(map[string]Resource, len(ctrl.resources))
+	for name, resource := range ctrl.resources {
+		views[name] = copyResource(resource)
+	}
+	return views
+}
+
+// updateResource applies the change to the resource under the resources
+// lock.
+func (ctrl *ResourceController) updateResource(resource *Resource, change func(*Resource)) {
+	ctrl.rescLock.Lock()
+	defer ctrl.rescLock.Unlock()
+	change(resource)
+}
+
+// saveResource saves a copy of the resource taken under the resources lock,
+// so that the document does not change while it is written, and copies the
+// save times back to the resource.
+func (ctrl *ResourceController) saveResource(resource *Resource, resourceModel Model) error {
+	doc := ctrl.resourceDoc(resource)
+	if _, err := resourceModel.Save(doc); err != nil {
+		return err
+	}
+	ctrl.syncResource(resource, doc)
+	return nil
+}
+
+// resourceDoc returns a copy of the resource to be saved.
+func (ctrl *ResourceController) resourceDoc(resource *Resource) *Resource {
+	ctrl.rescLock.RLock()
+	defer ctrl.rescLock.RUnlock()
+	doc := copyResource(resource)
+	return &doc
+}
+
+// syncResource copies the save times of the saved copy back to the
+// resource.
+func (ctrl *ResourceController) syncResource(resource *Resource, doc *Resource) {
+	ctrl.updateResource(resource, func(r *Resource) {
+		r.Created = doc.Created
+		r.Updated = doc.Updated
+		r.UpdatedBy = doc.UpdatedBy
+	})
+}
+
+// copyResource returns a copy of the resource that does not share the
+// quota starts, which are filtered in place.
+func copyResource(resource *Resource) Resource {
+	v := *resource
+	v.QuotaStarts = append([]time.Time(nil), resource.QuotaStarts...)
+	return v
+}
+
+// storeResource adds the resource to the managed resources or replaces
+// the resource with the same name.
+func (ctrl *ResourceController) storeResource(resource *Resource) {
+	ctrl.rescLock.Lock()
+	defer ctrl.rescLock.Unlock()
+	ctrl.resources[resource.Name] = resource
+}
+
+// insertResource adds the resource to the managed resources.
+//
+// an error is encountered if the name is taken by a resource or a pool or
+// if the pool of the resource is the name of a resource.
+func (ctrl *ResourceController) insertResource(resource *Resource) error {
+	ctrl.rescLock.Lock()
+	defer ctrl.rescLock.Unlock()
+	if _, ok := ctrl.resources[resource.Name]; ok {
+		return ResourceExistsError
+	}
+	if _, ok := ctrl.resources[resource.Pool]; ok || isPool(ctrl.resources, resource.Name) || resource.Pool == resource.Name {
+		return PoolConflictError
+	}
+	ctrl.resources[resource.Name] = resource
+	return nil
+}
+
+// deleteResource stops managing the resource with the provided name.
+func (ctrl *ResourceController) deleteResource(name string) {
+	ctrl.rescLock.Lock()
+	defer ctrl.rescLock.Unlock()
+	delete(ctrl.resources, name)
+}
+
+// resourceSnapshot returns a copy of the managed resources map that can be
+// ranged over while resources are added or removed.
+func (ctrl *ResourceController) resourceSnapshot() map[string]*Resource {
+	ctrl.rescLock.RLock()
+	defer ctrl.rescLock.RUnlock()
+	resources := make(map[string]*Resource, len(ctrl.resources))
+	for name, resource := range ctrl.resources {
+		resources[name] = resource
+	}
+	return resources
+}
+
+// envDuration returns the duration value of the environment variable or 0
+// if it is unset or invalid.
+func envDuration(name string) time.Duration {
+	v, _ := time.ParseDuration(os.Getenv(name))
+	return v
+}
+
+// sleepContext pauses for the duration and returns false if the context is
+// done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// envDurationOr returns the duration value of the environment variable or
+// the fallback if it is unset, invalid or not positive.
+func envDurationOr(name string, fallback time.Duration) time.Duration {
+	if v := envDuration(name); v > 0 {
+		return v
+	}
+	return fallback
+}
+
+// topQueuedTask returns the highest priority task in the priority queue
+// listing or nil if the queue is empty.
+func topQueuedTask(queue map[string]interface{}) *Task {
+	entries, _ := queue["heap"].([]interface{})
+	var top *Task
+	for _, entry := range entries {
+		v, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var task *Task
+		mapstructure.Decode(v, &task)
+		if task != nil && (top == nil || task.Priority < top.Priority) {
+			top = task
+		}
+	}
+	return top
+}
+
+// taskFilter returns the query filters matching tasks with the status, key
+// and labels and adds them to the bind vars. Empty filters are omitted.
+func taskFilter(status string, key string, labels map[string]string, vars map[string]interface{}) string {
+	q := ""
+	if status != "" {
+		q += " FILTER t.status == @status"
+		vars["status"] = status
+	}
+	if key != "" {
+		q += " FILTER t.key == @key"
+		vars["key"] = key
+	}
+	return q + labelFilter(labels, vars)
+}
+
+// labelFilter returns the query filters matching tasks with all of the
+// labels and adds the label pairs to the bind vars.
+func labelFilter(labels map[string]string, vars map[string]interface{}) string {
+	q := ""
+	for i, pair := range LabelPairs(labels) {
+		name := fmt.Sprintf("l%d", i)
+		q += fmt.Sprintf(" FILTER @%s IN t.labelIndex", name)
+		vars[name] = pair
+	}
+	return q
+}
+
+// rollbackTask undoes the submission of the task that could not be added.
+// The task is removed from the priority queue or timetable it was submitted
+// to with the status and then from the database. A deferred task is left to
+// the replay of its buffered call. Failures are logged since the add
+// already failed.
+func (ctrl *ResourceController) rollbackTask(ctx context.Context, task *Task, status string, taskModel Model) {
+	if status == StatusDeferred {
+		return
+	}
+	if status == StatusQueued || status == StatusScheduled {
+		host := PriorityQueueHost
+		if status == StatusScheduled {
+			host = TimetableHost
+		}
+		params := map[string]interface{}{"key": task.QueueKey(), "id": task.Id}
+		result, errObj := CallInt(ctx, ctrl.broker, host, "remove", params)
+		if errObj != nil {
+			logln(ctx, errObj.Message, task.Id)
+		} else if result != 0 {
+			logln(ctx, TaskRemoveFailedError, task.Id)
+		}
+	}
+	if err := task.SetStatus(StatusCancelled); err != nil {
+		logln(ctx, err, task.Id)
+	}
+	ctrl.recordTransition(ctx, task, StatusCreated, "task add failed")
+	if err := taskModel.Remove(task); err != nil {
+		logln(ctx, err, task.Id)
+	}
+	logf(ctx, "rolled back task [%s %s]\n", task.Created, string(task.Meta))
+}
+
+// checkParent verifies that the parent of the task exists and is started.
+func (ctrl *ResourceController) checkParent(task *Task, taskModel Model) error {
+	if task.ParentId == "" {
+		return nil
+	}
+	parent, err := getTask(task.ParentId, taskModel)
+	if err == TaskNotFoundError {
+		return ParentNotFoundError
+	}
+	if err != nil {
+		return err
+	}
+	if parent.Status != StatusStarted {
+		return ParentNotStartedError
+	}
+	return nil
+}
+
+// pendingDependencies returns the number of tasks the task depends on that
+// are not complete.
+//
+// an error is encountered if a dependency does not exist or ended in a
+// final status other than complete.
+func (ctrl *ResourceController) pendingDependencies(task *Task, taskModel Model) (int, error) {
+	if len(task.DependsOn) == 0 {
+		return 0, nil
+	}
+	parents, err := queryTasks(task.DependsOn, taskModel)
+	if err != nil {
+		return 0, err
+	}
+	if len(parents) < len(task.DependsOn) {
+		return 0, DependencyNotFoundError
+	}
+	pending := 0
+	for _, parent := range parents {
+		parent := parent.(*Task)
+		if parent.Status == StatusComplete {
+			continue
+		}
+		if parent.IsFinal() {
+			return 0, DependencyFailedError
+		}
+		pending++
+	}
+	return pending, nil
+}
+
+// recordTransition saves the status transition of the task to the task
+// history when history recording is enabled. The task callback is sent
+// once the task reaches a final status.
+func (ctrl *ResourceController) recordTransition(ctx context.Context, task *Task, from string, reason string) {
+	if task.GroupId != "" && ctrl.groups != nil {
+		if err := ctrl.updateGroup(ctx, task); err != nil {
+			logln(ctx, err)
+		}
+	}
+	if task.CallbackUrl != "" && task.IsFinal() {
+		data, _ := json.Marshal(task)
+		if !ctrl.track() {
+			if err := ctrl.deferCallback(ctx, task.Id, task.CallbackUrl, data, 0); err != nil {
+				logln(ctx, err)
+			}
+		} else {
+			go func(taskId string, callbackUrl string) {
+				defer ctrl.inflight.Done()
+				if err := ctrl.deliverTaskCallback(ctx, taskId, callbackUrl, data); err != nil {
+					logln(ctx, err)
+				}
+			}(task.Id, task.CallbackUrl)
+		}
+	}
+	if ctrl.history == nil {
+		return
+	}
+	if _, err := ctrl.history.Save(NewTaskHistory(task.Id, from, task.Status, reason)); err != nil {
+		logln(ctx, err)
+	}
+}
+
+// preemption is a requested preemption of the task running on a resource
+// by the task that takes the resource next.
+type preemption struct {
+	// By is the id of the preempting task.
+	// TaskId is the id of the preempted task.
+	By     string
+	TaskId string
+}
+
+// requestPreemption sends a task preempt requested event for the task
+// running on the resource if the task that would take the resource next
+// outranks it by more than the preemption margin. The event is sent once
+// per running task.
+func (ctrl *ResourceController) requestPreemption(ctx context.Context, key string, taskModel Model) error {
+	view, _ := ctrl.viewResource(key)
+	if v, ok := ctrl.preempting.Load(key); ok && v.(preemption).TaskId == view.TaskId {
+		return nil
+	}
+	next, err := ctrl.preemptor(ctx, key)
+	if err != nil || next == nil {
+		return err
+	}
+	task, err := getTask(view.TaskId, taskModel)
+	if err != nil {
+		return err
+	}
+	if task.Status != StatusStarted || task.Priority-next.Priority <= PreemptionMargin {
+		return nil
+	}
+	ctrl.preempting.Store(key, preemption{By: next.Id, TaskId: task.Id})
+
+	meta := make(map[string]interface{})
+	json.Unmarshal(task.Meta, &meta)
+	meta["_id"] = task.Id
+	meta["_key"] = key
+	meta["_preemptedBy"] = next.Id
+	data, _ := json.Marshal(meta)
+	logf(ctx, "requested preemption of task [%s %s] by [%s]\n", task.Created, string(task.Meta), next.Id)
+	return ctrl.notify(ctx, NewEvent(TaskPreemptEvent, data))
+}
+
+// preemptor returns the task that takes the resource next if its running
+// task is preempted. This is the first staged task of the key unless the
+// highest priority queued task outranks it.
+func (ctrl *ResourceController) preemptor(ctx context.Context, key string) (*Task, error) {
+	var staged *Task
+	if slot, ok := ctrl.stagedSlot(key); ok {
+		if tasks := slot.Tasks(); len(tasks) > 0 {
+			staged = tasks[0]
+		}
+	}
+	queue, err := ctrl.listPriorityQueue(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	next := topQueuedTask(queue)
+	if next == nil || (staged != nil && staged.Priority <= next.Priority) {
+		return staged, nil
+	}
+	return next, nil
+}
+
+// stagePreemptor stages the preempting task in front of the stage of the
+// key. The tasks staged for the key are returned to their queues first. A
+// preempting task that is already first in the stage stays there and one
+// that left the priority queue in the meantime is not staged.
+func (ctrl *ResourceController) stagePreemptor(ctx context.Context, key string, id string, taskModel Model) error {
+	if slot, ok := ctrl.stagedSlot(key); ok {
+		if tasks := slot.Tasks(); len(tasks) > 0 && tasks[0].Id == id {
+			return nil
+		}
+		if err := ctrl.unstageTask(ctx, key, taskModel); err != nil && err != NoStagedTaskError {
+			return err
+		}
+	}
+	task, err := getTask(id, taskModel)
+	if err != nil {
+		return err
+	}
+	if task.Status != StatusQueued {
+		logf(ctx, "preempting task [%s] no longer queued\n", id)
+		return nil
+	}
+	result, errObj := CallInt(ctx, ctrl.broker, PriorityQueueHost, "remove", map[string]interface{}{"key": key, "id": id})
+	if errObj != nil {
+		return errors.New(string(errObj.Message))
+	}
+	if result != 0 {
+		logf(ctx, "preempting task [%s] no longer queued\n", id)
+		return nil
+	}
+	ctrl.stageTask(ctx, task, taskModel, true)
+	return nil
+}
+
+// stageNextTask stages the next scheduled or queued task of the resource
+// in the order of the stage policy. A pool member without tasks of its
+// own stages the next task of its pool and, if the pool has no tasks
+// either and the member is free, steals the highest priority queued task
+// of the member with the deepest backlog.
+//
+// A task with constraints that the resource does not satisfy is set aside
+// and the next task is fetched instead, so that it does not hold back the
+// tasks behind it. Up to ConstraintSkipLimit tasks are set aside per poll
+// and returned to their queues once the poll is done.
+func (ctrl *ResourceController) stageNextTask(ctx context.Context, key string, taskModel Model) error {
+	var skipped []*Task
+	defer func() { ctrl.resubmitTasks(ctx, skipped...) }()
+	for {
+		task, pool, victim, err := ctrl.selectTask(ctx, key, taskModel)
+		if err != nil || task == nil {
+			return err
+		}
+		if view, ok := ctrl.viewResource(key); ok && !view.Satisfies(task.Constraints) {
+			logf(ctx, "task constraints not satisfied [%s %s]\n", task.Id, key)
+			if skipped = append(skipped, task); len(skipped) >= ConstraintSkipLimit {
+				return nil
+			}
+			continue
+		}
+		ctrl.stageSelectedTask(ctx, key, task, pool, victim, taskModel)
+		return nil
+	}
+}
+
+// selectTask fetches the next task to stage for the resource key along with
+// the pool it was fetched from or the member it was stolen from. No task is
+// returned if none of the queues has one.
+func (ctrl *ResourceController) selectTask(ctx context.Context, key string, taskModel Model) (*Task, string, string, error) {
+	pool, victim := "", ""
+	task, err := ctrl.nextTask(ctx, key, taskModel)
+	if err != nil {
+		return nil, "", "", err
+	}
+	resource, ok := ctrl.lookupResource(key)
+	if ok && task == nil && resource.Pool != "" {
+		pool = resource.Pool
+		if task, err = ctrl.nextTask(ctx, pool, taskModel); err != nil {
+			return nil, "", "", err
+		}
+	}
+	if task == nil && pool != "" && StealThreshold > 0 && ctrl.resourceStatus(resource) == ResourceFree {
+		pool = ""
+		if victim = ctrl.stealVictim(ctx, key, resource.Pool); victim != "" {
+			if task, err = ctrl.nextQueuedTask(ctx, victim); err != nil {
+				return nil, "", "", err
+			}
+		}
+	}
+	if task == nil {
+		return nil, "", "", nil
+	}
+	if task, err = getTask(task.Id, taskModel); err != nil {
+		return nil, "", "", err
+	}
+	if StrictFIFO && task.Status == StatusQueued {
+		if task, err = ctrl.fifoTask(ctx, task, taskModel); err != nil || task == nil {
+			return nil, "", "", err
+		}
+	}
+	return task, pool, victim, nil
+}
+
+// stageSelectedTask stages the task selected for the resource key and
+// records the pool it was fetched from or the member it was stolen from.
+func (ctrl *ResourceController) stageSelectedTask(ctx context.Context, key string, task *Task, pool string, victim string, taskModel Model) {
+	if pool != "" {
+		task.Key = key
+		task.Pool = pool
+	}
+	if victim != "" {
+		task.Key = key
+		task.StolenFrom = victim
+		logf(ctx, "stole task [%s] from resource [%s] for resource [%s]\n", task.Id, victim, key)
+	} else if task.StolenFrom != "" && task.Pool == "" {
+		task.Key = key
+		task.StolenFrom = ""
+	}
+	ctrl.stageTask(ctx, task, taskModel, true)
+}
+
+// fifoTask returns the oldest queued task with the key and priority of the
+// popped queued task, so that tasks of equal priority are staged in the
+// order they were created regardless of the order the priority queue
+// returns them in. The popped task is returned to the priority queue if an
+// older task is staged instead, and is staged itself if the older task
+// cannot be looked up or the popped task cannot be returned. Nil is
+// returned while an older task is still being added, unless its add
+// started more than FIFOAddTimeout ago.
+func (ctrl *ResourceController) fifoTask(ctx context.Context, task *Task, taskModel Model) (*Task, error) {
+	tasks, err := queryOlderTask(task, taskModel)
+	if err != nil {
+		logln(ctx, err, task.Key)
+		return task, nil
+	}
+	if len(tasks) < 1 {
+		return task, nil
+	}
+	oldest := tasks[0].(*Task)
+	if _, err := ctrl.submitTask(ctx, task); err != nil {
+		logln(ctx, err, task.Key)
+		return task, nil
+	}
+	if oldest.Status != StatusQueued {
+		logf(ctx, "waiting for older task [%s] to be added [%s]\n", oldest.Id, task.Key)
+		return nil, nil
+	}
+	params := map[string]interface{}{"key": oldest.QueueKey(), "id": oldest.Id}
+	result, errObj := CallInt(ctx, ctrl.broker, PriorityQueueHost, "remove", params)
+	if errObj != nil {
+		return nil, errors.New(string(errObj.Message))
+	}
+	if result != 0 {
+		return nil, nil
+	}
+	return oldest, nil
+}
+
+// queueDepth is the cached priority queue depth of a pool member.
+type queueDepth struct {
+	Depth   int
+	Expires time.Time
+}
+
+// stealVictim returns the member of the pool other than the resource with
+// the deepest priority queue of at least StealThreshold tasks. An empty
+// string is returned if no member has such a backlog.
+//
+// The queue depths are cached for StealDepthTTL so that idle members do not
+// fetch the queue of every member on each poll. The cached depth of the
+// victim is lowered by the task about to be stolen.
+func (ctrl *ResourceController) stealVictim(ctx context.Context, key string, pool string) string {
+	victim, depth := "", StealThreshold-1
+	resources := ctrl.resourceViews()
+	names := make([]string, 0, len(resources))
+	for name, resource := range resources {
+		if name != key && resource.Pool == pool {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		n, err := ctrl.queueDepth(ctx, name)
+		if err != nil {
+			continue
+		}
+		if n > depth {
+			victim, depth = name, n
+		}
+	}
+	if victim != "" {
+		if v, ok := ctrl.depths.Load(victim); ok {
+			ctrl.depths.Store(victim, &queueDepth{depth - 1, v.(*queueDepth).Expires})
+		}
+	}
+	return victim
+}
+
+// queueDepth returns the number of tasks in the priority queue of the key,
+// which is cached for StealDepthTTL.
+func (ctrl *ResourceController) queueDepth(ctx context.Context, key string) (int, error) {
+	if v, ok := ctrl.depths.Load(key); ok && time.Now().Before(v.(*queueDepth).Expires) {
+		return v.(*queueDepth).Depth, nil
+	}
+	queue, err := ctrl.listPriorityQueue(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	n := entryCount(queue)
+	ctrl.depths.Store(key, &queueDepth{n, time.Now().Add(StealDepthTTL)})
+	return n, nil
+}
+
+// nextTask fetches the next due scheduled task or the highest priority
+// queued task of the key. The stage policy decides which of them is
+// fetched first; the other one is fetched if the first source is empty.
+func (ctrl *ResourceController) nextTask(ctx context.Context, key string, taskModel Model) (*Task, error) {
+	if StagePolicy == StagePolicyDeadline {
+		return ctrl.nextDeadlineTask(ctx, key, taskModel)
+	}
+	first, second := ctrl.nextScheduledTask, ctrl.nextQueuedTask
+	turn := 0
+	if v, ok := ctrl.turns.Load(key); ok {
+		turn = v.(int)
+	}
+	if queuedTurn(turn) {
+		first, second = second, first
+	}
+	task, err := first(ctx, key)
+	if err == nil && task == nil {
+		task, err = second(ctx, key)
+	}
+	if task != nil {
+		ctrl.turns.Store(key, turn+1)
+	}
+	return task, err
+}
+
+// nextDeadlineTask fetches the next due scheduled task and the highest
+// priority queued task of the key and returns the one that expires first.
+// Tasks without an expiry time come last and scheduled tasks win ties.
+// The other task is submitted back to its queue. Both tasks are submitted
+// back if neither can be returned.
+func (ctrl *ResourceController) nextDeadlineTask(ctx context.Context, key string, taskModel Model) (*Task, error) {
+	scheduled, err := ctrl.nextScheduledTask(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	queued, err := ctrl.nextQueuedTask(ctx, key)
+	if err != nil {
+		if scheduled != nil {
+			logln(ctx, err, key)
+			return scheduled, nil
+		}
+		return nil, err
+	}
+	if scheduled == nil || queued == nil {
+		if scheduled != nil {
+			return scheduled, nil
+		}
+		return queued, nil
+	}
+	candidates := []*Task{scheduled, queued}
+	for i, candidate := range candidates {
+		task, err := getTask(candidate.Id, taskModel)
+		if err != nil {
+			ctrl.resubmitTasks(ctx, candidates...)
+			return nil, err
+		}
+		candidates[i] = task
+	}
+	next, other := candidates[0], candidates[1]
+	if other.ExpiresAt != nil && (next.ExpiresAt == nil || other.ExpiresAt.Before(*next.ExpiresAt)) {
+		next, other = other, next
+	}
+	if _, err := ctrl.submitTask(ctx, other); err != nil {
+		ctrl.resubmitTasks(ctx, next, other)
+		return nil, err
+	}
+	return next, nil
+}
+
+// resubmitTasks submits the popped tasks that could not be staged back to
+// their priority queue or timetable. A task that cannot be submitted is
+// logged.
+func (ctrl *ResourceController) resubmitTasks(ctx context.Context, tasks ...*Task) {
+	for _, task := range tasks {
+		if _, err := ctrl.submitTask(ctx, task); err != nil {
+			logln(ctx, err, task.Id)
+		}
+	}
+}
+
+// nextScheduledTask fetches the next due scheduled task of the key. A
+// missing timetable is not an error.
+func (ctrl *ResourceController) nextScheduledTask(ctx context.Context, key string) (*Task, error) {
+	task, err := ctrl.stageScheduledTask(ctx, key)
+	if err != nil && !strings.EqualFold(err.Error(), TimetableNotFound.Error()) {
+		return nil, err
+	}
+	return task, nil
+}
+
+// nextQueuedTask fetches the highest priority queued task of the key. A
+// missing priority queue is not an error.
+func (ctrl *ResourceController) nextQueuedTask(ctx context.Context, key string) (*Task, error) {
+	task, err := ctrl.stageQueuedTask(ctx, key)
+	if err != nil && !strings.EqualFold(err.Error(), QueueNotFoundError.Error()) {
+		return nil, err
+	}
+	return task, nil
+}
+
+// queuedTurn indicates whether the stage policy fetches the queued task
+// first on the turn, which is the number of tasks fetched for the key.
+func queuedTurn(turn int) bool {
+	switch StagePolicy {
+	case StagePolicyQueued:
+		return true
+	case StagePolicyAlternate:
+		return turn%2 == 1
+	case StagePolicyWeighted:
+		weight := StageWeight
+		if weight < 1 {
+			weight = 1
+		}
+		return turn%(weight+1) == weight
+	}
+	return false
+}
+
+// stageGroup runs the stage polls of the keys, which are the due members
+// of a pool or a single key, in the order of the keys.
+func (ctrl *ResourceController) stageGroup(group string, keys []string, taskModel Model) {
+	defer ctrl.inflight.Done()
+	defer ctrl.staging.Delete(group)
+	for _, key := range keys {
+		ctrl.stageKey(key, taskModel)
+	}
+}
+
+// stageKey runs a stage poll of the resource key. A crashed poll is
+// recovered and backed off like a failed broker call, so the stage loop
+// restarts it once the backoff elapsed.
+func (ctrl *ResourceController) stageKey(key string, taskModel Model) {
+	ctx := ctrl.operation()
+	defer func() {
+		if r := recover(); r != nil {
+			logf(ctx, "stage poll crashed [%s %v]\n", key, r)
+			ctrl.schedulePoll(key, false, fmt.Errorf("%v", r))
+		}
+	}()
+	view, ok := ctrl.viewResource(key)
+	if !ok {
+		return
+	}
+	status := view.Status
+	if PreemptionEnabled && status == ResourceLocked {
+		if err := ctrl.requestPreemption(ctx, key, taskModel); err != nil {
+			logln(ctx, err)
+		}
+	}
+	locked := status == ResourceLocked && stageLimit() < 2
+	if ctrl.stageFull(key) || locked || view.Draining || view.Offline {
+		ctrl.schedulePoll(key, true, nil)
+		return
+	}
+	if ctrl.relativeLocked(key) || ctrl.quotaExhausted(ctx, key) || !ctrl.limiter.Ready(key, time.Now()) || ctrl.atCapacity() {
+		ctrl.schedulePoll(key, true, nil)
+		return
+	}
+	err := ctrl.stageNextTask(ctx, key, taskModel)
+	if err != nil {
+		logln(ctx, err, key)
+	}
+	_, staged := ctrl.stage.Load(key)
+	ctrl.schedulePoll(key, staged, err)
+}
+
+// stagePoll is the stage loop schedule of a key.
+type stagePoll struct {
+	// At is the time of the next poll.
+	// Delay is the delay between the previous and the next poll without
+	// jitter.
+	At    time.Time
+	Delay time.Duration
+}
+
+// pollDue indicates whether the stage loop should poll the key.
+func (ctrl *ResourceController) pollDue(key string) bool {
+	poll, ok := ctrl.polls.Load(key)
+	return !ok || !time.Now().Before(poll.(*stagePoll).At)
+}
+
+// schedulePoll sets the time of the next stage poll of the key from the
+// outcome of the last poll.
+func (ctrl *ResourceController) schedulePoll(key string, staged bool, err error) {
+	var prev time.Duration
+	if poll, ok := ctrl.polls.Load(key); ok {
+		prev = poll.(*stagePoll).Delay
+	}
+	delay := nextPollDelay(prev, staged, err)
+	at := time.Now().Add(delay)
+	if StageJitter > 0 {
+		at = at.Add(time.Duration(rand.Int63n(int64(StageJitter))))
+	}
+	ctrl.polls.Store(key, &stagePoll{At: at, Delay: delay})
+}
+
+// wakeStage makes the stage loop poll the key and the members of the pool
+// with the key as name on its next pass.
+func (ctrl *ResourceController) wakeStage(key string) {
+	ctrl.polls.Delete(key)
+	for name, view := range ctrl.resourceViews() {
+		if view.Pool == key {
+			ctrl.polls.Delete(name)
+		}
+	}
+}
+
+// nextPollDelay returns the delay before the next stage poll. The delay is
+// doubled up to the maximum backoff after errors and up to the idle
+// interval while nothing is staged.
+func nextPollDelay(prev time.Duration, staged bool, err error) time.Duration {
+	limit := StageInterval
+	if err != nil {
+		limit = StageMaxBackoff
+	} else if !staged && StageIdleInterval > StageInterval {
+		limit = StageIdleInterval
+	}
+	delay := prev * 2
+	if delay < StageInterval {
+		delay = StageInterval
+	}
+	if delay > limit {
+		delay = limit
+	}
+	return delay
+}
+
+// quotaExhausted returns true if the resource used up its quota. The
+// quota exceeded event is sent once each time the quota is used up.
+func (ctrl *ResourceController) quotaExhausted(ctx context.Context, key string) bool {
+	resource, _ := ctrl.lookupResource(key)
+	var exhausted bool
+	var quota ResourceQuota
+	ctrl.updateResource(resource, func(r *Resource) {
+		if exhausted = r.QuotaExhausted(time.Now()); exhausted {
+			quota = *r.Quota
+		}
+	})
+	if !exhausted {
+		ctrl.exhausted.Delete(key)
+		return false
+	}
+	if _, sent := ctrl.exhausted.LoadOrStore(key, true); !sent {
+		data, _ := json.Marshal(map[string]interface{}{
+			"_resource": key,
+			"limit":     quota.Limit,
+			"period":    quota.Period,
+		})
+		ctrl.notify(ctx, NewEvent(QuotaExceededEvent, data))
+		logf(ctx, "resource quota exceeded [%s]\n", key)
+	}
+	return true
+}
+
+// atCapacity indicates whether the number of started tasks reached the
+// maximum number of started tasks. Only the tasks started on the resources
+// owned by the instance are counted, so in sharding mode MaxStartedTasks
+// is a limit per instance rather than for the whole shard.
+func (ctrl *ResourceController) atCapacity() bool {
+	if MaxStartedTasks <= 0 {
+		return false
+	}
+	ctrl.rescLock.RLock()
+	defer ctrl.rescLock.RUnlock()
+	return ctrl.startedCount() >= MaxStartedTasks
+}
+
+// startedCount returns the number of owned resources locked by a started
+// task. The caller must hold the resources lock.
+func (ctrl *ResourceController) startedCount() int {
+	count := 0
+	for _, resource := range ctrl.resources {
+		if resource.Status == ResourceLocked && ctrl.ownsResource(resource) {
+			count++
+		}
+	}
+	return count
+}
+
+// ancestors returns the names of the parent resources of the resource,
+// nearest first.
+func (ctrl *ResourceController) ancestors(name string) []string {
+	ctrl.rescLock.RLock()
+	defer ctrl.rescLock.RUnlock()
+	return ancestors(ctrl.resources, name)
+}
+
+// relativeLocked indicates whether an ancestor or a descendant of the
+// resource is locked by a started task.
+func (ctrl *ResourceController) relativeLocked(name string) bool {
+	ctrl.rescLock.RLock()
+	defer ctrl.rescLock.RUnlock()
+	return relativeLocked(ctrl.resources, name)
+}
+
+// isPool returns true if the name is the pool of at least one resource.
+func (ctrl *ResourceController) isPool(name string) bool {
+	ctrl.rescLock.RLock()
+	defer ctrl.rescLock.RUnlock()
+	return isPool(ctrl.resources, name)
+}
+
+// ancestors returns the names of the parent resources of the resource in
+// the resources map, nearest first.
+func ancestors(resources map[string]*Resource, name string) []string {
+	var names []string
+	seen := map[string]bool{name: true}
+	for resource, ok := resources[name]; ok && resource.Parent != ""; resource, ok = resources[resource.Parent] {
+		if seen[resource.Parent] {
+			break
+		}
+		seen[resource.Parent] = true
+		names = append(names, resource.Parent)
+	}
+	return names
+}
+
+// relativeLocked indicates whether an ancestor or a descendant of the
+// resource in the resources map is locked by a started task.
+func relativeLocked(resources map[string]*Resource, name string) bool {
+	for _, ancestor := range ancestors(resources, name) {
+		if resources[ancestor].Status == ResourceLocked {
+			return true
+		}
+	}
+	for other, resource := range resources {
+		if other == name || resource.Status != ResourceLocked {
+			continue
+		}
+		for _, ancestor := range ancestors(resources, other) {
+			if ancestor == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resourcesByWeight returns the resource names ordered by descending
+// weight and then by name.
+func (ctrl *ResourceController) resourcesByWeight() []string {
+	resources := ctrl.resourceViews()
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		wi, wj := resources[names[i]].Weight, resources[names[j]].Weight
+		if wi != wj {
+			return wi > wj
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// isPool returns true if the name is the pool of at least one resource in
+// the resources map.
+func isPool(resources map[string]*Resource, name string) bool {
+	for _, resource := range resources {
+		if resource.Pool == name && name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// stagedSlot returns the stage slot of the key.
+func (ctrl *ResourceController) stagedSlot(key string) (*StagedSlot, bool) {
+	v, ok := ctrl.stage.Load(key)
+	if !ok {
+		return nil, false
+	}
+	return v.(*StagedSlot), true
+}
+
+// pushStagedTask adds the task to the stage slot of its key and returns
+// the number of tasks staged ahead of it. A new slot is created if the key
+// has no slot or its slot was removed concurrently.
+func (ctrl *ResourceController) pushStagedTask(task *Task, stagedAt time.Time) (int, error) {
+	for {
+		v, loaded := ctrl.stage.LoadOrStore(task.Key, NewStagedSlot(stagedAt, task))
+		if !loaded {
+			return 0, nil
+		}
+		slot := v.(*StagedSlot)
+		ahead, err := slot.Push(task, stageLimit())
+		if err != StageRemovedError {
+			return ahead, err
+		}
+		ctrl.stage.CompareAndDelete(task.Key, slot)
+	}
+}
+
+// releaseSlot removes the slot from the stage once its last task is taken.
+func (ctrl *ResourceController) releaseSlot(key string, slot *StagedSlot) {
+	if slot.Removed() {
+		ctrl.stage.CompareAndDelete(key, slot)
+	}
+}
+
+// returnStagedTask puts the task taken from the stage of the key back in
+// front of the stage. A new slot is created if the slot of the key was
+// removed when the task was taken.
+func (ctrl *ResourceController) returnStagedTask(key string, task *Task) {
+	for {
+		v, loaded := ctrl.stage.LoadOrStore(key, NewStagedSlot(time.Now(), task))
+		if !loaded {
+			break
+		}
+		slot := v.(*StagedSlot)
+		if slot.PushFront(task) != StageRemovedError {
+			break
+		}
+		ctrl.stage.CompareAndDelete(key, slot)
+	}
+	ctrl.setStagedTaskId(key, task.Id)
+}
+
+// restageTasks puts the tasks taken from a stage back into the stage of
+// their key. A task that does not fit is logged and left pending.
+func (ctrl *ResourceController) restageTasks(tasks []*Task, stagedAt time.Time) {
+	for _, task := range tasks {
+		if _, err := ctrl.pushStagedTask(task, stagedAt); err != nil {
+			log.Println(err, task.Id)
+		}
+	}
+}
+
+// requeueStagedTask submits the pending task that could not be staged back
+// to its priority queue or timetable.
+func (ctrl *ResourceController) requeueStagedTask(ctx context.Context, task *Task, taskModel Model, reason string) error {
+	status, err := ctrl.submitTask(ctx, task)
+	if err != nil {
+		return err
+	}
+	prev := task.Status
+	task.StagedAt = nil
+	if err := task.ChangeStatus(taskModel, status); err != nil {
+		return err
+	}
+	ctrl.recordTransition(ctx, task, prev, reason)
+	logf(ctx, "returned staged task [%s %s] to queue\n", task.Created, string(task.Meta))
+	return nil
+}
+
+// setStagedTaskId records the id of the task staged first on the resource
+// while the resource is free.
+func (ctrl *ResourceController) setStagedTaskId(key string, taskId string) {
+	ctrl.rescLock.Lock()
+	defer ctrl.rescLock.Unlock()
+	if resource, ok := ctrl.resources[key]; ok && resource.Status == ResourceFree {
+		resource.TaskId = taskId
+	}
+}
+
+// stageLimit returns the number of tasks that may be staged per key.
+func stageLimit() int {
+	if StageLookahead < 1 {
+		return 1
+	}
+	if StageLookahead > StageBuffer {
+		return StageBuffer
+	}
+	return StageLookahead
+}
+
+// stageFull indicates whether the stage of the key holds as many tasks as
+// may be staged.
+func (ctrl *ResourceController) stageFull(key string) bool {
+	slot, ok := ctrl.stagedSlot(key)
+	return ok && slot.Len() >= stageLimit()
+}
+
+// submitTask adds the task to the timetable service when it has a run at
+// time or to the priority queue service otherwise, and returns the status
+// the task is in after submission.
+//
+// If call buffering is enabled and the service is unreachable the call
+// is stored for later replay and the deferred status is returned.
+func (ctrl *ResourceController) submitTask(ctx context.Context, task *Task) (string, error) {
+	if task.RunAt != nil {
+		return ctrl.submitTaskAs(ctx, task, StatusScheduled)
+	}
+	return ctrl.submitTaskAs(ctx, task, StatusQueued)
+}
+
+// submitTaskAs adds the task to the timetable service if status is the
+// scheduled status and the task has a run at time, or to the priority
+// queue service otherwise.
+func (ctrl *ResourceController) submitTaskAs(ctx context.Context, task *Task, status string) (string, error) {
+	var host, method string
+
+	params := map[string]interface{}{"key": task.QueueKey(), "id": task.Id}
+	if status == StatusScheduled && task.RunAt != nil {
+		params["runAt"] = task.RunAt.Format(time.RFC3339)
+		host, method, status = TimetableHost, "insert", StatusScheduled
+	} else {
+		params["priority"] = task.Priority
+		host, method, status = PriorityQueueHost, "push", StatusQueued
+	}
+	result, errObj := CallInt(ctx, ctrl.broker, host, method, params)
+	if errObj != nil {
+		if errObj.Code != BrokerCallErrorCode || ctrl.callBuffer == nil {
+			return "", errors.New(string(errObj.Message))
+		}
+		if _, err := ctrl.callBuffer.Save(NewDeferredCall(task.Id, host, method, params, status)); err != nil {
+			return "", err
+		}
+		status = StatusDeferred
+	} else if result != 0 {
+		return "", TaskAddFailedError
+	}
+	ctrl.wakeStage(task.QueueKey())
+	logf(ctx, "%s task [%s %s]\n", status, task.Created, string(task.Meta))
+	return status, nil
+}
+
+// stageQueuedTask fetches the next task from the priorty queue.
+func (ctrl *ResourceController) stageQueuedTask(ctx context.Context, key string) (*Task, error) {
+	params := map[string]interface{}{"key": key}
+	var task *Task
+	if _, errObj := CallDecode(ctx, ctrl.broker, PriorityQueueHost, "pop", params, &task); errObj != nil {
+		return nil, errors.New(string(errObj.Message))
+	}
+	return task, nil
+}
+
+// stageScheduledTask fetches the next scheduled task from the timetable.
+func (ctrl *ResourceController) stageScheduledTask(ctx context.Context, key string) (*Task, error) {
+	params := map[string]interface{}{"key": key}
+	result, errObj := CallObject(ctx, ctrl.broker, TimetableHost, "next", params)
+	if errObj != nil {
+		return nil, errors.New(string(errObj.Message))
+	}
+	var task *Task
+	if result != nil {
+		delete(result, "runAt")
+		if err := mapstructure.Decode(result, &task); err != nil {
+			return nil, err
+		}
 	}
 	return task, nil
 }
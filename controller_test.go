@@ -2,11 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -92,7 +98,7 @@ func TestServiceBrokerCall(t *testing.T) {
 
 	for _, tt := range table {
 		broker := &JsonRPCServiceBroker{}
-		result, errObj := broker.Call(tt.Url, tt.Method, tt.Params)
+		result, errObj := broker.Call(context.Background(), tt.Url, tt.Method, tt.Params)
 		if errObj != nil {
 			if tt.ErrCode == nil {
 				t.Fatal(errObj)
@@ -110,6 +116,333 @@ func TestServiceBrokerCall(t *testing.T) {
 	}
 }
 
+func TestServiceBrokerCallRetry(t *testing.T) {
+	defer func(n int, d time.Duration) { BrokerRetries, BrokerBackoff = n, d }(BrokerRetries, BrokerBackoff)
+	BrokerRetries, BrokerBackoff = 2, time.Millisecond
+
+	var table = []struct {
+		Method   string
+		Failures int
+		Status   int
+		Calls    int
+		Result   interface{}
+		Code     jrpc2.ErrorCode
+		Data     string
+	}{
+		{"push", 0, http.StatusOK, 1, float64(0), 0, ""},
+		{"get", 2, http.StatusServiceUnavailable, 3, float64(0), 0, ""},
+		{"get", 3, http.StatusBadGateway, 3, nil, BrokerCallErrorCode, "status 502 (attempts 3)"},
+		{"get", 1, http.StatusUnauthorized, 1, nil, BrokerRejectedErrorCode, "status 401"},
+		{"push", 1, http.StatusServiceUnavailable, 1, nil, BrokerCallErrorCode, "status 503 (attempts 1)"},
+		{"pop", 1, http.StatusBadGateway, 1, nil, BrokerCallErrorCode, "status 502 (attempts 1)"},
+	}
+
+	for i, tt := range table {
+		calls := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls <= tt.Failures {
+				w.WriteHeader(tt.Status)
+				return
+			}
+			w.Write([]byte(`{"jsonrpc": "2.0", "result": 0, "id": 0}`))
+		}))
+		broker := &JsonRPCServiceBroker{}
+		result, errObj := broker.Call(context.Background(), strings.TrimPrefix(srv.URL, "http://"), tt.Method, map[string]interface{}{"key": "test"})
+		srv.Close()
+		if calls != tt.Calls {
+			t.Fatalf("[%d] expected %d calls, got %d", i, tt.Calls, calls)
+		}
+		if result != tt.Result {
+			t.Fatalf("[%d] expected result %v, got %v", i, tt.Result, result)
+		}
+		if tt.Data != "" && (errObj == nil || errObj.Code != tt.Code || errObj.Data != tt.Data) {
+			t.Fatalf("[%d] expected error data '%s', got %v", i, tt.Data, errObj)
+		}
+	}
+}
+
+func TestServiceBrokerCallRetryUnsent(t *testing.T) {
+	defer func(n int, d time.Duration) { BrokerRetries, BrokerBackoff = n, d }(BrokerRetries, BrokerBackoff)
+	BrokerRetries, BrokerBackoff = 2, time.Millisecond
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := strings.TrimPrefix(srv.URL, "http://")
+	srv.Close()
+	broker := &JsonRPCServiceBroker{}
+	_, errObj := broker.Call(context.Background(), url, "push", map[string]interface{}{"key": "test"})
+	if errObj == nil || errObj.Code != BrokerCallErrorCode || !strings.HasSuffix(fmt.Sprint(errObj.Data), "(attempts 3)") {
+		t.Fatalf("expected the refused push to be retried, got %v", errObj)
+	}
+}
+
+func TestServiceBrokerCallTimeout(t *testing.T) {
+	defer func(n int, d time.Duration) { BrokerRetries, BrokerTimeout = n, d }(BrokerRetries, BrokerTimeout)
+	BrokerRetries, BrokerTimeout = 0, time.Millisecond*20
+
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+	url := strings.TrimPrefix(srv.URL, "http://")
+	broker := &JsonRPCServiceBroker{}
+
+	start := time.Now()
+	if _, errObj := broker.Call(context.Background(), url, "notify", map[string]interface{}{}); errObj == nil || errObj.Code != BrokerCallErrorCode {
+		t.Fatalf("expected the hung call to time out, got %v", errObj)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the call to time out after %s, took %s", BrokerTimeout, elapsed)
+	}
+
+	BrokerRetries, BrokerTimeout = 3, time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*20, cancel)
+	_, errObj := broker.Call(ctx, url, "notify", map[string]interface{}{})
+	if errObj == nil || !strings.HasSuffix(fmt.Sprint(errObj.Data), "(attempts 1)") {
+		t.Fatalf("expected the cancelled call not to be retried, got %v", errObj)
+	}
+}
+
+func TestJsonRPCRequest(t *testing.T) {
+	params := map[string]interface{}{"key": `test", "id": "injected`, "meta": map[string]interface{}{"quote": `"}]`}}
+	req, errObj := jsonRPCRequest(context.Background(), "queue:8080", `push"`, params)
+	if errObj != nil {
+		t.Fatal(errObj)
+	}
+	var decoded struct {
+		Jsonrpc string                 `json:"jsonrpc"`
+		Method  string                 `json:"method"`
+		Params  map[string]interface{} `json:"params"`
+		Id      uint64                 `json:"id"`
+	}
+	if err := json.Unmarshal(req, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Jsonrpc != "2.0" || decoded.Method != `push"` || fmt.Sprint(decoded.Params) != fmt.Sprint(params) || decoded.Id == 0 {
+		t.Fatalf("expected the request to round trip, got %s", req)
+	}
+	if _, errObj := jsonRPCRequest(context.Background(), "queue:8080", "push", map[string]interface{}{"key": make(chan int)}); errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+		t.Fatalf("expected the parameters not to be encoded, got %v", errObj)
+	}
+}
+
+func TestJsonRPCResponse(t *testing.T) {
+	var table = []struct {
+		Body   string
+		Result interface{}
+		Code   jrpc2.ErrorCode
+	}{
+		{`{"jsonrpc": "2.0", "result": 1, "id": 1}`, float64(1), 0},
+		{`{"jsonrpc": "2.0", "error": {"code": -32601, "message": "Method not found"}, "id": 1}`, nil, jrpc2.MethodNotFoundCode},
+		{`{"jsonrpc": "2.0", "id": 1}`, nil, 0},
+		{`{"result": 1, "id": 1}`, nil, BrokerResponseErrorCode},
+		{`[1, 2]`, nil, BrokerResponseErrorCode},
+		{`<html>bad gateway</html>`, nil, BrokerResponseErrorCode},
+	}
+
+	for i, tt := range table {
+		result, errObj := jsonRPCResponse(context.Background(), "queue:8080", "push", []byte(tt.Body))
+		if result != tt.Result {
+			t.Fatalf("[%d] expected result %v, got %v", i, tt.Result, result)
+		}
+		if (errObj == nil && tt.Code != 0) || (errObj != nil && errObj.Code != tt.Code) {
+			t.Fatalf("[%d] expected error code %d, got %v", i, tt.Code, errObj)
+		}
+	}
+}
+
+func TestCallTypedResults(t *testing.T) {
+	var table = []struct {
+		Result interface{}
+		Int    int
+		IntErr bool
+		Object map[string]interface{}
+		ObjErr bool
+	}{
+		{float64(1), 1, false, nil, true},
+		{float64(1.5), 0, true, nil, true},
+		{"0", 0, true, nil, true},
+		{nil, 0, true, nil, false},
+		{map[string]interface{}{"_key": "abc123"}, 0, true, map[string]interface{}{"_key": "abc123"}, false},
+		{[]interface{}{}, 0, true, nil, true},
+	}
+
+	for i, tt := range table {
+		broker := new(MockServiceBroker)
+		broker.On("Call", mock.Anything, PriorityQueueHost, "pop", mock.Anything).Return(tt.Result, nil)
+		n, errObj := CallInt(context.Background(), broker, PriorityQueueHost, "pop", nil)
+		if n != tt.Int || (errObj != nil) != tt.IntErr {
+			t.Fatalf("[%d] expected the integer %d, got %d %v", i, tt.Int, n, errObj)
+		}
+		if errObj != nil && errObj.Code != BrokerResponseErrorCode {
+			t.Fatalf("[%d] expected an invalid response error, got %v", i, errObj)
+		}
+		object, errObj := CallObject(context.Background(), broker, PriorityQueueHost, "pop", nil)
+		if fmt.Sprint(object) != fmt.Sprint(tt.Object) || (errObj != nil) != tt.ObjErr {
+			t.Fatalf("[%d] expected the object %v, got %v %v", i, tt.Object, object, errObj)
+		}
+		var task *Task
+		ok, errObj := CallDecode(context.Background(), broker, PriorityQueueHost, "pop", nil, &task)
+		if ok != (tt.Object != nil) || (errObj != nil) != tt.ObjErr || (ok && task.Id != "abc123") {
+			t.Fatalf("[%d] expected the decoded task, got %v %v %v", i, ok, task, errObj)
+		}
+	}
+
+	broker := new(MockServiceBroker)
+	broker.On("Call", mock.Anything, PriorityQueueHost, "pop", mock.Anything).Return("unexpected", nil)
+	ctrl := NewResourceController(broker)
+	if _, err := ctrl.stageQueuedTask(context.Background(), "test"); err == nil {
+		t.Fatal("expected the invalid pop result to fail staging")
+	}
+}
+
+func TestServiceBrokerBatchCall(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		var reqs []struct {
+			Method string `json:"method"`
+			Id     int    `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+			w.Write([]byte(`{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}`))
+			return
+		}
+		for i := range reqs {
+			if reqs[i].Id == 0 || (i > 0 && reqs[i].Id == reqs[i-1].Id) {
+				t.Errorf("expected unique non-zero request ids, got %v", reqs)
+			}
+		}
+		var resps []string
+		for i := len(reqs) - 1; i >= 0; i-- {
+			switch reqs[i].Method {
+			case "push":
+				resps = append(resps, fmt.Sprintf(`{"jsonrpc": "2.0", "result": %d, "id": %d}`, i, reqs[i].Id))
+			case "pop":
+				resps = append(resps, fmt.Sprintf(`{"jsonrpc": "2.0", "error": {"code": -32601, "message": "Method not found"}, "id": %d}`, reqs[i].Id))
+			}
+		}
+		w.Write([]byte("[" + strings.Join(resps, ",") + "]"))
+	}))
+	defer srv.Close()
+	url := strings.TrimPrefix(srv.URL, "http://")
+
+	broker := NewJsonRPCServiceBroker()
+	results, errObj := broker.BatchCall(context.Background(), url, []BrokerCall{
+		{"push", map[string]interface{}{"key": "test"}},
+		{"pop", map[string]interface{}{"key": "test"}},
+		{"push", map[string]interface{}{"key": "test"}},
+		{"notify", map[string]interface{}{}},
+	})
+	if errObj != nil {
+		t.Fatal(errObj)
+	}
+	if requests != 1 || len(results) != 4 {
+		t.Fatalf("expected 4 results from 1 request, got %d from %d", len(results), requests)
+	}
+	if results[0].Result != float64(0) || results[2].Result != float64(2) {
+		t.Fatalf("expected the results in call order, got %v %v", results[0].Result, results[2].Result)
+	}
+	if results[1].Error == nil || results[1].Error.Code != jrpc2.MethodNotFoundCode {
+		t.Fatalf("expected the method error of the call, got %v", results[1].Error)
+	}
+	if results[3].Error == nil || results[3].Error.Code != jrpc2.InternalErrorCode {
+		t.Fatalf("expected the call without a response to fail, got %v", results[3].Error)
+	}
+	if results, _ := broker.BatchCall(context.Background(), url, nil); results != nil || requests != 1 {
+		t.Fatal("expected an empty batch not to be sent")
+	}
+
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}`))
+	})
+	if _, errObj := broker.BatchCall(context.Background(), url, []BrokerCall{{"push", nil}}); errObj == nil || errObj.Code != jrpc2.InvalidRequestCode {
+		t.Fatalf("expected the batch error of the service, got %v", errObj)
+	}
+}
+
+// newBenchmarkService starts a json-rpc server that answers the priority
+// queue, timetable and notifier calls of a stage poll.
+func newBenchmarkService() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string `json:"method"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		result := `0`
+		switch req.Method {
+		case "pop":
+			result = `{"_key": "abc123", "key": "test"}`
+		case "next":
+			result = `null`
+		}
+		w.Write([]byte(`{"jsonrpc": "2.0", "result": ` + result + `, "id": 0}`))
+	}))
+}
+
+// benchmarkBrokers returns the pooled broker and a broker that opens a new
+// connection for each call.
+func benchmarkBrokers() map[string]*JsonRPCServiceBroker {
+	return map[string]*JsonRPCServiceBroker{
+		"pooled":   NewJsonRPCServiceBroker(),
+		"unpooled": {client: &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}},
+	}
+}
+
+func BenchmarkServiceBrokerCall(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	srv := newBenchmarkService()
+	defer srv.Close()
+	url := strings.TrimPrefix(srv.URL, "http://")
+	for name, broker := range benchmarkBrokers() {
+		b.Run(name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, errObj := broker.Call(context.Background(), url, "notify", map[string]interface{}{}); errObj != nil {
+						b.Fatal(errObj)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkStageNextTask(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	srv := newBenchmarkService()
+	defer srv.Close()
+	defer func(queue, timetable, notifier string) {
+		PriorityQueueHost, TimetableHost, StatusChangeNotifierHost = queue, timetable, notifier
+	}(PriorityQueueHost, TimetableHost, StatusChangeNotifierHost)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	PriorityQueueHost, TimetableHost, StatusChangeNotifierHost = host, host, host
+
+	task := &Task{Id: "abc123", Key: "test"}
+	taskModel := new(MockModel)
+	taskModel.On("Query", mock.Anything, mock.Anything).Return([]interface{}{task}, nil)
+	taskModel.On("Save", task).Return(DocumentMeta{}, nil)
+	for name, broker := range benchmarkBrokers() {
+		b.Run(name, func(b *testing.B) {
+			ctrl := NewResourceController(broker)
+			ctrl.storeResource(&Resource{Name: "test", Status: ResourceFree})
+			for i := 0; i < b.N; i++ {
+				task.Status = StatusQueued
+				if err := ctrl.stageNextTask(context.Background(), "test", taskModel); err != nil {
+					b.Fatal(err)
+				}
+				slot, _ := ctrl.stagedSlot("test")
+				slot.Take(func(*Task) error { return nil })
+				ctrl.releaseSlot("test", slot)
+			}
+		})
+	}
+}
+
 func TestControllerAddTask(t *testing.T) {
 	var table = []struct {
 		Task         *Task
@@ -141,7 +474,7 @@ func TestControllerAddTask(t *testing.T) {
 		{
 			NewTask([]byte(fmt.Sprintf(`{"key": "test123", runAt": %s}`, time.Now().Format(time.RFC3339)))),
 			-1,
-			StatusCreated,
+			StatusCancelled,
 			nil,
 			nil,
 			nil,
@@ -150,7 +483,7 @@ func TestControllerAddTask(t *testing.T) {
 		{
 			NewTask([]byte(`{"key": "test123", priority": 12.3}`)),
 			-1,
-			StatusCreated,
+			StatusCancelled,
 			&jrpc2.ErrorObject{Message: "broker error"},
 			nil,
 			nil,
@@ -180,6 +513,7 @@ func TestControllerAddTask(t *testing.T) {
 		broker := new(MockServiceBroker)
 		broker.On(
 			"Call",
+			mock.Anything,
 			StatusChangeNotifierHost,
 			"notify",
 			mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
@@ -187,15 +521,17 @@ func TestControllerAddTask(t *testing.T) {
 		params := map[string]interface{}{"key": tt.Task.Key, "id": tt.Task.Id}
 		if tt.Task.RunAt != nil {
 			params["runAt"] = tt.Task.RunAt.Format(time.RFC3339)
-			broker.On("Call", TimetableHost, "insert", params).Return(tt.Result, tt.BrokerErr).Maybe()
+			broker.On("Call", mock.Anything, TimetableHost, "insert", params).Return(tt.Result, tt.BrokerErr).Maybe()
 		} else {
 			params["priority"] = tt.Task.Priority
-			broker.On("Call", PriorityQueueHost, "push", params).Return(tt.Result, tt.BrokerErr).Maybe()
+			broker.On("Call", mock.Anything, PriorityQueueHost, "push", params).Return(tt.Result, tt.BrokerErr).Maybe()
 		}
 		taskModel := new(MockModel)
 		rescModel := new(MockModel)
 		taskModel.On("Save", tt.Task).Return(DocumentMeta{}, tt.taskModelErr).Maybe()
+		taskModel.On("Remove", tt.Task).Return(nil).Maybe()
 		rescModel.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, tt.RescModelErr).Maybe()
+		rescModel.On("Query", mock.Anything, mock.Anything).Return(nil, nil).Maybe()
 		ctrl := NewResourceController(broker)
 		if err := ctrl.AddTask(tt.Task, taskModel, rescModel); err != nil && err.Error() != tt.Err.Error() {
 			t.Fatal(err)
@@ -209,769 +545,4944 @@ func TestControllerAddTask(t *testing.T) {
 	}
 }
 
-func TestControllerAddResource(t *testing.T) {
+func TestControllerEnsureResource(t *testing.T) {
 	var table = []struct {
-		Name     string
-		ModelErr error
+		Key    string
+		Stored []interface{}
+		Saved  bool
 	}{
-		{"test", nil},
-		{"test", errors.New("model error")},
+		{"pool1", nil, false},
+		{"member1", nil, true},
+		{"test", []interface{}{&Resource{Name: "other1", Pool: "test"}}, false},
+		{"test", []interface{}{&Resource{Name: "test"}}, false},
+		{"test", nil, true},
 	}
 
-	for _, tt := range table {
-		model := &MockModel{}
-		model.On("Save", NewResource(tt.Name)).Return(DocumentMeta{}, tt.ModelErr)
+	for i, tt := range table {
+		rescModel := new(MockModel)
+		rescModel.On("Query", mock.Anything, map[string]interface{}{"key": tt.Key}).Return(tt.Stored, nil).Maybe()
+		rescModel.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, nil).Maybe()
 		ctrl := NewResourceController(nil)
-		if err := ctrl.AddResource(tt.Name, model); err != nil && err.Error() != tt.ModelErr.Error() {
-			t.Fatal(err)
+		ctrl.storeResource(&Resource{Name: "member1", Pool: "pool1", Status: ResourceFree})
+		if err := ctrl.ensureResource(tt.Key, rescModel); err != nil {
+			t.Fatalf("[%d] %v", i, err)
 		}
-		if err := ctrl.AddResource(tt.Name, model); err != ResourceExistsError {
-			t.Fatal("expected resource exists error")
+		saved := false
+		for _, call := range rescModel.Calls {
+			if call.Method == "Save" && call.Arguments.Get(0).(*Resource).Name == tt.Key {
+				saved = true
+			}
 		}
-		if _, ok := ctrl.resources[tt.Name]; !ok {
-			t.Fatalf("expected resource with '%s' to have been added", tt.Name)
+		if saved != tt.Saved {
+			t.Fatalf("[%d] expected resource %s saved %v, got %v", i, tt.Key, tt.Saved, saved)
 		}
 	}
-
 }
 
-func TestControllerNotify(t *testing.T) {
+func TestControllerAddTaskRollback(t *testing.T) {
+	runAt := time.Now().Add(time.Hour)
 	var table = []struct {
-		Evt       *Event
-		Url       string
-		Result    float64
-		BrokerErr *jrpc2.ErrorObject
-		Err       error
+		Task   *Task
+		Host   string
+		Method string
 	}{
-		{
-			NewEvent("taskStatusChanged", []byte(`{"status": 1}`)),
-			StatusChangeNotifierHost,
-			0,
-			nil,
-			nil,
-		},
-		{
-			NewEvent("taskStatusChanged", []byte(`{"status": 1}`)),
-			StatusChangeNotifierHost,
-			-1,
-			nil,
-			NotificationFailedError,
-		},
-		{
-			NewEvent("taskStatusChanged", []byte(`{"status": 1}`)),
-			StatusChangeNotifierHost,
-			-1,
-			&jrpc2.ErrorObject{Message: "an error occured"},
-			errors.New("an error occured"),
-		},
+		{&Task{Id: "abc123", Key: "test", Priority: 1}, PriorityQueueHost, "push"},
+		{&Task{Id: "abc123", Key: "test", RunAt: &runAt}, TimetableHost, "insert"},
 	}
 
-	for _, tt := range table {
-		params := map[string]interface{}{"created": tt.Evt.Created, "kind": tt.Evt.Kind, "meta": tt.Evt.Meta}
+	for i, tt := range table {
+		saveErr := errors.New("model error")
 		broker := new(MockServiceBroker)
-		broker.On("Call", tt.Url, "notify", params).Return(tt.Result, tt.BrokerErr).Once()
+		broker.On("Call", mock.Anything, tt.Host, tt.Method, mock.Anything).Return(float64(0), nil).Once()
+		broker.On("Call", mock.Anything, tt.Host, "remove", map[string]interface{}{"key": "test", "id": "abc123"}).Return(float64(0), nil).Once()
+		taskModel := new(MockModel)
+		taskModel.On("Save", tt.Task).Return(DocumentMeta{}, nil).Once()
+		taskModel.On("Save", tt.Task).Return(DocumentMeta{}, saveErr).Once()
+		taskModel.On("Remove", tt.Task).Return(nil).Once()
+		history := new(MockModel)
+		history.On("Save", mock.AnythingOfType("*main.TaskHistory")).Return(DocumentMeta{}, nil)
 		ctrl := NewResourceController(broker)
-		if err := ctrl.Notify(tt.Evt); err != nil && err.Error() != tt.Err.Error() {
-			t.Fatal(err)
+		ctrl.RecordHistory(history)
+		if err := ctrl.AddTask(tt.Task, taskModel, new(MockModel)); err != saveErr {
+			t.Fatalf("[%d] expected error %v, got %v", i, saveErr, err)
+		}
+		if tt.Task.Status != StatusCancelled {
+			t.Fatalf("[%d] expected task status %s, got %s", i, StatusCancelled, tt.Task.Status)
+		}
+		last := history.Calls[len(history.Calls)-1].Arguments.Get(0).(*TaskHistory)
+		if last.To != StatusCancelled || last.Reason != "task add failed" {
+			t.Fatalf("[%d] unexpected history entry %+v", i, last)
 		}
 		broker.AssertExpectations(t)
+		taskModel.AssertExpectations(t)
 	}
 }
 
-func TestControllerGetTask(t *testing.T) {
-	task := NewTask([]byte(`{"key": "test123", priority": 12.3}`))
+func TestControllerAddTaskDeferred(t *testing.T) {
 	var table = []struct {
-		TaskId   string
-		Tasks    []interface{}
-		ModelErr error
-		Err      error
+		Buffer    bool
+		BrokerErr *jrpc2.ErrorObject
+		BufferErr error
+		Status    string
+		Err       error
 	}{
 		{
-			task.Id,
-			[]interface{}{task},
+			true,
+			&jrpc2.ErrorObject{Code: BrokerCallErrorCode, Message: jrpc2.ServerErrorMsg},
 			nil,
+			StatusDeferred,
 			nil,
 		},
 		{
-			"abc123",
+			true,
+			&jrpc2.ErrorObject{Code: BrokerCallErrorCode, Message: jrpc2.ServerErrorMsg},
+			errors.New("model error"),
+			StatusCancelled,
+			errors.New("model error"),
+		},
+		{
+			false,
+			&jrpc2.ErrorObject{Code: BrokerCallErrorCode, Message: jrpc2.ServerErrorMsg},
 			nil,
-			errors.New("query error"),
-			errors.New("query error"),
+			StatusCancelled,
+			errors.New(string(jrpc2.ServerErrorMsg)),
 		},
 		{
-			"abc123",
-			make([]interface{}, 0),
+			true,
+			&jrpc2.ErrorObject{Message: "broker error"},
 			nil,
-			TaskNotFoundError,
+			StatusCancelled,
+			errors.New("broker error"),
 		},
 	}
 
-	for _, tt := range table {
-		q := fmt.Sprintf(`FOR t IN %s FILTER t._key == @key RETURN t`, CollectionTasks)
-		ctrl := NewResourceController(nil)
-		model := new(MockModel)
-		model.On("Query", q, map[string]interface{}{"key": tt.TaskId}).Return(tt.Tasks, tt.ModelErr).Once()
-		task, err := ctrl.GetTask(tt.TaskId, model)
-		if err != nil && err.Error() != tt.Err.Error() {
+	for i, tt := range table {
+		task := NewTask([]byte(`{"key": "test123", "priority": 12.3}`))
+		broker := new(MockServiceBroker)
+		broker.On(
+			"Call",
+			mock.Anything,
+			StatusChangeNotifierHost,
+			"notify",
+			mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
+		).Return(float64(0), nil).Maybe()
+		params := map[string]interface{}{"key": task.Key, "id": task.Id, "priority": task.Priority}
+		broker.On("Call", mock.Anything, PriorityQueueHost, "push", params).Return(nil, tt.BrokerErr).Once()
+		taskModel := new(MockModel)
+		taskModel.On("Save", task).Return(DocumentMeta{}, nil)
+		taskModel.On("Remove", task).Return(nil).Maybe()
+		rescModel := new(MockModel)
+		rescModel.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, nil).Maybe()
+		rescModel.On("Query", mock.Anything, mock.Anything).Return(nil, nil).Maybe()
+		callModel := new(MockModel)
+		callModel.On("Save", mock.AnythingOfType("*main.DeferredCall")).Return(DocumentMeta{}, tt.BufferErr).Maybe()
+		ctrl := NewResourceController(broker)
+		if tt.Buffer {
+			ctrl.BufferCalls(callModel)
+		}
+		if err := ctrl.AddTask(task, taskModel, rescModel); err != nil && err.Error() != tt.Err.Error() {
 			t.Fatal(err)
 		}
-		if task != nil && task.Id != tt.TaskId {
-			t.Fatalf("expected task key to be %s, got %s", task.Id, tt.TaskId)
+		if task.Status != tt.Status {
+			t.Fatalf("[%d] expected task status to be %s, got %s", i, tt.Status, task.Status)
 		}
-		model.AssertExpectations(t)
+		broker.AssertExpectations(t)
+		callModel.AssertExpectations(t)
 	}
 }
 
-func TestControllerListTimetable(t *testing.T) {
+func TestControllerReplayDeferredCalls(t *testing.T) {
 	var table = []struct {
-		Key       string
-		Result    map[string]interface{}
+		Result    interface{}
 		BrokerErr *jrpc2.ErrorObject
+		Removed   bool
+		Status    string
 		Err       error
 	}{
 		{
-			"test",
-			map[string]interface{}{"_key": "test"},
+			float64(0),
 			nil,
+			true,
+			StatusQueued,
 			nil,
 		},
 		{
-			"test",
+			float64(-1),
+			nil,
+			true,
+			StatusError,
+			nil,
+		},
+		{
+			nil,
+			&jrpc2.ErrorObject{Message: "broker error"},
+			true,
+			StatusError,
 			nil,
-			&jrpc2.ErrorObject{Code: -32002, Message: "Timetable not found"},
-			TimetableNotFound,
+		},
+		{
+			nil,
+			&jrpc2.ErrorObject{Code: BrokerCallErrorCode, Message: jrpc2.ServerErrorMsg},
+			false,
+			StatusDeferred,
+			errors.New(string(jrpc2.ServerErrorMsg)),
 		},
 	}
 
-	for _, tt := range table {
-		params := map[string]interface{}{"key": tt.Key}
+	for i, tt := range table {
+		task := &Task{Id: "abc123", Key: "test", Status: StatusDeferred}
+		params := map[string]interface{}{"key": task.Key, "id": task.Id, "priority": 2.5}
+		call := NewDeferredCall(task.Id, PriorityQueueHost, "push", params, StatusQueued)
 		broker := new(MockServiceBroker)
-		broker.On("Call", TimetableHost, "get", params).Return(tt.Result, tt.BrokerErr)
+		broker.On(
+			"Call",
+			mock.Anything,
+			StatusChangeNotifierHost,
+			"notify",
+			mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
+		).Return(float64(0), nil).Maybe()
+		broker.On("Call", mock.Anything, PriorityQueueHost, "push", params).Return(tt.Result, tt.BrokerErr).Once()
+		callModel := new(MockModel)
+		callModel.On("FetchAll").Return([]interface{}{call}, nil)
+		callModel.On("Remove", call).Return(nil).Maybe()
+		taskModel := new(MockModel)
+		taskModel.On("Get", task.Id).Return(task, nil).Maybe()
+		taskModel.On("Save", task).Return(DocumentMeta{}, nil).Maybe()
 		ctrl := NewResourceController(broker)
-		list, err := ctrl.ListTimetable(tt.Key)
-		if err != nil && err.Error() != tt.Err.Error() {
+		ctrl.BufferCalls(callModel)
+		if err := ctrl.ReplayDeferredCalls(taskModel); err != nil && err.Error() != tt.Err.Error() {
 			t.Fatal(err)
 		}
-		if list != nil && list["_key"] != tt.Result["_key"] {
-			t.Fatalf("expected list to be %s, got %s", tt.Result["_key"], list["_key"])
+		if task.Status != tt.Status {
+			t.Fatalf("[%d] expected task status to be %s, got %s", i, tt.Status, task.Status)
+		}
+		if tt.Removed {
+			callModel.AssertCalled(t, "Remove", call)
+		} else {
+			callModel.AssertNotCalled(t, "Remove", call)
 		}
 		broker.AssertExpectations(t)
 	}
 }
 
-func TestControllerListPriorityQueue(t *testing.T) {
+func TestControllerReplayDeferredCallbacks(t *testing.T) {
+	defer func(hosts []string) { CallbackHosts = hosts }(CallbackHosts)
+	CallbackHosts = []string{"127.0.0.1"}
 	var table = []struct {
-		Key       string
-		Result    map[string]interface{}
-		BrokerErr *jrpc2.ErrorObject
-		Err       error
+		Status   int
+		Attempts int
+		Removed  bool
+		Saved    int
 	}{
-		{
-			"test",
-			map[string]interface{}{"_key": "test"},
-			nil,
-			nil,
-		},
-		{
-			"test",
-			nil,
-			&jrpc2.ErrorObject{Code: 32002, Message: "Queue not found"},
-			QueueNotFoundError,
-		},
+		{http.StatusNoContent, 1, true, 0},
+		{http.StatusInternalServerError, 1, false, 2},
+		{http.StatusInternalServerError, CallbackAttempts - 1, true, 0},
 	}
 
-	for _, tt := range table {
-		params := map[string]interface{}{"key": tt.Key}
-		broker := new(MockServiceBroker)
-		broker.On("Call", PriorityQueueHost, "get", params).Return(tt.Result, tt.BrokerErr)
-		ctrl := NewResourceController(broker)
-		list, err := ctrl.ListPriorityQueue(tt.Key)
-		if err != nil && err.Error() != tt.Err.Error() {
+	for i, tt := range table {
+		var body []byte
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(tt.Status)
+		}))
+		call := NewDeferredCall("abc123", srv.URL, CallbackMethod, map[string]interface{}{"body": `{"_key":"abc123"}`}, "")
+		call.Attempts = tt.Attempts
+		callModel := new(MockModel)
+		callModel.On("FetchAll").Return([]interface{}{call}, nil)
+		callModel.On("Remove", call).Return(nil).Maybe()
+		callModel.On("Save", call).Return(DocumentMeta{}, nil).Maybe()
+		ctrl := NewResourceController(new(MockServiceBroker))
+		ctrl.BufferCalls(callModel)
+		err := ctrl.ReplayDeferredCalls(new(MockModel))
+		srv.Close()
+		if err != nil {
+			t.Fatalf("[%d] %s", i, err)
+		}
+		if string(body) != `{"_key":"abc123"}` {
+			t.Fatalf("[%d] unexpected body %s", i, body)
+		}
+		if tt.Removed {
+			callModel.AssertCalled(t, "Remove", call)
+			callModel.AssertNotCalled(t, "Save", call)
+		} else {
+			callModel.AssertNotCalled(t, "Remove", call)
+			if call.Attempts != tt.Saved {
+				t.Fatalf("[%d] expected %d attempts, got %d", i, tt.Saved, call.Attempts)
+			}
+		}
+	}
+}
+
+func TestControllerDeliverTaskCallbackDeferred(t *testing.T) {
+	defer func(hosts []string) { CallbackHosts = hosts }(CallbackHosts)
+	CallbackHosts = []string{"127.0.0.1"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	var saved *DeferredCall
+	callModel := new(MockModel)
+	callModel.On("Save", mock.Anything).Run(func(args mock.Arguments) {
+		saved = args.Get(0).(*DeferredCall)
+	}).Return(DocumentMeta{}, nil).Once()
+	ctrl := NewResourceController(new(MockServiceBroker))
+	ctrl.BufferCalls(callModel)
+	if err := ctrl.deliverTaskCallback(context.Background(), "abc123", srv.URL, []byte(`{"_key":"abc123"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if saved == nil || saved.Method != CallbackMethod || saved.Host != srv.URL || saved.TaskId != "abc123" || saved.Attempts != 1 {
+		t.Fatalf("unexpected deferred callback %+v", saved)
+	}
+	if saved.Params["body"] != `{"_key":"abc123"}` {
+		t.Fatalf("unexpected deferred callback body %v", saved.Params["body"])
+	}
+}
+
+// batchRecordingBroker is a batch broker that records the size of each
+// batch and serves the calls with the wrapped mock broker.
+type batchRecordingBroker struct {
+	*MockServiceBroker
+	batches []int
+}
+
+func (b *batchRecordingBroker) BatchCall(ctx context.Context, host string, calls []BrokerCall) ([]BrokerResult, *jrpc2.ErrorObject) {
+	b.batches = append(b.batches, len(calls))
+	return batchCall(ctx, b.MockServiceBroker, host, calls)
+}
+
+func TestControllerReplayDeferredCallsBatch(t *testing.T) {
+	defer func(queue, timetable string) { PriorityQueueHost, TimetableHost = queue, timetable }(PriorityQueueHost, TimetableHost)
+	PriorityQueueHost, TimetableHost = "queue:8080", "timetable:8080"
+	var docs []interface{}
+	taskModel := new(MockModel)
+	mockBroker := new(MockServiceBroker)
+	mockBroker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+	tasks := make([]*Task, 4)
+	for i, host := range []string{PriorityQueueHost, PriorityQueueHost, TimetableHost, PriorityQueueHost} {
+		tasks[i] = &Task{Id: fmt.Sprintf("task%d", i), Key: "test", Status: StatusDeferred}
+		params := map[string]interface{}{"key": "test", "id": tasks[i].Id}
+		docs = append(docs, NewDeferredCall(tasks[i].Id, host, fmt.Sprintf("method%d", i), params, StatusQueued))
+		taskModel.On("Get", tasks[i].Id).Return(tasks[i], nil).Maybe()
+		taskModel.On("Save", tasks[i]).Return(DocumentMeta{}, nil).Maybe()
+	}
+	mockBroker.On("Call", mock.Anything, PriorityQueueHost, "method0", mock.Anything).Return(float64(0), nil).Once()
+	mockBroker.On("Call", mock.Anything, PriorityQueueHost, "method1", mock.Anything).Return(float64(0), nil).Once()
+	mockBroker.On("Call", mock.Anything, TimetableHost, "method2", mock.Anything).Return(nil, &jrpc2.ErrorObject{Code: BrokerCallErrorCode, Message: jrpc2.ServerErrorMsg}).Once()
+	callModel := new(MockModel)
+	callModel.On("FetchAll").Return(docs, nil)
+	callModel.On("Remove", mock.Anything).Return(nil)
+	broker := &batchRecordingBroker{MockServiceBroker: mockBroker}
+	ctrl := NewResourceController(broker)
+	ctrl.BufferCalls(callModel)
+
+	if err := ctrl.ReplayDeferredCalls(taskModel); err == nil {
+		t.Fatal("expected the unreachable timetable to stop the replay")
+	}
+	if fmt.Sprint(broker.batches) != "[2 1]" {
+		t.Fatalf("expected batches [2 1], got %v", broker.batches)
+	}
+	for i, status := range []string{StatusQueued, StatusQueued, StatusDeferred, StatusDeferred} {
+		if tasks[i].Status != status {
+			t.Fatalf("[%d] expected task status to be %s, got %s", i, status, tasks[i].Status)
+		}
+	}
+	callModel.AssertNumberOfCalls(t, "Remove", 2)
+	mockBroker.AssertExpectations(t)
+}
+
+func TestControllerAddResource(t *testing.T) {
+	var table = []struct {
+		Name     string
+		ModelErr error
+	}{
+		{"test", nil},
+		{"test", errors.New("model error")},
+	}
+
+	for _, tt := range table {
+		model := &MockModel{}
+		model.On("Save", NewResource(tt.Name)).Return(DocumentMeta{}, tt.ModelErr)
+		ctrl := NewResourceController(nil)
+		if err := ctrl.AddResource(tt.Name, "", nil, 0, model); err != nil && err.Error() != tt.ModelErr.Error() {
 			t.Fatal(err)
 		}
-		if list != nil && list["_key"] != tt.Result["_key"] {
-			t.Fatalf("expected list to be %s, got %s", tt.Result["_key"], list["_key"])
+		if err := ctrl.AddResource(tt.Name, "", nil, 0, model); err != ResourceExistsError {
+			t.Fatal("expected resource exists error")
+		}
+		if _, ok := ctrl.resources[tt.Name]; !ok {
+			t.Fatalf("expected resource with '%s' to have been added", tt.Name)
 		}
-		broker.AssertExpectations(t)
 	}
+
 }
 
-func TestControllerStartTask(t *testing.T) {
-	modelErr := errors.New("model error")
+func TestControllerNotify(t *testing.T) {
 	var table = []struct {
-		Key            string
-		Task           *Task
-		Resource       *Resource
-		Err            error
-		Model          bool
-		ModelErr       error
-		ResourceErr    error
-		TaskStatus     string
-		ResourceStatus ResourceStatus
+		Evt       *Event
+		Url       string
+		Result    float64
+		BrokerErr *jrpc2.ErrorObject
+		Err       error
 	}{
 		{
-			"test",
-			&Task{Status: StatusPending},
-			&Resource{Name: "test", Status: ResourceFree},
+			NewEvent("taskStatusChanged", []byte(`{"status": 1}`)),
+			StatusChangeNotifierHost,
+			0,
 			nil,
-			true,
 			nil,
+		},
+		{
+			NewEvent("taskStatusChanged", []byte(`{"status": 1}`)),
+			StatusChangeNotifierHost,
+			-1,
 			nil,
-			StatusStarted,
-			ResourceLocked,
+			NotificationFailedError,
+		},
+		{
+			NewEvent("taskStatusChanged", []byte(`{"status": 1}`)),
+			StatusChangeNotifierHost,
+			-1,
+			&jrpc2.ErrorObject{Message: "an error occured"},
+			errors.New("an error occured"),
 		},
+	}
+
+	for _, tt := range table {
+		params := map[string]interface{}{"created": tt.Evt.Created, "kind": tt.Evt.Kind, "meta": tt.Evt.Meta}
+		broker := new(MockServiceBroker)
+		broker.On("Call", mock.Anything, tt.Url, "notify", params).Return(tt.Result, tt.BrokerErr).Once()
+		ctrl := NewResourceController(broker)
+		if err := ctrl.Notify(tt.Evt); err != nil && err.Error() != tt.Err.Error() {
+			t.Fatal(err)
+		}
+		broker.AssertExpectations(t)
+	}
+}
+
+func TestControllerGetResource(t *testing.T) {
+	lockedAt := time.Now().Add(-time.Minute)
+	var table = []struct {
+		Name      string
+		Resource  *Resource
+		List      map[string]interface{}
+		BrokerErr *jrpc2.ErrorObject
+		Depth     int
+		Locked    bool
+		Err       error
+	}{
 		{
 			"test",
-			&Task{Status: StatusPending},
-			&Resource{Name: "test", Status: ResourceFree},
-			modelErr,
+			&Resource{Name: "test", Status: ResourceLocked, TaskId: "abc123", LockedAt: &lockedAt},
+			map[string]interface{}{"_key": "test", "heap": []interface{}{map[string]interface{}{}, map[string]interface{}{}}},
+			nil,
+			2,
 			true,
-			modelErr,
 			nil,
-			StatusStarted,
-			ResourceLocked,
 		},
 		{
 			"test",
-			&Task{Status: StatusPending},
-			&Resource{Name: "test", Status: ResourceFree},
-			modelErr,
-			true,
+			&Resource{Name: "test"},
+			map[string]interface{}{"_key": "test", "schedule": map[string]interface{}{"a": []interface{}{"x"}}},
+			nil,
+			1,
+			false,
 			nil,
-			modelErr,
-			StatusStarted,
-			ResourceLocked,
 		},
 		{
 			"test",
 			nil,
 			nil,
-			NoStagedTaskError,
-			false,
-			nil,
 			nil,
-			StatusScheduled,
-			ResourceFree,
+			0,
+			false,
+			ResourceNotFoundError,
 		},
 		{
 			"test",
-			&Task{Status: StatusPending},
-			&Resource{Name: "test", Status: ResourceLocked},
-			ResourceUnavailableError,
-			false,
+			&Resource{Name: "test"},
 			nil,
-			nil,
-			StatusPending,
-			ResourceLocked,
+			&jrpc2.ErrorObject{Message: "broker error"},
+			0,
+			false,
+			errors.New("broker error"),
 		},
 	}
 
 	for i, tt := range table {
-		broker := &MockServiceBroker{}
-		broker.On(
-			"Call",
-			StatusChangeNotifierHost,
-			"notify",
-			mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
-		).Return(float64(0), nil).Maybe()
+		params := map[string]interface{}{"key": tt.Name}
+		broker := new(MockServiceBroker)
+		broker.On("Call", mock.Anything, PriorityQueueHost, "get", params).Return(tt.List, tt.BrokerErr).Maybe()
+		broker.On("Call", mock.Anything, TimetableHost, "get", params).Return(tt.List, tt.BrokerErr).Maybe()
 		ctrl := NewResourceController(broker)
-		if tt.Task != nil {
-			ch := make(chan *Task, StageBuffer)
-			ch <- tt.Task
-			ctrl.stage.Store(tt.Key, ch)
-		}
 		if tt.Resource != nil {
-			ctrl.resources[tt.Key] = tt.Resource
+			ctrl.resources[tt.Name] = tt.Resource
 		}
-		taskModel := &MockModel{}
-		taskModel.On("Save", tt.Task).Return(DocumentMeta{}, tt.ModelErr).Maybe()
-		resourceModel := &MockModel{}
-		resourceModel.On("Save", tt.Resource).Return(DocumentMeta{}, tt.ResourceErr).Maybe()
-		if err := ctrl.StartTask(tt.Key, taskModel, resourceModel); err != nil && err != tt.Err {
+		detail, err := ctrl.GetResource(tt.Name)
+		if err != nil && err.Error() != tt.Err.Error() {
 			t.Fatal(err)
 		}
-		if ctrl.resources[tt.Key] != nil && ctrl.resources[tt.Key].Status != tt.ResourceStatus {
-			t.Fatalf("[%d] expected resource status %d, got %d", i, tt.ResourceStatus, ctrl.resources[tt.Key].Status)
+		if detail == nil {
+			continue
 		}
-		if tt.Model {
-			taskModel.AssertExpectations(t)
-			resourceModel.AssertExpectations(t)
+		if detail.QueueDepth != tt.Depth {
+			t.Fatalf("[%d] expected queue depth %d, got %d", i, tt.Depth, detail.QueueDepth)
+		}
+		if tt.Locked != (detail.LockedFor > 0) {
+			t.Fatalf("[%d] expected locked for to be set when locked", i)
 		}
-		broker.AssertExpectations(t)
 	}
 }
 
-func TestControllerCompleteTask(t *testing.T) {
-	modelErr := errors.New("model error")
-	queryErr := errors.New("query error")
+// firstDoc returns the first of the documents, or nil if there are none.
+func firstDoc(docs []interface{}) interface{} {
+	if len(docs) == 0 {
+		return nil
+	}
+	return docs[0]
+}
+
+func TestControllerGetTask(t *testing.T) {
+	task := NewTask([]byte(`{"key": "test123", priority": 12.3}`))
 	var table = []struct {
-		TaskId         string
-		Tasks          []interface{}
-		Resource       *Resource
-		Status         string
-		Err            error
-		Model          bool
-		ModelErr       error
-		ResourceErr    error
-		QueryErr       error
-		TaskStatus     string
-		ResourceStatus ResourceStatus
+		TaskId   string
+		Doc      interface{}
+		ModelErr error
+		Err      error
 	}{
 		{
-			"test",
-			[]interface{}{&Task{Key: "test", Status: StatusStarted}},
-			&Resource{Name: "test", Status: ResourceLocked},
-			StatusComplete,
-			nil,
-			true,
-			nil,
+			task.Id,
+			task,
 			nil,
 			nil,
-			StatusComplete,
-			ResourceFree,
 		},
 		{
-			"test",
-			[]interface{}{&Task{Key: "test", Status: StatusStarted}},
-			&Resource{Name: "test", Status: ResourceFree},
-			StatusCancelled,
-			nil,
-			true,
-			nil,
-			nil,
+			"abc123",
 			nil,
-			StatusComplete,
-			ResourceFree,
+			errors.New("query error"),
+			errors.New("query error"),
 		},
 		{
-			"test",
-			[]interface{}{&Task{Key: "test", Status: StatusQueued}},
-			&Resource{Name: "test", Status: ResourceFree},
-			StatusComplete,
-			TaskNotStartedError,
-			false,
-			nil,
+			"abc123",
 			nil,
 			nil,
-			StatusQueued,
-			ResourceFree,
+			TaskNotFoundError,
 		},
+	}
+
+	for _, tt := range table {
+		ctrl := NewResourceController(nil)
+		model := new(MockModel)
+		model.On("Get", tt.TaskId).Return(tt.Doc, tt.ModelErr).Once()
+		q := fmt.Sprintf(`FOR t IN %s FILTER t.parentId == @id SORT t.created ASC RETURN t`, CollectionTasks)
+		model.On("Query", q, map[string]interface{}{"id": tt.TaskId}).Return(make([]interface{}, 0), nil).Maybe()
+		task, err := ctrl.GetTask(tt.TaskId, model)
+		if err != nil && err.Error() != tt.Err.Error() {
+			t.Fatal(err)
+		}
+		if task != nil && task.Id != tt.TaskId {
+			t.Fatalf("expected task key to be %s, got %s", task.Id, tt.TaskId)
+		}
+		model.AssertExpectations(t)
+	}
+}
+
+func TestControllerListResources(t *testing.T) {
+	var table = []struct {
+		Docs      []interface{}
+		Managed   []*Resource
+		Resources []*Resource
+		ModelErr  error
+		Err       error
+	}{
 		{
-			"test",
-			[]interface{}{&Task{Key: "test", Status: StatusStarted}},
-			&Resource{Name: "test", Status: ResourceLocked},
-			StatusComplete,
-			modelErr,
-			true,
+			[]interface{}{&Resource{Name: "b", Status: ResourceFree}, &Resource{Name: "c"}},
+			[]*Resource{{Name: "a"}, {Name: "b", Status: ResourceLocked, TaskId: "abc123"}},
+			[]*Resource{{Name: "a"}, {Name: "b", Status: ResourceLocked, TaskId: "abc123"}, {Name: "c"}},
 			nil,
-			modelErr,
 			nil,
-			StatusComplete,
-			ResourceFree,
 		},
 		{
-			"test",
-			[]interface{}{},
-			&Resource{Name: "test", Status: ResourceFree},
-			StatusComplete,
-			TaskNotFoundError,
-			true,
 			nil,
+			[]*Resource{{Name: "a"}},
 			nil,
-			nil,
-			StatusPending,
-			ResourceFree,
+			errors.New("model error"),
+			errors.New("model error"),
 		},
+	}
+
+	for _, tt := range table {
+		model := new(MockModel)
+		model.On("FetchAll").Return(tt.Docs, tt.ModelErr).Once()
+		ctrl := NewResourceController(nil)
+		for _, resource := range tt.Managed {
+			ctrl.resources[resource.Name] = resource
+		}
+		resources, err := ctrl.ListResources(model)
+		if err != nil && err.Error() != tt.Err.Error() {
+			t.Fatal(err)
+		}
+		if len(resources) != len(tt.Resources) {
+			t.Fatalf("expected %d resources, got %d", len(tt.Resources), len(resources))
+		}
+		for i, resource := range resources {
+			expected := tt.Resources[i]
+			if resource.Name != expected.Name || resource.Status != expected.Status || resource.TaskId != expected.TaskId {
+				t.Fatalf("expected resource %v, got %v", expected, resource)
+			}
+		}
+		model.AssertExpectations(t)
+	}
+}
+
+func TestControllerListTasks(t *testing.T) {
+	var table = []struct {
+		Status   string
+		Key      string
+		Labels   map[string]string
+		Query    string
+		Vars     map[string]interface{}
+		Tasks    []interface{}
+		ModelErr error
+		Err      error
+	}{
 		{
-			"abc123",
+			"",
+			"",
 			nil,
-			&Resource{Name: "test", Status: ResourceFree},
+			fmt.Sprintf("FOR t IN %s SORT t.created ASC LIMIT @offset, @limit RETURN t", CollectionTasks),
+			map[string]interface{}{},
+			[]interface{}{&Task{Id: "abc123"}, &Task{Id: "xyz789"}},
+			nil,
+			nil,
+		},
+		{
+			StatusQueued,
+			"test",
+			nil,
+			fmt.Sprintf("FOR t IN %s FILTER t.status == @status FILTER t.key == @key SORT t.created ASC LIMIT @offset, @limit RETURN t", CollectionTasks),
+			map[string]interface{}{"status": StatusQueued, "key": "test"},
+			[]interface{}{&Task{Id: "abc123"}},
+			nil,
+			nil,
+		},
+		{
+			StatusError,
+			"",
+			nil,
+			fmt.Sprintf("FOR t IN %s FILTER t.status == @status SORT t.created ASC LIMIT @offset, @limit RETURN t", CollectionTasks),
+			map[string]interface{}{"status": StatusError},
+			nil,
+			errors.New("query error"),
+			errors.New("query error"),
+		},
+		{
+			"",
+			"",
+			map[string]string{"team": "data", "env": "prod"},
+			fmt.Sprintf("FOR t IN %s FILTER @l0 IN t.labelIndex FILTER @l1 IN t.labelIndex SORT t.created ASC LIMIT @offset, @limit RETURN t", CollectionTasks),
+			map[string]interface{}{"l0": "env=prod", "l1": "team=data"},
+			[]interface{}{&Task{Id: "abc123"}},
+			nil,
+			nil,
+		},
+	}
+
+	for _, tt := range table {
+		model := new(MockModel)
+		var result *Page
+		if tt.Tasks != nil {
+			result = &Page{Docs: tt.Tasks, Total: int64(len(tt.Tasks))}
+		}
+		model.On("QueryPage", tt.Query, tt.Vars, 0, 10).Return(result, tt.ModelErr).Once()
+		ctrl := NewResourceController(nil)
+		page, err := ctrl.ListTasks(tt.Status, tt.Key, tt.Labels, 10, 0, model)
+		if err != nil && err.Error() != tt.Err.Error() {
+			t.Fatal(err)
+		}
+		if page != nil && len(page.Tasks) != len(tt.Tasks) {
+			t.Fatalf("expected %d tasks, got %d", len(tt.Tasks), len(page.Tasks))
+		}
+		model.AssertExpectations(t)
+	}
+}
+
+func TestControllerExportTasks(t *testing.T) {
+	var table = []struct {
+		Status   string
+		Key      string
+		Labels   map[string]string
+		Query    string
+		Vars     map[string]interface{}
+		Tasks    []interface{}
+		ModelErr error
+		FnErr    error
+		Ids      []string
+	}{
+		{
+			"",
+			"",
+			nil,
+			fmt.Sprintf("FOR t IN %s SORT t.created ASC RETURN t", CollectionTasks),
+			map[string]interface{}{},
+			[]interface{}{&Task{Id: "abc123"}, &Task{Id: "xyz789"}},
+			nil,
+			nil,
+			[]string{"abc123", "xyz789"},
+		},
+		{
 			StatusComplete,
-			queryErr,
-			true,
+			"test",
+			map[string]string{"team": "data"},
+			fmt.Sprintf("FOR t IN %s FILTER t.status == @status FILTER t.key == @key FILTER @l0 IN t.labelIndex SORT t.created ASC RETURN t", CollectionTasks),
+			map[string]interface{}{"status": StatusComplete, "key": "test", "l0": "team=data"},
+			[]interface{}{&Task{Id: "abc123"}},
 			nil,
 			nil,
-			queryErr,
-			StatusPending,
-			ResourceFree,
+			[]string{"abc123"},
+		},
+		{
+			"",
+			"",
+			nil,
+			fmt.Sprintf("FOR t IN %s SORT t.created ASC RETURN t", CollectionTasks),
+			map[string]interface{}{},
+			nil,
+			errors.New("query error"),
+			nil,
+			[]string{},
+		},
+		{
+			"",
+			"",
+			nil,
+			fmt.Sprintf("FOR t IN %s SORT t.created ASC RETURN t", CollectionTasks),
+			map[string]interface{}{},
+			[]interface{}{&Task{Id: "abc123"}, &Task{Id: "xyz789"}},
+			nil,
+			errors.New("write error"),
+			[]string{"abc123"},
 		},
 	}
 
 	for i, tt := range table {
-		broker := &MockServiceBroker{}
-		broker.On(
-			"Call",
-			StatusChangeNotifierHost,
-			"notify",
-			mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
-		).Return(float64(0), nil).Maybe()
-		ctrl := NewResourceController(broker)
-		if tt.Resource != nil {
-			ctrl.resources[tt.TaskId] = tt.Resource
+		model := new(MockModel)
+		it := newSliceIterator(tt.Tasks...)
+		if tt.ModelErr != nil {
+			model.On("QueryStream", tt.Query, tt.Vars).Return(nil, tt.ModelErr).Once()
+		} else {
+			model.On("QueryStream", tt.Query, tt.Vars).Return(it, nil).Once()
 		}
-		taskModel := &MockModel{}
-		resourceModel := &MockModel{}
-		resourceModel.On("Save", tt.Resource).Return(DocumentMeta{}, tt.ResourceErr).Maybe()
-		q := fmt.Sprintf(`FOR t IN %s FILTER t._key == @key RETURN t`, CollectionTasks)
-		taskModel.On("Query", q, map[string]interface{}{"key": tt.TaskId}).Return(tt.Tasks, tt.QueryErr).Maybe()
-		taskModel.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, tt.ModelErr).Maybe()
-		if err := ctrl.CompleteTask(tt.TaskId, tt.Status, taskModel, resourceModel); err != nil && err != tt.Err {
-			t.Fatal(err)
+		ctrl := NewResourceController(nil)
+		ids := make([]string, 0)
+		err := ctrl.ExportTasks(tt.Status, tt.Key, tt.Labels, model, func(task *Task) error {
+			ids = append(ids, task.Id)
+			return tt.FnErr
+		})
+		expected := tt.ModelErr
+		if expected == nil {
+			expected = tt.FnErr
 		}
-		if ctrl.resources[tt.TaskId] != nil && ctrl.resources[tt.TaskId].Status != tt.ResourceStatus {
-			t.Fatalf("[%d] expected resource status %d, got %d", i, tt.ResourceStatus, ctrl.resources[tt.TaskId].Status)
+		if err != expected {
+			t.Fatalf("[%d] expected error %v, got %v", i, expected, err)
 		}
-		if tt.Model {
-			taskModel.AssertExpectations(t)
-			resourceModel.AssertExpectations(t)
+		if fmt.Sprint(ids) != fmt.Sprint(tt.Ids) {
+			t.Fatalf("[%d] expected tasks %v, got %v", i, tt.Ids, ids)
 		}
-		broker.AssertExpectations(t)
+		model.AssertExpectations(t)
 	}
 }
 
-func TestControllerStagedQueuedTask(t *testing.T) {
+func TestControllerListTimetable(t *testing.T) {
 	var table = []struct {
 		Key       string
-		Priority  float64
 		Result    map[string]interface{}
 		BrokerErr *jrpc2.ErrorObject
 		Err       error
 	}{
 		{
 			"test",
-			2.4,
-			map[string]interface{}{"_key": "test", "priority": 2.4},
+			map[string]interface{}{"_key": "test"},
 			nil,
 			nil,
 		},
 		{
 			"test",
-			0,
 			nil,
-			&jrpc2.ErrorObject{Message: "broker error"},
-			errors.New("broker error"),
+			&jrpc2.ErrorObject{Code: -32002, Message: "Timetable not found"},
+			TimetableNotFound,
 		},
 	}
 
 	for _, tt := range table {
 		params := map[string]interface{}{"key": tt.Key}
-		broker := &MockServiceBroker{}
-		broker.On("Call", PriorityQueueHost, "pop", params).Return(tt.Result, tt.BrokerErr)
+		broker := new(MockServiceBroker)
+		broker.On("Call", mock.Anything, TimetableHost, "get", params).Return(tt.Result, tt.BrokerErr)
 		ctrl := NewResourceController(broker)
-		task, err := ctrl.stageQueuedTask(tt.Key)
+		list, err := ctrl.ListTimetable(tt.Key)
 		if err != nil && err.Error() != tt.Err.Error() {
 			t.Fatal(err)
 		}
-		if task != nil && tt.Priority != task.Priority {
-			t.Fatalf("expected task priority to be %f, got %f", tt.Priority, task.Priority)
+		if list != nil && list["_key"] != tt.Result["_key"] {
+			t.Fatalf("expected list to be %s, got %s", tt.Result["_key"], list["_key"])
 		}
 		broker.AssertExpectations(t)
 	}
 }
 
-func TestControllerStageScheduledTask(t *testing.T) {
+func TestControllerListPriorityQueue(t *testing.T) {
 	var table = []struct {
 		Key       string
-		RunAt     string
 		Result    map[string]interface{}
 		BrokerErr *jrpc2.ErrorObject
 		Err       error
 	}{
 		{
 			"test",
-			time.Now().Format(time.RFC3339),
-			map[string]interface{}{"_key": "test", "runAt": time.Now()},
+			map[string]interface{}{"_key": "test"},
 			nil,
 			nil,
 		},
 		{
 			"test",
-			time.Now().String(),
 			nil,
-			&jrpc2.ErrorObject{Message: "broker error"},
-			errors.New("broker error"),
+			&jrpc2.ErrorObject{Code: 32002, Message: "Queue not found"},
+			QueueNotFoundError,
 		},
 	}
 
 	for _, tt := range table {
 		params := map[string]interface{}{"key": tt.Key}
-		broker := &MockServiceBroker{}
-		broker.On("Call", TimetableHost, "next", params).Return(tt.Result, tt.BrokerErr)
+		broker := new(MockServiceBroker)
+		broker.On("Call", mock.Anything, PriorityQueueHost, "get", params).Return(tt.Result, tt.BrokerErr)
 		ctrl := NewResourceController(broker)
-		task, err := ctrl.stageScheduledTask(tt.Key)
+		list, err := ctrl.ListPriorityQueue(tt.Key)
 		if err != nil && err.Error() != tt.Err.Error() {
 			t.Fatal(err)
 		}
-		if task != nil && task.RunAt != nil && tt.RunAt != task.RunAt.Format(time.RFC3339) {
-			t.Fatalf("expected task run at to be %s, got %s", tt.RunAt, task.RunAt)
+		if list != nil && list["_key"] != tt.Result["_key"] {
+			t.Fatalf("expected list to be %s, got %s", tt.Result["_key"], list["_key"])
 		}
 		broker.AssertExpectations(t)
 	}
 }
 
-func TestControllerStartStageLoop(t *testing.T) {
-	table := []struct {
-		Key              string
-		Resources        []*Resource
-		QueueResponse    interface{}
-		QueueErr         *jrpc2.ErrorObject
-		ScheduleResponse interface{}
-		ScheduleErr      *jrpc2.ErrorObject
-		QueryResult      []interface{}
-		QueryErr         error
-		TaskId           string
+func TestControllerStartTask(t *testing.T) {
+	modelErr := errors.New("model error")
+	var table = []struct {
+		Key            string
+		Task           *Task
+		Resource       *Resource
+		Err            error
+		Model          bool
+		ModelErr       error
+		ResourceErr    error
+		TaskStatus     string
+		ResourceStatus ResourceStatus
 	}{
 		{
 			"test",
-			[]*Resource{{Name: "test"}},
-			nil,
+			&Task{Status: StatusPending},
+			&Resource{Name: "test", Status: ResourceFree},
 			nil,
-			map[string]interface{}{"_key": "abc123", "key": "test"},
+			true,
 			nil,
-			[]interface{}{&Task{Id: "abc123", Key: "test"}},
 			nil,
-			"abc123",
+			StatusStarted,
+			ResourceLocked,
 		},
 		{
 			"test",
-			[]*Resource{{Name: "test"}},
-			nil,
-			nil,
-			nil,
-			&jrpc2.ErrorObject{Message: "error"},
+			&Task{Status: StatusPending},
+			&Resource{Name: "test", Status: ResourceFree},
+			modelErr,
+			true,
+			modelErr,
 			nil,
+			StatusPending,
+			ResourceFree,
+		},
+		{
+			"test",
+			&Task{Status: StatusPending},
+			&Resource{Name: "test", Status: ResourceFree},
+			modelErr,
+			true,
 			nil,
-			"",
+			modelErr,
+			StatusPending,
+			ResourceFree,
 		},
 		{
 			"test",
-			[]*Resource{{Name: "test"}},
-			map[string]interface{}{"_key": "abc123", "key": "test"},
 			nil,
 			nil,
+			NoStagedTaskError,
+			false,
 			nil,
-			[]interface{}{&Task{Id: "abc123", Key: "test"}},
 			nil,
-			"abc123",
+			StatusScheduled,
+			ResourceFree,
 		},
 		{
 			"test",
-			[]*Resource{{Name: "test"}},
-			nil,
-			&jrpc2.ErrorObject{Message: "error"},
+			&Task{Status: StatusPending},
+			&Resource{Name: "test", Status: ResourceLocked},
+			ResourceUnavailableError,
+			false,
 			nil,
 			nil,
+			StatusPending,
+			ResourceLocked,
+		},
+		{
+			"test",
+			&Task{Status: StatusPending},
+			&Resource{Name: "test", Status: ResourceFree, Draining: true},
+			ResourceDrainingError,
+			false,
 			nil,
 			nil,
-			"",
+			StatusPending,
+			ResourceFree,
 		},
 	}
 
-	for _, tt := range table {
-		params := map[string]interface{}{"key": tt.Key}
-		model := &MockModel{}
-		q := fmt.Sprintf(`FOR t IN %s FILTER t._key == @key RETURN t`, CollectionTasks)
+	for i, tt := range table {
 		broker := &MockServiceBroker{}
-		ctrl := NewResourceController(broker)
-		model.On("Query", q, map[string]interface{}{"key": tt.TaskId}).Return(tt.QueryResult, tt.QueryErr).Maybe().Run(func(args mock.Arguments) {
-			if tt.QueryErr != nil {
-				ch := make(chan *Task, StageBuffer)
-				ch <- nil
-				ctrl.stage.Store(tt.Key, ch)
-			}
-		})
-		model.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, nil).Maybe()
 		broker.On(
 			"Call",
+			mock.Anything,
 			StatusChangeNotifierHost,
 			"notify",
 			mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
 		).Return(float64(0), nil).Maybe()
-		broker.On("Call", TimetableHost, "next", params).Return(tt.ScheduleResponse, tt.ScheduleErr).Maybe().Run(func(args mock.Arguments) {
-			if tt.ScheduleErr != nil {
-				ch := make(chan *Task, StageBuffer)
-				ch <- nil
-				ctrl.stage.Store(tt.Key, ch)
-			}
-		})
-		broker.On("Call", PriorityQueueHost, "pop", params).Return(tt.QueueResponse, tt.QueueErr).Maybe().Run(func(args mock.Arguments) {
-			if tt.QueueErr != nil {
-				ch := make(chan *Task, StageBuffer)
-				ch <- nil
-				ctrl.stage.Store(tt.Key, ch)
-			}
-		})
-		for _, resource := range tt.Resources {
-			ctrl.resources[resource.Name] = resource
+		ctrl := NewResourceController(broker)
+		if tt.Task != nil {
+			ctrl.stage.Store(tt.Key, NewStagedSlot(time.Now(), tt.Task))
 		}
-		go ctrl.StartStageLoop(model)
-		var task *Task
-		for {
-			if ch, ok := ctrl.stage.Load(tt.Key); ok {
-				task = <-ch.(chan *Task)
-				break
+		if tt.Resource != nil {
+			ctrl.resources[tt.Key] = tt.Resource
+		}
+		taskModel := &MockModel{}
+		taskModel.On("Save", tt.Task).Return(DocumentMeta{}, tt.ModelErr).Maybe()
+		resourceModel := &MockModel{}
+		resourceModel.On("Save", tt.Resource).Return(DocumentMeta{}, tt.ResourceErr).Maybe()
+		if err := ctrl.StartTask(tt.Key, "", taskModel, resourceModel); err != nil && err != tt.Err {
+			t.Fatal(err)
+		}
+		if ctrl.resources[tt.Key] != nil && ctrl.resources[tt.Key].Status != tt.ResourceStatus {
+			t.Fatalf("[%d] expected resource status %d, got %d", i, tt.ResourceStatus, ctrl.resources[tt.Key].Status)
+		}
+		if tt.Task != nil {
+			if tt.Task.Status != tt.TaskStatus {
+				t.Fatalf("[%d] expected task status %s, got %s", i, tt.TaskStatus, tt.Task.Status)
+			}
+			slot, staged := ctrl.stagedSlot(tt.Key)
+			if staged != (tt.TaskStatus == StatusPending) || (staged && slot.Tasks()[0] != tt.Task) {
+				t.Fatalf("[%d] expected task staged %v", i, tt.TaskStatus == StatusPending)
+			}
+			if tt.Err != nil && len(tt.Task.AttemptHistory) != 0 {
+				t.Fatalf("[%d] expected no attempt, got %d", i, len(tt.Task.AttemptHistory))
 			}
 		}
-		if task != nil && task.Id != tt.TaskId {
-			t.Fatalf("expected task id to be %s", tt.TaskId)
+		if tt.Model {
+			taskModel.AssertExpectations(t)
+			resourceModel.AssertExpectations(t)
 		}
 		broker.AssertExpectations(t)
-		model.AssertExpectations(t)
-	}
-}
-
-func TestControllerStageTask(t *testing.T) {
-	model := &MockModel{}
-	model.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, nil).Maybe()
-	broker := &MockServiceBroker{}
-	broker.On(
-		"Call",
-		StatusChangeNotifierHost,
-		"notify",
-		mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
-	).Return(float64(0), nil).Maybe()
-	ctrl := NewResourceController(broker)
-	ctrl.StageTask(&Task{Id: "abc123", Key: "test"}, model, true)
-	if _, ok := ctrl.stage.Load("test"); !ok {
-		t.Fatal("expected stage abc123 to be ok")
 	}
-	model.AssertExpectations(t)
-	broker.AssertExpectations(t)
 }
 
-func TestControllerRemoveTask(t *testing.T) {
+func TestControllerCompleteTask(t *testing.T) {
+	modelErr := errors.New("model error")
+	queryErr := errors.New("query error")
 	var table = []struct {
-		Key         string
-		Id          string
-		Result      float64
-		Status      string
-		BrokerErr   *jrpc2.ErrorObject
-		ModelErr    error
-		QueryResult []interface{}
-		QueryErr    error
-		Err         error
+		TaskId         string
+		Tasks          []interface{}
+		Resource       *Resource
+		Status         string
+		Err            error
+		Model          bool
+		ModelErr       error
+		ResourceErr    error
+		QueryErr       error
+		TaskStatus     string
+		ResourceStatus ResourceStatus
 	}{
 		{
-			"test123",
-			"abc123",
-			0,
-			StatusCancelled,
+			"test",
+			[]interface{}{&Task{Key: "test", Status: StatusStarted}},
+			&Resource{Name: "test", Status: ResourceLocked},
+			StatusComplete,
 			nil,
+			true,
 			nil,
-			[]interface{}{&Task{Key: "test123", Id: "abc123", Status: StatusQueued}},
 			nil,
 			nil,
+			StatusComplete,
+			ResourceFree,
 		},
 		{
-			"test123",
-			"abc123",
-			0,
+			"test",
+			[]interface{}{&Task{Key: "test", Status: StatusStarted}},
+			&Resource{Name: "test", Status: ResourceFree},
 			StatusCancelled,
 			nil,
+			true,
 			nil,
-			[]interface{}{&Task{Key: "test123", Id: "abc123", Status: StatusScheduled}},
 			nil,
 			nil,
+			StatusCancelled,
+			ResourceFree,
 		},
 		{
-			"test123",
-			"abc123",
-			0,
-			StatusCancelled,
-			nil,
+			"test",
+			[]interface{}{&Task{Key: "test", Status: StatusQueued}},
+			&Resource{Name: "test", Status: ResourceFree},
+			StatusComplete,
+			TaskNotStartedError,
+			false,
 			nil,
-			[]interface{}{&Task{Key: "test123", Id: "abc123", Status: StatusPending}},
 			nil,
 			nil,
+			StatusQueued,
+			ResourceFree,
 		},
 		{
-			"test123",
-			"abc123",
-			0,
-			StatusStarted,
-			nil,
+			"test",
+			[]interface{}{&Task{Key: "test", Status: StatusStarted}},
+			&Resource{Name: "test", Status: ResourceLocked},
+			StatusComplete,
+			modelErr,
+			true,
 			nil,
-			[]interface{}{&Task{Key: "test123", Id: "abc123", Status: StatusStarted}},
+			modelErr,
 			nil,
-			TaskRemoveFailedError,
+			StatusStarted,
+			ResourceLocked,
 		},
 		{
-			"test123",
-			"abc123",
-			-1,
-			StatusStarted,
+			"test",
+			[]interface{}{},
+			&Resource{Name: "test", Status: ResourceFree},
+			StatusComplete,
+			TaskNotFoundError,
+			true,
 			nil,
 			nil,
-			[]interface{}{&Task{Key: "test123", Id: "abc123", Status: StatusPending}},
 			nil,
-			TaskRemoveFailedError,
+			StatusPending,
+			ResourceFree,
 		},
 		{
-			"test123",
 			"abc123",
-			0,
-			StatusStarted,
 			nil,
+			&Resource{Name: "test", Status: ResourceFree},
+			StatusComplete,
+			queryErr,
+			true,
 			nil,
-			[]interface{}{},
 			nil,
-			TaskNotFoundError,
+			queryErr,
+			StatusPending,
+			ResourceFree,
 		},
+	}
+
+	for i, tt := range table {
+		broker := &MockServiceBroker{}
+		broker.On(
+			"Call",
+			mock.Anything,
+			StatusChangeNotifierHost,
+			"notify",
+			mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
+		).Return(float64(0), nil).Maybe()
+		ctrl := NewResourceController(broker)
+		if tt.Resource != nil {
+			ctrl.resources[tt.TaskId] = tt.Resource
+		}
+		taskModel := &MockModel{}
+		resourceModel := &MockModel{}
+		resourceModel.On("Save", tt.Resource).Return(DocumentMeta{}, tt.ResourceErr).Maybe()
+		taskModel.On("Get", tt.TaskId).Return(firstDoc(tt.Tasks), tt.QueryErr).Maybe()
+		q := fmt.Sprintf(`FOR t IN %s FILTER t.status == @status AND @id IN t.dependsOn RETURN t`, CollectionTasks)
+		taskModel.On("Query", q, mock.Anything).Return([]interface{}{}, nil).Maybe()
+		taskModel.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, tt.ModelErr).Maybe()
+		if err := ctrl.CompleteTask(tt.TaskId, tt.Status, nil, "", false, taskModel, resourceModel); err != nil && err != tt.Err {
+			t.Fatal(err)
+		}
+		if ctrl.resources[tt.TaskId] != nil && ctrl.resources[tt.TaskId].Status != tt.ResourceStatus {
+			t.Fatalf("[%d] expected resource status %d, got %d", i, tt.ResourceStatus, ctrl.resources[tt.TaskId].Status)
+		}
+		if task, ok := firstDoc(tt.Tasks).(*Task); ok && task.Status != tt.TaskStatus {
+			t.Fatalf("[%d] expected task status %s, got %s", i, tt.TaskStatus, task.Status)
+		}
+		if tt.Model {
+			taskModel.AssertExpectations(t)
+			resourceModel.AssertExpectations(t)
+		}
+		broker.AssertExpectations(t)
+	}
+}
+
+func TestControllerStagedQueuedTask(t *testing.T) {
+	var table = []struct {
+		Key       string
+		Priority  float64
+		Result    map[string]interface{}
+		BrokerErr *jrpc2.ErrorObject
+		Err       error
+	}{
 		{
-			"test123",
-			"abc123",
-			0,
-			StatusStarted,
+			"test",
+			2.4,
+			map[string]interface{}{"_key": "test", "priority": 2.4},
 			nil,
 			nil,
-			[]interface{}{},
-			errors.New("query error"),
-			errors.New("query error"),
 		},
 		{
-			"test123",
-			"abc123",
+			"test",
 			0,
-			StatusStarted,
 			nil,
-			errors.New("model error"),
-			[]interface{}{&Task{Key: "test123", Id: "abc123", Status: StatusQueued}},
-			nil,
-			errors.New("model error"),
+			&jrpc2.ErrorObject{Message: "broker error"},
+			errors.New("broker error"),
 		},
+	}
+
+	for _, tt := range table {
+		params := map[string]interface{}{"key": tt.Key}
+		broker := &MockServiceBroker{}
+		broker.On("Call", mock.Anything, PriorityQueueHost, "pop", params).Return(tt.Result, tt.BrokerErr)
+		ctrl := NewResourceController(broker)
+		task, err := ctrl.stageQueuedTask(context.Background(), tt.Key)
+		if err != nil && err.Error() != tt.Err.Error() {
+			t.Fatal(err)
+		}
+		if task != nil && tt.Priority != task.Priority {
+			t.Fatalf("expected task priority to be %f, got %f", tt.Priority, task.Priority)
+		}
+		broker.AssertExpectations(t)
+	}
+}
+
+func TestControllerStageScheduledTask(t *testing.T) {
+	var table = []struct {
+		Key       string
+		RunAt     string
+		Result    map[string]interface{}
+		BrokerErr *jrpc2.ErrorObject
+		Err       error
+	}{
 		{
-			"test123",
-			"abc123",
-			0,
-			StatusCancelled,
-			nil,
+			"test",
+			time.Now().Format(time.RFC3339),
+			map[string]interface{}{"_key": "test", "runAt": time.Now()},
 			nil,
-			[]interface{}{&Task{Key: "test123", Id: "abc123", Status: StatusPending}},
 			nil,
+		},
+		{
+			"test",
+			time.Now().String(),
 			nil,
+			&jrpc2.ErrorObject{Message: "broker error"},
+			errors.New("broker error"),
 		},
 	}
 
 	for _, tt := range table {
-		model := new(MockModel)
-		q := fmt.Sprintf(`FOR t IN %s FILTER t._key == @key RETURN t`, CollectionTasks)
-		model.On("Query", q, map[string]interface{}{"key": tt.Id}).Return(tt.QueryResult, tt.QueryErr).Maybe()
-		model.On("Remove", mock.AnythingOfType("*main.Task")).Return(tt.ModelErr).Maybe()
-		broker := new(MockServiceBroker)
-		broker.On(
-			"Call",
-			StatusChangeNotifierHost,
-			"notify",
-			mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
-		).Return(float64(0), nil).Maybe()
-		params := map[string]interface{}{"key": tt.Key, "id": tt.Id}
-		broker.On("Call", TimetableHost, "remove", params).Return(tt.Result, tt.BrokerErr).Maybe()
-		broker.On("Call", PriorityQueueHost, "remove", params).Return(tt.Result, tt.BrokerErr).Maybe()
-		ctrl := NewResourceController(broker)
-		if err := ctrl.RemoveTask(tt.Id, model); err != nil && err.Error() != tt.Err.Error() {
+		params := map[string]interface{}{"key": tt.Key}
+		broker := &MockServiceBroker{}
+		broker.On("Call", mock.Anything, TimetableHost, "next", params).Return(tt.Result, tt.BrokerErr)
+		ctrl := NewResourceController(broker)
+		task, err := ctrl.stageScheduledTask(context.Background(), tt.Key)
+		if err != nil && err.Error() != tt.Err.Error() {
 			t.Fatal(err)
 		}
+		if task != nil && task.RunAt != nil && tt.RunAt != task.RunAt.Format(time.RFC3339) {
+			t.Fatalf("expected task run at to be %s, got %s", tt.RunAt, task.RunAt)
+		}
+		broker.AssertExpectations(t)
+	}
+}
+
+func TestControllerStartStageLoop(t *testing.T) {
+	table := []struct {
+		Key              string
+		Resources        []*Resource
+		QueueResponse    interface{}
+		QueueErr         *jrpc2.ErrorObject
+		ScheduleResponse interface{}
+		ScheduleErr      *jrpc2.ErrorObject
+		QueryResult      []interface{}
+		QueryErr         error
+		TaskId           string
+	}{
+		{
+			"test",
+			[]*Resource{{Name: "test"}},
+			nil,
+			nil,
+			map[string]interface{}{"_key": "abc123", "key": "test"},
+			nil,
+			[]interface{}{&Task{Id: "abc123", Key: "test", Status: StatusScheduled}},
+			nil,
+			"abc123",
+		},
+		{
+			"test",
+			[]*Resource{{Name: "test"}},
+			nil,
+			nil,
+			nil,
+			&jrpc2.ErrorObject{Message: "error"},
+			nil,
+			nil,
+			"",
+		},
+		{
+			"test",
+			[]*Resource{{Name: "test"}},
+			map[string]interface{}{"_key": "abc123", "key": "test"},
+			nil,
+			nil,
+			nil,
+			[]interface{}{&Task{Id: "abc123", Key: "test", Status: StatusQueued}},
+			nil,
+			"abc123",
+		},
+		{
+			"test",
+			[]*Resource{{Name: "test"}},
+			nil,
+			&jrpc2.ErrorObject{Message: "error"},
+			nil,
+			nil,
+			nil,
+			nil,
+			"",
+		},
+	}
+
+	for _, tt := range table {
+		params := map[string]interface{}{"key": tt.Key}
+		model := &MockModel{}
+		broker := &MockServiceBroker{}
+		ctrl := NewResourceController(broker)
+		model.On("Get", tt.TaskId).Return(firstDoc(tt.QueryResult), tt.QueryErr).Maybe().Run(func(args mock.Arguments) {
+			if tt.QueryErr != nil {
+				ctrl.stage.Store(tt.Key, NewStagedSlot(time.Now()))
+			}
+		})
+		model.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, nil).Maybe()
+		broker.On(
+			"Call",
+			mock.Anything,
+			StatusChangeNotifierHost,
+			"notify",
+			mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
+		).Return(float64(0), nil).Maybe()
+		broker.On("Call", mock.Anything, TimetableHost, "next", params).Return(tt.ScheduleResponse, tt.ScheduleErr).Maybe().Run(func(args mock.Arguments) {
+			if tt.ScheduleErr != nil {
+				ctrl.stage.Store(tt.Key, NewStagedSlot(time.Now()))
+			}
+		})
+		broker.On("Call", mock.Anything, PriorityQueueHost, "pop", params).Return(tt.QueueResponse, tt.QueueErr).Maybe().Run(func(args mock.Arguments) {
+			if tt.QueueErr != nil {
+				ctrl.stage.Store(tt.Key, NewStagedSlot(time.Now()))
+			}
+		})
+		for _, resource := range tt.Resources {
+			ctrl.resources[resource.Name] = resource
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		go ctrl.StartStageLoop(ctx, model)
+		var task *Task
+		for {
+			if slot, ok := ctrl.stagedSlot(tt.Key); ok {
+				if tasks := slot.Tasks(); len(tasks) > 0 {
+					task = tasks[0]
+				}
+				break
+			}
+		}
+		cancel()
+		if task != nil && task.Id != tt.TaskId {
+			t.Fatalf("expected task id to be %s", tt.TaskId)
+		}
 		broker.AssertExpectations(t)
 		model.AssertExpectations(t)
 	}
 }
+
+func TestControllerStartStageLoopPoolWeight(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		task := &Task{Id: "abc123", Key: "gpu", Priority: 1, Status: StatusQueued}
+		model := &MockModel{}
+		model.On("Get", "abc123").Return(task, nil)
+		model.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, nil)
+		broker := &MockServiceBroker{}
+		broker.On("Call", mock.Anything, TimetableHost, "next", mock.Anything).Return(nil, nil)
+		broker.On("Call", mock.Anything, PriorityQueueHost, "pop", map[string]interface{}{"key": "gpu"}).Return(map[string]interface{}{"_key": "abc123", "key": "gpu"}, nil).Once()
+		broker.On("Call", mock.Anything, PriorityQueueHost, "pop", mock.Anything).Return(nil, nil)
+		broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+		ctrl := NewResourceController(broker)
+		ctrl.resources["light"] = &Resource{Name: "light", Pool: "gpu", Weight: 1}
+		ctrl.resources["heavy"] = &Resource{Name: "heavy", Pool: "gpu", Weight: 5}
+		ctx, cancel := context.WithCancel(context.Background())
+		go ctrl.StartStageLoop(ctx, model)
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			_, heavy := ctrl.stagedSlot("heavy")
+			_, light := ctrl.stagedSlot("light")
+			if heavy || light {
+				break
+			}
+		}
+		cancel()
+		ctrl.Shutdown(context.Background())
+		if slot, ok := ctrl.stagedSlot("heavy"); !ok || slot.Len() != 1 {
+			t.Fatalf("[%d] expected the pool task to be staged on the heaviest member", i)
+		}
+	}
+}
+
+func TestControllerStageTask(t *testing.T) {
+	model := &MockModel{}
+	model.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, nil).Maybe()
+	broker := &MockServiceBroker{}
+	broker.On(
+		"Call",
+		mock.Anything,
+		StatusChangeNotifierHost,
+		"notify",
+		mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
+	).Return(float64(0), nil).Maybe()
+	ctrl := NewResourceController(broker)
+	ctrl.StageTask(&Task{Id: "abc123", Key: "test", Status: StatusQueued}, model, true)
+	if _, ok := ctrl.stage.Load("test"); !ok {
+		t.Fatal("expected stage abc123 to be ok")
+	}
+	model.AssertExpectations(t)
+	broker.AssertExpectations(t)
+}
+
+func TestControllerStageLookahead(t *testing.T) {
+	defer func(n int) { StageLookahead = n }(StageLookahead)
+	StageLookahead = 2
+
+	taskModel := &MockModel{}
+	taskModel.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, nil)
+	rescModel := &MockModel{}
+	rescModel.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, nil)
+	broker := &MockServiceBroker{}
+	broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+	ctrl := NewResourceController(broker)
+	ctrl.resources["test"] = &Resource{Name: "test", Status: ResourceFree}
+	for _, id := range []string{"abc123", "def456", "ghi789"} {
+		ctrl.StageTask(&Task{Id: id, Key: "test", Status: StatusQueued}, taskModel, true)
+	}
+	if !ctrl.stageFull("test") {
+		t.Fatal("expected stage to be full")
+	}
+	staged, _ := ctrl.ListStagedTasks("test")
+	if len(staged) != 2 || staged[0].Id != "abc123" || staged[1].Id != "def456" {
+		t.Fatalf("expected staged tasks [abc123 def456], got %v", staged)
+	}
+	if ctrl.resources["test"].TaskId != "abc123" {
+		t.Fatalf("expected resource task id abc123, got %s", ctrl.resources["test"].TaskId)
+	}
+
+	if err := ctrl.StartTask("test", "", taskModel, rescModel); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctrl.StartTask("test", "", taskModel, rescModel); err != ResourceUnavailableError {
+		t.Fatalf("expected error %v, got %v", ResourceUnavailableError, err)
+	}
+	if task, _ := ctrl.GetStagedTask("test"); task == nil || task.Id != "def456" {
+		t.Fatalf("expected staged task def456, got %v", task)
+	}
+	ctrl.resources["test"].Status = ResourceFree
+	if err := ctrl.StartTask("test", "", taskModel, rescModel); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ctrl.stage.Load("test"); ok {
+		t.Fatal("expected stage to be removed")
+	}
+	if staged, _ := ctrl.ListStagedTasks("test"); len(staged) != 0 {
+		t.Fatalf("expected no staged tasks, got %v", staged)
+	}
+}
+
+func TestControllerUnstageTaskLookahead(t *testing.T) {
+	broker := &MockServiceBroker{}
+	broker.On("Call", mock.Anything, PriorityQueueHost, "push", mock.Anything).Return(float64(0), nil)
+	broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+	model := &MockModel{}
+	model.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, nil)
+	ctrl := NewResourceController(broker)
+	tasks := []*Task{
+		{Id: "abc123", Key: "test", Priority: 2.5, Status: StatusPending},
+		{Id: "def456", Key: "test", Priority: 1.5, Status: StatusPending},
+	}
+	ctrl.stage.Store("test", NewStagedSlot(time.Now(), tasks...))
+	if err := ctrl.UnstageTask("test", model); err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range tasks {
+		if task.Status != StatusQueued {
+			t.Fatalf("expected task %s to be %s, got %s", task.Id, StatusQueued, task.Status)
+		}
+	}
+	if _, ok := ctrl.stage.Load("test"); ok {
+		t.Fatal("expected stage to be removed")
+	}
+	broker.AssertNumberOfCalls(t, "Call", 4)
+}
+
+func TestControllerPauseResource(t *testing.T) {
+	var table = []struct {
+		Name     string
+		Resource *Resource
+		ModelErr error
+		Err      error
+	}{
+		{"test", &Resource{Name: "test"}, nil, nil},
+		{"test", nil, nil, ResourceNotFoundError},
+		{"test", &Resource{Name: "test"}, errors.New("model error"), errors.New("model error")},
+	}
+
+	for _, tt := range table {
+		model := new(MockModel)
+		model.On("Save", tt.Resource).Return(DocumentMeta{}, tt.ModelErr).Maybe()
+		ctrl := NewResourceController(nil)
+		if tt.Resource != nil {
+			ctrl.resources[tt.Name] = tt.Resource
+		}
+		if err := ctrl.PauseResource(tt.Name, model); err != nil && err.Error() != tt.Err.Error() {
+			t.Fatal(err)
+		}
+		if tt.Resource != nil && !tt.Resource.Draining {
+			t.Fatal("expected resource to be draining")
+		}
+		if err := ctrl.ResumeResource(tt.Name, model); err != nil && err.Error() != tt.Err.Error() {
+			t.Fatal(err)
+		}
+		if tt.Resource != nil && tt.Resource.Draining {
+			t.Fatal("expected resource not to be draining")
+		}
+		model.AssertExpectations(t)
+	}
+}
+
+func TestControllerRemoveResource(t *testing.T) {
+	var table = []struct {
+		Name     string
+		Resource *Resource
+		Staged   *Task
+		ModelErr error
+		Err      error
+	}{
+		{"test", &Resource{Name: "test"}, nil, nil, nil},
+		{"test", &Resource{Name: "test"}, &Task{Id: "abc123", Key: "test", Status: StatusPending}, nil, nil},
+		{"test", nil, nil, nil, ResourceNotFoundError},
+		{"test", &Resource{Name: "test", Status: ResourceLocked}, nil, nil, ResourceUnavailableError},
+		{"test", &Resource{Name: "test"}, nil, errors.New("model error"), errors.New("model error")},
+	}
+
+	for i, tt := range table {
+		broker := new(MockServiceBroker)
+		broker.On(
+			"Call",
+			mock.Anything,
+			StatusChangeNotifierHost,
+			"notify",
+			mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
+		).Return(float64(0), nil).Maybe()
+		broker.On(
+			"Call",
+			mock.Anything,
+			StatusChangeNotifierHost,
+			"notify",
+			mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "resourceRemoved" }),
+		).Return(float64(0), nil).Maybe()
+		taskModel := new(MockModel)
+		taskModel.On("Save", tt.Staged).Return(DocumentMeta{}, nil).Maybe()
+		rescModel := new(MockModel)
+		rescModel.On("Remove", tt.Resource).Return(tt.ModelErr).Maybe()
+		ctrl := NewResourceController(broker)
+		if tt.Resource != nil {
+			ctrl.resources[tt.Name] = tt.Resource
+		}
+		if tt.Staged != nil {
+			ctrl.stage.Store(tt.Name, NewStagedSlot(time.Now(), tt.Staged))
+		}
+		taskModel.On("Query", dependentsQuery, mock.Anything).Return(nil, nil).Maybe()
+		err := ctrl.RemoveResource(tt.Name, taskModel, rescModel)
+		if err != nil && err.Error() != tt.Err.Error() {
+			t.Fatal(err)
+		}
+		if err == nil {
+			if _, ok := ctrl.resources[tt.Name]; ok {
+				t.Fatalf("[%d] expected resource to be removed", i)
+			}
+			if _, ok := ctrl.stage.Load(tt.Name); ok {
+				t.Fatalf("[%d] expected stage to be removed", i)
+			}
+			if tt.Staged != nil && tt.Staged.Status != StatusCancelled {
+				t.Fatalf("[%d] expected staged task to be cancelled, got %s", i, tt.Staged.Status)
+			}
+			rescModel.AssertExpectations(t)
+		}
+		taskModel.AssertExpectations(t)
+	}
+}
+
+func TestControllerRemoveTask(t *testing.T) {
+	var table = []struct {
+		Key         string
+		Id          string
+		Result      float64
+		Status      string
+		BrokerErr   *jrpc2.ErrorObject
+		ModelErr    error
+		QueryResult []interface{}
+		QueryErr    error
+		Staged      bool
+		Err         error
+	}{
+		{
+			"test123",
+			"abc123",
+			0,
+			StatusCancelled,
+			nil,
+			nil,
+			[]interface{}{&Task{Key: "test123", Id: "abc123", Status: StatusQueued}},
+			nil,
+			false,
+			nil,
+		},
+		{
+			"test123",
+			"abc123",
+			0,
+			StatusCancelled,
+			nil,
+			nil,
+			[]interface{}{&Task{Key: "test123", Id: "abc123", Status: StatusScheduled}},
+			nil,
+			false,
+			nil,
+		},
+		{
+			"test123",
+			"abc123",
+			0,
+			StatusCancelled,
+			nil,
+			nil,
+			[]interface{}{&Task{Key: "test123", Id: "abc123", Status: StatusPending}},
+			nil,
+			true,
+			nil,
+		},
+		{
+			"test123",
+			"abc123",
+			0,
+			StatusStarted,
+			nil,
+			nil,
+			[]interface{}{&Task{Key: "test123", Id: "abc123", Status: StatusStarted}},
+			nil,
+			false,
+			TaskRemoveFailedError,
+		},
+		{
+			"test123",
+			"abc123",
+			-1,
+			StatusStarted,
+			nil,
+			nil,
+			[]interface{}{&Task{Key: "test123", Id: "abc123", Status: StatusPending}},
+			nil,
+			false,
+			TaskRemoveFailedError,
+		},
+		{
+			"test123",
+			"abc123",
+			0,
+			StatusStarted,
+			nil,
+			nil,
+			[]interface{}{},
+			nil,
+			false,
+			TaskNotFoundError,
+		},
+		{
+			"test123",
+			"abc123",
+			0,
+			StatusStarted,
+			nil,
+			nil,
+			[]interface{}{},
+			errors.New("query error"),
+			false,
+			errors.New("query error"),
+		},
+		{
+			"test123",
+			"abc123",
+			0,
+			StatusStarted,
+			nil,
+			errors.New("model error"),
+			[]interface{}{&Task{Key: "test123", Id: "abc123", Status: StatusQueued}},
+			nil,
+			false,
+			errors.New("model error"),
+		},
+		{
+			"test123",
+			"abc123",
+			0,
+			StatusCancelled,
+			nil,
+			nil,
+			[]interface{}{&Task{Key: "test123", Id: "abc123", Status: StatusPending}},
+			nil,
+			true,
+			nil,
+		},
+	}
+
+	for _, tt := range table {
+		model := new(MockModel)
+		model.On("Get", tt.Id).Return(firstDoc(tt.QueryResult), tt.QueryErr).Maybe()
+		model.On("Remove", mock.AnythingOfType("*main.Task")).Return(tt.ModelErr).Maybe()
+		archiveModel := new(MockModel)
+		archiveModel.On("Save", mock.MatchedBy(func(a *ArchivedTask) bool {
+			return a.Id == tt.Id && a.Status == StatusCancelled && a.RemovedReason == "duplicate"
+		})).Return(DocumentMeta{}, nil).Maybe()
+		broker := new(MockServiceBroker)
+		broker.On(
+			"Call",
+			mock.Anything,
+			StatusChangeNotifierHost,
+			"notify",
+			mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
+		).Return(float64(0), nil).Maybe()
+		params := map[string]interface{}{"key": tt.Key, "id": tt.Id}
+		broker.On("Call", mock.Anything, TimetableHost, "remove", params).Return(tt.Result, tt.BrokerErr).Maybe()
+		broker.On("Call", mock.Anything, PriorityQueueHost, "remove", params).Return(tt.Result, tt.BrokerErr).Maybe()
+		ctrl := NewResourceController(broker)
+		if tt.Staged {
+			ctrl.stage.Store(tt.Key, NewStagedSlot(time.Now(), tt.QueryResult[0].(*Task)))
+		}
+		model.On("Query", dependentsQuery, mock.Anything).Return(nil, nil).Maybe()
+		if err := ctrl.RemoveTask(tt.Id, "duplicate", model, archiveModel); err != nil && err.Error() != tt.Err.Error() {
+			t.Fatal(err)
+		}
+		if tt.Staged {
+			if err := ctrl.StartTask(tt.Key, "", model, new(MockModel)); err != NoStagedTaskError {
+				t.Fatalf("expected the removed task to be unstaged, got %v", err)
+			}
+		}
+		broker.AssertExpectations(t)
+		model.AssertExpectations(t)
+	}
+}
+
+func TestControllerUpdateTaskPriority(t *testing.T) {
+	var table = []struct {
+		Tasks        []interface{}
+		RemoveResult interface{}
+		RemoveErr    *jrpc2.ErrorObject
+		PushResult   interface{}
+		PushErr      *jrpc2.ErrorObject
+		ModelErr     error
+		Priority     float64
+		Err          error
+	}{
+		{
+			[]interface{}{&Task{Id: "abc123", Key: "test", Priority: 2.5, Status: StatusQueued}},
+			float64(0),
+			nil,
+			float64(0),
+			nil,
+			nil,
+			0.5,
+			nil,
+		},
+		{
+			[]interface{}{},
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+			0,
+			TaskNotFoundError,
+		},
+		{
+			[]interface{}{&Task{Id: "abc123", Key: "test", Priority: 2.5, Status: StatusStarted}},
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+			2.5,
+			TaskNotQueuedError,
+		},
+		{
+			[]interface{}{&Task{Id: "abc123", Key: "test", Priority: 2.5, Status: StatusQueued}},
+			float64(-1),
+			nil,
+			nil,
+			nil,
+			nil,
+			2.5,
+			TaskUpdateFailedError,
+		},
+		{
+			[]interface{}{&Task{Id: "abc123", Key: "test", Priority: 2.5, Status: StatusQueued}},
+			float64(0),
+			nil,
+			nil,
+			&jrpc2.ErrorObject{Message: "broker error"},
+			nil,
+			2.5,
+			errors.New("broker error"),
+		},
+		{
+			[]interface{}{&Task{Id: "abc123", Key: "test", Priority: 2.5, Status: StatusQueued}},
+			float64(0),
+			nil,
+			float64(0),
+			nil,
+			errors.New("model error"),
+			0.5,
+			errors.New("model error"),
+		},
+	}
+
+	for i, tt := range table {
+		broker := new(MockServiceBroker)
+		broker.On(
+			"Call",
+			mock.Anything,
+			StatusChangeNotifierHost,
+			"notify",
+			mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
+		).Return(float64(0), nil).Maybe()
+		params := map[string]interface{}{"key": "test", "id": "abc123"}
+		broker.On("Call", mock.Anything, PriorityQueueHost, "remove", params).Return(tt.RemoveResult, tt.RemoveErr).Maybe()
+		pushParams := map[string]interface{}{"key": "test", "id": "abc123", "priority": 0.5}
+		broker.On("Call", mock.Anything, PriorityQueueHost, "push", pushParams).Return(tt.PushResult, tt.PushErr).Maybe()
+		restoreParams := map[string]interface{}{"key": "test", "id": "abc123", "priority": 2.5}
+		broker.On("Call", mock.Anything, PriorityQueueHost, "push", restoreParams).Return(float64(0), nil).Maybe()
+		model := new(MockModel)
+		model.On("Get", "abc123").Return(firstDoc(tt.Tasks), nil).Once()
+		model.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, tt.ModelErr).Maybe()
+		ctrl := NewResourceController(broker)
+		if err := ctrl.UpdateTaskPriority("abc123", 0.5, model); err != nil && err.Error() != tt.Err.Error() {
+			t.Fatal(err)
+		}
+		if len(tt.Tasks) > 0 && tt.Tasks[0].(*Task).Priority != tt.Priority {
+			t.Fatalf("[%d] expected task priority to be %f, got %f", i, tt.Priority, tt.Tasks[0].(*Task).Priority)
+		}
+		broker.AssertExpectations(t)
+		model.AssertExpectations(t)
+	}
+}
+
+func TestControllerRetryTask(t *testing.T) {
+	var table = []struct {
+		Tasks     []interface{}
+		Result    interface{}
+		BrokerErr *jrpc2.ErrorObject
+		Status    string
+		Attempts  int
+		Err       error
+	}{
+		{
+			[]interface{}{&Task{Id: "abc123", Key: "test", Priority: 2.5, Status: StatusError}},
+			float64(0),
+			nil,
+			StatusQueued,
+			1,
+			nil,
+		},
+		{
+			[]interface{}{&Task{Id: "abc123", Key: "test", Priority: 2.5, Status: StatusCancelled, Attempts: 1}},
+			float64(0),
+			nil,
+			StatusQueued,
+			2,
+			nil,
+		},
+		{
+			[]interface{}{},
+			nil,
+			nil,
+			"",
+			0,
+			TaskNotFoundError,
+		},
+		{
+			[]interface{}{&Task{Id: "abc123", Key: "test", Priority: 2.5, Status: StatusComplete}},
+			nil,
+			nil,
+			StatusComplete,
+			0,
+			TaskNotRetryableError,
+		},
+		{
+			[]interface{}{&Task{Id: "abc123", Key: "test", Priority: 2.5, Status: StatusError}},
+			float64(-1),
+			nil,
+			StatusError,
+			0,
+			TaskAddFailedError,
+		},
+		{
+			[]interface{}{&Task{Id: "abc123", Key: "test", Priority: 2.5, Status: StatusError}},
+			nil,
+			&jrpc2.ErrorObject{Message: "broker error"},
+			StatusError,
+			0,
+			errors.New("broker error"),
+		},
+	}
+
+	for i, tt := range table {
+		broker := new(MockServiceBroker)
+		broker.On(
+			"Call",
+			mock.Anything,
+			StatusChangeNotifierHost,
+			"notify",
+			mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
+		).Return(float64(0), nil).Maybe()
+		params := map[string]interface{}{"key": "test", "id": "abc123", "priority": 2.5}
+		broker.On("Call", mock.Anything, PriorityQueueHost, "push", params).Return(tt.Result, tt.BrokerErr).Maybe()
+		model := new(MockModel)
+		model.On("Get", "abc123").Return(firstDoc(tt.Tasks), nil).Once()
+		model.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, nil).Maybe()
+		ctrl := NewResourceController(broker)
+		if err := ctrl.RetryTask("abc123", model); err != nil && err.Error() != tt.Err.Error() {
+			t.Fatal(err)
+		}
+		if len(tt.Tasks) > 0 {
+			task := tt.Tasks[0].(*Task)
+			if task.Status != tt.Status || task.Attempts != tt.Attempts {
+				t.Fatalf("[%d] expected task %s/%d, got %s/%d", i, tt.Status, tt.Attempts, task.Status, task.Attempts)
+			}
+		}
+		broker.AssertExpectations(t)
+		model.AssertExpectations(t)
+	}
+}
+
+func TestControllerRescheduleTask(t *testing.T) {
+	runAt := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	prevRunAt := time.Date(2018, 1, 1, 8, 0, 0, 0, time.UTC)
+	var table = []struct {
+		Tasks        []interface{}
+		RemoveResult interface{}
+		InsertResult interface{}
+		InsertErr    *jrpc2.ErrorObject
+		ModelErr     error
+		RunAt        time.Time
+		Err          error
+	}{
+		{
+			[]interface{}{&Task{Id: "abc123", Key: "test", RunAt: &prevRunAt, Status: StatusScheduled}},
+			float64(0),
+			float64(0),
+			nil,
+			nil,
+			runAt,
+			nil,
+		},
+		{
+			[]interface{}{},
+			nil,
+			nil,
+			nil,
+			nil,
+			runAt,
+			TaskNotFoundError,
+		},
+		{
+			[]interface{}{&Task{Id: "abc123", Key: "test", RunAt: &prevRunAt, Status: StatusQueued}},
+			nil,
+			nil,
+			nil,
+			nil,
+			prevRunAt,
+			TaskNotScheduledError,
+		},
+		{
+			[]interface{}{&Task{Id: "abc123", Key: "test", RunAt: &prevRunAt, Status: StatusScheduled}},
+			float64(-1),
+			nil,
+			nil,
+			nil,
+			prevRunAt,
+			TaskUpdateFailedError,
+		},
+		{
+			[]interface{}{&Task{Id: "abc123", Key: "test", RunAt: &prevRunAt, Status: StatusScheduled}},
+			float64(0),
+			float64(-1),
+			nil,
+			nil,
+			prevRunAt,
+			TaskUpdateFailedError,
+		},
+		{
+			[]interface{}{&Task{Id: "abc123", Key: "test", RunAt: &prevRunAt, Status: StatusScheduled}},
+			float64(0),
+			nil,
+			&jrpc2.ErrorObject{Message: "broker error"},
+			nil,
+			prevRunAt,
+			errors.New("broker error"),
+		},
+	}
+
+	for i, tt := range table {
+		broker := new(MockServiceBroker)
+		broker.On(
+			"Call",
+			mock.Anything,
+			StatusChangeNotifierHost,
+			"notify",
+			mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
+		).Return(float64(0), nil).Maybe()
+		params := map[string]interface{}{"key": "test", "id": "abc123"}
+		broker.On("Call", mock.Anything, TimetableHost, "remove", params).Return(tt.RemoveResult, nil).Maybe()
+		insertParams := map[string]interface{}{"key": "test", "id": "abc123", "runAt": runAt.Format(time.RFC3339)}
+		broker.On("Call", mock.Anything, TimetableHost, "insert", insertParams).Return(tt.InsertResult, tt.InsertErr).Maybe()
+		restoreParams := map[string]interface{}{"key": "test", "id": "abc123", "runAt": prevRunAt.Format(time.RFC3339)}
+		broker.On("Call", mock.Anything, TimetableHost, "insert", restoreParams).Return(float64(0), nil).Maybe()
+		model := new(MockModel)
+		model.On("Get", "abc123").Return(firstDoc(tt.Tasks), nil).Once()
+		model.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, tt.ModelErr).Maybe()
+		ctrl := NewResourceController(broker)
+		if err := ctrl.RescheduleTask("abc123", runAt, model); err != nil && err.Error() != tt.Err.Error() {
+			t.Fatal(err)
+		}
+		if len(tt.Tasks) > 0 && !tt.Tasks[0].(*Task).RunAt.Equal(tt.RunAt) {
+			t.Fatalf("[%d] expected task run at to be %s, got %s", i, tt.RunAt, tt.Tasks[0].(*Task).RunAt)
+		}
+		broker.AssertExpectations(t)
+		model.AssertExpectations(t)
+	}
+}
+
+func TestControllerGetTaskHistory(t *testing.T) {
+	var table = []struct {
+		TaskId   string
+		Entries  []interface{}
+		ModelErr error
+		Count    int
+		Err      error
+	}{
+		{
+			"abc123",
+			[]interface{}{
+				NewTaskHistory("abc123", "", StatusCreated, "task added"),
+				NewTaskHistory("abc123", StatusCreated, StatusQueued, "task submitted"),
+			},
+			nil,
+			2,
+			nil,
+		},
+		{
+			"abc123",
+			nil,
+			errors.New("query error"),
+			0,
+			errors.New("query error"),
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf(`FOR h IN %s FILTER h.taskId == @taskId SORT h.created ASC RETURN h`, CollectionTaskHistory)
+		model := new(MockModel)
+		model.On("Query", q, map[string]interface{}{"taskId": tt.TaskId}).Return(tt.Entries, tt.ModelErr).Once()
+		ctrl := NewResourceController(nil)
+		history, err := ctrl.GetTaskHistory(tt.TaskId, model)
+		if err != nil && err.Error() != tt.Err.Error() {
+			t.Fatal(err)
+		}
+		if len(history) != tt.Count {
+			t.Fatalf("expected %d history entries, got %d", tt.Count, len(history))
+		}
+		model.AssertExpectations(t)
+	}
+}
+
+func TestControllerRecordTransition(t *testing.T) {
+	broker := new(MockServiceBroker)
+	broker.On(
+		"Call",
+		mock.Anything,
+		StatusChangeNotifierHost,
+		"notify",
+		mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
+	).Return(float64(0), nil).Maybe()
+	params := map[string]interface{}{"key": "test", "id": "abc123", "priority": 2.5}
+	broker.On("Call", mock.Anything, PriorityQueueHost, "push", params).Return(float64(0), nil).Once()
+	model := new(MockModel)
+	task := &Task{Id: "abc123", Key: "test", Priority: 2.5, Status: StatusError}
+	model.On("Get", "abc123").Return(task, nil).Once()
+	model.On("Save", task).Return(DocumentMeta{}, nil).Once()
+	historyModel := new(MockModel)
+	historyModel.On("Save", mock.MatchedBy(func(h *TaskHistory) bool {
+		return h.TaskId == "abc123" && h.From == StatusError && h.To == StatusQueued && h.Reason == "task retried"
+	})).Return(DocumentMeta{}, nil).Once()
+	ctrl := NewResourceController(broker)
+	ctrl.RecordHistory(historyModel)
+	if err := ctrl.RetryTask("abc123", model); err != nil {
+		t.Fatal(err)
+	}
+	broker.AssertExpectations(t)
+	model.AssertExpectations(t)
+	historyModel.AssertExpectations(t)
+}
+
+func TestControllerGetTaskStats(t *testing.T) {
+	var table = []struct {
+		TaskStats []interface{}
+		ModelErr  error
+		Stats     *TaskStats
+		Err       error
+	}{
+		{
+			[]interface{}{
+				NewTaskStat("test", 2.0),
+				NewTaskStat("test", 1.0),
+				NewTaskStat("test", 6.0),
+			},
+			nil,
+			&TaskStats{Average: 3.0, Count: 3, Key: "test", Max: 6.0, Min: 1.0},
+			nil,
+		},
+		{
+			[]interface{}{},
+			nil,
+			&TaskStats{Key: "test"},
+			nil,
+		},
+		{
+			nil,
+			errors.New("query error"),
+			nil,
+			errors.New("query error"),
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf(`FOR t IN %s FILTER t.key == @key RETURN t`, CollectionTaskStats)
+		model := new(MockModel)
+		model.On("Query", q, map[string]interface{}{"key": "test"}).Return(tt.TaskStats, tt.ModelErr).Once()
+		ctrl := NewResourceController(nil)
+		stats, err := ctrl.GetTaskStats("test", model)
+		if err != nil && err.Error() != tt.Err.Error() {
+			t.Fatal(err)
+		}
+		if tt.Stats != nil && *stats != *tt.Stats {
+			t.Fatalf("expected stats %+v, got %+v", tt.Stats, stats)
+		}
+		model.AssertExpectations(t)
+	}
+}
+
+func TestControllerHealth(t *testing.T) {
+	var table = []struct {
+		BrokerErr *jrpc2.ErrorObject
+		Unhealthy int
+	}{
+		{nil, 0},
+		{&jrpc2.ErrorObject{Code: jrpc2.MethodNotFoundCode, Message: jrpc2.MethodNotFoundMsg}, 0},
+		{&jrpc2.ErrorObject{Code: BrokerCallErrorCode, Message: jrpc2.ServerErrorMsg, Data: "connection refused"}, 3},
+	}
+
+	for _, tt := range table {
+		broker := new(MockServiceBroker)
+		broker.On("Call", mock.Anything, mock.Anything, "health", map[string]interface{}{}).Return(nil, tt.BrokerErr).Times(3)
+		ctrl := NewResourceController(broker)
+		health := ctrl.Health()
+		if len(health) != 3 {
+			t.Fatalf("expected 3 dependencies, got %d", len(health))
+		}
+		unhealthy := 0
+		for _, status := range health {
+			if !status.Healthy {
+				unhealthy++
+				if status.Error != "connection refused" {
+					t.Fatalf("expected error to be 'connection refused', got '%s'", status.Error)
+				}
+			}
+		}
+		if unhealthy != tt.Unhealthy {
+			t.Fatalf("expected %d unhealthy dependencies, got %d", tt.Unhealthy, unhealthy)
+		}
+		broker.AssertExpectations(t)
+	}
+}
+
+func TestControllerServerInfo(t *testing.T) {
+	ctrl := NewResourceController(nil)
+	ctrl.resources["test"] = NewResource("test")
+	info := ctrl.ServerInfo()
+	if info.ResourceCount != 1 {
+		t.Fatalf("expected resource count to be 1, got %d", info.ResourceCount)
+	}
+	if info.StageInterval != StageInterval.Seconds() {
+		t.Fatalf("expected stage interval to be %v, got %v", StageInterval.Seconds(), info.StageInterval)
+	}
+	if info.Version != Version || info.BuildCommit != BuildCommit {
+		t.Fatalf("expected version %s/%s, got %s/%s", Version, BuildCommit, info.Version, info.BuildCommit)
+	}
+	if info.PriorityQueueHost != PriorityQueueHost || info.TimetableHost != TimetableHost {
+		t.Fatal("expected configured hosts to be reported")
+	}
+}
+
+func TestControllerPurgeTasks(t *testing.T) {
+	var table = []struct {
+		Tasks    []interface{}
+		ModelErr error
+		Count    int
+		Err      error
+	}{
+		{
+			[]interface{}{&Task{Id: "abc123", Status: StatusComplete}, &Task{Id: "def456", Status: StatusCancelled}},
+			nil,
+			2,
+			nil,
+		},
+		{
+			[]interface{}{},
+			nil,
+			0,
+			nil,
+		},
+		{
+			nil,
+			errors.New("query error"),
+			0,
+			errors.New("query error"),
+		},
+	}
+
+	for _, tt := range table {
+		q := fmt.Sprintf(
+			`FOR t IN %s FILTER t.status IN @statuses AND DATE_TIMESTAMP(t.created) < @before LIMIT @limit REMOVE t IN %s RETURN OLD`,
+			CollectionTasks,
+			CollectionTasks,
+		)
+		before := time.Now().Add(-time.Hour).UnixNano() / int64(time.Millisecond)
+		model := new(MockModel)
+		model.On("Query", q, mock.MatchedBy(func(vars map[string]interface{}) bool {
+			statuses := vars["statuses"].([]string)
+			return vars["limit"] == 50 &&
+				vars["before"].(int64) >= before &&
+				len(statuses) == 2 && statuses[0] == StatusComplete && statuses[1] == StatusCancelled
+		})).Return(tt.Tasks, tt.ModelErr).Once()
+		ctrl := NewResourceController(nil)
+		count, err := ctrl.PurgeTasks(time.Hour, 50, model)
+		if err != nil && err.Error() != tt.Err.Error() {
+			t.Fatal(err)
+		}
+		if count != tt.Count {
+			t.Fatalf("expected %d purged tasks, got %d", tt.Count, count)
+		}
+		model.AssertExpectations(t)
+	}
+}
+
+func TestControllerSearchTasks(t *testing.T) {
+	var table = []struct {
+		Filters  map[string]interface{}
+		Labels   map[string]string
+		Query    string
+		Vars     map[string]interface{}
+		Tasks    []interface{}
+		ModelErr error
+		Err      error
+	}{
+		{
+			map[string]interface{}{"order.id": "A-1001"},
+			nil,
+			fmt.Sprintf("FOR t IN %s FILTER t.meta[@f0_0][@f0_1] == @v0 SORT t.created ASC LIMIT @offset, @limit RETURN t", CollectionTasks),
+			map[string]interface{}{"f0_0": "order", "f0_1": "id", "v0": "A-1001"},
+			[]interface{}{&Task{Id: "abc123"}},
+			nil,
+			nil,
+		},
+		{
+			map[string]interface{}{"region": "eu", "customer": 12.0},
+			nil,
+			fmt.Sprintf("FOR t IN %s FILTER t.meta[@f0_0] == @v0 FILTER t.meta[@f1_0] == @v1 SORT t.created ASC LIMIT @offset, @limit RETURN t", CollectionTasks),
+			map[string]interface{}{"f0_0": "customer", "v0": 12.0, "f1_0": "region", "v1": "eu"},
+			[]interface{}{&Task{Id: "abc123"}, &Task{Id: "xyz789"}},
+			nil,
+			nil,
+		},
+		{
+			map[string]interface{}{"id": "A-1001"},
+			nil,
+			fmt.Sprintf("FOR t IN %s FILTER t.meta[@f0_0] == @v0 SORT t.created ASC LIMIT @offset, @limit RETURN t", CollectionTasks),
+			map[string]interface{}{"f0_0": "id", "v0": "A-1001"},
+			nil,
+			errors.New("query error"),
+			errors.New("query error"),
+		},
+		{
+			map[string]interface{}{"region": "eu"},
+			map[string]string{"team": "data"},
+			fmt.Sprintf("FOR t IN %s FILTER t.meta[@f0_0] == @v0 FILTER @l0 IN t.labelIndex SORT t.created ASC LIMIT @offset, @limit RETURN t", CollectionTasks),
+			map[string]interface{}{"f0_0": "region", "v0": "eu", "l0": "team=data"},
+			[]interface{}{&Task{Id: "abc123"}},
+			nil,
+			nil,
+		},
+	}
+
+	for _, tt := range table {
+		model := new(MockModel)
+		var result *Page
+		if tt.Tasks != nil {
+			result = &Page{Docs: tt.Tasks, Total: int64(len(tt.Tasks))}
+		}
+		model.On("QueryPage", tt.Query, tt.Vars, 0, 10).Return(result, tt.ModelErr).Once()
+		ctrl := NewResourceController(nil)
+		page, err := ctrl.SearchTasks(tt.Filters, tt.Labels, 10, 0, model)
+		if err != nil && err.Error() != tt.Err.Error() {
+			t.Fatal(err)
+		}
+		if page != nil && len(page.Tasks) != len(tt.Tasks) {
+			t.Fatalf("expected %d tasks, got %d", len(tt.Tasks), len(page.Tasks))
+		}
+		model.AssertExpectations(t)
+	}
+}
+
+func TestControllerListTasksCursor(t *testing.T) {
+	var table = []struct {
+		Offset int
+		Docs   int
+		Total  int64
+		Cursor string
+	}{
+		{0, 10, 25, PageCursor(10)},
+		{10, 10, 25, PageCursor(20)},
+		{20, 5, 25, ""},
+		{0, 0, 0, ""},
+	}
+
+	for i, tt := range table {
+		docs := make([]interface{}, tt.Docs)
+		for j := range docs {
+			docs[j] = &Task{Id: fmt.Sprint(tt.Offset + j)}
+		}
+		model := new(MockModel)
+		model.On("QueryPage", mock.Anything, mock.Anything, tt.Offset, 10).Return(&Page{Docs: docs, Total: tt.Total}, nil)
+		ctrl := NewResourceController(nil)
+		page, err := ctrl.ListTasks("", "", nil, 10, tt.Offset, model)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Total != tt.Total || page.Cursor != tt.Cursor {
+			t.Fatalf("[%d] expected total %d and cursor %q, got %d and %q", i, tt.Total, tt.Cursor, page.Total, page.Cursor)
+		}
+	}
+}
+
+func TestControllerGetStagedTask(t *testing.T) {
+	var table = []struct {
+		Key   string
+		Stage []*Task
+		Id    string
+		Err   error
+	}{
+		{"test", []*Task{{Id: "abc123", Key: "test", Meta: []byte(`{"order":"A-1001"}`)}}, "abc123", nil},
+		{"test", []*Task{}, "", NoStagedTaskError},
+		{"test", nil, "", NoStagedTaskError},
+	}
+
+	for _, tt := range table {
+		ctrl := NewResourceController(nil)
+		if tt.Stage != nil {
+			ctrl.stage.Store(tt.Key, NewStagedSlot(time.Now().Add(-time.Minute), tt.Stage...))
+		}
+		staged, err := ctrl.GetStagedTask(tt.Key)
+		if err != tt.Err {
+			t.Fatalf("expected error %v, got %v", tt.Err, err)
+		}
+		if staged == nil {
+			continue
+		}
+		if staged.Id != tt.Id || staged.Key != tt.Key {
+			t.Fatalf("expected staged task %s/%s, got %s/%s", tt.Id, tt.Key, staged.Id, staged.Key)
+		}
+		if staged.StagedFor < 60 {
+			t.Fatalf("expected task to be staged for at least 60 seconds, got %v", staged.StagedFor)
+		}
+		slot, _ := ctrl.stagedSlot(tt.Key)
+		if tasks := slot.Tasks(); len(tasks) == 0 || tasks[0].Id != tt.Id {
+			t.Fatal("expected staged task to remain in the stage")
+		}
+	}
+}
+
+func TestControllerUnstageTask(t *testing.T) {
+	runAt := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	var table = []struct {
+		Task      *Task
+		Host      string
+		Method    string
+		Params    map[string]interface{}
+		Result    interface{}
+		BrokerErr *jrpc2.ErrorObject
+		Status    string
+		Staged    bool
+		Err       error
+	}{
+		{
+			&Task{Id: "abc123", Key: "test", Priority: 2.5, Status: StatusPending},
+			PriorityQueueHost,
+			"push",
+			map[string]interface{}{"key": "test", "id": "abc123", "priority": 2.5},
+			float64(0),
+			nil,
+			StatusQueued,
+			false,
+			nil,
+		},
+		{
+			&Task{Id: "abc123", Key: "test", RunAt: &runAt, Status: StatusPending},
+			TimetableHost,
+			"insert",
+			map[string]interface{}{"key": "test", "id": "abc123", "runAt": runAt.Format(time.RFC3339)},
+			float64(0),
+			nil,
+			StatusScheduled,
+			false,
+			nil,
+		},
+		{
+			&Task{Id: "abc123", Key: "test", Priority: 2.5, Status: StatusPending},
+			PriorityQueueHost,
+			"push",
+			map[string]interface{}{"key": "test", "id": "abc123", "priority": 2.5},
+			float64(-1),
+			nil,
+			StatusPending,
+			true,
+			TaskAddFailedError,
+		},
+		{
+			nil,
+			"",
+			"",
+			nil,
+			nil,
+			nil,
+			"",
+			false,
+			NoStagedTaskError,
+		},
+	}
+
+	for i, tt := range table {
+		broker := new(MockServiceBroker)
+		broker.On(
+			"Call",
+			mock.Anything,
+			StatusChangeNotifierHost,
+			"notify",
+			mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
+		).Return(float64(0), nil).Maybe()
+		if tt.Params != nil {
+			broker.On("Call", mock.Anything, tt.Host, tt.Method, tt.Params).Return(tt.Result, tt.BrokerErr).Once()
+		}
+		model := new(MockModel)
+		model.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, nil).Maybe()
+		ctrl := NewResourceController(broker)
+		ctrl.resources["test"] = &Resource{Name: "test", TaskId: "abc123"}
+		if tt.Task != nil {
+			ctrl.stage.Store("test", NewStagedSlot(time.Now(), tt.Task))
+		}
+		if err := ctrl.UnstageTask("test", model); err != tt.Err {
+			t.Fatalf("[%d] expected error %v, got %v", i, tt.Err, err)
+		}
+		if tt.Task == nil {
+			continue
+		}
+		if tt.Task.Status != tt.Status {
+			t.Fatalf("[%d] expected task status %s, got %s", i, tt.Status, tt.Task.Status)
+		}
+		if _, ok := ctrl.stage.Load("test"); ok != tt.Staged {
+			t.Fatalf("[%d] expected staged to be %v", i, tt.Staged)
+		}
+		if !tt.Staged && ctrl.resources["test"].TaskId != "" {
+			t.Fatalf("[%d] expected resource task id to be cleared", i)
+		}
+		broker.AssertExpectations(t)
+		model.AssertExpectations(t)
+	}
+}
+
+func TestControllerForceCompleteTask(t *testing.T) {
+	lockedAt := time.Now()
+	var table = []struct {
+		Tasks    []interface{}
+		Status   string
+		Method   string
+		Resource *Resource
+		Staged   bool
+		Err      error
+	}{
+		{
+			[]interface{}{&Task{Id: "abc123", Key: "test", Status: StatusStarted}},
+			StatusComplete,
+			"",
+			&Resource{Name: "test", Status: ResourceLocked, TaskId: "abc123", LockedAt: &lockedAt},
+			false,
+			nil,
+		},
+		{
+			[]interface{}{&Task{Id: "abc123", Key: "test", Status: StatusQueued}},
+			StatusCancelled,
+			"remove",
+			&Resource{Name: "test", Status: ResourceFree},
+			false,
+			nil,
+		},
+		{
+			[]interface{}{&Task{Id: "abc123", Key: "test", Status: StatusPending}},
+			StatusCancelled,
+			"",
+			&Resource{Name: "test", Status: ResourceFree, TaskId: "abc123"},
+			true,
+			nil,
+		},
+		{
+			[]interface{}{},
+			StatusComplete,
+			"",
+			&Resource{Name: "test", Status: ResourceFree},
+			false,
+			TaskNotFoundError,
+		},
+	}
+
+	for i, tt := range table {
+		broker := new(MockServiceBroker)
+		broker.On(
+			"Call",
+			mock.Anything,
+			StatusChangeNotifierHost,
+			"notify",
+			mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
+		).Return(float64(0), nil).Maybe()
+		if tt.Method != "" {
+			params := map[string]interface{}{"key": "test", "id": "abc123"}
+			broker.On("Call", mock.Anything, PriorityQueueHost, tt.Method, params).Return(float64(0), nil).Once()
+		}
+		taskModel := new(MockModel)
+		taskModel.On("Get", "abc123").Return(firstDoc(tt.Tasks), nil).Once()
+		taskModel.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, nil).Maybe()
+		rescModel := new(MockModel)
+		rescModel.On("Save", tt.Resource).Return(DocumentMeta{}, nil).Maybe()
+		historyModel := new(MockModel)
+		historyModel.On("Save", mock.MatchedBy(func(h *TaskHistory) bool {
+			return h.Reason == "task force completed: worker crashed"
+		})).Return(DocumentMeta{}, nil).Maybe()
+		ctrl := NewResourceController(broker)
+		ctrl.RecordHistory(historyModel)
+		ctrl.resources["test"] = tt.Resource
+		if tt.Staged {
+			ctrl.stage.Store("test", NewStagedSlot(time.Now(), tt.Tasks[0].(*Task)))
+		}
+		taskModel.On("Query", dependentsQuery, mock.Anything).Return(nil, nil).Maybe()
+		if err := ctrl.ForceCompleteTask("abc123", tt.Status, "worker crashed", taskModel, rescModel); err != tt.Err {
+			t.Fatalf("[%d] expected error %v, got %v", i, tt.Err, err)
+		}
+		if tt.Err != nil {
+			continue
+		}
+		if task := tt.Tasks[0].(*Task); task.Status != tt.Status {
+			t.Fatalf("[%d] expected task status %s, got %s", i, tt.Status, task.Status)
+		}
+		if tt.Resource.Status != ResourceFree || tt.Resource.TaskId != "" || tt.Resource.LockedAt != nil {
+			t.Fatalf("[%d] expected resource to be released", i)
+		}
+		if _, ok := ctrl.stage.Load("test"); ok {
+			t.Fatalf("[%d] expected stage to be empty", i)
+		}
+		broker.AssertExpectations(t)
+		taskModel.AssertExpectations(t)
+		historyModel.AssertExpectations(t)
+	}
+}
+
+func TestControllerCountTasks(t *testing.T) {
+	var table = []struct {
+		ByKey    bool
+		Query    string
+		Counts   []interface{}
+		ModelErr error
+		Err      error
+	}{
+		{
+			false,
+			fmt.Sprintf("FOR t IN %s COLLECT status = t.status WITH COUNT INTO count RETURN {status, count}", CollectionTasks),
+			[]interface{}{&TaskCount{Count: 3, Status: StatusQueued}, &TaskCount{Count: 1, Status: StatusStarted}},
+			nil,
+			nil,
+		},
+		{
+			true,
+			fmt.Sprintf("FOR t IN %s COLLECT status = t.status, key = t.key WITH COUNT INTO count RETURN {status, key, count}", CollectionTasks),
+			[]interface{}{&TaskCount{Count: 3, Key: "test", Status: StatusQueued}},
+			nil,
+			nil,
+		},
+		{
+			false,
+			fmt.Sprintf("FOR t IN %s COLLECT status = t.status WITH COUNT INTO count RETURN {status, count}", CollectionTasks),
+			nil,
+			errors.New("query error"),
+			errors.New("query error"),
+		},
+	}
+
+	for _, tt := range table {
+		model := new(MockModel)
+		model.On("Query", tt.Query, map[string]interface{}{}).Return(tt.Counts, tt.ModelErr).Once()
+		ctrl := NewResourceController(nil)
+		counts, err := ctrl.CountTasks(tt.ByKey, model)
+		if err != nil && err.Error() != tt.Err.Error() {
+			t.Fatal(err)
+		}
+		if len(counts) != len(tt.Counts) {
+			t.Fatalf("expected %d counts, got %d", len(tt.Counts), len(counts))
+		}
+		model.AssertExpectations(t)
+	}
+}
+
+func TestControllerCompleteTaskRetry(t *testing.T) {
+	var table = []struct {
+		Task     *Task
+		Retry    bool
+		Status   string
+		Attempts int
+	}{
+		{&Task{Id: "abc123", Key: "test", Status: StatusStarted, MaxAttempts: 3, Backoff: 30}, true, StatusScheduled, 1},
+		{&Task{Id: "abc123", Key: "test", Status: StatusStarted, MaxAttempts: 3, Attempts: 2}, false, StatusError, 2},
+	}
+
+	for i, tt := range table {
+		broker := new(MockServiceBroker)
+		broker.On(
+			"Call",
+			mock.Anything,
+			StatusChangeNotifierHost,
+			"notify",
+			mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
+		).Return(float64(0), nil).Maybe()
+		if tt.Retry {
+			broker.On("Call", mock.Anything, TimetableHost, "insert", mock.MatchedBy(func(p map[string]interface{}) bool {
+				return p["id"] == "abc123" && p["runAt"] != nil
+			})).Return(float64(0), nil).Once()
+		} else {
+			broker.On(
+				"Call",
+				mock.Anything,
+				StatusChangeNotifierHost,
+				"notify",
+				mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == TaskFailedEvent }),
+			).Return(float64(0), nil).Once()
+		}
+		taskModel := new(MockModel)
+		taskModel.On("Get", "abc123").Return(tt.Task, nil).Once()
+		taskModel.On("Save", tt.Task).Return(DocumentMeta{}, nil)
+		rescModel := new(MockModel)
+		rescModel.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, nil).Once()
+		ctrl := NewResourceController(broker)
+		ctrl.resources["test"] = &Resource{Name: "test", Status: ResourceLocked, TaskId: "abc123"}
+		taskModel.On("Query", dependentsQuery, mock.Anything).Return(nil, nil).Maybe()
+		if err := ctrl.CompleteTask("abc123", StatusError, nil, "", false, taskModel, rescModel); err != nil {
+			t.Fatal(err)
+		}
+		if tt.Task.Status != tt.Status || tt.Task.Attempts != tt.Attempts {
+			t.Fatalf("[%d] expected task %s/%d, got %s/%d", i, tt.Status, tt.Attempts, tt.Task.Status, tt.Task.Attempts)
+		}
+		if tt.Retry && (tt.Task.RunAt == nil || tt.Task.RunAt.Before(time.Now().Add(time.Second*29))) {
+			t.Fatalf("[%d] expected task to be scheduled in 30 seconds", i)
+		}
+		broker.AssertExpectations(t)
+		taskModel.AssertExpectations(t)
+	}
+}
+
+func TestControllerAddTaskDependencies(t *testing.T) {
+	var table = []struct {
+		Parents []interface{}
+		Status  string
+		Err     error
+	}{
+		{[]interface{}{&Task{Id: "a", Status: StatusComplete}, &Task{Id: "b", Status: StatusStarted}}, StatusBlocked, nil},
+		{[]interface{}{&Task{Id: "a", Status: StatusComplete}, &Task{Id: "b", Status: StatusComplete}}, StatusQueued, nil},
+		{[]interface{}{&Task{Id: "a", Status: StatusComplete}}, StatusPending, DependencyNotFoundError},
+		{[]interface{}{&Task{Id: "a", Status: StatusCancelled}, &Task{Id: "b", Status: StatusQueued}}, StatusPending, DependencyFailedError},
+		{[]interface{}{&Task{Id: "a", Status: StatusError, MaxAttempts: 3}, &Task{Id: "b", Status: StatusQueued}}, StatusBlocked, nil},
+	}
+
+	for i, tt := range table {
+		task := NewTask([]byte(`{"key": "test123", "priority": 12.3, "dependsOn": ["a", "b"]}`))
+		broker := new(MockServiceBroker)
+		broker.On(
+			"Call",
+			mock.Anything,
+			StatusChangeNotifierHost,
+			"notify",
+			mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
+		).Return(float64(0), nil).Maybe()
+		params := map[string]interface{}{"key": task.Key, "id": task.Id, "priority": task.Priority}
+		broker.On("Call", mock.Anything, PriorityQueueHost, "push", params).Return(float64(0), nil).Maybe()
+		taskModel := new(MockModel)
+		q := fmt.Sprintf(`FOR t IN %s FILTER t._key IN @ids RETURN t`, CollectionTasks)
+		taskModel.On("Query", q, map[string]interface{}{"ids": []string{"a", "b"}}).Return(tt.Parents, nil).Once()
+		taskModel.On("Save", task).Return(DocumentMeta{}, nil).Maybe()
+		rescModel := new(MockModel)
+		rescModel.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, nil).Maybe()
+		rescModel.On("Query", mock.Anything, mock.Anything).Return(nil, nil).Maybe()
+		ctrl := NewResourceController(broker)
+		if err := ctrl.AddTask(task, taskModel, rescModel); err != tt.Err {
+			t.Fatalf("[%d] expected error %v, got %v", i, tt.Err, err)
+		}
+		if task.Status != tt.Status {
+			t.Fatalf("[%d] expected task status to be %s, got %s", i, tt.Status, task.Status)
+		}
+		if tt.Status == StatusBlocked {
+			broker.AssertNotCalled(t, "Call", mock.Anything, PriorityQueueHost, "push", params)
+		}
+		taskModel.AssertExpectations(t)
+	}
+}
+
+// dependentsQuery is the query of the blocked tasks that depend on a task.
+var dependentsQuery = fmt.Sprintf(`FOR t IN %s FILTER t.status == @status AND @id IN t.dependsOn RETURN t`, CollectionTasks)
+
+func TestControllerSettleDependents(t *testing.T) {
+	child := &Task{Id: "c", Key: "test", Priority: 1, Status: StatusBlocked, DependsOn: []string{"a", "b"}}
+	var table = []struct {
+		Task    *Task
+		Parents []interface{}
+		Status  string
+	}{
+		{
+			&Task{Id: "a", Status: StatusComplete},
+			[]interface{}{&Task{Id: "a", Status: StatusComplete}, &Task{Id: "b", Status: StatusQueued}},
+			StatusBlocked,
+		},
+		{
+			&Task{Id: "a", Status: StatusComplete},
+			[]interface{}{&Task{Id: "a", Status: StatusComplete}, &Task{Id: "b", Status: StatusComplete}},
+			StatusQueued,
+		},
+		{
+			&Task{Id: "a", Status: StatusError},
+			[]interface{}{&Task{Id: "a", Status: StatusError}, &Task{Id: "b", Status: StatusQueued}},
+			StatusCancelled,
+		},
+		{
+			&Task{Id: "a", Status: StatusCancelled},
+			[]interface{}{&Task{Id: "b", Status: StatusComplete}},
+			StatusCancelled,
+		},
+		{
+			&Task{Id: "a", Status: StatusError, MaxAttempts: 3},
+			nil,
+			StatusBlocked,
+		},
+	}
+
+	for i, tt := range table {
+		child.Status = StatusBlocked
+		broker := new(MockServiceBroker)
+		broker.On(
+			"Call",
+			mock.Anything,
+			StatusChangeNotifierHost,
+			"notify",
+			mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
+		).Return(float64(0), nil).Maybe()
+		params := map[string]interface{}{"key": "test", "id": "c", "priority": float64(1)}
+		broker.On("Call", mock.Anything, PriorityQueueHost, "push", params).Return(float64(0), nil).Maybe()
+		taskModel := new(MockModel)
+		taskModel.On("Query", dependentsQuery, map[string]interface{}{"id": "a", "status": StatusBlocked}).Return([]interface{}{child}, nil).Maybe()
+		taskModel.On("Query", dependentsQuery, map[string]interface{}{"id": "c", "status": StatusBlocked}).Return(nil, nil).Maybe()
+		q := fmt.Sprintf(`FOR t IN %s FILTER t._key IN @ids RETURN t`, CollectionTasks)
+		taskModel.On("Query", q, map[string]interface{}{"ids": []string{"a", "b"}}).Return(tt.Parents, nil).Maybe()
+		taskModel.On("Save", child).Return(DocumentMeta{}, nil).Maybe()
+		ctrl := NewResourceController(broker)
+		if err := ctrl.settleDependents(context.Background(), tt.Task, taskModel); err != nil {
+			t.Fatal(err)
+		}
+		if child.Status != tt.Status {
+			t.Fatalf("[%d] expected task status to be %s, got %s", i, tt.Status, child.Status)
+		}
+		if tt.Parents == nil && len(taskModel.Calls) != 0 {
+			t.Fatalf("[%d] expected the dependents of a retried task not to be settled, got %v", i, taskModel.Calls)
+		}
+	}
+}
+
+func TestControllerExpireTasks(t *testing.T) {
+	queued := &Task{Id: "a", Key: "test", Status: StatusQueued}
+	scheduled := &Task{Id: "b", Key: "test", Status: StatusScheduled}
+	staged := &Task{Id: "c", Key: "test", Status: StatusQueued}
+	broker := new(MockServiceBroker)
+	broker.On(
+		"Call",
+		mock.Anything,
+		StatusChangeNotifierHost,
+		"notify",
+		mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == "taskStatusChanged" }),
+	).Return(float64(0), nil).Maybe()
+	broker.On("Call", mock.Anything, mock.Anything, "remove", map[string]interface{}{"key": "test", "id": "a"}).Return(float64(0), nil).Once()
+	broker.On("Call", mock.Anything, mock.Anything, "remove", map[string]interface{}{"key": "test", "id": "b"}).Return(float64(0), nil).Once()
+	broker.On("Call", mock.Anything, mock.Anything, "remove", map[string]interface{}{"key": "test", "id": "c"}).Return(float64(-1), nil).Once()
+	taskModel := new(MockModel)
+	q := fmt.Sprintf(
+		`FOR t IN %s FILTER t.status IN @statuses AND t.expiresAt != null AND DATE_TIMESTAMP(t.expiresAt) <= DATE_NOW() RETURN t`,
+		CollectionTasks,
+	)
+	vars := map[string]interface{}{"statuses": []string{StatusQueued, StatusScheduled}}
+	taskModel.On("Query", q, vars).Return([]interface{}{queued, scheduled, staged}, nil).Once()
+	taskModel.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, nil).Twice()
+	ctrl := NewResourceController(broker)
+	taskModel.On("Query", dependentsQuery, mock.Anything).Return(nil, nil).Maybe()
+	count, err := ctrl.ExpireTasks(taskModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 expired tasks, got %d", count)
+	}
+	if queued.Status != StatusCancelled || scheduled.Status != StatusCancelled || staged.Status != StatusQueued {
+		t.Fatalf("unexpected task statuses %s, %s, %s", queued.Status, scheduled.Status, staged.Status)
+	}
+	broker.AssertExpectations(t)
+	taskModel.AssertExpectations(t)
+}
+
+func TestControllerArchiveTasks(t *testing.T) {
+	batch := make([]interface{}, ArchiveBatchSize)
+	for i := range batch {
+		status := StatusComplete
+		if i%2 == 1 {
+			status = StatusCancelled
+		}
+		batch[i] = &Task{Id: fmt.Sprint(i), Status: status}
+	}
+	failed := &Task{Id: "failed", Status: StatusError}
+	retried := &Task{Id: "retried", Status: StatusError, MaxAttempts: 3}
+	q := fmt.Sprintf(
+		`FOR t IN %s FILTER t.status IN @statuses AND DATE_TIMESTAMP(NOT_NULL(t.updated, t.created)) <= DATE_NOW() - @retention SORT t.created ASC LIMIT @limit RETURN t`,
+		CollectionTasks,
+	)
+	vars := map[string]interface{}{
+		"limit":     ArchiveBatchSize,
+		"retention": int64(3600000),
+		"statuses":  []string{StatusCancelled, StatusComplete, StatusError},
+	}
+	taskModel := new(MockModel)
+	taskModel.On("Query", q, vars).Return(batch, nil).Once()
+	taskModel.On("Query", q, vars).Return([]interface{}{retried, failed}, nil).Once()
+	taskModel.On("Remove", mock.AnythingOfType("*main.Task")).Return(nil)
+	archiveModel := new(MockModel)
+	archived := make(map[string]bool)
+	archiveModel.On("Save", mock.AnythingOfType("*main.ArchivedTask")).Run(func(args mock.Arguments) {
+		task := args.Get(0).(*ArchivedTask)
+		if task.RemovedReason != ArchivedReason {
+			t.Fatalf("expected reason %s, got %s", ArchivedReason, task.RemovedReason)
+		}
+		archived[task.Id] = true
+	}).Return(DocumentMeta{}, nil)
+	count, err := NewResourceController(nil).ArchiveTasks(time.Hour, taskModel, archiveModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != ArchiveBatchSize+1 || len(archived) != ArchiveBatchSize+1 {
+		t.Fatalf("expected %d archived tasks, got %d", ArchiveBatchSize+1, count)
+	}
+	if !archived[failed.Id] || archived[retried.Id] {
+		t.Fatal("expected the failed task to be archived and the retried task to be kept")
+	}
+	taskModel.AssertExpectations(t)
+	taskModel.AssertNotCalled(t, "Remove", retried)
+}
+
+func TestControllerArchiveTasksError(t *testing.T) {
+	task := &Task{Id: "a", Status: StatusComplete}
+	taskModel := new(MockModel)
+	taskModel.On("Query", mock.Anything, mock.Anything).Return([]interface{}{task}, nil).Once()
+	taskModel.On("Remove", task).Return(nil).Once()
+	taskModel.On("Save", task).Return(DocumentMeta{}, nil).Once()
+	archiveModel := new(MockModel)
+	archiveModel.On("Save", mock.AnythingOfType("*main.ArchivedTask")).Return(DocumentMeta{}, errors.New("save error"))
+	count, err := NewResourceController(nil).ArchiveTasks(time.Hour, taskModel, archiveModel)
+	if err == nil || err.Error() != "save error" || count != 0 {
+		t.Fatalf("expected save error, got %d %v", count, err)
+	}
+	taskModel.AssertExpectations(t)
+
+	taskModel = new(MockModel)
+	taskModel.On("Query", mock.Anything, mock.Anything).Return([]interface{}{task}, nil).Once()
+	taskModel.On("Remove", task).Return(errors.New("remove error")).Once()
+	archiveModel = new(MockModel)
+	count, err = NewResourceController(nil).ArchiveTasks(time.Hour, taskModel, archiveModel)
+	if err == nil || err.Error() != "remove error" || count != 0 {
+		t.Fatalf("expected remove error, got %d %v", count, err)
+	}
+	archiveModel.AssertNotCalled(t, "Save", mock.Anything)
+}
+
+func TestControllerCompleteTaskResult(t *testing.T) {
+	task := &Task{Id: "abc123", Key: "test", Status: StatusStarted}
+	broker := new(MockServiceBroker)
+	broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+	taskModel := new(MockModel)
+	taskModel.On("Get", "abc123").Return(task, nil).Once()
+	q := fmt.Sprintf(`FOR t IN %s FILTER t.status == @status AND @id IN t.dependsOn RETURN t`, CollectionTasks)
+	taskModel.On("Query", q, mock.Anything).Return([]interface{}{}, nil).Once()
+	taskModel.On("Save", task).Return(DocumentMeta{}, nil).Once()
+	rescModel := new(MockModel)
+	rescModel.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, nil).Once()
+	ctrl := NewResourceController(broker)
+	ctrl.resources["test"] = &Resource{Name: "test", Status: ResourceLocked, TaskId: "abc123"}
+	if err := ctrl.CompleteTask("abc123", StatusComplete, json.RawMessage(`{"rows":10}`), "", false, taskModel, rescModel); err != nil {
+		t.Fatal(err)
+	}
+	if string(task.Result) != `{"rows":10}` {
+		t.Fatalf("expected task result to be stored, got %s", string(task.Result))
+	}
+	taskModel.AssertExpectations(t)
+}
+
+func TestControllerGetGroupStatus(t *testing.T) {
+	var table = []struct {
+		Groups   []interface{}
+		ModelErr error
+		Status   *GroupStatus
+		Err      error
+	}{
+		{
+			[]interface{}{&TaskGroup{Id: "batch-1", Members: map[string]string{"a": StatusComplete, "b": StatusQueued, "c": StatusComplete}}},
+			nil,
+			&GroupStatus{GroupId: "batch-1", Total: 3, Counts: map[string]int{StatusComplete: 2, StatusQueued: 1}},
+			nil,
+		},
+		{[]interface{}{}, nil, nil, GroupNotFoundError},
+		{nil, errors.New("query error"), nil, errors.New("query error")},
+	}
+
+	for i, tt := range table {
+		model := new(MockModel)
+		q := fmt.Sprintf(`FOR g IN %s FILTER g._key == @key RETURN g`, CollectionTaskGroups)
+		model.On("Query", q, map[string]interface{}{"key": "batch-1"}).Return(tt.Groups, tt.ModelErr).Once()
+		ctrl := NewResourceController(nil)
+		status, err := ctrl.GetGroupStatus("batch-1", model)
+		if err != nil && err.Error() != tt.Err.Error() {
+			t.Fatal(err)
+		}
+		if tt.Status == nil {
+			continue
+		}
+		if status.Total != tt.Status.Total || status.Complete != tt.Status.Complete {
+			t.Fatalf("[%d] expected status %+v, got %+v", i, tt.Status, status)
+		}
+		for k, v := range tt.Status.Counts {
+			if status.Counts[k] != v {
+				t.Fatalf("[%d] expected %d %s tasks, got %d", i, v, k, status.Counts[k])
+			}
+		}
+	}
+}
+
+func TestControllerUpdateGroup(t *testing.T) {
+	var table = []struct {
+		Task      *Task
+		Members   map[string]string
+		Completed bool
+	}{
+		{&Task{Id: "a", GroupId: "batch-1", Status: StatusComplete}, map[string]string{"a": StatusStarted, "b": StatusCancelled}, true},
+		{&Task{Id: "a", GroupId: "batch-1", Status: StatusComplete}, map[string]string{"a": StatusStarted, "b": StatusQueued}, false},
+		{&Task{Id: "a", GroupId: "batch-1", Status: StatusError, MaxAttempts: 3}, map[string]string{"a": StatusStarted}, false},
+		{&Task{Id: "a", GroupId: "batch-1", Status: StatusError}, map[string]string{"a": StatusStarted}, true},
+	}
+
+	for i, tt := range table {
+		broker := new(MockServiceBroker)
+		if tt.Completed {
+			broker.On(
+				"Call",
+				mock.Anything,
+				StatusChangeNotifierHost,
+				"notify",
+				mock.MatchedBy(func(p map[string]interface{}) bool { return p["kind"] == TaskGroupCompletedEvent }),
+			).Return(float64(0), nil).Once()
+		}
+		group := &TaskGroup{Id: "batch-1", Members: tt.Members}
+		groupModel := new(MockModel)
+		q := fmt.Sprintf(`FOR g IN %s FILTER g._key == @key RETURN g`, CollectionTaskGroups)
+		groupModel.On("Query", q, map[string]interface{}{"key": "batch-1"}).Return([]interface{}{group}, nil).Once()
+		groupModel.On("Save", group).Return(DocumentMeta{}, nil).Once()
+		ctrl := NewResourceController(broker)
+		ctrl.TrackGroups(groupModel)
+		ctrl.recordTransition(context.Background(), tt.Task, StatusStarted, "task completed")
+		if (group.Completed != nil) != tt.Completed {
+			t.Fatalf("[%d] expected group completed to be %v", i, tt.Completed)
+		}
+		if group.Members["a"] != tt.Task.Status {
+			t.Fatalf("[%d] expected member status %s, got %s", i, tt.Task.Status, group.Members["a"])
+		}
+		broker.AssertExpectations(t)
+		groupModel.AssertExpectations(t)
+	}
+}
+
+func TestControllerHeartbeat(t *testing.T) {
+	var table = []struct {
+		Tasks []interface{}
+		Err   error
+	}{
+		{[]interface{}{&Task{Id: "abc123", Status: StatusStarted}}, nil},
+		{[]interface{}{&Task{Id: "abc123", Status: StatusQueued}}, TaskNotStartedError},
+		{[]interface{}{}, TaskNotFoundError},
+	}
+
+	for i, tt := range table {
+		taskModel := new(MockModel)
+		taskModel.On("Get", "abc123").Return(firstDoc(tt.Tasks), nil).Once()
+		taskModel.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, nil).Maybe()
+		ctrl := NewResourceController(nil)
+		leaseExpires, err := ctrl.Heartbeat("abc123", taskModel)
+		if err != tt.Err {
+			t.Fatalf("[%d] expected error %v, got %v", i, tt.Err, err)
+		}
+		if err == nil {
+			task := tt.Tasks[0].(*Task)
+			if task.LeaseExpires == nil || !task.LeaseExpires.Equal(leaseExpires) {
+				t.Fatalf("[%d] expected the task lease to be renewed", i)
+			}
+			if leaseExpires.Before(time.Now().Add(LeaseDuration - time.Second)) {
+				t.Fatalf("[%d] expected the lease to expire in %s", i, LeaseDuration)
+			}
+		}
+		taskModel.AssertExpectations(t)
+	}
+}
+
+func TestControllerReclaimExpiredLeases(t *testing.T) {
+	var table = []struct {
+		Staged bool
+		Status string
+	}{
+		{false, StatusPending},
+		{true, StatusQueued},
+	}
+
+	for i, tt := range table {
+		expired := time.Now().Add(-time.Second)
+		task := &Task{Id: "abc123", Key: "test", Priority: 1, Status: StatusStarted, LeaseExpires: &expired}
+		broker := new(MockServiceBroker)
+		broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+		if tt.Staged {
+			params := map[string]interface{}{"key": "test", "id": "abc123", "priority": float64(1)}
+			broker.On("Call", mock.Anything, PriorityQueueHost, "push", params).Return(float64(0), nil).Once()
+		}
+		taskModel := new(MockModel)
+		q := fmt.Sprintf(
+			`FOR t IN %s FILTER t.status == @status AND t.leaseExpires != null AND DATE_TIMESTAMP(t.leaseExpires) < DATE_NOW() RETURN t`,
+			CollectionTasks,
+		)
+		taskModel.On("Query", q, map[string]interface{}{"status": StatusStarted}).Return([]interface{}{task}, nil).Once()
+		taskModel.On("Save", task).Return(DocumentMeta{}, nil).Once()
+		rescModel := new(MockModel)
+		rescModel.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, nil).Once()
+		ctrl := NewResourceController(broker)
+		ctrl.resources["test"] = &Resource{Name: "test", Status: ResourceLocked, TaskId: "abc123"}
+		if tt.Staged {
+			ctrl.stage.Store("test", NewStagedSlot(time.Now(), &Task{Id: "xyz789", Key: "test", Status: StatusPending}))
+		}
+		count, err := ctrl.ReclaimExpiredLeases(taskModel, rescModel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Fatalf("[%d] expected 1 reclaimed task, got %d", i, count)
+		}
+		if task.Status != tt.Status || task.LeaseExpires != nil {
+			t.Fatalf("[%d] expected task status %s without lease, got %s", i, tt.Status, task.Status)
+		}
+		if ctrl.resources["test"].Status != ResourceFree {
+			t.Fatalf("[%d] expected resource to be unlocked", i)
+		}
+		if _, ok := ctrl.stage.Load("test"); !ok {
+			t.Fatalf("[%d] expected a task to be staged", i)
+		}
+		broker.AssertExpectations(t)
+		taskModel.AssertExpectations(t)
+	}
+}
+
+func TestControllerRecoverStartedTasks(t *testing.T) {
+	defer func(p string) { RecoveryPolicy = p }(RecoveryPolicy)
+	expired := time.Now().Add(-time.Second)
+	leased := time.Now().Add(time.Minute)
+	var table = []struct {
+		Policy   string
+		Resource *Resource
+		Lease    *time.Time
+		Status   string
+		Reason   string
+	}{
+		{"", nil, nil, StatusQueued, "resource not locked"},
+		{"", &Resource{Name: "test", Status: ResourceLocked, TaskId: "xyz789"}, nil, StatusQueued, "resource not locked"},
+		{"", &Resource{Name: "test", Status: ResourceLocked, TaskId: "abc123"}, &expired, StatusQueued, "lease expired"},
+		{"", &Resource{Name: "test", Status: ResourceLocked, TaskId: "abc123"}, &leased, StatusStarted, ""},
+		{RecoveryPolicyFail, &Resource{Name: "test", Status: ResourceFree}, nil, StatusError, "resource not locked"},
+	}
+
+	for i, tt := range table {
+		RecoveryPolicy = tt.Policy
+		task := &Task{Id: "abc123", Key: "test", Priority: 1, Status: StatusStarted, LeaseExpires: tt.Lease}
+		var events []string
+		broker := new(MockServiceBroker)
+		broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe().Run(func(args mock.Arguments) {
+			event := args.Get(3).(map[string]interface{})
+			events = append(events, fmt.Sprint(event["kind"]))
+		})
+		if tt.Status == StatusQueued {
+			params := map[string]interface{}{"key": "test", "id": "abc123", "priority": float64(1)}
+			broker.On("Call", mock.Anything, PriorityQueueHost, "push", params).Return(float64(0), nil).Once()
+		}
+		taskModel := new(MockModel)
+		q := fmt.Sprintf(`FOR t IN %s FILTER t.status == @status RETURN t`, CollectionTasks)
+		it := newSliceIterator(task)
+		taskModel.On("QueryStream", q, map[string]interface{}{"status": StatusStarted}).Return(it, nil).Once()
+		taskModel.On("Save", task).Return(DocumentMeta{}, nil).Maybe()
+		rescModel := new(MockModel)
+		rescModel.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, nil).Maybe()
+		ctrl := NewResourceController(broker)
+		if tt.Resource != nil {
+			ctrl.storeResource(tt.Resource)
+		}
+		count, err := ctrl.RecoverStartedTasks(taskModel, rescModel)
+		if !it.closed {
+			t.Fatalf("[%d] expected the task stream to be closed", i)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.Status != tt.Status {
+			t.Fatalf("[%d] expected task status %s, got %s", i, tt.Status, task.Status)
+		}
+		if tt.Reason == "" {
+			if count != 0 || len(events) != 0 {
+				t.Fatalf("[%d] expected task not to be recovered", i)
+			}
+			continue
+		}
+		if count != 1 {
+			t.Fatalf("[%d] expected 1 recovered task, got %d", i, count)
+		}
+		if task.LeaseExpires != nil || task.AttemptHistory != nil && task.AttemptHistory[0].Error != tt.Reason {
+			t.Fatalf("[%d] expected task without lease ended with %s, got %+v", i, tt.Reason, task)
+		}
+		if fmt.Sprint(events) != fmt.Sprint([]string{TaskStatusChangedEvent, TaskRecoveredEvent}) {
+			t.Fatalf("[%d] unexpected events %v", i, events)
+		}
+		if tt.Resource != nil && tt.Resource.TaskId == "abc123" && tt.Resource.Status != ResourceFree {
+			t.Fatalf("[%d] expected resource to be unlocked", i)
+		}
+		broker.AssertExpectations(t)
+	}
+}
+
+func TestControllerTaskAttemptHistory(t *testing.T) {
+	task := &Task{Id: "abc123", Key: "test", Status: StatusPending}
+	broker := new(MockServiceBroker)
+	broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+	taskModel := new(MockModel)
+	taskModel.On("Get", "abc123").Return(task, nil).Once()
+	taskModel.On("Save", task).Return(DocumentMeta{}, nil).Twice()
+	rescModel := new(MockModel)
+	rescModel.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, nil).Twice()
+	ctrl := NewResourceController(broker)
+	ctrl.resources["test"] = &Resource{Name: "test", Status: ResourceFree}
+	ctrl.stage.Store("test", NewStagedSlot(time.Now(), task))
+	if err := ctrl.StartTask("test", "worker-1", taskModel, rescModel); err != nil {
+		t.Fatal(err)
+	}
+	taskModel.On("Query", dependentsQuery, mock.Anything).Return(nil, nil).Maybe()
+	if err := ctrl.CompleteTask("abc123", StatusError, nil, "exit status 1", false, taskModel, rescModel); err != nil {
+		t.Fatal(err)
+	}
+	if len(task.AttemptHistory) != 1 {
+		t.Fatalf("expected 1 attempt, got %d", len(task.AttemptHistory))
+	}
+	attempt := task.AttemptHistory[0]
+	if attempt.WorkerId != "worker-1" || attempt.Status != StatusError || attempt.Error != "exit status 1" || attempt.EndedAt == nil {
+		t.Fatalf("unexpected attempt %+v", attempt)
+	}
+	taskModel.AssertExpectations(t)
+}
+
+func TestControllerAppendTaskLog(t *testing.T) {
+	var table = []struct {
+		Tasks   []interface{}
+		SaveErr error
+		Err     error
+	}{
+		{[]interface{}{&Task{Id: "abc123"}}, nil, nil},
+		{[]interface{}{}, nil, TaskNotFoundError},
+		{[]interface{}{&Task{Id: "abc123"}}, errors.New("model error"), errors.New("model error")},
+	}
+
+	for i, tt := range table {
+		taskModel := new(MockModel)
+		taskModel.On("Get", "abc123").Return(firstDoc(tt.Tasks), nil).Once()
+		logModel := new(MockModel)
+		logModel.On("Save", mock.MatchedBy(func(l *TaskLog) bool {
+			return l.TaskId == "abc123" && l.Stream == "stderr" && l.Data == "oops"
+		})).Return(DocumentMeta{}, tt.SaveErr).Maybe()
+		q := fmt.Sprintf(
+			`FOR l IN %s FILTER l.taskId == @taskId SORT l.created DESC LIMIT @offset, @count REMOVE l IN %s`,
+			CollectionTaskLogs,
+			CollectionTaskLogs,
+		)
+		vars := map[string]interface{}{"taskId": "abc123", "offset": MaxTaskLogEntries, "count": MaxTaskLogEntries}
+		logModel.On("Query", q, vars).Return([]interface{}{}, nil).Maybe()
+		ctrl := NewResourceController(nil)
+		err := ctrl.AppendTaskLog("abc123", "stderr", "oops", taskModel, logModel)
+		if (err == nil) != (tt.Err == nil) || (err != nil && err.Error() != tt.Err.Error()) {
+			t.Fatalf("[%d] expected error %v, got %v", i, tt.Err, err)
+		}
+		if tt.Err == nil {
+			logModel.AssertExpectations(t)
+		}
+	}
+}
+
+func TestControllerGetTaskLog(t *testing.T) {
+	model := new(MockModel)
+	q := fmt.Sprintf(`FOR l IN %s FILTER l.taskId == @taskId SORT l.created ASC RETURN l`, CollectionTaskLogs)
+	entries := []interface{}{NewTaskLog("abc123", "stdout", "a"), NewTaskLog("abc123", "stderr", "b")}
+	model.On("Query", q, map[string]interface{}{"taskId": "abc123"}).Return(entries, nil).Once()
+	ctrl := NewResourceController(nil)
+	logs, err := ctrl.GetTaskLog("abc123", model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 || logs[0].Data != "a" || logs[1].Stream != "stderr" {
+		t.Fatalf("unexpected task log %+v", logs)
+	}
+	model.AssertExpectations(t)
+}
+
+func TestControllerAddTaskParent(t *testing.T) {
+	var table = []struct {
+		Parents []interface{}
+		Err     error
+	}{
+		{[]interface{}{}, ParentNotFoundError},
+		{[]interface{}{&Task{Id: "parent1", Status: StatusQueued}}, ParentNotStartedError},
+	}
+
+	for _, tt := range table {
+		taskModel := new(MockModel)
+		taskModel.On("Get", "parent1").Return(firstDoc(tt.Parents), nil).Once()
+		ctrl := NewResourceController(nil)
+		task := NewTask([]byte(`{"key": "test", "priority": 1, "parentId": "parent1"}`))
+		if err := ctrl.AddTask(task, taskModel, new(MockModel)); err != tt.Err {
+			t.Fatalf("expected error %v, got %v", tt.Err, err)
+		}
+		taskModel.AssertExpectations(t)
+	}
+}
+
+func TestControllerValidateTask(t *testing.T) {
+	runAt := time.Now().Add(time.Hour)
+	var table = []struct {
+		Task       *Task
+		Validation *TaskValidation
+		Err        error
+	}{
+		{&Task{Key: "test", Priority: 1}, &TaskValidation{false, "test", StatusQueued}, nil},
+		{&Task{Key: "test", RunAt: &runAt}, &TaskValidation{false, "test", StatusScheduled}, nil},
+		{&Task{Key: "pool", Priority: 1}, &TaskValidation{false, "pool", StatusQueued}, nil},
+		{&Task{Key: "other", Priority: 1}, &TaskValidation{true, "other", StatusQueued}, nil},
+		{&Task{Key: "test", Priority: 1, DependsOn: []string{"a"}}, &TaskValidation{false, "test", StatusBlocked}, nil},
+		{&Task{Key: "test", Priority: 1, DependsOn: []string{"b"}}, nil, DependencyNotFoundError},
+		{&Task{Key: "test", Priority: 1, ParentId: "parent1"}, nil, ParentNotStartedError},
+	}
+
+	for i, tt := range table {
+		taskModel := new(MockModel)
+		taskModel.On("Get", "parent1").Return(&Task{Id: "parent1", Status: StatusQueued}, nil)
+		q := fmt.Sprintf(`FOR t IN %s FILTER t._key IN @ids RETURN t`, CollectionTasks)
+		taskModel.On("Query", q, map[string]interface{}{"ids": []string{"a"}}).Return([]interface{}{&Task{Id: "a", Status: StatusStarted}}, nil)
+		taskModel.On("Query", q, map[string]interface{}{"ids": []string{"b"}}).Return([]interface{}{}, nil)
+		ctrl := NewResourceController(nil)
+		ctrl.storeResource(&Resource{Name: "test", Status: ResourceFree})
+		ctrl.storeResource(&Resource{Name: "member", Pool: "pool", Status: ResourceFree})
+		validation, err := ctrl.ValidateTask(tt.Task, taskModel)
+		if err != tt.Err {
+			t.Fatalf("[%d] expected error %v, got %v", i, tt.Err, err)
+		}
+		if fmt.Sprint(validation) != fmt.Sprint(tt.Validation) {
+			t.Fatalf("[%d] expected validation %+v, got %+v", i, tt.Validation, validation)
+		}
+		taskModel.AssertNotCalled(t, "Save", mock.Anything)
+	}
+}
+
+func TestControllerGetTaskChildren(t *testing.T) {
+	model := new(MockModel)
+	model.On("Get", "abc123").Return(&Task{Id: "abc123"}, nil).Once()
+	q := fmt.Sprintf(`FOR t IN %s FILTER t.parentId == @id SORT t.created ASC RETURN t`, CollectionTasks)
+	model.On("Query", q, map[string]interface{}{"id": "abc123"}).Return([]interface{}{&Task{Id: "child1", ParentId: "abc123"}}, nil).Once()
+	model.On("Query", q, map[string]interface{}{"id": "child1"}).Return([]interface{}{&Task{Id: "child2", ParentId: "child1"}}, nil).Once()
+	model.On("Query", q, map[string]interface{}{"id": "child2"}).Return([]interface{}{}, nil).Once()
+	ctrl := NewResourceController(nil)
+	task, err := ctrl.GetTask("abc123", model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(task.Children) != 1 || task.Children[0].Id != "child1" {
+		t.Fatalf("unexpected children %+v", task.Children)
+	}
+	if len(task.Children[0].Children) != 1 || task.Children[0].Children[0].Id != "child2" {
+		t.Fatalf("unexpected grandchildren %+v", task.Children[0].Children)
+	}
+	model.AssertExpectations(t)
+}
+
+func TestControllerCompleteTaskCascade(t *testing.T) {
+	parent := &Task{Id: "abc123", Key: "test", Status: StatusStarted}
+	queued := &Task{Id: "child1", Key: "other", ParentId: "abc123", Status: StatusQueued}
+	done := &Task{Id: "child2", Key: "other", ParentId: "abc123", Status: StatusComplete}
+	broker := new(MockServiceBroker)
+	broker.On("Call", mock.Anything, PriorityQueueHost, "remove", map[string]interface{}{"key": "other", "id": "child1"}).Return(float64(0), nil).Once()
+	broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+	taskModel := new(MockModel)
+	taskModel.On("Get", "abc123").Return(parent, nil).Once()
+	taskModel.On("Get", "child1").Return(queued, nil).Once()
+	q := fmt.Sprintf(`FOR t IN %s FILTER t.status == @status AND @id IN t.dependsOn RETURN t`, CollectionTasks)
+	taskModel.On("Query", q, mock.Anything).Return([]interface{}{}, nil).Once()
+	q = fmt.Sprintf(`FOR t IN %s FILTER t.parentId == @id RETURN t`, CollectionTasks)
+	taskModel.On("Query", q, map[string]interface{}{"id": "abc123"}).Return([]interface{}{queued, done}, nil).Once()
+	taskModel.On("Query", q, map[string]interface{}{"id": "child1"}).Return([]interface{}{}, nil).Once()
+	taskModel.On("Query", q, map[string]interface{}{"id": "child2"}).Return([]interface{}{}, nil).Once()
+	taskModel.On("Save", parent).Return(DocumentMeta{}, nil).Once()
+	taskModel.On("Save", queued).Return(DocumentMeta{}, nil).Once()
+	rescModel := new(MockModel)
+	rescModel.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, nil).Once()
+	ctrl := NewResourceController(broker)
+	ctrl.resources["test"] = &Resource{Name: "test", Status: ResourceLocked, TaskId: "abc123"}
+	taskModel.On("Query", dependentsQuery, mock.Anything).Return(nil, nil).Maybe()
+	if err := ctrl.CompleteTask("abc123", StatusComplete, nil, "", true, taskModel, rescModel); err != nil {
+		t.Fatal(err)
+	}
+	if queued.Status != StatusCancelled || done.Status != StatusComplete {
+		t.Fatalf("unexpected child statuses %s, %s", queued.Status, done.Status)
+	}
+	broker.AssertExpectations(t)
+	taskModel.AssertExpectations(t)
+}
+
+func TestControllerRestoreResource(t *testing.T) {
+	var table = []struct {
+		Status   ResourceStatus
+		TaskId   string
+		Started  string
+		Saved    bool
+		Expected ResourceStatus
+	}{
+		{ResourceFree, "", "", false, ResourceFree},
+		{ResourceLocked, "abc123", "abc123", false, ResourceLocked},
+		{ResourceLocked, "abc123", "", true, ResourceFree},
+		{ResourceFree, "", "def456", true, ResourceLocked},
+	}
+
+	for i, tt := range table {
+		tasks := make([]interface{}, 0)
+		if tt.Started != "" {
+			tasks = append(tasks, &Task{Id: tt.Started, Key: "test", Status: StatusStarted})
+		}
+		taskModel := new(MockModel)
+		q := fmt.Sprintf(`FOR t IN %s FILTER t.key == @key AND t.status == @status RETURN t`, CollectionTasks)
+		taskModel.On("Query", q, map[string]interface{}{"key": "test", "status": StatusStarted}).Return(tasks, nil)
+		rescModel := new(MockModel)
+		if tt.Saved {
+			rescModel.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, nil).Once()
+		}
+		ctrl := NewResourceController(nil)
+		resource := &Resource{Name: "test", Status: tt.Status, TaskId: tt.TaskId, Weight: 2}
+		if err := ctrl.RestoreResource(resource, taskModel, rescModel); err != nil {
+			t.Fatal(err)
+		}
+		if ctrl.resources["test"] != resource || resource.Status != tt.Expected || resource.TaskId != tt.Started {
+			t.Fatalf("[%d] unexpected resource %+v", i, resource)
+		}
+		if err := ctrl.RestoreResource(resource, taskModel, rescModel); err != ResourceExistsError {
+			t.Fatalf("[%d] expected error '%v', got '%v'", i, ResourceExistsError, err)
+		}
+		rescModel.AssertExpectations(t)
+	}
+}
+
+func TestControllerRestoreStagedTask(t *testing.T) {
+	stagedAt := time.Now().Add(-time.Minute)
+	var table = []struct {
+		Key        string
+		Pool       string
+		StolenFrom string
+		Duplicate  bool
+		Staged     bool
+	}{
+		{"test", "", "", false, true},
+		{"gone", "", "", false, true},
+		{"test", "", "", true, false},
+		{"gone", "gpu", "", false, false},
+		{"gone", "", "test", false, false},
+	}
+
+	for i, tt := range table {
+		task := &Task{Id: "abc123", Key: tt.Key, Pool: tt.Pool, StolenFrom: tt.StolenFrom, Priority: 1, Status: StatusPending, StagedAt: &stagedAt}
+		broker := new(MockServiceBroker)
+		broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+		if !tt.Staged {
+			params := map[string]interface{}{"key": task.QueueKey(), "id": "abc123", "priority": float64(1)}
+			broker.On("Call", mock.Anything, PriorityQueueHost, "push", params).Return(float64(0), nil).Once()
+		}
+		model := new(MockModel)
+		model.On("Save", task).Return(DocumentMeta{}, nil).Maybe()
+		ctrl := NewResourceController(broker)
+		ctrl.resources["test"] = &Resource{Name: "test"}
+		if tt.Duplicate {
+			ctrl.stage.Store(tt.Key, NewStagedSlot(time.Now(), &Task{Id: "def456", Key: tt.Key}))
+		}
+		if err := ctrl.RestoreStagedTask(task, model); err != nil {
+			t.Fatal(err)
+		}
+		if tt.Staged {
+			slot, _ := ctrl.stagedSlot(tt.Key)
+			if task.Status != StatusPending || slot.StagedAt() != stagedAt {
+				t.Fatalf("[%d] expected task to be staged at its saved staging time", i)
+			}
+		} else if task.Status != StatusQueued || task.StagedAt != nil {
+			t.Fatalf("[%d] expected task to be queued, got %s", i, task.Status)
+		}
+		broker.AssertExpectations(t)
+	}
+}
+
+func TestControllerRestoreTask(t *testing.T) {
+	var table = []struct {
+		Archived []interface{}
+		Status   string
+		Err      error
+	}{
+		{[]interface{}{NewArchivedTask(&Task{Id: "abc123", Key: "test", Priority: 2, Status: StatusCancelled}, "duplicate")}, StatusQueued, nil},
+		{[]interface{}{}, "", TaskNotFoundError},
+	}
+
+	for _, tt := range table {
+		archiveModel := new(MockModel)
+		q := fmt.Sprintf(`FOR t IN %s FILTER t._key == @key RETURN t`, CollectionTasksArchive)
+		archiveModel.On("Query", q, map[string]interface{}{"key": "abc123"}).Return(tt.Archived, nil).Once()
+		archiveModel.On("Remove", mock.AnythingOfType("*main.ArchivedTask")).Return(nil).Maybe()
+		taskModel := new(MockModel)
+		taskModel.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, nil).Maybe()
+		rescModel := new(MockModel)
+		rescModel.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, nil).Maybe()
+		rescModel.On("Query", mock.Anything, mock.Anything).Return(nil, nil).Maybe()
+		broker := new(MockServiceBroker)
+		params := map[string]interface{}{"key": "test", "id": "abc123", "priority": float64(2)}
+		broker.On("Call", mock.Anything, PriorityQueueHost, "push", params).Return(float64(0), nil).Maybe()
+		broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+		ctrl := NewResourceController(broker)
+		if err := ctrl.RestoreTask("abc123", taskModel, rescModel, archiveModel); err != tt.Err {
+			t.Fatalf("expected error %v, got %v", tt.Err, err)
+		}
+		if tt.Err == nil {
+			if task := tt.Archived[0].(*ArchivedTask).Task; task.Status != tt.Status {
+				t.Fatalf("expected status %s, got %s", tt.Status, task.Status)
+			}
+			archiveModel.AssertCalled(t, "Remove", tt.Archived[0])
+			broker.AssertExpectations(t)
+		}
+	}
+}
+
+func TestControllerRequestPreemption(t *testing.T) {
+	defer func(margin float64) { PreemptionMargin = margin }(PreemptionMargin)
+	var table = []struct {
+		Margin    float64
+		Requested string
+		Staged    *Task
+		Notify    bool
+		By        string
+	}{
+		{2, "", nil, true, "high"},
+		{4, "", nil, false, ""},
+		{2, "abc123", nil, false, ""},
+		{2, "other", nil, true, "high"},
+		{2, "", &Task{Id: "staged", Key: "test", Priority: 0}, true, "staged"},
+		{2, "", &Task{Id: "staged", Key: "test", Priority: 4}, true, "high"},
+		{4, "", &Task{Id: "staged", Key: "test", Priority: 4}, false, ""},
+	}
+
+	for i, tt := range table {
+		PreemptionMargin = tt.Margin
+		heap := []interface{}{
+			map[string]interface{}{"_key": "low", "key": "test", "priority": float64(8)},
+			map[string]interface{}{"_key": "high", "key": "test", "priority": float64(1)},
+		}
+		broker := new(MockServiceBroker)
+		broker.On("Call", mock.Anything, PriorityQueueHost, "get", map[string]interface{}{"key": "test"}).Return(map[string]interface{}{"_key": "test", "heap": heap}, nil).Maybe()
+		broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.MatchedBy(func(p map[string]interface{}) bool {
+			return p["kind"] == TaskPreemptEvent
+		})).Return(float64(0), nil).Maybe()
+		taskModel := new(MockModel)
+		running := &Task{Id: "abc123", Key: "test", Priority: 5, Status: StatusStarted}
+		taskModel.On("Get", "abc123").Return(running, nil).Maybe()
+		ctrl := NewResourceController(broker)
+		ctrl.resources["test"] = &Resource{Name: "test", Status: ResourceLocked, TaskId: "abc123"}
+		if tt.Requested != "" {
+			ctrl.preempting.Store("test", preemption{TaskId: tt.Requested})
+		}
+		if tt.Staged != nil {
+			ctrl.stage.Store("test", NewStagedSlot(time.Now(), tt.Staged))
+		}
+		if err := ctrl.requestPreemption(context.Background(), "test", taskModel); err != nil {
+			t.Fatal(err)
+		}
+		notified := false
+		for _, call := range broker.Calls {
+			if call.Arguments.Get(2) == "notify" {
+				notified = true
+			}
+		}
+		if notified != tt.Notify {
+			t.Fatalf("[%d] expected notify to be %v, got %v", i, tt.Notify, notified)
+		}
+		if v, _ := ctrl.preempting.Load("test"); tt.Notify && v != (preemption{By: tt.By, TaskId: "abc123"}) {
+			t.Fatalf("[%d] expected preemption of abc123 by %s to be requested, got %v", i, tt.By, v)
+		}
+	}
+}
+
+func TestControllerAcknowledgePreemption(t *testing.T) {
+	var table = []struct {
+		Requested string
+		Staged    *Task
+		Status    string
+		Err       error
+	}{
+		{"abc123", nil, StatusQueued, nil},
+		{"abc123", &Task{Id: "staged1", Key: "test", Priority: 3, Status: StatusPending}, StatusQueued, nil},
+		{"", nil, StatusStarted, PreemptNotRequestedError},
+	}
+
+	for i, tt := range table {
+		running := &Task{Id: "abc123", Key: "test", Priority: 5, Status: StatusStarted}
+		next := &Task{Id: "next1", Key: "test", Priority: 1, Status: StatusQueued}
+		broker := new(MockServiceBroker)
+		broker.On("Call", mock.Anything, PriorityQueueHost, "push", map[string]interface{}{"key": "test", "id": "abc123", "priority": float64(5)}).Return(float64(0), nil).Maybe()
+		broker.On("Call", mock.Anything, PriorityQueueHost, "push", map[string]interface{}{"key": "test", "id": "staged1", "priority": float64(3)}).Return(float64(0), nil).Maybe()
+		broker.On("Call", mock.Anything, PriorityQueueHost, "remove", map[string]interface{}{"key": "test", "id": "next1"}).Return(float64(0), nil).Maybe()
+		broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+		taskModel := new(MockModel)
+		taskModel.On("Get", "abc123").Return(running, nil).Once()
+		taskModel.On("Get", "next1").Return(next, nil).Maybe()
+		taskModel.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, nil).Maybe()
+		rescModel := new(MockModel)
+		rescModel.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, nil).Maybe()
+		ctrl := NewResourceController(broker)
+		ctrl.resources["test"] = &Resource{Name: "test", Status: ResourceLocked, TaskId: "abc123"}
+		if tt.Requested != "" {
+			ctrl.preempting.Store("test", preemption{By: "next1", TaskId: tt.Requested})
+		}
+		if tt.Staged != nil {
+			ctrl.stage.Store("test", NewStagedSlot(time.Now(), tt.Staged))
+		}
+		if err := ctrl.AcknowledgePreemption("abc123", taskModel, rescModel); err != tt.Err {
+			t.Fatalf("[%d] expected error %v, got %v", i, tt.Err, err)
+		}
+		if running.Status != tt.Status {
+			t.Fatalf("[%d] expected status %s, got %s", i, tt.Status, running.Status)
+		}
+		if tt.Err != nil {
+			continue
+		}
+		if ctrl.resources["test"].Status != ResourceFree || next.Status != StatusPending {
+			t.Fatalf("[%d] expected next task to be staged on the free resource, got %s", i, next.Status)
+		}
+		if slot, ok := ctrl.stagedSlot("test"); !ok || slot.Tasks()[0] != next {
+			t.Fatalf("[%d] expected the preempting task to be staged first", i)
+		}
+		if tt.Staged != nil && tt.Staged.Status != StatusQueued {
+			t.Fatalf("[%d] expected the staged task to be returned to the queue, got %s", i, tt.Staged.Status)
+		}
+		broker.AssertCalled(t, "Call", mock.Anything, PriorityQueueHost, "remove", map[string]interface{}{"key": "test", "id": "next1"})
+	}
+}
+
+func TestControllerEstimateStart(t *testing.T) {
+	runAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	var table = []struct {
+		Task     *Task
+		Position int
+		Wait     float64
+		Err      error
+	}{
+		{&Task{Id: "abc123", Key: "test", Priority: 3, Status: StatusQueued}, 2, 80, nil},
+		{&Task{Id: "abc123", Key: "test", RunAt: &runAt, Status: StatusScheduled}, 0, 3600, nil},
+		{&Task{Id: "abc123", Key: "test", Status: StatusStarted}, 0, 0, TaskNotQueuedError},
+	}
+
+	for i, tt := range table {
+		taskModel := new(MockModel)
+		taskModel.On("Get", "abc123").Return(tt.Task, nil).Once()
+		statModel := new(MockModel)
+		q := fmt.Sprintf("FOR t IN %s FILTER t.key == @key SORT t.created DESC LIMIT 10 RETURN t", CollectionTaskStats)
+		statModel.On("Query", q, map[string]interface{}{"key": "test"}).Return([]interface{}{NewTaskStat("test", 30)}, nil).Maybe()
+		heap := []interface{}{
+			map[string]interface{}{"_key": "a", "priority": float64(1)},
+			map[string]interface{}{"_key": "b", "priority": float64(2)},
+			map[string]interface{}{"_key": "c", "priority": float64(7)},
+		}
+		broker := new(MockServiceBroker)
+		broker.On("Call", mock.Anything, PriorityQueueHost, "get", map[string]interface{}{"key": "test"}).Return(map[string]interface{}{"heap": heap}, nil).Maybe()
+		ctrl := NewResourceController(broker)
+		lockedAt := time.Now().Add(-10 * time.Second)
+		ctrl.resources["test"] = &Resource{Name: "test", Status: ResourceLocked, TaskId: "running", LockedAt: &lockedAt}
+		estimate, err := ctrl.EstimateStart("abc123", taskModel, statModel)
+		if err != tt.Err {
+			t.Fatalf("[%d] expected error %v, got %v", i, tt.Err, err)
+		}
+		if err != nil {
+			continue
+		}
+		if estimate.Position != tt.Position || estimate.AverageRunTime != 30 {
+			t.Fatalf("[%d] unexpected estimate %+v", i, estimate)
+		}
+		if wait := time.Until(estimate.EstimatedStart).Seconds(); math.Abs(wait-tt.Wait) > 2 {
+			t.Fatalf("[%d] expected start in %v seconds, got %v", i, tt.Wait, wait)
+		}
+	}
+}
+
+func TestControllerStageTaskInvalidTransition(t *testing.T) {
+	model := &MockModel{}
+	ctrl := NewResourceController(nil)
+	ctrl.StageTask(&Task{Id: "abc123", Key: "test", Status: StatusComplete}, model, true)
+	if _, ok := ctrl.stage.Load("test"); ok {
+		t.Fatal("expected complete task not to be staged")
+	}
+	model.AssertNotCalled(t, "Save", mock.Anything)
+}
+
+func TestControllerCompleteTaskInvalidStatus(t *testing.T) {
+	taskModel := new(MockModel)
+	taskModel.On("Get", "abc123").Return(&Task{Id: "abc123", Key: "test", Status: StatusStarted}, nil).Once()
+	ctrl := NewResourceController(nil)
+	ctrl.resources["test"] = &Resource{Name: "test", Status: ResourceLocked, TaskId: "abc123"}
+	err := ctrl.CompleteTask("abc123", StatusQueued, nil, "", false, taskModel, new(MockModel))
+	if _, ok := err.(*TransitionError); !ok {
+		t.Fatalf("expected transition error, got %v", err)
+	}
+	if ctrl.resources["test"].Status != ResourceLocked {
+		t.Fatal("expected resource to stay locked")
+	}
+	taskModel.AssertExpectations(t)
+}
+
+func TestControllerPauseTask(t *testing.T) {
+	var table = []struct {
+		Status string
+		Host   string
+		Remove bool
+		Result float64
+		Err    error
+	}{
+		{StatusQueued, PriorityQueueHost, true, 0, nil},
+		{StatusScheduled, TimetableHost, true, 0, nil},
+		{StatusQueued, PriorityQueueHost, true, -1, TaskRemoveFailedError},
+		{StatusStarted, "", false, 0, TaskNotQueuedError},
+	}
+
+	for _, tt := range table {
+		task := &Task{Id: "abc123", Key: "test", Status: tt.Status}
+		taskModel := new(MockModel)
+		taskModel.On("Get", "abc123").Return(task, nil).Once()
+		taskModel.On("Save", task).Return(DocumentMeta{}, nil).Maybe()
+		broker := new(MockServiceBroker)
+		if tt.Remove {
+			broker.On("Call", mock.Anything, tt.Host, "remove", map[string]interface{}{"key": "test", "id": "abc123"}).Return(tt.Result, nil).Once()
+		}
+		broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+		ctrl := NewResourceController(broker)
+		if err := ctrl.PauseTask("abc123", taskModel); err != tt.Err {
+			t.Fatalf("expected error %v, got %v", tt.Err, err)
+		}
+		if tt.Err == nil && (task.Status != StatusPaused || task.PausedFrom != tt.Status) {
+			t.Fatalf("expected task paused from %s, got %s from %s", tt.Status, task.Status, task.PausedFrom)
+		}
+		broker.AssertExpectations(t)
+	}
+}
+
+func TestControllerResumeTask(t *testing.T) {
+	runAt := time.Now().Add(time.Hour)
+	var table = []struct {
+		Task   *Task
+		Host   string
+		Method string
+		Status string
+		Err    error
+	}{
+		{&Task{Id: "abc123", Key: "test", Priority: 2, Status: StatusPaused, PausedFrom: StatusQueued}, PriorityQueueHost, "push", StatusQueued, nil},
+		{&Task{Id: "abc123", Key: "test", RunAt: &runAt, Status: StatusPaused, PausedFrom: StatusScheduled}, TimetableHost, "insert", StatusScheduled, nil},
+		{&Task{Id: "abc123", Key: "test", RunAt: &runAt, Status: StatusPaused, PausedFrom: StatusQueued}, PriorityQueueHost, "push", StatusQueued, nil},
+		{&Task{Id: "abc123", Key: "test", RunAt: &runAt, Status: StatusPaused}, TimetableHost, "insert", StatusScheduled, nil},
+		{&Task{Id: "abc123", Key: "test", Status: StatusQueued}, "", "", StatusQueued, TaskNotPausedError},
+	}
+
+	for _, tt := range table {
+		taskModel := new(MockModel)
+		taskModel.On("Get", "abc123").Return(tt.Task, nil).Once()
+		taskModel.On("Save", tt.Task).Return(DocumentMeta{}, nil).Maybe()
+		broker := new(MockServiceBroker)
+		if tt.Method != "" {
+			broker.On("Call", mock.Anything, tt.Host, tt.Method, mock.Anything).Return(float64(0), nil).Once()
+		}
+		broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+		ctrl := NewResourceController(broker)
+		if err := ctrl.ResumeTask("abc123", taskModel); err != tt.Err {
+			t.Fatalf("expected error %v, got %v", tt.Err, err)
+		}
+		if tt.Task.Status != tt.Status {
+			t.Fatalf("expected status %s, got %s", tt.Status, tt.Task.Status)
+		}
+		if tt.Err == nil && tt.Task.PausedFrom != "" {
+			t.Fatalf("expected paused from to be cleared, got %s", tt.Task.PausedFrom)
+		}
+		broker.AssertExpectations(t)
+	}
+}
+
+func TestDeliverCallback(t *testing.T) {
+	defer func(hosts []string) { CallbackHosts = hosts }(CallbackHosts)
+	var table = []struct {
+		Failures int
+		Secret   string
+		Hosts    []string
+		Calls    int
+		Err      error
+	}{
+		{0, "", []string{"127.0.0.1"}, 1, nil},
+		{1, "s3cret", []string{"127.0.0.1"}, 2, nil},
+		{0, "", nil, 0, CallbackFailedError},
+		{0, "", []string{"example.com", ".example.com"}, 0, CallbackFailedError},
+	}
+
+	for i, tt := range table {
+		CallbackHosts = tt.Hosts
+		calls := 0
+		var signature string
+		var body []byte
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls <= tt.Failures {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			signature = r.Header.Get(CallbackSignatureHeader)
+			body, _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		CallbackSecret = tt.Secret
+		err := deliverCallback(srv.URL, []byte(`{"_key":"abc123","status":"complete"}`))
+		CallbackSecret = ""
+		srv.Close()
+		if err != tt.Err {
+			t.Fatalf("[%d] expected error '%v', got '%v'", i, tt.Err, err)
+		}
+		if calls != tt.Calls {
+			t.Fatalf("[%d] expected %d calls, got %d", i, tt.Calls, calls)
+		}
+		if tt.Err != nil {
+			continue
+		}
+		if string(body) != `{"_key":"abc123","status":"complete"}` {
+			t.Fatalf("[%d] unexpected body %s", i, body)
+		}
+		if tt.Secret != "" && signature != signBody(tt.Secret, body) {
+			t.Fatalf("[%d] unexpected signature %s", i, signature)
+		}
+		if tt.Secret == "" && signature != "" {
+			t.Fatalf("[%d] expected no signature, got %s", i, signature)
+		}
+	}
+}
+
+func TestCallbackAllowed(t *testing.T) {
+	defer func(hosts []string) { CallbackHosts = hosts }(CallbackHosts)
+	var table = []struct {
+		Hosts   []string
+		Url     string
+		Allowed bool
+	}{
+		{nil, "http://10.0.0.1/done", true},
+		{[]string{"example.com"}, "https://example.com/done", true},
+		{[]string{"example.com"}, "https://api.example.com/done", false},
+		{[]string{".example.com"}, "https://api.example.com/done", true},
+		{[]string{".example.com"}, "https://badexample.com/done", false},
+		{[]string{"example.com"}, "http://169.254.169.254/latest", false},
+	}
+
+	for i, tt := range table {
+		CallbackHosts = tt.Hosts
+		if allowed := callbackAllowed(tt.Url); allowed != tt.Allowed {
+			t.Fatalf("[%d] expected allowed %v, got %v", i, tt.Allowed, allowed)
+		}
+	}
+}
+
+func TestSignCallback(t *testing.T) {
+	sig := signBody("key", []byte("The quick brown fox jumps over the lazy dog"))
+	if sig != "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8" {
+		t.Fatalf("unexpected signature %s", sig)
+	}
+}
+
+func TestControllerAddResourcePool(t *testing.T) {
+	var table = []struct {
+		Name string
+		Pool string
+		Err  error
+	}{
+		{"gpu2", "gpu", nil},
+		{"cpu", "gpu1", PoolConflictError},
+		{"gpu", "", PoolConflictError},
+		{"self", "self", PoolConflictError},
+	}
+
+	for _, tt := range table {
+		model := &MockModel{}
+		model.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, nil)
+		ctrl := NewResourceController(nil)
+		ctrl.resources["gpu1"] = &Resource{Name: "gpu1", Pool: "gpu"}
+		if err := ctrl.AddResource(tt.Name, tt.Pool, nil, 0, model); err != tt.Err {
+			t.Fatalf("expected error '%v', got '%v'", tt.Err, err)
+		}
+		if tt.Err == nil && ctrl.resources[tt.Name].Pool != tt.Pool {
+			t.Fatalf("expected resource pool to be '%s'", tt.Pool)
+		}
+	}
+}
+
+func TestControllerStageNextTaskPool(t *testing.T) {
+	var table = []struct {
+		Pool     string
+		OwnTask  interface{}
+		PoolTask interface{}
+		TaskId   string
+		TaskKey  string
+	}{
+		{"gpu", nil, map[string]interface{}{"_key": "abc123", "key": "gpu"}, "abc123", "gpu1"},
+		{"gpu", map[string]interface{}{"_key": "def456", "key": "gpu1"}, nil, "def456", "gpu1"},
+		{"", nil, nil, "", ""},
+	}
+
+	for _, tt := range table {
+		broker := &MockServiceBroker{}
+		broker.On("Call", mock.Anything, TimetableHost, "next", map[string]interface{}{"key": "gpu1"}).Return(nil, nil)
+		broker.On("Call", mock.Anything, PriorityQueueHost, "pop", map[string]interface{}{"key": "gpu1"}).Return(tt.OwnTask, nil)
+		broker.On("Call", mock.Anything, TimetableHost, "next", map[string]interface{}{"key": "gpu"}).Return(nil, nil)
+		broker.On("Call", mock.Anything, PriorityQueueHost, "pop", map[string]interface{}{"key": "gpu"}).Return(tt.PoolTask, nil)
+		broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil)
+		model := &MockModel{}
+		model.On("Get", "abc123").Return(&Task{Id: "abc123", Key: "gpu", Status: StatusQueued}, nil)
+		model.On("Get", "def456").Return(&Task{Id: "def456", Key: "gpu1", Status: StatusQueued}, nil)
+		model.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, nil)
+		ctrl := NewResourceController(broker)
+		ctrl.resources["gpu1"] = &Resource{Name: "gpu1", Pool: tt.Pool}
+		if err := ctrl.stageNextTask(context.Background(), "gpu1", model); err != nil {
+			t.Fatal(err)
+		}
+		slot, ok := ctrl.stagedSlot("gpu1")
+		if tt.TaskId == "" {
+			if ok {
+				t.Fatal("expected no staged task")
+			}
+			continue
+		}
+		task := slot.Tasks()[0]
+		if task.Id != tt.TaskId || task.Key != tt.TaskKey || task.QueueKey() != "gpu" && tt.OwnTask == nil {
+			t.Fatalf("unexpected staged task %+v", task)
+		}
+		if tt.OwnTask != nil && task.Pool != "" {
+			t.Fatal("expected task of the resource to have no pool")
+		}
+	}
+}
+
+func TestControllerStageNextTaskSteal(t *testing.T) {
+	defer func(n int) { StealThreshold = n }(StealThreshold)
+	heap := func(n int) map[string]interface{} {
+		entries := make([]interface{}, n)
+		for i := range entries {
+			entries[i] = map[string]interface{}{"id": fmt.Sprintf("t%d", i)}
+		}
+		return map[string]interface{}{"heap": entries}
+	}
+	var table = []struct {
+		Threshold int
+		Status    ResourceStatus
+		TaskId    string
+	}{
+		{0, ResourceFree, ""},
+		{2, ResourceFree, "abc123"},
+		{4, ResourceFree, ""},
+		{2, ResourceLocked, ""},
+	}
+
+	for i, tt := range table {
+		StealThreshold = tt.Threshold
+		broker := &MockServiceBroker{}
+		for _, key := range []string{"gpu1", "gpu"} {
+			broker.On("Call", mock.Anything, TimetableHost, "next", map[string]interface{}{"key": key}).Return(nil, nil)
+			broker.On("Call", mock.Anything, PriorityQueueHost, "pop", map[string]interface{}{"key": key}).Return(nil, nil)
+		}
+		broker.On("Call", mock.Anything, PriorityQueueHost, "get", map[string]interface{}{"key": "gpu2"}).Return(heap(3), nil)
+		broker.On("Call", mock.Anything, PriorityQueueHost, "get", map[string]interface{}{"key": "gpu3"}).Return(heap(1), nil)
+		broker.On("Call", mock.Anything, PriorityQueueHost, "pop", map[string]interface{}{"key": "gpu2"}).Return(map[string]interface{}{"_key": "abc123", "key": "gpu2"}, nil)
+		broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil)
+		model := &MockModel{}
+		model.On("Get", "abc123").Return(&Task{Id: "abc123", Key: "gpu2", Status: StatusQueued}, nil)
+		model.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, nil)
+		ctrl := NewResourceController(broker)
+		ctrl.resources["gpu1"] = &Resource{Name: "gpu1", Pool: "gpu", Status: tt.Status}
+		ctrl.resources["gpu2"] = &Resource{Name: "gpu2", Pool: "gpu", Status: ResourceLocked}
+		ctrl.resources["gpu3"] = &Resource{Name: "gpu3", Pool: "gpu", Status: ResourceLocked}
+		if err := ctrl.stageNextTask(context.Background(), "gpu1", model); err != nil {
+			t.Fatal(err)
+		}
+		slot, ok := ctrl.stagedSlot("gpu1")
+		if tt.TaskId == "" {
+			if ok {
+				t.Fatalf("[%d] expected no staged task", i)
+			}
+			continue
+		}
+		task := slot.Tasks()[0]
+		if task.Id != tt.TaskId || task.Key != "gpu1" || task.StolenFrom != "gpu2" || task.QueueKey() != "gpu2" {
+			t.Fatalf("[%d] unexpected staged task %+v", i, task)
+		}
+	}
+}
+
+func TestControllerStealVictimCachedDepth(t *testing.T) {
+	defer func(n int) { StealThreshold = n }(StealThreshold)
+	StealThreshold = 2
+	heap := map[string]interface{}{"heap": []interface{}{
+		map[string]interface{}{"id": "t1"},
+		map[string]interface{}{"id": "t2"},
+		map[string]interface{}{"id": "t3"},
+	}}
+	broker := &MockServiceBroker{}
+	broker.On("Call", mock.Anything, PriorityQueueHost, "get", map[string]interface{}{"key": "gpu2"}).Return(heap, nil).Once()
+	broker.On("Call", mock.Anything, PriorityQueueHost, "get", map[string]interface{}{"key": "gpu3"}).Return(nil, nil).Once()
+	ctrl := NewResourceController(broker)
+	for _, name := range []string{"gpu1", "gpu2", "gpu3"} {
+		ctrl.resources[name] = &Resource{Name: name, Pool: "gpu"}
+	}
+	for i, expected := range []string{"gpu2", "gpu2", ""} {
+		if victim := ctrl.stealVictim(context.Background(), "gpu1", "gpu"); victim != expected {
+			t.Fatalf("[%d] expected victim '%s', got '%s'", i, expected, victim)
+		}
+	}
+	broker.AssertExpectations(t)
+}
+
+func TestControllerStageNextTaskReturnedStolen(t *testing.T) {
+	broker := &MockServiceBroker{}
+	broker.On("Call", mock.Anything, TimetableHost, "next", map[string]interface{}{"key": "gpu2"}).Return(nil, nil)
+	broker.On("Call", mock.Anything, PriorityQueueHost, "pop", map[string]interface{}{"key": "gpu2"}).Return(map[string]interface{}{"_key": "abc123", "key": "gpu1"}, nil)
+	broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil)
+	model := &MockModel{}
+	model.On("Get", "abc123").Return(&Task{Id: "abc123", Key: "gpu1", StolenFrom: "gpu2", Status: StatusQueued}, nil)
+	model.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, nil)
+	ctrl := NewResourceController(broker)
+	ctrl.resources["gpu2"] = &Resource{Name: "gpu2"}
+	if err := ctrl.stageNextTask(context.Background(), "gpu2", model); err != nil {
+		t.Fatal(err)
+	}
+	slot, ok := ctrl.stagedSlot("gpu2")
+	if !ok {
+		t.Fatal("expected staged task")
+	}
+	if task := slot.Tasks()[0]; task.Key != "gpu2" || task.StolenFrom != "" {
+		t.Fatalf("unexpected staged task %+v", task)
+	}
+}
+
+func TestControllerStageNextTaskBrokerError(t *testing.T) {
+	var table = []struct {
+		ErrMsg jrpc2.ErrorMsg
+		Err    bool
+	}{
+		{"queue not found", false},
+		{jrpc2.ServerErrorMsg, true},
+	}
+
+	for i, tt := range table {
+		broker := &MockServiceBroker{}
+		broker.On("Call", mock.Anything, TimetableHost, "next", mock.Anything).Return(nil, nil)
+		broker.On("Call", mock.Anything, PriorityQueueHost, "pop", mock.Anything).Return(nil, &jrpc2.ErrorObject{Message: tt.ErrMsg})
+		ctrl := NewResourceController(broker)
+		ctrl.resources["r1"] = &Resource{Name: "r1"}
+		if err := ctrl.stageNextTask(context.Background(), "r1", &MockModel{}); (err != nil) != tt.Err {
+			t.Fatalf("[%d] unexpected error '%v'", i, err)
+		}
+	}
+}
+
+func TestControllerStageKey(t *testing.T) {
+	broker := &MockServiceBroker{}
+	broker.On("Call", mock.Anything, TimetableHost, "next", mock.Anything).Return(nil, nil)
+	broker.On("Call", mock.Anything, PriorityQueueHost, "pop", mock.Anything).Return(nil, nil)
+	ctrl := NewResourceController(broker)
+	ctrl.resources["r1"] = &Resource{Name: "r1"}
+	ctrl.staging.Store("r1", true)
+	ctrl.inflight.Add(1)
+	ctrl.stageGroup("r1", []string{"r1"}, &MockModel{})
+	poll, ok := ctrl.polls.Load("r1")
+	if !ok || poll.(*stagePoll).Delay != StageInterval {
+		t.Fatal("expected idle key to be polled after the stage interval")
+	}
+	if _, running := ctrl.staging.Load("r1"); running {
+		t.Fatal("expected poll to be finished")
+	}
+
+	ctrl = NewResourceController(nil)
+	ctrl.resources["r1"] = &Resource{Name: "r1"}
+	ctrl.polls.Store("r1", &stagePoll{Delay: StageInterval})
+	ctrl.stageKey("r1", &MockModel{})
+	poll, ok = ctrl.polls.Load("r1")
+	if !ok || poll.(*stagePoll).Delay != StageInterval*2 {
+		t.Fatal("expected crashed poll to be backed off")
+	}
+}
+
+func TestControllerShutdown(t *testing.T) {
+	task := &Task{Id: "abc123", Key: "test", Status: StatusPending}
+	ctrl := NewResourceController(nil)
+	slot := NewStagedSlot(time.Now(), task)
+	ctrl.stage.Store("test", slot)
+	if err := ctrl.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if staged := slot.Tasks(); len(staged) != 1 || staged[0] != task {
+		t.Fatal("expected task to stay staged")
+	}
+	if ctrl.ctx.Err() != nil {
+		t.Fatal("expected the service calls not to be cancelled")
+	}
+	if ctrl.track() {
+		t.Fatal("expected no work to be tracked once stopping")
+	}
+
+	ctrl = NewResourceController(nil)
+	if !ctrl.track() {
+		t.Fatal("expected work to be tracked")
+	}
+	defer ctrl.inflight.Done()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if err := ctrl.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected error '%v', got '%v'", context.DeadlineExceeded, err)
+	}
+	if ctrl.ctx.Err() != context.Canceled {
+		t.Fatal("expected the service calls in flight to be cancelled")
+	}
+}
+
+func TestControllerRecordTransitionStopping(t *testing.T) {
+	task := &Task{Id: "abc123", Key: "test", Status: StatusCancelled, CallbackUrl: "http://callback"}
+	history := new(MockModel)
+	history.On("Save", mock.MatchedBy(func(h *TaskHistory) bool { return h.TaskId == task.Id })).Return(DocumentMeta{}, nil)
+	ctrl := NewResourceController(nil)
+	ctrl.RecordHistory(history)
+	if err := ctrl.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctrl.recordTransition(context.Background(), task, StatusQueued, "task expired")
+	history.AssertExpectations(t)
+}
+
+func TestSleepContext(t *testing.T) {
+	if !sleepContext(context.Background(), time.Millisecond) {
+		t.Fatal("expected sleep to complete")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if sleepContext(ctx, time.Hour) {
+		t.Fatal("expected sleep to end with the context")
+	}
+}
+
+func TestQueuedTurn(t *testing.T) {
+	var table = []struct {
+		Policy string
+		Weight int
+		Turns  []bool
+	}{
+		{"", 0, []bool{false, false, false}},
+		{StagePolicyQueued, 0, []bool{true, true, true}},
+		{StagePolicyAlternate, 0, []bool{false, true, false, true}},
+		{StagePolicyWeighted, 2, []bool{false, false, true, false, false, true}},
+		{StagePolicyWeighted, 0, []bool{false, true, false}},
+	}
+
+	for i, tt := range table {
+		StagePolicy, StageWeight = tt.Policy, tt.Weight
+		for turn, queued := range tt.Turns {
+			if queuedTurn(turn) != queued {
+				t.Fatalf("[%d] expected queued turn %d to be %t", i, turn, queued)
+			}
+		}
+	}
+	StagePolicy, StageWeight = "", 0
+}
+
+func TestControllerNextTaskAlternate(t *testing.T) {
+	StagePolicy = StagePolicyAlternate
+	defer func() { StagePolicy = "" }()
+	broker := &MockServiceBroker{}
+	broker.On("Call", mock.Anything, TimetableHost, "next", mock.Anything).Return(map[string]interface{}{"_key": "scheduled"}, nil)
+	broker.On("Call", mock.Anything, PriorityQueueHost, "pop", mock.Anything).Return(map[string]interface{}{"_key": "queued"}, nil)
+	ctrl := NewResourceController(broker)
+	for _, id := range []string{"scheduled", "queued", "scheduled"} {
+		task, err := ctrl.nextTask(context.Background(), "test", &MockModel{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.Id != id {
+			t.Fatalf("expected task %s, got %s", id, task.Id)
+		}
+	}
+}
+
+func TestControllerNextDeadlineTask(t *testing.T) {
+	StagePolicy = StagePolicyDeadline
+	defer func() { StagePolicy = "" }()
+	now := time.Now()
+	soon, later := now.Add(time.Minute), now.Add(time.Hour)
+	var table = []struct {
+		ScheduledExpiry *time.Time
+		QueuedExpiry    *time.Time
+		Next            string
+	}{
+		{nil, nil, "scheduled"},
+		{&later, &soon, "queued"},
+		{&soon, &later, "scheduled"},
+		{nil, &later, "queued"},
+		{&soon, &soon, "scheduled"},
+	}
+
+	for i, tt := range table {
+		scheduled := &Task{Id: "scheduled", Key: "test", RunAt: &now, ExpiresAt: tt.ScheduledExpiry}
+		queued := &Task{Id: "queued", Key: "test", Priority: 1, ExpiresAt: tt.QueuedExpiry}
+		broker := &MockServiceBroker{}
+		broker.On("Call", mock.Anything, TimetableHost, "next", mock.Anything).Return(map[string]interface{}{"_key": "scheduled"}, nil)
+		broker.On("Call", mock.Anything, PriorityQueueHost, "pop", mock.Anything).Return(map[string]interface{}{"_key": "queued"}, nil)
+		if tt.Next == "scheduled" {
+			params := map[string]interface{}{"key": "test", "id": "queued", "priority": float64(1)}
+			broker.On("Call", mock.Anything, PriorityQueueHost, "push", params).Return(float64(0), nil).Once()
+		} else {
+			params := map[string]interface{}{"key": "test", "id": "scheduled", "runAt": now.Format(time.RFC3339)}
+			broker.On("Call", mock.Anything, TimetableHost, "insert", params).Return(float64(0), nil).Once()
+		}
+		model := &MockModel{}
+		model.On("Get", "scheduled").Return(scheduled, nil)
+		model.On("Get", "queued").Return(queued, nil)
+		ctrl := NewResourceController(broker)
+		task, err := ctrl.nextTask(context.Background(), "test", model)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.Id != tt.Next {
+			t.Fatalf("[%d] expected task %s, got %s", i, tt.Next, task.Id)
+		}
+		broker.AssertExpectations(t)
+	}
+}
+
+func TestControllerNextDeadlineTaskResubmit(t *testing.T) {
+	StagePolicy = StagePolicyDeadline
+	defer func() { StagePolicy = "" }()
+	now := time.Now()
+	var table = []struct {
+		GetErr    error
+		SubmitErr *jrpc2.ErrorObject
+		Pushes    int
+		Inserts   int
+	}{
+		{errors.New("query error"), nil, 1, 1},
+		{TaskNotFoundError, nil, 1, 1},
+		{nil, &jrpc2.ErrorObject{Message: "push failed"}, 2, 1},
+	}
+
+	for i, tt := range table {
+		scheduled := &Task{Id: "scheduled", Key: "test", RunAt: &now}
+		queued := &Task{Id: "queued", Key: "test", Priority: 1}
+		pushes, inserts := 0, 0
+		broker := &MockServiceBroker{}
+		broker.On("Call", mock.Anything, TimetableHost, "next", mock.Anything).Return(map[string]interface{}{"_key": "scheduled", "key": "test", "runAt": now}, nil)
+		broker.On("Call", mock.Anything, PriorityQueueHost, "pop", mock.Anything).Return(map[string]interface{}{"_key": "queued", "key": "test", "priority": 1}, nil)
+		broker.On("Call", mock.Anything, PriorityQueueHost, "push", mock.Anything).Return(float64(0), tt.SubmitErr).Run(func(mock.Arguments) { pushes++ })
+		broker.On("Call", mock.Anything, TimetableHost, "insert", mock.Anything).Return(float64(0), nil).Run(func(mock.Arguments) { inserts++ })
+		model := &MockModel{}
+		model.On("Get", "scheduled").Return(scheduled, nil)
+		model.On("Get", "queued").Return(queued, tt.GetErr)
+		ctrl := NewResourceController(broker)
+		task, err := ctrl.nextTask(context.Background(), "test", model)
+		if err == nil || task != nil {
+			t.Fatalf("[%d] expected error, got task %v", i, task)
+		}
+		if pushes != tt.Pushes || inserts != tt.Inserts {
+			t.Fatalf("[%d] expected %d pushes and %d inserts, got %d and %d", i, tt.Pushes, tt.Inserts, pushes, inserts)
+		}
+	}
+}
+
+func TestControllerFifoTaskFailure(t *testing.T) {
+	popped := &Task{Id: "xyz789", Key: "test", Priority: 1, Status: StatusQueued}
+	oldest := &Task{Id: "abc123", Key: "test", Priority: 1, Status: StatusQueued}
+	var table = []struct {
+		Tasks    []interface{}
+		QueryErr error
+	}{
+		{nil, errors.New("query error")},
+		{[]interface{}{oldest}, nil},
+	}
+
+	for i, tt := range table {
+		model := &MockModel{}
+		model.On("Query", mock.Anything, mock.Anything).Return(tt.Tasks, tt.QueryErr)
+		broker := &MockServiceBroker{}
+		broker.On("Call", mock.Anything, PriorityQueueHost, "push", mock.Anything).Return(nil, &jrpc2.ErrorObject{Message: "push failed"})
+		ctrl := NewResourceController(broker)
+		task, err := ctrl.fifoTask(context.Background(), popped, model)
+		if err != nil {
+			t.Fatalf("[%d] %v", i, err)
+		}
+		if task != popped {
+			t.Fatalf("[%d] expected the popped task to be staged, got %v", i, task)
+		}
+		broker.AssertNotCalled(t, "Call", mock.Anything, PriorityQueueHost, "remove", mock.Anything)
+	}
+}
+
+func TestNextPollDelay(t *testing.T) {
+	var table = []struct {
+		IdleInterval time.Duration
+		Prev         time.Duration
+		Staged       bool
+		Err          error
+		Delay        time.Duration
+	}{
+		{0, 0, false, nil, StageInterval},
+		{0, StageInterval * 4, false, nil, StageInterval},
+		{StageInterval * 3, StageInterval, false, nil, StageInterval * 2},
+		{StageInterval * 3, StageInterval * 2, false, nil, StageInterval * 3},
+		{StageInterval * 3, StageInterval * 3, true, nil, StageInterval},
+		{0, StageInterval, true, errors.New("broker error"), StageInterval * 2},
+		{0, StageMaxBackoff, false, errors.New("broker error"), StageMaxBackoff},
+	}
+
+	for i, tt := range table {
+		StageIdleInterval = tt.IdleInterval
+		if delay := nextPollDelay(tt.Prev, tt.Staged, tt.Err); delay != tt.Delay {
+			t.Fatalf("[%d] expected delay %v, got %v", i, tt.Delay, delay)
+		}
+	}
+	StageIdleInterval = 0
+}
+
+func TestControllerSchedulePoll(t *testing.T) {
+	ctrl := NewResourceController(nil)
+	ctrl.resources["r1"] = &Resource{Name: "r1", Pool: "gpu"}
+	if !ctrl.pollDue("r1") {
+		t.Fatal("expected unscheduled key to be due")
+	}
+	ctrl.schedulePoll("r1", false, nil)
+	if ctrl.pollDue("r1") {
+		t.Fatal("expected scheduled key not to be due")
+	}
+	ctrl.wakeStage("gpu")
+	if !ctrl.pollDue("r1") {
+		t.Fatal("expected pool member to be due after wake")
+	}
+}
+
+func TestControllerStageNextTaskConstraints(t *testing.T) {
+	var table = []struct {
+		Tags   map[string]string
+		Staged bool
+	}{
+		{map[string]string{"gpu": "true"}, true},
+		{map[string]string{"gpu": "false"}, false},
+	}
+
+	for _, tt := range table {
+		task := &Task{Id: "abc123", Key: "gpu", Priority: 1, Status: StatusQueued, Constraints: map[string]string{"gpu": "true"}}
+		broker := &MockServiceBroker{}
+		broker.On("Call", mock.Anything, TimetableHost, "next", mock.Anything).Return(nil, nil)
+		broker.On("Call", mock.Anything, PriorityQueueHost, "pop", map[string]interface{}{"key": "r1"}).Return(nil, nil)
+		broker.On("Call", mock.Anything, PriorityQueueHost, "pop", map[string]interface{}{"key": "gpu"}).Return(map[string]interface{}{"_key": "abc123", "key": "gpu"}, nil).Once()
+		broker.On("Call", mock.Anything, PriorityQueueHost, "pop", map[string]interface{}{"key": "gpu"}).Return(nil, nil).Maybe()
+		broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+		if !tt.Staged {
+			broker.On("Call", mock.Anything, PriorityQueueHost, "push", map[string]interface{}{"key": "gpu", "id": "abc123", "priority": float64(1)}).Return(float64(0), nil).Once()
+		}
+		model := &MockModel{}
+		model.On("Get", "abc123").Return(task, nil)
+		model.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, nil)
+		ctrl := NewResourceController(broker)
+		ctrl.resources["r1"] = &Resource{Name: "r1", Pool: "gpu", Tags: tt.Tags}
+		if err := ctrl.stageNextTask(context.Background(), "r1", model); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := ctrl.stage.Load("r1"); ok != tt.Staged {
+			t.Fatalf("expected staged to be %t", tt.Staged)
+		}
+		broker.AssertExpectations(t)
+	}
+}
+
+func TestControllerStageNextTaskSkipsUnsatisfied(t *testing.T) {
+	var table = []struct {
+		Unsatisfied int
+		Staged      bool
+		Pushed      int
+	}{
+		{1, true, 1},
+		{ConstraintSkipLimit - 1, true, ConstraintSkipLimit - 1},
+		{ConstraintSkipLimit, false, ConstraintSkipLimit},
+	}
+
+	for i, tt := range table {
+		broker := &MockServiceBroker{}
+		model := &MockModel{}
+		broker.On("Call", mock.Anything, TimetableHost, "next", mock.Anything).Return(nil, nil)
+		for n := 0; n < tt.Unsatisfied; n++ {
+			id := fmt.Sprintf("cpu%d", n)
+			broker.On("Call", mock.Anything, PriorityQueueHost, "pop", map[string]interface{}{"key": "r1"}).Return(map[string]interface{}{"_key": id, "key": "r1"}, nil).Once()
+			model.On("Get", id).Return(&Task{Id: id, Key: "r1", Priority: 1, Status: StatusQueued, Constraints: map[string]string{"cpu": "true"}}, nil)
+		}
+		broker.On("Call", mock.Anything, PriorityQueueHost, "pop", map[string]interface{}{"key": "r1"}).Return(map[string]interface{}{"_key": "abc123", "key": "r1"}, nil).Once()
+		broker.On("Call", mock.Anything, PriorityQueueHost, "push", mock.Anything).Return(float64(0), nil)
+		broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+		model.On("Get", "abc123").Return(&Task{Id: "abc123", Key: "r1", Priority: 2, Status: StatusQueued}, nil).Maybe()
+		model.On("Save", mock.AnythingOfType("*main.Task")).Return(DocumentMeta{}, nil)
+		ctrl := NewResourceController(broker)
+		ctrl.resources["r1"] = &Resource{Name: "r1", Tags: map[string]string{"gpu": "true"}}
+		if err := ctrl.stageNextTask(context.Background(), "r1", model); err != nil {
+			t.Fatalf("[%d] %v", i, err)
+		}
+		if _, ok := ctrl.stage.Load("r1"); ok != tt.Staged {
+			t.Fatalf("[%d] expected staged to be %t", i, tt.Staged)
+		}
+		pushed := 0
+		for _, call := range broker.Calls {
+			if call.Arguments.String(2) == "push" {
+				pushed++
+			}
+		}
+		if pushed != tt.Pushed {
+			t.Fatalf("[%d] expected %d tasks returned to the queue, got %d", i, tt.Pushed, pushed)
+		}
+	}
+}
+
+func TestControllerReleaseExpiredLocks(t *testing.T) {
+	var table = []struct {
+		LockedFor   time.Duration
+		MaxAttempts int
+		Count       int
+		Status      string
+	}{
+		{time.Minute * 5, 0, 0, StatusStarted},
+		{time.Hour * 3, 0, 1, StatusError},
+		{time.Hour * 3, 3, 1, StatusScheduled},
+	}
+
+	for i, tt := range table {
+		lockedAt := time.Now().Add(-tt.LockedFor)
+		task := &Task{Id: "abc123", Key: "test", Status: StatusStarted, MaxAttempts: tt.MaxAttempts}
+		task.BeginAttempt("worker-1")
+		broker := new(MockServiceBroker)
+		broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+		broker.On("Call", mock.Anything, TimetableHost, "insert", mock.Anything).Return(float64(0), nil).Maybe()
+		taskModel := new(MockModel)
+		taskModel.On("Get", "abc123").Return(task, nil).Maybe()
+		taskModel.On("Save", task).Return(DocumentMeta{}, nil).Maybe()
+		rescModel := new(MockModel)
+		rescModel.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, nil).Maybe()
+		ctrl := NewResourceController(broker)
+		ctrl.resources["test"] = &Resource{Name: "test", Status: ResourceLocked, TaskId: "abc123", LockedAt: &lockedAt}
+		ctrl.resources["idle"] = &Resource{Name: "idle", Status: ResourceFree}
+		taskModel.On("Query", dependentsQuery, mock.Anything).Return(nil, nil).Maybe()
+		count, err := ctrl.ReleaseExpiredLocks(time.Hour*2, taskModel, rescModel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != tt.Count {
+			t.Fatalf("[%d] expected %d released locks, got %d", i, tt.Count, count)
+		}
+		if task.Status != tt.Status {
+			t.Fatalf("[%d] expected task status %s, got %s", i, tt.Status, task.Status)
+		}
+		if tt.Count > 0 && (ctrl.resources["test"].Status != ResourceFree || ctrl.resources["test"].LockedAt != nil) {
+			t.Fatalf("[%d] expected resource to be unlocked", i)
+		}
+		if tt.Count > 0 {
+			broker.AssertCalled(t, "Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.MatchedBy(func(params map[string]interface{}) bool {
+				return params["kind"] == ResourceLockExpiredEvent
+			}))
+		}
+	}
+}
+
+func TestControllerResourceHeartbeat(t *testing.T) {
+	var table = []struct {
+		Name string
+		Err  error
+	}{
+		{"test", nil},
+		{"pool", nil},
+		{"missing", ResourceNotFoundError},
+	}
+
+	for _, tt := range table {
+		rescModel := new(MockModel)
+		rescModel.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, nil).Maybe()
+		ctrl := NewResourceController(nil)
+		ctrl.resources["test"] = &Resource{Name: "test", Offline: true, Pool: "pool"}
+		if err := ctrl.ResourceHeartbeat(tt.Name, rescModel); err != tt.Err {
+			t.Fatalf("expected error '%v', got '%v'", tt.Err, err)
+		}
+		if tt.Err == nil && (ctrl.resources["test"].Offline || ctrl.resources["test"].HeartbeatAt == nil) {
+			t.Fatal("expected resource to be online with a heartbeat")
+		}
+	}
+}
+
+func TestControllerRegisterResource(t *testing.T) {
+	var table = []struct {
+		Name     string
+		Capacity int
+		Slots    []string
+		Err      error
+	}{
+		{"worker", 2, []string{"worker:1", "worker:2"}, nil},
+		{"worker", 1, []string{"worker:1"}, nil},
+		{"manual", 1, nil, PoolConflictError},
+	}
+
+	for i, tt := range table {
+		tags := map[string]string{"gpu": "true"}
+		rescModel := new(MockModel)
+		rescModel.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, nil)
+		rescModel.On("Remove", mock.AnythingOfType("*main.Resource")).Return(nil).Maybe()
+		broker := new(MockServiceBroker)
+		broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+		ctrl := NewResourceController(broker)
+		ctrl.resources["manual"] = &Resource{Name: "manual"}
+		ctrl.resources["worker:1"] = &Resource{Name: "worker:1", Pool: "worker", Registered: true, Offline: true}
+		ctrl.resources["worker:3"] = &Resource{Name: "worker:3", Pool: "worker", Registered: true}
+		ctrl.resources["worker:4"] = &Resource{Name: "worker:4", Pool: "worker", Registered: true, Status: ResourceLocked}
+		slots, err := ctrl.RegisterResource(tt.Name, tags, tt.Capacity, new(MockModel), rescModel)
+		if err != tt.Err {
+			t.Fatalf("[%d] expected error '%v', got '%v'", i, tt.Err, err)
+		}
+		if fmt.Sprint(slots) != fmt.Sprint(tt.Slots) {
+			t.Fatalf("[%d] expected slots %v, got %v", i, tt.Slots, slots)
+		}
+		if tt.Err != nil {
+			continue
+		}
+		for _, slot := range slots {
+			resource := ctrl.resources[slot]
+			if !resource.Registered || resource.Offline || resource.HeartbeatAt == nil || resource.Tags["gpu"] != "true" {
+				t.Fatalf("[%d] unexpected slot %+v", i, resource)
+			}
+		}
+		if _, ok := ctrl.resources["worker:3"]; ok {
+			t.Fatalf("[%d] expected surplus slot to be removed", i)
+		}
+		if !ctrl.resources["worker:4"].Draining {
+			t.Fatalf("[%d] expected locked surplus slot to be draining", i)
+		}
+	}
+}
+
+func TestControllerDeregisterResources(t *testing.T) {
+	var table = []struct {
+		HeartbeatAge time.Duration
+		Registered   bool
+		Locked       bool
+		Count        int
+	}{
+		{time.Minute, true, false, 0},
+		{DeregisterTimeout + time.Minute, true, false, 1},
+		{DeregisterTimeout + time.Minute, true, true, 0},
+		{DeregisterTimeout + time.Minute, false, false, 0},
+	}
+
+	for i, tt := range table {
+		heartbeatAt := time.Now().Add(-tt.HeartbeatAge)
+		rescModel := new(MockModel)
+		rescModel.On("Remove", mock.AnythingOfType("*main.Resource")).Return(nil).Maybe()
+		broker := new(MockServiceBroker)
+		broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+		ctrl := NewResourceController(broker)
+		ctrl.resources["worker:1"] = &Resource{Name: "worker:1", Pool: "worker", HeartbeatAt: &heartbeatAt, Registered: tt.Registered}
+		if tt.Locked {
+			ctrl.resources["worker:1"].Status = ResourceLocked
+		}
+		count, err := ctrl.DeregisterResources(new(MockModel), rescModel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != tt.Count {
+			t.Fatalf("[%d] expected %d deregistered resources, got %d", i, tt.Count, count)
+		}
+		if _, ok := ctrl.resources["worker:1"]; ok == (tt.Count > 0) {
+			t.Fatalf("[%d] unexpected resource presence", i)
+		}
+	}
+}
+
+func TestControllerMarkOfflineResources(t *testing.T) {
+	var table = []struct {
+		HeartbeatAge time.Duration
+		Locked       bool
+		Count        int
+		Status       string
+	}{
+		{time.Second, true, 0, StatusStarted},
+		{time.Minute, false, 1, StatusStarted},
+		{time.Minute, true, 1, StatusQueued},
+	}
+
+	for i, tt := range table {
+		heartbeatAt := time.Now().Add(-tt.HeartbeatAge)
+		task := &Task{Id: "abc123", Key: "test", Priority: 1, Status: StatusStarted}
+		task.BeginAttempt("worker-1")
+		broker := new(MockServiceBroker)
+		broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+		params := map[string]interface{}{"key": "test", "id": "abc123", "priority": float64(1)}
+		broker.On("Call", mock.Anything, PriorityQueueHost, "push", params).Return(float64(0), nil).Maybe()
+		taskModel := new(MockModel)
+		taskModel.On("Get", "abc123").Return(task, nil).Maybe()
+		taskModel.On("Save", task).Return(DocumentMeta{}, nil).Maybe()
+		rescModel := new(MockModel)
+		rescModel.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, nil).Maybe()
+		ctrl := NewResourceController(broker)
+		ctrl.resources["test"] = &Resource{Name: "test", HeartbeatAt: &heartbeatAt}
+		ctrl.resources["legacy"] = &Resource{Name: "legacy"}
+		if tt.Locked {
+			ctrl.resources["test"].Status = ResourceLocked
+			ctrl.resources["test"].TaskId = "abc123"
+		}
+		count, err := ctrl.MarkOfflineResources(taskModel, rescModel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != tt.Count {
+			t.Fatalf("[%d] expected %d offline resources, got %d", i, tt.Count, count)
+		}
+		if ctrl.resources["test"].Offline != (tt.Count > 0) || ctrl.resources["legacy"].Offline {
+			t.Fatalf("[%d] unexpected offline state", i)
+		}
+		if task.Status != tt.Status {
+			t.Fatalf("[%d] expected task status %s, got %s", i, tt.Status, task.Status)
+		}
+	}
+}
+
+func TestControllerGetResourceStats(t *testing.T) {
+	now := time.Now()
+	lockedAt := now.Add(-time.Minute * 15)
+	var table = []struct {
+		Name     string
+		QueryErr error
+		Err      error
+	}{
+		{"test", nil, nil},
+		{"missing", nil, ResourceNotFoundError},
+		{"test", errors.New("query error"), errors.New("query error")},
+	}
+
+	for _, tt := range table {
+		model := &MockModel{}
+		q := fmt.Sprintf(
+			`FOR s IN %s FILTER s.resource == @resource AND DATE_TIMESTAMP(s.ended) >= DATE_NOW() - @window RETURN s`,
+			CollectionResourceStats,
+		)
+		vars := map[string]interface{}{"resource": "test", "window": int64(24 * 60 * 60 * 1000)}
+		model.On("Query", q, vars).Return([]interface{}{NewResourceStat("test", now.Add(-time.Minute*45), now.Add(-time.Minute*30))}, tt.QueryErr)
+		ctrl := NewResourceController(nil)
+		ctrl.resources["test"] = &Resource{Name: "test", Status: ResourceLocked, LockedAt: &lockedAt}
+		stats, err := ctrl.GetResourceStats(tt.Name, []time.Duration{time.Hour, time.Hour * 24}, model)
+		if fmt.Sprint(err) != fmt.Sprint(tt.Err) {
+			t.Fatalf("expected error '%v', got '%v'", tt.Err, err)
+		}
+		if err != nil {
+			continue
+		}
+		if stats.Name != "test" || len(stats.Windows) != 2 {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+		if busy := stats.Windows[0].Busy; math.Abs(busy-1800) > 1 {
+			t.Fatalf("expected 1800 busy seconds in the first window, got %f", busy)
+		}
+	}
+}
+
+func TestControllerUnlockResource(t *testing.T) {
+	lockedAt := time.Now().Add(-time.Minute)
+	model := &MockModel{}
+	model.On("Save", mock.AnythingOfType("*main.ResourceStat")).Return(DocumentMeta{}, nil).Once()
+	ctrl := NewResourceController(nil)
+	ctrl.TrackResourceStats(model)
+	resource := &Resource{Name: "test", Status: ResourceLocked, TaskId: "abc123", LockedAt: &lockedAt}
+	ctrl.unlockResource(resource)
+	if resource.Status != ResourceFree || resource.TaskId != "" || resource.LockedAt != nil {
+		t.Fatalf("expected resource to be unlocked, got %+v", resource)
+	}
+	stat := model.Calls[0].Arguments.Get(0).(*ResourceStat)
+	if stat.Resource != "test" || !stat.Started.Equal(lockedAt) {
+		t.Fatalf("unexpected resource stat %+v", stat)
+	}
+	ctrl.unlockResource(resource)
+	model.AssertExpectations(t)
+}
+
+func TestControllerReleaseTaskLock(t *testing.T) {
+	lockedAt := time.Now()
+	ctrl := NewResourceController(nil)
+	ctrl.resources["test"] = &Resource{Name: "test", Status: ResourceLocked, TaskId: "abc123", LockedAt: &lockedAt}
+	if _, ok := ctrl.releaseTaskLock("test", "other"); ok {
+		t.Fatal("expected a lock held by another task not to be released")
+	}
+	if _, ok := ctrl.releaseTaskLock("missing", "abc123"); ok {
+		t.Fatal("expected a missing resource not to be released")
+	}
+	resource, ok := ctrl.releaseTaskLock("test", "abc123")
+	if !ok || resource.Status != ResourceFree || resource.TaskId != "" || resource.LockedAt != nil {
+		t.Fatalf("expected resource to be unlocked, got %+v", resource)
+	}
+}
+
+func TestControllerSaveResource(t *testing.T) {
+	resource := &Resource{Name: "test", QuotaStarts: []time.Time{time.Now()}}
+	model := &MockModel{}
+	model.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, nil).Run(func(args mock.Arguments) {
+		doc := args.Get(0).(*Resource)
+		if doc == resource || &doc.QuotaStarts[0] == &resource.QuotaStarts[0] {
+			t.Error("expected a copy of the resource to be saved")
+		}
+		touchResource(doc, "tester")
+	})
+	ctrl := NewResourceController(nil)
+	ctrl.storeResource(resource)
+	if err := ctrl.saveResource(resource, model); err != nil {
+		t.Fatal(err)
+	}
+	if resource.UpdatedBy != "tester" || resource.Updated.IsZero() {
+		t.Fatalf("expected the save times to be copied back, got %+v", resource)
+	}
+}
+
+func TestControllerResourcesByWeight(t *testing.T) {
+	ctrl := NewResourceController(nil)
+	ctrl.resources["old1"] = &Resource{Name: "old1", Weight: 1}
+	ctrl.resources["old2"] = &Resource{Name: "old2"}
+	ctrl.resources["new2"] = &Resource{Name: "new2", Weight: 5}
+	ctrl.resources["new1"] = &Resource{Name: "new1", Weight: 5}
+	names := ctrl.resourcesByWeight()
+	if fmt.Sprint(names) != "[new1 new2 old1 old2]" {
+		t.Fatalf("unexpected resource order %v", names)
+	}
+}
+
+func TestControllerSetResourceWeight(t *testing.T) {
+	var table = []struct {
+		Name string
+		Err  error
+	}{
+		{"test", nil},
+		{"missing", ResourceNotFoundError},
+	}
+
+	for _, tt := range table {
+		model := &MockModel{}
+		model.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, nil).Maybe()
+		ctrl := NewResourceController(nil)
+		ctrl.resources["test"] = &Resource{Name: "test", Weight: 1}
+		if err := ctrl.SetResourceWeight(tt.Name, 3, model); err != tt.Err {
+			t.Fatalf("expected error '%v', got '%v'", tt.Err, err)
+		}
+		if tt.Err == nil && ctrl.resources["test"].Weight != 3 {
+			t.Fatalf("expected weight 3, got %g", ctrl.resources["test"].Weight)
+		}
+	}
+}
+
+func TestControllerSetResourceParent(t *testing.T) {
+	var table = []struct {
+		Name   string
+		Parent string
+		Err    error
+	}{
+		{"gpu0", "host", nil},
+		{"gpu0", "", nil},
+		{"missing", "host", ResourceNotFoundError},
+		{"gpu0", "missing", ResourceNotFoundError},
+		{"gpu0", "gpu0", ResourceCycleError},
+		{"host", "gpu0", ResourceCycleError},
+		{"rack", "gpu0", ResourceCycleError},
+	}
+
+	for i, tt := range table {
+		model := &MockModel{}
+		model.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, nil).Maybe()
+		ctrl := NewResourceController(nil)
+		ctrl.resources["rack"] = &Resource{Name: "rack"}
+		ctrl.resources["host"] = &Resource{Name: "host", Parent: "rack"}
+		ctrl.resources["gpu0"] = &Resource{Name: "gpu0", Parent: "host"}
+		if err := ctrl.SetResourceParent(tt.Name, tt.Parent, model); err != tt.Err {
+			t.Fatalf("[%d] expected error '%v', got '%v'", i, tt.Err, err)
+		}
+		if tt.Err == nil && ctrl.resources[tt.Name].Parent != tt.Parent {
+			t.Fatalf("[%d] expected parent '%s', got '%s'", i, tt.Parent, ctrl.resources[tt.Name].Parent)
+		}
+	}
+}
+
+func TestControllerRelativeLocked(t *testing.T) {
+	var table = []struct {
+		Locked string
+		Name   string
+		Result bool
+	}{
+		{"rack", "gpu0", true},
+		{"gpu0", "rack", true},
+		{"gpu0", "host", true},
+		{"gpu0", "gpu1", false},
+		{"gpu0", "gpu0", false},
+		{"other", "host", false},
+	}
+
+	for i, tt := range table {
+		ctrl := NewResourceController(nil)
+		ctrl.resources["rack"] = &Resource{Name: "rack"}
+		ctrl.resources["host"] = &Resource{Name: "host", Parent: "rack"}
+		ctrl.resources["gpu0"] = &Resource{Name: "gpu0", Parent: "host"}
+		ctrl.resources["gpu1"] = &Resource{Name: "gpu1", Parent: "host"}
+		ctrl.resources["other"] = &Resource{Name: "other"}
+		ctrl.resources[tt.Locked].Status = ResourceLocked
+		if result := ctrl.relativeLocked(tt.Name); result != tt.Result {
+			t.Fatalf("[%d] expected %t, got %t", i, tt.Result, result)
+		}
+	}
+}
+
+func TestControllerQuotaExhausted(t *testing.T) {
+	broker := &MockServiceBroker{}
+	broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.MatchedBy(func(params map[string]interface{}) bool {
+		return params["kind"] == QuotaExceededEvent
+	})).Return(float64(0), nil).Once()
+	ctrl := NewResourceController(broker)
+	ctrl.resources["test"] = &Resource{Name: "test", Quota: &ResourceQuota{Limit: 1, Period: 60}}
+	if ctrl.quotaExhausted(context.Background(), "test") {
+		t.Fatal("expected quota not to be exhausted")
+	}
+	ctrl.resources["test"].RecordStart(time.Now())
+	for i := 0; i < 2; i++ {
+		if !ctrl.quotaExhausted(context.Background(), "test") {
+			t.Fatal("expected quota to be exhausted")
+		}
+	}
+	broker.AssertExpectations(t)
+}
+
+func TestControllerStartRateLimited(t *testing.T) {
+	ctrl := NewResourceController(nil)
+	ctrl.LimitStarts(NewStartLimiter(1, 1))
+	ctrl.resources["test"] = &Resource{Name: "test", Status: ResourceFree}
+	if err := ctrl.claimResource("test", &Task{Id: "abc123", Key: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	ctrl.resources["test"].Status = ResourceFree
+	if err := ctrl.claimResource("test", &Task{Id: "def456", Key: "test"}); err != StartRateLimitedError {
+		t.Fatalf("expected error %v, got %v", StartRateLimitedError, err)
+	}
+	if ctrl.resources["test"].Status != ResourceFree {
+		t.Fatal("expected the resource to stay free")
+	}
+	broker := new(MockServiceBroker)
+	broker.On("Call", mock.Anything, PriorityQueueHost, "get", mock.Anything).Return(map[string]interface{}{"heap": []interface{}{}}, nil)
+	broker.On("Call", mock.Anything, TimetableHost, "get", mock.Anything).Return(map[string]interface{}{"schedule": map[string]interface{}{}}, nil)
+	ctrl.broker = broker
+	detail, err := ctrl.GetResource("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail.StartLimit == nil || detail.StartLimit.NextStartAt == nil {
+		t.Fatalf("expected the start limit state, got %+v", detail.StartLimit)
+	}
+}
+
+func TestControllerAtCapacity(t *testing.T) {
+	defer func(n int) { MaxStartedTasks = n }(MaxStartedTasks)
+	MaxStartedTasks = 1
+
+	ctrl := NewResourceController(nil)
+	ctrl.resources["test1"] = &Resource{Name: "test1", Status: ResourceFree}
+	ctrl.resources["test2"] = &Resource{Name: "test2", Status: ResourceFree}
+	if ctrl.atCapacity() {
+		t.Fatal("expected the controller not to be at capacity")
+	}
+	if err := ctrl.claimResource("test1", &Task{Id: "abc123", Key: "test1"}); err != nil {
+		t.Fatal(err)
+	}
+	if !ctrl.atCapacity() {
+		t.Fatal("expected the controller to be at capacity")
+	}
+	if err := ctrl.claimResource("test2", &Task{Id: "def456", Key: "test2"}); err != AtCapacityError {
+		t.Fatalf("expected error %v, got %v", AtCapacityError, err)
+	}
+	if ctrl.resources["test2"].Status != ResourceFree {
+		t.Fatal("expected the resource to stay free")
+	}
+	ctrl.unlockResource(ctrl.resources["test1"])
+	if ctrl.atCapacity() {
+		t.Fatal("expected the completion to free a slot")
+	}
+}
+
+func TestControllerSetResourceQuota(t *testing.T) {
+	var table = []struct {
+		Name  string
+		Quota *ResourceQuota
+		Err   error
+	}{
+		{"test", &ResourceQuota{Limit: 100, Period: 86400}, nil},
+		{"test", nil, nil},
+		{"missing", nil, ResourceNotFoundError},
+	}
+
+	for _, tt := range table {
+		model := &MockModel{}
+		model.On("Save", mock.AnythingOfType("*main.Resource")).Return(DocumentMeta{}, nil).Maybe()
+		ctrl := NewResourceController(nil)
+		ctrl.resources["test"] = &Resource{Name: "test", QuotaStarts: []time.Time{time.Now()}}
+		if err := ctrl.SetResourceQuota(tt.Name, tt.Quota, model); err != tt.Err {
+			t.Fatalf("expected error '%v', got '%v'", tt.Err, err)
+		}
+		if tt.Err == nil && ctrl.resources["test"].Quota != tt.Quota {
+			t.Fatalf("expected quota %+v", tt.Quota)
+		}
+		if tt.Err == nil && tt.Quota == nil && ctrl.resources["test"].QuotaStarts != nil {
+			t.Fatal("expected counted starts to be cleared")
+		}
+	}
+}
+
+func TestControllerConcurrentResourceAccess(t *testing.T) {
+	taskModel := &MockModel{}
+	taskModel.On("Save", mock.Anything).Return(DocumentMeta{}, nil)
+	taskModel.On("Query", dependentsQuery, mock.Anything).Return(nil, nil).Maybe()
+	rescModel := &MockModel{}
+	rescModel.On("Save", mock.Anything).Return(DocumentMeta{}, nil)
+	broker := &MockServiceBroker{}
+	broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil)
+	ctrl := NewResourceController(broker)
+
+	const n = 8
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("test%d", i)
+		task := &Task{Id: fmt.Sprintf("abc%d", i), Key: keys[i], Status: StatusPending}
+		taskModel.On("Get", task.Id).Return(task, nil)
+		ctrl.storeResource(&Resource{Name: keys[i], Status: ResourceFree})
+		ctrl.stage.Store(keys[i], NewStagedSlot(time.Now(), task))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(3)
+		go func(i int) {
+			defer wg.Done()
+			if err := ctrl.StartTask(keys[i], "", taskModel, rescModel); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := ctrl.CompleteTask(fmt.Sprintf("abc%d", i), StatusError, nil, "", false, taskModel, rescModel); err != nil {
+				t.Error(err)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			if err := ctrl.AddResource(fmt.Sprintf("added%d", i), "", nil, 0, rescModel); err != nil {
+				t.Error(err)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for _, key := range ctrl.resourcesByWeight() {
+				if resource, ok := ctrl.lookupResource(key); ok {
+					ctrl.resourceStatus(resource)
+				}
+				ctrl.relativeLocked(key)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if count := len(ctrl.resourceSnapshot()); count != 2*n {
+		t.Fatalf("expected %d resources, got %d", 2*n, count)
+	}
+	for _, key := range keys {
+		if resource, _ := ctrl.lookupResource(key); resource.Status != ResourceFree {
+			t.Fatalf("expected resource %s to be free", key)
+		}
+	}
+}
+
+func TestControllerConcurrentStartTask(t *testing.T) {
+	taskModel := &MockModel{}
+	taskModel.On("Save", mock.Anything).Return(DocumentMeta{}, nil)
+	rescModel := &MockModel{}
+	rescModel.On("Save", mock.Anything).Return(DocumentMeta{}, nil)
+	broker := &MockServiceBroker{}
+	broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+	ctrl := NewResourceController(broker)
+	ctrl.storeResource(&Resource{Name: "parent", Status: ResourceFree})
+	ctrl.storeResource(&Resource{Name: "child", Parent: "parent", Status: ResourceFree})
+	for _, key := range []string{"parent", "child"} {
+		ctrl.stage.Store(key, NewStagedSlot(time.Now(), &Task{Id: key, Key: key, Status: StatusPending}))
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for _, key := range []string{"parent", "child"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			errs <- ctrl.StartTask(key, "", taskModel, rescModel)
+		}(key)
+	}
+	wg.Wait()
+	close(errs)
+
+	started := 0
+	for err := range errs {
+		if err == nil {
+			started++
+		} else if err != ResourceUnavailableError {
+			t.Fatal(err)
+		}
+	}
+	if started != 1 {
+		t.Fatalf("expected 1 started task, got %d", started)
+	}
+}
+
+func TestControllerConcurrentStartSameKey(t *testing.T) {
+	defer func(n int) { StageLookahead = n }(StageLookahead)
+	StageLookahead = 3
+
+	taskModel := &MockModel{}
+	taskModel.On("Save", mock.Anything).Return(DocumentMeta{}, nil)
+	rescModel := &MockModel{}
+	rescModel.On("Save", mock.Anything).Return(DocumentMeta{}, nil)
+	broker := &MockServiceBroker{}
+	broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+	ctrl := NewResourceController(broker)
+	ctrl.storeResource(&Resource{Name: "test", Status: ResourceFree})
+	ctrl.stage.Store("test", NewStagedSlot(
+		time.Now(),
+		&Task{Id: "abc123", Key: "test", Status: StatusPending},
+		&Task{Id: "def456", Key: "test", Status: StatusPending},
+		&Task{Id: "ghi789", Key: "test", Status: StatusPending},
+	))
+
+	const n = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- ctrl.StartTask("test", "", taskModel, rescModel)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	started := 0
+	for err := range errs {
+		if err == nil {
+			started++
+		} else if err != ResourceUnavailableError {
+			t.Fatal(err)
+		}
+	}
+	if started != 1 {
+		t.Fatalf("expected 1 started task, got %d", started)
+	}
+	if resource, _ := ctrl.lookupResource("test"); resource.TaskId != "abc123" {
+		t.Fatalf("expected task abc123 to lock the resource, got %s", resource.TaskId)
+	}
+	staged, _ := ctrl.ListStagedTasks("test")
+	if len(staged) != 2 || staged[0].Id != "def456" || staged[1].Id != "ghi789" {
+		t.Fatalf("expected staged tasks [def456 ghi789], got %v", staged)
+	}
+}
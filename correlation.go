@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/satori/go.uuid"
+)
+
+const CorrelationHeader = "X-Correlation-Id" // the header of the correlation id of a broker call.
+
+var DebugLogging = os.Getenv("CONCORD_LOG_LEVEL") == "debug" // log the requests and responses of broker calls.
+
+// correlationKey is the context key of the correlation id.
+type correlationKey struct{}
+
+// NewCorrelationId returns a new unique version 1 uuid correlation id.
+func NewCorrelationId() string {
+	id, _ := uuid.NewV1()
+	return id.String()
+}
+
+// WithCorrelationId returns a copy of the context with the correlation id.
+func WithCorrelationId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// CorrelationId returns the correlation id of the context. An empty string
+// is returned if the context has none.
+func CorrelationId(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// logf logs the message with the correlation id of the context.
+func logf(ctx context.Context, format string, v ...interface{}) {
+	if id := CorrelationId(ctx); id != "" {
+		format = "[" + id + "] " + format
+	}
+	log.Printf(format, v...)
+}
+
+// logln logs the operands with the correlation id of the context.
+func logln(ctx context.Context, v ...interface{}) {
+	logf(ctx, "%s", fmt.Sprintln(v...))
+}
+
+// debugf logs the message with the correlation id of the context if debug
+// logging is enabled.
+func debugf(ctx context.Context, format string, v ...interface{}) {
+	if DebugLogging {
+		logf(ctx, format, v...)
+	}
+}
+
+// operation returns the context of a new controller operation with a new
+// correlation id. The broker calls and log lines of the operation carry
+// the correlation id.
+func (ctrl *ResourceController) operation() context.Context {
+	return WithCorrelationId(ctrl.ctx, NewCorrelationId())
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCorrelationLogging(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer func(debug bool) { DebugLogging = debug }(DebugLogging)
+
+	ctx := WithCorrelationId(context.Background(), "abc123")
+	if id := CorrelationId(ctx); id != "abc123" {
+		t.Fatalf("expected the correlation id abc123, got %s", id)
+	}
+	logf(ctx, "started task [%s]\n", "test")
+	logln(context.Background(), "task not found", "xyz789")
+	DebugLogging = false
+	debugf(ctx, "broker request\n")
+	if out := buf.String(); !strings.Contains(out, "[abc123] started task [test]\n") || !strings.Contains(out, " task not found xyz789\n") || strings.Contains(out, "broker request") {
+		t.Fatalf("unexpected log output %q", out)
+	}
+	DebugLogging = true
+	debugf(ctx, "broker request\n")
+	if !strings.Contains(buf.String(), "[abc123] broker request") {
+		t.Fatalf("expected the debug line to be logged, got %q", buf.String())
+	}
+}
+
+func TestServiceBrokerCallCorrelation(t *testing.T) {
+	var header string
+	var ids []interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Id interface{} `json:"id"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		header, ids = r.Header.Get(CorrelationHeader), append(ids, req.Id)
+		w.Write([]byte(`{"jsonrpc": "2.0", "result": 0, "id": 0}`))
+	}))
+	defer srv.Close()
+	url := strings.TrimPrefix(srv.URL, "http://")
+
+	broker := NewJsonRPCServiceBroker()
+	if _, errObj := broker.Call(WithCorrelationId(context.Background(), "abc123"), url, "push", nil); errObj != nil {
+		t.Fatal(errObj)
+	}
+	if header != "abc123" {
+		t.Fatalf("expected the correlation id in the header, got %s", header)
+	}
+	if _, errObj := broker.Call(context.Background(), url, "push", nil); errObj != nil {
+		t.Fatal(errObj)
+	}
+	if header != "" {
+		t.Fatalf("expected no correlation id, got %s", header)
+	}
+	if ids[0] == float64(0) || ids[1] == float64(0) || ids[0] == ids[1] {
+		t.Fatalf("expected unique non-zero request ids, got %v", ids)
+	}
+}
+
+func TestControllerOperationCorrelation(t *testing.T) {
+	task := &Task{Id: "abc123", Key: "test", Priority: 2.5}
+	var calls []string
+	record := func(args mock.Arguments) {
+		calls = append(calls, CorrelationId(args.Get(0).(context.Context)))
+	}
+	broker := &MockServiceBroker{}
+	broker.On("Call", mock.Anything, PriorityQueueHost, "push", mock.Anything).Run(record).Return(float64(0), nil)
+	broker.On("Call", mock.Anything, PriorityQueueHost, "remove", mock.Anything).Run(record).Return(float64(0), nil)
+	broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Run(record).Return(float64(0), nil)
+	taskModel := &MockModel{}
+	taskModel.On("Save", mock.Anything).Return(DocumentMeta{}, nil)
+	taskModel.On("Get", "abc123").Return(task, nil)
+	taskModel.On("Query", mock.Anything, mock.Anything).Return([]interface{}{}, nil)
+	taskModel.On("Remove", mock.Anything).Return(nil)
+	rescModel := &MockModel{}
+	rescModel.On("Save", mock.Anything).Return(DocumentMeta{}, nil)
+	rescModel.On("Query", mock.Anything, mock.Anything).Return(nil, nil).Maybe()
+	archiveModel := &MockModel{}
+	archiveModel.On("Save", mock.Anything).Return(DocumentMeta{}, nil)
+	ctrl := NewResourceController(broker)
+
+	if err := ctrl.AddTask(task, taskModel, rescModel); err != nil {
+		t.Fatal(err)
+	}
+	added := len(calls)
+	if err := ctrl.RemoveTask("abc123", "", taskModel, archiveModel); err != nil {
+		t.Fatal(err)
+	}
+	if added == 0 || len(calls) < added+2 {
+		t.Fatalf("expected broker calls for both operations, got %v", calls)
+	}
+	for i, id := range calls {
+		first := calls[0]
+		if i >= added {
+			first = calls[added]
+		}
+		if id == "" || id != first {
+			t.Fatalf("[%d] expected the calls of an operation to share a correlation id, got %v", i, calls)
+		}
+	}
+	if calls[0] == calls[added] {
+		t.Fatalf("expected each operation to have its own correlation id, got %v", calls)
+	}
+}
@@ -1,21 +1,82 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	arango "github.com/arangodb/go-driver"
 	arangohttp "github.com/arangodb/go-driver/http"
 )
 
-const (
-	CollectionResources = "resources"  // the name of the resources database collection.
-	CollectionTasks     = "tasks"      // the name of the tasks database collection.
-	CollectionTaskStats = "task_stats" // the name of the task stats database collection.
+var CollectionPrefix = os.Getenv("CONCORD_COLLECTION_PREFIX") // the prefix of the collection names, so several environments can share a database.
+
+var (
+	CollectionDeferredCalls = CollectionPrefix + "deferred_calls" // the name of the deferred calls database collection.
+	CollectionFailedEvents  = CollectionPrefix + "failed_events"  // the name of the failed events database collection.
+	CollectionResources     = CollectionPrefix + "resources"      // the name of the resources database collection.
+	CollectionResourceStats = CollectionPrefix + "resource_stats" // the name of the resource stats database collection.
+	CollectionShardMembers  = CollectionPrefix + "shard_members"  // the name of the shard members database collection.
+	CollectionTaskGroups    = CollectionPrefix + "task_groups"    // the name of the task groups database collection.
+	CollectionTaskHistory   = CollectionPrefix + "task_history"   // the name of the task history database collection.
+	CollectionTaskLogs      = CollectionPrefix + "task_logs"      // the name of the task logs database collection.
+	CollectionTasks         = CollectionPrefix + "tasks"          // the name of the tasks database collection.
+	CollectionTasksArchive  = CollectionPrefix + "tasks_archive"  // the name of the removed tasks database collection.
+	CollectionTaskStats     = CollectionPrefix + "task_stats"     // the name of the task stats database collection.
+)
+
+const DatabaseUnavailableExitCode = 3 // the exit code when the database cannot be connected on startup.
+
+const StreamBatchSize = 500 // the number of documents read from a streamed query at a time.
+
+var (
+	DatabaseAttempts      = int(envFloat("ARANGODB_CONNECT_ATTEMPTS"))                    // the number of database connection attempts on startup, unlimited if 0.
+	DatabaseBackoff       = envDurationOr("ARANGODB_CONNECT_BACKOFF", time.Second)        // the delay before the first database connection retry.
+	DatabaseMaxBackoff    = envDurationOr("ARANGODB_CONNECT_MAX_BACKOFF", time.Second*30) // the maximum delay between database connection attempts.
+	DatabaseFailFast      = os.Getenv("ARANGODB_FAIL_FAST") != ""                         // give up on startup after the first failed connection attempt.
+	DatabaseWatchInterval = envDurationOr("ARANGODB_WATCH_INTERVAL", time.Second*10)      // the interval between database connection checks.
+	DatabaseConnLimit     = int(envFloat("ARANGODB_CONN_LIMIT"))                          // the maximum number of connections per coordinator, the driver default if 0.
+	DatabaseSyncInterval  = envDuration("ARANGODB_SYNC_INTERVAL")                         // the interval between coordinator endpoint discoveries, disabled if 0.
+)
+
+var QueryTimeout = envDuration("CONCORD_QUERY_TIMEOUT") // the maximum runtime of a query, unlimited if 0.
+
+var (
+	DatabaseShards            = int(envFloat("ARANGODB_SHARDS"))             // the number of shards of the created collections, the server default if 0.
+	DatabaseReplicationFactor = int(envFloat("ARANGODB_REPLICATION_FACTOR")) // the number of copies of each shard of the created collections, the server default if 0.
 )
 
-var db arango.Database // package local arango database instance.
+// shardKeys are the shard keys of the collections that are not sharded by
+// the document key. Task logs, history and stats are kept with the other
+// documents of their task or task key, and are never read by document key.
+// Tasks stay sharded by _key and not by their task key, because arangodb
+// rejects documents with a custom _key, like the task id, in a collection
+// sharded by another attribute.
+var shardKeys = map[string][]string{
+	CollectionTaskHistory: {"taskId"},
+	CollectionTaskLogs:    {"taskId"},
+	CollectionTaskStats:   {"key"},
+	CollectionTasks:       {"_key"},
+}
+
+var (
+	DatabaseUnavailableError  = errors.New("database unavailable")
+	NoDatabaseEndpointsError  = errors.New("no database endpoints")
+	NoMoreDocumentsError      = errors.New("no more documents")
+	UnsupportedOperationError = errors.New("unsupported operation")
+)
+
+var (
+	db     arango.Database // package local arango database instance.
+	dbLock sync.RWMutex    // guards the database instance replaced on reconnect.
+)
 
 // DocumentMeta contains meta data for an arango document
 type DocumentMeta struct {
@@ -24,252 +85,1542 @@ type DocumentMeta struct {
 
 // Model contains methods for interacting with database collections.
 type Model interface {
+	// Create creates the collection and its indexes.
+	// FetchAll returns all documents of the collection.
+	// Get returns the document with the key, or nil if it does not exist.
+	// Query runs the AQL query with the bind variables and returns the
+	// documents it returns.
+	// QueryPage runs the AQL query with the bind variables and the offset
+	// and limit bind variables, and returns the page of documents.
+	// QueryStream runs the AQL query with the bind variables and returns an
+	// iterator of the documents it returns.
+	// Remove deletes the document from the collection.
+	// Save creates the document, or updates the existing document with its
+	// key.
 	Create() error
 	FetchAll() ([]interface{}, error)
+	Get(string) (interface{}, error)
 	Query(string, interface{}) ([]interface{}, error)
+	QueryPage(string, interface{}, int, int) (*Page, error)
+	QueryStream(string, interface{}) (DocumentIterator, error)
 	Remove(interface{}) error
 	Save(interface{}) (DocumentMeta, error)
 }
 
-// TaskStatModel represents a task stat collection model.
-type TaskStatModel struct{}
+// Page is a page of the documents matched by a paginated query.
+type Page struct {
+	// Docs are the documents in the page.
+	// Total is the number of documents matched by the query regardless of
+	// the page.
+	Docs  []interface{}
+	Total int64
+}
 
-// Create creates the task_stats collection and creates a persistent index on
-// the Created field in the arangodb database.
-func (model *TaskStatModel) Create() error {
-	col, err := db.CreateCollection(nil, CollectionTaskStats, nil)
+// PageCursor returns the opaque cursor token of the page that starts at
+// the offset.
+func PageCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+// PageOffset returns the offset of the page of the cursor token.
+//
+// an error is encountered if the cursor token is malformed.
+func PageOffset(cursor string) (int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
 	if err != nil {
-		if arango.IsConflict(err) {
-			return nil
-		}
-		return err
+		return 0, InvalidCursorError
 	}
-	_, _, err = col.EnsurePersistentIndex(nil, []string{"Created"}, nil)
-	if err != nil {
-		return err
+	offset, err := strconv.Atoi(string(data))
+	if err != nil || offset < 0 {
+		return 0, InvalidCursorError
 	}
-	return err
+	return offset, nil
 }
 
-func (model *TaskStatModel) FetchAll() ([]interface{}, error) {
-	return make([]interface{}, 0), nil
+// collectionOptions returns the options of the named collection in an
+// arangodb cluster. Nil is returned if neither the number of shards nor the
+// replication factor is configured.
+func collectionOptions(name string) *arango.CreateCollectionOptions {
+	if DatabaseShards <= 0 && DatabaseReplicationFactor <= 0 {
+		return nil
+	}
+	return &arango.CreateCollectionOptions{
+		NumberOfShards:    DatabaseShards,
+		ReplicationFactor: DatabaseReplicationFactor,
+		ShardKeys:         shardKeys[name],
+	}
 }
 
-// Query runs the AQL query against the task stat model collection.
-func (model *TaskStatModel) Query(q string, vars interface{}) ([]interface{}, error) {
-	taskStats := make([]interface{}, 0)
-	cursor, err := db.Query(nil, q, vars.(map[string]interface{}))
+// ensureCollection creates the collection, or returns the existing
+// collection if it was already created, so that its indexes can be ensured
+// on every start.
+func ensureCollection(name string) (arango.Collection, error) {
+	col, err := database().CreateCollection(nil, name, collectionOptions(name))
+	if err != nil && arango.IsConflict(err) {
+		return database().Collection(nil, name)
+	}
+	return col, err
+}
+
+// queryContext returns the context of a query run for ctx, or for the
+// background context if ctx is nil. The query is canceled with ctx, and
+// aborted by the database and the client once it ran for QueryTimeout.
+func queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if QueryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	ctx = arango.WithQueryMaxRuntime(ctx, QueryTimeout.Seconds())
+	return context.WithTimeout(ctx, QueryTimeout)
+}
+
+// queryDocuments runs the AQL query with the bind variables and reads the
+// returned documents into the values returned by doc. The query is bound
+// to ctx as described by queryContext.
+func queryDocuments(ctx context.Context, q string, vars interface{}, doc func() interface{}) ([]interface{}, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	bindVars, _ := vars.(map[string]interface{})
+	cursor, err := database().Query(ctx, q, bindVars)
 	if err != nil {
 		return nil, err
 	}
 	defer cursor.Close()
+	docs := make([]interface{}, 0)
 	for {
-		taskStat := new(TaskStat)
-		_, err := cursor.ReadDocument(nil, taskStat)
+		v := doc()
+		_, err := cursor.ReadDocument(ctx, v)
 		if arango.IsNoMoreDocuments(err) {
 			break
 		}
 		if err != nil {
 			return nil, err
 		}
-		taskStats = append(taskStats, taskStat)
+		docs = append(docs, v)
 	}
-	return taskStats, nil
+	return docs, nil
 }
 
-func (model *TaskStatModel) Remove(taskStat interface{}) error {
-	return nil
+// ContextModel is a model whose queries can be bound to a context, so that
+// the queries run for a request are canceled with the request.
+type ContextModel interface {
+	Model
+	WithContext(context.Context) Model
 }
 
-// Save creates a document in the task stats collection.
-func (model *TaskStatModel) Save(taskStat interface{}) (DocumentMeta, error) {
-	col, err := db.Collection(nil, CollectionTaskStats)
+// bindContext returns the model with its queries bound to ctx, or the model
+// itself if it does not support contexts.
+func bindContext(model Model, ctx context.Context) Model {
+	if bound, ok := model.(ContextModel); ok {
+		return bound.WithContext(ctx)
+	}
+	return model
+}
+
+// bindModels returns a copy of the models by name with their queries bound
+// to ctx.
+func bindModels(models map[string]Model, ctx context.Context) map[string]Model {
+	bound := make(map[string]Model, len(models))
+	for name, model := range models {
+		bound[name] = bindContext(model, ctx)
+	}
+	return bound
+}
+
+// DocumentIterator reads the documents returned by a query one at a time,
+// so that large results are never held in memory at once.
+type DocumentIterator interface {
+	// Next returns the next document. NoMoreDocumentsError is returned once
+	// all documents were read.
+	// Close releases the query. The iterator must be closed once it is no
+	// longer read.
+	Next() (interface{}, error)
+	Close() error
+}
+
+// cursorIterator is the document iterator of an arangodb query cursor.
+type cursorIterator struct {
+	ctx    context.Context
+	cursor arango.Cursor
+	doc    func() interface{}
+}
+
+// Next reads the next document of the cursor into the value returned by
+// doc. The next batch of documents is fetched once the current batch was
+// read.
+func (it *cursorIterator) Next() (interface{}, error) {
+	v := it.doc()
+	_, err := it.cursor.ReadDocument(it.ctx, v)
+	if arango.IsNoMoreDocuments(err) {
+		return nil, NoMoreDocumentsError
+	}
 	if err != nil {
-		return DocumentMeta{}, err
+		return nil, err
 	}
-	meta, err := col.CreateDocument(nil, taskStat)
+	return v, nil
+}
+
+// Close closes the cursor, which releases it in the database before it
+// expires.
+func (it *cursorIterator) Close() error {
+	return it.cursor.Close()
+}
+
+// queryStream runs the AQL query with the bind variables and returns an
+// iterator of the returned documents read into the values returned by doc.
+// The documents are read from the cursor in batches of StreamBatchSize.
+// The query is canceled with ctx, but it is not limited by QueryTimeout
+// since its documents are read as fast as the caller handles them.
+func queryStream(ctx context.Context, q string, vars interface{}, doc func() interface{}) (DocumentIterator, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	bindVars, _ := vars.(map[string]interface{})
+	ctx = arango.WithQueryBatchSize(ctx, StreamBatchSize)
+	cursor, err := database().Query(ctx, q, bindVars)
 	if err != nil {
-		return DocumentMeta{}, err
+		return nil, err
 	}
-	return DocumentMeta{Id: meta.ID}, nil
+	return &cursorIterator{ctx, cursor, doc}, nil
 }
 
-// TaskModel represents a task collection model.
-type TaskModel struct{}
+// streamQuery calls fn with each document returned by the query stream of
+// the model. The documents of a cached model are streamed past its cache.
+//
+// an error is encountered if the query fails or fn returns an error, which
+// stops the stream.
+func streamQuery(model Model, q string, vars interface{}, fn func(interface{}) error) error {
+	it, err := model.QueryStream(q, vars)
+	if err != nil {
+		return err
+	}
+	return streamDocuments(it, fn)
+}
 
-// Create creates the tasks collection in the arangodb database.
-func (model *TaskModel) Create() error {
-	col, err := db.CreateCollection(nil, CollectionTasks, nil)
-	if err != nil && arango.IsConflict(err) {
-		return nil
+// streamDocuments calls fn with each document of the iterator and closes
+// it.
+//
+// an error is encountered if the iterator fails or fn returns an error,
+// which stops the stream.
+func streamDocuments(it DocumentIterator, fn func(interface{}) error) error {
+	defer it.Close()
+	for {
+		doc, err := it.Next()
+		if err == NoMoreDocumentsError {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(doc); err != nil {
+			return err
+		}
 	}
-	_, _, err = col.EnsureHashIndex(nil, []string{"status"}, nil)
-	return err
 }
 
-func (model *TaskModel) FetchAll() ([]interface{}, error) {
-	return make([]interface{}, 0), nil
+// getDocument reads the document with the key from the collection into
+// doc. Nil is returned if the document does not exist.
+func getDocument(collection string, key string, doc interface{}) (interface{}, error) {
+	col, err := database().Collection(nil, collection)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := col.ReadDocument(nil, key, doc); err != nil {
+		if arango.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return doc, nil
 }
 
-// Query runs the AQL query against the task model collection.
-func (model *TaskModel) Query(q string, vars interface{}) ([]interface{}, error) {
-	tasks := make([]interface{}, 0)
-	cursor, err := db.Query(nil, q, vars.(map[string]interface{}))
+// queryPage runs the AQL query with the offset and limit bind parameters
+// and reads the documents of the page into the values returned by doc.
+// The documents are fetched in batches of the page size and the total is
+// counted by the database, so the documents outside the page are never
+// read. The query is bound to ctx as described by queryContext.
+func queryPage(ctx context.Context, q string, vars interface{}, offset int, limit int, doc func() interface{}) (*Page, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	bindVars := make(map[string]interface{})
+	for k, v := range vars.(map[string]interface{}) {
+		bindVars[k] = v
+	}
+	bindVars["offset"] = offset
+	bindVars["limit"] = limit
+	ctx = arango.WithQueryFullCount(arango.WithQueryBatchSize(ctx, limit), true)
+	cursor, err := database().Query(ctx, q, bindVars)
 	if err != nil {
 		return nil, err
 	}
 	defer cursor.Close()
+	page := &Page{Docs: make([]interface{}, 0, limit)}
 	for {
-		task := new(Task)
-		_, err := cursor.ReadDocument(nil, task)
+		v := doc()
+		_, err := cursor.ReadDocument(ctx, v)
 		if arango.IsNoMoreDocuments(err) {
 			break
 		}
 		if err != nil {
 			return nil, err
 		}
-		tasks = append(tasks, task)
+		page.Docs = append(page.Docs, v)
 	}
-	return tasks, nil
+	page.Total = cursor.Statistics().FullCount()
+	return page, nil
 }
 
-func (model *TaskModel) Remove(task interface{}) error {
-	col, err := db.Collection(nil, CollectionTasks)
+// TxModel is a model whose existing documents can be updated inside an
+// arangodb stream transaction.
+type TxModel interface {
+	Model
+	Collection() string
+	Update(context.Context, interface{}) (DocumentMeta, error)
+}
+
+// Update is an update of an existing document with its model.
+type Update struct {
+	Model Model
+	Doc   interface{}
+}
+
+// UpdateAll applies the updates in a single arangodb stream transaction,
+// which is aborted if any update fails so that either all or none of the
+// documents are updated. The documents are saved one after the other if
+// one of the models does not support transactions. Updates of postgresql
+// models are applied in a postgresql transaction instead. The documents of
+// cached models are written through to the cache after the transaction.
+func UpdateAll(updates ...Update) error {
+	cached := make(map[int]*CachedModel)
+	unwrapped := make([]Update, len(updates))
+	for i, update := range updates {
+		if model, ok := update.Model.(*CachedModel); ok {
+			cached[i] = model
+			update.Model = model.Model
+		}
+		unwrapped[i] = update
+	}
+	err := updateAll(unwrapped)
+	for i, model := range cached {
+		model.writeThrough(updates[i].Doc, err)
+	}
+	return err
+}
+
+// updateAll applies the updates in a single transaction of the database of
+// the models.
+func updateAll(updates []Update) error {
+	if len(updates) > 0 {
+		if model, ok := updates[0].Model.(*PostgresModel); ok {
+			return model.storage.UpdateAll(updates)
+		}
+	}
+	models := make([]TxModel, len(updates))
+	collections := make([]string, len(updates))
+	for i, update := range updates {
+		model, ok := update.Model.(TxModel)
+		if !ok {
+			return saveAll(updates)
+		}
+		models[i] = model
+		collections[i] = model.Collection()
+	}
+	tid, err := database().BeginTransaction(nil, arango.TransactionCollections{Write: collections}, nil)
 	if err != nil {
 		return err
 	}
-	v, _ := task.(*Task)
-	if _, err := col.RemoveDocument(nil, v.Id); err != nil {
+	ctx := arango.WithTransactionID(context.Background(), tid)
+	for i, update := range updates {
+		if _, err := models[i].Update(ctx, update.Doc); err != nil {
+			database().AbortTransaction(nil, tid, nil)
+			return err
+		}
+	}
+	if err := database().CommitTransaction(nil, tid, nil); err != nil {
+		database().AbortTransaction(nil, tid, nil)
 		return err
 	}
+	return nil
+}
 
+// saveAll saves the documents of the updates one after the other until a
+// save fails.
+func saveAll(updates []Update) error {
+	for _, update := range updates {
+		if _, err := update.Model.Save(update.Doc); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// Save creates a document in the tasks collection.
-func (model *TaskModel) Save(task interface{}) (DocumentMeta, error) {
-	var meta arango.DocumentMeta
-	col, err := db.Collection(nil, CollectionTasks)
+// TaskStatModel represents a task stat collection model.
+type TaskStatModel struct{}
+
+// Create creates the task_stats collection and ensures a skiplist index on
+// the key and created fields, which serves the most recent task stats of a
+// task key, in the arangodb database.
+func (model *TaskStatModel) Create() error {
+	col, err := ensureCollection(CollectionTaskStats)
+	if err != nil {
+		return err
+	}
+	_, _, err = col.EnsureSkipListIndex(nil, []string{"key", "created"}, nil)
+	return err
+}
+
+func (model *TaskStatModel) FetchAll() ([]interface{}, error) {
+	return make([]interface{}, 0), nil
+}
+
+// Get returns the task stat document with the key. Nil is returned if the
+// document does not exist.
+func (model *TaskStatModel) Get(key string) (interface{}, error) {
+	return getDocument(CollectionTaskStats, key, new(TaskStat))
+}
+
+// Query runs the AQL query against the task stat model collection.
+func (model *TaskStatModel) Query(q string, vars interface{}) ([]interface{}, error) {
+	return queryDocuments(nil, q, vars, func() interface{} { return new(TaskStat) })
+}
+
+// QueryPage runs the paginated AQL query against the task stat model collection.
+func (model *TaskStatModel) QueryPage(q string, vars interface{}, offset int, limit int) (*Page, error) {
+	return queryPage(nil, q, vars, offset, limit, func() interface{} { return new(TaskStat) })
+}
+
+// QueryStream streams the task stats returned by the query.
+func (model *TaskStatModel) QueryStream(q string, vars interface{}) (DocumentIterator, error) {
+	return queryStream(nil, q, vars, func() interface{} { return new(TaskStat) })
+}
+
+// Remove fails since task stats are not read with their keys. Task stats
+// are removed with REMOVE queries instead.
+func (model *TaskStatModel) Remove(taskStat interface{}) error {
+	return UnsupportedOperationError
+}
+
+// Save creates a document in the task stats collection.
+func (model *TaskStatModel) Save(taskStat interface{}) (DocumentMeta, error) {
+	col, err := database().Collection(nil, CollectionTaskStats)
 	if err != nil {
 		return DocumentMeta{}, err
 	}
-	meta, err = col.CreateDocument(nil, task)
-	if arango.IsConflict(err) {
-		v, _ := task.(*Task)
-		patch := map[string]interface{}{"status": v.Status}
-		meta, err = col.UpdateDocument(nil, v.Id, patch)
-		if err != nil {
-			return DocumentMeta{}, err
-		}
-	} else if err != nil {
+	meta, err := col.CreateDocument(nil, taskStat)
+	if err != nil {
 		return DocumentMeta{}, err
 	}
 	return DocumentMeta{Id: meta.ID}, nil
 }
 
-type ResourceModel struct{}
+// TaskCountModel represents the task count aggregations of the tasks
+// collection.
+type TaskCountModel struct {
+	ctx context.Context // the context the queries are bound to.
+}
+
+// WithContext returns a copy of the model whose queries are canceled with
+// the context.
+func (model *TaskCountModel) WithContext(ctx context.Context) Model {
+	return &TaskCountModel{ctx}
+}
 
-func (model *ResourceModel) Create() error {
-	_, err := db.CreateCollection(nil, CollectionResources, nil)
+func (model *TaskCountModel) Create() error {
+	return nil
+}
+
+func (model *TaskCountModel) FetchAll() ([]interface{}, error) {
+	return make([]interface{}, 0), nil
+}
+
+func (model *TaskCountModel) Get(key string) (interface{}, error) {
+	return nil, nil
+}
+
+// Query runs the AQL aggregation query against the tasks collection.
+func (model *TaskCountModel) Query(q string, vars interface{}) ([]interface{}, error) {
+	return queryDocuments(model.ctx, q, vars, func() interface{} { return new(TaskCount) })
+}
+
+// QueryPage runs the paginated AQL aggregation query against the tasks collection.
+func (model *TaskCountModel) QueryPage(q string, vars interface{}, offset int, limit int) (*Page, error) {
+	return queryPage(model.ctx, q, vars, offset, limit, func() interface{} { return new(TaskCount) })
+}
+
+// QueryStream streams the counts of the aggregation query, bound to the
+// context of the model.
+func (model *TaskCountModel) QueryStream(q string, vars interface{}) (DocumentIterator, error) {
+	return queryStream(model.ctx, q, vars, func() interface{} { return new(TaskCount) })
+}
+
+// Remove fails since task counts are aggregated from the tasks collection.
+func (model *TaskCountModel) Remove(count interface{}) error {
+	return UnsupportedOperationError
+}
+
+// Save fails since task counts are aggregated from the tasks collection.
+func (model *TaskCountModel) Save(count interface{}) (DocumentMeta, error) {
+	return DocumentMeta{}, UnsupportedOperationError
+}
+
+// TaskGroupModel represents a task group collection model.
+type TaskGroupModel struct{}
+
+// Create creates the task_groups collection in the arangodb database.
+func (model *TaskGroupModel) Create() error {
+	_, err := database().CreateCollection(nil, CollectionTaskGroups, collectionOptions(CollectionTaskGroups))
 	if err != nil && arango.IsConflict(err) {
 		return nil
 	}
 	return err
 }
 
-func (model *ResourceModel) FetchAll() ([]interface{}, error) {
-	resources := make([]interface{}, 0)
-	query := fmt.Sprintf("FOR r in %s RETURN r", CollectionResources)
-	cursor, err := db.Query(nil, query, nil)
-	if err != nil {
-		return nil, err
-	}
-	defer cursor.Close()
-	for {
-		r := new(Resource)
-		_, err := cursor.ReadDocument(nil, r)
-		if arango.IsNoMoreDocuments(err) {
-			break
-		} else if err != nil {
-			return nil, err
-		}
-		resources = append(resources, r)
-	}
-	return resources, nil
+func (model *TaskGroupModel) FetchAll() ([]interface{}, error) {
+	return make([]interface{}, 0), nil
 }
 
-func (model *ResourceModel) Query(q string, vars interface{}) ([]interface{}, error) {
-	return make([]interface{}, 0), nil
+// Get returns the task group document with the key. Nil is returned if the
+// document does not exist.
+func (model *TaskGroupModel) Get(key string) (interface{}, error) {
+	return getDocument(CollectionTaskGroups, key, new(TaskGroup))
 }
 
-func (model *ResourceModel) Remove(res interface{}) error {
+// Query runs the AQL query against the task group model collection.
+func (model *TaskGroupModel) Query(q string, vars interface{}) ([]interface{}, error) {
+	return queryDocuments(nil, q, vars, func() interface{} { return new(TaskGroup) })
+}
+
+// QueryPage runs the paginated AQL query against the task group model collection.
+func (model *TaskGroupModel) QueryPage(q string, vars interface{}, offset int, limit int) (*Page, error) {
+	return queryPage(nil, q, vars, offset, limit, func() interface{} { return new(TaskGroup) })
+}
+
+// QueryStream streams the task groups returned by the query.
+func (model *TaskGroupModel) QueryStream(q string, vars interface{}) (DocumentIterator, error) {
+	return queryStream(nil, q, vars, func() interface{} { return new(TaskGroup) })
+}
+
+// Remove deletes the task group document from the collection.
+func (model *TaskGroupModel) Remove(group interface{}) error {
+	col, err := database().Collection(nil, CollectionTaskGroups)
+	if err != nil {
+		return err
+	}
+	v, _ := group.(*TaskGroup)
+	if _, err := col.RemoveDocument(nil, v.Id); err != nil {
+		return err
+	}
 	return nil
 }
 
-func (model *ResourceModel) Save(res interface{}) (DocumentMeta, error) {
-	var meta arango.DocumentMeta
-	col, err := db.Collection(nil, CollectionResources)
+// Save creates a document in the task groups collection or replaces the
+// existing document of the group.
+func (model *TaskGroupModel) Save(group interface{}) (DocumentMeta, error) {
+	col, err := database().Collection(nil, CollectionTaskGroups)
 	if err != nil {
 		return DocumentMeta{}, err
 	}
-	meta, err = col.CreateDocument(nil, res)
+	meta, err := col.CreateDocument(nil, group)
 	if arango.IsConflict(err) {
-		v, _ := res.(*Resource)
-		patch := map[string]interface{}{"status": v.Status}
-		meta, err = col.UpdateDocument(nil, v.Name, patch)
-		if err != nil {
-			return DocumentMeta{}, err
-		}
-	} else if err != nil {
+		v, _ := group.(*TaskGroup)
+		meta, err = col.ReplaceDocument(nil, v.Id, v)
+	}
+	if err != nil {
 		return DocumentMeta{}, err
 	}
 	return DocumentMeta{Id: meta.ID}, nil
 }
 
-// InitDatabase connects to the arangodb and creates the collections from the
-// provided models.
-func InitDatabase() {
-	host := os.Getenv("ARANGODB_HOST")
-	name := os.Getenv("ARANGODB_NAME")
-	user := os.Getenv("ARANGODB_USER")
-	pass := os.Getenv("ARANGODB_PASS")
+// TaskHistoryModel represents a task history collection model.
+type TaskHistoryModel struct{}
 
-	conn, err := arangohttp.NewConnection(
-		arangohttp.ConnectionConfig{Endpoints: []string{host}},
-	)
+// Create creates the task_history collection and creates a persistent
+// index on the taskId field in the arangodb database.
+func (model *TaskHistoryModel) Create() error {
+	col, err := database().CreateCollection(nil, CollectionTaskHistory, collectionOptions(CollectionTaskHistory))
 	if err != nil {
-		panic(err)
+		if arango.IsConflict(err) {
+			return nil
+		}
+		return err
 	}
-	client, err := arango.NewClient(arango.ClientConfig{
-		Connection:     conn,
-		Authentication: arango.BasicAuthentication(user, pass),
-	})
+	_, _, err = col.EnsurePersistentIndex(nil, []string{"taskId"}, nil)
+	return err
+}
+
+func (model *TaskHistoryModel) FetchAll() ([]interface{}, error) {
+	return make([]interface{}, 0), nil
+}
+
+// Get returns the task history entry document with the key. Nil is returned
+// if the document does not exist.
+func (model *TaskHistoryModel) Get(key string) (interface{}, error) {
+	return getDocument(CollectionTaskHistory, key, new(TaskHistory))
+}
+
+// Query runs the AQL query against the task history model collection.
+func (model *TaskHistoryModel) Query(q string, vars interface{}) ([]interface{}, error) {
+	return queryDocuments(nil, q, vars, func() interface{} { return new(TaskHistory) })
+}
+
+// QueryPage runs the paginated AQL query against the task history model collection.
+func (model *TaskHistoryModel) QueryPage(q string, vars interface{}, offset int, limit int) (*Page, error) {
+	return queryPage(nil, q, vars, offset, limit, func() interface{} { return new(TaskHistory) })
+}
+
+// QueryStream returns an iterator over the history entries matched by the
+// query.
+func (model *TaskHistoryModel) QueryStream(q string, vars interface{}) (DocumentIterator, error) {
+	return queryStream(nil, q, vars, func() interface{} { return new(TaskHistory) })
+}
+
+// Remove fails since task history entries are not read with their keys.
+// Entries are removed with REMOVE queries instead.
+func (model *TaskHistoryModel) Remove(entry interface{}) error {
+	return UnsupportedOperationError
+}
+
+// Save creates a document in the task history collection.
+func (model *TaskHistoryModel) Save(entry interface{}) (DocumentMeta, error) {
+	col, err := database().Collection(nil, CollectionTaskHistory)
 	if err != nil {
-		panic(err)
+		return DocumentMeta{}, err
 	}
-
-	for {
-		if exists, err := client.DatabaseExists(nil, name); err == nil {
-			if !exists {
-				db, err = client.CreateDatabase(nil, name, nil)
-			} else {
-				db, err = client.Database(nil, name)
-			}
-			if err == nil {
-				break
-			}
-		}
-		time.Sleep(time.Second * 1)
+	meta, err := col.CreateDocument(nil, entry)
+	if err != nil {
+		return DocumentMeta{}, err
 	}
+	return DocumentMeta{Id: meta.ID}, nil
+}
 
-	models := []Model{
-		&TaskModel{},
-		&TaskStatModel{},
+// TaskLogModel represents a task log collection model.
+type TaskLogModel struct{}
+
+// Create creates the task_logs collection and creates a persistent index on
+// the taskId and created fields in the arangodb database.
+func (model *TaskLogModel) Create() error {
+	col, err := database().CreateCollection(nil, CollectionTaskLogs, collectionOptions(CollectionTaskLogs))
+	if err != nil {
+		if arango.IsConflict(err) {
+			return nil
+		}
+		return err
+	}
+	_, _, err = col.EnsurePersistentIndex(nil, []string{"taskId", "created"}, nil)
+	return err
+}
+
+func (model *TaskLogModel) FetchAll() ([]interface{}, error) {
+	return make([]interface{}, 0), nil
+}
+
+// Get returns the task log entry document with the key. Nil is returned if
+// the document does not exist.
+func (model *TaskLogModel) Get(key string) (interface{}, error) {
+	return getDocument(CollectionTaskLogs, key, new(TaskLog))
+}
+
+// Query runs the AQL query against the task log model collection.
+func (model *TaskLogModel) Query(q string, vars interface{}) ([]interface{}, error) {
+	return queryDocuments(nil, q, vars, func() interface{} { return new(TaskLog) })
+}
+
+// QueryPage runs the paginated AQL query against the task log model collection.
+func (model *TaskLogModel) QueryPage(q string, vars interface{}, offset int, limit int) (*Page, error) {
+	return queryPage(nil, q, vars, offset, limit, func() interface{} { return new(TaskLog) })
+}
+
+// QueryStream returns an iterator over the task log lines matched by the
+// query, so a long log is read without loading it at once.
+func (model *TaskLogModel) QueryStream(q string, vars interface{}) (DocumentIterator, error) {
+	return queryStream(nil, q, vars, func() interface{} { return new(TaskLog) })
+}
+
+// Remove fails since task log entries are not read with their keys.
+// Entries are removed with REMOVE queries instead.
+func (model *TaskLogModel) Remove(entry interface{}) error {
+	return UnsupportedOperationError
+}
+
+// Save creates a document in the task logs collection.
+func (model *TaskLogModel) Save(entry interface{}) (DocumentMeta, error) {
+	col, err := database().Collection(nil, CollectionTaskLogs)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	meta, err := col.CreateDocument(nil, entry)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	return DocumentMeta{Id: meta.ID}, nil
+}
+
+// TaskModel represents a task collection model.
+type TaskModel struct {
+	ctx context.Context // the context the queries are bound to and the tasks are saved by.
+}
+
+// WithContext returns a copy of the model whose queries are canceled with
+// the context, and whose saves are recorded with the caller of the context.
+func (model *TaskModel) WithContext(ctx context.Context) Model {
+	return &TaskModel{ctx}
+}
+
+// Create creates the tasks collection and ensures the indexes of the task
+// queries in the arangodb database. The persistent indexes on the status,
+// key and created fields serve the task filters and sorts.
+func (model *TaskModel) Create() error {
+	col, err := ensureCollection(CollectionTasks)
+	if err != nil {
+		return err
+	}
+	for _, field := range []string{"status", "key", "created"} {
+		if _, _, err = col.EnsurePersistentIndex(nil, []string{field}, nil); err != nil {
+			return err
+		}
+	}
+	if _, _, err = col.EnsureHashIndex(nil, []string{"dependsOn[*]"}, nil); err != nil {
+		return err
+	}
+	if _, _, err = col.EnsureHashIndex(nil, []string{"labelIndex[*]"}, nil); err != nil {
+		return err
+	}
+	_, _, err = col.EnsureHashIndex(nil, []string{"parentId"}, nil)
+	return err
+}
+
+// FetchAll returns all task documents. The tasks are streamed from the
+// database in batches.
+func (model *TaskModel) FetchAll() ([]interface{}, error) {
+	tasks := make([]interface{}, 0)
+	q := fmt.Sprintf("FOR t IN %s RETURN t", CollectionTasks)
+	err := streamQuery(model, q, nil, func(task interface{}) error {
+		tasks = append(tasks, task)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// Get returns the task document with the key. Nil is returned if the
+// document does not exist.
+func (model *TaskModel) Get(key string) (interface{}, error) {
+	return getDocument(CollectionTasks, key, new(Task))
+}
+
+// Query runs the AQL query against the task model collection.
+func (model *TaskModel) Query(q string, vars interface{}) ([]interface{}, error) {
+	return queryDocuments(model.ctx, q, vars, func() interface{} { return new(Task) })
+}
+
+// QueryPage runs the paginated AQL query against the task model collection.
+func (model *TaskModel) QueryPage(q string, vars interface{}, offset int, limit int) (*Page, error) {
+	return queryPage(model.ctx, q, vars, offset, limit, func() interface{} { return new(Task) })
+}
+
+// QueryStream runs the query with the context of the model and returns
+// an iterator of the matched tasks.
+func (model *TaskModel) QueryStream(q string, vars interface{}) (DocumentIterator, error) {
+	return queryStream(model.ctx, q, vars, func() interface{} { return new(Task) })
+}
+
+func (model *TaskModel) Remove(task interface{}) error {
+	col, err := database().Collection(nil, CollectionTasks)
+	if err != nil {
+		return err
+	}
+	v, _ := task.(*Task)
+	if _, err := col.RemoveDocument(nil, v.Id); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Save creates a document in the tasks collection, or replaces all fields
+// of the existing task document except its creation time. The update time
+// and the caller of the context of the model are recorded in the task.
+func (model *TaskModel) Save(task interface{}) (DocumentMeta, error) {
+	var meta arango.DocumentMeta
+	col, err := database().Collection(nil, CollectionTasks)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	touchTask(task, Caller(model.ctx))
+	meta, err = col.CreateDocument(nil, task)
+	if arango.IsConflict(err) {
+		v, _ := task.(*Task)
+		meta, err = col.UpdateDocument(replaceContext(nil), v.Id, taskPatch(v))
+		if err != nil {
+			return DocumentMeta{}, err
+		}
+	} else if err != nil {
+		return DocumentMeta{}, err
+	}
+	return DocumentMeta{Id: meta.ID}, nil
+}
+
+// Collection returns the name of the tasks collection.
+func (model *TaskModel) Collection() string {
+	return CollectionTasks
+}
+
+// Update replaces all fields of the existing task document except its
+// creation time in the transaction of the context. The update time and the
+// caller of the context of the model are recorded in the task.
+func (model *TaskModel) Update(ctx context.Context, task interface{}) (DocumentMeta, error) {
+	col, err := database().Collection(ctx, CollectionTasks)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	touchTask(task, Caller(model.ctx))
+	v, _ := task.(*Task)
+	meta, err := col.UpdateDocument(replaceContext(ctx), v.Id, taskPatch(v))
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	return DocumentMeta{Id: meta.ID}, nil
+}
+
+// taskPatch returns all fields of the task except the key, the creation
+// time and the children, which are loaded from the child tasks. Unset
+// fields are null so they are removed from the existing document.
+func taskPatch(v *Task) map[string]interface{} {
+	return map[string]interface{}{
+		"attemptHistory": v.AttemptHistory,
+		"attempts":       v.Attempts,
+		"backoff":        v.Backoff,
+		"callbackUrl":    v.CallbackUrl,
+		"constraints":    v.Constraints,
+		"dependsOn":      v.DependsOn,
+		"expiresAt":      v.ExpiresAt,
+		"groupId":        v.GroupId,
+		"key":            v.Key,
+		"labelIndex":     v.LabelIndex,
+		"labels":         v.Labels,
+		"leaseExpires":   v.LeaseExpires,
+		"maxAttempts":    v.MaxAttempts,
+		"meta":           v.Meta,
+		"parentId":       v.ParentId,
+		"pausedFrom":     v.PausedFrom,
+		"pool":           v.Pool,
+		"priority":       v.Priority,
+		"result":         v.Result,
+		"runAt":          v.RunAt,
+		"stagedAt":       v.StagedAt,
+		"status":         v.Status,
+		"stolenFrom":     v.StolenFrom,
+		"updated":        v.Updated,
+		"updatedBy":      v.UpdatedBy,
+	}
+}
+
+// touchTask sets the update time and the caller of the task, and its
+// creation time if it is unset.
+func touchTask(doc interface{}, caller string) {
+	v, _ := doc.(*Task)
+	v.Updated = time.Now()
+	v.UpdatedBy = caller
+	if v.Created.IsZero() {
+		v.Created = v.Updated
+	}
+}
+
+// replaceContext returns the context of a document update that replaces
+// the nested objects of the document instead of merging them and removes
+// the fields updated to null.
+func replaceContext(ctx context.Context) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return arango.WithKeepNull(arango.WithMergeObjects(ctx, false), false)
+}
+
+// TaskArchiveModel represents the removed tasks collection model.
+type TaskArchiveModel struct{}
+
+// Create creates the tasks_archive collection and creates a persistent
+// index on the removedAt field in the arangodb database.
+func (model *TaskArchiveModel) Create() error {
+	col, err := database().CreateCollection(nil, CollectionTasksArchive, collectionOptions(CollectionTasksArchive))
+	if err != nil {
+		if arango.IsConflict(err) {
+			return nil
+		}
+		return err
+	}
+	_, _, err = col.EnsurePersistentIndex(nil, []string{"removedAt"}, nil)
+	return err
+}
+
+func (model *TaskArchiveModel) FetchAll() ([]interface{}, error) {
+	return make([]interface{}, 0), nil
+}
+
+// Get returns the archived task document with the key. Nil is returned if
+// the document does not exist.
+func (model *TaskArchiveModel) Get(key string) (interface{}, error) {
+	return getDocument(CollectionTasksArchive, key, new(ArchivedTask))
+}
+
+// Query runs the AQL query against the task archive model collection.
+func (model *TaskArchiveModel) Query(q string, vars interface{}) ([]interface{}, error) {
+	return queryDocuments(nil, q, vars, func() interface{} { return new(ArchivedTask) })
+}
+
+// QueryPage runs the paginated AQL query against the task archive model collection.
+func (model *TaskArchiveModel) QueryPage(q string, vars interface{}, offset int, limit int) (*Page, error) {
+	return queryPage(nil, q, vars, offset, limit, func() interface{} { return new(ArchivedTask) })
+}
+
+// QueryStream returns an iterator over the archived tasks matched by the
+// query.
+func (model *TaskArchiveModel) QueryStream(q string, vars interface{}) (DocumentIterator, error) {
+	return queryStream(nil, q, vars, func() interface{} { return new(ArchivedTask) })
+}
+
+// Remove deletes the archived task document from the collection.
+func (model *TaskArchiveModel) Remove(task interface{}) error {
+	col, err := database().Collection(nil, CollectionTasksArchive)
+	if err != nil {
+		return err
+	}
+	v, _ := task.(*ArchivedTask)
+	if _, err := col.RemoveDocument(nil, v.Id); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Save creates a document in the tasks archive collection or replaces the
+// archived document of a task that was removed again after a restore.
+func (model *TaskArchiveModel) Save(task interface{}) (DocumentMeta, error) {
+	col, err := database().Collection(nil, CollectionTasksArchive)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	meta, err := col.CreateDocument(nil, task)
+	if arango.IsConflict(err) {
+		v, _ := task.(*ArchivedTask)
+		meta, err = col.ReplaceDocument(nil, v.Id, v)
+	}
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	return DocumentMeta{Id: meta.ID}, nil
+}
+
+// ShardMemberModel represents a shard member collection model.
+type ShardMemberModel struct{}
+
+// Create creates the shard_members collection in the arangodb database.
+func (model *ShardMemberModel) Create() error {
+	_, err := database().CreateCollection(nil, CollectionShardMembers, collectionOptions(CollectionShardMembers))
+	if err != nil && arango.IsConflict(err) {
+		return nil
+	}
+	return err
+}
+
+// FetchAll returns all shard members.
+func (model *ShardMemberModel) FetchAll() ([]interface{}, error) {
+	query := fmt.Sprintf("FOR m IN %s RETURN m", CollectionShardMembers)
+	return model.Query(query, nil)
+}
+
+// Get returns the shard member document with the key. Nil is returned if
+// the document does not exist.
+func (model *ShardMemberModel) Get(key string) (interface{}, error) {
+	return getDocument(CollectionShardMembers, key, new(ShardMember))
+}
+
+// Query runs the AQL query against the shard member model collection.
+func (model *ShardMemberModel) Query(q string, vars interface{}) ([]interface{}, error) {
+	return queryDocuments(nil, q, vars, func() interface{} { return new(ShardMember) })
+}
+
+// QueryPage runs the paginated AQL query against the shard member model collection.
+func (model *ShardMemberModel) QueryPage(q string, vars interface{}, offset int, limit int) (*Page, error) {
+	return queryPage(nil, q, vars, offset, limit, func() interface{} { return new(ShardMember) })
+}
+
+// QueryStream streams the shard members returned by the query.
+func (model *ShardMemberModel) QueryStream(q string, vars interface{}) (DocumentIterator, error) {
+	return queryStream(nil, q, vars, func() interface{} { return new(ShardMember) })
+}
+
+// Remove deletes the shard member document from the collection.
+func (model *ShardMemberModel) Remove(member interface{}) error {
+	col, err := database().Collection(nil, CollectionShardMembers)
+	if err != nil {
+		return err
+	}
+	v, _ := member.(*ShardMember)
+	if _, err := col.RemoveDocument(nil, v.Address); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Save creates a document in the shard members collection or replaces the
+// existing document of the member.
+func (model *ShardMemberModel) Save(member interface{}) (DocumentMeta, error) {
+	col, err := database().Collection(nil, CollectionShardMembers)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	meta, err := col.CreateDocument(nil, member)
+	if arango.IsConflict(err) {
+		v, _ := member.(*ShardMember)
+		meta, err = col.ReplaceDocument(nil, v.Address, v)
+	}
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	return DocumentMeta{Id: meta.ID}, nil
+}
+
+type ResourceModel struct {
+	ctx context.Context // the context of the caller the resources are updated by.
+}
+
+// WithContext returns a copy of the model whose updates are recorded with
+// the caller of the context.
+func (model *ResourceModel) WithContext(ctx context.Context) Model {
+	return &ResourceModel{ctx}
+}
+
+func (model *ResourceModel) Create() error {
+	_, err := database().CreateCollection(nil, CollectionResources, collectionOptions(CollectionResources))
+	if err != nil && arango.IsConflict(err) {
+		return nil
+	}
+	return err
+}
+
+func (model *ResourceModel) FetchAll() ([]interface{}, error) {
+	query := fmt.Sprintf("FOR r in %s RETURN r", CollectionResources)
+	return model.Query(query, nil)
+}
+
+// Get returns the resource document with the key. Nil is returned if the
+// document does not exist.
+func (model *ResourceModel) Get(key string) (interface{}, error) {
+	return getDocument(CollectionResources, key, new(Resource))
+}
+
+// Query runs the AQL query against the resource model collection.
+func (model *ResourceModel) Query(q string, vars interface{}) ([]interface{}, error) {
+	return queryDocuments(nil, q, vars, func() interface{} { return new(Resource) })
+}
+
+// QueryPage runs the paginated AQL query against the resource model collection.
+func (model *ResourceModel) QueryPage(q string, vars interface{}, offset int, limit int) (*Page, error) {
+	return queryPage(nil, q, vars, offset, limit, func() interface{} { return new(Resource) })
+}
+
+// QueryStream returns an iterator over the resources matched by the
+// query.
+func (model *ResourceModel) QueryStream(q string, vars interface{}) (DocumentIterator, error) {
+	return queryStream(nil, q, vars, func() interface{} { return new(Resource) })
+}
+
+// Remove deletes the resource document from the collection.
+func (model *ResourceModel) Remove(res interface{}) error {
+	col, err := database().Collection(nil, CollectionResources)
+	if err != nil {
+		return err
+	}
+	v, _ := res.(*Resource)
+	if _, err := col.RemoveDocument(nil, v.Name); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Save creates a document in the resources collection or updates the
+// status and task of an existing resource document. The update time and the
+// caller of the context of the model are recorded in the resource.
+func (model *ResourceModel) Save(res interface{}) (DocumentMeta, error) {
+	var meta arango.DocumentMeta
+	col, err := database().Collection(nil, CollectionResources)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	v, _ := res.(*Resource)
+	touchResource(v, Caller(model.ctx))
+	meta, err = col.CreateDocument(nil, res)
+	if arango.IsConflict(err) {
+		meta, err = col.UpdateDocument(nil, v.Name, resourcePatch(v))
+		if err != nil {
+			return DocumentMeta{}, err
+		}
+	} else if err != nil {
+		return DocumentMeta{}, err
+	}
+	return DocumentMeta{Id: meta.ID}, nil
+}
+
+// Collection returns the name of the resources collection.
+func (model *ResourceModel) Collection() string {
+	return CollectionResources
+}
+
+// Update updates the status and task of the existing resource document in
+// the transaction of the context. The update time and the caller of the
+// context of the model are recorded in the resource.
+func (model *ResourceModel) Update(ctx context.Context, res interface{}) (DocumentMeta, error) {
+	col, err := database().Collection(ctx, CollectionResources)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	v, _ := res.(*Resource)
+	touchResource(v, Caller(model.ctx))
+	meta, err := col.UpdateDocument(ctx, v.Name, resourcePatch(v))
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	return DocumentMeta{Id: meta.ID}, nil
+}
+
+// resourcePatch returns the fields of the resource that change after it is
+// created.
+func resourcePatch(v *Resource) map[string]interface{} {
+	return map[string]interface{}{
+		"draining":    v.Draining,
+		"heartbeatAt": v.HeartbeatAt,
+		"lockedAt":    v.LockedAt,
+		"offline":     v.Offline,
+		"parent":      v.Parent,
+		"quota":       v.Quota,
+		"quotaStarts": v.QuotaStarts,
+		"registered":  v.Registered,
+		"status":      v.Status,
+		"tags":        v.Tags,
+		"taskId":      v.TaskId,
+		"updated":     v.Updated,
+		"updatedBy":   v.UpdatedBy,
+		"weight":      v.Weight,
+	}
+}
+
+// touchResource sets the update time and the caller of the resource, and
+// its creation time if it is new.
+func touchResource(doc interface{}, caller string) {
+	v, _ := doc.(*Resource)
+	v.Updated = time.Now()
+	v.UpdatedBy = caller
+	if v.Created.IsZero() {
+		v.Created = v.Updated
+	}
+}
+
+// ResourceStatModel represents a resource stat collection model.
+type ResourceStatModel struct{}
+
+// Create creates the resource_stats collection and creates a persistent
+// index on the resource and ended fields in the arangodb database.
+func (model *ResourceStatModel) Create() error {
+	col, err := database().CreateCollection(nil, CollectionResourceStats, collectionOptions(CollectionResourceStats))
+	if err != nil {
+		if arango.IsConflict(err) {
+			return nil
+		}
+		return err
+	}
+	_, _, err = col.EnsurePersistentIndex(nil, []string{"resource", "ended"}, nil)
+	return err
+}
+
+func (model *ResourceStatModel) FetchAll() ([]interface{}, error) {
+	return make([]interface{}, 0), nil
+}
+
+// Get returns the resource stat document with the key. Nil is returned if
+// the document does not exist.
+func (model *ResourceStatModel) Get(key string) (interface{}, error) {
+	return getDocument(CollectionResourceStats, key, new(ResourceStat))
+}
+
+// Query runs the AQL query against the resource stat model collection.
+func (model *ResourceStatModel) Query(q string, vars interface{}) ([]interface{}, error) {
+	return queryDocuments(nil, q, vars, func() interface{} { return new(ResourceStat) })
+}
+
+// QueryPage runs the paginated AQL query against the resource stat model collection.
+func (model *ResourceStatModel) QueryPage(q string, vars interface{}, offset int, limit int) (*Page, error) {
+	return queryPage(nil, q, vars, offset, limit, func() interface{} { return new(ResourceStat) })
+}
+
+// QueryStream streams the resource stats returned by the query.
+func (model *ResourceStatModel) QueryStream(q string, vars interface{}) (DocumentIterator, error) {
+	return queryStream(nil, q, vars, func() interface{} { return new(ResourceStat) })
+}
+
+// Remove fails since resource stats are not read with their keys.
+// Resource stats are removed with REMOVE queries instead.
+func (model *ResourceStatModel) Remove(rescStat interface{}) error {
+	return UnsupportedOperationError
+}
+
+// Save creates a document in the resource stats collection.
+func (model *ResourceStatModel) Save(rescStat interface{}) (DocumentMeta, error) {
+	col, err := database().Collection(nil, CollectionResourceStats)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	meta, err := col.CreateDocument(nil, rescStat)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	return DocumentMeta{Id: meta.ID}, nil
+}
+
+// DeferredCallModel represents a deferred call collection model.
+type DeferredCallModel struct{}
+
+// Create creates the deferred_calls collection in the arangodb database.
+func (model *DeferredCallModel) Create() error {
+	_, err := database().CreateCollection(nil, CollectionDeferredCalls, collectionOptions(CollectionDeferredCalls))
+	if err != nil && arango.IsConflict(err) {
+		return nil
+	}
+	return err
+}
+
+// FetchAll returns all deferred calls ordered by creation time.
+func (model *DeferredCallModel) FetchAll() ([]interface{}, error) {
+	q := fmt.Sprintf("FOR c IN %s SORT c.created ASC RETURN c", CollectionDeferredCalls)
+	return model.Query(q, make(map[string]interface{}))
+}
+
+// Get returns the deferred call document with the key. Nil is returned if
+// the document does not exist.
+func (model *DeferredCallModel) Get(key string) (interface{}, error) {
+	return getDocument(CollectionDeferredCalls, key, new(DeferredCall))
+}
+
+// Query runs the AQL query against the deferred call model collection.
+func (model *DeferredCallModel) Query(q string, vars interface{}) ([]interface{}, error) {
+	return queryDocuments(nil, q, vars, func() interface{} { return new(DeferredCall) })
+}
+
+// QueryPage runs the paginated AQL query against the deferred call model collection.
+func (model *DeferredCallModel) QueryPage(q string, vars interface{}, offset int, limit int) (*Page, error) {
+	return queryPage(nil, q, vars, offset, limit, func() interface{} { return new(DeferredCall) })
+}
+
+// QueryStream returns an iterator over the deferred calls matched by the
+// query, in the order of the query.
+func (model *DeferredCallModel) QueryStream(q string, vars interface{}) (DocumentIterator, error) {
+	return queryStream(nil, q, vars, func() interface{} { return new(DeferredCall) })
+}
+
+// Remove deletes the deferred call document from the collection.
+func (model *DeferredCallModel) Remove(call interface{}) error {
+	col, err := database().Collection(nil, CollectionDeferredCalls)
+	if err != nil {
+		return err
+	}
+	v, _ := call.(*DeferredCall)
+	if _, err := col.RemoveDocument(nil, v.Id); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Save creates a document in the deferred calls collection.
+func (model *DeferredCallModel) Save(call interface{}) (DocumentMeta, error) {
+	col, err := database().Collection(nil, CollectionDeferredCalls)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	meta, err := col.CreateDocument(nil, call)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	return DocumentMeta{Id: meta.ID}, nil
+}
+
+// FailedEventModel represents a failed event collection model.
+type FailedEventModel struct{}
+
+// Create creates the failed_events collection in the arangodb database.
+func (model *FailedEventModel) Create() error {
+	_, err := database().CreateCollection(nil, CollectionFailedEvents, collectionOptions(CollectionFailedEvents))
+	if err != nil && arango.IsConflict(err) {
+		return nil
+	}
+	return err
+}
+
+// FetchAll returns all failed events ordered by creation time.
+func (model *FailedEventModel) FetchAll() ([]interface{}, error) {
+	q := fmt.Sprintf("FOR e IN %s SORT e.created ASC RETURN e", CollectionFailedEvents)
+	return model.Query(q, make(map[string]interface{}))
+}
+
+// Get returns the failed event document with the key. Nil is returned if
+// the document does not exist.
+func (model *FailedEventModel) Get(key string) (interface{}, error) {
+	return getDocument(CollectionFailedEvents, key, new(FailedEvent))
+}
+
+// Query runs the AQL query against the failed event model collection.
+func (model *FailedEventModel) Query(q string, vars interface{}) ([]interface{}, error) {
+	return queryDocuments(nil, q, vars, func() interface{} { return new(FailedEvent) })
+}
+
+// QueryPage runs the paginated AQL query against the failed event model collection.
+func (model *FailedEventModel) QueryPage(q string, vars interface{}, offset int, limit int) (*Page, error) {
+	return queryPage(nil, q, vars, offset, limit, func() interface{} { return new(FailedEvent) })
+}
+
+// QueryStream streams the failed events returned by the query.
+func (model *FailedEventModel) QueryStream(q string, vars interface{}) (DocumentIterator, error) {
+	return queryStream(nil, q, vars, func() interface{} { return new(FailedEvent) })
+}
+
+// Remove deletes the failed event document from the collection.
+func (model *FailedEventModel) Remove(evt interface{}) error {
+	col, err := database().Collection(nil, CollectionFailedEvents)
+	if err != nil {
+		return err
+	}
+	v, _ := evt.(*FailedEvent)
+	if _, err := col.RemoveDocument(nil, v.Id); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Save creates a document in the failed events collection or replaces the
+// existing document of the event.
+func (model *FailedEventModel) Save(evt interface{}) (DocumentMeta, error) {
+	col, err := database().Collection(nil, CollectionFailedEvents)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	meta, err := col.CreateDocument(nil, evt)
+	if arango.IsConflict(err) {
+		v, _ := evt.(*FailedEvent)
+		meta, err = col.ReplaceDocument(nil, v.Id, v)
+	}
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	return DocumentMeta{Id: meta.ID}, nil
+}
+
+// PingDatabase checks the connectivity of the arangodb database.
+func PingDatabase() error {
+	db := database()
+	if db == nil {
+		return errors.New("database not initialized")
+	}
+	_, err := db.Info(nil)
+	return err
+}
+
+// database returns the connected arangodb database.
+func database() arango.Database {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	return db
+}
+
+// setDatabase replaces the connected arangodb database.
+func setDatabase(conn arango.Database) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db = conn
+}
+
+// connectDatabase connects to the arangodb server and opens the database,
+// which is created if it does not exist.
+func connectDatabase() (arango.Database, error) {
+	name := os.Getenv("ARANGODB_NAME")
+	user := os.Getenv("ARANGODB_USER")
+	pass := os.Getenv("ARANGODB_PASS")
+
+	config, err := databaseConnectionConfig(os.Getenv("ARANGODB_HOST"))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := arangohttp.NewConnection(config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := arango.NewClient(arango.ClientConfig{
+		Connection:                   &availabilityConnection{conn},
+		Authentication:               arango.BasicAuthentication(user, pass),
+		SynchronizeEndpointsInterval: DatabaseSyncInterval,
+	})
+	if err != nil {
+		return nil, err
+	}
+	exists, err := client.DatabaseExists(nil, name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return client.CreateDatabase(nil, name, nil)
+	}
+	return client.Database(nil, name)
+}
+
+// databaseConnectionConfig returns the arangodb connection configuration of
+// the comma-separated coordinator endpoints of the host. The driver fails
+// over to the next endpoint when a coordinator cannot be reached. The
+// endpoints are called with the tls configuration of the ARANGODB_CA,
+// ARANGODB_CERT and ARANGODB_KEY files if any is set.
+//
+// an error is encountered if the host has no endpoints or a tls file
+// cannot be loaded.
+func databaseConnectionConfig(host string) (arangohttp.ConnectionConfig, error) {
+	config := arangohttp.ConnectionConfig{
+		Endpoints: serviceEndpoints(host),
+		ConnLimit: DatabaseConnLimit,
+	}
+	if len(config.Endpoints) == 0 {
+		return config, NoDatabaseEndpointsError
+	}
+	if files := envServiceTLS("ARANGODB"); !files.Empty() {
+		tlsConfig, err := files.Config()
+		if err != nil {
+			return config, fmt.Errorf("arangodb tls: %v", err)
+		}
+		config.TLSConfig = tlsConfig
+	}
+	return config, nil
+}
+
+// availabilityConnection is an arangodb connection whose requests fail
+// with StorageUnavailableError when the database cannot be reached, so the
+// models return an error that is distinguishable from a rejected request.
+type availabilityConnection struct {
+	arango.Connection
+}
+
+// Do performs the request. Requests that failed to reach the database fail
+// with StorageUnavailableError, while requests cancelled by their context
+// or past its deadline fail with the context error.
+func (c *availabilityConnection) Do(ctx context.Context, req arango.Request) (arango.Response, error) {
+	resp, err := c.Connection.Do(ctx, req)
+	if err != nil && (ctx == nil || ctx.Err() == nil) && connectionError(err) {
+		logf(ctx, "database request failed [%s]\n", err)
+		return nil, StorageUnavailableError
+	}
+	return resp, err
+}
+
+// connectionError reports whether the error is caused by a database that
+// cannot be reached, such as a refused or reset connection or a network
+// timeout, rather than by the request.
+func connectionError(err error) bool {
+	var netErr net.Error
+	err = arango.Cause(err)
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// SetAuthentication returns an availability connection of the connection
+// with the authentication.
+func (c *availabilityConnection) SetAuthentication(auth arango.Authentication) (arango.Connection, error) {
+	conn, err := c.Connection.SetAuthentication(auth)
+	if err != nil {
+		return nil, err
+	}
+	return &availabilityConnection{conn}, nil
+}
+
+// databaseBackoff returns the delay after the provided number of failed
+// database connection attempts, which doubles with every attempt up to
+// DatabaseMaxBackoff.
+func databaseBackoff(attempts int) time.Duration {
+	backoff := DatabaseBackoff
+	for i := 1; i < attempts && backoff < DatabaseMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > DatabaseMaxBackoff {
+		return DatabaseMaxBackoff
+	}
+	return backoff
+}
+
+// InitDatabase connects to the arangodb and creates the collections from the
+// provided models. The connection is retried with connectRetry.
+//
+// an error is encountered if the database could not be connected or a
+// collection could not be created.
+func InitDatabase() error {
+	err := connectRetry(func() error {
+		conn, err := connectDatabase()
+		if err == nil {
+			setDatabase(conn)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	models := []Model{
+		&DeferredCallModel{},
+		&FailedEventModel{},
+		&TaskGroupModel{},
+		&TaskHistoryModel{},
+		&TaskLogModel{},
+		&TaskModel{},
+		&TaskStatModel{},
+		&TaskArchiveModel{},
 		&ResourceModel{},
+		&ResourceStatModel{},
+		&ShardMemberModel{},
 	}
 	for _, model := range models {
 		if err := model.Create(); err != nil {
-			panic(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// StartDatabaseWatchdog periodically checks the database connection until
+// the context is done, and reconnects to the database when the connection
+// was lost. Failed reconnects are retried with the databaseBackoff delays
+// instead of the watch interval.
+func StartDatabaseWatchdog(ctx context.Context) {
+	failures := 0
+	for sleepContext(ctx, watchDelay(failures)) {
+		err := PingDatabase()
+		if err == nil {
+			failures = 0
+			continue
 		}
+		if failures == 0 {
+			logf(ctx, "database connection lost [%s]\n", err)
+		}
+		conn, err := connectDatabase()
+		if err != nil {
+			failures++
+			logf(ctx, "database reconnect failed [%d %s]\n", failures, err)
+			continue
+		}
+		setDatabase(conn)
+		failures = 0
+		logf(ctx, "database reconnected\n")
+	}
+}
+
+// watchDelay returns the delay before the next database connection check
+// after the provided number of failed reconnects.
+func watchDelay(failures int) time.Duration {
+	if failures == 0 {
+		return DatabaseWatchInterval
 	}
+	return databaseBackoff(failures)
 }
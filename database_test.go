@@ -1,19 +1,32 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"reflect"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	arango "github.com/arangodb/go-driver"
 	arangohttp "github.com/arangodb/go-driver/http"
+	"github.com/stretchr/testify/mock"
 )
 
 func TestMain(m *testing.M) {
 	flag.Parse()
 	if !testing.Short() {
-		InitDatabase()
+		if err := InitDatabase(); err != nil {
+			panic(err)
+		}
 	}
 	result := m.Run()
 	if !testing.Short() {
@@ -22,6 +35,30 @@ func TestMain(m *testing.M) {
 	os.Exit(result)
 }
 
+// sliceIterator is a document iterator of the documents in a slice.
+type sliceIterator struct {
+	docs   []interface{}
+	closed bool
+}
+
+func newSliceIterator(docs ...interface{}) *sliceIterator {
+	return &sliceIterator{docs: docs}
+}
+
+func (it *sliceIterator) Next() (interface{}, error) {
+	if len(it.docs) == 0 {
+		return nil, NoMoreDocumentsError
+	}
+	doc := it.docs[0]
+	it.docs = it.docs[1:]
+	return doc, nil
+}
+
+func (it *sliceIterator) Close() error {
+	it.closed = true
+	return nil
+}
+
 func tearDownDatabase() {
 	host := os.Getenv("ARANGODB_HOST")
 	name := os.Getenv("ARANGODB_NAME")
@@ -99,8 +136,10 @@ func TestTaskModelCreate(t *testing.T) {
 		t.Skip("skipping integration test")
 	}
 	model := new(TaskModel)
-	if err := model.Create(); err != nil {
-		t.Fatal(err)
+	for i := 0; i < 2; i++ {
+		if err := model.Create(); err != nil {
+			t.Fatalf("[%d] %v", i, err)
+		}
 	}
 }
 
@@ -124,6 +163,27 @@ func TestTaskModelQuery(t *testing.T) {
 	}
 }
 
+func TestTaskModelFetchAll(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	task := NewTask([]byte(`{"priority": 1.5, "key": "fetch"}`))
+	model := new(TaskModel)
+	if _, err := model.Save(task); err != nil {
+		t.Fatal(err)
+	}
+	tasks, err := model.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, doc := range tasks {
+		if doc.(*Task).Id == task.Id {
+			return
+		}
+	}
+	t.Fatalf("expected task %s in %d tasks", task.Id, len(tasks))
+}
+
 func TestTaskModelSave(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping integration test")
@@ -136,6 +196,119 @@ func TestTaskModelSave(t *testing.T) {
 	if _, err := model.Save(task); err != nil {
 		t.Fatal(err)
 	}
+
+	created := task.Created
+	runAt := time.Now().Add(time.Hour).UTC()
+	update := &Task{
+		Id:       task.Id,
+		Created:  time.Now(),
+		Key:      "tb1",
+		Meta:     json.RawMessage(`{"name": "b"}`),
+		Priority: 3.5,
+		Result:   json.RawMessage(`{"rows": 10}`),
+		RunAt:    &runAt,
+		Status:   StatusScheduled,
+		Attempts: 2,
+	}
+	if _, err := model.Save(update); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := model.Get(task.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := doc.(*Task)
+	if !saved.Created.Equal(created) {
+		t.Fatalf("expected created %s to be preserved, got %s", created, saved.Created)
+	}
+	if saved.Priority != 3.5 || saved.Status != StatusScheduled || saved.Attempts != 2 || saved.RunAt == nil || !saved.RunAt.Equal(runAt) {
+		t.Fatalf("expected the updated fields to be saved, got %+v", saved)
+	}
+	if string(saved.Meta) != `{"name":"b"}` || string(saved.Result) != `{"rows":10}` {
+		t.Fatalf("expected the meta and result to be replaced, got %s %s", saved.Meta, saved.Result)
+	}
+
+	admin := model.WithContext(WithCaller(context.Background(), AdminCaller))
+	if _, err := admin.Save(update); err != nil {
+		t.Fatal(err)
+	}
+	doc, err = model.Get(task.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved := doc.(*Task); saved.UpdatedBy != AdminCaller || !saved.Updated.After(created) {
+		t.Fatalf("expected task updated by %s after %s, got %s at %s", AdminCaller, created, saved.UpdatedBy, saved.Updated)
+	}
+}
+
+func TestTouchTask(t *testing.T) {
+	created := time.Now().Add(-time.Hour)
+	var table = []struct {
+		Created time.Time
+		New     bool
+	}{
+		{time.Time{}, true},
+		{created, false},
+	}
+
+	for i, tt := range table {
+		task := &Task{Created: tt.Created}
+		touchTask(task, AdminCaller)
+		if task.UpdatedBy != AdminCaller || task.Updated.IsZero() {
+			t.Fatalf("[%d] expected update by %s, got %s at %s", i, AdminCaller, task.UpdatedBy, task.Updated)
+		}
+		if tt.New && !task.Created.Equal(task.Updated) {
+			t.Fatalf("[%d] expected created %s, got %s", i, task.Updated, task.Created)
+		}
+		if !tt.New && !task.Created.Equal(created) {
+			t.Fatalf("[%d] expected created %s to be preserved, got %s", i, created, task.Created)
+		}
+	}
+	resource := &Resource{}
+	touchResource(resource, SystemCaller)
+	if resource.UpdatedBy != SystemCaller || !resource.Created.Equal(resource.Updated) {
+		t.Fatalf("expected new resource updated by %s, got %+v", SystemCaller, resource)
+	}
+}
+
+func TestTaskPatch(t *testing.T) {
+	patch := taskPatch(&Task{Id: "a", Created: time.Now(), Children: []*Task{{Id: "b"}}})
+	typ := reflect.TypeOf(Task{})
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		_, ok := patch[name]
+		switch name {
+		case "_key", "created", "children":
+			if ok {
+				t.Fatalf("expected %s not to be patched", name)
+			}
+		default:
+			if !ok {
+				t.Fatalf("expected %s to be patched", name)
+			}
+		}
+	}
+}
+
+func TestTaskModelGet(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	task := NewTask([]byte(`{"meta": {"id": 123}, "Priority": 22.5, "key": "tb2"}`))
+	model := new(TaskModel)
+	if _, err := model.Save(task); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := model.Get(task.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc == nil || doc.(*Task).Id != task.Id {
+		t.Fatalf("expected task %s, got %v", task.Id, doc)
+	}
+	if doc, err := model.Get("missing"); err != nil || doc != nil {
+		t.Fatalf("expected no task, got %v %v", doc, err)
+	}
 }
 
 func TestTaskModelRemove(t *testing.T) {
@@ -152,6 +325,103 @@ func TestTaskModelRemove(t *testing.T) {
 	}
 }
 
+func TestTaskCountModelQuery(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	task := NewTask([]byte(`{"key": "count-test", "priority": 1.0}`))
+	task.Status = StatusQueued
+	if _, err := new(TaskModel).Save(task); err != nil {
+		t.Fatal(err)
+	}
+	q := fmt.Sprintf("FOR t IN %s COLLECT status = t.status WITH COUNT INTO count RETURN {status, count}", CollectionTasks)
+	counts, err := new(TaskCountModel).Query(q, map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, count := range counts {
+		if count.(*TaskCount).Status == StatusQueued && count.(*TaskCount).Count > 0 {
+			return
+		}
+	}
+	t.Fatal("expected queued task count to be greater than 0")
+}
+
+func TestTaskHistoryModelCreate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	model := new(TaskHistoryModel)
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTaskHistoryModelQuery(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	entry := NewTaskHistory("history123", StatusCreated, StatusQueued, "task submitted")
+	model := new(TaskHistoryModel)
+	if _, err := model.Save(entry); err != nil {
+		t.Fatal(err)
+	}
+	q := fmt.Sprintf(`FOR h IN %s FILTER h.taskId == @taskId RETURN h`, CollectionTaskHistory)
+	history, err := model.Query(q, map[string]interface{}{"taskId": "history123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) == 0 {
+		t.Fatal("expected task history entries to exist")
+	}
+}
+
+func TestDeferredCallModelCreate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	model := new(DeferredCallModel)
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeferredCallModelFetchAll(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	params := map[string]interface{}{"key": "test", "id": "abc123", "priority": 1.5}
+	call := NewDeferredCall("abc123", "127.0.0.1:8080", "push", params, StatusQueued)
+	model := new(DeferredCallModel)
+	if _, err := model.Save(call); err != nil {
+		t.Fatal(err)
+	}
+	calls, err := model.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range calls {
+		if v.(*DeferredCall).Id == call.Id {
+			return
+		}
+	}
+	t.Fatalf("expected deferred call %s to exist", call.Id)
+}
+
+func TestDeferredCallModelRemove(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	call := NewDeferredCall("abc123", "127.0.0.1:8080", "insert", map[string]interface{}{}, StatusScheduled)
+	model := new(DeferredCallModel)
+	if _, err := model.Save(call); err != nil {
+		t.Fatal(err)
+	}
+	if err := model.Remove(call); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestResourceModelCreate(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping integration test")
@@ -192,3 +462,502 @@ func TestResourceModelSave(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestResourceModelRemove(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	res := NewResource("test-remove")
+	model := new(ResourceModel)
+	if _, err := model.Save(res); err != nil {
+		t.Fatal(err)
+	}
+	if err := model.Remove(res); err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := model.Get(res.Name); err != nil || doc != nil {
+		t.Fatalf("expected removed resource, got %v %v", doc, err)
+	}
+}
+
+func TestResourceModelQuery(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	res := NewResource("test-query")
+	model := new(ResourceModel)
+	if _, err := model.Save(res); err != nil {
+		t.Fatal(err)
+	}
+	defer model.Remove(res)
+	q := fmt.Sprintf("FOR r IN %s FILTER r._key == @name RETURN r", CollectionResources)
+	docs, err := model.Query(q, map[string]interface{}{"name": res.Name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || docs[0].(*Resource).Name != res.Name {
+		t.Fatalf("expected resource %s, got %s", res.Name, fmt.Sprint(docs))
+	}
+}
+
+func TestUnsupportedModelOperations(t *testing.T) {
+	for i, model := range []Model{new(TaskStatModel), new(TaskHistoryModel), new(TaskLogModel), new(ResourceStatModel), new(TaskCountModel)} {
+		if err := model.Remove(nil); err != UnsupportedOperationError {
+			t.Fatalf("[%d] expected error %v, got %v", i, UnsupportedOperationError, err)
+		}
+	}
+	if _, err := new(TaskCountModel).Save(nil); err != UnsupportedOperationError {
+		t.Fatalf("expected error %v, got %v", UnsupportedOperationError, err)
+	}
+}
+
+func TestPageOffset(t *testing.T) {
+	var table = []struct {
+		Cursor string
+		Offset int
+		Err    error
+	}{
+		{PageCursor(0), 0, nil},
+		{PageCursor(1200), 1200, nil},
+		{PageCursor(-1), 0, InvalidCursorError},
+		{"not a cursor", 0, InvalidCursorError},
+		{"", 0, InvalidCursorError},
+	}
+
+	for i, tt := range table {
+		offset, err := PageOffset(tt.Cursor)
+		if err != tt.Err || offset != tt.Offset {
+			t.Fatalf("[%d] expected offset %d and error %v, got %d and %v", i, tt.Offset, tt.Err, offset, err)
+		}
+	}
+}
+
+func TestTaskModelQueryPage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	model := new(TaskModel)
+	for i := 0; i < 3; i++ {
+		if _, err := model.Save(NewTask([]byte(`{"key": "page-test", "priority": 1.0}`))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := fmt.Sprintf(`FOR t IN %s FILTER t.key == @key SORT t.created ASC LIMIT @offset, @limit RETURN t`, CollectionTasks)
+	page, err := model.QueryPage(q, map[string]interface{}{"key": "page-test"}, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Docs) != 1 || page.Total < 3 {
+		t.Fatalf("expected 1 task of at least 3, got %d of %d", len(page.Docs), page.Total)
+	}
+}
+
+func TestUpdateAll(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	task := NewTask([]byte(`{"key": "tx-test", "priority": 1.0}`))
+	taskModel := new(TaskModel)
+	if _, err := taskModel.Save(task); err != nil {
+		t.Fatal(err)
+	}
+	res := NewResource("tx-test")
+	resourceModel := new(ResourceModel)
+	if _, err := resourceModel.Save(res); err != nil {
+		t.Fatal(err)
+	}
+	task.Status = StatusStarted
+	res.TaskId = task.Id
+	if err := UpdateAll(Update{taskModel, task}, Update{resourceModel, res}); err != nil {
+		t.Fatal(err)
+	}
+	task.Status = StatusComplete
+	if err := UpdateAll(Update{taskModel, task}, Update{resourceModel, NewResource("tx-missing")}); err == nil {
+		t.Fatal("expected the update of the missing resource to fail")
+	}
+	q := fmt.Sprintf(`FOR t IN %s FILTER t._key == @key RETURN t`, CollectionTasks)
+	tasks, err := taskModel.Query(q, map[string]interface{}{"key": task.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || tasks[0].(*Task).Status != StatusStarted {
+		t.Fatalf("expected the task update to be rolled back, got %v", tasks)
+	}
+}
+
+func TestUpdateAllWithoutTransactions(t *testing.T) {
+	var table = []struct {
+		Errs  []error
+		Saved int
+	}{
+		{[]error{nil, nil}, 2},
+		{[]error{errors.New("save error"), nil}, 1},
+	}
+
+	for i, tt := range table {
+		saved := 0
+		updates := make([]Update, len(tt.Errs))
+		for j, err := range tt.Errs {
+			model := new(MockModel)
+			model.On("Save", j).Run(func(args mock.Arguments) { saved++ }).Return(DocumentMeta{}, err)
+			updates[j] = Update{model, j}
+		}
+		err := UpdateAll(updates...)
+		if (err != nil) != (tt.Saved < len(tt.Errs)) {
+			t.Fatalf("[%d] unexpected error %v", i, err)
+		}
+		if saved != tt.Saved {
+			t.Fatalf("[%d] expected %d saves, got %d", i, tt.Saved, saved)
+		}
+	}
+}
+
+func TestShardMemberModelSave(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	model := new(ShardMemberModel)
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	member := &ShardMember{"controller1:8080", time.Now()}
+	for i := 0; i < 2; i++ {
+		if _, err := model.Save(member); err != nil {
+			t.Fatal(err)
+		}
+	}
+	members, err := model.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].(*ShardMember).Address != "controller1:8080" {
+		t.Fatalf("expected the saved shard member to be replaced, got %v", members)
+	}
+	if err := model.Remove(member); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTaskGroupModelCreate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	model := new(TaskGroupModel)
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTaskGroupModelSave(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	group := NewTaskGroup("group123")
+	group.Members["task123"] = StatusQueued
+	model := new(TaskGroupModel)
+	if _, err := model.Save(group); err != nil {
+		t.Fatal(err)
+	}
+	group.Members["task123"] = StatusComplete
+	if _, err := model.Save(group); err != nil {
+		t.Fatal(err)
+	}
+	q := fmt.Sprintf(`FOR g IN %s FILTER g._key == @key RETURN g`, CollectionTaskGroups)
+	groups, err := model.Query(q, map[string]interface{}{"key": "group123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups[0].(*TaskGroup).Members["task123"] != StatusComplete {
+		t.Fatal("expected the saved task group to be replaced")
+	}
+}
+
+func TestTaskLogModelQuery(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	model := new(TaskLogModel)
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := model.Save(NewTaskLog("log123", "stdout", "line")); err != nil {
+		t.Fatal(err)
+	}
+	q := fmt.Sprintf(`FOR l IN %s FILTER l.taskId == @taskId RETURN l`, CollectionTaskLogs)
+	logs, err := model.Query(q, map[string]interface{}{"taskId": "log123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) == 0 {
+		t.Fatal("expected task log entries to exist")
+	}
+}
+
+func TestTaskArchiveModelSave(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	model := new(TaskArchiveModel)
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	archived := NewArchivedTask(NewTask([]byte(`{"key": "test", "priority": 1}`)), "duplicate")
+	if _, err := model.Save(archived); err != nil {
+		t.Fatal(err)
+	}
+	q := fmt.Sprintf(`FOR t IN %s FILTER t._key == @key RETURN t`, CollectionTasksArchive)
+	tasks, err := model.Query(q, map[string]interface{}{"key": archived.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || tasks[0].(*ArchivedTask).RemovedReason != "duplicate" {
+		t.Fatalf("expected archived task to exist, got %v", tasks)
+	}
+	if err := model.Remove(tasks[0]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResourceStatModelQuery(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	model := new(ResourceStatModel)
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if _, err := model.Save(NewResourceStat("stat123", now.Add(-time.Minute), now)); err != nil {
+		t.Fatal(err)
+	}
+	q := fmt.Sprintf(`FOR s IN %s FILTER s.resource == @resource RETURN s`, CollectionResourceStats)
+	rescStats, err := model.Query(q, map[string]interface{}{"resource": "stat123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rescStats) == 0 {
+		t.Fatal("expected resource stats to exist")
+	}
+}
+
+func TestDatabaseBackoff(t *testing.T) {
+	var table = []struct {
+		Attempts int
+		Backoff  time.Duration
+	}{
+		{1, DatabaseBackoff},
+		{2, DatabaseBackoff * 2},
+		{3, DatabaseBackoff * 4},
+		{20, DatabaseMaxBackoff},
+	}
+
+	for i, tt := range table {
+		if backoff := databaseBackoff(tt.Attempts); backoff != tt.Backoff {
+			t.Fatalf("[%d] expected backoff %s, got %s", i, tt.Backoff, backoff)
+		}
+	}
+}
+
+func TestDatabaseConnectionConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "concord-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeClientCert(t, dir)
+	defer func(limit int) { DatabaseConnLimit = limit }(DatabaseConnLimit)
+	DatabaseConnLimit = 8
+
+	var table = []struct {
+		Host      string
+		Cert      string
+		Key       string
+		Endpoints []string
+		TLS       bool
+		Err       bool
+	}{
+		{"http://arango:8529", "", "", []string{"http://arango:8529"}, false, false},
+		{"https://arango-1:8529, https://arango-2:8529", certFile, keyFile, []string{"https://arango-1:8529", "https://arango-2:8529"}, true, false},
+		{"https://arango-1:8529", certFile, "", nil, false, true},
+		{" , ", "", "", nil, false, true},
+	}
+
+	for i, tt := range table {
+		os.Setenv("ARANGODB_CERT", tt.Cert)
+		os.Setenv("ARANGODB_KEY", tt.Key)
+		config, err := databaseConnectionConfig(tt.Host)
+		os.Unsetenv("ARANGODB_CERT")
+		os.Unsetenv("ARANGODB_KEY")
+		if (err != nil) != tt.Err {
+			t.Fatalf("[%d] expected error %v, got %v", i, tt.Err, err)
+		}
+		if err != nil {
+			continue
+		}
+		if fmt.Sprint(config.Endpoints) != fmt.Sprint(tt.Endpoints) {
+			t.Fatalf("[%d] expected endpoints %v, got %v", i, tt.Endpoints, config.Endpoints)
+		}
+		if (config.TLSConfig != nil) != tt.TLS {
+			t.Fatalf("[%d] expected tls %v, got %v", i, tt.TLS, config.TLSConfig != nil)
+		}
+		if config.ConnLimit != 8 {
+			t.Fatalf("[%d] expected connection limit 8, got %d", i, config.ConnLimit)
+		}
+	}
+}
+
+func TestWatchDelay(t *testing.T) {
+	if delay := watchDelay(0); delay != DatabaseWatchInterval {
+		t.Fatalf("expected delay %s, got %s", DatabaseWatchInterval, delay)
+	}
+	if delay := watchDelay(2); delay != databaseBackoff(2) {
+		t.Fatalf("expected delay %s, got %s", databaseBackoff(2), delay)
+	}
+}
+
+// failingConnection is an arangodb connection whose requests fail with err.
+type failingConnection struct {
+	arango.Connection
+	err error
+}
+
+func (c *failingConnection) Do(ctx context.Context, req arango.Request) (arango.Response, error) {
+	return nil, c.err
+}
+
+func (c *failingConnection) SetAuthentication(auth arango.Authentication) (arango.Connection, error) {
+	return c, nil
+}
+
+func TestAvailabilityConnection(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	invalid := errors.New("invalid request")
+	var table = []struct {
+		Ctx context.Context
+		Err error
+		Out error
+	}{
+		{context.Background(), nil, nil},
+		{context.Background(), refused, StorageUnavailableError},
+		{nil, refused, StorageUnavailableError},
+		{context.Background(), io.EOF, StorageUnavailableError},
+		{context.Background(), invalid, invalid},
+		{cancelled, context.Canceled, context.Canceled},
+		{expired, context.DeadlineExceeded, context.DeadlineExceeded},
+	}
+
+	for i, tt := range table {
+		conn, err := (&availabilityConnection{&failingConnection{err: tt.Err}}).SetAuthentication(nil)
+		if err != nil {
+			t.Fatalf("[%d] %v", i, err)
+		}
+		if _, ok := conn.(*availabilityConnection); !ok {
+			t.Fatalf("[%d] expected authenticated availability connection, got %T", i, conn)
+		}
+		if _, err := conn.Do(tt.Ctx, nil); err != tt.Out {
+			t.Fatalf("[%d] expected error %v, got %v", i, tt.Out, err)
+		}
+	}
+}
+
+func TestCollectionOptions(t *testing.T) {
+	defer func(shards, factor int) {
+		DatabaseShards, DatabaseReplicationFactor = shards, factor
+	}(DatabaseShards, DatabaseReplicationFactor)
+	var table = []struct {
+		Shards    int
+		Factor    int
+		Name      string
+		ShardKeys []string
+		Nil       bool
+	}{
+		{0, 0, CollectionTasks, nil, true},
+		{3, 0, CollectionTasks, []string{"_key"}, false},
+		{0, 2, CollectionTaskLogs, []string{"taskId"}, false},
+		{3, 2, CollectionResources, nil, false},
+	}
+
+	for i, tt := range table {
+		DatabaseShards, DatabaseReplicationFactor = tt.Shards, tt.Factor
+		opts := collectionOptions(tt.Name)
+		if (opts == nil) != tt.Nil {
+			t.Fatalf("[%d] expected nil options %v, got %+v", i, tt.Nil, opts)
+		}
+		if opts == nil {
+			continue
+		}
+		if opts.NumberOfShards != tt.Shards || opts.ReplicationFactor != tt.Factor {
+			t.Fatalf("[%d] expected %d shards with %d replicas, got %+v", i, tt.Shards, tt.Factor, opts)
+		}
+		if fmt.Sprint(opts.ShardKeys) != fmt.Sprint(tt.ShardKeys) {
+			t.Fatalf("[%d] expected shard keys %v, got %v", i, tt.ShardKeys, opts.ShardKeys)
+		}
+	}
+}
+
+func TestQueryContext(t *testing.T) {
+	defer func(timeout time.Duration) { QueryTimeout = timeout }(QueryTimeout)
+	var table = []struct {
+		Timeout  time.Duration
+		Deadline bool
+	}{
+		{0, false},
+		{time.Minute, true},
+	}
+
+	for i, tt := range table {
+		QueryTimeout = tt.Timeout
+		ctx, cancel := queryContext(nil)
+		if _, ok := ctx.Deadline(); ok != tt.Deadline {
+			t.Fatalf("[%d] expected deadline %v, got %v", i, tt.Deadline, ok)
+		}
+		cancel()
+		if ctx.Err() != context.Canceled {
+			t.Fatalf("[%d] expected canceled query context, got %v", i, ctx.Err())
+		}
+	}
+}
+
+func TestBindModels(t *testing.T) {
+	ctx := context.Background()
+	other := new(MockModel)
+	models := map[string]Model{
+		"tasks":      NewCachedModel(&TaskModel{}, newMemoryCache(), CollectionTasks, func() interface{} { return new(Task) }),
+		"taskCounts": &TaskCountModel{},
+		"other":      other,
+	}
+	bound := bindModels(models, ctx)
+	if v := bound["tasks"].(*CachedModel).Model.(*TaskModel); v.ctx != ctx {
+		t.Fatal("expected cached task model bound to the context")
+	}
+	if models["tasks"].(*CachedModel).Model.(*TaskModel).ctx != nil {
+		t.Fatal("expected original task model not to be bound")
+	}
+	if v := bound["taskCounts"].(*TaskCountModel); v.ctx != ctx {
+		t.Fatal("expected task count model bound to the context")
+	}
+	if bound["other"] != other {
+		t.Fatal("expected model without context support to be kept")
+	}
+}
+
+func TestInitDatabaseFailFast(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	defer func(host string) { os.Setenv("ARANGODB_HOST", host) }(os.Getenv("ARANGODB_HOST"))
+	defer func(failFast bool) { DatabaseFailFast = failFast }(DatabaseFailFast)
+	os.Setenv("ARANGODB_HOST", "http://127.0.0.1:1")
+	DatabaseFailFast = true
+	conn := database()
+	if err := InitDatabase(); err != DatabaseUnavailableError {
+		t.Fatalf("expected error %v, got %v", DatabaseUnavailableError, err)
+	}
+	if database() != conn {
+		t.Fatal("expected database to be unchanged")
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bitwurx/jrpc2"
+)
+
+const (
+	EmbeddedPriorityQueueHost = "embedded:priority-queue" // the host of the embedded priority queue.
+	EmbeddedTimetableHost     = "embedded:timetable"      // the host of the embedded timetable.
+)
+
+// EmbedServices replaces the priority queue and timetable services whose
+// hosts are unset with in-memory implementations, so that the controller
+// can run standalone. The returned broker serves the calls to the embedded
+// services and passes the other calls to the provided broker. The broker
+// is returned unchanged if both hosts are set.
+func EmbedServices(broker ServiceBroker) ServiceBroker {
+	if PriorityQueueHost != "" && TimetableHost != "" {
+		return broker
+	}
+	embedded := &EmbeddedBroker{broker: broker}
+	if PriorityQueueHost == "" {
+		PriorityQueueHost = EmbeddedPriorityQueueHost
+		embedded.queue = NewMemoryPriorityQueue()
+		log.Println("using the embedded priority queue")
+	}
+	if TimetableHost == "" {
+		TimetableHost = EmbeddedTimetableHost
+		embedded.timetable = NewMemoryTimetable()
+		log.Println("using the embedded timetable")
+	}
+	return embedded
+}
+
+// EmbeddedBroker is a service broker that serves the priority queue and
+// timetable calls in-process.
+type EmbeddedBroker struct {
+	broker    ServiceBroker
+	queue     *MemoryPriorityQueue
+	timetable *MemoryTimetable
+}
+
+// Call serves the call of the method with parameters if the host is an
+// embedded service, and passes it to the wrapped broker otherwise.
+func (b *EmbeddedBroker) Call(ctx context.Context, host string, method string, params map[string]interface{}) (interface{}, *jrpc2.ErrorObject) {
+	switch {
+	case host == EmbeddedPriorityQueueHost && b.queue != nil:
+		return b.queue.Call(method, params)
+	case host == EmbeddedTimetableHost && b.timetable != nil:
+		return b.timetable.Call(method, params)
+	}
+	return b.broker.Call(ctx, host, method, params)
+}
+
+// BatchCall serves the calls one after the other if the host is an
+// embedded service, and passes them to the wrapped broker otherwise.
+func (b *EmbeddedBroker) BatchCall(ctx context.Context, host string, calls []BrokerCall) ([]BrokerResult, *jrpc2.ErrorObject) {
+	if (host == EmbeddedPriorityQueueHost && b.queue != nil) || (host == EmbeddedTimetableHost && b.timetable != nil) {
+		results := make([]BrokerResult, len(calls))
+		for i, call := range calls {
+			results[i].Result, results[i].Error = b.Call(ctx, host, call.Method, call.Params)
+		}
+		return results, nil
+	}
+	return batchCall(ctx, b.broker, host, calls)
+}
+
+// Load submits the queued and scheduled tasks to the embedded services,
+// which start out empty. The tasks are streamed from the task model, so
+// large backlogs are loaded without reading all tasks at once.
+func (b *EmbeddedBroker) Load(taskModel Model) error {
+	count := 0
+	err := streamWaitingTasks(taskModel, func(doc interface{}) error {
+		task := doc.(*Task)
+		switch {
+		case task.Status == StatusQueued && b.queue != nil:
+			b.queue.Push(task.QueueKey(), task.Id, task.Priority)
+		case task.Status == StatusScheduled && task.RunAt != nil && b.timetable != nil:
+			b.timetable.Insert(task.QueueKey(), task.Id, *task.RunAt)
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("loaded %d tasks into the embedded services\n", count)
+	return nil
+}
+
+// embeddedResult returns the result of a priority queue or timetable
+// update, which is 0 on success and 1 otherwise.
+func embeddedResult(ok bool) float64 {
+	if ok {
+		return 0
+	}
+	return 1
+}
+
+// embeddedParams returns the string key and id parameters of the call.
+func embeddedParams(params map[string]interface{}) (string, string) {
+	key, _ := params["key"].(string)
+	id, _ := params["id"].(string)
+	return key, id
+}
+
+// queueEntry is a task in the embedded priority queue.
+type queueEntry struct {
+	id       string
+	priority float64
+	seq      uint64
+}
+
+// queueHeap orders the entries by ascending priority value and tasks of
+// equal priority in the order they were pushed.
+type queueHeap []*queueEntry
+
+func (h queueHeap) Len() int { return len(h) }
+func (h queueHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority < h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h queueHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *queueHeap) Push(x interface{}) { *h = append(*h, x.(*queueEntry)) }
+func (h *queueHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// MemoryPriorityQueue is an in-memory priority queue per key with the
+// methods of the priority queue service. All methods are safe for
+// concurrent use.
+type MemoryPriorityQueue struct {
+	mu     sync.Mutex
+	seq    uint64
+	queues map[string]*queueHeap
+}
+
+// NewMemoryPriorityQueue creates a new empty in-memory priority queue.
+func NewMemoryPriorityQueue() *MemoryPriorityQueue {
+	return &MemoryPriorityQueue{queues: make(map[string]*queueHeap)}
+}
+
+// Call serves the priority queue service method with parameters.
+func (pq *MemoryPriorityQueue) Call(method string, params map[string]interface{}) (interface{}, *jrpc2.ErrorObject) {
+	key, id := embeddedParams(params)
+	switch method {
+	case "push":
+		priority, _ := params["priority"].(float64)
+		pq.Push(key, id, priority)
+		return float64(0), nil
+	case "pop":
+		if entry := pq.Pop(key); entry != nil {
+			return entry, nil
+		}
+		return nil, nil
+	case "remove":
+		return embeddedResult(pq.Remove(key, id)), nil
+	case "get":
+		queue, ok := pq.Get(key)
+		if !ok {
+			return nil, &jrpc2.ErrorObject{Code: jrpc2.InternalErrorCode, Message: jrpc2.ErrorMsg(QueueNotFoundError.Error())}
+		}
+		return queue, nil
+	case "health":
+		return float64(0), nil
+	}
+	return nil, &jrpc2.ErrorObject{Code: jrpc2.MethodNotFoundCode, Message: jrpc2.MethodNotFoundMsg}
+}
+
+// Push adds the task to the queue of the key.
+func (pq *MemoryPriorityQueue) Push(key string, id string, priority float64) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	queue, ok := pq.queues[key]
+	if !ok {
+		queue = &queueHeap{}
+		pq.queues[key] = queue
+	}
+	pq.seq++
+	heap.Push(queue, &queueEntry{id, priority, pq.seq})
+}
+
+// Pop removes and returns the highest priority task of the key. Nil is
+// returned if the queue is empty.
+func (pq *MemoryPriorityQueue) Pop(key string) map[string]interface{} {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	queue, ok := pq.queues[key]
+	if !ok || queue.Len() == 0 {
+		return nil
+	}
+	entry := heap.Pop(queue).(*queueEntry)
+	return map[string]interface{}{"_key": entry.id, "key": key, "priority": entry.priority}
+}
+
+// Remove removes the task from the queue of the key. False is returned if
+// the task is not queued.
+func (pq *MemoryPriorityQueue) Remove(key string, id string) bool {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	queue, ok := pq.queues[key]
+	if !ok {
+		return false
+	}
+	for i, entry := range *queue {
+		if entry.id == id {
+			heap.Remove(queue, i)
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns the listing of the queue of the key in priority order. False
+// is returned if nothing was ever pushed to the queue.
+func (pq *MemoryPriorityQueue) Get(key string) (map[string]interface{}, bool) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	queue, ok := pq.queues[key]
+	if !ok {
+		return nil, false
+	}
+	sorted := append(queueHeap(nil), *queue...)
+	sort.Sort(sorted)
+	entries := make([]interface{}, 0, len(sorted))
+	for _, entry := range sorted {
+		entries = append(entries, map[string]interface{}{"_key": entry.id, "key": key, "priority": entry.priority})
+	}
+	return map[string]interface{}{"_key": key, "heap": entries}, true
+}
+
+// timetableEntry is a task in the embedded timetable.
+type timetableEntry struct {
+	id    string
+	runAt time.Time
+}
+
+// MemoryTimetable is an in-memory schedule per key with the methods of the
+// timetable service. All methods are safe for concurrent use.
+type MemoryTimetable struct {
+	mu        sync.Mutex
+	schedules map[string][]*timetableEntry
+}
+
+// NewMemoryTimetable creates a new empty in-memory timetable.
+func NewMemoryTimetable() *MemoryTimetable {
+	return &MemoryTimetable{schedules: make(map[string][]*timetableEntry)}
+}
+
+// Call serves the timetable service method with parameters.
+func (tt *MemoryTimetable) Call(method string, params map[string]interface{}) (interface{}, *jrpc2.ErrorObject) {
+	key, id := embeddedParams(params)
+	switch method {
+	case "insert":
+		v, _ := params["runAt"].(string)
+		runAt, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, &jrpc2.ErrorObject{Code: jrpc2.InvalidParamsCode, Message: jrpc2.InvalidParamsMsg, Data: err.Error()}
+		}
+		tt.Insert(key, id, runAt)
+		return float64(0), nil
+	case "next":
+		if entry := tt.Next(key, time.Now()); entry != nil {
+			return entry, nil
+		}
+		return nil, nil
+	case "remove":
+		return embeddedResult(tt.Remove(key, id)), nil
+	case "get":
+		schedule, ok := tt.Get(key)
+		if !ok {
+			return nil, &jrpc2.ErrorObject{Code: jrpc2.InternalErrorCode, Message: jrpc2.ErrorMsg(TimetableNotFound.Error())}
+		}
+		return schedule, nil
+	case "health":
+		return float64(0), nil
+	}
+	return nil, &jrpc2.ErrorObject{Code: jrpc2.MethodNotFoundCode, Message: jrpc2.MethodNotFoundMsg}
+}
+
+// Insert adds the task to the schedule of the key. Tasks with the same run
+// time are kept in the order they were inserted.
+func (tt *MemoryTimetable) Insert(key string, id string, runAt time.Time) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	schedule := tt.schedules[key]
+	i := sort.Search(len(schedule), func(i int) bool { return schedule[i].runAt.After(runAt) })
+	schedule = append(schedule, nil)
+	copy(schedule[i+1:], schedule[i:])
+	schedule[i] = &timetableEntry{id, runAt}
+	tt.schedules[key] = schedule
+}
+
+// Next removes and returns the earliest task of the key that is due at the
+// provided time. Nil is returned if no task is due.
+func (tt *MemoryTimetable) Next(key string, now time.Time) map[string]interface{} {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	schedule := tt.schedules[key]
+	if len(schedule) == 0 || schedule[0].runAt.After(now) {
+		return nil
+	}
+	entry := schedule[0]
+	tt.schedules[key] = schedule[1:]
+	return map[string]interface{}{"_key": entry.id, "key": key, "runAt": entry.runAt.Format(time.RFC3339)}
+}
+
+// Remove removes the task from the schedule of the key. False is returned
+// if the task is not scheduled.
+func (tt *MemoryTimetable) Remove(key string, id string) bool {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	schedule := tt.schedules[key]
+	for i, entry := range schedule {
+		if entry.id == id {
+			tt.schedules[key] = append(schedule[:i:i], schedule[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns the schedule of the key as the task ids by run time. False
+// is returned if nothing was ever inserted for the key.
+func (tt *MemoryTimetable) Get(key string) (map[string]interface{}, bool) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	entries, ok := tt.schedules[key]
+	if !ok {
+		return nil, false
+	}
+	schedule := make(map[string]interface{})
+	for _, entry := range entries {
+		runAt := entry.runAt.Format(time.RFC3339)
+		ids, _ := schedule[runAt].([]interface{})
+		schedule[runAt] = append(ids, entry.id)
+	}
+	return map[string]interface{}{"_key": key, "schedule": schedule}, true
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
+
+func TestMemoryPriorityQueue(t *testing.T) {
+	pq := NewMemoryPriorityQueue()
+	if _, errObj := pq.Call("get", map[string]interface{}{"key": "test"}); errObj == nil || string(errObj.Message) != QueueNotFoundError.Error() {
+		t.Fatalf("expected error %v, got %v", QueueNotFoundError, errObj)
+	}
+	for _, entry := range []struct {
+		Id       string
+		Priority float64
+	}{{"c", 2}, {"a", 1}, {"b", 2}, {"d", 3}} {
+		pq.Call("push", map[string]interface{}{"key": "test", "id": entry.Id, "priority": entry.Priority})
+	}
+	if result, _ := pq.Call("remove", map[string]interface{}{"key": "test", "id": "d"}); result != float64(0) {
+		t.Fatalf("expected the task to be removed, got %v", result)
+	}
+	if result, _ := pq.Call("remove", map[string]interface{}{"key": "test", "id": "d"}); result != float64(1) {
+		t.Fatalf("expected the missing task not to be removed, got %v", result)
+	}
+	queue, _ := pq.Call("get", map[string]interface{}{"key": "test"})
+	if n := entryCount(queue.(map[string]interface{})); n != 3 {
+		t.Fatalf("expected 3 queued tasks, got %d", n)
+	}
+	if top := topQueuedTask(queue.(map[string]interface{})); top.Id != "a" {
+		t.Fatalf("expected top task a, got %s", top.Id)
+	}
+	popped := make([]string, 0)
+	for {
+		result, _ := pq.Call("pop", map[string]interface{}{"key": "test"})
+		if result == nil {
+			break
+		}
+		popped = append(popped, result.(map[string]interface{})["_key"].(string))
+	}
+	if fmt.Sprint(popped) != "[a c b]" {
+		t.Fatalf("expected the tasks in priority and push order [a c b], got %v", popped)
+	}
+}
+
+func TestMemoryTimetable(t *testing.T) {
+	tt := NewMemoryTimetable()
+	if _, errObj := tt.Call("get", map[string]interface{}{"key": "test"}); errObj == nil || string(errObj.Message) != TimetableNotFound.Error() {
+		t.Fatalf("expected error %v, got %v", TimetableNotFound, errObj)
+	}
+	if _, errObj := tt.Call("insert", map[string]interface{}{"key": "test", "id": "x", "runAt": "soon"}); errObj == nil {
+		t.Fatal("expected an invalid run time to be rejected")
+	}
+	now := time.Now()
+	for _, entry := range []struct {
+		Id    string
+		RunAt time.Time
+	}{{"b", now.Add(-time.Minute)}, {"a", now.Add(-time.Hour)}, {"c", now.Add(-time.Minute)}, {"d", now.Add(time.Hour)}} {
+		tt.Call("insert", map[string]interface{}{"key": "test", "id": entry.Id, "runAt": entry.RunAt.Format(time.RFC3339)})
+	}
+	schedule, _ := tt.Call("get", map[string]interface{}{"key": "test"})
+	if n := entryCount(schedule.(map[string]interface{})); n != 4 {
+		t.Fatalf("expected 4 scheduled tasks, got %d", n)
+	}
+	next := make([]string, 0)
+	for {
+		result, _ := tt.Call("next", map[string]interface{}{"key": "test"})
+		if result == nil {
+			break
+		}
+		next = append(next, result.(map[string]interface{})["_key"].(string))
+	}
+	if fmt.Sprint(next) != "[a b c]" {
+		t.Fatalf("expected the due tasks [a b c], got %v", next)
+	}
+	if result, _ := tt.Call("remove", map[string]interface{}{"key": "test", "id": "d"}); result != float64(0) {
+		t.Fatalf("expected the task to be removed, got %v", result)
+	}
+}
+
+func TestEmbedServices(t *testing.T) {
+	defer func(queue, timetable string) {
+		PriorityQueueHost, TimetableHost = queue, timetable
+	}(PriorityQueueHost, TimetableHost)
+	PriorityQueueHost, TimetableHost = "", "timetable:8080"
+
+	remote := new(MockServiceBroker)
+	remote.On("Call", mock.Anything, "timetable:8080", "next", map[string]interface{}{"key": "test"}).Return(nil, nil).Once()
+	broker := EmbedServices(remote)
+	if PriorityQueueHost != EmbeddedPriorityQueueHost || TimetableHost != "timetable:8080" {
+		t.Fatalf("expected only the priority queue to be embedded, got %s %s", PriorityQueueHost, TimetableHost)
+	}
+	runAt := time.Now().Add(time.Hour)
+	taskModel := new(MockModel)
+	taskModel.On("QueryStream", mock.AnythingOfType("string"), mock.Anything).Return(newSliceIterator(
+		&Task{Id: "abc123", Key: "test", Priority: 1, Status: StatusQueued},
+		&Task{Id: "def456", Key: "test", RunAt: &runAt, Status: StatusScheduled},
+	), nil)
+	if err := broker.(*EmbeddedBroker).Load(taskModel); err != nil {
+		t.Fatal(err)
+	}
+
+	ctrl := NewResourceController(broker)
+	task, err := ctrl.nextQueuedTask(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task == nil || task.Id != "abc123" {
+		t.Fatalf("expected the loaded task to be queued, got %v", task)
+	}
+	if _, err := ctrl.nextScheduledTask(context.Background(), "test"); err != nil {
+		t.Fatal(err)
+	}
+	remote.AssertExpectations(t)
+
+	PriorityQueueHost, TimetableHost = "queue:8080", "timetable:8080"
+	if EmbedServices(remote) != ServiceBroker(remote) {
+		t.Fatal("expected the broker to be unchanged when the hosts are set")
+	}
+}
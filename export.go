@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const TaskExportRoute = "/tasks/export" // the route the task exports are served on.
+
+// TaskExportHandler serves all tasks matched by the status, key and label
+// query parameters as newline delimited json ordered by creation time.
+// Labels are passed as repeated label=name=value parameters.
+type TaskExportHandler struct {
+	ctrl      Controller
+	taskModel Model
+}
+
+// NewTaskExportHandler creates a new task export handler that exports the
+// tasks of the task model through the controller.
+func NewTaskExportHandler(ctrl Controller, taskModel Model) *TaskExportHandler {
+	return &TaskExportHandler{ctrl, taskModel}
+}
+
+// ServeHTTP streams the matched tasks to the response. A failure before the
+// first task is written is served as an internal server error, and a later
+// failure ends the response early since the status was already sent. The
+// export stops once the client disconnects.
+func (h *TaskExportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	labels := make(map[string]string)
+	for _, label := range query["label"] {
+		pair := strings.SplitN(label, "=", 2)
+		if len(pair) != 2 || pair[0] == "" {
+			http.Error(w, "invalid label "+label, http.StatusBadRequest)
+			return
+		}
+		labels[pair[0]] = pair[1]
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	written := false
+	err := h.ctrl.ExportTasks(query.Get("status"), query.Get("key"), labels, bindContext(h.taskModel, r.Context()), func(task *Task) error {
+		written = true
+		return enc.Encode(task)
+	})
+	if err != nil && !written {
+		code := http.StatusInternalServerError
+		if errors.Is(err, StorageUnavailableError) {
+			code = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), code)
+	} else if err != nil {
+		log.Println(err)
+	}
+}
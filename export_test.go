@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+)
+
+func TestTaskExportHandler(t *testing.T) {
+	var table = []struct {
+		Method string
+		Url    string
+		Status string
+		Key    string
+		Labels map[string]string
+		Tasks  []*Task
+		Err    error
+		Code   int
+		Body   string
+	}{
+		{
+			http.MethodGet,
+			TaskExportRoute,
+			"",
+			"",
+			map[string]string{},
+			[]*Task{{Id: "a"}, {Id: "b"}},
+			nil,
+			http.StatusOK,
+			"a\nb\n",
+		},
+		{
+			http.MethodGet,
+			TaskExportRoute + "?status=complete&key=test&label=team=data",
+			StatusComplete,
+			"test",
+			map[string]string{"team": "data"},
+			[]*Task{{Id: "a"}},
+			nil,
+			http.StatusOK,
+			"a\n",
+		},
+		{
+			http.MethodGet,
+			TaskExportRoute,
+			"",
+			"",
+			map[string]string{},
+			nil,
+			errors.New("query error"),
+			http.StatusInternalServerError,
+			"query error\n",
+		},
+		{
+			http.MethodGet,
+			TaskExportRoute + "?label=team",
+			"",
+			"",
+			nil,
+			nil,
+			nil,
+			http.StatusBadRequest,
+			"invalid label team\n",
+		},
+		{
+			http.MethodPost,
+			TaskExportRoute,
+			"",
+			"",
+			nil,
+			nil,
+			nil,
+			http.StatusMethodNotAllowed,
+			"method not allowed\n",
+		},
+	}
+
+	for i, tt := range table {
+		taskModel := new(MockModel)
+		ctrl := new(MockController)
+		if tt.Labels != nil {
+			ctrl.On("ExportTasks", tt.Status, tt.Key, tt.Labels, taskModel, mock.Anything).Return(func(status string, key string, labels map[string]string, model Model, fn func(*Task) error) error {
+				for _, task := range tt.Tasks {
+					if err := fn(task); err != nil {
+						return err
+					}
+				}
+				return tt.Err
+			})
+		}
+		rec := httptest.NewRecorder()
+		NewTaskExportHandler(ctrl, taskModel).ServeHTTP(rec, httptest.NewRequest(tt.Method, tt.Url, nil))
+		if rec.Code != tt.Code {
+			t.Fatalf("[%d] expected status %d, got %d", i, tt.Code, rec.Code)
+		}
+		body := rec.Body.String()
+		if tt.Code == http.StatusOK {
+			body = ""
+			for _, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+				task := new(Task)
+				if err := json.Unmarshal([]byte(line), task); err != nil {
+					t.Fatalf("[%d] %v", i, err)
+				}
+				body += task.Id + "\n"
+			}
+		}
+		if body != tt.Body {
+			t.Fatalf("[%d] expected body %q, got %q", i, tt.Body, body)
+		}
+		ctrl.AssertExpectations(t)
+	}
+}
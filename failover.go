@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitwurx/jrpc2"
+)
+
+const (
+	FailoverPolicyOrdered    = "ordered"    // call the first healthy endpoint of a service.
+	FailoverPolicyRoundRobin = "roundrobin" // spread the calls over the healthy endpoints of a service.
+)
+
+// serviceEndpoints returns the endpoints of the comma-separated host.
+func serviceEndpoints(host string) []string {
+	endpoints := make([]string, 0)
+	for _, endpoint := range strings.Split(host, ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// FailoverServices makes the calls to the priority queue, timetable and
+// status change notifier services with several comma-separated endpoints
+// fail over between the endpoints. The broker is returned unchanged if no
+// service has several endpoints.
+func FailoverServices(broker ServiceBroker) ServiceBroker {
+	for _, service := range brokerServices() {
+		if endpoints := serviceEndpoints(*service.host); len(endpoints) > 1 {
+			log.Printf("failing over between the endpoints %v of service [%s]\n", endpoints, strings.ToLower(service.prefix))
+			return NewFailoverBroker(broker, FailoverPolicy == FailoverPolicyRoundRobin)
+		}
+	}
+	return broker
+}
+
+// FailoverBroker is a service broker that calls a host of several
+// comma-separated endpoints at one endpoint after the other until a call
+// does not fail in transport. Like the retries of retryCall, a call of a
+// method that is not idempotent only fails over if its request was not
+// sent, since the endpoint may already have applied it. An endpoint whose
+// call failed in transport is tried after the other endpoints until
+// FailoverCooldown has passed.
+// All methods are safe for concurrent use.
+type FailoverBroker struct {
+	broker     ServiceBroker
+	roundRobin bool
+	mu         sync.Mutex
+	next       map[string]int
+	down       map[string]time.Time
+}
+
+// NewFailoverBroker creates a new failover broker that calls the endpoints
+// with the provided broker. The healthy endpoints of a host are called in
+// turns if roundRobin is set, and in the order they are listed otherwise.
+func NewFailoverBroker(broker ServiceBroker, roundRobin bool) *FailoverBroker {
+	return &FailoverBroker{
+		broker:     broker,
+		roundRobin: roundRobin,
+		next:       make(map[string]int),
+		down:       make(map[string]time.Time),
+	}
+}
+
+// Call calls the method with parameters at the endpoints of the host until
+// the call does not fail in transport. The transport error of the last
+// endpoint is returned if the call fails at every endpoint.
+func (b *FailoverBroker) Call(ctx context.Context, host string, method string, params map[string]interface{}) (interface{}, *jrpc2.ErrorObject) {
+	endpoints := serviceEndpoints(host)
+	if len(endpoints) < 2 {
+		return b.broker.Call(ctx, host, method, params)
+	}
+	var errObj *jrpc2.ErrorObject
+	for _, endpoint := range b.order(host, endpoints) {
+		var result interface{}
+		result, errObj = b.broker.Call(ctx, endpoint, method, params)
+		if !b.failed(ctx, endpoint, IdempotentMethods[method], errObj) {
+			return result, errObj
+		}
+	}
+	return nil, errObj
+}
+
+// BatchCall sends the calls to the endpoints of the host until they do not
+// fail in transport. The calls not delivered before an endpoint failed are
+// sent to the next endpoint if they are all idempotent or were not sent.
+func (b *FailoverBroker) BatchCall(ctx context.Context, host string, calls []BrokerCall) ([]BrokerResult, *jrpc2.ErrorObject) {
+	endpoints := serviceEndpoints(host)
+	if len(endpoints) < 2 {
+		return batchCall(ctx, b.broker, host, calls)
+	}
+	results := make([]BrokerResult, 0, len(calls))
+	var errObj *jrpc2.ErrorObject
+	for _, endpoint := range b.order(host, endpoints) {
+		var delivered []BrokerResult
+		delivered, errObj = batchCall(ctx, b.broker, endpoint, calls[len(results):])
+		results = append(results, delivered...)
+		if !b.failed(ctx, endpoint, idempotentCalls(calls[len(results):]), errObj) {
+			return results, errObj
+		}
+	}
+	return results, errObj
+}
+
+// order returns the endpoints of the host in the order they are called,
+// which is the healthy endpoints followed by the endpoints that are down.
+// The healthy endpoints start at the next endpoint in turn if the broker
+// round-robins.
+func (b *FailoverBroker) order(host string, endpoints []string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	healthy := make([]string, 0, len(endpoints))
+	down := make([]string, 0)
+	for _, endpoint := range endpoints {
+		if at, ok := b.down[endpoint]; ok && time.Since(at) < FailoverCooldown {
+			down = append(down, endpoint)
+		} else {
+			healthy = append(healthy, endpoint)
+		}
+	}
+	if b.roundRobin && len(healthy) > 0 {
+		i := b.next[host] % len(healthy)
+		b.next[host] = i + 1
+		healthy = append(append([]string{}, healthy[i:]...), healthy[:i]...)
+	}
+	return append(healthy, down...)
+}
+
+// failed indicates whether the call to the endpoint failed in transport,
+// in which case the endpoint is marked down, and the call fails over to the
+// next endpoint if it is idempotent or its request was not sent. The
+// endpoint is marked healthy otherwise. A call is not failed over once the
+// context is done.
+func (b *FailoverBroker) failed(ctx context.Context, endpoint string, idempotent bool, errObj *jrpc2.ErrorObject) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if errObj == nil || errObj.Code != BrokerCallErrorCode {
+		delete(b.down, endpoint)
+		return false
+	}
+	b.down[endpoint] = time.Now()
+	if ctx.Err() != nil {
+		return false
+	}
+	logf(ctx, "service endpoint down [%s %v]\n", endpoint, errObj.Data)
+	return idempotent || errObj.Message == BrokerUnsentErrorMsg
+}
+
+// idempotentCalls indicates whether all of the calls are of idempotent
+// methods.
+func idempotentCalls(calls []BrokerCall) bool {
+	for _, call := range calls {
+		if !IdempotentMethods[call.Method] {
+			return false
+		}
+	}
+	return true
+}
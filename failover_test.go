@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bitwurx/jrpc2"
+)
+
+// endpointBroker is a service broker that records the endpoints it calls
+// and fails the calls to the endpoints that are down in transport before
+// they are sent, and to the endpoints that time out after they are sent.
+type endpointBroker struct {
+	down     map[string]bool
+	timeouts map[string]bool
+	calls    []string
+}
+
+func (b *endpointBroker) Call(ctx context.Context, host string, method string, params map[string]interface{}) (interface{}, *jrpc2.ErrorObject) {
+	b.calls = append(b.calls, host)
+	if b.down[host] {
+		return nil, &jrpc2.ErrorObject{Code: BrokerCallErrorCode, Message: BrokerUnsentErrorMsg, Data: "connection refused"}
+	}
+	if b.timeouts[host] {
+		return nil, &jrpc2.ErrorObject{Code: BrokerCallErrorCode, Message: jrpc2.ServerErrorMsg, Data: "timeout"}
+	}
+	return host, nil
+}
+
+func TestServiceEndpoints(t *testing.T) {
+	var table = []struct {
+		Host      string
+		Endpoints string
+	}{
+		{"", "[]"},
+		{"queue:8080", "[queue:8080]"},
+		{"queue-1:8080,queue-2:8080", "[queue-1:8080 queue-2:8080]"},
+		{" https://queue-1:8443 , queue-2:8080,", "[https://queue-1:8443 queue-2:8080]"},
+	}
+
+	for i, tt := range table {
+		if endpoints := fmt.Sprint(serviceEndpoints(tt.Host)); endpoints != tt.Endpoints {
+			t.Fatalf("[%d] expected endpoints %s, got %s", i, tt.Endpoints, endpoints)
+		}
+	}
+}
+
+func TestFailoverBrokerCall(t *testing.T) {
+	defer func(cooldown time.Duration) { FailoverCooldown = cooldown }(FailoverCooldown)
+	FailoverCooldown = time.Hour
+	host := "a:8080,b:8080,c:8080"
+
+	var table = []struct {
+		RoundRobin bool
+		Down       []string
+		Results    []string
+		Calls      []string
+	}{
+		{false, nil, []string{"a:8080", "a:8080", "a:8080"}, []string{"a:8080", "a:8080", "a:8080"}},
+		{false, []string{"a:8080"}, []string{"b:8080", "b:8080"}, []string{"a:8080", "b:8080", "b:8080"}},
+		{false, []string{"a:8080", "b:8080", "c:8080"}, []string{"<nil>", "<nil>"}, []string{"a:8080", "b:8080", "c:8080", "a:8080", "b:8080", "c:8080"}},
+		{true, nil, []string{"a:8080", "b:8080", "c:8080", "a:8080"}, []string{"a:8080", "b:8080", "c:8080", "a:8080"}},
+		{true, []string{"b:8080"}, []string{"a:8080", "c:8080", "a:8080", "c:8080"}, []string{"a:8080", "b:8080", "c:8080", "a:8080", "c:8080"}},
+	}
+
+	for i, tt := range table {
+		endpoints := &endpointBroker{down: make(map[string]bool)}
+		for _, endpoint := range tt.Down {
+			endpoints.down[endpoint] = true
+		}
+		broker := NewFailoverBroker(endpoints, tt.RoundRobin)
+		results := make([]string, 0)
+		for range tt.Results {
+			result, errObj := broker.Call(context.Background(), host, "health", nil)
+			if (errObj != nil) != (len(tt.Down) == 3) {
+				t.Fatalf("[%d] unexpected error %v", i, errObj)
+			}
+			results = append(results, fmt.Sprint(result))
+		}
+		if fmt.Sprint(results) != fmt.Sprint(tt.Results) {
+			t.Fatalf("[%d] expected results %v, got %v", i, tt.Results, results)
+		}
+		if fmt.Sprint(endpoints.calls) != fmt.Sprint(tt.Calls) {
+			t.Fatalf("[%d] expected calls %v, got %v", i, tt.Calls, endpoints.calls)
+		}
+	}
+}
+
+func TestFailoverBrokerRecovery(t *testing.T) {
+	defer func(cooldown time.Duration) { FailoverCooldown = cooldown }(FailoverCooldown)
+	FailoverCooldown = time.Hour
+	endpoints := &endpointBroker{down: map[string]bool{"a:8080": true}}
+	broker := NewFailoverBroker(endpoints, false)
+	broker.Call(context.Background(), "a:8080,b:8080", "health", nil)
+	endpoints.down["a:8080"] = false
+	if result, _ := broker.Call(context.Background(), "a:8080,b:8080", "health", nil); result != "b:8080" {
+		t.Fatalf("expected the down endpoint to be called last, got %v", result)
+	}
+	FailoverCooldown = 0
+	if result, _ := broker.Call(context.Background(), "a:8080,b:8080", "health", nil); result != "a:8080" {
+		t.Fatalf("expected the endpoint to be called first after the cooldown, got %v", result)
+	}
+	if result, _ := broker.Call(context.Background(), "c:8080", "health", nil); result != "c:8080" {
+		t.Fatalf("expected a single endpoint to be called directly, got %v", result)
+	}
+}
+
+func TestFailoverBrokerBatchCall(t *testing.T) {
+	endpoints := &endpointBroker{down: map[string]bool{"a:8080": true}}
+	broker := NewFailoverBroker(endpoints, false)
+	calls := []BrokerCall{{"push", nil}, {"push", nil}}
+	results, errObj := broker.BatchCall(context.Background(), "a:8080,b:8080", calls)
+	if errObj != nil {
+		t.Fatal(errObj)
+	}
+	if len(results) != 2 || results[0].Result != "b:8080" || results[1].Result != "b:8080" {
+		t.Fatalf("expected the batch to fail over to b:8080, got %v", results)
+	}
+	if fmt.Sprint(endpoints.calls) != "[a:8080 b:8080 b:8080]" {
+		t.Fatalf("expected the calls [a:8080 b:8080 b:8080], got %v", endpoints.calls)
+	}
+}
+
+func TestFailoverServices(t *testing.T) {
+	defer func(queue, timetable, notifier string) {
+		PriorityQueueHost, TimetableHost, StatusChangeNotifierHost = queue, timetable, notifier
+	}(PriorityQueueHost, TimetableHost, StatusChangeNotifierHost)
+	PriorityQueueHost, TimetableHost, StatusChangeNotifierHost = "queue:8080", "timetable:8080", "notifier:8080"
+	broker := NewJsonRPCServiceBroker()
+	if FailoverServices(broker) != ServiceBroker(broker) {
+		t.Fatal("expected the broker to be unchanged")
+	}
+	TimetableHost = "timetable-1:8080,timetable-2:8080"
+	if _, ok := FailoverServices(broker).(*FailoverBroker); !ok {
+		t.Fatal("expected a failover broker")
+	}
+}
+
+func TestFailoverBrokerSentCall(t *testing.T) {
+	var table = []struct {
+		Method string
+		Calls  string
+	}{
+		{"push", "[a:8080]"},
+		{"pop", "[a:8080]"},
+		{"get", "[a:8080 b:8080]"},
+	}
+
+	for i, tt := range table {
+		endpoints := &endpointBroker{timeouts: map[string]bool{"a:8080": true}}
+		broker := NewFailoverBroker(endpoints, false)
+		if _, errObj := broker.Call(context.Background(), "a:8080,b:8080", tt.Method, nil); (errObj != nil) != (tt.Calls == "[a:8080]") {
+			t.Fatalf("[%d] unexpected error %v", i, errObj)
+		}
+		if fmt.Sprint(endpoints.calls) != tt.Calls {
+			t.Fatalf("[%d] expected the calls %s, got %v", i, tt.Calls, endpoints.calls)
+		}
+	}
+
+	endpoints := &endpointBroker{timeouts: map[string]bool{"a:8080": true}}
+	broker := NewFailoverBroker(endpoints, false)
+	if _, errObj := broker.BatchCall(context.Background(), "a:8080,b:8080", []BrokerCall{{"push", nil}}); errObj == nil {
+		t.Fatal("expected the sent batch to fail")
+	}
+	if fmt.Sprint(endpoints.calls) != "[a:8080]" {
+		t.Fatalf("expected the sent batch not to be sent again, got %v", endpoints.calls)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bitwurx/jrpc2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	concordpb "concord-controller/proto"
+)
+
+const (
+	TransportJsonRPC                = "jsonrpc"                      // the json-rpc over http broker transport.
+	TransportGRPC                   = "grpc"                         // the grpc broker transport.
+	GRPCPriorityQueueService        = "concord.PriorityQueue"        // the grpc priority queue service.
+	GRPCTimetableService            = "concord.Timetable"            // the grpc timetable service.
+	GRPCStatusChangeNotifierService = "concord.StatusChangeNotifier" // the grpc status change notifier service.
+)
+
+var UnknownTransportError = errors.New("unknown broker transport")
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative proto/concord.proto
+
+// ConfigureServiceTransports configures the broker to call the priority
+// queue, timetable and status change notifier services over grpc when the
+// <prefix>_TRANSPORT environment variable of the service is grpc. It must
+// be called after ConfigureServiceTLS and ConfigureServiceAuth, whose
+// configuration the grpc connections use.
+//
+// an error is encountered if a transport is unknown or cannot be created.
+func ConfigureServiceTransports(broker *JsonRPCServiceBroker) error {
+	for _, service := range brokerServices() {
+		transport := os.Getenv(service.prefix + "_TRANSPORT")
+		if *service.host == "" || transport == "" || transport == TransportJsonRPC {
+			continue
+		}
+		if transport != TransportGRPC {
+			return fmt.Errorf("%s transport: %v %s", strings.ToLower(service.prefix), UnknownTransportError, transport)
+		}
+		for _, endpoint := range serviceEndpoints(*service.host) {
+			var auth *ServiceAuth
+			if serviceAuth, ok := broker.auths[endpoint]; ok {
+				auth = &serviceAuth
+			}
+			g, err := NewGRPCTransport(service.grpc, grpcTarget(endpoint), broker.tlsConfig(endpoint), auth)
+			if err != nil {
+				return fmt.Errorf("%s transport: %v", strings.ToLower(service.prefix), err)
+			}
+			broker.UseTransport(endpoint, g)
+			log.Printf("using grpc for service [%s]\n", endpoint)
+		}
+	}
+	return nil
+}
+
+// grpcTarget returns the <host>:<port> of the host without its scheme.
+func grpcTarget(host string) string {
+	if i := strings.Index(host, "://"); i >= 0 {
+		return host[i+3:]
+	}
+	return host
+}
+
+// GRPCTransport is a broker transport that calls a service of
+// proto/concord.proto over grpc with the generated clients.
+type GRPCTransport struct {
+	service string
+	auth    *ServiceAuth
+	methods map[string]grpcMethod
+}
+
+// grpcMethod calls the rpc of a broker method with its parameters and
+// returns the json-rpc result of the reply.
+type grpcMethod func(ctx context.Context, params map[string]interface{}) (interface{}, error)
+
+// NewGRPCTransport creates a new transport to the grpc service at the
+// <host>:<port> target. The service is called over tls if the tls
+// configuration is not nil, and with the token of the authentication if it
+// is not nil. The connection is made on the first call.
+func NewGRPCTransport(service string, target string, config *tls.Config, auth *ServiceAuth) (*GRPCTransport, error) {
+	creds := insecure.NewCredentials()
+	if config != nil {
+		creds = credentials.NewTLS(config)
+	}
+	conn, err := grpc.Dial(target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	return newGRPCTransport(service, conn, auth), nil
+}
+
+// newGRPCTransport creates a new transport to the service over the
+// connection.
+func newGRPCTransport(service string, conn grpc.ClientConnInterface, auth *ServiceAuth) *GRPCTransport {
+	return &GRPCTransport{service, auth, grpcMethods(service, conn)}
+}
+
+// grpcMethods returns the broker methods served by the service with the
+// rpcs of its client.
+func grpcMethods(service string, conn grpc.ClientConnInterface) map[string]grpcMethod {
+	switch service {
+	case GRPCPriorityQueueService:
+		client := concordpb.NewPriorityQueueClient(conn)
+		return map[string]grpcMethod{
+			"push":   taskRPC("push", client.Push),
+			"pop":    taskRPC("pop", client.Pop),
+			"remove": taskRPC("remove", client.Remove),
+			"get":    listRPC(client.Get),
+			"health": healthRPC(client.Health),
+		}
+	case GRPCTimetableService:
+		client := concordpb.NewTimetableClient(conn)
+		return map[string]grpcMethod{
+			"insert": taskRPC("insert", client.Insert),
+			"next":   taskRPC("next", client.Next),
+			"remove": taskRPC("remove", client.Remove),
+			"get":    listRPC(client.Get),
+			"health": healthRPC(client.Health),
+		}
+	case GRPCStatusChangeNotifierService:
+		client := concordpb.NewStatusChangeNotifierClient(conn)
+		return map[string]grpcMethod{
+			"notify": notifyRPC(client.Notify),
+			"health": healthRPC(client.Health),
+		}
+	}
+	return nil
+}
+
+// RoundTrip calls the rpc of the method with the parameters converted to
+// the request message of the rpc, and converts the reply to the result of
+// the json-rpc method. Unavailable services are transport errors and
+// unauthenticated calls are rejected.
+func (g *GRPCTransport) RoundTrip(ctx context.Context, method string, params map[string]interface{}) (interface{}, *jrpc2.ErrorObject, error) {
+	call, ok := g.methods[method]
+	if !ok {
+		return nil, &jrpc2.ErrorObject{Code: jrpc2.MethodNotFoundCode, Message: jrpc2.MethodNotFoundMsg}, nil
+	}
+	if g.auth != nil {
+		header, value, err := g.auth.header(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, strings.ToLower(header), value)
+	}
+	if id := CorrelationId(ctx); id != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, strings.ToLower(CorrelationHeader), id)
+	}
+	result, err := call(ctx, params)
+	if err != nil {
+		return grpcError(err)
+	}
+	return result, nil, nil
+}
+
+// taskRPC returns the broker method of an rpc with a TaskRequest.
+func taskRPC(method string, rpc func(context.Context, *concordpb.TaskRequest, ...grpc.CallOption) (*concordpb.Reply, error)) grpcMethod {
+	return func(ctx context.Context, params map[string]interface{}) (interface{}, error) {
+		reply, err := rpc(ctx, taskRequest(params))
+		if err != nil {
+			return nil, err
+		}
+		return replyResult(method, reply), nil
+	}
+}
+
+// listRPC returns the broker method of a Get rpc, whose result is the
+// json priority queue or timetable of the reply.
+func listRPC(rpc func(context.Context, *concordpb.TaskRequest, ...grpc.CallOption) (*concordpb.ListReply, error)) grpcMethod {
+	return func(ctx context.Context, params map[string]interface{}) (interface{}, error) {
+		reply, err := rpc(ctx, taskRequest(params))
+		if err != nil {
+			return nil, err
+		}
+		list := make(map[string]interface{})
+		if len(reply.GetList()) > 0 {
+			if err := json.Unmarshal(reply.GetList(), &list); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+		return list, nil
+	}
+}
+
+// notifyRPC returns the broker method of a Notify rpc.
+func notifyRPC(rpc func(context.Context, *concordpb.NotifyRequest, ...grpc.CallOption) (*concordpb.Reply, error)) grpcMethod {
+	return func(ctx context.Context, params map[string]interface{}) (interface{}, error) {
+		req := &concordpb.NotifyRequest{}
+		req.Kind, _ = params["kind"].(string)
+		switch created := params["created"].(type) {
+		case time.Time:
+			req.Created = created.Format(time.RFC3339Nano)
+		case string:
+			req.Created = created
+		}
+		req.Meta, _ = json.Marshal(params["meta"])
+		reply, err := rpc(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return replyResult("notify", reply), nil
+	}
+}
+
+// healthRPC returns the broker method of a Health rpc.
+func healthRPC(rpc func(context.Context, *concordpb.HealthRequest, ...grpc.CallOption) (*concordpb.Reply, error)) grpcMethod {
+	return func(ctx context.Context, params map[string]interface{}) (interface{}, error) {
+		reply, err := rpc(ctx, &concordpb.HealthRequest{})
+		if err != nil {
+			return nil, err
+		}
+		return replyResult("health", reply), nil
+	}
+}
+
+// taskRequest returns the TaskRequest message of the parameters.
+func taskRequest(params map[string]interface{}) *concordpb.TaskRequest {
+	req := &concordpb.TaskRequest{}
+	req.Key, req.Id = embeddedParams(params)
+	req.Priority, _ = params["priority"].(float64)
+	req.RunAt, _ = params["runAt"].(string)
+	return req
+}
+
+// grpcError converts the error of a grpc call to the result of a round
+// trip.
+func grpcError(err error) (interface{}, *jrpc2.ErrorObject, error) {
+	s, ok := status.FromError(err)
+	if !ok {
+		return nil, nil, err
+	}
+	switch s.Code() {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Canceled:
+		return nil, nil, err
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return nil, nil, rejectedError{err}
+	case codes.Unimplemented:
+		return nil, &jrpc2.ErrorObject{Code: jrpc2.MethodNotFoundCode, Message: jrpc2.MethodNotFoundMsg}, nil
+	case codes.InvalidArgument:
+		return nil, &jrpc2.ErrorObject{Code: jrpc2.InvalidParamsCode, Message: jrpc2.InvalidParamsMsg, Data: s.Message()}, nil
+	}
+	return nil, &jrpc2.ErrorObject{Code: jrpc2.InternalErrorCode, Message: jrpc2.ErrorMsg(s.Message())}, nil
+}
+
+// replyResult returns the json-rpc result of the method for the reply,
+// which is the task taken out for pop and next and the result code
+// otherwise.
+func replyResult(method string, reply *concordpb.Reply) interface{} {
+	switch method {
+	case "pop":
+		if reply.GetId() == "" {
+			return nil
+		}
+		return map[string]interface{}{"_key": reply.GetId(), "key": reply.GetKey(), "priority": reply.GetPriority()}
+	case "next":
+		if reply.GetId() == "" {
+			return nil
+		}
+		return map[string]interface{}{"_key": reply.GetId(), "key": reply.GetKey(), "runAt": reply.GetRunAt()}
+	}
+	return float64(reply.GetResult())
+}
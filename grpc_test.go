@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bitwurx/jrpc2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	concordpb "concord-controller/proto"
+)
+
+// stubConn is a grpc connection that records the called rpc and its
+// request, and answers with the reply or error.
+type stubConn struct {
+	method string
+	args   interface{}
+	ctx    context.Context
+	reply  proto.Message
+	err    error
+}
+
+func (c *stubConn) Invoke(ctx context.Context, method string, args interface{}, reply interface{}, opts ...grpc.CallOption) error {
+	c.method, c.args, c.ctx = method, args, ctx
+	if c.reply != nil {
+		proto.Merge(reply.(proto.Message), c.reply)
+	}
+	return c.err
+}
+
+func (c *stubConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return nil, errors.New("streams are not supported")
+}
+
+func TestGRPCTransportRoundTrip(t *testing.T) {
+	var table = []struct {
+		Service string
+		Method  string
+		Params  map[string]interface{}
+		Reply   proto.Message
+		Err     error
+		Path    string
+		Result  interface{}
+		Code    jrpc2.ErrorCode
+		Retried bool
+	}{
+		{
+			GRPCPriorityQueueService,
+			"push",
+			map[string]interface{}{"key": "test", "id": "abc123", "priority": 2.5},
+			&concordpb.Reply{},
+			nil,
+			"/concord.PriorityQueue/Push",
+			float64(0),
+			0,
+			false,
+		},
+		{
+			GRPCPriorityQueueService,
+			"pop",
+			map[string]interface{}{"key": "test"},
+			&concordpb.Reply{Id: "abc123", Key: "test", Priority: 2.5},
+			nil,
+			"/concord.PriorityQueue/Pop",
+			map[string]interface{}{"_key": "abc123", "key": "test", "priority": 2.5},
+			0,
+			false,
+		},
+		{
+			GRPCTimetableService,
+			"next",
+			map[string]interface{}{"key": "test"},
+			&concordpb.Reply{},
+			nil,
+			"/concord.Timetable/Next",
+			nil,
+			0,
+			false,
+		},
+		{
+			GRPCStatusChangeNotifierService,
+			"notify",
+			map[string]interface{}{"kind": "test", "created": time.Now(), "meta": []byte(`{}`)},
+			&concordpb.Reply{Result: 1},
+			nil,
+			"/concord.StatusChangeNotifier/Notify",
+			float64(1),
+			0,
+			false,
+		},
+		{
+			GRPCPriorityQueueService,
+			"get",
+			map[string]interface{}{"key": "test"},
+			&concordpb.ListReply{List: []byte(`{"heap":[{"_key":"abc123"}]}`)},
+			nil,
+			"/concord.PriorityQueue/Get",
+			map[string]interface{}{"heap": []interface{}{map[string]interface{}{"_key": "abc123"}}},
+			0,
+			false,
+		},
+		{GRPCTimetableService, "get", map[string]interface{}{"key": "test"}, &concordpb.ListReply{}, nil, "/concord.Timetable/Get", map[string]interface{}{}, 0, false},
+		{GRPCStatusChangeNotifierService, "get", map[string]interface{}{"key": "test"}, nil, nil, "", nil, jrpc2.MethodNotFoundCode, false},
+		{GRPCTimetableService, "insert", map[string]interface{}{}, nil, status.Error(codes.InvalidArgument, "bad run at"), "/concord.Timetable/Insert", nil, jrpc2.InvalidParamsCode, false},
+		{GRPCTimetableService, "insert", map[string]interface{}{}, nil, status.Error(codes.Unavailable, "connection refused"), "/concord.Timetable/Insert", nil, 0, true},
+		{GRPCTimetableService, "insert", map[string]interface{}{}, nil, errors.New("connection reset"), "/concord.Timetable/Insert", nil, 0, true},
+	}
+
+	for i, tt := range table {
+		conn := &stubConn{reply: tt.Reply, err: tt.Err}
+		transport := newGRPCTransport(tt.Service, conn, &ServiceAuth{Token: StaticToken("secret")})
+		result, errObj, err := transport.RoundTrip(context.Background(), tt.Method, tt.Params)
+		if conn.method != tt.Path {
+			t.Fatalf("[%d] expected the rpc %s, got %s", i, tt.Path, conn.method)
+		}
+		var token []string
+		if conn.ctx != nil {
+			md, _ := metadata.FromOutgoingContext(conn.ctx)
+			token = md["authorization"]
+		}
+		if conn.method != "" && fmt.Sprint(token) != "[Bearer secret]" {
+			t.Fatalf("[%d] expected the bearer token metadata, got %v", i, token)
+		}
+		key, _ := tt.Params["key"].(string)
+		id, _ := tt.Params["id"].(string)
+		if req, ok := conn.args.(*concordpb.TaskRequest); ok && (req.Key != key || req.Id != id) {
+			t.Fatalf("[%d] unexpected request %v", i, req)
+		}
+		if (err != nil) != tt.Retried {
+			t.Fatalf("[%d] unexpected transport error %v", i, err)
+		}
+		if (errObj != nil) != (tt.Code != 0) || (errObj != nil && errObj.Code != tt.Code) {
+			t.Fatalf("[%d] expected error code %d, got %v", i, tt.Code, errObj)
+		}
+		if fmt.Sprint(result) != fmt.Sprint(tt.Result) {
+			t.Fatalf("[%d] expected result %v, got %v", i, tt.Result, result)
+		}
+	}
+}
+
+// stubTransport is a broker transport that fails with the errors before it
+// returns the result.
+type stubTransport struct {
+	errs  []error
+	calls int
+}
+
+func (s *stubTransport) RoundTrip(ctx context.Context, method string, params map[string]interface{}) (interface{}, *jrpc2.ErrorObject, error) {
+	s.calls++
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		return nil, nil, err
+	}
+	return float64(0), nil, nil
+}
+
+func TestServiceBrokerCallTransport(t *testing.T) {
+	defer func(n int, d time.Duration) { BrokerRetries, BrokerBackoff = n, d }(BrokerRetries, BrokerBackoff)
+	BrokerRetries, BrokerBackoff = 2, time.Millisecond
+
+	var table = []struct {
+		Method string
+		Errs   []error
+		Calls  int
+		Result interface{}
+		Code   jrpc2.ErrorCode
+	}{
+		{"push", nil, 1, float64(0), 0},
+		{"get", []error{errors.New("unavailable"), errors.New("unavailable")}, 3, float64(0), 0},
+		{"get", []error{errors.New("unavailable"), errors.New("unavailable"), errors.New("unavailable")}, 3, nil, BrokerCallErrorCode},
+		{"get", []error{rejectedError{errors.New("unauthenticated")}}, 1, nil, BrokerRejectedErrorCode},
+		{"push", []error{errors.New("unavailable")}, 1, nil, BrokerCallErrorCode},
+		{"push", []error{unsentError{errors.New("connection refused")}}, 2, float64(0), 0},
+	}
+
+	for i, tt := range table {
+		transport := &stubTransport{errs: tt.Errs}
+		broker := NewJsonRPCServiceBroker()
+		broker.UseTransport("queue:9090", transport)
+		result, errObj := broker.Call(context.Background(), "queue:9090", tt.Method, map[string]interface{}{})
+		if transport.calls != tt.Calls {
+			t.Fatalf("[%d] expected %d attempts, got %d", i, tt.Calls, transport.calls)
+		}
+		if result != tt.Result {
+			t.Fatalf("[%d] expected result %v, got %v", i, tt.Result, result)
+		}
+		if (errObj != nil) != (tt.Code != 0) || (errObj != nil && errObj.Code != tt.Code) {
+			t.Fatalf("[%d] expected error code %d, got %v", i, tt.Code, errObj)
+		}
+	}
+
+	transport := &stubTransport{errs: []error{unsentError{errors.New("connection refused")}}}
+	broker := NewJsonRPCServiceBroker()
+	broker.UseTransport("queue:9090", transport)
+	BrokerRetries = 0
+	if _, errObj := broker.Call(context.Background(), "queue:9090", "push", map[string]interface{}{}); errObj == nil || errObj.Message != BrokerUnsentErrorMsg {
+		t.Fatalf("expected the unsent call to be marked, got %v", errObj)
+	}
+}
+
+func TestConfigureServiceTransports(t *testing.T) {
+	defer func(queue, timetable, notifier string) {
+		PriorityQueueHost, TimetableHost, StatusChangeNotifierHost = queue, timetable, notifier
+	}(PriorityQueueHost, TimetableHost, StatusChangeNotifierHost)
+	PriorityQueueHost, TimetableHost, StatusChangeNotifierHost = "https://queue:9090", "timetable:9090", "notifier:8080"
+	defer os.Unsetenv("CONCORD_PRIORITY_QUEUE_TRANSPORT")
+	defer os.Unsetenv("CONCORD_TIMETABLE_TRANSPORT")
+	os.Setenv("CONCORD_TIMETABLE_TRANSPORT", "thrift")
+
+	broker := NewJsonRPCServiceBroker()
+	if err := ConfigureServiceTransports(broker); err == nil {
+		t.Fatal("expected the unknown transport to fail the configuration")
+	}
+	os.Setenv("CONCORD_PRIORITY_QUEUE_TRANSPORT", TransportGRPC)
+	os.Setenv("CONCORD_TIMETABLE_TRANSPORT", TransportJsonRPC)
+	broker.UseAuth("https://queue:9090", ServiceAuth{Token: StaticToken("secret")})
+	if err := ConfigureServiceTransports(broker); err != nil {
+		t.Fatal(err)
+	}
+	if len(broker.transports) != 1 {
+		t.Fatalf("expected 1 grpc transport, got %d", len(broker.transports))
+	}
+	transport, ok := broker.transports["https://queue:9090"].(*GRPCTransport)
+	if !ok || transport.service != GRPCPriorityQueueService || transport.auth == nil {
+		t.Fatalf("expected an authenticated grpc priority queue transport, got %v", broker.transports)
+	}
+	if target := grpcTarget("https://queue:9090"); target != "queue:9090" {
+		t.Fatalf("expected the target without the scheme, got %s", target)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import "log"
+
+// ControllerHooks receives the task lifecycle events of the controller so
+// that metrics, auditing and other integrations can observe the tasks
+// without changes to the controller.
+//
+// The hooks are called synchronously after the change has been saved and
+// must not block or modify the task. A panicking hook is recovered and
+// logged.
+type ControllerHooks interface {
+	// OnTaskAdded is called when the task has been added and submitted to
+	// the priority queue or timetable, or blocked on its dependencies.
+	// OnTaskStaged is called when the task has been staged for its
+	// resource.
+	// OnTaskStarted is called when the task has been started and locked
+	// its resource.
+	// OnTaskCompleted is called when the started task has been completed,
+	// failed or cancelled, or when the task has been force completed.
+	// OnTaskRemoved is called when the task has been moved to the tasks
+	// archive.
+	OnTaskAdded(*Task)
+	OnTaskStaged(*Task)
+	OnTaskStarted(*Task)
+	OnTaskCompleted(*Task)
+	OnTaskRemoved(*Task)
+}
+
+// NopControllerHooks implements ControllerHooks with hooks that do
+// nothing. It can be embedded to implement only some of the hooks.
+type NopControllerHooks struct{}
+
+func (NopControllerHooks) OnTaskAdded(*Task)     {}
+func (NopControllerHooks) OnTaskStaged(*Task)    {}
+func (NopControllerHooks) OnTaskStarted(*Task)   {}
+func (NopControllerHooks) OnTaskCompleted(*Task) {}
+func (NopControllerHooks) OnTaskRemoved(*Task)   {}
+
+// runHooks calls fn with each registered hooks implementation in the order
+// of registration.
+func (ctrl *ResourceController) runHooks(fn func(ControllerHooks)) {
+	for _, hooks := range ctrl.hooks {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("controller hook crashed [%T %v]\n", hooks, r)
+				}
+			}()
+			fn(hooks)
+		}()
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type recordingHooks struct {
+	NopControllerHooks
+	events []string
+}
+
+func (h *recordingHooks) OnTaskAdded(task *Task)     { h.record("added", task) }
+func (h *recordingHooks) OnTaskStaged(task *Task)    { h.record("staged", task) }
+func (h *recordingHooks) OnTaskStarted(task *Task)   { h.record("started", task) }
+func (h *recordingHooks) OnTaskCompleted(task *Task) { h.record("completed", task) }
+func (h *recordingHooks) OnTaskRemoved(task *Task)   { h.record("removed", task) }
+
+func (h *recordingHooks) record(event string, task *Task) {
+	h.events = append(h.events, fmt.Sprintf("%s:%s:%s", event, task.Id, task.Status))
+}
+
+type panickingHooks struct {
+	NopControllerHooks
+}
+
+func (panickingHooks) OnTaskAdded(*Task) { panic("hook error") }
+
+func TestControllerHooks(t *testing.T) {
+	task := &Task{Id: "abc123", Key: "test", Priority: 2.5}
+	broker := &MockServiceBroker{}
+	broker.On("Call", mock.Anything, PriorityQueueHost, "push", mock.Anything).Return(float64(0), nil)
+	broker.On("Call", mock.Anything, PriorityQueueHost, "remove", mock.Anything).Return(float64(0), nil)
+	broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil)
+	taskModel := &MockModel{}
+	taskModel.On("Save", mock.Anything).Return(DocumentMeta{}, nil)
+	taskModel.On("Get", "abc123").Return(task, nil)
+	taskModel.On("Query", mock.Anything, mock.Anything).Return([]interface{}{}, nil)
+	taskModel.On("Remove", mock.Anything).Return(nil)
+	rescModel := &MockModel{}
+	rescModel.On("Save", mock.Anything).Return(DocumentMeta{}, nil)
+	archiveModel := &MockModel{}
+	archiveModel.On("Save", mock.Anything).Return(DocumentMeta{}, nil)
+	hooks := &recordingHooks{}
+	ctrl := NewResourceController(broker, panickingHooks{}, hooks)
+	ctrl.storeResource(&Resource{Name: "test", Status: ResourceFree})
+
+	if err := ctrl.AddTask(task, taskModel, rescModel); err != nil {
+		t.Fatal(err)
+	}
+	ctrl.StageTask(task, taskModel, true)
+	if err := ctrl.StartTask("test", "", taskModel, rescModel); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctrl.CompleteTask("abc123", StatusComplete, nil, "", false, taskModel, rescModel); err != nil {
+		t.Fatal(err)
+	}
+	task.Status = StatusQueued
+	if err := ctrl.RemoveTask("abc123", "", taskModel, archiveModel); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"added:abc123:queued",
+		"staged:abc123:pending",
+		"started:abc123:started",
+		"completed:abc123:complete",
+		"removed:abc123:cancelled",
+	}
+	if fmt.Sprint(hooks.events) != fmt.Sprint(expected) {
+		t.Fatalf("expected hook events %v, got %v", expected, hooks.events)
+	}
+}
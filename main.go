@@ -1,18 +1,157 @@
 package main
 
 import (
-	"github.com/bitwurx/jrpc2"
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+var (
+	Version     = "dev"     // the controller version, set at build time.
+	BuildCommit = "unknown" // the commit the controller was built from, set at build time.
 )
 
 func main() {
-	InitDatabase()
-	s := jrpc2.NewServer(":8080", "/rpc")
-	models := map[string]Model{
-		"resources": &ResourceModel{},
-		"tasks":     &TaskModel{},
+	var err error
+	if CallbackSecret == "" {
+		log.Println("CONCORD_CALLBACK_SECRET is not set, task callbacks are not signed")
+	}
+	if schema := os.Getenv("CONCORD_META_SCHEMA"); schema != "" {
+		if TaskMetaSchema, err = NewMetaSchema([]byte(schema)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if store, err = NewStorage(StorageBackend); err != nil {
+		log.Fatal(err)
+	}
+	if err := store.Init(); err != nil {
+		log.Println(err)
+		if err == DatabaseUnavailableError {
+			os.Exit(DatabaseUnavailableExitCode)
+		}
+		os.Exit(1)
+	}
+	s := NewDispatcher(":8080", "/rpc")
+	models := store.Models()
+	if RedisURL != "" {
+		cache, err := NewRedisCache(RedisURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		CacheModels(models, cache)
+		log.Println("caching tasks and resources in redis")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var broker ServiceBroker
+	if NatsURL != "" {
+		conn, err := ConnectNats(NatsURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+		broker = NewNatsServiceBroker(conn)
+		log.Printf("calling services through nats [%s]\n", NatsURL)
+	} else if AMQPURL != "" {
+		amqpBroker := NewAMQPServiceBroker(AMQPURL)
+		defer amqpBroker.Close()
+		broker = amqpBroker
+		log.Println("calling services through amqp")
+	} else {
+		jsonRPCBroker := NewJsonRPCServiceBroker()
+		if err := ConfigureServiceTLS(jsonRPCBroker); err != nil {
+			log.Fatal(err)
+		}
+		ConfigureServiceAuth(jsonRPCBroker)
+		if err := ConfigureServiceTransports(jsonRPCBroker); err != nil {
+			log.Fatal(err)
+		}
+		broker = jsonRPCBroker
+	}
+	metrics := NewMetricsBroker(broker)
+	s.Handle(MetricsRoute, metrics)
+	broker = EmbedServices(FailoverServices(metrics))
+	if embedded, ok := broker.(*EmbeddedBroker); ok {
+		if err := embedded.Load(models["tasks"]); err != nil {
+			log.Fatal(err)
+		}
+	}
+	ctrl := NewResourceController(broker)
+	ctrl.RecordHistory(models["taskHistory"])
+	ctrl.TrackGroups(models["taskGroups"])
+	ctrl.TrackResourceStats(models["resourceStats"])
+	ctrl.QueueNotifications(NewNotifyQueue(NotifyQueueSize, NotifyOverflow), 1)
+	ctrl.StoreFailedEvents(models["failedEvents"])
+	if StartRate > 0 {
+		ctrl.LimitStarts(NewStartLimiter(StartRate, StartBurst))
+	}
+	var shards *Sharder
+	if ShardAddress != "" {
+		if ShardSecret == "" {
+			log.Fatal(ShardSecretError)
+		}
+		shards = NewSharder(ShardAddress)
+		if _, _, err := shards.Refresh(models["shardMembers"]); err != nil {
+			log.Fatal(err)
+		}
+		ctrl.Shard(shards)
+		s.Proxy(NewShardRouter(ctrl, models["tasks"]), ShardSecret)
+		if files := envServiceTLS("CONCORD_SHARD"); !files.Empty() {
+			config, err := files.Config()
+			if err != nil {
+				log.Fatal(err)
+			}
+			s.ProxyTLS(config)
+		}
 	}
-	ctrl := NewResourceController(&JsonRPCServiceBroker{})
+	if BufferBrokerCalls {
+		ctrl.BufferCalls(models["deferredCalls"])
+		go ctrl.StartReplayLoop(ctx, models["tasks"])
+	}
+	s.Handle(TaskExportRoute, NewTaskExportHandler(ctrl, models["tasks"]))
 	NewApiV1(models, ctrl, s)
-	go ctrl.StartStageLoop(models["tasks"])
-	s.Start()
+	NewApiV2(models, ctrl, s)
+	if _, err := ctrl.RecoverStartedTasks(models["tasks"], models["resources"]); err != nil {
+		log.Println(err)
+	}
+	go ctrl.StartStageLoop(ctx, models["tasks"])
+	if shards != nil {
+		go ctrl.StartShardLoop(ctx, models["shardMembers"], models["tasks"], models["resources"])
+	}
+	go ctrl.StartRedeliverLoop(ctx)
+	go store.Watch(ctx)
+	go ctrl.StartExpiryLoop(ctx, models["tasks"])
+	go ctrl.StartLeaseLoop(ctx, models["tasks"], models["resources"])
+	go ctrl.StartHeartbeatLoop(ctx, models["tasks"], models["resources"])
+	if MaxLockDuration > 0 {
+		go ctrl.StartLockLoop(ctx, MaxLockDuration, models["tasks"], models["resources"])
+	}
+	if ArchiveRetention > 0 {
+		go ctrl.StartArchiveLoop(ctx, ArchiveRetention, models["tasks"], models["taskArchive"])
+	}
+	go func() {
+		if err := s.Start(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	log.Printf("received %s, shutting down\n", <-sig)
+	cancel()
+	shutdownCtx, done := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer done()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		log.Println(err)
+	}
+	if err := ctrl.Shutdown(shutdownCtx); err != nil {
+		log.Println(err)
+	}
+	if shards != nil {
+		if err := shards.Leave(models["shardMembers"]); err != nil {
+			log.Println(err)
+		}
+	}
 }
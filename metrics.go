@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitwurx/jrpc2"
+)
+
+const MetricsRoute = "/metrics" // the route the metrics are served on.
+
+// BrokerLatencyBuckets are the upper bounds in seconds of the buckets of
+// the broker call latency histograms.
+var BrokerLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// retriesKey is the context key of the retry counter of a broker call.
+type retriesKey struct{}
+
+// countRetries returns a copy of the context that counts the retries of
+// the broker call made with it in the returned counter.
+func countRetries(ctx context.Context) (context.Context, *uint64) {
+	retries := new(uint64)
+	return context.WithValue(ctx, retriesKey{}, retries), retries
+}
+
+// addRetry counts a retry of the broker call made with the context.
+func addRetry(ctx context.Context) {
+	if retries, ok := ctx.Value(retriesKey{}).(*uint64); ok {
+		atomic.AddUint64(retries, 1)
+	}
+}
+
+// brokerSeries identifies the metrics of the calls of a method to a host.
+type brokerSeries struct {
+	host   string
+	method string
+}
+
+// brokerStats are the metrics of the calls of a method to a host.
+type brokerStats struct {
+	requests uint64
+	failures uint64
+	retries  uint64
+	buckets  []uint64
+	sum      float64
+}
+
+// MetricsBroker is a service broker that records the number, failures,
+// retries and latency of the calls of the wrapped broker per host and
+// method, and whether each host was reachable on its last call. All methods
+// are safe for concurrent use.
+type MetricsBroker struct {
+	broker ServiceBroker
+	mu     sync.Mutex
+	stats  map[brokerSeries]*brokerStats
+	up     map[string]bool
+}
+
+// NewMetricsBroker creates a new metrics broker that passes the calls to
+// the provided broker.
+func NewMetricsBroker(broker ServiceBroker) *MetricsBroker {
+	return &MetricsBroker{
+		broker: broker,
+		stats:  make(map[brokerSeries]*brokerStats),
+		up:     make(map[string]bool),
+	}
+}
+
+// Call passes the call to the wrapped broker and records its metrics.
+func (b *MetricsBroker) Call(ctx context.Context, host string, method string, params map[string]interface{}) (interface{}, *jrpc2.ErrorObject) {
+	ctx, retries := countRetries(ctx)
+	start := time.Now()
+	result, errObj := b.broker.Call(ctx, host, method, params)
+	b.record(host, method, time.Since(start), atomic.LoadUint64(retries), errObj)
+	return result, errObj
+}
+
+// BatchCall passes the calls to the wrapped broker and records the
+// metrics of the batch with the batch method.
+func (b *MetricsBroker) BatchCall(ctx context.Context, host string, calls []BrokerCall) ([]BrokerResult, *jrpc2.ErrorObject) {
+	ctx, retries := countRetries(ctx)
+	start := time.Now()
+	results, errObj := batchCall(ctx, b.broker, host, calls)
+	b.record(host, "batch", time.Since(start), atomic.LoadUint64(retries), errObj)
+	return results, errObj
+}
+
+// record adds the call of the method to the host to the metrics. A call
+// fails if it fails in transport or is rejected by the service, and the
+// host is down after a call failed in transport.
+func (b *MetricsBroker) record(host string, method string, elapsed time.Duration, retries uint64, errObj *jrpc2.ErrorObject) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	series := brokerSeries{host, method}
+	stats, ok := b.stats[series]
+	if !ok {
+		stats = &brokerStats{buckets: make([]uint64, len(BrokerLatencyBuckets))}
+		b.stats[series] = stats
+	}
+	stats.requests++
+	stats.retries += retries
+	if errObj != nil && (errObj.Code == BrokerCallErrorCode || errObj.Code == BrokerRejectedErrorCode) {
+		stats.failures++
+	}
+	seconds := elapsed.Seconds()
+	stats.sum += seconds
+	for i, bound := range BrokerLatencyBuckets {
+		if seconds <= bound {
+			stats.buckets[i]++
+		}
+	}
+	b.up[host] = errObj == nil || errObj.Code != BrokerCallErrorCode
+}
+
+// ServeHTTP writes the metrics in the prometheus text format.
+func (b *MetricsBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.Metrics()))
+}
+
+// Metrics returns the metrics in the prometheus text format, sorted by
+// host and method.
+func (b *MetricsBroker) Metrics() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	series := make([]brokerSeries, 0, len(b.stats))
+	for s := range b.stats {
+		series = append(series, s)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].host != series[j].host {
+			return series[i].host < series[j].host
+		}
+		return series[i].method < series[j].method
+	})
+	hosts := make([]string, 0, len(b.up))
+	for host := range b.up {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var out strings.Builder
+	counters := []struct {
+		name  string
+		help  string
+		value func(*brokerStats) uint64
+	}{
+		{"concord_broker_requests_total", "The number of calls to the service.", func(s *brokerStats) uint64 { return s.requests }},
+		{"concord_broker_failures_total", "The number of calls to the service that failed in transport or were rejected.", func(s *brokerStats) uint64 { return s.failures }},
+		{"concord_broker_retries_total", "The number of retried call attempts to the service.", func(s *brokerStats) uint64 { return s.retries }},
+	}
+	for _, counter := range counters {
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+		for _, s := range series {
+			fmt.Fprintf(&out, "%s{%s} %d\n", counter.name, s.labels(), counter.value(b.stats[s]))
+		}
+	}
+	out.WriteString("# HELP concord_broker_request_duration_seconds The latency of the calls to the service.\n")
+	out.WriteString("# TYPE concord_broker_request_duration_seconds histogram\n")
+	for _, s := range series {
+		stats := b.stats[s]
+		for i, bound := range BrokerLatencyBuckets {
+			fmt.Fprintf(&out, "concord_broker_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n", s.labels(), bound, stats.buckets[i])
+		}
+		fmt.Fprintf(&out, "concord_broker_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", s.labels(), stats.requests)
+		fmt.Fprintf(&out, "concord_broker_request_duration_seconds_sum{%s} %g\n", s.labels(), stats.sum)
+		fmt.Fprintf(&out, "concord_broker_request_duration_seconds_count{%s} %d\n", s.labels(), stats.requests)
+	}
+	out.WriteString("# HELP concord_broker_up Whether the last call to the service did not fail in transport.\n")
+	out.WriteString("# TYPE concord_broker_up gauge\n")
+	for _, host := range hosts {
+		up := 0
+		if b.up[host] {
+			up = 1
+		}
+		fmt.Fprintf(&out, "concord_broker_up{host=%q} %d\n", host, up)
+	}
+	return out.String()
+}
+
+// labels returns the prometheus labels of the series.
+func (s brokerSeries) labels() string {
+	return fmt.Sprintf("host=%q,method=%q", s.host, s.method)
+}
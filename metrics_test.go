@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsBrokerCall(t *testing.T) {
+	defer func(n int, d time.Duration) { BrokerRetries, BrokerBackoff = n, d }(BrokerRetries, BrokerBackoff)
+	BrokerRetries, BrokerBackoff = 2, time.Millisecond
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts++; attempts == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"jsonrpc": "2.0", "result": 0, "id": 0}`))
+	}))
+	defer srv.Close()
+	url := strings.TrimPrefix(srv.URL, "http://")
+
+	broker := NewMetricsBroker(NewJsonRPCServiceBroker())
+	broker.Call(context.Background(), url, "get", nil)
+	broker.Call(context.Background(), url, "get", nil)
+	broker.BatchCall(context.Background(), url, []BrokerCall{{"push", nil}})
+	down := NewMetricsBroker(&endpointBroker{down: map[string]bool{"queue:8080": true}})
+	down.Call(context.Background(), "queue:8080", "pop", nil)
+
+	expected := []string{
+		`concord_broker_requests_total{host="` + url + `",method="get"} 2`,
+		`concord_broker_requests_total{host="` + url + `",method="batch"} 1`,
+		`concord_broker_retries_total{host="` + url + `",method="get"} 1`,
+		`concord_broker_failures_total{host="` + url + `",method="get"} 0`,
+		`concord_broker_request_duration_seconds_bucket{host="` + url + `",method="get",le="+Inf"} 2`,
+		`concord_broker_request_duration_seconds_count{host="` + url + `",method="get"} 2`,
+		`concord_broker_up{host="` + url + `"} 1`,
+	}
+	metrics := broker.Metrics()
+	for _, line := range expected {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Fatalf("expected the metrics to contain %s, got\n%s", line, metrics)
+		}
+	}
+	for _, line := range []string{
+		`concord_broker_failures_total{host="queue:8080",method="pop"} 1`,
+		`concord_broker_up{host="queue:8080"} 0`,
+	} {
+		if !strings.Contains(down.Metrics(), line+"\n") {
+			t.Fatalf("expected the metrics to contain %s, got\n%s", line, down.Metrics())
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	broker.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, MetricsRoute, nil))
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") || rec.Body.String() != metrics {
+		t.Fatalf("expected the metrics to be served as text, got %s", rec.Header().Get("Content-Type"))
+	}
+}
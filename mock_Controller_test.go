@@ -1,6 +1,8 @@
 // Code generated by mockery v1.0.0
 package main
 
+import json "encoding/json"
+import time "time"
 import mock "github.com/stretchr/testify/mock"
 
 // MockController is an autogenerated mock type for the Controller type
@@ -8,13 +10,27 @@ type MockController struct {
 	mock.Mock
 }
 
-// AddResource provides a mock function with given fields: _a0, _a1
-func (_m *MockController) AddResource(_a0 string, _a1 Model) error {
-	ret := _m.Called(_a0, _a1)
+// AcknowledgePreemption provides a mock function with given fields: _a0, _a1, _a2
+func (_m *MockController) AcknowledgePreemption(_a0 string, _a1 Model, _a2 Model) error {
+	ret := _m.Called(_a0, _a1, _a2)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string, Model) error); ok {
-		r0 = rf(_a0, _a1)
+	if rf, ok := ret.Get(0).(func(string, Model, Model) error); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// AddResource provides a mock function with given fields: _a0, _a1, _a2, _a3, _a4
+func (_m *MockController) AddResource(_a0 string, _a1 string, _a2 map[string]string, _a3 float64, _a4 Model) error {
+	ret := _m.Called(_a0, _a1, _a2, _a3, _a4)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, string, map[string]string, float64, Model) error); ok {
+		r0 = rf(_a0, _a1, _a2, _a3, _a4)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -36,13 +52,13 @@ func (_m *MockController) AddTask(_a0 *Task, _a1 Model, _a2 Model) error {
 	return r0
 }
 
-// CompleteTask provides a mock function with given fields: _a0, _a1, _a2, _a3
-func (_m *MockController) CompleteTask(_a0 string, _a1 string, _a2 Model, _a3 Model) error {
-	ret := _m.Called(_a0, _a1, _a2, _a3)
+// AppendTaskLog provides a mock function with given fields: _a0, _a1, _a2, _a3, _a4
+func (_m *MockController) AppendTaskLog(_a0 string, _a1 string, _a2 string, _a3 Model, _a4 Model) error {
+	ret := _m.Called(_a0, _a1, _a2, _a3, _a4)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string, string, Model, Model) error); ok {
-		r0 = rf(_a0, _a1, _a2, _a3)
+	if rf, ok := ret.Get(0).(func(string, string, string, Model, Model) error); ok {
+		r0 = rf(_a0, _a1, _a2, _a3, _a4)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -50,16 +66,104 @@ func (_m *MockController) CompleteTask(_a0 string, _a1 string, _a2 Model, _a3 Mo
 	return r0
 }
 
-// GetTask provides a mock function with given fields: _a0, _a1
-func (_m *MockController) GetTask(_a0 string, _a1 Model) (*Task, error) {
+// CompleteTask provides a mock function with given fields: _a0, _a1, _a2, _a3, _a4, _a5, _a6
+func (_m *MockController) CompleteTask(_a0 string, _a1 string, _a2 json.RawMessage, _a3 string, _a4 bool, _a5 Model, _a6 Model) error {
+	ret := _m.Called(_a0, _a1, _a2, _a3, _a4, _a5, _a6)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, string, json.RawMessage, string, bool, Model, Model) error); ok {
+		r0 = rf(_a0, _a1, _a2, _a3, _a4, _a5, _a6)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// CountTasks provides a mock function with given fields: _a0, _a1
+func (_m *MockController) CountTasks(_a0 bool, _a1 Model) ([]*TaskCount, error) {
 	ret := _m.Called(_a0, _a1)
 
-	var r0 *Task
-	if rf, ok := ret.Get(0).(func(string, Model) *Task); ok {
+	var r0 []*TaskCount
+	if rf, ok := ret.Get(0).(func(bool, Model) []*TaskCount); ok {
 		r0 = rf(_a0, _a1)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).(*Task)
+			r0 = ret.Get(0).([]*TaskCount)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(bool, Model) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// EstimateStart provides a mock function with given fields: _a0, _a1, _a2
+func (_m *MockController) EstimateStart(_a0 string, _a1 Model, _a2 Model) (*StartEstimate, error) {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 *StartEstimate
+	if rf, ok := ret.Get(0).(func(string, Model, Model) *StartEstimate); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*StartEstimate)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, Model, Model) error); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ExportTasks provides a mock function with given fields: _a0, _a1, _a2, _a3, _a4
+func (_m *MockController) ExportTasks(_a0 string, _a1 string, _a2 map[string]string, _a3 Model, _a4 func(*Task) error) error {
+	ret := _m.Called(_a0, _a1, _a2, _a3, _a4)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, string, map[string]string, Model, func(*Task) error) error); ok {
+		r0 = rf(_a0, _a1, _a2, _a3, _a4)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ForceCompleteTask provides a mock function with given fields: _a0, _a1, _a2, _a3, _a4
+func (_m *MockController) ForceCompleteTask(_a0 string, _a1 string, _a2 string, _a3 Model, _a4 Model) error {
+	ret := _m.Called(_a0, _a1, _a2, _a3, _a4)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, string, string, Model, Model) error); ok {
+		r0 = rf(_a0, _a1, _a2, _a3, _a4)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// GetGroupStatus provides a mock function with given fields: _a0, _a1
+func (_m *MockController) GetGroupStatus(_a0 string, _a1 Model) (*GroupStatus, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 *GroupStatus
+	if rf, ok := ret.Get(0).(func(string, Model) *GroupStatus); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*GroupStatus)
 		}
 	}
 
@@ -73,16 +177,16 @@ func (_m *MockController) GetTask(_a0 string, _a1 Model) (*Task, error) {
 	return r0, r1
 }
 
-// ListPriorityQueue provides a mock function with given fields: _a0
-func (_m *MockController) ListPriorityQueue(_a0 string) (map[string]interface{}, error) {
+// GetResource provides a mock function with given fields: _a0
+func (_m *MockController) GetResource(_a0 string) (*ResourceDetail, error) {
 	ret := _m.Called(_a0)
 
-	var r0 map[string]interface{}
-	if rf, ok := ret.Get(0).(func(string) map[string]interface{}); ok {
+	var r0 *ResourceDetail
+	if rf, ok := ret.Get(0).(func(string) *ResourceDetail); ok {
 		r0 = rf(_a0)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).(map[string]interface{})
+			r0 = ret.Get(0).(*ResourceDetail)
 		}
 	}
 
@@ -96,16 +200,39 @@ func (_m *MockController) ListPriorityQueue(_a0 string) (map[string]interface{},
 	return r0, r1
 }
 
-// ListTimetable provides a mock function with given fields: _a0
-func (_m *MockController) ListTimetable(_a0 string) (map[string]interface{}, error) {
+// GetResourceStats provides a mock function with given fields: _a0, _a1, _a2
+func (_m *MockController) GetResourceStats(_a0 string, _a1 []time.Duration, _a2 Model) (*ResourceStats, error) {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 *ResourceStats
+	if rf, ok := ret.Get(0).(func(string, []time.Duration, Model) *ResourceStats); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*ResourceStats)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, []time.Duration, Model) error); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetStagedTask provides a mock function with given fields: _a0
+func (_m *MockController) GetStagedTask(_a0 string) (*StagedTask, error) {
 	ret := _m.Called(_a0)
 
-	var r0 map[string]interface{}
-	if rf, ok := ret.Get(0).(func(string) map[string]interface{}); ok {
+	var r0 *StagedTask
+	if rf, ok := ret.Get(0).(func(string) *StagedTask); ok {
 		r0 = rf(_a0)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).(map[string]interface{})
+			r0 = ret.Get(0).(*StagedTask)
 		}
 	}
 
@@ -119,49 +246,646 @@ func (_m *MockController) ListTimetable(_a0 string) (map[string]interface{}, err
 	return r0, r1
 }
 
-// Notify provides a mock function with given fields: _a0
-func (_m *MockController) Notify(_a0 *Event) error {
-	ret := _m.Called(_a0)
+// GetTask provides a mock function with given fields: _a0, _a1
+func (_m *MockController) GetTask(_a0 string, _a1 Model) (*Task, error) {
+	ret := _m.Called(_a0, _a1)
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(*Event) error); ok {
-		r0 = rf(_a0)
+	var r0 *Task
+	if rf, ok := ret.Get(0).(func(string, Model) *Task); ok {
+		r0 = rf(_a0, _a1)
 	} else {
-		r0 = ret.Error(0)
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*Task)
+		}
 	}
 
-	return r0
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, Model) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
 }
 
-// RemoveTask provides a mock function with given fields: _a0, _a1
-func (_m *MockController) RemoveTask(_a0 string, _a1 Model) error {
+// GetTaskHistory provides a mock function with given fields: _a0, _a1
+func (_m *MockController) GetTaskHistory(_a0 string, _a1 Model) ([]*TaskHistory, error) {
 	ret := _m.Called(_a0, _a1)
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(string, Model) error); ok {
+	var r0 []*TaskHistory
+	if rf, ok := ret.Get(0).(func(string, Model) []*TaskHistory); ok {
 		r0 = rf(_a0, _a1)
 	} else {
-		r0 = ret.Error(0)
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*TaskHistory)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, Model) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetTaskLog provides a mock function with given fields: _a0, _a1
+func (_m *MockController) GetTaskLog(_a0 string, _a1 Model) ([]*TaskLog, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 []*TaskLog
+	if rf, ok := ret.Get(0).(func(string, Model) []*TaskLog); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*TaskLog)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, Model) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetTaskStats provides a mock function with given fields: _a0, _a1
+func (_m *MockController) GetTaskStats(_a0 string, _a1 Model) (*TaskStats, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 *TaskStats
+	if rf, ok := ret.Get(0).(func(string, Model) *TaskStats); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*TaskStats)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, Model) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Health provides a mock function with given fields:
+func (_m *MockController) Health() map[string]*DependencyStatus {
+	ret := _m.Called()
+
+	var r0 map[string]*DependencyStatus
+	if rf, ok := ret.Get(0).(func() map[string]*DependencyStatus); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(map[string]*DependencyStatus)
+		}
 	}
 
 	return r0
 }
 
-// StageTask provides a mock function with given fields: _a0, _a1, _a2
-func (_m *MockController) StageTask(_a0 *Task, _a1 Model, _a2 bool) {
-	_m.Called(_a0, _a1, _a2)
+// Heartbeat provides a mock function with given fields: _a0, _a1
+func (_m *MockController) Heartbeat(_a0 string, _a1 Model) (time.Time, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 time.Time
+	if rf, ok := ret.Get(0).(func(string, Model) time.Time); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Get(0).(time.Time)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, Model) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
 }
 
-// StartTask provides a mock function with given fields: _a0, _a1, _a2
-func (_m *MockController) StartTask(_a0 string, _a1 Model, _a2 Model) error {
+// ListFailedEvents provides a mock function with given fields: _a0, _a1, _a2
+func (_m *MockController) ListFailedEvents(_a0 string, _a1 int, _a2 Model) ([]*FailedEvent, error) {
 	ret := _m.Called(_a0, _a1, _a2)
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(string, Model, Model) error); ok {
+	var r0 []*FailedEvent
+	if rf, ok := ret.Get(0).(func(string, int, Model) []*FailedEvent); ok {
 		r0 = rf(_a0, _a1, _a2)
 	} else {
-		r0 = ret.Error(0)
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*FailedEvent)
+		}
 	}
 
-	return r0
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, int, Model) error); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListPriorityQueue provides a mock function with given fields: _a0
+func (_m *MockController) ListPriorityQueue(_a0 string) (map[string]interface{}, error) {
+	ret := _m.Called(_a0)
+
+	var r0 map[string]interface{}
+	if rf, ok := ret.Get(0).(func(string) map[string]interface{}); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(map[string]interface{})
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(_a0)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListResources provides a mock function with given fields: _a0
+func (_m *MockController) ListResources(_a0 Model) ([]*Resource, error) {
+	ret := _m.Called(_a0)
+
+	var r0 []*Resource
+	if rf, ok := ret.Get(0).(func(Model) []*Resource); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*Resource)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(Model) error); ok {
+		r1 = rf(_a0)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListStagedTasks provides a mock function with given fields: _a0
+func (_m *MockController) ListStagedTasks(_a0 string) ([]*StagedTask, error) {
+	ret := _m.Called(_a0)
+
+	var r0 []*StagedTask
+	if rf, ok := ret.Get(0).(func(string) []*StagedTask); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*StagedTask)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(_a0)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListTasks provides a mock function with given fields: _a0, _a1, _a2, _a3, _a4, _a5
+func (_m *MockController) ListTasks(_a0 string, _a1 string, _a2 map[string]string, _a3 int, _a4 int, _a5 Model) (*TaskPage, error) {
+	ret := _m.Called(_a0, _a1, _a2, _a3, _a4, _a5)
+
+	var r0 *TaskPage
+	if rf, ok := ret.Get(0).(func(string, string, map[string]string, int, int, Model) *TaskPage); ok {
+		r0 = rf(_a0, _a1, _a2, _a3, _a4, _a5)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*TaskPage)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, string, map[string]string, int, int, Model) error); ok {
+		r1 = rf(_a0, _a1, _a2, _a3, _a4, _a5)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListTimetable provides a mock function with given fields: _a0
+func (_m *MockController) ListTimetable(_a0 string) (map[string]interface{}, error) {
+	ret := _m.Called(_a0)
+
+	var r0 map[string]interface{}
+	if rf, ok := ret.Get(0).(func(string) map[string]interface{}); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(map[string]interface{})
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(_a0)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Notify provides a mock function with given fields: _a0
+func (_m *MockController) Notify(_a0 *Event) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*Event) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// PauseResource provides a mock function with given fields: _a0, _a1
+func (_m *MockController) PauseResource(_a0 string, _a1 Model) error {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, Model) error); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// PauseTask provides a mock function with given fields: _a0, _a1
+func (_m *MockController) PauseTask(_a0 string, _a1 Model) error {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, Model) error); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// PurgeTasks provides a mock function with given fields: _a0, _a1, _a2
+func (_m *MockController) PurgeTasks(_a0 time.Duration, _a1 int, _a2 Model) (int, error) {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func(time.Duration, int, Model) int); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(time.Duration, int, Model) error); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// RegisterResource provides a mock function with given fields: _a0, _a1, _a2, _a3, _a4
+func (_m *MockController) RegisterResource(_a0 string, _a1 map[string]string, _a2 int, _a3 Model, _a4 Model) ([]string, error) {
+	ret := _m.Called(_a0, _a1, _a2, _a3, _a4)
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func(string, map[string]string, int, Model, Model) []string); ok {
+		r0 = rf(_a0, _a1, _a2, _a3, _a4)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, map[string]string, int, Model, Model) error); ok {
+		r1 = rf(_a0, _a1, _a2, _a3, _a4)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// RemoveResource provides a mock function with given fields: _a0, _a1, _a2
+func (_m *MockController) RemoveResource(_a0 string, _a1 Model, _a2 Model) error {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, Model, Model) error); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RemoveTask provides a mock function with given fields: _a0, _a1, _a2, _a3
+func (_m *MockController) RemoveTask(_a0 string, _a1 string, _a2 Model, _a3 Model) error {
+	ret := _m.Called(_a0, _a1, _a2, _a3)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, string, Model, Model) error); ok {
+		r0 = rf(_a0, _a1, _a2, _a3)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RescheduleTask provides a mock function with given fields: _a0, _a1, _a2
+func (_m *MockController) RescheduleTask(_a0 string, _a1 time.Time, _a2 Model) error {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, time.Time, Model) error); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ResourceHeartbeat provides a mock function with given fields: _a0, _a1
+func (_m *MockController) ResourceHeartbeat(_a0 string, _a1 Model) error {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, Model) error); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RestoreResource provides a mock function with given fields: _a0, _a1, _a2
+func (_m *MockController) RestoreResource(_a0 *Resource, _a1 Model, _a2 Model) error {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*Resource, Model, Model) error); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RestoreStagedTask provides a mock function with given fields: _a0, _a1
+func (_m *MockController) RestoreStagedTask(_a0 *Task, _a1 Model) error {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*Task, Model) error); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RestoreTask provides a mock function with given fields: _a0, _a1, _a2, _a3
+func (_m *MockController) RestoreTask(_a0 string, _a1 Model, _a2 Model, _a3 Model) error {
+	ret := _m.Called(_a0, _a1, _a2, _a3)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, Model, Model, Model) error); ok {
+		r0 = rf(_a0, _a1, _a2, _a3)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ResumeResource provides a mock function with given fields: _a0, _a1
+func (_m *MockController) ResumeResource(_a0 string, _a1 Model) error {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, Model) error); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ResumeTask provides a mock function with given fields: _a0, _a1
+func (_m *MockController) ResumeTask(_a0 string, _a1 Model) error {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, Model) error); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RetryTask provides a mock function with given fields: _a0, _a1
+func (_m *MockController) RetryTask(_a0 string, _a1 Model) error {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, Model) error); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SearchTasks provides a mock function with given fields: _a0, _a1, _a2, _a3, _a4
+func (_m *MockController) SearchTasks(_a0 map[string]interface{}, _a1 map[string]string, _a2 int, _a3 int, _a4 Model) (*TaskPage, error) {
+	ret := _m.Called(_a0, _a1, _a2, _a3, _a4)
+
+	var r0 *TaskPage
+	if rf, ok := ret.Get(0).(func(map[string]interface{}, map[string]string, int, int, Model) *TaskPage); ok {
+		r0 = rf(_a0, _a1, _a2, _a3, _a4)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*TaskPage)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(map[string]interface{}, map[string]string, int, int, Model) error); ok {
+		r1 = rf(_a0, _a1, _a2, _a3, _a4)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ServerInfo provides a mock function with given fields:
+func (_m *MockController) ServerInfo() *ServerInfo {
+	ret := _m.Called()
+
+	var r0 *ServerInfo
+	if rf, ok := ret.Get(0).(func() *ServerInfo); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*ServerInfo)
+		}
+	}
+
+	return r0
+}
+
+// SetResourceParent provides a mock function with given fields: _a0, _a1, _a2
+func (_m *MockController) SetResourceParent(_a0 string, _a1 string, _a2 Model) error {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, string, Model) error); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SetResourceQuota provides a mock function with given fields: _a0, _a1, _a2
+func (_m *MockController) SetResourceQuota(_a0 string, _a1 *ResourceQuota, _a2 Model) error {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, *ResourceQuota, Model) error); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SetResourceWeight provides a mock function with given fields: _a0, _a1, _a2
+func (_m *MockController) SetResourceWeight(_a0 string, _a1 float64, _a2 Model) error {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, float64, Model) error); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// StageTask provides a mock function with given fields: _a0, _a1, _a2
+func (_m *MockController) StageTask(_a0 *Task, _a1 Model, _a2 bool) {
+	_m.Called(_a0, _a1, _a2)
+}
+
+// StartTask provides a mock function with given fields: _a0, _a1, _a2, _a3
+func (_m *MockController) StartTask(_a0 string, _a1 string, _a2 Model, _a3 Model) error {
+	ret := _m.Called(_a0, _a1, _a2, _a3)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, string, Model, Model) error); ok {
+		r0 = rf(_a0, _a1, _a2, _a3)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// UnstageTask provides a mock function with given fields: _a0, _a1
+func (_m *MockController) UnstageTask(_a0 string, _a1 Model) error {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, Model) error); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// UpdateTaskPriority provides a mock function with given fields: _a0, _a1, _a2
+func (_m *MockController) UpdateTaskPriority(_a0 string, _a1 float64, _a2 Model) error {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, float64, Model) error); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ValidateTask provides a mock function with given fields: _a0, _a1
+func (_m *MockController) ValidateTask(_a0 *Task, _a1 Model) (*TaskValidation, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 *TaskValidation
+	if rf, ok := ret.Get(0).(func(*Task, Model) *TaskValidation); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*TaskValidation)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(*Task, Model) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
 }
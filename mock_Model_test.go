@@ -45,6 +45,29 @@ func (_m *MockModel) FetchAll() ([]interface{}, error) {
 	return r0, r1
 }
 
+// Get provides a mock function with given fields: _a0
+func (_m *MockModel) Get(_a0 string) (interface{}, error) {
+	ret := _m.Called(_a0)
+
+	var r0 interface{}
+	if rf, ok := ret.Get(0).(func(string) interface{}); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(interface{})
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(_a0)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // Query provides a mock function with given fields: _a0, _a1
 func (_m *MockModel) Query(_a0 string, _a1 interface{}) ([]interface{}, error) {
 	ret := _m.Called(_a0, _a1)
@@ -68,6 +91,52 @@ func (_m *MockModel) Query(_a0 string, _a1 interface{}) ([]interface{}, error) {
 	return r0, r1
 }
 
+// QueryPage provides a mock function with given fields: _a0, _a1, _a2, _a3
+func (_m *MockModel) QueryPage(_a0 string, _a1 interface{}, _a2 int, _a3 int) (*Page, error) {
+	ret := _m.Called(_a0, _a1, _a2, _a3)
+
+	var r0 *Page
+	if rf, ok := ret.Get(0).(func(string, interface{}, int, int) *Page); ok {
+		r0 = rf(_a0, _a1, _a2, _a3)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*Page)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, interface{}, int, int) error); ok {
+		r1 = rf(_a0, _a1, _a2, _a3)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// QueryStream provides a mock function with given fields: _a0, _a1
+func (_m *MockModel) QueryStream(_a0 string, _a1 interface{}) (DocumentIterator, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 DocumentIterator
+	if rf, ok := ret.Get(0).(func(string, interface{}) DocumentIterator); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(DocumentIterator)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, interface{}) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // Remove provides a mock function with given fields: _a0
 func (_m *MockModel) Remove(_a0 interface{}) error {
 	ret := _m.Called(_a0)
@@ -1,6 +1,7 @@
 // Code generated by mockery v1.0.0
 package main
 
+import context "context"
 import jrpc2 "github.com/bitwurx/jrpc2"
 import mock "github.com/stretchr/testify/mock"
 
@@ -9,13 +10,13 @@ type MockServiceBroker struct {
 	mock.Mock
 }
 
-// Call provides a mock function with given fields: _a0, _a1, _a2
-func (_m *MockServiceBroker) Call(_a0 string, _a1 string, _a2 map[string]interface{}) (interface{}, *jrpc2.ErrorObject) {
-	ret := _m.Called(_a0, _a1, _a2)
+// Call provides a mock function with given fields: _a0, _a1, _a2, _a3
+func (_m *MockServiceBroker) Call(_a0 context.Context, _a1 string, _a2 string, _a3 map[string]interface{}) (interface{}, *jrpc2.ErrorObject) {
+	ret := _m.Called(_a0, _a1, _a2, _a3)
 
 	var r0 interface{}
-	if rf, ok := ret.Get(0).(func(string, string, map[string]interface{}) interface{}); ok {
-		r0 = rf(_a0, _a1, _a2)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, map[string]interface{}) interface{}); ok {
+		r0 = rf(_a0, _a1, _a2, _a3)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(interface{})
@@ -23,8 +24,8 @@ func (_m *MockServiceBroker) Call(_a0 string, _a1 string, _a2 map[string]interfa
 	}
 
 	var r1 *jrpc2.ErrorObject
-	if rf, ok := ret.Get(1).(func(string, string, map[string]interface{}) *jrpc2.ErrorObject); ok {
-		r1 = rf(_a0, _a1, _a2)
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, map[string]interface{}) *jrpc2.ErrorObject); ok {
+		r1 = rf(_a0, _a1, _a2, _a3)
 	} else {
 		if ret.Get(1) != nil {
 			r1 = ret.Get(1).(*jrpc2.ErrorObject)
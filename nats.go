@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+
+	"github.com/bitwurx/jrpc2"
+	"github.com/nats-io/nats.go"
+)
+
+// natsRequester sends nats requests and waits for their reply.
+type natsRequester interface {
+	RequestWithContext(ctx context.Context, subj string, data []byte) (*nats.Msg, error)
+}
+
+// NatsServiceBroker is a json-rpc 2.0 service broker that sends each call
+// as a nats request to the subject named by the host of the service, and
+// reads the json-rpc response from the reply.
+type NatsServiceBroker struct {
+	conn natsRequester
+}
+
+// NewNatsServiceBroker creates a new broker that calls the services
+// through the nats connection.
+func NewNatsServiceBroker(conn *nats.Conn) *NatsServiceBroker {
+	return &NatsServiceBroker{conn}
+}
+
+// ConnectNats connects to the nats server at the url. The connection
+// reconnects without limit when the server is lost.
+func ConnectNats(url string) (*nats.Conn, error) {
+	return nats.Connect(url, nats.Name("concord-controller"), nats.MaxReconnects(-1))
+}
+
+// Call initiates a remote call of the method with parameters to the
+// service subscribed to the subject.
+//
+// Calls are retried like the calls of JsonRPCServiceBroker. A call fails
+// in transport if no service is subscribed to the subject or no reply is
+// received within BrokerTimeout. The requests that no service received
+// are retried for every method.
+func (b *NatsServiceBroker) Call(ctx context.Context, subject string, method string, params map[string]interface{}) (interface{}, *jrpc2.ErrorObject) {
+	req, errObj := jsonRPCRequest(ctx, subject, method, params)
+	if errObj != nil {
+		return nil, errObj
+	}
+	var data []byte
+	errObj = retryCall(ctx, subject, method, func() error {
+		ctx, cancel := context.WithTimeout(ctx, BrokerTimeout)
+		defer cancel()
+		msg, err := b.conn.RequestWithContext(ctx, subject, req)
+		if err == nats.ErrNoResponders {
+			return unsentError{err}
+		} else if err != nil {
+			return err
+		}
+		data = msg.Data
+		return nil
+	})
+	if errObj != nil {
+		return nil, errObj
+	}
+	return jsonRPCResponse(ctx, subject, method, data)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bitwurx/jrpc2"
+	"github.com/nats-io/nats.go"
+)
+
+// stubNatsConn is a nats requester that fails with the errors before it
+// answers the requests with the reply.
+type stubNatsConn struct {
+	errs     []error
+	reply    string
+	subjects []string
+	methods  []string
+}
+
+func (c *stubNatsConn) RequestWithContext(ctx context.Context, subj string, data []byte) (*nats.Msg, error) {
+	var req struct {
+		Method string `json:"method"`
+	}
+	json.Unmarshal(data, &req)
+	c.subjects = append(c.subjects, subj)
+	c.methods = append(c.methods, req.Method)
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		return nil, err
+	}
+	return &nats.Msg{Subject: subj, Data: []byte(c.reply)}, nil
+}
+
+func TestNatsServiceBrokerCall(t *testing.T) {
+	defer func(n int, d time.Duration) { BrokerRetries, BrokerBackoff = n, d }(BrokerRetries, BrokerBackoff)
+	BrokerRetries, BrokerBackoff = 1, time.Millisecond
+
+	var table = []struct {
+		Method string
+		Errs   []error
+		Reply  string
+		Calls  int
+		Result interface{}
+		Code   jrpc2.ErrorCode
+	}{
+		{"push", nil, `{"jsonrpc": "2.0", "result": 0, "id": 0}`, 1, float64(0), 0},
+		{"push", nil, `{"jsonrpc": "2.0", "error": {"code": -32602, "message": "Invalid params"}, "id": 0}`, 1, nil, jrpc2.InvalidParamsCode},
+		{"push", []error{nats.ErrNoResponders}, `{"jsonrpc": "2.0", "result": 0, "id": 0}`, 2, float64(0), 0},
+		{"get", []error{nats.ErrTimeout, nats.ErrTimeout}, "", 2, nil, BrokerCallErrorCode},
+		{"get", []error{nats.ErrTimeout}, `{"jsonrpc": "2.0", "result": 0, "id": 0}`, 2, float64(0), 0},
+		{"push", []error{nats.ErrTimeout}, `{"jsonrpc": "2.0", "result": 0, "id": 0}`, 1, nil, BrokerCallErrorCode},
+	}
+
+	for i, tt := range table {
+		conn := &stubNatsConn{errs: tt.Errs, reply: tt.Reply}
+		broker := &NatsServiceBroker{conn}
+		result, errObj := broker.Call(context.Background(), "concord.priority-queue", tt.Method, map[string]interface{}{"key": "test"})
+		if len(conn.subjects) != tt.Calls {
+			t.Fatalf("[%d] expected %d requests, got %d", i, tt.Calls, len(conn.subjects))
+		}
+		if conn.subjects[0] != "concord.priority-queue" || conn.methods[0] != tt.Method {
+			t.Fatalf("[%d] expected %s on concord.priority-queue, got %s on %s", i, tt.Method, conn.methods[0], conn.subjects[0])
+		}
+		if fmt.Sprint(result) != fmt.Sprint(tt.Result) {
+			t.Fatalf("[%d] expected result %v, got %v", i, tt.Result, result)
+		}
+		if (errObj != nil) != (tt.Code != 0) || (errObj != nil && errObj.Code != tt.Code) {
+			t.Fatalf("[%d] expected error code %d, got %v", i, tt.Code, errObj)
+		}
+	}
+}
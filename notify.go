@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+const (
+	NotifyOverflowDropOldest = "drop-oldest" // drop the oldest queued notification to make room.
+	NotifyOverflowDropNewest = "drop-newest" // drop the notification that does not fit.
+	NotifyOverflowBlock      = "block"       // wait until a queued notification is delivered.
+)
+
+const (
+	FailedEventPending = "pending" // the failed event waits to be redelivered.
+	FailedEventDead    = "dead"    // the failed event exhausted its delivery attempts.
+)
+
+var NotificationDroppedError = errors.New("notification dropped")
+
+// notification is an event queued for the status change notifier service
+// with the context of the operation it was sent in.
+type notification struct {
+	ctx context.Context
+	evt *Event
+}
+
+// FailedEvent is an event the status change notifier service did not
+// accept, stored for redelivery.
+type FailedEvent struct {
+	// Attempts is the number of failed deliveries of the event.
+	// Created is the time the event was first stored.
+	// Error is the error of the last failed delivery.
+	// Event is the undelivered event.
+	// Id is the unique version 1 uuid assigned for event identification.
+	// NextAttemptAt is the time the event is due to be redelivered.
+	// Status is the pending or dead status of the event.
+	// Updated is the time of the last failed delivery.
+	Attempts      int       `json:"attempts"`
+	Created       time.Time `json:"created"`
+	Error         string    `json:"error"`
+	Event         *Event    `json:"event"`
+	Id            string    `json:"_key"`
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+	Status        string    `json:"status"`
+	Updated       time.Time `json:"updated"`
+}
+
+// NewFailedEvent creates a new pending failed event instance for the event
+// whose delivery failed with the provided error.
+func NewFailedEvent(evt *Event, err error) *FailedEvent {
+	id, _ := uuid.NewV1()
+	now := time.Now()
+	return &FailedEvent{1, now, err.Error(), evt, id.String(), now.Add(redeliverBackoff(1)), FailedEventPending, now}
+}
+
+// Fail records another failed delivery of the event. The event is dead
+// once it failed RedeliverAttempts times, and due again after the backoff
+// of its attempts otherwise.
+func (failed *FailedEvent) Fail(err error) {
+	now := time.Now()
+	failed.Attempts++
+	failed.Error = err.Error()
+	failed.Updated = now
+	if failed.Attempts >= RedeliverAttempts {
+		failed.Status = FailedEventDead
+		return
+	}
+	failed.NextAttemptAt = now.Add(redeliverBackoff(failed.Attempts))
+}
+
+// redeliverBackoff returns the delay before the redelivery of an event
+// that failed the provided number of times, which doubles with every
+// attempt up to RedeliverMaxBackoff.
+func redeliverBackoff(attempts int) time.Duration {
+	backoff := RedeliverBackoff
+	for i := 1; i < attempts && backoff < RedeliverMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > RedeliverMaxBackoff {
+		return RedeliverMaxBackoff
+	}
+	return backoff
+}
+
+// NotifyQueue is a bounded queue of the notifications waiting to be
+// delivered to the status change notifier service. The overflow policy
+// decides which notification is dropped when the queue is full. All
+// methods are safe for concurrent use.
+type NotifyQueue struct {
+	overflow string
+	mu       sync.RWMutex
+	closed   bool
+	queue    chan notification
+	dropped  uint64
+}
+
+// NewNotifyQueue creates a new notify queue that holds up to size
+// notifications. Unknown overflow policies drop the oldest notification.
+func NewNotifyQueue(size int, overflow string) *NotifyQueue {
+	if size < 1 {
+		size = 1
+	}
+	return &NotifyQueue{overflow: overflow, queue: make(chan notification, size)}
+}
+
+// Push queues the event sent in the operation of the context. False is
+// returned if the queue is closed, in which case the event must be
+// delivered by the caller.
+//
+// an error is encountered if the event is dropped because the queue is
+// full.
+func (q *NotifyQueue) Push(ctx context.Context, evt *Event) (bool, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return false, nil
+	}
+	n := notification{ctx, evt}
+	for {
+		select {
+		case q.queue <- n:
+			return true, nil
+		default:
+		}
+		switch q.overflow {
+		case NotifyOverflowBlock:
+			q.queue <- n
+			return true, nil
+		case NotifyOverflowDropNewest:
+			q.drop(ctx, evt)
+			return true, NotificationDroppedError
+		}
+		select {
+		case old := <-q.queue:
+			q.drop(old.ctx, old.evt)
+		default:
+		}
+	}
+}
+
+// Len returns the number of queued notifications.
+func (q *NotifyQueue) Len() int {
+	return len(q.queue)
+}
+
+// Dropped returns the number of notifications dropped because the queue
+// was full.
+func (q *NotifyQueue) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+// Close stops the queue from taking notifications. The notifications
+// already queued are still delivered.
+func (q *NotifyQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.queue)
+	}
+}
+
+// drop counts and logs the dropped event.
+func (q *NotifyQueue) drop(ctx context.Context, evt *Event) {
+	atomic.AddUint64(&q.dropped, 1)
+	logf(ctx, "notification queue full, dropped event [%s %s]\n", evt.Kind, string(evt.Meta))
+}
+
+// QueueNotifications makes the controller queue the notifications to the
+// status change notifier service instead of sending them in the calling
+// operation. The queued notifications are delivered by the provided
+// number of workers, in order if there is a single worker, until the
+// controller is shut down.
+func (ctrl *ResourceController) QueueNotifications(queue *NotifyQueue, workers int) {
+	ctrl.notifications = queue
+	for i := 0; i < workers; i++ {
+		ctrl.notifiers.Add(1)
+		go func() {
+			defer ctrl.notifiers.Done()
+			for n := range queue.queue {
+				ctrl.deliverNotification(n.ctx, n.evt)
+			}
+		}()
+	}
+}
+
+// deliverNotification sends the event to the status change notifier
+// service in the operation of the context. Failed sends are retried up to
+// NotifyAttempts times, or until the controller is shut down.
+func (ctrl *ResourceController) deliverNotification(ctx context.Context, evt *Event) {
+	var err error
+	backoff := NotifyBackoff
+	for attempt := 1; attempt <= NotifyAttempts; attempt++ {
+		if err = ctrl.sendNotification(ctx, evt); err == nil {
+			return
+		}
+		logf(ctx, "notification failed [%s %d %s]\n", evt.Kind, attempt, err)
+		if attempt < NotifyAttempts && !sleepContext(ctx, backoff) {
+			break
+		}
+		backoff *= 2
+	}
+	if !ctrl.storeFailedEvent(ctx, evt, err) {
+		logf(ctx, "dropped notification [%s %s]\n", evt.Kind, string(evt.Meta))
+	}
+}
+
+// StoreFailedEvents enables the storing of the notifications that could
+// not be delivered using the provided failed event model, from which they
+// are redelivered.
+func (ctrl *ResourceController) StoreFailedEvents(eventModel Model) {
+	ctrl.failedEvents = eventModel
+}
+
+// storeFailedEvent stores the event whose delivery failed with the
+// provided error for redelivery. False is returned if failed events are
+// not stored or the event could not be saved.
+func (ctrl *ResourceController) storeFailedEvent(ctx context.Context, evt *Event, err error) bool {
+	if ctrl.failedEvents == nil {
+		return false
+	}
+	if _, err := ctrl.failedEvents.Save(NewFailedEvent(evt, err)); err != nil {
+		logln(ctx, err)
+		return false
+	}
+	logf(ctx, "stored failed notification [%s %s]\n", evt.Kind, string(evt.Meta))
+	return true
+}
+
+// RedeliverFailedEvents sends the pending failed events that are due to
+// the status change notifier service in the order they were stored. A
+// delivered event is removed, and an event that fails again is due after
+// a longer backoff or dead once it failed RedeliverAttempts times.
+// Redelivery stops at the first failed event.
+func (ctrl *ResourceController) RedeliverFailedEvents() error {
+	ctx := ctrl.operation()
+	docs, err := queryDueFailedEvents(time.Now(), ctrl.failedEvents)
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		failed := doc.(*FailedEvent)
+		sendErr := ctrl.sendNotification(ctx, failed.Event)
+		if sendErr == nil {
+			if err := ctrl.failedEvents.Remove(failed); err != nil {
+				return err
+			}
+			logf(ctx, "redelivered notification [%s %s]\n", failed.Event.Kind, string(failed.Event.Meta))
+			continue
+		}
+		failed.Fail(sendErr)
+		if _, err := ctrl.failedEvents.Save(failed); err != nil {
+			return err
+		}
+		if failed.Status == FailedEventDead {
+			logf(ctx, "dead notification [%s %s %s]\n", failed.Event.Kind, string(failed.Event.Meta), sendErr)
+		}
+		return sendErr
+	}
+	return nil
+}
+
+// StartRedeliverLoop periodically redelivers the failed events that are
+// due until the context is done.
+func (ctrl *ResourceController) StartRedeliverLoop(ctx context.Context) {
+	for {
+		if err := ctrl.RedeliverFailedEvents(); err != nil {
+			logln(ctx, err)
+		}
+		if !sleepContext(ctx, RedeliverInterval) {
+			return
+		}
+	}
+}
+
+// ListFailedEvents returns up to limit failed events in the order they
+// were stored. The status filter is omitted from the query when empty.
+func (ctrl *ResourceController) ListFailedEvents(status string, limit int, eventModel Model) ([]*FailedEvent, error) {
+	docs, err := queryFailedEvents(status, limit, eventModel)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]*FailedEvent, 0, len(docs))
+	for _, doc := range docs {
+		events = append(events, doc.(*FailedEvent))
+	}
+	return events, nil
+}
+
+// drainNotifications closes the notify queue and waits until the queued
+// notifications are delivered or the context is done.
+func (ctrl *ResourceController) drainNotifications(ctx context.Context) error {
+	if ctrl.notifications == nil {
+		return nil
+	}
+	ctrl.notifications.Close()
+	done := make(chan struct{})
+	go func() {
+		ctrl.notifiers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bitwurx/jrpc2"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestNotifyQueuePush(t *testing.T) {
+	var table = []struct {
+		Overflow string
+		Queued   string
+		Dropped  uint64
+		Err      error
+	}{
+		{NotifyOverflowDropOldest, "[b c]", 1, nil},
+		{"", "[b c]", 1, nil},
+		{NotifyOverflowDropNewest, "[a b]", 1, NotificationDroppedError},
+	}
+
+	for i, tt := range table {
+		q := NewNotifyQueue(2, tt.Overflow)
+		var err error
+		for _, kind := range []string{"a", "b", "c"} {
+			_, err = q.Push(context.Background(), NewEvent(kind, nil))
+		}
+		if err != tt.Err {
+			t.Fatalf("[%d] expected error %v, got %v", i, tt.Err, err)
+		}
+		if q.Dropped() != tt.Dropped {
+			t.Fatalf("[%d] expected %d dropped notifications, got %d", i, tt.Dropped, q.Dropped())
+		}
+		q.Close()
+		kinds := make([]string, 0)
+		for n := range q.queue {
+			kinds = append(kinds, n.evt.Kind)
+		}
+		if fmt.Sprint(kinds) != tt.Queued {
+			t.Fatalf("[%d] expected queued events %s, got %v", i, tt.Queued, kinds)
+		}
+		if queued, _ := q.Push(context.Background(), NewEvent("d", nil)); queued {
+			t.Fatalf("[%d] expected the closed queue not to take events", i)
+		}
+	}
+}
+
+func TestNotifyQueueBlock(t *testing.T) {
+	q := NewNotifyQueue(1, NotifyOverflowBlock)
+	q.Push(context.Background(), NewEvent("a", nil))
+	pushed := make(chan struct{})
+	go func() {
+		q.Push(context.Background(), NewEvent("b", nil))
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("expected the push to wait for room in the queue")
+	case <-time.After(time.Millisecond * 50):
+	}
+	if n := <-q.queue; n.evt.Kind != "a" {
+		t.Fatalf("expected event a, got %s", n.evt.Kind)
+	}
+	<-pushed
+	if q.Len() != 1 || q.Dropped() != 0 {
+		t.Fatalf("expected the blocked event to be queued, got %d queued %d dropped", q.Len(), q.Dropped())
+	}
+}
+
+func TestControllerQueueNotifications(t *testing.T) {
+	var kinds []string
+	broker := new(MockServiceBroker)
+	broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(
+		nil, &jrpc2.ErrorObject{Code: BrokerCallErrorCode, Message: jrpc2.ServerErrorMsg},
+	).Once()
+	broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Run(func(args mock.Arguments) {
+		kinds = append(kinds, args.Get(3).(map[string]interface{})["kind"].(string))
+	}).Return(float64(0), nil)
+	ctrl := NewResourceController(broker)
+	ctrl.QueueNotifications(NewNotifyQueue(NotifyQueueSize, NotifyOverflowDropOldest), 1)
+
+	for _, kind := range []string{"a", "b", "c"} {
+		if err := ctrl.Notify(NewEvent(kind, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := ctrl.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(kinds) != "[a b c]" {
+		t.Fatalf("expected the events to be delivered in order, got %v", kinds)
+	}
+	if err := ctrl.Notify(NewEvent("d", nil)); err != nil || fmt.Sprint(kinds) != "[a b c d]" {
+		t.Fatalf("expected the event to be sent directly after shutdown, got %v %v", err, kinds)
+	}
+}
+
+func TestRedeliverBackoff(t *testing.T) {
+	var table = []struct {
+		Attempts int
+		Backoff  time.Duration
+	}{
+		{1, RedeliverBackoff},
+		{2, RedeliverBackoff * 2},
+		{4, RedeliverBackoff * 8},
+		{20, RedeliverMaxBackoff},
+		{1000, RedeliverMaxBackoff},
+	}
+
+	for i, tt := range table {
+		if backoff := redeliverBackoff(tt.Attempts); backoff != tt.Backoff {
+			t.Fatalf("[%d] expected backoff %s, got %s", i, tt.Backoff, backoff)
+		}
+	}
+}
+
+func TestControllerStoreFailedEvent(t *testing.T) {
+	broker := new(MockServiceBroker)
+	broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(1), nil)
+	eventModel := new(MockModel)
+	eventModel.On("Save", mock.MatchedBy(func(failed *FailedEvent) bool {
+		return failed.Event.Kind == "a" && failed.Attempts == 1 && failed.Status == FailedEventPending &&
+			failed.Error == NotificationFailedError.Error() && failed.NextAttemptAt.After(failed.Created)
+	})).Return(DocumentMeta{}, nil).Once()
+	ctrl := NewResourceController(broker)
+	if err := ctrl.Notify(NewEvent("a", nil)); err != NotificationFailedError {
+		t.Fatalf("expected error %v, got %v", NotificationFailedError, err)
+	}
+	ctrl.StoreFailedEvents(eventModel)
+	if err := ctrl.Notify(NewEvent("a", nil)); err != nil {
+		t.Fatal(err)
+	}
+	eventModel.AssertExpectations(t)
+}
+
+func TestControllerRedeliverFailedEvents(t *testing.T) {
+	var table = []struct {
+		Attempts []int
+		Results  []interface{}
+		Removed  int
+		Statuses string
+		Err      bool
+	}{
+		{[]int{1, 3}, []interface{}{float64(0), float64(0)}, 2, "[]", false},
+		{[]int{1, 3}, []interface{}{float64(0), float64(1)}, 1, fmt.Sprintf("[%s]", FailedEventPending), true},
+		{[]int{RedeliverAttempts - 1, 1}, []interface{}{float64(1)}, 0, fmt.Sprintf("[%s]", FailedEventDead), true},
+	}
+
+	for i, tt := range table {
+		docs := make([]interface{}, len(tt.Attempts))
+		for j, attempts := range tt.Attempts {
+			failed := NewFailedEvent(NewEvent(fmt.Sprint(j), nil), NotificationFailedError)
+			failed.Attempts = attempts
+			docs[j] = failed
+		}
+		broker := new(MockServiceBroker)
+		for _, result := range tt.Results {
+			broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(result, nil).Once()
+		}
+		removed := 0
+		statuses := make([]string, 0)
+		eventModel := new(MockModel)
+		eventModel.On("Query", mock.Anything, mock.Anything).Return(docs, nil)
+		eventModel.On("Remove", mock.Anything).Run(func(args mock.Arguments) { removed++ }).Return(nil)
+		eventModel.On("Save", mock.Anything).Run(func(args mock.Arguments) {
+			failed := args.Get(0).(*FailedEvent)
+			statuses = append(statuses, failed.Status)
+			if failed.Status == FailedEventPending && failed.NextAttemptAt.Sub(failed.Updated) != redeliverBackoff(failed.Attempts) {
+				t.Fatalf("[%d] expected backoff %s, got %s", i, redeliverBackoff(failed.Attempts), failed.NextAttemptAt.Sub(failed.Updated))
+			}
+		}).Return(DocumentMeta{}, nil)
+		ctrl := NewResourceController(broker)
+		ctrl.StoreFailedEvents(eventModel)
+
+		err := ctrl.RedeliverFailedEvents()
+		if (err != nil) != tt.Err {
+			t.Fatalf("[%d] expected error %v, got %v", i, tt.Err, err)
+		}
+		if removed != tt.Removed {
+			t.Fatalf("[%d] expected %d removed events, got %d", i, tt.Removed, removed)
+		}
+		if fmt.Sprint(statuses) != tt.Statuses {
+			t.Fatalf("[%d] expected saved statuses %s, got %v", i, tt.Statuses, statuses)
+		}
+		broker.AssertExpectations(t)
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	arango "github.com/arangodb/go-driver"
+	_ "github.com/lib/pq"
+	"github.com/satori/go.uuid"
+)
+
+var (
+	DocumentNotFoundError = errors.New("document not found")
+	UnsupportedQueryError = errors.New("unsupported query")
+)
+
+// postgresIndexes are the indexed document attributes of the postgresql
+// tables, which serve the filters and sorts of the task queries.
+var postgresIndexes = map[string][][]string{
+	CollectionFailedEvents:  {{"status"}, {"created"}},
+	CollectionResourceStats: {{"resource", "ended"}},
+	CollectionTaskHistory:   {{"taskId"}},
+	CollectionTaskLogs:      {{"taskId", "created"}},
+	CollectionTaskStats:     {{"key", "created"}},
+	CollectionTasks:         {{"status"}, {"key"}, {"created"}, {"parentId"}},
+	CollectionTasksArchive:  {{"removedAt"}},
+}
+
+// PostgresStorage is the storage backend that stores each collection in a
+// postgresql table of json documents by key. The models run the sql
+// statements of the typed queries, and do not support AQL queries.
+type PostgresStorage struct {
+	url string
+	db  *sql.DB
+}
+
+// NewPostgresStorage creates a new postgresql storage instance for the
+// database at the connection url.
+func NewPostgresStorage(url string) *PostgresStorage {
+	return &PostgresStorage{url: url}
+}
+
+// Init connects to the postgresql database and creates the tables of the
+// collections. The connection is retried with connectRetry.
+//
+// an error is encountered if the database could not be connected or a
+// table could not be created.
+func (s *PostgresStorage) Init() error {
+	opened, err := sql.Open("postgres", s.url)
+	if err != nil {
+		return err
+	}
+	db := sql.OpenDB(&availabilityConnector{opened.Driver(), s.url})
+	s.db = db
+	if err := connectRetry(db.Ping); err != nil {
+		return err
+	}
+	for _, model := range s.Models() {
+		if err := model.Create(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Models returns the postgresql table models by name.
+func (s *PostgresStorage) Models() map[string]Model {
+	return map[string]Model{
+		"deferredCalls": s.model(CollectionDeferredCalls, func() interface{} { return new(DeferredCall) }),
+		"failedEvents":  s.model(CollectionFailedEvents, func() interface{} { return new(FailedEvent) }),
+		"resourceStats": s.model(CollectionResourceStats, func() interface{} { return new(ResourceStat) }),
+		"resources": &PostgresModel{
+			storage: s,
+			table:   CollectionResources,
+			doc:     func() interface{} { return new(Resource) },
+			patch:   func(doc interface{}) interface{} { return resourcePatch(doc.(*Resource)) },
+			touch:   touchResource,
+		},
+		"shardMembers": s.model(CollectionShardMembers, func() interface{} { return new(ShardMember) }),
+		"taskArchive":  s.model(CollectionTasksArchive, func() interface{} { return new(ArchivedTask) }),
+		"taskCounts":   s.model(CollectionTasks, func() interface{} { return new(TaskCount) }),
+		"taskGroups":   s.model(CollectionTaskGroups, func() interface{} { return new(TaskGroup) }),
+		"taskHistory":  s.model(CollectionTaskHistory, func() interface{} { return new(TaskHistory) }),
+		"taskLogs":     s.model(CollectionTaskLogs, func() interface{} { return new(TaskLog) }),
+		"taskStats":    s.model(CollectionTaskStats, func() interface{} { return new(TaskStat) }),
+		"tasks": &PostgresModel{
+			storage: s,
+			table:   CollectionTasks,
+			doc:     func() interface{} { return new(Task) },
+			patch:   func(doc interface{}) interface{} { return taskPatch(doc.(*Task)) },
+			touch:   touchTask,
+		},
+	}
+}
+
+// model returns the model of the table whose documents are replaced when
+// they are saved again.
+func (s *PostgresStorage) model(table string, doc func() interface{}) *PostgresModel {
+	return &PostgresModel{storage: s, table: table, doc: doc}
+}
+
+// Name returns the name of the postgresql database.
+func (s *PostgresStorage) Name() string {
+	return StoragePostgres
+}
+
+// Ping checks the connectivity of the postgresql database.
+func (s *PostgresStorage) Ping() error {
+	if s.db == nil {
+		return errors.New("database not initialized")
+	}
+	return s.db.Ping()
+}
+
+// Watch periodically checks the postgresql connection until the context is
+// done. The connection pool reconnects on the next check after the
+// connection was lost.
+func (s *PostgresStorage) Watch(ctx context.Context) {
+	lost := false
+	for sleepContext(ctx, DatabaseWatchInterval) {
+		err := s.Ping()
+		if err != nil && !lost {
+			logf(ctx, "database connection lost [%s]\n", err)
+		} else if err == nil && lost {
+			logf(ctx, "database reconnected\n")
+		}
+		lost = err != nil
+	}
+}
+
+// availabilityConnector opens the connections of the postgresql connection
+// pool. Connections that cannot reach the database fail with
+// StorageUnavailableError, so the models return an error that is
+// distinguishable from a rejected query. Broken connections are replaced
+// by the pool.
+type availabilityConnector struct {
+	driver driver.Driver
+	url    string
+}
+
+// Connect opens a connection to the database.
+func (c *availabilityConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.url)
+	if err != nil && connectionError(err) {
+		logf(ctx, "postgresql connection failed [%s]\n", err)
+		return nil, StorageUnavailableError
+	}
+	return conn, err
+}
+
+// Driver returns the postgresql driver.
+func (c *availabilityConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// UpdateAll applies the updates in a single postgresql transaction, which
+// is rolled back if any update fails. The documents are saved one after
+// the other if one of the models is not a postgresql model.
+func (s *PostgresStorage) UpdateAll(updates []Update) error {
+	models := make([]*PostgresModel, len(updates))
+	for i, update := range updates {
+		model, ok := update.Model.(*PostgresModel)
+		if !ok {
+			return saveAll(updates)
+		}
+		models[i] = model
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for i, update := range updates {
+		if err := models[i].update(tx, update.Doc); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// PostgresModel represents the postgresql table of a collection with a
+// key and a doc column holding the json document.
+type PostgresModel struct {
+	// storage is the storage of the table.
+	// table is the name of the table.
+	// doc returns a new value the documents are read into.
+	// patch returns the fields of an existing document that are updated when
+	// it is saved again, and the document is replaced if it is nil.
+	// touch updates the timestamps and the caller of a document before it
+	// is saved.
+	// ctx is the context the queries of the model are bound to, and whose
+	// caller is recorded by touch.
+	storage *PostgresStorage
+	table   string
+	doc     func() interface{}
+	patch   func(interface{}) interface{}
+	touch   func(interface{}, string)
+	ctx     context.Context
+}
+
+// WithContext returns a copy of the model whose queries are canceled with
+// the context, and whose saves are recorded with the caller of the context.
+func (model *PostgresModel) WithContext(ctx context.Context) Model {
+	bound := *model
+	bound.ctx = ctx
+	return &bound
+}
+
+// Create creates the table and the indexes of its document attributes.
+func (model *PostgresModel) Create() error {
+	db := model.storage.db
+	q := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (key text PRIMARY KEY, doc jsonb NOT NULL)", model.table)
+	if _, err := db.Exec(q); err != nil {
+		return err
+	}
+	for _, fields := range postgresIndexes[model.table] {
+		exprs := make([]string, len(fields))
+		for i, field := range fields {
+			exprs[i] = fmt.Sprintf("(doc -> %s)", quoteSQL(field))
+		}
+		q := fmt.Sprintf(
+			"CREATE INDEX IF NOT EXISTS %s_%s ON %s (%s)",
+			model.table,
+			strings.ToLower(strings.Join(fields, "_")),
+			model.table,
+			strings.Join(exprs, ", "),
+		)
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FetchAll returns all documents of the table.
+func (model *PostgresModel) FetchAll() ([]interface{}, error) {
+	rows, err := model.storage.db.Query(fmt.Sprintf("SELECT doc FROM %s", model.table))
+	if err != nil {
+		return nil, err
+	}
+	return model.read(rows)
+}
+
+// Get returns the document with the key. Nil is returned if the document
+// does not exist.
+func (model *PostgresModel) Get(key string) (interface{}, error) {
+	var data []byte
+	q := fmt.Sprintf("SELECT doc FROM %s WHERE key = $1", model.table)
+	if err := model.storage.db.QueryRow(q, key).Scan(&data); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	doc := model.doc()
+	if err := json.Unmarshal(data, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Query is not supported by the postgresql models, which run the sql
+// statements of the typed queries with QuerySQL instead.
+func (model *PostgresModel) Query(q string, vars interface{}) ([]interface{}, error) {
+	return nil, UnsupportedQueryError
+}
+
+// QueryStream is not supported by the postgresql models, which stream the
+// documents of the typed queries with StreamSQL instead.
+func (model *PostgresModel) QueryStream(q string, vars interface{}) (DocumentIterator, error) {
+	return nil, UnsupportedQueryError
+}
+
+// QueryPage is not supported by the postgresql models, which page the
+// documents of the typed queries with PageSQL instead.
+func (model *PostgresModel) QueryPage(q string, vars interface{}, offset int, limit int) (*Page, error) {
+	return nil, UnsupportedQueryError
+}
+
+// QuerySQL runs the statement, which selects the json documents of the
+// table, and returns the documents. The statement is bound to the context
+// of the model as described by queryContext.
+func (model *PostgresModel) QuerySQL(q string, args ...interface{}) ([]interface{}, error) {
+	ctx, cancel := queryContext(model.ctx)
+	defer cancel()
+	rows, err := model.storage.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	return model.read(rows)
+}
+
+// RemoveSQL runs the delete statement and returns the json documents it
+// returns with RETURNING doc.
+func (model *PostgresModel) RemoveSQL(q string, args ...interface{}) ([]interface{}, error) {
+	return model.QuerySQL(q, args...)
+}
+
+// StreamSQL runs the statement and returns an iterator of the json
+// documents it selects, which are read as the rows are read. The statement
+// is canceled with the context of the model.
+func (model *PostgresModel) StreamSQL(q string, args ...interface{}) (DocumentIterator, error) {
+	ctx := model.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	rows, err := model.storage.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &rowsIterator{rows, model.doc}, nil
+}
+
+// PageSQL returns the page of the documents of the table matching the
+// condition, which matches all documents when empty, in the order. The
+// total is counted in the same statement unless the page is empty. The
+// statements are bound to the context of the model as described by
+// queryContext.
+func (model *PostgresModel) PageSQL(where string, order string, offset int, limit int, args ...interface{}) (*Page, error) {
+	if where != "" {
+		where = " WHERE " + where
+	}
+	ctx, cancel := queryContext(model.ctx)
+	defer cancel()
+	q := fmt.Sprintf("SELECT doc, count(*) OVER () FROM %s%s ORDER BY %s LIMIT %d OFFSET %d", model.table, where, order, limit, offset)
+	rows, err := model.storage.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	page := &Page{Docs: make([]interface{}, 0, limit)}
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data, &page.Total); err != nil {
+			return nil, err
+		}
+		doc := model.doc()
+		if err := json.Unmarshal(data, doc); err != nil {
+			return nil, err
+		}
+		page.Docs = append(page.Docs, doc)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(page.Docs) == 0 {
+		q := fmt.Sprintf("SELECT count(*) FROM %s%s", model.table, where)
+		err = model.storage.db.QueryRowContext(ctx, q, args...).Scan(&page.Total)
+	}
+	return page, err
+}
+
+// Remove deletes the document from the table.
+func (model *PostgresModel) Remove(doc interface{}) error {
+	key, _, err := document(doc)
+	if err != nil {
+		return err
+	}
+	_, err = model.storage.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE key = $1", model.table), key)
+	return err
+}
+
+// Save creates the document in the table, or updates the patched fields
+// of the existing document with the key. A document without a key is given
+// a version 1 uuid key.
+func (model *PostgresModel) Save(doc interface{}) (DocumentMeta, error) {
+	if model.touch != nil {
+		model.touch(doc, Caller(model.ctx))
+	}
+	key, fields, err := document(doc)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	q := fmt.Sprintf(
+		"INSERT INTO %s (key, doc) VALUES ($1, $2::jsonb) ON CONFLICT (key) DO UPDATE SET doc = EXCLUDED.doc",
+		model.table,
+	)
+	args := []interface{}{key, string(data)}
+	if model.patch != nil {
+		patch, err := json.Marshal(model.patch(doc))
+		if err != nil {
+			return DocumentMeta{}, err
+		}
+		q = fmt.Sprintf(
+			"INSERT INTO %s (key, doc) VALUES ($1, $2::jsonb) ON CONFLICT (key) DO UPDATE SET doc = %s.doc || $3::jsonb",
+			model.table,
+			model.table,
+		)
+		args = append(args, string(patch))
+	}
+	if _, err := model.storage.db.Exec(q, args...); err != nil {
+		return DocumentMeta{}, err
+	}
+	return DocumentMeta{Id: arango.DocumentID(model.table + "/" + key)}, nil
+}
+
+// update updates the patched fields of the existing document in the
+// transaction.
+func (model *PostgresModel) update(tx *sql.Tx, doc interface{}) error {
+	if model.touch != nil {
+		model.touch(doc, Caller(model.ctx))
+	}
+	key, fields, err := document(doc)
+	if err != nil {
+		return err
+	}
+	var patch interface{} = fields
+	if model.patch != nil {
+		patch = model.patch(doc)
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	q := fmt.Sprintf("UPDATE %s SET doc = doc || $2::jsonb WHERE key = $1", model.table)
+	result, err := tx.Exec(q, key, string(data))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return DocumentNotFoundError
+	}
+	return nil
+}
+
+// read reads the json documents of the rows.
+func (model *PostgresModel) read(rows *sql.Rows) ([]interface{}, error) {
+	it := &rowsIterator{rows, model.doc}
+	defer it.Close()
+	docs := make([]interface{}, 0)
+	for {
+		doc, err := it.Next()
+		if err == NoMoreDocumentsError {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+}
+
+// rowsIterator is the document iterator of the rows of a query that
+// selects the json documents of a table.
+type rowsIterator struct {
+	rows *sql.Rows
+	doc  func() interface{}
+}
+
+// Next reads the json document of the next row into the value returned by
+// doc.
+func (it *rowsIterator) Next() (interface{}, error) {
+	if !it.rows.Next() {
+		if err := it.rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, NoMoreDocumentsError
+	}
+	var data []byte
+	if err := it.rows.Scan(&data); err != nil {
+		return nil, err
+	}
+	doc := it.doc()
+	if err := json.Unmarshal(data, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Close closes the rows, which returns their connection to the pool.
+func (it *rowsIterator) Close() error {
+	return it.rows.Close()
+}
+
+// document returns the key and the json fields of the document. A version 1
+// uuid key is added to a document without a key.
+func document(doc interface{}) (string, map[string]interface{}, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return "", nil, err
+	}
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return "", nil, err
+	}
+	key, _ := fields["_key"].(string)
+	if key == "" {
+		id, _ := uuid.NewV1()
+		key = id.String()
+		fields["_key"] = key
+	}
+	return key, fields, nil
+}
+
+// quoteSQL returns the string as a sql string literal.
+func quoteSQL(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
@@ -0,0 +1,432 @@
+// The grpc services of the concord priority queue, timetable and status
+// change notifier, as called by the controller with the grpc broker
+// transport.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: proto/concord.proto
+
+package concordpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// TaskRequest identifies a task in the queue or schedule of a resource
+// key. Pop, Next and Get only set the key.
+type TaskRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Key           string                 `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Id            string                 `protobuf:"bytes,2,opt,name=id,proto3" json:"id,omitempty"`
+	Priority      float64                `protobuf:"fixed64,3,opt,name=priority,proto3" json:"priority,omitempty"`
+	RunAt         string                 `protobuf:"bytes,4,opt,name=run_at,json=runAt,proto3" json:"run_at,omitempty"` // RFC 3339
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TaskRequest) Reset() {
+	*x = TaskRequest{}
+	mi := &file_proto_concord_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TaskRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TaskRequest) ProtoMessage() {}
+
+func (x *TaskRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_concord_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TaskRequest.ProtoReflect.Descriptor instead.
+func (*TaskRequest) Descriptor() ([]byte, []int) {
+	return file_proto_concord_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *TaskRequest) GetKey() string {
+	if x != nil {
+		return x.Key
+	}
+	return ""
+}
+
+func (x *TaskRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *TaskRequest) GetPriority() float64 {
+	if x != nil {
+		return x.Priority
+	}
+	return 0
+}
+
+func (x *TaskRequest) GetRunAt() string {
+	if x != nil {
+		return x.RunAt
+	}
+	return ""
+}
+
+// NotifyRequest is a status change event.
+type NotifyRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Kind          string                 `protobuf:"bytes,1,opt,name=kind,proto3" json:"kind,omitempty"`
+	Created       string                 `protobuf:"bytes,2,opt,name=created,proto3" json:"created,omitempty"` // RFC 3339
+	Meta          []byte                 `protobuf:"bytes,3,opt,name=meta,proto3" json:"meta,omitempty"`       // json
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *NotifyRequest) Reset() {
+	*x = NotifyRequest{}
+	mi := &file_proto_concord_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *NotifyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*NotifyRequest) ProtoMessage() {}
+
+func (x *NotifyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_concord_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use NotifyRequest.ProtoReflect.Descriptor instead.
+func (*NotifyRequest) Descriptor() ([]byte, []int) {
+	return file_proto_concord_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *NotifyRequest) GetKind() string {
+	if x != nil {
+		return x.Kind
+	}
+	return ""
+}
+
+func (x *NotifyRequest) GetCreated() string {
+	if x != nil {
+		return x.Created
+	}
+	return ""
+}
+
+func (x *NotifyRequest) GetMeta() []byte {
+	if x != nil {
+		return x.Meta
+	}
+	return nil
+}
+
+type HealthRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HealthRequest) Reset() {
+	*x = HealthRequest{}
+	mi := &file_proto_concord_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HealthRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HealthRequest) ProtoMessage() {}
+
+func (x *HealthRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_concord_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HealthRequest.ProtoReflect.Descriptor instead.
+func (*HealthRequest) Descriptor() ([]byte, []int) {
+	return file_proto_concord_proto_rawDescGZIP(), []int{2}
+}
+
+// Reply is the result of a call, which is 0 on success. Pop and Next
+// return the task they took out, with an empty id if there was none.
+type Reply struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Result        int32                  `protobuf:"varint,1,opt,name=result,proto3" json:"result,omitempty"`
+	Id            string                 `protobuf:"bytes,2,opt,name=id,proto3" json:"id,omitempty"`
+	Key           string                 `protobuf:"bytes,3,opt,name=key,proto3" json:"key,omitempty"`
+	Priority      float64                `protobuf:"fixed64,4,opt,name=priority,proto3" json:"priority,omitempty"`
+	RunAt         string                 `protobuf:"bytes,5,opt,name=run_at,json=runAt,proto3" json:"run_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Reply) Reset() {
+	*x = Reply{}
+	mi := &file_proto_concord_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Reply) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Reply) ProtoMessage() {}
+
+func (x *Reply) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_concord_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Reply.ProtoReflect.Descriptor instead.
+func (*Reply) Descriptor() ([]byte, []int) {
+	return file_proto_concord_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Reply) GetResult() int32 {
+	if x != nil {
+		return x.Result
+	}
+	return 0
+}
+
+func (x *Reply) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Reply) GetKey() string {
+	if x != nil {
+		return x.Key
+	}
+	return ""
+}
+
+func (x *Reply) GetPriority() float64 {
+	if x != nil {
+		return x.Priority
+	}
+	return 0
+}
+
+func (x *Reply) GetRunAt() string {
+	if x != nil {
+		return x.RunAt
+	}
+	return ""
+}
+
+// ListReply is the priority queue or timetable of a key, in the json form
+// returned by the json-rpc get method.
+type ListReply struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	List          []byte                 `protobuf:"bytes,1,opt,name=list,proto3" json:"list,omitempty"` // json
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListReply) Reset() {
+	*x = ListReply{}
+	mi := &file_proto_concord_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListReply) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListReply) ProtoMessage() {}
+
+func (x *ListReply) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_concord_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListReply.ProtoReflect.Descriptor instead.
+func (*ListReply) Descriptor() ([]byte, []int) {
+	return file_proto_concord_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ListReply) GetList() []byte {
+	if x != nil {
+		return x.List
+	}
+	return nil
+}
+
+var File_proto_concord_proto protoreflect.FileDescriptor
+
+const file_proto_concord_proto_rawDesc = "" +
+	"\n" +
+	"\x13proto/concord.proto\x12\aconcord\"b\n" +
+	"\vTaskRequest\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x0e\n" +
+	"\x02id\x18\x02 \x01(\tR\x02id\x12\x1a\n" +
+	"\bpriority\x18\x03 \x01(\x01R\bpriority\x12\x15\n" +
+	"\x06run_at\x18\x04 \x01(\tR\x05runAt\"Q\n" +
+	"\rNotifyRequest\x12\x12\n" +
+	"\x04kind\x18\x01 \x01(\tR\x04kind\x12\x18\n" +
+	"\acreated\x18\x02 \x01(\tR\acreated\x12\x12\n" +
+	"\x04meta\x18\x03 \x01(\fR\x04meta\"\x0f\n" +
+	"\rHealthRequest\"t\n" +
+	"\x05Reply\x12\x16\n" +
+	"\x06result\x18\x01 \x01(\x05R\x06result\x12\x0e\n" +
+	"\x02id\x18\x02 \x01(\tR\x02id\x12\x10\n" +
+	"\x03key\x18\x03 \x01(\tR\x03key\x12\x1a\n" +
+	"\bpriority\x18\x04 \x01(\x01R\bpriority\x12\x15\n" +
+	"\x06run_at\x18\x05 \x01(\tR\x05runAt\"\x1f\n" +
+	"\tListReply\x12\x12\n" +
+	"\x04list\x18\x01 \x01(\fR\x04list2\xfd\x01\n" +
+	"\rPriorityQueue\x12,\n" +
+	"\x04Push\x12\x14.concord.TaskRequest\x1a\x0e.concord.Reply\x12+\n" +
+	"\x03Pop\x12\x14.concord.TaskRequest\x1a\x0e.concord.Reply\x12.\n" +
+	"\x06Remove\x12\x14.concord.TaskRequest\x1a\x0e.concord.Reply\x12/\n" +
+	"\x03Get\x12\x14.concord.TaskRequest\x1a\x12.concord.ListReply\x120\n" +
+	"\x06Health\x12\x16.concord.HealthRequest\x1a\x0e.concord.Reply2\xfc\x01\n" +
+	"\tTimetable\x12.\n" +
+	"\x06Insert\x12\x14.concord.TaskRequest\x1a\x0e.concord.Reply\x12,\n" +
+	"\x04Next\x12\x14.concord.TaskRequest\x1a\x0e.concord.Reply\x12.\n" +
+	"\x06Remove\x12\x14.concord.TaskRequest\x1a\x0e.concord.Reply\x12/\n" +
+	"\x03Get\x12\x14.concord.TaskRequest\x1a\x12.concord.ListReply\x120\n" +
+	"\x06Health\x12\x16.concord.HealthRequest\x1a\x0e.concord.Reply2z\n" +
+	"\x14StatusChangeNotifier\x120\n" +
+	"\x06Notify\x12\x16.concord.NotifyRequest\x1a\x0e.concord.Reply\x120\n" +
+	"\x06Health\x12\x16.concord.HealthRequest\x1a\x0e.concord.ReplyB$Z\"concord-controller/proto;concordpbb\x06proto3"
+
+var (
+	file_proto_concord_proto_rawDescOnce sync.Once
+	file_proto_concord_proto_rawDescData []byte
+)
+
+func file_proto_concord_proto_rawDescGZIP() []byte {
+	file_proto_concord_proto_rawDescOnce.Do(func() {
+		file_proto_concord_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_proto_concord_proto_rawDesc), len(file_proto_concord_proto_rawDesc)))
+	})
+	return file_proto_concord_proto_rawDescData
+}
+
+var file_proto_concord_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_proto_concord_proto_goTypes = []any{
+	(*TaskRequest)(nil),   // 0: concord.TaskRequest
+	(*NotifyRequest)(nil), // 1: concord.NotifyRequest
+	(*HealthRequest)(nil), // 2: concord.HealthRequest
+	(*Reply)(nil),         // 3: concord.Reply
+	(*ListReply)(nil),     // 4: concord.ListReply
+}
+var file_proto_concord_proto_depIdxs = []int32{
+	0,  // 0: concord.PriorityQueue.Push:input_type -> concord.TaskRequest
+	0,  // 1: concord.PriorityQueue.Pop:input_type -> concord.TaskRequest
+	0,  // 2: concord.PriorityQueue.Remove:input_type -> concord.TaskRequest
+	0,  // 3: concord.PriorityQueue.Get:input_type -> concord.TaskRequest
+	2,  // 4: concord.PriorityQueue.Health:input_type -> concord.HealthRequest
+	0,  // 5: concord.Timetable.Insert:input_type -> concord.TaskRequest
+	0,  // 6: concord.Timetable.Next:input_type -> concord.TaskRequest
+	0,  // 7: concord.Timetable.Remove:input_type -> concord.TaskRequest
+	0,  // 8: concord.Timetable.Get:input_type -> concord.TaskRequest
+	2,  // 9: concord.Timetable.Health:input_type -> concord.HealthRequest
+	1,  // 10: concord.StatusChangeNotifier.Notify:input_type -> concord.NotifyRequest
+	2,  // 11: concord.StatusChangeNotifier.Health:input_type -> concord.HealthRequest
+	3,  // 12: concord.PriorityQueue.Push:output_type -> concord.Reply
+	3,  // 13: concord.PriorityQueue.Pop:output_type -> concord.Reply
+	3,  // 14: concord.PriorityQueue.Remove:output_type -> concord.Reply
+	4,  // 15: concord.PriorityQueue.Get:output_type -> concord.ListReply
+	3,  // 16: concord.PriorityQueue.Health:output_type -> concord.Reply
+	3,  // 17: concord.Timetable.Insert:output_type -> concord.Reply
+	3,  // 18: concord.Timetable.Next:output_type -> concord.Reply
+	3,  // 19: concord.Timetable.Remove:output_type -> concord.Reply
+	4,  // 20: concord.Timetable.Get:output_type -> concord.ListReply
+	3,  // 21: concord.Timetable.Health:output_type -> concord.Reply
+	3,  // 22: concord.StatusChangeNotifier.Notify:output_type -> concord.Reply
+	3,  // 23: concord.StatusChangeNotifier.Health:output_type -> concord.Reply
+	12, // [12:24] is the sub-list for method output_type
+	0,  // [0:12] is the sub-list for method input_type
+	0,  // [0:0] is the sub-list for extension type_name
+	0,  // [0:0] is the sub-list for extension extendee
+	0,  // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_proto_concord_proto_init() }
+func file_proto_concord_proto_init() {
+	if File_proto_concord_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_proto_concord_proto_rawDesc), len(file_proto_concord_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   5,
+			NumExtensions: 0,
+			NumServices:   3,
+		},
+		GoTypes:           file_proto_concord_proto_goTypes,
+		DependencyIndexes: file_proto_concord_proto_depIdxs,
+		MessageInfos:      file_proto_concord_proto_msgTypes,
+	}.Build()
+	File_proto_concord_proto = out.File
+	file_proto_concord_proto_goTypes = nil
+	file_proto_concord_proto_depIdxs = nil
+}
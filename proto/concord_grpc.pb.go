@@ -0,0 +1,671 @@
+// The grpc services of the concord priority queue, timetable and status
+// change notifier, as called by the controller with the grpc broker
+// transport.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             (unknown)
+// source: proto/concord.proto
+
+package concordpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	PriorityQueue_Push_FullMethodName   = "/concord.PriorityQueue/Push"
+	PriorityQueue_Pop_FullMethodName    = "/concord.PriorityQueue/Pop"
+	PriorityQueue_Remove_FullMethodName = "/concord.PriorityQueue/Remove"
+	PriorityQueue_Get_FullMethodName    = "/concord.PriorityQueue/Get"
+	PriorityQueue_Health_FullMethodName = "/concord.PriorityQueue/Health"
+)
+
+// PriorityQueueClient is the client API for PriorityQueue service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type PriorityQueueClient interface {
+	Push(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*Reply, error)
+	Pop(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*Reply, error)
+	Remove(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*Reply, error)
+	Get(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*ListReply, error)
+	Health(ctx context.Context, in *HealthRequest, opts ...grpc.CallOption) (*Reply, error)
+}
+
+type priorityQueueClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPriorityQueueClient(cc grpc.ClientConnInterface) PriorityQueueClient {
+	return &priorityQueueClient{cc}
+}
+
+func (c *priorityQueueClient) Push(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*Reply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Reply)
+	err := c.cc.Invoke(ctx, PriorityQueue_Push_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *priorityQueueClient) Pop(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*Reply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Reply)
+	err := c.cc.Invoke(ctx, PriorityQueue_Pop_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *priorityQueueClient) Remove(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*Reply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Reply)
+	err := c.cc.Invoke(ctx, PriorityQueue_Remove_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *priorityQueueClient) Get(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*ListReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListReply)
+	err := c.cc.Invoke(ctx, PriorityQueue_Get_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *priorityQueueClient) Health(ctx context.Context, in *HealthRequest, opts ...grpc.CallOption) (*Reply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Reply)
+	err := c.cc.Invoke(ctx, PriorityQueue_Health_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PriorityQueueServer is the server API for PriorityQueue service.
+// All implementations must embed UnimplementedPriorityQueueServer
+// for forward compatibility.
+type PriorityQueueServer interface {
+	Push(context.Context, *TaskRequest) (*Reply, error)
+	Pop(context.Context, *TaskRequest) (*Reply, error)
+	Remove(context.Context, *TaskRequest) (*Reply, error)
+	Get(context.Context, *TaskRequest) (*ListReply, error)
+	Health(context.Context, *HealthRequest) (*Reply, error)
+	mustEmbedUnimplementedPriorityQueueServer()
+}
+
+// UnimplementedPriorityQueueServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedPriorityQueueServer struct{}
+
+func (UnimplementedPriorityQueueServer) Push(context.Context, *TaskRequest) (*Reply, error) {
+	return nil, status.Error(codes.Unimplemented, "method Push not implemented")
+}
+func (UnimplementedPriorityQueueServer) Pop(context.Context, *TaskRequest) (*Reply, error) {
+	return nil, status.Error(codes.Unimplemented, "method Pop not implemented")
+}
+func (UnimplementedPriorityQueueServer) Remove(context.Context, *TaskRequest) (*Reply, error) {
+	return nil, status.Error(codes.Unimplemented, "method Remove not implemented")
+}
+func (UnimplementedPriorityQueueServer) Get(context.Context, *TaskRequest) (*ListReply, error) {
+	return nil, status.Error(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedPriorityQueueServer) Health(context.Context, *HealthRequest) (*Reply, error) {
+	return nil, status.Error(codes.Unimplemented, "method Health not implemented")
+}
+func (UnimplementedPriorityQueueServer) mustEmbedUnimplementedPriorityQueueServer() {}
+func (UnimplementedPriorityQueueServer) testEmbeddedByValue()                       {}
+
+// UnsafePriorityQueueServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PriorityQueueServer will
+// result in compilation errors.
+type UnsafePriorityQueueServer interface {
+	mustEmbedUnimplementedPriorityQueueServer()
+}
+
+func RegisterPriorityQueueServer(s grpc.ServiceRegistrar, srv PriorityQueueServer) {
+	// If the following call panics, it indicates UnimplementedPriorityQueueServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&PriorityQueue_ServiceDesc, srv)
+}
+
+func _PriorityQueue_Push_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TaskRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PriorityQueueServer).Push(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PriorityQueue_Push_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PriorityQueueServer).Push(ctx, req.(*TaskRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PriorityQueue_Pop_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TaskRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PriorityQueueServer).Pop(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PriorityQueue_Pop_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PriorityQueueServer).Pop(ctx, req.(*TaskRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PriorityQueue_Remove_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TaskRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PriorityQueueServer).Remove(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PriorityQueue_Remove_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PriorityQueueServer).Remove(ctx, req.(*TaskRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PriorityQueue_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TaskRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PriorityQueueServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PriorityQueue_Get_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PriorityQueueServer).Get(ctx, req.(*TaskRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PriorityQueue_Health_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HealthRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PriorityQueueServer).Health(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PriorityQueue_Health_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PriorityQueueServer).Health(ctx, req.(*HealthRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// PriorityQueue_ServiceDesc is the grpc.ServiceDesc for PriorityQueue service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var PriorityQueue_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "concord.PriorityQueue",
+	HandlerType: (*PriorityQueueServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Push",
+			Handler:    _PriorityQueue_Push_Handler,
+		},
+		{
+			MethodName: "Pop",
+			Handler:    _PriorityQueue_Pop_Handler,
+		},
+		{
+			MethodName: "Remove",
+			Handler:    _PriorityQueue_Remove_Handler,
+		},
+		{
+			MethodName: "Get",
+			Handler:    _PriorityQueue_Get_Handler,
+		},
+		{
+			MethodName: "Health",
+			Handler:    _PriorityQueue_Health_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "proto/concord.proto",
+}
+
+const (
+	Timetable_Insert_FullMethodName = "/concord.Timetable/Insert"
+	Timetable_Next_FullMethodName   = "/concord.Timetable/Next"
+	Timetable_Remove_FullMethodName = "/concord.Timetable/Remove"
+	Timetable_Get_FullMethodName    = "/concord.Timetable/Get"
+	Timetable_Health_FullMethodName = "/concord.Timetable/Health"
+)
+
+// TimetableClient is the client API for Timetable service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type TimetableClient interface {
+	Insert(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*Reply, error)
+	Next(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*Reply, error)
+	Remove(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*Reply, error)
+	Get(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*ListReply, error)
+	Health(ctx context.Context, in *HealthRequest, opts ...grpc.CallOption) (*Reply, error)
+}
+
+type timetableClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewTimetableClient(cc grpc.ClientConnInterface) TimetableClient {
+	return &timetableClient{cc}
+}
+
+func (c *timetableClient) Insert(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*Reply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Reply)
+	err := c.cc.Invoke(ctx, Timetable_Insert_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *timetableClient) Next(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*Reply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Reply)
+	err := c.cc.Invoke(ctx, Timetable_Next_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *timetableClient) Remove(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*Reply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Reply)
+	err := c.cc.Invoke(ctx, Timetable_Remove_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *timetableClient) Get(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*ListReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListReply)
+	err := c.cc.Invoke(ctx, Timetable_Get_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *timetableClient) Health(ctx context.Context, in *HealthRequest, opts ...grpc.CallOption) (*Reply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Reply)
+	err := c.cc.Invoke(ctx, Timetable_Health_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// TimetableServer is the server API for Timetable service.
+// All implementations must embed UnimplementedTimetableServer
+// for forward compatibility.
+type TimetableServer interface {
+	Insert(context.Context, *TaskRequest) (*Reply, error)
+	Next(context.Context, *TaskRequest) (*Reply, error)
+	Remove(context.Context, *TaskRequest) (*Reply, error)
+	Get(context.Context, *TaskRequest) (*ListReply, error)
+	Health(context.Context, *HealthRequest) (*Reply, error)
+	mustEmbedUnimplementedTimetableServer()
+}
+
+// UnimplementedTimetableServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedTimetableServer struct{}
+
+func (UnimplementedTimetableServer) Insert(context.Context, *TaskRequest) (*Reply, error) {
+	return nil, status.Error(codes.Unimplemented, "method Insert not implemented")
+}
+func (UnimplementedTimetableServer) Next(context.Context, *TaskRequest) (*Reply, error) {
+	return nil, status.Error(codes.Unimplemented, "method Next not implemented")
+}
+func (UnimplementedTimetableServer) Remove(context.Context, *TaskRequest) (*Reply, error) {
+	return nil, status.Error(codes.Unimplemented, "method Remove not implemented")
+}
+func (UnimplementedTimetableServer) Get(context.Context, *TaskRequest) (*ListReply, error) {
+	return nil, status.Error(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedTimetableServer) Health(context.Context, *HealthRequest) (*Reply, error) {
+	return nil, status.Error(codes.Unimplemented, "method Health not implemented")
+}
+func (UnimplementedTimetableServer) mustEmbedUnimplementedTimetableServer() {}
+func (UnimplementedTimetableServer) testEmbeddedByValue()                   {}
+
+// UnsafeTimetableServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to TimetableServer will
+// result in compilation errors.
+type UnsafeTimetableServer interface {
+	mustEmbedUnimplementedTimetableServer()
+}
+
+func RegisterTimetableServer(s grpc.ServiceRegistrar, srv TimetableServer) {
+	// If the following call panics, it indicates UnimplementedTimetableServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Timetable_ServiceDesc, srv)
+}
+
+func _Timetable_Insert_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TaskRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TimetableServer).Insert(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Timetable_Insert_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TimetableServer).Insert(ctx, req.(*TaskRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Timetable_Next_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TaskRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TimetableServer).Next(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Timetable_Next_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TimetableServer).Next(ctx, req.(*TaskRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Timetable_Remove_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TaskRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TimetableServer).Remove(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Timetable_Remove_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TimetableServer).Remove(ctx, req.(*TaskRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Timetable_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TaskRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TimetableServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Timetable_Get_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TimetableServer).Get(ctx, req.(*TaskRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Timetable_Health_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HealthRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TimetableServer).Health(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Timetable_Health_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TimetableServer).Health(ctx, req.(*HealthRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Timetable_ServiceDesc is the grpc.ServiceDesc for Timetable service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Timetable_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "concord.Timetable",
+	HandlerType: (*TimetableServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Insert",
+			Handler:    _Timetable_Insert_Handler,
+		},
+		{
+			MethodName: "Next",
+			Handler:    _Timetable_Next_Handler,
+		},
+		{
+			MethodName: "Remove",
+			Handler:    _Timetable_Remove_Handler,
+		},
+		{
+			MethodName: "Get",
+			Handler:    _Timetable_Get_Handler,
+		},
+		{
+			MethodName: "Health",
+			Handler:    _Timetable_Health_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "proto/concord.proto",
+}
+
+const (
+	StatusChangeNotifier_Notify_FullMethodName = "/concord.StatusChangeNotifier/Notify"
+	StatusChangeNotifier_Health_FullMethodName = "/concord.StatusChangeNotifier/Health"
+)
+
+// StatusChangeNotifierClient is the client API for StatusChangeNotifier service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type StatusChangeNotifierClient interface {
+	Notify(ctx context.Context, in *NotifyRequest, opts ...grpc.CallOption) (*Reply, error)
+	Health(ctx context.Context, in *HealthRequest, opts ...grpc.CallOption) (*Reply, error)
+}
+
+type statusChangeNotifierClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewStatusChangeNotifierClient(cc grpc.ClientConnInterface) StatusChangeNotifierClient {
+	return &statusChangeNotifierClient{cc}
+}
+
+func (c *statusChangeNotifierClient) Notify(ctx context.Context, in *NotifyRequest, opts ...grpc.CallOption) (*Reply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Reply)
+	err := c.cc.Invoke(ctx, StatusChangeNotifier_Notify_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *statusChangeNotifierClient) Health(ctx context.Context, in *HealthRequest, opts ...grpc.CallOption) (*Reply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Reply)
+	err := c.cc.Invoke(ctx, StatusChangeNotifier_Health_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// StatusChangeNotifierServer is the server API for StatusChangeNotifier service.
+// All implementations must embed UnimplementedStatusChangeNotifierServer
+// for forward compatibility.
+type StatusChangeNotifierServer interface {
+	Notify(context.Context, *NotifyRequest) (*Reply, error)
+	Health(context.Context, *HealthRequest) (*Reply, error)
+	mustEmbedUnimplementedStatusChangeNotifierServer()
+}
+
+// UnimplementedStatusChangeNotifierServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedStatusChangeNotifierServer struct{}
+
+func (UnimplementedStatusChangeNotifierServer) Notify(context.Context, *NotifyRequest) (*Reply, error) {
+	return nil, status.Error(codes.Unimplemented, "method Notify not implemented")
+}
+func (UnimplementedStatusChangeNotifierServer) Health(context.Context, *HealthRequest) (*Reply, error) {
+	return nil, status.Error(codes.Unimplemented, "method Health not implemented")
+}
+func (UnimplementedStatusChangeNotifierServer) mustEmbedUnimplementedStatusChangeNotifierServer() {}
+func (UnimplementedStatusChangeNotifierServer) testEmbeddedByValue()                              {}
+
+// UnsafeStatusChangeNotifierServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to StatusChangeNotifierServer will
+// result in compilation errors.
+type UnsafeStatusChangeNotifierServer interface {
+	mustEmbedUnimplementedStatusChangeNotifierServer()
+}
+
+func RegisterStatusChangeNotifierServer(s grpc.ServiceRegistrar, srv StatusChangeNotifierServer) {
+	// If the following call panics, it indicates UnimplementedStatusChangeNotifierServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&StatusChangeNotifier_ServiceDesc, srv)
+}
+
+func _StatusChangeNotifier_Notify_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(NotifyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StatusChangeNotifierServer).Notify(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: StatusChangeNotifier_Notify_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StatusChangeNotifierServer).Notify(ctx, req.(*NotifyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StatusChangeNotifier_Health_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HealthRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StatusChangeNotifierServer).Health(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: StatusChangeNotifier_Health_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StatusChangeNotifierServer).Health(ctx, req.(*HealthRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// StatusChangeNotifier_ServiceDesc is the grpc.ServiceDesc for StatusChangeNotifier service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var StatusChangeNotifier_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "concord.StatusChangeNotifier",
+	HandlerType: (*StatusChangeNotifierServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Notify",
+			Handler:    _StatusChangeNotifier_Notify_Handler,
+		},
+		{
+			MethodName: "Health",
+			Handler:    _StatusChangeNotifier_Health_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "proto/concord.proto",
+}
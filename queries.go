@@ -0,0 +1,686 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SQLModel is a model that runs sql statements against its table natively,
+// as the postgresql models do. The queries below run their sql statement
+// against an SQLModel and their AQL query against the other models.
+type SQLModel interface {
+	// QuerySQL runs the statement and returns the json documents it
+	// selects.
+	// RemoveSQL runs the delete statement and returns the json documents it
+	// returns with RETURNING doc.
+	// StreamSQL runs the statement and returns an iterator of the json
+	// documents it selects.
+	// PageSQL returns the page of the documents of the table matching the
+	// condition in the order, with the number of all matching documents.
+	QuerySQL(string, ...interface{}) ([]interface{}, error)
+	RemoveSQL(string, ...interface{}) ([]interface{}, error)
+	StreamSQL(string, ...interface{}) (DocumentIterator, error)
+	PageSQL(string, string, int, int, ...interface{}) (*Page, error)
+}
+
+// sqlModel returns the model as an SQLModel if it runs sql natively. A
+// cached model runs sql if the model it wraps does.
+func sqlModel(model Model) (SQLModel, bool) {
+	if cached, ok := model.(*CachedModel); ok {
+		if _, ok := cached.Model.(SQLModel); !ok {
+			return nil, false
+		}
+	}
+	m, ok := model.(SQLModel)
+	return m, ok
+}
+
+// sqlArgs are the positional arguments of a sql statement.
+type sqlArgs []interface{}
+
+// add adds the value and returns its placeholder.
+func (args *sqlArgs) add(v interface{}) string {
+	*args = append(*args, v)
+	return fmt.Sprintf("$%d", len(*args))
+}
+
+// json adds the json encoding of the value and returns its placeholder as
+// a jsonb value, which compares to the document attributes.
+func (args *sqlArgs) json(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return args.add(string(data)) + "::jsonb"
+}
+
+// in returns the condition matching the documents whose attribute is one
+// of the values.
+func (args *sqlArgs) in(attr string, values interface{}) string {
+	return fmt.Sprintf("%s IN (SELECT jsonb_array_elements(%s))", attr, args.json(values))
+}
+
+// sqlAttr returns the jsonb value of the document attribute.
+func sqlAttr(name string) string {
+	return "doc -> " + quoteSQL(name)
+}
+
+// sqlTime returns the timestamp of the document attribute holding a date
+// string. The timestamp is null if the attribute is not set.
+func sqlTime(name string) string {
+	return fmt.Sprintf("(doc ->> %s)::timestamptz", quoteSQL(name))
+}
+
+// sqlWhere returns the where clause of the conditions, which is empty
+// without conditions.
+func sqlWhere(conds []string) string {
+	if len(conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conds, " AND ")
+}
+
+// millis returns the duration in milliseconds, as the AQL dates are
+// compared.
+func millis(d time.Duration) int64 {
+	return d.Nanoseconds() / int64(time.Millisecond)
+}
+
+// queryResource returns the resource named key or a member of the pool
+// named key, if any.
+func queryResource(key string, resourceModel Model) ([]interface{}, error) {
+	if m, ok := sqlModel(resourceModel); ok {
+		args := sqlArgs{}
+		q := fmt.Sprintf(
+			"SELECT doc FROM %s WHERE key = %s OR %s = %s LIMIT 1",
+			CollectionResources,
+			args.add(key),
+			sqlAttr("pool"),
+			args.json(key),
+		)
+		return m.QuerySQL(q, args...)
+	}
+	q := fmt.Sprintf(`FOR r IN %s FILTER r._key == @key OR r.pool == @key LIMIT 1 RETURN r`, CollectionResources)
+	return resourceModel.Query(q, map[string]interface{}{"key": key})
+}
+
+// queryResourceTasks returns the tasks of the resource key with the status.
+func queryResourceTasks(key string, status string, taskModel Model) ([]interface{}, error) {
+	if m, ok := sqlModel(taskModel); ok {
+		args := sqlArgs{}
+		q := fmt.Sprintf(
+			"SELECT doc FROM %s WHERE %s = %s AND %s = %s",
+			CollectionTasks,
+			sqlAttr("key"),
+			args.json(key),
+			sqlAttr("status"),
+			args.json(status),
+		)
+		return m.QuerySQL(q, args...)
+	}
+	q := fmt.Sprintf(`FOR t IN %s FILTER t.key == @key AND t.status == @status RETURN t`, CollectionTasks)
+	return taskModel.Query(q, map[string]interface{}{"key": key, "status": status})
+}
+
+// queryResourceStats returns the busy periods of the resource that ended
+// within the window.
+func queryResourceStats(name string, window time.Duration, resourceStatModel Model) ([]interface{}, error) {
+	if m, ok := sqlModel(resourceStatModel); ok {
+		args := sqlArgs{}
+		q := fmt.Sprintf(
+			"SELECT doc FROM %s WHERE %s = %s AND %s >= %s",
+			CollectionResourceStats,
+			sqlAttr("resource"),
+			args.json(name),
+			sqlTime("ended"),
+			args.add(time.Now().Add(-window)),
+		)
+		return m.QuerySQL(q, args...)
+	}
+	q := fmt.Sprintf(
+		`FOR s IN %s FILTER s.resource == @resource AND DATE_TIMESTAMP(s.ended) >= DATE_NOW() - @window RETURN s`,
+		CollectionResourceStats,
+	)
+	return resourceStatModel.Query(q, map[string]interface{}{"resource": name, "window": millis(window)})
+}
+
+// queryTaskCounts returns the number of tasks per status and, if byKey is
+// set, per resource key.
+func queryTaskCounts(byKey bool, countModel Model) ([]interface{}, error) {
+	if m, ok := sqlModel(countModel); ok {
+		q := fmt.Sprintf(
+			"SELECT jsonb_build_object('status', %s, 'count', count(*)) FROM %s GROUP BY %s",
+			sqlAttr("status"),
+			CollectionTasks,
+			sqlAttr("status"),
+		)
+		if byKey {
+			q = fmt.Sprintf(
+				"SELECT jsonb_build_object('status', %s, 'key', %s, 'count', count(*)) FROM %s GROUP BY %s, %s",
+				sqlAttr("status"),
+				sqlAttr("key"),
+				CollectionTasks,
+				sqlAttr("status"),
+				sqlAttr("key"),
+			)
+		}
+		return m.QuerySQL(q)
+	}
+	q := fmt.Sprintf("FOR t IN %s COLLECT status = t.status WITH COUNT INTO count RETURN {status, count}", CollectionTasks)
+	if byKey {
+		q = fmt.Sprintf("FOR t IN %s COLLECT status = t.status, key = t.key WITH COUNT INTO count RETURN {status, key, count}", CollectionTasks)
+	}
+	return countModel.Query(q, map[string]interface{}{})
+}
+
+// queryPendingTasks returns the pending tasks, which were staged before
+// the controller stopped.
+func queryPendingTasks(taskModel Model) ([]interface{}, error) {
+	if m, ok := sqlModel(taskModel); ok {
+		args := sqlArgs{}
+		q := fmt.Sprintf("SELECT doc FROM %s WHERE %s = %s", CollectionTasks, sqlAttr("status"), args.json(StatusPending))
+		return m.QuerySQL(q, args...)
+	}
+	q := fmt.Sprintf("FOR t IN %s FILTER t.status == 'pending' RETURN t", CollectionTasks)
+	return taskModel.Query(q, map[string]interface{}{})
+}
+
+// queryTasks returns the tasks with the ids. Ids without a task are
+// skipped.
+func queryTasks(ids []string, taskModel Model) ([]interface{}, error) {
+	if m, ok := sqlModel(taskModel); ok {
+		args := sqlArgs{}
+		q := fmt.Sprintf("SELECT doc FROM %s WHERE key IN (SELECT jsonb_array_elements_text(%s))", CollectionTasks, args.json(ids))
+		return m.QuerySQL(q, args...)
+	}
+	q := fmt.Sprintf(`FOR t IN %s FILTER t._key IN @ids RETURN t`, CollectionTasks)
+	return taskModel.Query(q, map[string]interface{}{"ids": ids})
+}
+
+// queryChildTasks returns the child tasks of the task, in creation order if
+// ordered is set.
+func queryChildTasks(taskId string, ordered bool, taskModel Model) ([]interface{}, error) {
+	if m, ok := sqlModel(taskModel); ok {
+		args := sqlArgs{}
+		q := fmt.Sprintf("SELECT doc FROM %s WHERE %s = %s", CollectionTasks, sqlAttr("parentId"), args.json(taskId))
+		if ordered {
+			q += " ORDER BY " + sqlTime("created")
+		}
+		return m.QuerySQL(q, args...)
+	}
+	q := fmt.Sprintf(`FOR t IN %s FILTER t.parentId == @id RETURN t`, CollectionTasks)
+	if ordered {
+		q = fmt.Sprintf(`FOR t IN %s FILTER t.parentId == @id SORT t.created ASC RETURN t`, CollectionTasks)
+	}
+	return taskModel.Query(q, map[string]interface{}{"id": taskId})
+}
+
+// queryDependents returns the blocked tasks that depend on the task.
+func queryDependents(taskId string, taskModel Model) ([]interface{}, error) {
+	if m, ok := sqlModel(taskModel); ok {
+		args := sqlArgs{}
+		q := fmt.Sprintf(
+			"SELECT doc FROM %s WHERE %s = %s AND %s @> %s",
+			CollectionTasks,
+			sqlAttr("status"),
+			args.json(StatusBlocked),
+			sqlAttr("dependsOn"),
+			args.json([]string{taskId}),
+		)
+		return m.QuerySQL(q, args...)
+	}
+	q := fmt.Sprintf(`FOR t IN %s FILTER t.status == @status AND @id IN t.dependsOn RETURN t`, CollectionTasks)
+	return taskModel.Query(q, map[string]interface{}{"id": taskId, "status": StatusBlocked})
+}
+
+// queryOlderTask returns the oldest queued task with the key and priority
+// of the task that was created before it, or a task that is still being
+// added since less than FIFOAddTimeout.
+func queryOlderTask(task *Task, taskModel Model) ([]interface{}, error) {
+	if m, ok := sqlModel(taskModel); ok {
+		args := sqlArgs{}
+		q := fmt.Sprintf(
+			"SELECT doc FROM %s WHERE %s = %s AND %s = %s AND %s < %s AND (%s = %s OR (%s = %s AND %s >= %s)) ORDER BY %s LIMIT 1",
+			CollectionTasks,
+			sqlAttr("key"),
+			args.json(task.Key),
+			sqlAttr("priority"),
+			args.json(task.Priority),
+			sqlTime("created"),
+			args.add(task.Created),
+			sqlAttr("status"),
+			args.json(StatusQueued),
+			sqlAttr("status"),
+			args.json(StatusCreated),
+			sqlTime("created"),
+			args.add(time.Now().Add(-FIFOAddTimeout)),
+			sqlTime("created"),
+		)
+		return m.QuerySQL(q, args...)
+	}
+	q := fmt.Sprintf(
+		`FOR t IN %s FILTER t.key == @key AND t.priority == @priority AND DATE_TIMESTAMP(t.created) < DATE_TIMESTAMP(@before) `+
+			`FILTER t.status == @queued OR (t.status == @adding AND DATE_TIMESTAMP(t.created) >= DATE_NOW() - @timeout) `+
+			`SORT DATE_TIMESTAMP(t.created) LIMIT 1 RETURN t`,
+		CollectionTasks,
+	)
+	return taskModel.Query(q, map[string]interface{}{
+		"key":      task.Key,
+		"priority": task.Priority,
+		"before":   task.Created,
+		"queued":   StatusQueued,
+		"adding":   StatusCreated,
+		"timeout":  millis(FIFOAddTimeout),
+	})
+}
+
+// queryExpiredTasks returns the queued and scheduled tasks that are past
+// their expiration time.
+func queryExpiredTasks(taskModel Model) ([]interface{}, error) {
+	statuses := []string{StatusQueued, StatusScheduled}
+	if m, ok := sqlModel(taskModel); ok {
+		args := sqlArgs{}
+		q := fmt.Sprintf(
+			"SELECT doc FROM %s WHERE %s AND %s <= now()",
+			CollectionTasks,
+			args.in(sqlAttr("status"), statuses),
+			sqlTime("expiresAt"),
+		)
+		return m.QuerySQL(q, args...)
+	}
+	q := fmt.Sprintf(
+		`FOR t IN %s FILTER t.status IN @statuses AND t.expiresAt != null AND DATE_TIMESTAMP(t.expiresAt) <= DATE_NOW() RETURN t`,
+		CollectionTasks,
+	)
+	return taskModel.Query(q, map[string]interface{}{"statuses": statuses})
+}
+
+// queryExpiredLeases returns the started tasks whose lease expired.
+func queryExpiredLeases(taskModel Model) ([]interface{}, error) {
+	if m, ok := sqlModel(taskModel); ok {
+		args := sqlArgs{}
+		q := fmt.Sprintf(
+			"SELECT doc FROM %s WHERE %s = %s AND %s < now()",
+			CollectionTasks,
+			sqlAttr("status"),
+			args.json(StatusStarted),
+			sqlTime("leaseExpires"),
+		)
+		return m.QuerySQL(q, args...)
+	}
+	q := fmt.Sprintf(
+		`FOR t IN %s FILTER t.status == @status AND t.leaseExpires != null AND DATE_TIMESTAMP(t.leaseExpires) < DATE_NOW() RETURN t`,
+		CollectionTasks,
+	)
+	return taskModel.Query(q, map[string]interface{}{"status": StatusStarted})
+}
+
+// queryArchivableTasks returns up to ArchiveBatchSize of the oldest tasks
+// in a final status that were last updated, or created if they were never
+// updated, longer than the retention ago.
+func queryArchivableTasks(retention time.Duration, taskModel Model) ([]interface{}, error) {
+	statuses := []string{StatusCancelled, StatusComplete, StatusError}
+	if m, ok := sqlModel(taskModel); ok {
+		args := sqlArgs{}
+		q := fmt.Sprintf(
+			"SELECT doc FROM %s WHERE %s AND COALESCE(%s, %s) <= %s ORDER BY %s LIMIT %s",
+			CollectionTasks,
+			args.in(sqlAttr("status"), statuses),
+			sqlTime("updated"),
+			sqlTime("created"),
+			args.add(time.Now().Add(-retention)),
+			sqlTime("created"),
+			args.add(ArchiveBatchSize),
+		)
+		return m.QuerySQL(q, args...)
+	}
+	q := fmt.Sprintf(
+		`FOR t IN %s FILTER t.status IN @statuses AND DATE_TIMESTAMP(NOT_NULL(t.updated, t.created)) <= DATE_NOW() - @retention SORT t.created ASC LIMIT @limit RETURN t`,
+		CollectionTasks,
+	)
+	return taskModel.Query(q, map[string]interface{}{
+		"limit":     ArchiveBatchSize,
+		"retention": millis(retention),
+		"statuses":  statuses,
+	})
+}
+
+// purgeTasks removes up to limit complete and cancelled tasks that were
+// created more than age ago and returns the number of removed tasks.
+func purgeTasks(age time.Duration, limit int, taskModel Model) (int, error) {
+	statuses := []string{StatusComplete, StatusCancelled}
+	before := time.Now().Add(-age)
+	var tasks []interface{}
+	var err error
+	if m, ok := sqlModel(taskModel); ok {
+		args := sqlArgs{}
+		q := fmt.Sprintf(
+			"DELETE FROM %s WHERE key IN (SELECT key FROM %s WHERE %s AND %s < %s LIMIT %s) RETURNING doc",
+			CollectionTasks,
+			CollectionTasks,
+			args.in(sqlAttr("status"), statuses),
+			sqlTime("created"),
+			args.add(before),
+			args.add(limit),
+		)
+		tasks, err = m.RemoveSQL(q, args...)
+	} else {
+		q := fmt.Sprintf(
+			`FOR t IN %s FILTER t.status IN @statuses AND DATE_TIMESTAMP(t.created) < @before LIMIT @limit REMOVE t IN %s RETURN OLD`,
+			CollectionTasks,
+			CollectionTasks,
+		)
+		vars := map[string]interface{}{
+			"before":   before.UnixNano() / int64(time.Millisecond),
+			"limit":    limit,
+			"statuses": statuses,
+		}
+		tasks, err = taskModel.Query(q, vars)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(tasks), nil
+}
+
+// streamStartedTasks calls fn with each started task.
+func streamStartedTasks(taskModel Model, fn func(interface{}) error) error {
+	if m, ok := sqlModel(taskModel); ok {
+		args := sqlArgs{}
+		q := fmt.Sprintf("SELECT doc FROM %s WHERE %s = %s", CollectionTasks, sqlAttr("status"), args.json(StatusStarted))
+		return streamSQL(m, q, args, fn)
+	}
+	q := fmt.Sprintf(`FOR t IN %s FILTER t.status == @status RETURN t`, CollectionTasks)
+	return streamQuery(taskModel, q, map[string]interface{}{"status": StatusStarted}, fn)
+}
+
+// streamWaitingTasks calls fn with each queued and scheduled task in
+// creation order.
+func streamWaitingTasks(taskModel Model, fn func(interface{}) error) error {
+	statuses := []string{StatusQueued, StatusScheduled}
+	if m, ok := sqlModel(taskModel); ok {
+		args := sqlArgs{}
+		q := fmt.Sprintf(
+			"SELECT doc FROM %s WHERE %s ORDER BY %s",
+			CollectionTasks,
+			args.in(sqlAttr("status"), statuses),
+			sqlTime("created"),
+		)
+		return streamSQL(m, q, args, fn)
+	}
+	q := fmt.Sprintf(`FOR t IN %s FILTER t.status IN @statuses SORT t.created RETURN t`, CollectionTasks)
+	return streamQuery(taskModel, q, map[string]interface{}{"statuses": statuses}, fn)
+}
+
+// streamTasks calls fn with each task with the status, key and labels in
+// creation order. The empty filters are omitted.
+func streamTasks(status string, key string, labels map[string]string, taskModel Model, fn func(interface{}) error) error {
+	if m, ok := sqlModel(taskModel); ok {
+		args := sqlArgs{}
+		q := fmt.Sprintf(
+			"SELECT doc FROM %s%s ORDER BY %s",
+			CollectionTasks,
+			sqlWhere(sqlTaskFilter(status, key, labels, &args)),
+			sqlTime("created"),
+		)
+		return streamSQL(m, q, args, fn)
+	}
+	vars := make(map[string]interface{})
+	q := fmt.Sprintf("FOR t IN %s", CollectionTasks) + taskFilter(status, key, labels, vars)
+	q += " SORT t.created ASC RETURN t"
+	return streamQuery(taskModel, q, vars, fn)
+}
+
+// streamSQL calls fn with each document selected by the statement.
+func streamSQL(model SQLModel, q string, args sqlArgs, fn func(interface{}) error) error {
+	it, err := model.StreamSQL(q, args...)
+	if err != nil {
+		return err
+	}
+	return streamDocuments(it, fn)
+}
+
+// queryTaskList returns the page of the tasks with the status, key and
+// labels in creation order. The empty filters are omitted.
+func queryTaskList(status string, key string, labels map[string]string, limit int, offset int, taskModel Model) (*Page, error) {
+	if m, ok := sqlModel(taskModel); ok {
+		args := sqlArgs{}
+		where := strings.Join(sqlTaskFilter(status, key, labels, &args), " AND ")
+		return m.PageSQL(where, sqlTime("created"), offset, limit, args...)
+	}
+	vars := make(map[string]interface{})
+	q := fmt.Sprintf("FOR t IN %s", CollectionTasks) + taskFilter(status, key, labels, vars)
+	q += " SORT t.created ASC LIMIT @offset, @limit RETURN t"
+	return taskModel.QueryPage(q, vars, offset, limit)
+}
+
+// querySearchTasks returns the page of the tasks with the meta values of
+// the filters and the labels in creation order. Filter keys are dot
+// separated meta paths.
+func querySearchTasks(filters map[string]interface{}, labels map[string]string, limit int, offset int, taskModel Model) (*Page, error) {
+	paths := make([]string, 0, len(filters))
+	for path := range filters {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	if m, ok := sqlModel(taskModel); ok {
+		args := sqlArgs{}
+		conds := make([]string, 0, len(paths)+len(labels))
+		for _, path := range paths {
+			attr := sqlAttr("meta")
+			for _, segment := range strings.Split(path, ".") {
+				attr += " -> " + args.add(segment) + "::text"
+			}
+			conds = append(conds, fmt.Sprintf("%s = %s", attr, args.json(filters[path])))
+		}
+		conds = append(conds, sqlLabelFilter(labels, &args)...)
+		return m.PageSQL(strings.Join(conds, " AND "), sqlTime("created"), offset, limit, args...)
+	}
+	q := fmt.Sprintf("FOR t IN %s", CollectionTasks)
+	vars := make(map[string]interface{})
+	for i, path := range paths {
+		attr := "t.meta"
+		for j, segment := range strings.Split(path, ".") {
+			name := fmt.Sprintf("f%d_%d", i, j)
+			attr += fmt.Sprintf("[@%s]", name)
+			vars[name] = segment
+		}
+		q += fmt.Sprintf(" FILTER %s == @v%d", attr, i)
+		vars[fmt.Sprintf("v%d", i)] = filters[path]
+	}
+	q += labelFilter(labels, vars)
+	q += " SORT t.created ASC LIMIT @offset, @limit RETURN t"
+	return taskModel.QueryPage(q, vars, offset, limit)
+}
+
+// sqlTaskFilter returns the sql conditions matching tasks with the status,
+// key and labels and adds their arguments. Empty filters are omitted.
+func sqlTaskFilter(status string, key string, labels map[string]string, args *sqlArgs) []string {
+	conds := make([]string, 0)
+	if status != "" {
+		conds = append(conds, fmt.Sprintf("%s = %s", sqlAttr("status"), args.json(status)))
+	}
+	if key != "" {
+		conds = append(conds, fmt.Sprintf("%s = %s", sqlAttr("key"), args.json(key)))
+	}
+	return append(conds, sqlLabelFilter(labels, args)...)
+}
+
+// sqlLabelFilter returns the sql conditions matching tasks with all of the
+// labels and adds the label pairs to the arguments.
+func sqlLabelFilter(labels map[string]string, args *sqlArgs) []string {
+	conds := make([]string, 0, len(labels))
+	for _, pair := range LabelPairs(labels) {
+		conds = append(conds, fmt.Sprintf("%s @> %s", sqlAttr("labelIndex"), args.json([]string{pair})))
+	}
+	return conds
+}
+
+// queryArchivedTask returns the archived task with the id, if any.
+func queryArchivedTask(id string, archiveModel Model) ([]interface{}, error) {
+	if m, ok := sqlModel(archiveModel); ok {
+		return m.QuerySQL(fmt.Sprintf("SELECT doc FROM %s WHERE key = $1", CollectionTasksArchive), id)
+	}
+	q := fmt.Sprintf(`FOR t IN %s FILTER t._key == @key RETURN t`, CollectionTasksArchive)
+	return archiveModel.Query(q, map[string]interface{}{"key": id})
+}
+
+// queryTaskGroup returns the task group with the id, if any.
+func queryTaskGroup(groupId string, groupModel Model) ([]interface{}, error) {
+	if m, ok := sqlModel(groupModel); ok {
+		return m.QuerySQL(fmt.Sprintf("SELECT doc FROM %s WHERE key = $1", CollectionTaskGroups), groupId)
+	}
+	q := fmt.Sprintf(`FOR g IN %s FILTER g._key == @key RETURN g`, CollectionTaskGroups)
+	return groupModel.Query(q, map[string]interface{}{"key": groupId})
+}
+
+// queryTaskHistory returns the status transitions of the task in the
+// order they occurred.
+func queryTaskHistory(taskId string, historyModel Model) ([]interface{}, error) {
+	if m, ok := sqlModel(historyModel); ok {
+		args := sqlArgs{}
+		q := fmt.Sprintf(
+			"SELECT doc FROM %s WHERE %s = %s ORDER BY %s",
+			CollectionTaskHistory,
+			sqlAttr("taskId"),
+			args.json(taskId),
+			sqlTime("created"),
+		)
+		return m.QuerySQL(q, args...)
+	}
+	q := fmt.Sprintf(`FOR h IN %s FILTER h.taskId == @taskId SORT h.created ASC RETURN h`, CollectionTaskHistory)
+	return historyModel.Query(q, map[string]interface{}{"taskId": taskId})
+}
+
+// queryTaskLog returns the output snippets of the task in the order they
+// were appended.
+func queryTaskLog(taskId string, logModel Model) ([]interface{}, error) {
+	if m, ok := sqlModel(logModel); ok {
+		args := sqlArgs{}
+		q := fmt.Sprintf(
+			"SELECT doc FROM %s WHERE %s = %s ORDER BY %s",
+			CollectionTaskLogs,
+			sqlAttr("taskId"),
+			args.json(taskId),
+			sqlTime("created"),
+		)
+		return m.QuerySQL(q, args...)
+	}
+	q := fmt.Sprintf(`FOR l IN %s FILTER l.taskId == @taskId SORT l.created ASC RETURN l`, CollectionTaskLogs)
+	return logModel.Query(q, map[string]interface{}{"taskId": taskId})
+}
+
+// trimTaskLog removes the output snippets of the task beyond the most
+// recent MaxTaskLogEntries.
+func trimTaskLog(taskId string, logModel Model) error {
+	if m, ok := sqlModel(logModel); ok {
+		args := sqlArgs{}
+		q := fmt.Sprintf(
+			"DELETE FROM %s WHERE key IN (SELECT key FROM %s WHERE %s = %s ORDER BY %s DESC LIMIT %s OFFSET %s) RETURNING doc",
+			CollectionTaskLogs,
+			CollectionTaskLogs,
+			sqlAttr("taskId"),
+			args.json(taskId),
+			sqlTime("created"),
+			args.add(MaxTaskLogEntries),
+			args.add(MaxTaskLogEntries),
+		)
+		_, err := m.RemoveSQL(q, args...)
+		return err
+	}
+	q := fmt.Sprintf(
+		`FOR l IN %s FILTER l.taskId == @taskId SORT l.created DESC LIMIT @offset, @count REMOVE l IN %s`,
+		CollectionTaskLogs,
+		CollectionTaskLogs,
+	)
+	vars := map[string]interface{}{"taskId": taskId, "offset": MaxTaskLogEntries, "count": MaxTaskLogEntries}
+	_, err := logModel.Query(q, vars)
+	return err
+}
+
+// queryTaskStats returns the recorded task stats of the key.
+func queryTaskStats(key string, taskStatModel Model) ([]interface{}, error) {
+	if m, ok := sqlModel(taskStatModel); ok {
+		args := sqlArgs{}
+		q := fmt.Sprintf("SELECT doc FROM %s WHERE %s = %s", CollectionTaskStats, sqlAttr("key"), args.json(key))
+		return m.QuerySQL(q, args...)
+	}
+	q := fmt.Sprintf(`FOR t IN %s FILTER t.key == @key RETURN t`, CollectionTaskStats)
+	return taskStatModel.Query(q, map[string]interface{}{"key": key})
+}
+
+// queryRecentTaskStats returns the 10 most recent task stats of the key.
+func queryRecentTaskStats(key string, taskStatModel Model) ([]interface{}, error) {
+	if m, ok := sqlModel(taskStatModel); ok {
+		args := sqlArgs{}
+		q := fmt.Sprintf(
+			"SELECT doc FROM %s WHERE %s = %s ORDER BY %s DESC LIMIT 10",
+			CollectionTaskStats,
+			sqlAttr("key"),
+			args.json(key),
+			sqlTime("created"),
+		)
+		return m.QuerySQL(q, args...)
+	}
+	q := fmt.Sprintf(
+		"FOR t IN %s FILTER t.key == @key SORT t.created DESC LIMIT 10 RETURN t",
+		CollectionTaskStats,
+	)
+	return taskStatModel.Query(q, map[string]interface{}{"key": key})
+}
+
+// queryDueFailedEvents returns the pending failed events that are due at
+// now in the order they were stored.
+func queryDueFailedEvents(now time.Time, eventModel Model) ([]interface{}, error) {
+	if m, ok := sqlModel(eventModel); ok {
+		args := sqlArgs{}
+		q := fmt.Sprintf(
+			"SELECT doc FROM %s WHERE %s = %s AND %s <= %s ORDER BY %s",
+			CollectionFailedEvents,
+			sqlAttr("status"),
+			args.json(FailedEventPending),
+			sqlTime("nextAttemptAt"),
+			args.add(now),
+			sqlTime("created"),
+		)
+		return m.QuerySQL(q, args...)
+	}
+	q := fmt.Sprintf(
+		`FOR e IN %s FILTER e.status == @status AND DATE_TIMESTAMP(e.nextAttemptAt) <= @now SORT e.created ASC RETURN e`,
+		CollectionFailedEvents,
+	)
+	vars := map[string]interface{}{
+		"now":    now.UnixNano() / int64(time.Millisecond),
+		"status": FailedEventPending,
+	}
+	return eventModel.Query(q, vars)
+}
+
+// queryFailedEvents returns up to limit failed events with the status in
+// the order they were stored. The status filter is omitted when empty.
+func queryFailedEvents(status string, limit int, eventModel Model) ([]interface{}, error) {
+	if m, ok := sqlModel(eventModel); ok {
+		args := sqlArgs{}
+		conds := make([]string, 0, 1)
+		if status != "" {
+			conds = append(conds, fmt.Sprintf("%s = %s", sqlAttr("status"), args.json(status)))
+		}
+		q := fmt.Sprintf(
+			"SELECT doc FROM %s%s ORDER BY %s LIMIT %s",
+			CollectionFailedEvents,
+			sqlWhere(conds),
+			sqlTime("created"),
+			args.add(limit),
+		)
+		return m.QuerySQL(q, args...)
+	}
+	q := fmt.Sprintf("FOR e IN %s", CollectionFailedEvents)
+	vars := map[string]interface{}{"limit": limit}
+	if status != "" {
+		q += " FILTER e.status == @status"
+		vars["status"] = status
+	}
+	q += " SORT e.created ASC LIMIT @limit RETURN e"
+	return eventModel.Query(q, vars)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
+
+// mockSQLModel is a mock model that runs sql statements natively.
+type mockSQLModel struct {
+	MockModel
+}
+
+func (m *mockSQLModel) QuerySQL(q string, args ...interface{}) ([]interface{}, error) {
+	ret := m.Called(q, args)
+	docs, _ := ret.Get(0).([]interface{})
+	return docs, ret.Error(1)
+}
+
+func (m *mockSQLModel) RemoveSQL(q string, args ...interface{}) ([]interface{}, error) {
+	ret := m.Called(q, args)
+	docs, _ := ret.Get(0).([]interface{})
+	return docs, ret.Error(1)
+}
+
+func (m *mockSQLModel) StreamSQL(q string, args ...interface{}) (DocumentIterator, error) {
+	ret := m.Called(q, args)
+	it, _ := ret.Get(0).(DocumentIterator)
+	return it, ret.Error(1)
+}
+
+func (m *mockSQLModel) PageSQL(where string, order string, offset int, limit int, args ...interface{}) (*Page, error) {
+	ret := m.Called(where, order, offset, limit, args)
+	page, _ := ret.Get(0).(*Page)
+	return page, ret.Error(1)
+}
+
+func TestSQLModel(t *testing.T) {
+	var table = []struct {
+		Model Model
+		SQL   bool
+	}{
+		{new(MockModel), false},
+		{new(mockSQLModel), true},
+		{NewCachedModel(new(MockModel), newMemoryCache(), CollectionTasks, nil), false},
+		{NewCachedModel(new(mockSQLModel), newMemoryCache(), CollectionTasks, nil), true},
+		{&PostgresModel{}, true},
+	}
+
+	for i, tt := range table {
+		if _, ok := sqlModel(tt.Model); ok != tt.SQL {
+			t.Fatalf("[%d] expected sql model %v, got %v", i, tt.SQL, ok)
+		}
+	}
+}
+
+func TestQueryTaskCountsSQL(t *testing.T) {
+	var table = []struct {
+		ByKey bool
+		Group string
+	}{
+		{false, "GROUP BY doc -> 'status'"},
+		{true, "GROUP BY doc -> 'status', doc -> 'key'"},
+	}
+
+	for i, tt := range table {
+		countModel := new(mockSQLModel)
+		countModel.On("QuerySQL", mock.MatchedBy(func(q string) bool { return strings.HasSuffix(q, tt.Group) }), []interface{}(nil)).
+			Return([]interface{}{&TaskCount{Status: StatusQueued, Count: 2}}, nil)
+		counts, err := NewResourceController(nil).CountTasks(tt.ByKey, countModel)
+		if err != nil {
+			t.Fatalf("[%d] %v", i, err)
+		}
+		if len(counts) != 1 || counts[0].Count != 2 {
+			t.Fatalf("[%d] expected 2 queued tasks, got %v", i, counts)
+		}
+		countModel.AssertExpectations(t)
+	}
+}
+
+func TestPurgeTasksSQL(t *testing.T) {
+	taskModel := new(mockSQLModel)
+	taskModel.On("RemoveSQL", mock.MatchedBy(func(q string) bool { return strings.HasPrefix(q, "DELETE FROM "+CollectionTasks) }), mock.Anything).
+		Return([]interface{}{&Task{Id: "a"}, &Task{Id: "b"}}, nil)
+	count, err := NewResourceController(nil).PurgeTasks(time.Hour, 10, taskModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 purged tasks, got %d", count)
+	}
+	taskModel.AssertNotCalled(t, "Query", mock.Anything, mock.Anything)
+}
+
+func TestSearchTasksSQL(t *testing.T) {
+	where := "doc -> 'meta' -> $1::text -> $2::text = $3::jsonb AND doc -> 'labelIndex' @> $4::jsonb"
+	args := []interface{}{"a", "b", `"c"`, `["env=prod"]`}
+	taskModel := new(mockSQLModel)
+	taskModel.On("PageSQL", where, "(doc ->> 'created')::timestamptz", 0, 1, args).
+		Return(&Page{Docs: []interface{}{&Task{Id: "a"}}, Total: 2}, nil)
+	page, err := NewResourceController(nil).SearchTasks(map[string]interface{}{"a.b": "c"}, map[string]string{"env": "prod"}, 1, 0, taskModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Tasks) != 1 || page.Total != 2 || page.Cursor == "" {
+		t.Fatalf("expected the first of 2 tasks with a cursor, got %v", page)
+	}
+	taskModel.AssertExpectations(t)
+}
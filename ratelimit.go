@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// StartLimiter limits the rate of task starts per resource key with a token
+// bucket per key. A nil limiter allows all starts. All methods are safe for
+// concurrent use.
+type StartLimiter struct {
+	rate    float64
+	burst   float64
+	mu      sync.Mutex
+	buckets map[string]*startBucket
+}
+
+// startBucket holds the start tokens of a key as of the last update.
+type startBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// StartLimitState is the state of the start rate limiter of a resource key.
+type StartLimitState struct {
+	// Rate is the number of starts allowed per minute.
+	// Burst is the number of starts allowed at once.
+	// Tokens is the number of starts currently allowed.
+	// NextStartAt is the time the next start is allowed, if none is
+	// currently allowed.
+	Rate        float64    `json:"rate"`
+	Burst       int        `json:"burst"`
+	Tokens      float64    `json:"tokens"`
+	NextStartAt *time.Time `json:"nextStartAt,omitempty"`
+}
+
+// NewStartLimiter creates a new start limiter that allows the provided
+// number of starts per minute and key. The burst is at least one start.
+func NewStartLimiter(rate float64, burst int) *StartLimiter {
+	return &StartLimiter{
+		rate:    rate,
+		burst:   math.Max(float64(burst), 1),
+		buckets: make(map[string]*startBucket),
+	}
+}
+
+// Ready indicates whether a start is allowed for the key without taking
+// it.
+func (l *StartLimiter) Ready(key string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.refill(key, now).tokens >= 1
+}
+
+// Take takes a start for the key. False is returned if no start is
+// allowed.
+func (l *StartLimiter) Take(key string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket := l.refill(key, now)
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// State returns the state of the limiter for the key. Nil is returned if
+// the limiter is nil.
+func (l *StartLimiter) State(key string, now time.Time) *StartLimitState {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket := l.refill(key, now)
+	state := &StartLimitState{Rate: l.rate, Burst: int(l.burst), Tokens: bucket.tokens}
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Minute))
+		next := now.Add(wait)
+		state.NextStartAt = &next
+	}
+	return state
+}
+
+// Forget removes the bucket of the key.
+func (l *StartLimiter) Forget(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.buckets, key)
+}
+
+// refill returns the bucket of the key with the tokens accrued since the
+// last update. A new bucket is full.
+func (l *StartLimiter) refill(key string, now time.Time) *startBucket {
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &startBucket{l.burst, now}
+		l.buckets[key] = bucket
+		return bucket
+	}
+	if elapsed := now.Sub(bucket.updated); elapsed > 0 {
+		bucket.tokens = math.Min(l.burst, bucket.tokens+elapsed.Minutes()*l.rate)
+		bucket.updated = now
+	}
+	return bucket
+}
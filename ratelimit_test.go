@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStartLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := NewStartLimiter(30, 2)
+	for i := 0; i < 2; i++ {
+		if !limiter.Take("test", now) {
+			t.Fatalf("[%d] expected the start to be allowed within the burst", i)
+		}
+	}
+	if limiter.Ready("test", now) || limiter.Take("test", now) {
+		t.Fatal("expected the start to be rate limited")
+	}
+	if !limiter.Ready("other", now) {
+		t.Fatal("expected the keys to be limited separately")
+	}
+	state := limiter.State("test", now)
+	if state.Rate != 30 || state.Burst != 2 || state.Tokens != 0 {
+		t.Fatalf("unexpected limiter state %+v", state)
+	}
+	if state.NextStartAt == nil || !state.NextStartAt.Equal(now.Add(time.Second*2)) {
+		t.Fatalf("expected the next start in 2s, got %v", state.NextStartAt)
+	}
+	if !limiter.Take("test", now.Add(time.Second*2)) {
+		t.Fatal("expected the start to be allowed after the refill")
+	}
+	if state := limiter.State("test", now.Add(time.Hour)); state.Tokens != 2 || state.NextStartAt != nil {
+		t.Fatalf("expected the tokens to be capped at the burst, got %+v", state)
+	}
+	limiter.Forget("test")
+	if _, ok := limiter.buckets["test"]; ok {
+		t.Fatal("expected the bucket to be removed")
+	}
+
+	var nilLimiter *StartLimiter
+	if !nilLimiter.Take("test", now) || nilLimiter.State("test", now) != nil {
+		t.Fatal("expected a nil limiter to allow all starts")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"time"
 )
 
 const (
@@ -13,15 +14,140 @@ type ResourceStatus int // resource status type
 
 // Resource is a unit required by a task that is managed by the controller.
 type Resource struct {
+	// Created is the resource creation timestamp.
+	// Draining indicates that no new tasks are staged or started.
+	// HeartbeatAt is the time of the last heartbeat of the worker agent.
+	// LockedAt is the time the resource was locked by the started task.
 	// Name is the name of resource.
+	// Offline indicates that the worker agent missed its heartbeats. No
+	// tasks are staged for offline resources.
+	// Parent is the name of the parent resource. A resource cannot be
+	// locked while its parent or one of its children is locked.
+	// Pool is the name of the resource pool the resource is a member of.
+	// Quota limits the number of tasks started on the resource.
+	// QuotaStarts are the start times of the tasks counted by the quota.
+	// Registered indicates that the resource was registered by a worker
+	// agent and is removed after prolonged heartbeat silence.
 	// Status indicates if the resource is locked or free.
-	Name   string         `json:"_key"`
-	Status ResourceStatus `json:"status"`
+	// Tags are key value pairs matched against the constraints of tasks.
+	// TaskId is the id of the task staged or started on the resource.
+	// Updated is the last resource update timestamp.
+	// UpdatedBy is the caller the resource was last updated by.
+	// Weight is the staging preference of the resource. Free resources
+	// with a higher weight stage tasks first.
+	Created     time.Time         `json:"created"`
+	Draining    bool              `json:"draining"`
+	HeartbeatAt *time.Time        `json:"heartbeatAt,omitempty"`
+	LockedAt    *time.Time        `json:"lockedAt"`
+	Name        string            `json:"_key"`
+	Offline     bool              `json:"offline"`
+	Parent      string            `json:"parent,omitempty"`
+	Pool        string            `json:"pool,omitempty"`
+	Quota       *ResourceQuota    `json:"quota,omitempty"`
+	QuotaStarts []time.Time       `json:"quotaStarts,omitempty"`
+	Registered  bool              `json:"registered,omitempty"`
+	Status      ResourceStatus    `json:"status"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	TaskId      string            `json:"taskId"`
+	Updated     time.Time         `json:"updated"`
+	UpdatedBy   string            `json:"updatedBy,omitempty"`
+	Weight      float64           `json:"weight"`
+}
+
+// ResourceQuota limits the number of tasks started on a resource in a
+// rolling period.
+type ResourceQuota struct {
+	// Limit is the maximum number of tasks started in the period.
+	// Period is the length of the rolling period in seconds.
+	Limit  int     `json:"limit"`
+	Period float64 `json:"period"`
+}
+
+// ResourceDetail contains the diagnostic details of a resource.
+type ResourceDetail struct {
+	// LockedFor is the number of seconds the resource has been locked.
+	// QueueDepth is the number of tasks in the resource priority queue.
+	// TimetableDepth is the number of tasks in the resource timetable.
+	// StartLimit is the state of the start rate limiter of the resource, if
+	// task starts are rate limited.
+	*Resource
+	LockedFor      float64          `json:"lockedFor"`
+	QueueDepth     int              `json:"queueDepth"`
+	TimetableDepth int              `json:"timetableDepth"`
+	StartLimit     *StartLimitState `json:"startLimit,omitempty"`
+}
+
+// ResourceStat is a period in which a resource was locked by a task.
+type ResourceStat struct {
+	// Ended is the time the resource was unlocked.
+	// Resource is the name of the resource.
+	// Started is the time the resource was locked.
+	Ended    time.Time `json:"ended"`
+	Resource string    `json:"resource"`
+	Started  time.Time `json:"started"`
+}
+
+// NewResourceStat creates a new resource stat instance.
+func NewResourceStat(resource string, started time.Time, ended time.Time) *ResourceStat {
+	return &ResourceStat{ended, resource, started}
+}
+
+// Save creates a new document for the resource stat in the database.
+func (rescStat *ResourceStat) Save(resourceStatModel Model) (DocumentMeta, error) {
+	return resourceStatModel.Save(rescStat)
+}
+
+// ResourceUtilization is the busy and idle time of a resource in a window
+// of time.
+type ResourceUtilization struct {
+	// Busy is the number of seconds the resource was locked.
+	// Idle is the number of seconds the resource was not locked.
+	// Utilization is the percentage of the window the resource was locked.
+	// Window is the length of the window in seconds.
+	Busy        float64 `json:"busy"`
+	Idle        float64 `json:"idle"`
+	Utilization float64 `json:"utilization"`
+	Window      float64 `json:"window"`
+}
+
+// NewResourceUtilization calculates the utilization of the busy periods in
+// the window that ends at the provided time.
+func NewResourceUtilization(window time.Duration, end time.Time, periods []*ResourceStat) *ResourceUtilization {
+	start := end.Add(-window)
+	var busy time.Duration
+	for _, period := range periods {
+		from, to := period.Started, period.Ended
+		if from.Before(start) {
+			from = start
+		}
+		if to.After(end) {
+			to = end
+		}
+		if to.After(from) {
+			busy += to.Sub(from)
+		}
+	}
+	if busy > window {
+		busy = window
+	}
+	util := &ResourceUtilization{Busy: busy.Seconds(), Idle: (window - busy).Seconds(), Window: window.Seconds()}
+	if window > 0 {
+		util.Utilization = float64(busy) / float64(window) * 100
+	}
+	return util
+}
+
+// ResourceStats is the utilization of a resource over several windows.
+type ResourceStats struct {
+	// Name is the name of the resource.
+	// Windows is the utilization of the resource in each window.
+	Name    string                 `json:"name"`
+	Windows []*ResourceUtilization `json:"windows"`
 }
 
 // NewResource creates a new resource and sets the default free status.
 func NewResource(name string) *Resource {
-	return &Resource{name, ResourceFree}
+	return &Resource{Name: name, Status: ResourceFree}
 }
 
 // Acquire puts the resource in the locked state.
@@ -42,6 +168,42 @@ func (resc *Resource) Release() error {
 	return nil
 }
 
+// QuotaExhausted returns true if the number of tasks started on the
+// resource in the rolling quota period reached the quota limit. Starts
+// that are outside of the period are dropped.
+func (resc *Resource) QuotaExhausted(now time.Time) bool {
+	if resc.Quota == nil {
+		return false
+	}
+	since := now.Add(-time.Duration(resc.Quota.Period * float64(time.Second)))
+	starts := resc.QuotaStarts[:0]
+	for _, start := range resc.QuotaStarts {
+		if start.After(since) {
+			starts = append(starts, start)
+		}
+	}
+	resc.QuotaStarts = starts
+	return len(resc.QuotaStarts) >= resc.Quota.Limit
+}
+
+// RecordStart counts the task start against the quota of the resource.
+func (resc *Resource) RecordStart(start time.Time) {
+	if resc.Quota != nil {
+		resc.QuotaStarts = append(resc.QuotaStarts, start)
+	}
+}
+
+// Satisfies returns true if the resource has a tag with the value of
+// every constraint.
+func (resc *Resource) Satisfies(constraints map[string]string) bool {
+	for k, v := range constraints {
+		if tag, ok := resc.Tags[k]; !ok || tag != v {
+			return false
+		}
+	}
+	return true
+}
+
 // Save create a new document for the resource in the database.
 func (resc *Resource) Save(resourceModel Model) (DocumentMeta, error) {
 	return resourceModel.Save(resc)
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"testing"
+	"time"
 )
 
 func TestResourceAcquire(t *testing.T) {
@@ -57,3 +58,88 @@ func TestResourceSave(t *testing.T) {
 		model.AssertExpectations(t)
 	}
 }
+
+func TestResourceSatisfies(t *testing.T) {
+	var table = []struct {
+		Tags        map[string]string
+		Constraints map[string]string
+		Satisfied   bool
+	}{
+		{nil, nil, true},
+		{map[string]string{"gpu": "true"}, nil, true},
+		{map[string]string{"gpu": "true", "zone": "a"}, map[string]string{"gpu": "true"}, true},
+		{map[string]string{"gpu": "false"}, map[string]string{"gpu": "true"}, false},
+		{nil, map[string]string{"gpu": "true"}, false},
+	}
+
+	for i, tt := range table {
+		resc := &Resource{Name: "test", Tags: tt.Tags}
+		if resc.Satisfies(tt.Constraints) != tt.Satisfied {
+			t.Fatalf("[%d] expected satisfied to be %t", i, tt.Satisfied)
+		}
+	}
+}
+
+func TestNewResourceUtilization(t *testing.T) {
+	end := time.Now()
+	periods := []*ResourceStat{
+		NewResourceStat("test", end.Add(-time.Hour*2), end.Add(-time.Minute*90)),
+		NewResourceStat("test", end.Add(-time.Minute*45), end.Add(-time.Minute*30)),
+		NewResourceStat("test", end.Add(-time.Minute*15), end),
+	}
+	var table = []struct {
+		Window      time.Duration
+		Busy        float64
+		Utilization float64
+	}{
+		{time.Hour, 1800, 50},
+		{time.Minute * 30, 900, 50},
+		{time.Hour * 4, 3600, 25},
+		{time.Minute * 10, 600, 100},
+	}
+
+	for i, tt := range table {
+		util := NewResourceUtilization(tt.Window, end, periods)
+		if util.Busy != tt.Busy || util.Idle != tt.Window.Seconds()-tt.Busy || util.Utilization != tt.Utilization {
+			t.Fatalf("[%d] unexpected utilization %+v", i, util)
+		}
+	}
+}
+
+func TestResourceQuotaExhausted(t *testing.T) {
+	now := time.Now()
+	var table = []struct {
+		Quota     *ResourceQuota
+		Starts    []time.Time
+		Exhausted bool
+		Remaining int
+	}{
+		{nil, nil, false, 0},
+		{&ResourceQuota{Limit: 2, Period: 3600}, []time.Time{now.Add(-time.Minute)}, false, 1},
+		{&ResourceQuota{Limit: 2, Period: 3600}, []time.Time{now.Add(-time.Minute * 2), now.Add(-time.Minute)}, true, 2},
+		{&ResourceQuota{Limit: 2, Period: 3600}, []time.Time{now.Add(-time.Hour * 2), now.Add(-time.Minute)}, false, 1},
+	}
+
+	for i, tt := range table {
+		resc := &Resource{Name: "test", Quota: tt.Quota, QuotaStarts: tt.Starts}
+		if resc.QuotaExhausted(now) != tt.Exhausted {
+			t.Fatalf("[%d] expected exhausted to be %t", i, tt.Exhausted)
+		}
+		if len(resc.QuotaStarts) != tt.Remaining {
+			t.Fatalf("[%d] expected %d counted starts, got %d", i, tt.Remaining, len(resc.QuotaStarts))
+		}
+	}
+}
+
+func TestResourceRecordStart(t *testing.T) {
+	resc := &Resource{Name: "test"}
+	resc.RecordStart(time.Now())
+	if len(resc.QuotaStarts) != 0 {
+		t.Fatal("expected starts not to be counted without a quota")
+	}
+	resc.Quota = &ResourceQuota{Limit: 1, Period: 60}
+	resc.RecordStart(time.Now())
+	if len(resc.QuotaStarts) != 1 {
+		t.Fatal("expected start to be counted")
+	}
+}
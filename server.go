@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/bitwurx/jrpc2"
+)
+
+const (
+	MaxBatchSize  = 100                 // the maximum number of requests in a batch.
+	ProxiedHeader = "X-Concord-Proxied" // the signature of requests proxied by another controller instance.
+	ProxyTimeout  = time.Second * 30    // the proxied request timeout.
+)
+
+const (
+	ProxyErrorCode jrpc2.ErrorCode = -32056
+	ProxyErrorMsg  jrpc2.ErrorMsg  = "error proxying request"
+)
+
+// MethodRegistry registers json-rpc methods by name.
+type MethodRegistry interface {
+	Register(string, jrpc2.Method)
+}
+
+// ContextMethod is a json-rpc method that is called with the context of its
+// request, which is canceled once the client is gone.
+type ContextMethod func(context.Context, json.RawMessage) (interface{}, *jrpc2.ErrorObject)
+
+// ContextRegistry registers json-rpc methods that are called with the
+// context of their request by name.
+type ContextRegistry interface {
+	MethodRegistry
+	RegisterContext(string, ContextMethod)
+}
+
+// registerContext registers the context method with the registry. The
+// method is called with the background context if the registry does not
+// pass on the contexts of its requests.
+func registerContext(s MethodRegistry, name string, method ContextMethod) {
+	if registry, ok := s.(ContextRegistry); ok {
+		registry.RegisterContext(name, method)
+		return
+	}
+	s.Register(name, jrpc2.Method{Method: func(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+		return method(context.Background(), params)
+	}})
+}
+
+// Router returns the address of the controller instance that serves the
+// request with the method and params. An empty string is returned if the
+// request is served locally.
+type Router interface {
+	Route(string, json.RawMessage) string
+}
+
+// Request is a json-rpc 2.0 request object.
+type Request struct {
+	// Id is the request id. Notifications have no id; a null id is kept
+	// so that the request is answered.
+	// Jsonrpc is the protocol version.
+	// Method is the name of the called method.
+	// Params are the method parameters.
+	Id      json.RawMessage `json:"id,omitempty"`
+	Jsonrpc string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+// Dispatcher is a json-rpc 2.0 http server that handles single requests
+// and batches of requests.
+type Dispatcher struct {
+	host     string
+	route    string
+	methods  map[string]ContextMethod
+	handlers map[string]http.Handler
+	router   Router
+	secret   string
+	scheme   string
+	client   *http.Client
+	server   *http.Server
+}
+
+// NewDispatcher creates a new dispatcher that listens on the host and
+// serves the route.
+func NewDispatcher(host string, route string) *Dispatcher {
+	return &Dispatcher{
+		host:     host,
+		route:    route,
+		methods:  make(map[string]ContextMethod),
+		handlers: make(map[string]http.Handler),
+		scheme:   "http",
+		client:   &http.Client{Timeout: ProxyTimeout},
+		server:   &http.Server{Addr: host},
+	}
+}
+
+// Register adds the method to the dispatcher with the provided name.
+func (d *Dispatcher) Register(name string, method jrpc2.Method) {
+	d.methods[name] = func(ctx context.Context, params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+		return method.Method(params)
+	}
+}
+
+// RegisterContext adds the method that is called with the context of its
+// request to the dispatcher with the provided name.
+func (d *Dispatcher) RegisterContext(name string, method ContextMethod) {
+	d.methods[name] = method
+}
+
+// Handle serves the route with the handler next to the dispatcher route.
+func (d *Dispatcher) Handle(route string, handler http.Handler) {
+	d.handlers[route] = handler
+}
+
+// Proxy forwards the requests the router routes to another controller
+// instance to that instance. Proxied requests are always served locally,
+// so requests are not passed on twice while the instances disagree about
+// the routes. The forwarded requests are signed with the secret shared by
+// the instances, and requests without a valid signature are routed like
+// the requests of any other client.
+func (d *Dispatcher) Proxy(router Router, secret string) {
+	d.router = router
+	d.secret = secret
+}
+
+// ProxyTLS forwards the requests over https with the tls configuration.
+func (d *Dispatcher) ProxyTLS(config *tls.Config) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	d.client = &http.Client{Transport: transport, Timeout: ProxyTimeout}
+	d.scheme = "https"
+}
+
+// ServeHTTP handles the json-rpc request or batch in the request body. The
+// methods are called with the context of the http request, which is
+// canceled when the client disconnects.
+func (d *Dispatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := d.dispatch(r.Context(), body, d.proxied(r.Header.Get(ProxiedHeader), body))
+	if resp == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Dispatch calls the methods of the request or batch of requests in the
+// body and returns the response. nil is returned if there is nothing to
+// respond with because all requests were notifications.
+func (d *Dispatcher) Dispatch(body []byte) interface{} {
+	return d.dispatch(context.Background(), body, false)
+}
+
+// dispatch calls the methods of the request or batch of requests in the
+// body with ctx. The requests are served locally if proxied is set.
+func (d *Dispatcher) dispatch(ctx context.Context, body []byte, proxied bool) interface{} {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 || body[0] != '[' {
+		var req Request
+		if err := json.Unmarshal(body, &req); err != nil {
+			return newResponse(nil, nil, &jrpc2.ErrorObject{
+				Code:    jrpc2.ParseErrorCode,
+				Message: jrpc2.ParseErrorMsg,
+			})
+		}
+		return d.call(ctx, &req, proxied)
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return newResponse(nil, nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.ParseErrorCode,
+			Message: jrpc2.ParseErrorMsg,
+		})
+	}
+	if len(batch) == 0 || len(batch) > MaxBatchSize {
+		return newResponse(nil, nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidRequestCode,
+			Message: jrpc2.InvalidRequestMsg,
+			Data:    fmt.Sprintf("batch must contain between 1 and %d requests", MaxBatchSize),
+		})
+	}
+	responses := make([]interface{}, 0, len(batch))
+	for _, raw := range batch {
+		var req Request
+		if err := json.Unmarshal(raw, &req); err != nil {
+			responses = append(responses, newResponse(nil, nil, &jrpc2.ErrorObject{
+				Code:    jrpc2.InvalidRequestCode,
+				Message: jrpc2.InvalidRequestMsg,
+			}))
+			continue
+		}
+		if resp := d.call(ctx, &req, proxied); resp != nil {
+			responses = append(responses, resp)
+		}
+	}
+	if len(responses) == 0 {
+		return nil
+	}
+	return responses
+}
+
+// Start listens on the dispatcher host and serves the dispatcher route and
+// the routes of the handlers. http.ErrServerClosed is returned after the
+// dispatcher is shut down.
+func (d *Dispatcher) Start() error {
+	mux := http.NewServeMux()
+	mux.Handle(d.route, d)
+	for route, handler := range d.handlers {
+		mux.Handle(route, handler)
+	}
+	d.server.Handler = mux
+	return d.server.ListenAndServe()
+}
+
+// Shutdown stops accepting requests and waits for the requests in flight
+// to be answered or for the context to be done.
+func (d *Dispatcher) Shutdown(ctx context.Context) error {
+	return d.server.Shutdown(ctx)
+}
+
+// call runs the method of the request with ctx and returns the response.
+// nil is returned for notifications unless the request is invalid. The
+// request is forwarded if the router routes it to another instance, unless
+// proxied is set. A panic of the method is answered with an internal error.
+func (d *Dispatcher) call(ctx context.Context, req *Request, proxied bool) (resp interface{}) {
+	var result interface{}
+	var errObj *jrpc2.ErrorObject
+
+	defer func() {
+		if r := recover(); r != nil {
+			logf(ctx, "recovered from panic in method [%s]: %v\n", req.Method, r)
+			resp = nil
+			if req.Id != nil {
+				resp = newResponse(req.Id, nil, &jrpc2.ErrorObject{
+					Code:    jrpc2.InternalErrorCode,
+					Message: jrpc2.InternalErrorMsg,
+				})
+			}
+		}
+	}()
+
+	if req.Jsonrpc != "2.0" || req.Method == "" {
+		errObj = &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidRequestCode,
+			Message: jrpc2.InvalidRequestMsg,
+		}
+	} else if addr := d.routeTo(req, proxied); addr != "" {
+		return d.forward(ctx, addr, req)
+	} else if method, ok := d.methods[req.Method]; !ok {
+		errObj = &jrpc2.ErrorObject{
+			Code:    jrpc2.MethodNotFoundCode,
+			Message: jrpc2.MethodNotFoundMsg,
+		}
+	} else {
+		result, errObj = method(ctx, req.Params)
+	}
+	if req.Id == nil && (errObj == nil || errObj.Code != jrpc2.InvalidRequestCode) {
+		return nil
+	}
+	return newResponse(req.Id, result, errObj)
+}
+
+// routeTo returns the address of the instance the request is forwarded to.
+func (d *Dispatcher) routeTo(req *Request, proxied bool) string {
+	if d.router == nil || proxied {
+		return ""
+	}
+	return d.router.Route(req.Method, req.Params)
+}
+
+// proxied indicates whether the signature is the signature of the body
+// by another instance.
+func (d *Dispatcher) proxied(signature string, body []byte) bool {
+	if d.secret == "" || signature == "" {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(signBody(d.secret, body)))
+}
+
+// forward sends the request to the dispatcher of the instance at the
+// address and returns its response. The request is abandoned when ctx is
+// done.
+func (d *Dispatcher) forward(ctx context.Context, addr string, req *Request) interface{} {
+	body, _ := json.Marshal(req)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, d.scheme+"://"+addr+d.route, bytes.NewReader(body))
+	if err != nil {
+		return proxyError(req, err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set(ProxiedHeader, signBody(d.secret, body))
+	resp, err := d.client.Do(httpReq)
+	if err != nil {
+		return proxyError(req, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return proxyError(req, err)
+	}
+	return result
+}
+
+// proxyError returns the error response for the request that could not be
+// forwarded. nil is returned for notifications.
+func proxyError(req *Request, err error) interface{} {
+	if req.Id == nil {
+		return nil
+	}
+	return newResponse(req.Id, nil, &jrpc2.ErrorObject{
+		Code:    ProxyErrorCode,
+		Message: ProxyErrorMsg,
+		Data:    err.Error(),
+	})
+}
+
+// newResponse returns the response object for the request id.
+func newResponse(id json.RawMessage, result interface{}, errObj *jrpc2.ErrorObject) map[string]interface{} {
+	resp := map[string]interface{}{"jsonrpc": "2.0", "id": id}
+	if errObj != nil {
+		resp["error"] = errObj
+	} else {
+		resp["result"] = result
+	}
+	return resp
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitwurx/jrpc2"
+)
+
+func newTestDispatcher() *Dispatcher {
+	d := NewDispatcher("", "/rpc")
+	d.Register("echo", jrpc2.Method{Method: func(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+		var args []interface{}
+		json.Unmarshal(params, &args)
+		if len(args) == 0 {
+			return nil, &jrpc2.ErrorObject{Code: jrpc2.InvalidParamsCode, Message: jrpc2.InvalidParamsMsg}
+		}
+		return args[0], nil
+	}})
+	d.Register("panic", jrpc2.Method{Method: func(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+		panic("method failed")
+	}})
+	return d
+}
+
+func TestDispatcherDispatch(t *testing.T) {
+	var table = []struct {
+		Body     string
+		Response string
+	}{
+		{
+			`{"jsonrpc": "2.0", "method": "echo", "params": ["abc"], "id": 1}`,
+			`{"id":1,"jsonrpc":"2.0","result":"abc"}`,
+		},
+		{
+			`{"jsonrpc": "2.0", "method": "echo", "params": ["abc"]}`,
+			`null`,
+		},
+		{
+			`{"jsonrpc": "2.0", "method": "echo", "params": ["abc"], "id": null}`,
+			`{"id":null,"jsonrpc":"2.0","result":"abc"}`,
+		},
+		{
+			`{"jsonrpc": "2.0", "method": "panic", "id": 2}`,
+			`{"error":{"code":-32603,"message":"Internal error"},"id":2,"jsonrpc":"2.0"}`,
+		},
+		{
+			`{"jsonrpc": "2.0", "method": "panic"}`,
+			`null`,
+		},
+		{
+			`{"jsonrpc": "2.0", "method": "missing", "id": "a"}`,
+			`{"error":{"code":-32601,"message":"Method not found"},"id":"a","jsonrpc":"2.0"}`,
+		},
+		{
+			`{"jsonrpc": "2.0", "method": "echo", "params": [`,
+			`{"error":{"code":-32700,"message":"Parse error"},"id":null,"jsonrpc":"2.0"}`,
+		},
+		{
+			`[]`,
+			`{"error":{"code":-32600,"message":"Invalid Request","data":"batch must contain between 1 and 100 requests"},"id":null,"jsonrpc":"2.0"}`,
+		},
+		{
+			`[
+				{"jsonrpc": "2.0", "method": "echo", "params": [1], "id": 1},
+				{"jsonrpc": "2.0", "method": "echo", "params": [2]},
+				{"jsonrpc": "2.0", "method": "echo", "params": [], "id": 3},
+				{"method": "echo", "id": 4},
+				5
+			]`,
+			`[` +
+				`{"id":1,"jsonrpc":"2.0","result":1},` +
+				`{"error":{"code":-32602,"message":"Invalid params"},"id":3,"jsonrpc":"2.0"},` +
+				`{"error":{"code":-32600,"message":"Invalid Request"},"id":4,"jsonrpc":"2.0"},` +
+				`{"error":{"code":-32600,"message":"Invalid Request"},"id":null,"jsonrpc":"2.0"}` +
+				`]`,
+		},
+		{
+			`[{"jsonrpc": "2.0", "method": "echo", "params": [1]}]`,
+			`null`,
+		},
+	}
+
+	d := newTestDispatcher()
+	for i, tt := range table {
+		resp, _ := json.Marshal(d.Dispatch([]byte(tt.Body)))
+		if string(resp) != tt.Response {
+			t.Fatalf("[%d] expected response %s, got %s", i, tt.Response, string(resp))
+		}
+	}
+}
+
+func TestDispatcherServeHTTP(t *testing.T) {
+	var table = []struct {
+		Method string
+		Body   string
+		Code   int
+	}{
+		{http.MethodPost, `{"jsonrpc": "2.0", "method": "echo", "params": ["abc"], "id": 1}`, http.StatusOK},
+		{http.MethodPost, `{"jsonrpc": "2.0", "method": "echo", "params": ["abc"]}`, http.StatusNoContent},
+		{http.MethodGet, ``, http.StatusMethodNotAllowed},
+	}
+
+	d := newTestDispatcher()
+	for _, tt := range table {
+		req := httptest.NewRequest(tt.Method, "/rpc", bytes.NewBufferString(tt.Body))
+		w := httptest.NewRecorder()
+		d.ServeHTTP(w, req)
+		if w.Code != tt.Code {
+			t.Fatalf("expected status code %d, got %d", tt.Code, w.Code)
+		}
+	}
+}
+
+func TestDispatcherRequestContext(t *testing.T) {
+	d := newTestDispatcher()
+	d.RegisterContext("wait", func(ctx context.Context, params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+		<-ctx.Done()
+		return ctx.Err().Error(), nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	body := `{"jsonrpc": "2.0", "method": "wait", "id": 1}`
+	req := httptest.NewRequest(http.MethodPost, "/rpc", bytes.NewBufferString(body)).WithContext(ctx)
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, req)
+	if resp := strings.TrimSpace(w.Body.String()); resp != `{"id":1,"jsonrpc":"2.0","result":"context canceled"}` {
+		t.Fatalf("expected canceled request context, got %s", resp)
+	}
+}
+
+type staticRouter string
+
+func (r staticRouter) Route(method string, params json.RawMessage) string {
+	if method != "echo" {
+		return ""
+	}
+	return string(r)
+}
+
+func TestDispatcherProxy(t *testing.T) {
+	owner := newTestDispatcher()
+	owner.Register("echo", jrpc2.Method{Method: func(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+		return "owner", nil
+	}})
+	srv := httptest.NewServer(owner)
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	owner.Proxy(staticRouter("127.0.0.1:1"), "secret")
+
+	var table = []struct {
+		Router   staticRouter
+		Secret   string
+		Body     string
+		Response string
+	}{
+		{"", "secret", `{"jsonrpc": "2.0", "method": "echo", "params": ["abc"], "id": 1}`, `{"id":1,"jsonrpc":"2.0","result":"abc"}`},
+		{staticRouter(addr), "secret", `{"jsonrpc": "2.0", "method": "echo", "params": ["abc"], "id": 1}`, `{"id":1,"jsonrpc":"2.0","result":"owner"}`},
+		{staticRouter(addr), "secret", `{"jsonrpc": "2.0", "method": "echo", "params": ["abc"]}`, `null`},
+		{staticRouter(addr), "secret", `{"jsonrpc": "2.0", "method": "missing", "id": 2}`, `{"error":{"code":-32601,"message":"Method not found"},"id":2,"jsonrpc":"2.0"}`},
+		{
+			staticRouter("127.0.0.1:1"),
+			"secret",
+			`{"jsonrpc": "2.0", "method": "echo", "params": ["abc"], "id": 3}`,
+			`{"error":{"code":-32056,"message":"error proxying request","data":`,
+		},
+		{
+			staticRouter(addr),
+			"other",
+			`{"jsonrpc": "2.0", "method": "echo", "params": ["abc"], "id": 4}`,
+			`{"error":{"code":-32056,"data":"Post \"http://127.0.0.1:1/rpc\"`,
+		},
+	}
+
+	for i, tt := range table {
+		d := newTestDispatcher()
+		d.Proxy(tt.Router, tt.Secret)
+		resp, _ := json.Marshal(d.Dispatch([]byte(tt.Body)))
+		if !strings.HasPrefix(string(resp), tt.Response) {
+			t.Fatalf("[%d] expected response %s, got %s", i, tt.Response, string(resp))
+		}
+	}
+}
+
+func TestDispatcherProxiedSignature(t *testing.T) {
+	d := newTestDispatcher()
+	d.Proxy(staticRouter("127.0.0.1:1"), "secret")
+	body := `{"jsonrpc": "2.0", "method": "echo", "params": ["abc"], "id": 1}`
+
+	var table = []struct {
+		Signature string
+		Response  string
+	}{
+		{signBody("secret", []byte(body)), `{"id":1,"jsonrpc":"2.0","result":"abc"}`},
+		{"true", `{"error":{"code":-32056,"message":"error proxying request","data":`},
+		{signBody("other", []byte(body)), `{"error":{"code":-32056,"message":"error proxying request","data":`},
+	}
+
+	for i, tt := range table {
+		req := httptest.NewRequest(http.MethodPost, "/rpc", strings.NewReader(body))
+		req.Header.Set(ProxiedHeader, tt.Signature)
+		rec := httptest.NewRecorder()
+		d.ServeHTTP(rec, req)
+		if !strings.HasPrefix(rec.Body.String(), tt.Response) {
+			t.Fatalf("[%d] expected response %s, got %s", i, tt.Response, rec.Body.String())
+		}
+	}
+}
+
+func TestDispatcherShutdown(t *testing.T) {
+	d := NewDispatcher("127.0.0.1:0", "/rpc")
+	errs := make(chan error, 1)
+	go func() { errs <- d.Start() }()
+	time.Sleep(time.Millisecond * 10)
+	if err := d.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != http.ErrServerClosed {
+		t.Fatalf("expected error '%v', got '%v'", http.ErrServerClosed, err)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	ShardReplicas = 64               // the number of points of a member on the hash ring.
+	ShardInterval = time.Second * 5  // the shard membership renewal interval.
+	ShardTimeout  = time.Second * 15 // the time after the last renewal a member leaves the hash ring.
+)
+
+var ShardSecretError = errors.New("sharding requires a shard secret")
+
+// ShardMember is a controller instance that owns a share of the resource
+// keys.
+type ShardMember struct {
+	// Address is the <host>:<port> the instance serves the json-rpc api
+	// on.
+	// HeartbeatAt is the time the instance last renewed its membership.
+	Address     string    `json:"_key" mapstructure:"_key"`
+	HeartbeatAt time.Time `json:"heartbeatAt"`
+}
+
+// HashRing assigns keys to members by consistent hashing, so that only the
+// keys of a joining or leaving member change owners.
+type HashRing struct {
+	hashes  []uint32
+	members map[uint32]string
+}
+
+// NewHashRing creates a hash ring with the provided number of points per
+// member.
+func NewHashRing(members []string, replicas int) *HashRing {
+	ring := &HashRing{members: make(map[uint32]string)}
+	for _, member := range members {
+		for i := 0; i < replicas; i++ {
+			h := hashKey(member + "#" + strconv.Itoa(i))
+			if _, ok := ring.members[h]; ok {
+				continue
+			}
+			ring.members[h] = member
+			ring.hashes = append(ring.hashes, h)
+		}
+	}
+	sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+	return ring
+}
+
+// Owner returns the member that owns the key. An empty string is returned
+// if the ring has no members.
+func (ring *HashRing) Owner(key string) string {
+	if len(ring.hashes) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(ring.hashes), func(i int) bool { return ring.hashes[i] >= h })
+	if i == len(ring.hashes) {
+		i = 0
+	}
+	return ring.members[ring.hashes[i]]
+}
+
+// Members returns the members of the ring in sorted order.
+func (ring *HashRing) Members() []string {
+	seen := make(map[string]bool)
+	members := make([]string, 0)
+	for _, member := range ring.members {
+		if !seen[member] {
+			seen[member] = true
+			members = append(members, member)
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+// Has indicates whether the member is on the ring.
+func (ring *HashRing) Has(member string) bool {
+	for _, m := range ring.members {
+		if m == member {
+			return true
+		}
+	}
+	return false
+}
+
+// hashKey returns the position of the key on the hash ring.
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// Sharder tracks the members of the shard membership collection and the
+// resource keys owned by the instance. All methods are safe for concurrent
+// use.
+type Sharder struct {
+	self string
+	mu   sync.RWMutex
+	ring *HashRing
+}
+
+// NewSharder creates a new sharder for the instance with the provided
+// address. The instance owns all keys until the membership is refreshed.
+func NewSharder(self string) *Sharder {
+	return &Sharder{self: self}
+}
+
+// Owner returns the address of the instance that owns the key.
+func (s *Sharder) Owner(key string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.ring == nil {
+		return s.self
+	}
+	if owner := s.ring.Owner(key); owner != "" {
+		return owner
+	}
+	return s.self
+}
+
+// Refresh renews the membership of the instance and rebuilds the hash ring
+// from the members that renewed their membership within the shard timeout.
+// The previous ring is returned if the members changed.
+func (s *Sharder) Refresh(memberModel Model) (*HashRing, bool, error) {
+	if _, err := memberModel.Save(&ShardMember{s.self, time.Now()}); err != nil {
+		return nil, false, err
+	}
+	docs, err := memberModel.FetchAll()
+	if err != nil {
+		return nil, false, err
+	}
+	live := []string{s.self}
+	for _, doc := range docs {
+		member := doc.(*ShardMember)
+		if member.Address != s.self && time.Since(member.HeartbeatAt) <= ShardTimeout {
+			live = append(live, member.Address)
+		}
+	}
+	ring := NewHashRing(live, ShardReplicas)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.ring
+	if prev != nil && fmt.Sprint(prev.Members()) == fmt.Sprint(ring.Members()) {
+		return nil, false, nil
+	}
+	s.ring = ring
+	log.Printf("shard members changed %v\n", ring.Members())
+	return prev, true, nil
+}
+
+// Leave removes the membership of the instance so that the other members
+// take over its keys without waiting for the shard timeout.
+func (s *Sharder) Leave(memberModel Model) error {
+	return memberModel.Remove(&ShardMember{Address: s.self})
+}
+
+// shardRoutes maps the methods that are served by the owner of a resource
+// key to the parameter holding the key. The key of the methods with an id
+// parameter is the key of the task with the id.
+var shardRoutes = map[string]string{
+	"acknowledgePreemption": "id",
+	"addResource":           "name",
+	"addTask":               "key",
+	"completeTask":          "id",
+	"forceCompleteTask":     "id",
+	"getResource":           "name",
+	"getStagedTask":         "key",
+	"listPriorityQueue":     "key",
+	"listStagedTasks":       "key",
+	"listTimetable":         "key",
+	"pauseResource":         "name",
+	"registerResource":      "name",
+	"removeResource":        "name",
+	"removeTask":            "id",
+	"resourceHeartbeat":     "name",
+	"resumeResource":        "name",
+	"setResourceParent":     "name",
+	"setResourceQuota":      "name",
+	"setResourceWeight":     "name",
+	"startTask":             "key",
+	"unstageTask":           "key",
+	"v2.addResource":        "name",
+	"v2.addTask":            "key",
+	"v2.completeTask":       "id",
+	"v2.pauseResource":      "name",
+	"v2.removeResource":     "name",
+	"v2.removeTask":         "id",
+	"v2.resumeResource":     "name",
+}
+
+// shardPoolRoutes maps the methods that add a resource to the position of
+// their pool parameter. A resource added to a pool is routed by the pool,
+// since pool members are owned by the owner of their pool.
+var shardPoolRoutes = map[string]int{
+	"addResource":    1,
+	"v2.addResource": 1,
+}
+
+// ShardRouter routes the requests for resource keys owned by another
+// instance to that instance.
+type ShardRouter struct {
+	ctrl      *ResourceController
+	taskModel Model
+}
+
+// NewShardRouter creates a new router for the sharded controller.
+func NewShardRouter(ctrl *ResourceController, taskModel Model) *ShardRouter {
+	return &ShardRouter{ctrl, taskModel}
+}
+
+// Route returns the address of the instance that owns the resource key of
+// the request. An empty string is returned if the request is served
+// locally.
+func (router *ShardRouter) Route(method string, params json.RawMessage) string {
+	name, ok := shardRoutes[method]
+	if !ok {
+		return ""
+	}
+	if pos, ok := shardPoolRoutes[method]; ok {
+		if pool := routeParam(params, "pool", pos); pool != "" {
+			return router.ctrl.ShardOwner(pool)
+		}
+	}
+	key := routeParam(params, name, 0)
+	if key == "" {
+		return ""
+	}
+	if name == "id" {
+		task, err := getTask(key, router.taskModel)
+		if err != nil {
+			return ""
+		}
+		key = task.Key
+	}
+	return router.ctrl.ShardOwner(key)
+}
+
+// routeParam returns the string value of the named parameter, or of the
+// positional parameter at pos. An empty string is returned if the parameter
+// is missing or not a string.
+func routeParam(params json.RawMessage, name string, pos int) string {
+	params = bytes.TrimSpace(params)
+	var value string
+	if len(params) > 0 && params[0] == '[' {
+		var args []interface{}
+		json.Unmarshal(params, &args)
+		if len(args) > pos {
+			value, _ = args[pos].(string)
+		}
+		return value
+	}
+	var named map[string]interface{}
+	json.Unmarshal(params, &named)
+	value, _ = named[name].(string)
+	return value
+}
+
+// Shard restricts the controller to the resource keys owned by the
+// instance. Resources of other keys are tracked but not staged, started
+// or swept.
+func (ctrl *ResourceController) Shard(sharder *Sharder) {
+	ctrl.shards = sharder
+}
+
+// ShardOwner returns the address of the instance that owns the resource
+// key. An empty string is returned if the key is owned by the instance or
+// if sharding is disabled. Pool members are owned by the owner of the
+// pool.
+func (ctrl *ResourceController) ShardOwner(key string) string {
+	if ctrl.shards == nil {
+		return ""
+	}
+	if owner := ctrl.shards.Owner(ctrl.shardKey(key)); owner != ctrl.shards.self {
+		return owner
+	}
+	return ""
+}
+
+// StartShardLoop renews the shard membership of the instance until the
+// context is done. When the members change, the staged tasks of the keys
+// taken over by another instance are returned to their priority queue or
+// timetable and the resources of the keys taken over by the instance are
+// reloaded.
+func (ctrl *ResourceController) StartShardLoop(ctx context.Context, memberModel Model, taskModel Model, resourceModel Model) {
+	for {
+		prev, changed, err := ctrl.shards.Refresh(memberModel)
+		if err != nil {
+			logln(ctx, err)
+		} else if changed && prev != nil {
+			if err := ctrl.rebalanceShard(prev, taskModel, resourceModel); err != nil {
+				logln(ctx, err)
+			}
+		}
+
+		if !sleepContext(ctx, ShardInterval) {
+			return
+		}
+	}
+}
+
+// ownsKey indicates whether the resource key is owned by the instance.
+func (ctrl *ResourceController) ownsKey(key string) bool {
+	return ctrl.ShardOwner(key) == ""
+}
+
+// ownsResource indicates whether the resource is owned by the instance.
+// Unlike ownsKey it does not look up the resource, so it can be called
+// while holding the resources lock.
+func (ctrl *ResourceController) ownsResource(resource *Resource) bool {
+	if ctrl.shards == nil {
+		return true
+	}
+	key := resource.Name
+	if resource.Pool != "" {
+		key = resource.Pool
+	}
+	return ctrl.shards.Owner(key) == ctrl.shards.self
+}
+
+// shardKey returns the key the owner of the resource key is chosen by,
+// which is the pool name for pool members.
+func (ctrl *ResourceController) shardKey(key string) string {
+	if resource, ok := ctrl.lookupResource(key); ok && resource.Pool != "" {
+		return resource.Pool
+	}
+	return key
+}
+
+// rebalanceShard hands over the keys the instance no longer owns and takes
+// over the keys it owns since the ring was prev. The pending tasks of a
+// taken over key are staged again if its previous owner left the ring,
+// since nobody returns them to the priority queue.
+func (ctrl *ResourceController) rebalanceShard(prev *HashRing, taskModel Model, resourceModel Model) error {
+	resources, err := resourceModel.FetchAll()
+	if err != nil {
+		return err
+	}
+	self := ctrl.shards.self
+	for _, v := range resources {
+		resource := v.(*Resource)
+		key := resource.Name
+		if resource.Pool != "" {
+			key = resource.Pool
+		}
+		owned, prevOwner := ctrl.shards.Owner(key) == self, prev.Owner(key)
+		if owned == (prevOwner == self) {
+			continue
+		}
+		if !owned {
+			if _, ok := ctrl.stagedSlot(resource.Name); ok {
+				if err := ctrl.UnstageTask(resource.Name, taskModel); err != nil && err != NoStagedTaskError {
+					log.Println(err, resource.Name)
+				}
+			}
+			log.Printf("handed over resource [%s] to [%s]\n", resource.Name, ctrl.shards.Owner(key))
+			continue
+		}
+		ctrl.deleteResource(resource.Name)
+		if err := ctrl.RestoreResource(resource, taskModel, resourceModel); err != nil {
+			log.Println(err, resource.Name)
+			continue
+		}
+		log.Printf("took over resource [%s] from [%s]\n", resource.Name, prevOwner)
+		if ctrl.memberLive(prevOwner) {
+			continue
+		}
+		tasks, err := queryResourceTasks(resource.Name, StatusPending, taskModel)
+		if err != nil {
+			return err
+		}
+		for _, task := range tasks {
+			if err := ctrl.RestoreStagedTask(task.(*Task), taskModel); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	return nil
+}
+
+// memberLive indicates whether the instance with the address is a member
+// of the current hash ring.
+func (ctrl *ResourceController) memberLive(address string) bool {
+	ctrl.shards.mu.RLock()
+	defer ctrl.shards.mu.RUnlock()
+	return ctrl.shards.ring != nil && ctrl.shards.ring.Has(address)
+}
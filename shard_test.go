@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
+
+// shardKeyOwnedBy returns a resource key owned by the member of the ring.
+func shardKeyOwnedBy(ring *HashRing, member string) string {
+	for i := 0; ; i++ {
+		if key := fmt.Sprintf("resource%d", i); ring.Owner(key) == member {
+			return key
+		}
+	}
+}
+
+func TestHashRingOwner(t *testing.T) {
+	members := []string{"a:8080", "b:8080", "c:8080"}
+	ring := NewHashRing(members, ShardReplicas)
+	if fmt.Sprint(ring.Members()) != fmt.Sprint(members) {
+		t.Fatalf("expected members %v, got %v", members, ring.Members())
+	}
+	smaller := NewHashRing(members[:2], ShardReplicas)
+	owned := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("resource%d", i)
+		owner := ring.Owner(key)
+		owned[owner]++
+		if owner != NewHashRing(members, ShardReplicas).Owner(key) {
+			t.Fatalf("expected the owner of %s to be stable", key)
+		}
+		if owner != "c:8080" && smaller.Owner(key) != owner {
+			t.Fatalf("expected %s to stay with %s after c:8080 left", key, owner)
+		}
+	}
+	for _, member := range members {
+		if owned[member] == 0 {
+			t.Fatalf("expected %s to own keys, got %v", member, owned)
+		}
+	}
+	if owner := NewHashRing(nil, ShardReplicas).Owner("test"); owner != "" {
+		t.Fatalf("expected no owner on an empty ring, got %s", owner)
+	}
+}
+
+func TestSharderRefresh(t *testing.T) {
+	model := new(MockModel)
+	model.On("Save", mock.AnythingOfType("*main.ShardMember")).Return(DocumentMeta{}, nil)
+	model.On("FetchAll").Return([]interface{}{
+		&ShardMember{"a:8080", time.Now()},
+		&ShardMember{"b:8080", time.Now()},
+		&ShardMember{"c:8080", time.Now().Add(-ShardTimeout * 2)},
+	}, nil)
+	model.On("Remove", &ShardMember{Address: "a:8080"}).Return(nil).Once()
+	sharder := NewSharder("a:8080")
+	if owner := sharder.Owner("test"); owner != "a:8080" {
+		t.Fatalf("expected the instance to own all keys before the refresh, got %s", owner)
+	}
+
+	prev, changed, err := sharder.Refresh(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || prev != nil {
+		t.Fatalf("expected the first refresh to build the ring")
+	}
+	if members := sharder.ring.Members(); fmt.Sprint(members) != "[a:8080 b:8080]" {
+		t.Fatalf("expected the live members [a:8080 b:8080], got %v", members)
+	}
+	if _, changed, _ := sharder.Refresh(model); changed {
+		t.Fatal("expected the ring to be unchanged")
+	}
+	if err := sharder.Leave(model); err != nil {
+		t.Fatal(err)
+	}
+	model.AssertExpectations(t)
+}
+
+func TestShardRouterRoute(t *testing.T) {
+	ring := NewHashRing([]string{"a:8080", "b:8080"}, ShardReplicas)
+	local := shardKeyOwnedBy(ring, "a:8080")
+	foreign := shardKeyOwnedBy(ring, "b:8080")
+	taskModel := new(MockModel)
+	taskModel.On("Get", "abc123").Return(&Task{Id: "abc123", Key: foreign}, nil)
+	taskModel.On("Get", "xyz789").Return(nil, nil)
+	ctrl := NewResourceController(nil)
+	ctrl.Shard(&Sharder{self: "a:8080", ring: ring})
+	ctrl.storeResource(&Resource{Name: "member1", Pool: foreign, Status: ResourceFree})
+	router := NewShardRouter(ctrl, taskModel)
+
+	var table = []struct {
+		Method string
+		Params string
+		Addr   string
+	}{
+		{"addTask", fmt.Sprintf(`{"key": "%s", "priority": 1}`, foreign), "b:8080"},
+		{"addTask", fmt.Sprintf(`{"key": "%s", "priority": 1}`, local), ""},
+		{"startTask", fmt.Sprintf(`["%s"]`, foreign), "b:8080"},
+		{"startTask", `["member1"]`, "b:8080"},
+		{"getResource", fmt.Sprintf(`{"name": "%s"}`, foreign), "b:8080"},
+		{"addResource", fmt.Sprintf(`{"name": "%s", "pool": "%s"}`, local, foreign), "b:8080"},
+		{"addResource", fmt.Sprintf(`["%s", "%s"]`, local, foreign), "b:8080"},
+		{"addResource", fmt.Sprintf(`{"name": "%s", "pool": "%s"}`, foreign, local), ""},
+		{"addResource", fmt.Sprintf(`{"name": "%s"}`, foreign), "b:8080"},
+		{"completeTask", `{"id": "abc123", "status": "complete"}`, "b:8080"},
+		{"completeTask", `{"id": "xyz789", "status": "complete"}`, ""},
+		{"getTask", `["abc123"]`, ""},
+		{"listTasks", fmt.Sprintf(`{"key": "%s"}`, foreign), ""},
+		{"startTask", `[]`, ""},
+	}
+
+	for i, tt := range table {
+		if addr := router.Route(tt.Method, []byte(tt.Params)); addr != tt.Addr {
+			t.Fatalf("[%d] expected %s to be routed to '%s', got '%s'", i, tt.Method, tt.Addr, addr)
+		}
+	}
+}
+
+func TestControllerShardOwnership(t *testing.T) {
+	ring := NewHashRing([]string{"a:8080", "b:8080"}, ShardReplicas)
+	foreign := shardKeyOwnedBy(ring, "b:8080")
+	ctrl := NewResourceController(nil)
+	if !ctrl.ownsKey(foreign) {
+		t.Fatal("expected all keys to be owned without sharding")
+	}
+	ctrl.Shard(&Sharder{self: "a:8080", ring: ring})
+	if ctrl.ownsKey(foreign) {
+		t.Fatalf("expected %s to be owned by b:8080", foreign)
+	}
+
+	taskModel := new(MockModel)
+	if err := ctrl.RestoreStagedTask(&Task{Id: "abc123", Key: foreign, Status: StatusPending}, taskModel); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ctrl.stagedSlot(foreign); ok {
+		t.Fatal("expected the task of a foreign key not to be staged")
+	}
+	taskModel.AssertNotCalled(t, "Save", mock.Anything)
+}
+
+func TestControllerRebalanceShard(t *testing.T) {
+	both := NewHashRing([]string{"a:8080", "b:8080"}, ShardReplicas)
+	handed := shardKeyOwnedBy(both, "b:8080")
+	self := NewHashRing([]string{"a:8080"}, ShardReplicas)
+
+	// b:8080 joins and takes over the staged task of its key.
+	staged := &Task{Id: "abc123", Key: handed, Priority: 1, Status: StatusPending}
+	broker := new(MockServiceBroker)
+	broker.On("Call", mock.Anything, PriorityQueueHost, "push", map[string]interface{}{"key": handed, "id": "abc123", "priority": float64(1)}).Return(float64(0), nil).Once()
+	broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+	taskModel := new(MockModel)
+	taskModel.On("Save", staged).Return(DocumentMeta{}, nil).Once()
+	rescModel := new(MockModel)
+	rescModel.On("FetchAll").Return([]interface{}{&Resource{Name: handed, Status: ResourceFree}}, nil)
+	ctrl := NewResourceController(broker)
+	ctrl.storeResource(&Resource{Name: handed, Status: ResourceFree})
+	ctrl.stage.Store(handed, NewStagedSlot(time.Now(), staged))
+	ctrl.Shard(&Sharder{self: "a:8080", ring: both})
+	if err := ctrl.rebalanceShard(self, taskModel, rescModel); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ctrl.stagedSlot(handed); ok || staged.Status != StatusQueued {
+		t.Fatalf("expected the staged task to be returned to the queue, got %s", staged.Status)
+	}
+	broker.AssertExpectations(t)
+
+	// b:8080 leaves and its resource and pending task are taken over.
+	pending := &Task{Id: "def456", Key: handed, Priority: 1, Status: StatusPending}
+	taskModel = new(MockModel)
+	q := fmt.Sprintf(`FOR t IN %s FILTER t.key == @key AND t.status == @status RETURN t`, CollectionTasks)
+	taskModel.On("Query", q, map[string]interface{}{"key": handed, "status": StatusStarted}).Return([]interface{}{}, nil).Once()
+	taskModel.On("Query", q, map[string]interface{}{"key": handed, "status": StatusPending}).Return([]interface{}{pending}, nil).Once()
+	rescModel = new(MockModel)
+	rescModel.On("FetchAll").Return([]interface{}{&Resource{Name: handed, Status: ResourceFree, Weight: 2}}, nil)
+	broker = new(MockServiceBroker)
+	broker.On("Call", mock.Anything, StatusChangeNotifierHost, "notify", mock.Anything).Return(float64(0), nil).Maybe()
+	ctrl = NewResourceController(broker)
+	ctrl.storeResource(&Resource{Name: handed, Status: ResourceFree})
+	ctrl.Shard(&Sharder{self: "a:8080", ring: self})
+	if err := ctrl.rebalanceShard(both, taskModel, rescModel); err != nil {
+		t.Fatal(err)
+	}
+	if resource, _ := ctrl.lookupResource(handed); resource.Weight != 2 {
+		t.Fatal("expected the resource to be reloaded")
+	}
+	if slot, ok := ctrl.stagedSlot(handed); !ok || slot.Tasks()[0] != pending {
+		t.Fatal("expected the pending task to be staged")
+	}
+	taskModel.AssertExpectations(t)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	StageFullError    = errors.New("stage full")
+	StageRemovedError = errors.New("stage removed")
+)
+
+// StagedSlot holds the tasks staged for a resource key in the order they
+// are started. All methods are safe for concurrent use.
+//
+// A slot is removed once its last task is taken and rejects new tasks
+// from then on, so a task staged concurrently with the removal is staged
+// in a new slot instead of being lost.
+type StagedSlot struct {
+	mu       sync.Mutex
+	removed  bool
+	stagedAt time.Time
+	tasks    []*Task
+}
+
+// NewStagedSlot creates a new slot holding the tasks. The staging time is
+// the time the first task of the slot was staged.
+func NewStagedSlot(stagedAt time.Time, tasks ...*Task) *StagedSlot {
+	return &StagedSlot{stagedAt: stagedAt, tasks: tasks}
+}
+
+// Push appends the task to the slot and returns the number of tasks staged
+// ahead of it.
+//
+// an error is encountered if the slot holds limit tasks or if the slot
+// has been removed.
+func (slot *StagedSlot) Push(task *Task, limit int) (int, error) {
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	if slot.removed {
+		return 0, StageRemovedError
+	}
+	if len(slot.tasks) >= limit {
+		return 0, StageFullError
+	}
+	slot.tasks = append(slot.tasks, task)
+	return len(slot.tasks) - 1, nil
+}
+
+// Take removes and returns the first task of the slot if accept returns
+// nil for it. The task stays first in the slot if accept returns an error.
+// accept is called while the slot is locked, so no other task can be
+// taken from the slot until it returns.
+//
+// an error is encountered if the slot holds no tasks.
+func (slot *StagedSlot) Take(accept func(*Task) error) (*Task, error) {
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	if len(slot.tasks) == 0 {
+		return nil, NoStagedTaskError
+	}
+	task := slot.tasks[0]
+	if err := accept(task); err != nil {
+		return nil, err
+	}
+	slot.tasks[0] = nil
+	slot.tasks = slot.tasks[1:]
+	slot.stagedAt = time.Now()
+	slot.removed = len(slot.tasks) == 0
+	return task, nil
+}
+
+// PushFront puts the task in front of the slot regardless of the stage
+// limit. It is used to return a taken task whose start could not be saved.
+//
+// an error is encountered if the slot has been removed.
+func (slot *StagedSlot) PushFront(task *Task) error {
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	if slot.removed {
+		return StageRemovedError
+	}
+	slot.tasks = append([]*Task{task}, slot.tasks...)
+	return nil
+}
+
+// Remove removes the task with the provided id from the slot. nil is
+// returned if the slot does not hold the task.
+func (slot *StagedSlot) Remove(id string) *Task {
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	for i, task := range slot.tasks {
+		if task.Id != id {
+			continue
+		}
+		slot.tasks = append(slot.tasks[:i:i], slot.tasks[i+1:]...)
+		slot.removed = len(slot.tasks) == 0
+		return task
+	}
+	return nil
+}
+
+// Drain removes and returns all tasks of the slot and removes the slot.
+func (slot *StagedSlot) Drain() []*Task {
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	tasks := slot.tasks
+	slot.tasks = nil
+	slot.removed = true
+	return tasks
+}
+
+// Tasks returns the tasks of the slot in the order they are started.
+func (slot *StagedSlot) Tasks() []*Task {
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	return append([]*Task(nil), slot.tasks...)
+}
+
+// Len returns the number of tasks in the slot.
+func (slot *StagedSlot) Len() int {
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	return len(slot.tasks)
+}
+
+// Removed indicates whether the slot has been removed. A removed slot
+// stays removed.
+func (slot *StagedSlot) Removed() bool {
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	return slot.removed
+}
+
+// StagedAt returns the time the first task of the slot was staged or,
+// after a task was taken, moved to the front of the slot.
+func (slot *StagedSlot) StagedAt() time.Time {
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	return slot.stagedAt
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitwurx/jrpc2"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestStagedSlotPush(t *testing.T) {
+	slot := NewStagedSlot(time.Now())
+	for i := 0; i < 2; i++ {
+		ahead, err := slot.Push(&Task{Id: fmt.Sprintf("abc%d", i)}, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ahead != i {
+			t.Fatalf("expected %d tasks ahead, got %d", i, ahead)
+		}
+	}
+	if _, err := slot.Push(&Task{Id: "abc2"}, 2); err != StageFullError {
+		t.Fatalf("expected error %v, got %v", StageFullError, err)
+	}
+	slot.Drain()
+	if _, err := slot.Push(&Task{Id: "abc3"}, 2); err != StageRemovedError {
+		t.Fatalf("expected error %v, got %v", StageRemovedError, err)
+	}
+}
+
+func TestStagedSlotTake(t *testing.T) {
+	slot := NewStagedSlot(time.Now(), &Task{Id: "abc123"}, &Task{Id: "def456"})
+	rejectErr := errors.New("rejected")
+	if _, err := slot.Take(func(*Task) error { return rejectErr }); err != rejectErr {
+		t.Fatalf("expected error %v, got %v", rejectErr, err)
+	}
+	for _, id := range []string{"abc123", "def456"} {
+		task, err := slot.Take(func(*Task) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.Id != id {
+			t.Fatalf("expected task %s, got %s", id, task.Id)
+		}
+	}
+	if !slot.Removed() {
+		t.Fatal("expected empty slot to be removed")
+	}
+	if _, err := slot.Take(func(*Task) error { return nil }); err != NoStagedTaskError {
+		t.Fatalf("expected error %v, got %v", NoStagedTaskError, err)
+	}
+}
+
+func TestStagedSlotRemove(t *testing.T) {
+	slot := NewStagedSlot(time.Now(), &Task{Id: "abc123"}, &Task{Id: "def456"})
+	if task := slot.Remove("xyz789"); task != nil {
+		t.Fatalf("expected no task, got %v", task)
+	}
+	if task := slot.Remove("abc123"); task == nil || task.Id != "abc123" {
+		t.Fatalf("expected task abc123, got %v", task)
+	}
+	if tasks := slot.Tasks(); len(tasks) != 1 || tasks[0].Id != "def456" {
+		t.Fatalf("expected tasks [def456], got %v", tasks)
+	}
+	if slot.Removed() {
+		t.Fatal("expected slot not to be removed")
+	}
+	slot.Remove("def456")
+	if !slot.Removed() || slot.Len() != 0 {
+		t.Fatal("expected empty slot to be removed")
+	}
+}
+
+func TestStagedSlotPushFront(t *testing.T) {
+	slot := NewStagedSlot(time.Now(), &Task{Id: "abc123"})
+	if err := slot.PushFront(&Task{Id: "def456"}); err != nil {
+		t.Fatal(err)
+	}
+	if tasks := slot.Tasks(); len(tasks) != 2 || tasks[0].Id != "def456" {
+		t.Fatalf("expected tasks [def456 abc123], got %v", tasks)
+	}
+	slot.Drain()
+	if err := slot.PushFront(&Task{Id: "def456"}); err != StageRemovedError {
+		t.Fatalf("expected error %v, got %v", StageRemovedError, err)
+	}
+}
+
+func TestControllerStagedSlotConcurrentStaging(t *testing.T) {
+	defer func(n int) { StageLookahead = n }(StageLookahead)
+	StageLookahead = StageBuffer
+
+	ctrl := NewResourceController(nil)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	taken := make(map[string]bool)
+	for i := 0; i < StageBuffer; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			task := &Task{Id: fmt.Sprintf("abc%d", i), Key: "test"}
+			if _, err := ctrl.pushStagedTask(task, time.Now()); err != nil {
+				t.Error(err)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			slot, ok := ctrl.stagedSlot("test")
+			if !ok {
+				return
+			}
+			task, err := slot.Take(func(*Task) error { return nil })
+			ctrl.releaseSlot("test", slot)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			taken[task.Id] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if slot, ok := ctrl.stagedSlot("test"); ok {
+		for _, task := range slot.Tasks() {
+			taken[task.Id] = true
+		}
+	}
+	if len(taken) != StageBuffer {
+		t.Fatalf("expected %d tasks to be taken or staged, got %d", StageBuffer, len(taken))
+	}
+}
+
+// lifoQueueBroker is a priority queue service that pops the tasks of equal
+// priority in the reverse order they were pushed.
+type lifoQueueBroker struct {
+	mu    sync.Mutex
+	queue []map[string]interface{}
+}
+
+func (b *lifoQueueBroker) Call(ctx context.Context, host string, method string, params map[string]interface{}) (interface{}, *jrpc2.ErrorObject) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch method {
+	case "push":
+		b.queue = append(b.queue, params)
+	case "pop":
+		next := -1
+		for i, entry := range b.queue {
+			if next < 0 || entry["priority"].(float64) >= b.queue[next]["priority"].(float64) {
+				next = i
+			}
+		}
+		if next < 0 {
+			return nil, nil
+		}
+		entry := b.queue[next]
+		b.queue = append(b.queue[:next], b.queue[next+1:]...)
+		return map[string]interface{}{"_key": entry["id"], "key": entry["key"]}, nil
+	case "remove":
+		for i, entry := range b.queue {
+			if entry["id"] == params["id"] {
+				b.queue = append(b.queue[:i], b.queue[i+1:]...)
+				return float64(0), nil
+			}
+		}
+		return float64(1), nil
+	case "next":
+		return nil, nil
+	}
+	return float64(0), nil
+}
+
+// memoryTaskModel is a task model that keeps the tasks in memory and
+// answers the task lookup and strict fifo queries.
+type memoryTaskModel struct {
+	MockModel
+	mu    sync.Mutex
+	tasks map[string]*Task
+}
+
+func (m *memoryTaskModel) Save(doc interface{}) (DocumentMeta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if task, ok := doc.(*Task); ok {
+		m.tasks[task.Id] = task
+	}
+	return DocumentMeta{}, nil
+}
+
+func (m *memoryTaskModel) Get(key string) (interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if task, ok := m.tasks[key]; ok {
+		return task, nil
+	}
+	return nil, nil
+}
+
+func (m *memoryTaskModel) Query(q string, bindVars interface{}) ([]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	vars := bindVars.(map[string]interface{})
+	if before, ok := vars["before"].(time.Time); ok {
+		var oldest *Task
+		for _, task := range m.tasks {
+			if task.Key != vars["key"] || task.Priority != vars["priority"] || !task.Created.Before(before) {
+				continue
+			}
+			if task.Status != StatusQueued && task.Status != StatusCreated {
+				continue
+			}
+			if oldest == nil || task.Created.Before(oldest.Created) {
+				oldest = task
+			}
+		}
+		if oldest == nil {
+			return []interface{}{}, nil
+		}
+		return []interface{}{oldest}, nil
+	}
+	if task, ok := m.tasks[vars["key"].(string)]; ok {
+		return []interface{}{task}, nil
+	}
+	return []interface{}{}, nil
+}
+
+func TestControllerStrictFIFO(t *testing.T) {
+	defer func(fifo bool) { StrictFIFO = fifo }(StrictFIFO)
+	StrictFIFO = true
+
+	created := time.Now().Add(-time.Minute)
+	tasks := make([]*Task, 8)
+	for i := range tasks {
+		tasks[i] = &Task{Id: fmt.Sprintf("abc%d", i), Key: "test", Priority: 1, Created: created.Add(time.Millisecond * time.Duration(i))}
+	}
+	taskModel := &memoryTaskModel{tasks: make(map[string]*Task)}
+	rescModel := new(MockModel)
+	rescModel.On("Save", mock.Anything).Return(DocumentMeta{}, nil)
+	ctrl := NewResourceController(new(lifoQueueBroker))
+	ctrl.storeResource(&Resource{Name: "test", Status: ResourceFree})
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := len(tasks) - 1; i >= 0; i-- {
+		wg.Add(1)
+		go func(task *Task) {
+			defer wg.Done()
+			<-start
+			if err := ctrl.AddTask(task, taskModel, rescModel); err != nil {
+				t.Error(err)
+			}
+		}(tasks[i])
+	}
+	close(start)
+	wg.Wait()
+
+	for i, expected := range tasks {
+		if err := ctrl.stageNextTask(context.Background(), "test", taskModel); err != nil {
+			t.Fatal(err)
+		}
+		slot, ok := ctrl.stagedSlot("test")
+		if !ok {
+			t.Fatalf("[%d] expected a task to be staged", i)
+		}
+		task, err := slot.Take(func(*Task) error { return nil })
+		ctrl.releaseSlot("test", slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.Id != expected.Id {
+			t.Fatalf("[%d] expected task %s to be staged, got %s", i, expected.Id, task.Id)
+		}
+	}
+
+	// an older task that is still being added holds back the newer task.
+	adding := &Task{Id: "def456", Key: "test", Priority: 1, Created: time.Now(), Status: StatusCreated}
+	newer := &Task{Id: "xyz789", Key: "test", Priority: 1, Created: time.Now().Add(time.Millisecond)}
+	taskModel.Save(adding)
+	if err := ctrl.AddTask(newer, taskModel, rescModel); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctrl.stageNextTask(context.Background(), "test", taskModel); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ctrl.stagedSlot("test"); ok {
+		t.Fatal("expected no task to be staged while the older task is added")
+	}
+	if newer.Status != StatusQueued {
+		t.Fatalf("expected the newer task to be returned to the queue, got %s", newer.Status)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"regexp"
+	"time"
+)
+
+const (
+	StorageArango   = "arangodb"   // store the collections in arangodb.
+	StoragePostgres = "postgresql" // store the collections in postgresql tables.
+)
+
+var (
+	StorageBackend = os.Getenv("CONCORD_STORAGE") // the database the collections are stored in.
+	PostgresURL    = os.Getenv("POSTGRES_URL")    // the connection url of the postgresql database.
+)
+
+var (
+	InvalidCollectionPrefixError = errors.New("invalid collection prefix")
+	StorageUnavailableError      = errors.New("storage unavailable")
+	UnknownStorageError          = errors.New("unknown storage backend")
+)
+
+var collectionPrefixPattern = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9_]*)?$`) // the collection prefix format valid as arangodb collection and postgresql table name.
+
+var store Storage = new(ArangoStorage) // the storage backend of the controller.
+
+// Storage is a database backend that stores the collections of the
+// controller.
+type Storage interface {
+	// Init connects to the database and creates the collections.
+	// Models returns the models of the collections by name.
+	// Name returns the name of the database.
+	// Ping checks the connectivity of the database.
+	// Watch checks the connection until the context is done and
+	// reconnects when the connection was lost.
+	Init() error
+	Models() map[string]Model
+	Name() string
+	Ping() error
+	Watch(context.Context)
+}
+
+// NewStorage creates the storage backend with the provided name. The
+// arangodb storage is created if the name is empty.
+//
+// an error is encountered if the storage backend is unknown or the
+// collection prefix is not a letter followed by letters, digits and
+// underscores.
+func NewStorage(backend string) (Storage, error) {
+	if !collectionPrefixPattern.MatchString(CollectionPrefix) {
+		return nil, InvalidCollectionPrefixError
+	}
+	switch backend {
+	case "", StorageArango:
+		return new(ArangoStorage), nil
+	case StoragePostgres:
+		return NewPostgresStorage(PostgresURL), nil
+	}
+	return nil, UnknownStorageError
+}
+
+// connectRetry calls connect until it succeeds. The connection is
+// attempted up to DatabaseAttempts times, or once in fail-fast mode, and
+// until it succeeds if DatabaseAttempts is 0.
+//
+// an error is encountered if every connection attempt failed.
+func connectRetry(connect func() error) error {
+	attempts := DatabaseAttempts
+	if DatabaseFailFast {
+		attempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		err := connect()
+		if err == nil {
+			return nil
+		}
+		log.Printf("database connection failed [%d %s]\n", attempt, err)
+		if attempts > 0 && attempt >= attempts {
+			return DatabaseUnavailableError
+		}
+		time.Sleep(databaseBackoff(attempt))
+	}
+}
+
+// ArangoStorage is the storage backend of the arangodb collections.
+type ArangoStorage struct{}
+
+// Init connects to the arangodb and creates the collections.
+func (s *ArangoStorage) Init() error {
+	return InitDatabase()
+}
+
+// Models returns the arangodb collection models by name.
+func (s *ArangoStorage) Models() map[string]Model {
+	return map[string]Model{
+		"deferredCalls": &DeferredCallModel{},
+		"failedEvents":  &FailedEventModel{},
+		"resourceStats": &ResourceStatModel{},
+		"resources":     &ResourceModel{},
+		"shardMembers":  &ShardMemberModel{},
+		"taskArchive":   &TaskArchiveModel{},
+		"taskCounts":    &TaskCountModel{},
+		"taskGroups":    &TaskGroupModel{},
+		"taskHistory":   &TaskHistoryModel{},
+		"taskLogs":      &TaskLogModel{},
+		"taskStats":     &TaskStatModel{},
+		"tasks":         &TaskModel{},
+	}
+}
+
+// Name returns the name of the arangodb database.
+func (s *ArangoStorage) Name() string {
+	return StorageArango
+}
+
+// Ping checks the connectivity of the arangodb.
+func (s *ArangoStorage) Ping() error {
+	return PingDatabase()
+}
+
+// Watch checks the arangodb connection until the context is done.
+func (s *ArangoStorage) Watch(ctx context.Context) {
+	StartDatabaseWatchdog(ctx)
+}
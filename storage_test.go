@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestNewStorage(t *testing.T) {
+	var table = []struct {
+		Backend string
+		Name    string
+		Err     error
+	}{
+		{"", StorageArango, nil},
+		{StorageArango, StorageArango, nil},
+		{StoragePostgres, StoragePostgres, nil},
+		{"mysql", "", UnknownStorageError},
+	}
+
+	for i, tt := range table {
+		storage, err := NewStorage(tt.Backend)
+		if err != tt.Err {
+			t.Fatalf("[%d] expected error %v, got %v", i, tt.Err, err)
+		}
+		if err == nil && storage.Name() != tt.Name {
+			t.Fatalf("[%d] expected storage %s, got %s", i, tt.Name, storage.Name())
+		}
+	}
+}
+
+func TestNewStorageCollectionPrefix(t *testing.T) {
+	defer func(prefix string) { CollectionPrefix = prefix }(CollectionPrefix)
+	var table = []struct {
+		Prefix string
+		Err    error
+	}{
+		{"", nil},
+		{"staging_", nil},
+		{"Env2_", nil},
+		{"_system", InvalidCollectionPrefixError},
+		{"2env_", InvalidCollectionPrefixError},
+		{"env-", InvalidCollectionPrefixError},
+	}
+
+	for i, tt := range table {
+		CollectionPrefix = tt.Prefix
+		if _, err := NewStorage(StorageArango); err != tt.Err {
+			t.Fatalf("[%d] expected error %v, got %v", i, tt.Err, err)
+		}
+	}
+}
+
+func TestStorageModels(t *testing.T) {
+	arango := new(ArangoStorage).Models()
+	postgres := NewPostgresStorage("").Models()
+	if len(arango) != len(postgres) {
+		t.Fatalf("expected %d postgres models, got %d", len(arango), len(postgres))
+	}
+	for name := range arango {
+		if _, ok := postgres[name]; !ok {
+			t.Fatalf("expected postgres model %s", name)
+		}
+	}
+}
+
+func TestPostgresStoragePingUninitialized(t *testing.T) {
+	if err := NewPostgresStorage("").Ping(); err == nil {
+		t.Fatal("expected uninitialized storage ping to fail")
+	}
+}
+
+// failingDriver is a sql driver whose connections cannot be opened.
+type failingDriver struct{}
+
+func (d failingDriver) Open(name string) (driver.Conn, error) {
+	return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+}
+
+func TestAvailabilityConnector(t *testing.T) {
+	db := sql.OpenDB(&availabilityConnector{failingDriver{}, "postgres://localhost"})
+	defer db.Close()
+	if err := db.Ping(); err != StorageUnavailableError {
+		t.Fatalf("expected error %v, got %v", StorageUnavailableError, err)
+	}
+	if _, err := db.Query("SELECT 1"); err != StorageUnavailableError {
+		t.Fatalf("expected error %v, got %v", StorageUnavailableError, err)
+	}
+}
+
+func TestDocument(t *testing.T) {
+	key, fields, err := document(&Resource{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "a" || fields["_key"] != "a" {
+		t.Fatalf("expected key a, got %s", key)
+	}
+	key, fields, err = document(NewTaskStat("a", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key == "" || fmt.Sprint(fields["_key"]) != key {
+		t.Fatalf("expected generated key, got %q", key)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"math"
+	"sort"
 	"time"
 
 	"github.com/satori/go.uuid"
@@ -10,15 +12,57 @@ import (
 
 const (
 	StatusCreated   = "created"   // created task status.
+	StatusBlocked   = "blocked"   // blocked task status.
 	StatusQueued    = "queued"    // queued task status.
 	StatusScheduled = "scheduled" // queue scheduled status.
+	StatusDeferred  = "deferred"  // deferred task status.
 	StatusPending   = "pending"   // pending task status.
+	StatusPaused    = "paused"    // paused task status.
 	StatusCancelled = "cancelled" // cancelled status.
 	StatusStarted   = "started"   // started task status.
 	StatusError     = "error"     // error status.
 	StatusComplete  = "complete"  // complete task status.
 )
 
+// transitions maps each task status to the statuses the task may change to.
+var transitions = map[string][]string{
+	StatusCreated:   {StatusBlocked, StatusQueued, StatusScheduled, StatusDeferred, StatusCancelled},
+	StatusBlocked:   {StatusQueued, StatusScheduled, StatusDeferred, StatusCancelled},
+	StatusDeferred:  {StatusQueued, StatusScheduled, StatusError, StatusCancelled},
+	StatusQueued:    {StatusPending, StatusPaused, StatusCancelled},
+	StatusScheduled: {StatusPending, StatusPaused, StatusCancelled},
+	StatusPaused:    {StatusQueued, StatusScheduled, StatusDeferred, StatusCancelled},
+	StatusPending:   {StatusStarted, StatusQueued, StatusScheduled, StatusDeferred, StatusCancelled},
+	StatusStarted:   {StatusComplete, StatusError, StatusCancelled, StatusPending, StatusQueued, StatusScheduled, StatusDeferred},
+	StatusError:     {StatusQueued, StatusScheduled, StatusDeferred, StatusCancelled},
+	StatusCancelled: {StatusQueued, StatusScheduled, StatusDeferred},
+	StatusComplete:  {},
+}
+
+// TransitionError is returned when a task status change is not allowed.
+type TransitionError struct {
+	// From is the current status of the task.
+	// To is the rejected status.
+	From string
+	To   string
+}
+
+// Error returns the description of the rejected status change.
+func (err *TransitionError) Error() string {
+	return fmt.Sprintf("invalid task status transition from '%s' to '%s'", err.From, err.To)
+}
+
+// CheckTransition returns a TransitionError if a task with the from status
+// may not change to the to status.
+func CheckTransition(from string, to string) error {
+	for _, status := range transitions[from] {
+		if status == to {
+			return nil
+		}
+	}
+	return &TransitionError{from, to}
+}
+
 // TaskStat stores a runtime for a task.
 type TaskStat struct {
 	// Created is the task stat creation timestamp.
@@ -39,22 +83,315 @@ func (taskStat *TaskStat) Save(taskModel Model) (DocumentMeta, error) {
 	return taskModel.Save(taskStat)
 }
 
+// TaskStats summarizes the recorded runtimes of a task key.
+type TaskStats struct {
+	// Average is the average run time in seconds.
+	// Count is the number of recorded run times.
+	// Key is the task key.
+	// Max is the longest run time in seconds.
+	// Min is the shortest run time in seconds.
+	Average float64 `json:"average"`
+	Count   int     `json:"count"`
+	Key     string  `json:"key"`
+	Max     float64 `json:"max"`
+	Min     float64 `json:"min"`
+}
+
+// TaskValidation is the outcome of adding a task without submitting it.
+type TaskValidation struct {
+	// NewResource indicates if a resource would be created for the task
+	// key.
+	// QueueKey is the priority queue or timetable key of the task.
+	// Status is the status the task would get, queued, scheduled or
+	// blocked.
+	NewResource bool   `json:"newResource"`
+	QueueKey    string `json:"queueKey"`
+	Status      string `json:"status"`
+}
+
+// MetaSchema describes the task meta accepted by addTask. It is the
+// required and properties subset of JSON Schema, e.g.
+// {"required": ["image"], "properties": {"image": {"type": "string"}}}.
+type MetaSchema struct {
+	// Properties are the types of the meta fields.
+	// Required are the names of the meta fields a task must have.
+	Properties map[string]MetaProperty `json:"properties"`
+	Required   []string                `json:"required"`
+}
+
+// MetaProperty is the type of a task meta field, one of string, number,
+// integer, boolean, object, array or null.
+type MetaProperty struct {
+	Type string `json:"type"`
+}
+
+// NewMetaSchema creates a new MetaSchema instance from its json document.
+//
+// an error is encountered if the document is not a valid schema.
+func NewMetaSchema(data []byte) (*MetaSchema, error) {
+	schema := new(MetaSchema)
+	if err := json.Unmarshal(data, schema); err != nil {
+		return nil, fmt.Errorf("invalid meta schema: %s", err)
+	}
+	for name, prop := range schema.Properties {
+		switch prop.Type {
+		case "", "string", "number", "integer", "boolean", "object", "array", "null":
+		default:
+			return nil, fmt.Errorf("invalid meta schema: unknown type '%s' of '%s'", prop.Type, name)
+		}
+	}
+	return schema, nil
+}
+
+// Validate returns an error describing the first meta field that is
+// missing or has another type than the schema. Any meta is valid against
+// a nil schema.
+func (schema *MetaSchema) Validate(meta map[string]interface{}) error {
+	if schema == nil {
+		return nil
+	}
+	for _, name := range schema.Required {
+		if _, ok := meta[name]; !ok {
+			return fmt.Errorf("meta '%s' is required", name)
+		}
+	}
+	names := make([]string, 0, len(meta))
+	for name := range meta {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		prop, ok := schema.Properties[name]
+		if !ok || prop.Type == "" || metaType(meta[name], prop.Type) {
+			continue
+		}
+		return fmt.Errorf("meta '%s' must be of type %s", name, prop.Type)
+	}
+	return nil
+}
+
+// metaType indicates whether the decoded json value is of the schema type.
+func metaType(value interface{}, kind string) bool {
+	switch v := value.(type) {
+	case string:
+		return kind == "string"
+	case float64:
+		return kind == "number" || (kind == "integer" && v == math.Trunc(v))
+	case bool:
+		return kind == "boolean"
+	case map[string]interface{}:
+		return kind == "object"
+	case []interface{}:
+		return kind == "array"
+	case nil:
+		return kind == "null"
+	}
+	return false
+}
+
+// StartEstimate is the estimated start time of a task.
+type StartEstimate struct {
+	// AverageRunTime is the average run time in seconds of the tasks with
+	// the resource key of the task.
+	// EstimatedStart is the time the task is expected to start.
+	// Id is the id of the task.
+	// Position is the number of queued tasks ahead of the task.
+	AverageRunTime float64   `json:"averageRunTime"`
+	EstimatedStart time.Time `json:"estimatedStart"`
+	Id             string    `json:"id"`
+	Position       int       `json:"position"`
+}
+
+// TaskCount is the number of tasks with a status and, when grouped by key,
+// a resource key.
+type TaskCount struct {
+	// Count is the number of tasks.
+	// Key is the resource key of the tasks.
+	// Status is the status of the tasks.
+	Count  int    `json:"count"`
+	Key    string `json:"key,omitempty"`
+	Status string `json:"status"`
+}
+
+// TaskHistory is a status transition of a task.
+type TaskHistory struct {
+	// Created is the time of the transition.
+	// From is the status of the task before the transition.
+	// Reason describes what caused the transition.
+	// TaskId is the id of the task.
+	// To is the status of the task after the transition.
+	Created time.Time `json:"created"`
+	From    string    `json:"from"`
+	Reason  string    `json:"reason"`
+	TaskId  string    `json:"taskId"`
+	To      string    `json:"to"`
+}
+
+// NewTaskHistory returns an initialized task history instance.
+func NewTaskHistory(taskId string, from string, to string, reason string) *TaskHistory {
+	return &TaskHistory{time.Now(), from, reason, taskId, to}
+}
+
+// TaskAttempt is an execution attempt of a task.
+type TaskAttempt struct {
+	// EndedAt is the time the attempt ended.
+	// Error is the failure reason reported for the attempt.
+	// StartedAt is the time the attempt started.
+	// Status is the status the attempt ended with.
+	// WorkerId is the id of the worker that ran the attempt.
+	EndedAt   *time.Time `json:"endedAt,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	StartedAt time.Time  `json:"startedAt"`
+	Status    string     `json:"status"`
+	WorkerId  string     `json:"workerId,omitempty"`
+}
+
+// TaskGroup tracks the status of the member tasks of a group.
+type TaskGroup struct {
+	// Completed is the time all member tasks reached a final status.
+	// Created is the group creation timestamp.
+	// Id is the group id.
+	// Members maps the member task ids to their status.
+	Completed *time.Time        `json:"completed,omitempty"`
+	Created   time.Time         `json:"created"`
+	Id        string            `json:"_key" mapstructure:"_key"`
+	Members   map[string]string `json:"members"`
+}
+
+// NewTaskGroup returns an initialized task group instance.
+func NewTaskGroup(id string) *TaskGroup {
+	return &TaskGroup{Created: time.Now(), Id: id, Members: make(map[string]string)}
+}
+
+// GroupStatus summarizes the member task statuses of a task group.
+type GroupStatus struct {
+	// Complete indicates if all member tasks reached a final status.
+	// Counts is the number of member tasks per status.
+	// GroupId is the id of the group.
+	// Total is the number of member tasks.
+	Complete bool           `json:"complete"`
+	Counts   map[string]int `json:"counts"`
+	GroupId  string         `json:"groupId"`
+	Total    int            `json:"total"`
+}
+
+// TaskLog is an output snippet reported by the worker of a task.
+type TaskLog struct {
+	// Created is the time the snippet was appended.
+	// Data is the output snippet.
+	// Stream is the output stream of the snippet, stdout or stderr.
+	// TaskId is the id of the task.
+	Created time.Time `json:"created"`
+	Data    string    `json:"data"`
+	Stream  string    `json:"stream"`
+	TaskId  string    `json:"taskId"`
+}
+
+// NewTaskLog returns an initialized task log instance.
+func NewTaskLog(taskId string, stream string, data string) *TaskLog {
+	return &TaskLog{time.Now(), data, stream, taskId}
+}
+
+// TaskPage is a page of tasks from a task listing.
+type TaskPage struct {
+	// Cursor is the cursor token of the next page, empty on the last page.
+	// Limit is the maximum number of tasks in the page.
+	// Offset is the number of tasks skipped before the page.
+	// Tasks are the tasks in the page.
+	// Total is the number of tasks matched regardless of the page.
+	Cursor string  `json:"cursor,omitempty"`
+	Limit  int     `json:"limit"`
+	Offset int     `json:"offset"`
+	Tasks  []*Task `json:"tasks"`
+	Total  int64   `json:"total"`
+}
+
 // Task is a unit of work that is queued in the priority queue.
 type Task struct {
+	// AttemptHistory are the execution attempts of the task in the order
+	// they started.
+	// Attempts is the number of times the task has been retried.
+	// Backoff is the delay in seconds before the first automatic retry.
+	// The delay doubles with every attempt.
+	// CallbackUrl is the url the final task document is posted to once
+	// the task reaches a final status.
+	// Children are the child tasks spawned by the task. They are only
+	// loaded when the task is fetched by id.
+	// Constraints are the tags a resource must have for the task to be
+	// staged on it.
 	// Created is the task creation timestamp.
+	// DependsOn are the ids of the tasks that must complete before the
+	// task is submitted.
+	// ExpiresAt is the time after which the task is cancelled if it is
+	// still queued or scheduled.
+	// GroupId is the id of the task group the task is a member of.
 	// Id is the unique version 1 uuid assigned for task identification.
 	// Key is the resource key for the task.
+	// LabelIndex are the labels as key=value pairs for indexed label
+	// queries.
+	// Labels are user defined key value pairs used to filter tasks.
+	// LeaseExpires is the time the started task is reclaimed unless the
+	// worker renews the lease with a heartbeat.
+	// MaxAttempts is the number of times the task is run before it fails
+	// permanently. Failed tasks are not retried automatically when unset.
 	// Meta is user defined data that can be added to the task.
+	// ParentId is the id of the task that spawned the task.
+	// PausedFrom is the status of the paused task before it was paused.
+	// Pool is the resource pool the task was queued in. The key of a pool
+	// task is the pool member it was last staged on.
 	// Priority is the queue priority order.
+	// Result is the user defined output of the completed task.
 	// RunAt is a static point in time execution time.
+	// StagedAt is the time the task was last staged on the resource of
+	// its key.
 	// Status is the execution status of the task.
-	Created  time.Time       `json:"created"`
-	Id       string          `json:"_key" mapstructure:"_key"`
-	Key      string          `json:"key"`
-	Meta     json.RawMessage `json:"meta,omitempty"`
-	Priority float64         `json:"priority"`
-	RunAt    *time.Time      `json:"runAt,omitempty"`
-	Status   string          `json:"status"`
+	// StolenFrom is the pool member whose priority queue the task was
+	// stolen from by an idle member of the pool. The key of a stolen task
+	// is the member it was last staged on.
+	// Updated is the time the task was last saved.
+	// UpdatedBy is the caller the task was last saved by.
+	AttemptHistory []*TaskAttempt    `json:"attemptHistory,omitempty"`
+	Attempts       int               `json:"attempts"`
+	Backoff        float64           `json:"backoff,omitempty"`
+	CallbackUrl    string            `json:"callbackUrl,omitempty"`
+	Children       []*Task           `json:"children,omitempty"`
+	Constraints    map[string]string `json:"constraints,omitempty"`
+	Created        time.Time         `json:"created"`
+	DependsOn      []string          `json:"dependsOn,omitempty"`
+	ExpiresAt      *time.Time        `json:"expiresAt,omitempty"`
+	GroupId        string            `json:"groupId,omitempty"`
+	Id             string            `json:"_key" mapstructure:"_key"`
+	Key            string            `json:"key"`
+	LabelIndex     []string          `json:"labelIndex,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	LeaseExpires   *time.Time        `json:"leaseExpires,omitempty"`
+	MaxAttempts    int               `json:"maxAttempts,omitempty"`
+	Meta           json.RawMessage   `json:"meta,omitempty"`
+	ParentId       string            `json:"parentId,omitempty"`
+	PausedFrom     string            `json:"pausedFrom,omitempty"`
+	Pool           string            `json:"pool,omitempty"`
+	Priority       float64           `json:"priority"`
+	Result         json.RawMessage   `json:"result,omitempty"`
+	RunAt          *time.Time        `json:"runAt,omitempty"`
+	StagedAt       *time.Time        `json:"stagedAt,omitempty"`
+	Status         string            `json:"status"`
+	StolenFrom     string            `json:"stolenFrom,omitempty"`
+	Updated        time.Time         `json:"updated"`
+	UpdatedBy      string            `json:"updatedBy,omitempty"`
+}
+
+// ArchivedTask is a removed task kept for auditing.
+type ArchivedTask struct {
+	// RemovedAt is the time the task was removed.
+	// RemovedReason describes why the task was removed.
+	*Task
+	RemovedAt     time.Time `json:"removedAt"`
+	RemovedReason string    `json:"removedReason,omitempty"`
+}
+
+// NewArchivedTask returns an initialized archived task instance.
+func NewArchivedTask(task *Task, reason string) *ArchivedTask {
+	return &ArchivedTask{task, time.Now(), reason}
 }
 
 // NewTask returns an initialized task instance.
@@ -62,25 +399,108 @@ func NewTask(data []byte) *Task {
 	id, _ := uuid.NewV1()
 	task := &Task{Created: time.Now(), Status: StatusPending, Id: id.String()}
 	json.Unmarshal(data, task)
+	task.LabelIndex = LabelPairs(task.Labels)
 	return task
 }
 
-// ChangeStatus changes the status of the task and saves the task.
+// LabelPairs returns the labels as key=value pairs in sorted order.
+func LabelPairs(labels map[string]string) []string {
+	if len(labels) == 0 {
+		return nil
+	}
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+// QueueKey returns the priority queue and timetable key of the task. Pool
+// tasks are queued with the pool name and stolen tasks with the name of
+// the member they were stolen from.
+func (task *Task) QueueKey() string {
+	if task.Pool != "" {
+		return task.Pool
+	}
+	if task.StolenFrom != "" {
+		return task.StolenFrom
+	}
+	return task.Key
+}
+
+// BeginAttempt records the start of an execution attempt by the worker.
+func (task *Task) BeginAttempt(workerId string) {
+	attempt := &TaskAttempt{StartedAt: time.Now(), Status: StatusStarted, WorkerId: workerId}
+	task.AttemptHistory = append(task.AttemptHistory, attempt)
+}
+
+// snapshot returns a copy of the task that shares no attempt with it, so
+// that the task can be reset to the copy if its change cannot be saved.
+func (task *Task) snapshot() *Task {
+	saved := *task
+	saved.AttemptHistory = make([]*TaskAttempt, len(task.AttemptHistory))
+	for i, attempt := range task.AttemptHistory {
+		a := *attempt
+		saved.AttemptHistory[i] = &a
+	}
+	return &saved
+}
+
+// EndAttempt records the end of the current execution attempt with the
+// status and failure reason. Nothing is recorded if no attempt is running.
+func (task *Task) EndAttempt(status string, reason string) {
+	if len(task.AttemptHistory) == 0 {
+		return
+	}
+	attempt := task.AttemptHistory[len(task.AttemptHistory)-1]
+	if attempt.EndedAt != nil {
+		return
+	}
+	endedAt := time.Now()
+	attempt.EndedAt = &endedAt
+	attempt.Error = reason
+	attempt.Status = status
+}
+
+// ChangeStatus changes the status of the task and saves the task. A
+// TransitionError is returned if the task may not change to the status.
 func (task *Task) ChangeStatus(taskModel Model, status string) error {
-	task.Status = status
+	if err := task.SetStatus(status); err != nil {
+		return err
+	}
 	_, err := task.Save(taskModel)
 	return err
 }
 
+// SetStatus changes the status of the task without saving it, for changes
+// that are saved together with other updates of the task. A TransitionError
+// is returned if the task may not change to the status.
+func (task *Task) SetStatus(status string) error {
+	if err := CheckTransition(task.Status, status); err != nil {
+		return err
+	}
+	task.Status = status
+	return nil
+}
+
+// ForceStatus changes the status of the task to complete or cancelled
+// without saving it, regardless of the transitions of its current status.
+// A TransitionError is returned for any other status and for tasks that
+// are already complete.
+func (task *Task) ForceStatus(status string) error {
+	if task.Status == StatusComplete || (status != StatusComplete && status != StatusCancelled) {
+		return &TransitionError{task.Status, status}
+	}
+	task.Status = status
+	return nil
+}
+
 // GetAverageRunTime returns the average of, up to, the 10 most recent
 // task execution times.
 func (task *Task) GetAverageRunTime(taskStatModel Model) (float64, error) {
 	var sum float64 = 0.0
-	q := fmt.Sprintf(
-		"FOR t IN %s FILTER t.key == @key SORT t.created DESC LIMIT 10 RETURN t",
-		CollectionTaskStats,
-	)
-	taskStats, err := taskStatModel.Query(q, map[string]interface{}{"key": task.Key})
+	taskStats, err := queryRecentTaskStats(task.Key, taskStatModel)
 	if err != nil {
 		return float64(-1), err
 	}
@@ -95,6 +515,30 @@ func (task *Task) GetAverageRunTime(taskStatModel Model) (float64, error) {
 	return float64(int64(avg*20+0.5)) / 20, nil
 }
 
+// IsFinal returns true if the task will not change status on its own. A
+// failed task that is retried automatically is not final.
+func (task *Task) IsFinal() bool {
+	switch task.Status {
+	case StatusComplete, StatusCancelled:
+		return true
+	case StatusError:
+		_, retry := task.NextRetry()
+		return !retry
+	}
+	return false
+}
+
+// NextRetry returns the time of the next automatic retry of the failed
+// task. false is returned if the task has no retry policy or if all
+// attempts are exhausted.
+func (task *Task) NextRetry() (time.Time, bool) {
+	if task.MaxAttempts < 1 || task.Attempts+1 >= task.MaxAttempts {
+		return time.Time{}, false
+	}
+	delay := task.Backoff * math.Pow(2, float64(task.Attempts))
+	return time.Now().Add(time.Duration(delay * float64(time.Second))), true
+}
+
 // Save writes the task to the database.
 func (task *Task) Save(taskModel Model) (DocumentMeta, error) {
 	return taskModel.Save(task)
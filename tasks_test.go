@@ -43,6 +43,19 @@ func TestTaskStatSave(t *testing.T) {
 	}
 }
 
+func TestNewTaskHistory(t *testing.T) {
+	entry := NewTaskHistory("abc123", StatusCreated, StatusQueued, "task submitted")
+	if !entry.Created.Before(time.Now()) {
+		t.Fatal("expected task history created timestamp to be before now")
+	}
+	if entry.TaskId != "abc123" || entry.From != StatusCreated || entry.To != StatusQueued {
+		t.Fatal("expected task history to be abc123 created -> queued")
+	}
+	if entry.Reason != "task submitted" {
+		t.Fatal("expected task history reason to be 'task submitted'")
+	}
+}
+
 func TestNewTask(t *testing.T) {
 	runAt := time.Now()
 	var table = []struct {
@@ -86,6 +99,39 @@ func TestNewTask(t *testing.T) {
 	}
 }
 
+func TestMetaSchemaValidate(t *testing.T) {
+	schema, err := NewMetaSchema([]byte(`{"required": ["image"], "properties": {"image": {"type": "string"}, "cpus": {"type": "integer"}, "env": {"type": "object"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var table = []struct {
+		Meta string
+		Err  string
+	}{
+		{`{"image": "alpine"}`, ""},
+		{`{"image": "alpine", "cpus": 2, "env": {}, "other": [1]}`, ""},
+		{`{}`, "meta 'image' is required"},
+		{`null`, "meta 'image' is required"},
+		{`{"image": 1}`, "meta 'image' must be of type string"},
+		{`{"image": "alpine", "cpus": 1.5}`, "meta 'cpus' must be of type integer"},
+	}
+
+	for i, tt := range table {
+		var meta map[string]interface{}
+		json.Unmarshal([]byte(tt.Meta), &meta)
+		err := schema.Validate(meta)
+		if (err == nil && tt.Err != "") || (err != nil && err.Error() != tt.Err) {
+			t.Fatalf("[%d] expected error '%s', got '%v'", i, tt.Err, err)
+		}
+	}
+	if err := (*MetaSchema)(nil).Validate(nil); err != nil {
+		t.Fatal("expected any meta to be valid without a schema")
+	}
+	if _, err := NewMetaSchema([]byte(`{"properties": {"image": {"type": "text"}}}`)); err == nil {
+		t.Fatal("expected an unknown type to be rejected")
+	}
+}
+
 func TestTaskSave(t *testing.T) {
 	testErr := errors.New("test error")
 	var table = []struct {
@@ -110,23 +156,52 @@ func TestTaskChangeStatus(t *testing.T) {
 	var table = []struct {
 		Status   string
 		ModelErr error
+		Err      error
+		Expected string
 	}{
-		{StatusQueued, nil},
-		{StatusComplete, nil},
-		{StatusPending, taskErr},
+		{StatusQueued, nil, nil, StatusQueued},
+		{StatusComplete, nil, &TransitionError{StatusQueued, StatusComplete}, StatusQueued},
+		{StatusPending, taskErr, taskErr, StatusPending},
 	}
 
 	task := NewTask([]byte(""))
 	for _, tt := range table {
 		model := new(MockModel)
-		model.On("Save", task).Return(DocumentMeta{}, tt.ModelErr).Once()
-		if err := task.ChangeStatus(model, tt.Status); err != tt.ModelErr {
+		model.On("Save", task).Return(DocumentMeta{}, tt.ModelErr).Maybe()
+		if err := task.ChangeStatus(model, tt.Status); fmt.Sprint(err) != fmt.Sprint(tt.Err) {
 			t.Fatal(err)
 		}
-		if task.Status != tt.Status {
-			t.Fatalf("expected task status to be %s, got %s", tt.Status, task.Status)
+		if task.Status != tt.Expected {
+			t.Fatalf("expected task status to be %s, got %s", tt.Expected, task.Status)
+		}
+		if tt.Err == nil {
+			model.AssertExpectations(t)
+		}
+	}
+}
+
+func TestTaskForceStatus(t *testing.T) {
+	var table = []struct {
+		From  string
+		To    string
+		Valid bool
+	}{
+		{StatusQueued, StatusComplete, true},
+		{StatusStarted, StatusCancelled, true},
+		{StatusCancelled, StatusComplete, true},
+		{StatusQueued, StatusError, false},
+		{StatusComplete, StatusCancelled, false},
+	}
+
+	for i, tt := range table {
+		task := &Task{Status: tt.From}
+		err := task.ForceStatus(tt.To)
+		if (err == nil) != tt.Valid {
+			t.Fatalf("[%d] expected valid %t, got %v", i, tt.Valid, err)
+		}
+		if expected := map[bool]string{true: tt.To, false: tt.From}[tt.Valid]; task.Status != expected {
+			t.Fatalf("[%d] expected task status %s, got %s", i, expected, task.Status)
 		}
-		model.AssertExpectations(t)
 	}
 }
 
@@ -196,3 +271,137 @@ func TestTaskGetAverageRunTime(t *testing.T) {
 		model.AssertExpectations(t)
 	}
 }
+
+func TestTaskNextRetry(t *testing.T) {
+	var table = []struct {
+		Task  *Task
+		Delay time.Duration
+		Ok    bool
+	}{
+		{&Task{}, 0, false},
+		{&Task{MaxAttempts: 3, Backoff: 10}, time.Second * 10, true},
+		{&Task{MaxAttempts: 3, Backoff: 10, Attempts: 1}, time.Second * 20, true},
+		{&Task{MaxAttempts: 3, Backoff: 10, Attempts: 2}, 0, false},
+		{&Task{MaxAttempts: 1, Backoff: 10}, 0, false},
+	}
+
+	for i, tt := range table {
+		before := time.Now()
+		runAt, ok := tt.Task.NextRetry()
+		if ok != tt.Ok {
+			t.Fatalf("[%d] expected ok to be %v", i, tt.Ok)
+		}
+		if ok && (runAt.Before(before.Add(tt.Delay)) || runAt.After(time.Now().Add(tt.Delay))) {
+			t.Fatalf("[%d] expected retry in %s, got %s", i, tt.Delay, runAt.Sub(before))
+		}
+	}
+}
+
+func TestLabelPairs(t *testing.T) {
+	var table = []struct {
+		Labels map[string]string
+		Pairs  []string
+	}{
+		{nil, nil},
+		{map[string]string{"team": "data", "env": "prod"}, []string{"env=prod", "team=data"}},
+	}
+
+	for _, tt := range table {
+		pairs := LabelPairs(tt.Labels)
+		if len(pairs) != len(tt.Pairs) {
+			t.Fatalf("expected %d pairs, got %d", len(tt.Pairs), len(pairs))
+		}
+		for i := range pairs {
+			if pairs[i] != tt.Pairs[i] {
+				t.Fatalf("expected pair %s, got %s", tt.Pairs[i], pairs[i])
+			}
+		}
+	}
+}
+
+func TestTaskIsFinal(t *testing.T) {
+	var table = []struct {
+		Task  *Task
+		Final bool
+	}{
+		{&Task{Status: StatusComplete}, true},
+		{&Task{Status: StatusCancelled}, true},
+		{&Task{Status: StatusError}, true},
+		{&Task{Status: StatusError, MaxAttempts: 3, Attempts: 1}, false},
+		{&Task{Status: StatusError, MaxAttempts: 3, Attempts: 2}, true},
+		{&Task{Status: StatusQueued}, false},
+	}
+
+	for i, tt := range table {
+		if tt.Task.IsFinal() != tt.Final {
+			t.Fatalf("[%d] expected final to be %v", i, tt.Final)
+		}
+	}
+}
+
+func TestTaskAttempts(t *testing.T) {
+	task := &Task{}
+	task.EndAttempt(StatusError, "not started")
+	if len(task.AttemptHistory) != 0 {
+		t.Fatal("expected no attempts to be recorded")
+	}
+	task.BeginAttempt("worker-1")
+	task.EndAttempt(StatusError, "exit status 1")
+	task.EndAttempt(StatusComplete, "")
+	task.BeginAttempt("worker-2")
+	if len(task.AttemptHistory) != 2 {
+		t.Fatalf("expected 2 attempts, got %d", len(task.AttemptHistory))
+	}
+	first, second := task.AttemptHistory[0], task.AttemptHistory[1]
+	if first.EndedAt == nil || first.Status != StatusError || first.Error != "exit status 1" || first.WorkerId != "worker-1" {
+		t.Fatalf("unexpected first attempt %+v", first)
+	}
+	if second.EndedAt != nil || second.Status != StatusStarted || second.WorkerId != "worker-2" {
+		t.Fatalf("unexpected second attempt %+v", second)
+	}
+}
+
+func TestCheckTransition(t *testing.T) {
+	var table = []struct {
+		From  string
+		To    string
+		Valid bool
+	}{
+		{StatusCreated, StatusQueued, true},
+		{StatusQueued, StatusPending, true},
+		{StatusPending, StatusStarted, true},
+		{StatusStarted, StatusComplete, true},
+		{StatusError, StatusQueued, true},
+		{StatusQueued, StatusStarted, false},
+		{StatusComplete, StatusQueued, false},
+		{StatusQueued, "done", false},
+		{"unknown", StatusQueued, false},
+	}
+
+	for _, tt := range table {
+		err := CheckTransition(tt.From, tt.To)
+		if (err == nil) != tt.Valid {
+			t.Fatalf("expected transition from %s to %s valid to be %v, got %v", tt.From, tt.To, tt.Valid, err)
+		}
+		if err != nil && err.Error() != fmt.Sprintf("invalid task status transition from '%s' to '%s'", tt.From, tt.To) {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+}
+
+func TestTaskQueueKey(t *testing.T) {
+	var table = []struct {
+		Task *Task
+		Key  string
+	}{
+		{&Task{Key: "test"}, "test"},
+		{&Task{Key: "gpu1", Pool: "gpu"}, "gpu"},
+		{&Task{Key: "gpu1", StolenFrom: "gpu2"}, "gpu2"},
+	}
+
+	for _, tt := range table {
+		if key := tt.Task.QueueKey(); key != tt.Key {
+			t.Fatalf("expected queue key '%s', got '%s'", tt.Key, key)
+		}
+	}
+}
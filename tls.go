@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var InvalidCAError = errors.New("no certificates in CA file")
+
+// ServiceTLS is the tls configuration of the calls to a downstream service.
+type ServiceTLS struct {
+	// CAFile is the pem file of the CA certificates the service certificate
+	// is verified with instead of the system roots.
+	// CertFile and KeyFile are the pem files of the client certificate
+	// presented to the service.
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// envServiceTLS returns the tls configuration of the service from the
+// <prefix>_CA, <prefix>_CERT and <prefix>_KEY environment variables.
+func envServiceTLS(prefix string) ServiceTLS {
+	return ServiceTLS{os.Getenv(prefix + "_CA"), os.Getenv(prefix + "_CERT"), os.Getenv(prefix + "_KEY")}
+}
+
+// Empty indicates whether no files are configured.
+func (s ServiceTLS) Empty() bool {
+	return s.CAFile == "" && s.CertFile == "" && s.KeyFile == ""
+}
+
+// Config loads the files into a tls client configuration.
+//
+// an error is encountered if a file cannot be read or parsed.
+func (s ServiceTLS) Config() (*tls.Config, error) {
+	config := &tls.Config{}
+	if s.CAFile != "" {
+		data, err := ioutil.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, InvalidCAError
+		}
+	}
+	if s.CertFile != "" || s.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// ConfigureServiceTLS configures the broker to call the endpoints of the
+// priority queue, timetable and status change notifier services over https
+// when they have the https scheme or tls files are configured for the
+// service. The https scheme is added to the endpoints of a service with tls
+// files.
+func ConfigureServiceTLS(broker *JsonRPCServiceBroker) error {
+	for _, service := range brokerServices() {
+		files := envServiceTLS(service.prefix)
+		endpoints := serviceEndpoints(*service.host)
+		var config *tls.Config
+		for i, endpoint := range endpoints {
+			if files.Empty() && !strings.HasPrefix(endpoint, "https://") {
+				continue
+			}
+			if config == nil {
+				var err error
+				if config, err = files.Config(); err != nil {
+					return fmt.Errorf("%s tls: %v", strings.ToLower(service.prefix), err)
+				}
+			}
+			if !strings.Contains(endpoint, "://") {
+				endpoints[i] = "https://" + endpoint
+			}
+			broker.UseTLS(endpoints[i], config)
+			log.Printf("using tls for service [%s]\n", endpoints[i])
+		}
+		*service.host = strings.Join(endpoints, ",")
+	}
+	return nil
+}
+
+// brokerService is a downstream service with the prefix of its
+// environment variables and the name of its grpc service.
+type brokerService struct {
+	host   *string
+	prefix string
+	grpc   string
+}
+
+// brokerServices returns the downstream services called by the broker.
+func brokerServices() []brokerService {
+	return []brokerService{
+		{&PriorityQueueHost, "CONCORD_PRIORITY_QUEUE", GRPCPriorityQueueService},
+		{&TimetableHost, "CONCORD_TIMETABLE", GRPCTimetableService},
+		{&StatusChangeNotifierHost, "CONCORD_STATUS_CHANGE_NOTIFIER", GRPCStatusChangeNotifierService},
+	}
+}
+
+// UseTLS makes the broker call the service at the host with the tls
+// configuration. It must be called before the broker is used.
+func (t *JsonRPCServiceBroker) UseTLS(host string, config *tls.Config) {
+	var transport *http.Transport
+	if t.client != nil {
+		if base, ok := t.client.Transport.(*http.Transport); ok {
+			transport = base.Clone()
+		}
+	}
+	if transport == nil {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	transport.TLSClientConfig = config
+	if t.clients == nil {
+		t.clients = make(map[string]*http.Client)
+	}
+	t.clients[host] = &http.Client{Transport: transport}
+}
+
+// tlsConfig returns the tls configuration of the service at the host. Nil
+// is returned if the service is not called over tls.
+func (t *JsonRPCServiceBroker) tlsConfig(host string) *tls.Config {
+	if client, ok := t.clients[host]; ok {
+		if transport, ok := client.Transport.(*http.Transport); ok {
+			return transport.TLSClientConfig
+		}
+	}
+	return nil
+}
+
+// serviceURL returns the json-rpc endpoint of the service at the host. The
+// http scheme is used if the host has none.
+func serviceURL(host string) string {
+	if strings.Contains(host, "://") {
+		return host + "/rpc"
+	}
+	return fmt.Sprintf("http://%s/rpc", host)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeClientCert writes a self-signed client certificate and its key to
+// pem files in the directory.
+func writeClientCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "concord-controller"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestServiceTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "concord-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeClientCert(t, dir)
+	invalidCA := filepath.Join(dir, "invalid.pem")
+	ioutil.WriteFile(invalidCA, []byte("not a certificate"), 0600)
+
+	var table = []struct {
+		Files ServiceTLS
+		Certs int
+		Err   bool
+	}{
+		{ServiceTLS{}, 0, false},
+		{ServiceTLS{CAFile: certFile}, 0, false},
+		{ServiceTLS{CertFile: certFile, KeyFile: keyFile}, 1, false},
+		{ServiceTLS{CAFile: invalidCA}, 0, true},
+		{ServiceTLS{CAFile: filepath.Join(dir, "missing.pem")}, 0, true},
+		{ServiceTLS{CertFile: certFile}, 0, true},
+	}
+
+	for i, tt := range table {
+		config, err := tt.Files.Config()
+		if (err != nil) != tt.Err {
+			t.Fatalf("[%d] unexpected error %v", i, err)
+		}
+		if err != nil {
+			continue
+		}
+		if len(config.Certificates) != tt.Certs {
+			t.Fatalf("[%d] expected %d client certificates, got %d", i, tt.Certs, len(config.Certificates))
+		}
+		if (tt.Files.CAFile != "") != (config.RootCAs != nil) {
+			t.Fatalf("[%d] expected the CA file to set the root CAs", i)
+		}
+	}
+}
+
+func TestServiceBrokerCallTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "concord-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeClientCert(t, dir)
+
+	var clientCerts int
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientCerts = len(r.TLS.PeerCertificates)
+		w.Write([]byte(`{"jsonrpc": "2.0", "result": 0, "id": 0}`))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+
+	broker := NewJsonRPCServiceBroker()
+	if _, errObj := broker.Call(context.Background(), srv.URL, "notify", map[string]interface{}{}); errObj == nil {
+		t.Fatal("expected the call without tls configuration to fail")
+	}
+	config, err := ServiceTLS{caFile, certFile, keyFile}.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.UseTLS(srv.URL, config)
+	result, errObj := broker.Call(context.Background(), srv.URL, "notify", map[string]interface{}{})
+	if errObj != nil {
+		t.Fatal(errObj)
+	}
+	if result != float64(0) || clientCerts != 1 {
+		t.Fatalf("expected the call to present the client certificate, got %v with %d certificates", result, clientCerts)
+	}
+}
+
+func TestConfigureServiceTLS(t *testing.T) {
+	defer func(queue, timetable, notifier string) {
+		PriorityQueueHost, TimetableHost, StatusChangeNotifierHost = queue, timetable, notifier
+	}(PriorityQueueHost, TimetableHost, StatusChangeNotifierHost)
+	PriorityQueueHost, TimetableHost, StatusChangeNotifierHost = "https://queue:8443", "timetable-1:8443, timetable-2:8443", "notifier:8080"
+	defer os.Unsetenv("CONCORD_TIMETABLE_CA")
+	os.Setenv("CONCORD_TIMETABLE_CA", "missing.pem")
+
+	broker := NewJsonRPCServiceBroker()
+	if err := ConfigureServiceTLS(broker); err == nil {
+		t.Fatal("expected the missing CA file to fail the configuration")
+	}
+	dir, err := ioutil.TempDir("", "concord-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, _ := writeClientCert(t, dir)
+	os.Setenv("CONCORD_TIMETABLE_CA", certFile)
+	if err := ConfigureServiceTLS(broker); err != nil {
+		t.Fatal(err)
+	}
+	if TimetableHost != "https://timetable-1:8443,https://timetable-2:8443" || StatusChangeNotifierHost != "notifier:8080" {
+		t.Fatalf("expected only the timetable endpoints to get the https scheme, got %s %s", TimetableHost, StatusChangeNotifierHost)
+	}
+	for _, host := range []string{"https://queue:8443", "https://timetable-1:8443", "https://timetable-2:8443"} {
+		if _, ok := broker.clients[host]; !ok {
+			t.Fatalf("expected a tls client for %s", host)
+		}
+	}
+	if len(broker.clients) != 3 {
+		t.Fatalf("expected 3 tls clients, got %d", len(broker.clients))
+	}
+}
+
+func TestServiceURL(t *testing.T) {
+	if url := serviceURL("queue:8080"); url != "http://queue:8080/rpc" {
+		t.Fatalf("expected the http scheme, got %s", url)
+	}
+	if url := serviceURL("https://queue:8443"); url != "https://queue:8443/rpc" {
+		t.Fatalf("expected the https scheme, got %s", url)
+	}
+}